@@ -0,0 +1,238 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic Accounting:
+//
+// The forwarded packets and bytes are accounted for each client public key, across all the sessions of it,
+// and reported as the Accounts in the Stats. Unlike the PeerStats, they are never reset by the session expiry.
+//
+// With the AccountingFile, the accounts are also written to the file every AccountingInterval and on shutdown,
+// as a JSON object of the client public key => AccountingRecord. It is read at startup, so that the counters
+// keep growing across restarts. The file is replaced atomically, a reader never sees a partial one.
+
+const (
+	defaultAccountingInterval = time.Minute
+	kAccountingIntervalMax    = 24 * time.Hour
+)
+
+// AccountingRecord is the traffic of a client public key in the AccountingFile.
+// The rx is from the client and the tx is to the client.
+type AccountingRecord struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxPackets uint64 `json:"tx_packets"`
+
+	// LastHandshakeForwardedAt is the time the last MessageInitiation of the client is forwarded, null if never.
+	LastHandshakeForwardedAt *time.Time `json:"last_handshake_forwarded_at"`
+}
+
+// AccountStats is the traffic of a client public key, see AccountingRecord.
+type AccountStats struct {
+	ClientPublicKey string
+
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+
+	// LastHandshakeForwarded is the zero time if never.
+	LastHandshakeForwarded time.Time
+}
+
+// peerAccount is the counters of a client public key, shared by its sessions,
+// all the counters must be accessed atomically.
+type peerAccount struct {
+	rxBytes   uint64
+	txBytes   uint64
+	rxPackets uint64
+	txPackets uint64
+
+	// unix nano, 0 if never
+	lastHandshakeForwarded int64
+
+	// cookieGenerator is initialized with the cookieServerPublicKey, guarded by the accountsLock,
+	// see cookieGeneratorOf.
+	cookieGenerator       *device.CookieGenerator
+	cookieServerPublicKey NoisePublicKey
+}
+
+func (a *peerAccount) add(s2c bool, length int) {
+	if s2c {
+		atomic.AddUint64(&a.txPackets, 1)
+		atomic.AddUint64(&a.txBytes, uint64(length))
+	} else {
+		atomic.AddUint64(&a.rxPackets, 1)
+		atomic.AddUint64(&a.rxBytes, uint64(length))
+	}
+}
+
+// accountOf returns the account of the client public key, created if there is none.
+func (t *WireGuardIndexTranslationTable) accountOf(key NoisePublicKey) (a *peerAccount) {
+	t.accountsLock.Lock()
+	defer t.accountsLock.Unlock()
+	a = t.accounts[key]
+	if a == nil {
+		a = &peerAccount{}
+		t.accounts[key] = a
+	}
+	return
+}
+
+// accountStats returns the accounts sorted by the client public key.
+func (t *WireGuardIndexTranslationTable) accountStats() (stats []AccountStats) {
+	t.accountsLock.Lock()
+	stats = make([]AccountStats, 0, len(t.accounts))
+	for key, a := range t.accounts {
+		as := AccountStats{
+			ClientPublicKey: key.Base64(),
+			RxBytes:         atomic.LoadUint64(&a.rxBytes),
+			TxBytes:         atomic.LoadUint64(&a.txBytes),
+			RxPackets:       atomic.LoadUint64(&a.rxPackets),
+			TxPackets:       atomic.LoadUint64(&a.txPackets),
+		}
+		if ns := atomic.LoadInt64(&a.lastHandshakeForwarded); ns != 0 {
+			as.LastHandshakeForwarded = time.Unix(0, ns)
+		}
+		stats = append(stats, as)
+	}
+	t.accountsLock.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ClientPublicKey < stats[j].ClientPublicKey
+	})
+	return
+}
+
+// loadAccounting adds the records in the AccountingFile to the accounts, a missing file is not an error.
+func (t *WireGuardIndexTranslationTable) loadAccounting() (err error) {
+	if t.AccountingFile == "" {
+		return
+	}
+	bs, err := os.ReadFile(t.AccountingFile)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to read accounting file %s: %w", t.AccountingFile, err)
+		return
+	}
+	var records map[string]AccountingRecord
+	err = json.Unmarshal(bs, &records)
+	if err != nil {
+		err = fmt.Errorf("invalid accounting file %s: %w", t.AccountingFile, err)
+		return
+	}
+	for s, r := range records {
+		var key NoisePublicKey
+		err = key.FromBase64(s)
+		if err != nil {
+			err = fmt.Errorf("invalid accounting file %s: %q: %w", t.AccountingFile, s, err)
+			return
+		}
+		a := t.accountOf(key)
+		atomic.AddUint64(&a.rxBytes, r.RxBytes)
+		atomic.AddUint64(&a.txBytes, r.TxBytes)
+		atomic.AddUint64(&a.rxPackets, r.RxPackets)
+		atomic.AddUint64(&a.txPackets, r.TxPackets)
+		if r.LastHandshakeForwardedAt != nil {
+			atomic.StoreInt64(&a.lastHandshakeForwarded, r.LastHandshakeForwardedAt.UnixNano())
+		}
+	}
+	return
+}
+
+// saveAccounting replaces the AccountingFile with the accounts.
+func (t *WireGuardIndexTranslationTable) saveAccounting() (err error) {
+	if t.AccountingFile == "" {
+		return
+	}
+	records := make(map[string]AccountingRecord)
+	for _, as := range t.accountStats() {
+		r := AccountingRecord{
+			RxBytes:   as.RxBytes,
+			TxBytes:   as.TxBytes,
+			RxPackets: as.RxPackets,
+			TxPackets: as.TxPackets,
+		}
+		if !as.LastHandshakeForwarded.IsZero() {
+			at := as.LastHandshakeForwarded.UTC()
+			r.LastHandshakeForwardedAt = &at
+		}
+		records[as.ClientPublicKey] = r
+	}
+	bs, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomically(t.AccountingFile, bs)
+	if err != nil {
+		err = fmt.Errorf("failed to write accounting file %s: %w", t.AccountingFile, err)
+		return
+	}
+	return
+}
+
+// accountingLoop writes the AccountingFile every AccountingInterval until the table is closed,
+// the last one is written by Serve() after all the packets are handled.
+func (t *WireGuardIndexTranslationTable) accountingLoop() {
+	defer t.loopWaitGroup.Done()
+	interval := t.AccountingInterval
+	if interval <= 0 {
+		interval = defaultAccountingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.saveAccounting(); err != nil {
+				t.Logger.Errorf("%s", err.Error())
+			}
+		case <-t.closeChan:
+			return
+		}
+	}
+}
+
+// writeFileAtomically writes the data to a temporary file in the same directory, and renames it to the path.
+func writeFileAtomically(path string, data []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	_, err = f.Write(data)
+	if err != nil {
+		return
+	}
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	err = f.Chmod(0644)
+	if err != nil {
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), path)
+	return
+}
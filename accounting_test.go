@@ -0,0 +1,114 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readAccountingFile(t *testing.T, path string) (records map[string]AccountingRecord) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(bs, &records); err != nil {
+		t.Fatalf("invalid accounting file: %s", err)
+	}
+	return
+}
+
+func TestAccounting(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "accounting.json")
+	handshakeAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous, _ := json.Marshal(map[string]AccountingRecord{
+		clientPK.Base64(): {RxBytes: 1000, TxBytes: 2000, RxPackets: 10, TxPackets: 20, LastHandshakeForwardedAt: &handshakeAt},
+		otherPK.Base64():  {RxBytes: 1},
+	})
+	if err := os.WriteFile(path, previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.Logger = NewStdLogger(LogLevelError)
+	table.AccountingFile = path
+	table.AccountingInterval = 10 * time.Millisecond
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}}
+		return
+	}
+	served := make(chan error, 1)
+	go func() { served <- table.Serve() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(table.Stats().Accounts) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the accounting file is not loaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a new session counts into the previous account of the same client
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	peer, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.countForwardedPacket(peer, false, 148)
+	table.countForwardedPacket(peer, true, 92)
+	for readAccountingFile(t, path)[clientPK.Base64()].RxBytes != 1148 {
+		if time.Now().After(deadline) {
+			t.Fatal("the accounting file is not written periodically")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	table.countForwardedPacket(peer, false, 100)
+	if err = table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	records := readAccountingFile(t, path)
+	r := records[clientPK.Base64()]
+	if r.RxBytes != 1248 || r.TxBytes != 2092 || r.RxPackets != 12 || r.TxPackets != 21 ||
+		r.LastHandshakeForwardedAt == nil || !r.LastHandshakeForwardedAt.Equal(handshakeAt) {
+		t.Errorf("unexpected account after shutdown: %+v", r)
+	}
+	if records[otherPK.Base64()].RxBytes != 1 {
+		t.Errorf("expected the account of the inactive client kept, got %+v", records)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected no temporary file left, got %d files", len(entries))
+	}
+
+	stats := table.Stats()
+	if len(stats.Accounts) != 2 || stats.Accounts[0].ClientPublicKey > stats.Accounts[1].ClientPublicKey {
+		t.Errorf("expected the accounts sorted, got %+v", stats.Accounts)
+	}
+}
+
+func TestAccounting_Malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting.json")
+	if err := os.WriteFile(path, []byte(`{"not a key": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.Logger = NewStdLogger(LogLevelError)
+	table.AccountingFile = path
+	if err := table.Serve(); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected ErrConfig for a malformed accounting file, got %v", err)
+	}
+	if bs, _ := os.ReadFile(path); string(bs) != `{"not a key": {}}` {
+		t.Errorf("expected the malformed accounting file not overwritten")
+	}
+}
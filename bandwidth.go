@@ -0,0 +1,184 @@
+package mwgp
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"sync/atomic"
+	"time"
+)
+
+// Bandwidth Limit:
+//
+// The "rate_limit" of a server peer caps the throughput of its sessions in each direction,
+// and the "rate_limit" of the server config caps all the sessions together. A MessageTransport exceeding
+// a limit is dropped instead of queued, as an overloaded link does, and the TCP inside the tunnel backs off.
+// The handshake messages are never limited, so that a saturated peer can still rekey.
+//
+// The limit of a peer is shared by all the sessions of it, and by all the clients matched by the fallback peer.
+// It is kept across Reload() if unchanged, otherwise the new one applies to the new sessions,
+// which WireGuard creates every 2 minutes. The sessions restored from the cache are not limited until then.
+//
+// Each limit is a token bucket of bytes, implemented as GCRA on a single atomic integer,
+// so that the forward path neither allocates nor takes a lock.
+
+const (
+	// kBandwidthBurstMin is the min burst, which must hold a WireGuard packet of the common MTU.
+	kBandwidthBurstMin = 2048
+
+	// defaultBandwidthBurstMin is the min default burst, 1/10 of the rate is used if larger.
+	defaultBandwidthBurstMin = 16 << 10
+)
+
+// BandwidthLimitConfig is the "rate_limit" of a server peer or the server config.
+type BandwidthLimitConfig struct {
+	// Rate is the bytes per second in each direction, like "1MiB" or "125KB" (1 Mbps).
+	Rate ByteSize `json:"rate"`
+
+	// Burst is the max bytes passed at once, default to 1/10 of the Rate, but at least 16KiB.
+	Burst ByteSize `json:"burst,omitempty"`
+}
+
+func (c *BandwidthLimitConfig) validate(option string) (err error) {
+	if c.Rate <= 0 {
+		err = fmt.Errorf("%s.rate must be positive", option)
+		return
+	}
+	if c.Burst != 0 && c.Burst < kBandwidthBurstMin {
+		err = fmt.Errorf("%s.burst must be at least %d bytes, got %d", option, kBandwidthBurstMin, c.Burst)
+		return
+	}
+	return
+}
+
+// burst returns the Burst, or the default one.
+func (c *BandwidthLimitConfig) burst() int {
+	if c.Burst > 0 {
+		return int(c.Burst)
+	}
+	if int(c.Rate)/10 > defaultBandwidthBurstMin {
+		return int(c.Rate) / 10
+	}
+	return defaultBandwidthBurstMin
+}
+
+// bandwidthBucket is a token bucket of bytes as GCRA (generic cell rate algorithm).
+type bandwidthBucket struct {
+	// tat is the theoretical arrival time in unix nano, when the bucket is full again, accessed atomically.
+	tat int64
+
+	nsPerByte float64
+
+	// tolerance is the time to refill the burst.
+	tolerance int64
+}
+
+// allow consumes the tokens of the length at the now in unix nano, false if there are not enough tokens.
+func (b *bandwidthBucket) allow(now int64, length int) bool {
+	cost := int64(float64(length) * b.nsPerByte)
+	for {
+		tat := atomic.LoadInt64(&b.tat)
+		start := tat
+		if start < now {
+			start = now
+		}
+		next := start + cost
+		if next-now > b.tolerance {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, tat, next) {
+			return true
+		}
+	}
+}
+
+// bandwidthLimiter is a rate_limit, a bucket for each direction.
+type bandwidthLimiter struct {
+	c2s bandwidthBucket
+	s2c bandwidthBucket
+
+	config BandwidthLimitConfig
+}
+
+// newBandwidthLimiter returns the limiter of the config, nil if the config is nil.
+func newBandwidthLimiter(config *BandwidthLimitConfig) (l *bandwidthLimiter) {
+	if config == nil {
+		return
+	}
+	nsPerByte := float64(time.Second) / float64(config.Rate)
+	bucket := bandwidthBucket{
+		nsPerByte: nsPerByte,
+		tolerance: int64(float64(config.burst()) * nsPerByte),
+	}
+	l = &bandwidthLimiter{
+		c2s:    bucket,
+		s2c:    bucket,
+		config: *config,
+	}
+	return
+}
+
+// allow reports whether the packet of the length in the direction is within the limit, true if the l is nil.
+func (l *bandwidthLimiter) allow(s2c bool, now int64, length int) bool {
+	if l == nil {
+		return true
+	}
+	if s2c {
+		return l.s2c.allow(now, length)
+	}
+	return l.c2s.allow(now, length)
+}
+
+// allowBandwidth checks the MessageTransport of the peer with the rate_limit of the peer and the global one,
+// the packet is counted as BandwidthLimitedPackets of the peer and the table if it is to be dropped.
+func (t *WireGuardIndexTranslationTable) allowBandwidth(peer *Peer, s2c bool, packet *Packet, now time.Time) bool {
+	if packet.MessageType() != device.MessageTransportType || (peer.bandwidth == nil && t.bandwidthLimit == nil) {
+		return true
+	}
+	ns := now.UnixNano()
+	if peer.bandwidth.allow(s2c, ns, packet.Length) && t.bandwidthLimit.allow(s2c, ns, packet.Length) {
+		return true
+	}
+	atomic.AddUint64(&t.stats.bandwidthLimited, 1)
+	if s2c {
+		atomic.AddUint64(&peer.stats.s2cBandwidthLimited, 1)
+	} else {
+		atomic.AddUint64(&peer.stats.c2sBandwidthLimited, 1)
+	}
+	return false
+}
+
+// inheritBandwidthLimiters keeps the limiters of the peers with the same rate_limit across Reload(),
+// so that a reload does not refill the buckets.
+func inheritBandwidthLimiters(servers []*ServerConfigServer, oldServers []*ServerConfigServer) {
+	type limiterKey struct {
+		server NoisePublicKey
+		peer   NoisePublicKey
+		config BandwidthLimitConfig
+	}
+	keyOf := func(cs *ServerConfigServer, p *ServerConfigPeer) (key limiterKey) {
+		key.server = cs.publicKey
+		if !p.isFallback() {
+			key.peer = *p.ClientPublicKey
+		}
+		key.config = p.bandwidth.config
+		return
+	}
+	oldLimiters := make(map[limiterKey]*bandwidthLimiter)
+	for _, cs := range oldServers {
+		for _, p := range cs.Peers {
+			if p.bandwidth != nil {
+				oldLimiters[keyOf(cs, p)] = p.bandwidth
+			}
+		}
+	}
+	for _, cs := range servers {
+		for _, p := range cs.Peers {
+			if p.bandwidth == nil {
+				continue
+			}
+			if l, ok := oldLimiters[keyOf(cs, p)]; ok {
+				p.bandwidth = l
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimitConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		config  BandwidthLimitConfig
+		burst   int
+		invalid bool
+	}{
+		{config: BandwidthLimitConfig{Rate: 125000}, burst: defaultBandwidthBurstMin},
+		{config: BandwidthLimitConfig{Rate: 100 << 20}, burst: 10 << 20},
+		{config: BandwidthLimitConfig{Rate: 125000, Burst: 4096}, burst: 4096},
+		{config: BandwidthLimitConfig{}, invalid: true},
+		{config: BandwidthLimitConfig{Rate: 125000, Burst: 1024}, invalid: true},
+	} {
+		err := c.config.validate("rate_limit")
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%+v: expected an error", c.config)
+			}
+			continue
+		}
+		if err != nil || c.config.burst() != c.burst {
+			t.Errorf("%+v: expected the burst %d, got %d (%v)", c.config, c.burst, c.config.burst(), err)
+		}
+	}
+}
+
+func newBandwidthTestPacket(messageType uint32, length int) *Packet {
+	packet := &Packet{Data: make([]byte, length), Length: length}
+	binary.LittleEndian.PutUint32(packet.Data, messageType)
+	return packet
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	sk, _ := e2eGenerateKey(t)
+	_, limitedPK := e2eGenerateKey(t)
+	_, unlimitedPK := e2eGenerateKey(t)
+	serverConfig := func(rate ByteSize) *ServerConfig {
+		return &ServerConfig{
+			Listen: ListenAddresses{"127.0.0.1:0"},
+			Servers: []*ServerConfigServer{{
+				PrivateKey: &sk,
+				Peers: []*ServerConfigPeer{
+					{
+						ForwardTo:       "127.0.0.1:51820",
+						ClientPublicKey: &limitedPK,
+						RateLimit:       &BandwidthLimitConfig{Rate: rate, Burst: 8 << 10},
+					},
+					{ForwardTo: "127.0.0.1:51821", ClientPublicKey: &unlimitedPK},
+				},
+			}},
+		}
+	}
+	// 1 Mbps
+	server, err := NewServerWithConfig(serverConfig(125000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := server.wgitTable
+	limited := &Peer{clientPublicKey: limitedPK, clientProxyIndex: 1, bandwidth: server.servers[0].Peers[0].bandwidth}
+	unlimited := &Peer{clientPublicKey: unlimitedPK, clientProxyIndex: 2, bandwidth: server.servers[0].Peers[1].bandwidth}
+	table.clientMap.storeLocked(limited.clientProxyIndex, limited)
+	table.clientMap.storeLocked(unlimited.clientProxyIndex, unlimited)
+	if limited.bandwidth == nil || unlimited.bandwidth != nil {
+		t.Fatalf("expected only the peer with rate_limit limited")
+	}
+
+	// both of them send 10 Mbps in both directions for a second
+	packet := newBandwidthTestPacket(device.MessageTransportType, 1250)
+	start := time.Now()
+	var limitedBytes, unlimitedBytes [2]int
+	for i := 0; i < 1000; i++ {
+		now := start.Add(time.Duration(i) * time.Millisecond)
+		for d, s2c := range []bool{false, true} {
+			if table.allowBandwidth(limited, s2c, packet, now) {
+				limitedBytes[d] += packet.Length
+			}
+			if table.allowBandwidth(unlimited, s2c, packet, now) {
+				unlimitedBytes[d] += packet.Length
+			}
+		}
+	}
+	for d := range limitedBytes {
+		if limitedBytes[d] < 112500 || limitedBytes[d] > 137500 {
+			t.Errorf("expected about 125000 bytes passed in direction %d of the limited peer, got %d", d, limitedBytes[d])
+		}
+		if unlimitedBytes[d] != 1250000 {
+			t.Errorf("expected all the 1250000 bytes passed in direction %d of the unlimited peer, got %d", d, unlimitedBytes[d])
+		}
+	}
+
+	// the handshakes are never limited
+	if !table.allowBandwidth(limited, false, newBandwidthTestPacket(device.MessageInitiationType, device.MessageInitiationSize), start.Add(time.Second)) {
+		t.Errorf("expected the handshake not limited")
+	}
+
+	stats := table.Stats()
+	dropped := uint64(2000 - (limitedBytes[0]+limitedBytes[1])/packet.Length)
+	if stats.BandwidthLimitedPackets != dropped {
+		t.Errorf("expected %d packets dropped, got %d", dropped, stats.BandwidthLimitedPackets)
+	}
+	for _, ps := range stats.Peers {
+		total := ps.ClientToServerBandwidthLimited + ps.ServerToClientBandwidthLimited
+		if ps.ClientPublicKey == limitedPK.Base64() && total != dropped || ps.ClientPublicKey == unlimitedPK.Base64() && total != 0 {
+			t.Errorf("unexpected dropped packets of peer %s: %+v", ps.ClientPublicKey, ps)
+		}
+	}
+
+	now := start.Add(2 * time.Second)
+	if allocs := testing.AllocsPerRun(100, func() {
+		table.allowBandwidth(limited, false, packet, now)
+	}); allocs != 0 {
+		t.Errorf("expected no allocation in allowBandwidth, got %f", allocs)
+	}
+
+	// the limiter is kept across the reload if unchanged
+	if err = server.Reload(serverConfig(125000)); err != nil {
+		t.Fatal(err)
+	}
+	if server.servers[0].Peers[0].bandwidth != limited.bandwidth {
+		t.Errorf("expected the limiter inherited")
+	}
+	if err = server.Reload(serverConfig(250000)); err != nil {
+		t.Fatal(err)
+	}
+	if server.servers[0].Peers[0].bandwidth == limited.bandwidth {
+		t.Errorf("expected a new limiter for the changed rate_limit")
+	}
+}
+
+func TestBandwidthBucket_Concurrent(t *testing.T) {
+	l := newBandwidthLimiter(&BandwidthLimitConfig{Rate: 125000, Burst: 64000})
+	now := time.Now().UnixNano()
+	var passed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if l.allow(false, now, 1000) {
+					atomic.AddInt64(&passed, 1000)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if passed != 64000 {
+		t.Errorf("expected the burst of 64 packets passed, got %d bytes", passed)
+	}
+}
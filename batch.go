@@ -0,0 +1,18 @@
+package mwgp
+
+const (
+	// kMaxBatchSize is the max number of packets read or written in a single syscall.
+	kMaxBatchSize = 64
+)
+
+// normalizeBatchSize clamps the batch size into [1, kMaxBatchSize],
+// and returns 1 if the batch I/O is not supported on this platform.
+func normalizeBatchSize(size int) int {
+	if !batchSupported || size < 1 {
+		return 1
+	}
+	if size > kMaxBatchSize {
+		return kMaxBatchSize
+	}
+	return size
+}
@@ -0,0 +1,262 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+const batchSupported = true
+
+// mmsghdr is the struct mmsghdr for recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	Hdr unix.Msghdr
+	Len uint32
+}
+
+type udpBatchBuffer struct {
+	hdrs  [kMaxBatchSize]mmsghdr
+	iovs  [kMaxBatchSize]unix.Iovec
+	names [kMaxBatchSize]unix.RawSockaddrInet6
+	oobs  [kMaxBatchSize][kTOSControlSize]byte
+}
+
+var udpBatchBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &udpBatchBuffer{}
+	},
+}
+
+// prepare points the i-th message to the Data of packets[i], and returns the messages.
+func (b *udpBatchBuffer) prepare(packets []*Packet, dataLen func(packet *Packet) int) []mmsghdr {
+	for i, packet := range packets {
+		b.iovs[i].Base = &packet.Data[0]
+		b.iovs[i].SetLen(dataLen(packet))
+		b.hdrs[i] = mmsghdr{}
+		b.hdrs[i].Hdr.Iov = &b.iovs[i]
+		b.hdrs[i].Hdr.SetIovlen(1)
+		b.hdrs[i].Hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.hdrs[i].Hdr.Namelen = unix.SizeofSockaddrInet6
+	}
+	return b.hdrs[:len(packets)]
+}
+
+// release drops the references to the packets so that the buffer can be pooled.
+func (b *udpBatchBuffer) release(count int) {
+	for i := 0; i < count; i++ {
+		b.iovs[i] = unix.Iovec{}
+		b.hdrs[i] = mmsghdr{}
+	}
+}
+
+func sockaddrToAddrPort(rsa *unix.RawSockaddrInet6) (addr netip.AddrPort) {
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&rsa.Port))[:])
+	switch rsa.Family {
+	case unix.AF_INET:
+		rsa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		addr = netip.AddrPortFrom(netip.AddrFrom4(rsa4.Addr), port)
+	case unix.AF_INET6:
+		ip := netip.AddrFrom16(rsa.Addr)
+		if rsa.Scope_id != 0 {
+			zone := strconv.FormatUint(uint64(rsa.Scope_id), 10)
+			if ifi, err := net.InterfaceByIndex(int(rsa.Scope_id)); err == nil {
+				zone = ifi.Name
+			}
+			ip = ip.WithZone(zone)
+		}
+		addr = netip.AddrPortFrom(ip, port)
+	}
+	return
+}
+
+// udpAddrToSockaddr fills rsa with addr, in the address family of the socket.
+func udpAddrToSockaddr(addr *net.UDPAddr, inet6 bool, rsa *unix.RawSockaddrInet6) (length uint32, err error) {
+	if addr == nil {
+		err = fmt.Errorf("no destination address")
+		return
+	}
+	*rsa = unix.RawSockaddrInet6{}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&rsa.Port))[:], uint16(addr.Port))
+	if ip4 := addr.IP.To4(); ip4 != nil && !inet6 {
+		rsa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		rsa4.Family = unix.AF_INET
+		copy(rsa4.Addr[:], ip4)
+		length = unix.SizeofSockaddrInet4
+		return
+	}
+	ip6 := addr.IP.To16()
+	if ip6 == nil || !inet6 {
+		err = fmt.Errorf("address %s is not supported by the socket", addr.String())
+		return
+	}
+	rsa.Family = unix.AF_INET6
+	copy(rsa.Addr[:], ip6)
+	if addr.Zone != "" {
+		if ifi, ierr := net.InterfaceByName(addr.Zone); ierr == nil {
+			rsa.Scope_id = uint32(ifi.Index)
+		} else if id, perr := strconv.ParseUint(addr.Zone, 10, 32); perr == nil {
+			rsa.Scope_id = uint32(id)
+		}
+	}
+	length = unix.SizeofSockaddrInet6
+	return
+}
+
+func isInet6Conn(conn *net.UDPConn) bool {
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && laddr.IP.To4() == nil
+}
+
+// readBatchFromUDP reads up to len(packets) packets with a single recvmmsg(2),
+// n is the number of packets received.
+func readBatchFromUDP(u *UDPTransport, packets []*Packet) (n int, err error) {
+	if u.offload.groEnabled() {
+		return readBatchFromUDPWithGRO(u, packets)
+	}
+	conn := u.conn
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	b := udpBatchBufferPool.Get().(*udpBatchBuffer)
+	defer udpBatchBufferPool.Put(b)
+	defer b.release(len(packets))
+	hdrs := b.prepare(packets, func(packet *Packet) int {
+		return cap(packet.Data)
+	})
+	if u.preserveTOS {
+		for i := range hdrs {
+			hdrs[i].Hdr.Control = &b.oobs[i][0]
+			hdrs[i].Hdr.SetControllen(kTOSControlSize)
+		}
+	}
+
+	var serr error
+	err = rc.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+		if e == unix.EAGAIN || e == unix.EINTR {
+			return false
+		}
+		if e != 0 {
+			serr = e
+		} else {
+			n = int(r)
+		}
+		return true
+	})
+	if err == nil && serr != nil {
+		err = &net.OpError{Op: "read", Net: "udp", Source: conn.LocalAddr(), Err: os.NewSyscallError("recvmmsg", serr)}
+	}
+	if err != nil {
+		n = 0
+		return
+	}
+	for i := 0; i < n; i++ {
+		packets[i].Length = int(hdrs[i].Len)
+		packets[i].setSourceAddrPort(sockaddrToAddrPort(&b.names[i]))
+		if u.preserveTOS {
+			packets[i].tos, packets[i].hasTOS = parseTOSControl(b.oobs[i][:hdrs[i].Hdr.Controllen])
+		}
+	}
+	return
+}
+
+// writeBatchToUDP writes the packets with sendmmsg(2).
+//
+// A packet failed to be sent is skipped, failed is the number of such packets
+// and err is the last error.
+func writeBatchToUDP(u *UDPTransport, packets []*Packet) (failed int, err error) {
+	if u.offload.gsoEnabled() {
+		return writeBatchToUDPWithGSO(u, packets)
+	}
+	conn := u.conn
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		failed = len(packets)
+		return
+	}
+	b := udpBatchBufferPool.Get().(*udpBatchBuffer)
+	defer udpBatchBufferPool.Put(b)
+	defer b.release(len(packets))
+	hdrs := b.prepare(packets, func(packet *Packet) int {
+		return packet.Length
+	})
+
+	inet6 := isInet6Conn(conn)
+	connected := u.connected
+	var remoteIPv4 bool
+	if connected && u.preserveTOS {
+		remoteIPv4 = conn.RemoteAddr().(*net.UDPAddr).IP.To4() != nil
+	}
+	var valid []mmsghdr
+	var validPackets []*Packet
+	for i, packet := range packets {
+		if connected {
+			// the upstreamConn is connected to the packet.Destination
+			hdrs[i].Hdr.Name = nil
+			hdrs[i].Hdr.Namelen = 0
+		} else {
+			namelen, aerr := udpAddrToSockaddr(packet.Destination, inet6, &b.names[i])
+			if aerr != nil {
+				packet.writeFailed = true
+				failed++
+				err = &net.OpError{Op: "write", Net: "udp", Source: conn.LocalAddr(), Addr: packet.Destination, Err: aerr}
+				continue
+			}
+			hdrs[i].Hdr.Namelen = namelen
+		}
+		if u.preserveTOS && packet.hasTOS {
+			ipv4 := remoteIPv4
+			if !connected {
+				ipv4 = packet.Destination.IP.To4() != nil
+			}
+			oob := putTOSControl(b.oobs[i][:], packet.tos, ipv4)
+			hdrs[i].Hdr.Control = &oob[0]
+			hdrs[i].Hdr.SetControllen(len(oob))
+		}
+		// compact the messages in place, since we always move to a lower index
+		hdrs[len(valid)] = hdrs[i]
+		valid = hdrs[:len(valid)+1]
+		validPackets = append(validPackets, packet)
+	}
+
+	sent := 0
+	for sent < len(valid) {
+		var serr error
+		werr := rc.Write(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&valid[sent])), uintptr(len(valid)-sent), 0, 0, 0)
+			if e == unix.EAGAIN || e == unix.EINTR {
+				return false
+			}
+			if e != 0 {
+				serr = e
+			} else {
+				sent += int(r)
+			}
+			return true
+		})
+		if werr != nil {
+			// the socket is not usable anymore
+			for _, packet := range validPackets[sent:] {
+				packet.writeFailed = true
+			}
+			failed += len(valid) - sent
+			err = werr
+			return
+		}
+		if serr != nil {
+			// sendmmsg(2) reports the error of the first message not sent
+			validPackets[sent].writeFailed = true
+			failed++
+			err = &net.OpError{Op: "write", Net: "udp", Source: conn.LocalAddr(), Addr: validPackets[sent].Destination, Err: os.NewSyscallError("sendmmsg", serr)}
+			sent++
+		}
+	}
+	return
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package mwgp
+
+const batchSupported = false
+
+// readBatchFromUDP reads only one packet at a time on this platform.
+func readBatchFromUDP(u *UDPTransport, packets []*Packet) (n int, err error) {
+	err = defaultReadFunc(u, packets[0])
+	if err != nil {
+		return
+	}
+	n = 1
+	return
+}
+
+// writeBatchToUDP writes the packets one by one on this platform.
+func writeBatchToUDP(u *UDPTransport, packets []*Packet) (failed int, err error) {
+	for _, packet := range packets {
+		werr := defaultWriteFunc(u, packet)
+		if werr != nil {
+			packet.writeFailed = true
+			failed++
+			err = werr
+		}
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package mwgp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newBatchTestPackets(count int) (packets []*Packet) {
+	for i := 0; i < count; i++ {
+		packets = append(packets, &Packet{Data: make([]byte, 2048)})
+	}
+	return
+}
+
+func testBatchRoundTrip(t *testing.T, network string, listen string, dest string) {
+	sender, err := net.ListenUDP(network, nil)
+	if err != nil {
+		t.Skipf("%s is not available: %s", network, err.Error())
+	}
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listen)})
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", listen, err.Error())
+	}
+	defer receiver.Close()
+	destAddr := &net.UDPAddr{IP: net.ParseIP(dest), Port: receiver.LocalAddr().(*net.UDPAddr).Port}
+
+	const count = 8
+	packets := newBatchTestPackets(count)
+	for i, packet := range packets {
+		packet.Length = 100 + i
+		packet.Data[0] = byte(i)
+		packet.Destination = destAddr
+	}
+	failed, err := defaultWriteBatchFunc(NewUDPTransport(sender), packets)
+	if err != nil || failed != 0 {
+		t.Fatalf("failed to write %d packets: %v", failed, err)
+	}
+
+	_ = receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := newBatchTestPackets(count)
+	for total := 0; total < count; {
+		n, err := defaultReadBatchFunc(NewUDPTransport(receiver), received[total:])
+		if err != nil {
+			t.Fatalf("failed to read packets: %s", err.Error())
+		}
+		total += n
+	}
+	for i, packet := range received {
+		if packet.Length != packets[i].Length || !bytes.Equal(packet.Slice(), packets[i].Slice()) {
+			t.Errorf("packet #%d mismatched: %x != %x", i, packet.Slice(), packets[i].Slice())
+		}
+		if packet.Source == nil || packet.Source.Port != sender.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("packet #%d has unexpected source %v", i, packet.Source)
+		}
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	t.Run("ipv4", func(t *testing.T) {
+		testBatchRoundTrip(t, "udp4", "127.0.0.1", "127.0.0.1")
+	})
+	t.Run("ipv4-on-dual-stack", func(t *testing.T) {
+		testBatchRoundTrip(t, "udp", "127.0.0.1", "127.0.0.1")
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		testBatchRoundTrip(t, "udp6", "::1", "::1")
+	})
+}
+
+// benchmarkUDPLoopback sends bursts of kMaxBatchSize packets from a socket to another on loopback,
+// with GSO on the sender and GRO on the receiver if offload.
+func benchmarkUDPLoopback(b *testing.B, batch bool, offload bool) {
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiver.Close()
+	_ = receiver.SetReadBuffer(4 << 20)
+	senderTransport, receiverTransport := NewUDPTransport(sender), NewUDPTransport(receiver)
+	if offload && (!enableUDPOffload(senderTransport, true, false) || !enableUDPOffload(receiverTransport, false, true)) {
+		b.Skip("UDP GSO/GRO is not supported by the kernel")
+	}
+
+	packets := newBatchTestPackets(kMaxBatchSize)
+	for _, packet := range packets {
+		packet.Length = 148
+		packet.Destination = receiver.LocalAddr().(*net.UDPAddr)
+	}
+	received := newBatchTestPackets(kMaxBatchSize)
+
+	b.ResetTimer()
+	start := time.Now()
+	for sent := 0; sent < b.N; sent += kMaxBatchSize {
+		burst := kMaxBatchSize
+		if b.N-sent < burst {
+			burst = b.N - sent
+		}
+		_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+		if batch {
+			_, _ = defaultWriteBatchFunc(senderTransport, packets[:burst])
+			for n := 0; n < burst; {
+				rn, err := defaultReadBatchFunc(receiverTransport, received[:burst-n])
+				if err != nil {
+					b.Fatal(err)
+				}
+				n += rn
+			}
+		} else {
+			for _, packet := range packets[:burst] {
+				_ = defaultWriteFunc(senderTransport, packet)
+			}
+			for _, packet := range received[:burst] {
+				if err := defaultReadFunc(receiverTransport, packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pps")
+}
+
+func BenchmarkUDPLoopback_PerPacket(b *testing.B) {
+	benchmarkUDPLoopback(b, false, false)
+}
+
+func BenchmarkUDPLoopback_Batch(b *testing.B) {
+	if !batchSupported {
+		b.Skip("batch I/O is not supported on this platform")
+	}
+	benchmarkUDPLoopback(b, true, false)
+}
+
+func BenchmarkUDPLoopback_Offload(b *testing.B) {
+	if !udpOffloadSupported {
+		b.Skip("UDP offload is not supported on this platform")
+	}
+	benchmarkUDPLoopback(b, true, true)
+}
+
+func TestWireGuardIndexTranslationTable_WriteBatchCountsWritten(t *testing.T) {
+	for _, mark := range []bool{true, false} {
+		table := NewWireGuardIndexTranslationTable()
+		table.Logger = &testLogger{}
+		transport := &pathMTUTransport{}
+		listener := &clientListener{}
+		table.clientListenerMap = map[PacketTransport]*clientListener{transport: listener}
+
+		packets := newBatchTestPackets(3)
+		for i, packet := range packets {
+			packet.Length = 100 * (i + 1)
+		}
+		table.writeBatch("client", transport, func(transport PacketTransport, packets []*Packet) (failed int, err error) {
+			// the middle one fails, or the tail one is assumed to fail without the writeFailed marked
+			packets[1].writeFailed = mark
+			return 1, net.ErrClosed
+		}, packets)
+
+		expectedBytes := uint64(100 + 300)
+		if !mark {
+			expectedBytes = 100 + 200
+		}
+		if listener.packetsSent != 2 || listener.bytesSent != expectedBytes {
+			t.Errorf("mark=%v: expected 2 packets of %d bytes counted, got %d of %d",
+				mark, expectedBytes, listener.packetsSent, listener.bytesSent)
+		}
+		if stats := table.Stats(); stats.WriteErrors != 1 {
+			t.Errorf("mark=%v: expected 1 write error, got %d", mark, stats.WriteErrors)
+		}
+	}
+}
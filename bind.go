@@ -0,0 +1,68 @@
+package mwgp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+)
+
+// parseBindOptions parses the bind_device and bind_address options into the local address of
+// the forwarding sockets, and checks they are consistent with each other.
+func parseBindOptions(bindDevice, bindAddress string) (laddr *net.UDPAddr, err error) {
+	if bindDevice != "" && !bindDeviceSupported {
+		err = fmt.Errorf("option \"bind_device\" is not supported on %s", runtime.GOOS)
+		return
+	}
+	if bindAddress == "" {
+		return
+	}
+	addr, err := netip.ParseAddr(bindAddress)
+	if err != nil {
+		err = fmt.Errorf("invalid bind_address %s: %w", bindAddress, err)
+		return
+	}
+	laddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), 0))
+	if bindDevice == "" || addr.IsUnspecified() {
+		return
+	}
+
+	ifi, err := net.InterfaceByName(bindDevice)
+	if err != nil {
+		err = fmt.Errorf("invalid bind_device %s: %w", bindDevice, err)
+		return
+	}
+	ifaddrs, err := ifi.Addrs()
+	if err != nil {
+		err = fmt.Errorf("failed to get the addresses of bind_device %s: %w", bindDevice, err)
+		return
+	}
+	for _, ifaddr := range ifaddrs {
+		if ipnet, ok := ifaddr.(*net.IPNet); ok && ipnet.IP.Equal(laddr.IP) {
+			return
+		}
+	}
+	err = fmt.Errorf("bind_address %s is not an address of bind_device %s", bindAddress, bindDevice)
+	return
+}
+
+// bindDeviceControl returns the control function binding the forwarding sockets to the BindDevice.
+func (t *WireGuardIndexTranslationTable) bindDeviceControl() socketControlFunc {
+	if t.BindDevice == "" {
+		return nil
+	}
+	device := t.BindDevice
+	return func(network, address string, c syscall.RawConn) (err error) {
+		cerr := c.Control(func(fd uintptr) {
+			err = bindSocketToDevice(fd, device)
+		})
+		if cerr != nil {
+			err = cerr
+		}
+		if err != nil {
+			err = errorf(ErrNetwork, "failed to bind to device %s: %w", device, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,11 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const bindDeviceSupported = true
+
+func bindSocketToDevice(fd uintptr, device string) (err error) {
+	return unix.BindToDevice(int(fd), device)
+}
@@ -0,0 +1,57 @@
+package mwgp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBindOptions(t *testing.T) {
+	for _, c := range []struct {
+		device  string
+		address string
+		valid   bool
+	}{
+		{"", "", true},
+		{"", "127.0.0.1", true},
+		{"", "::1", true},
+		{"lo", "", true},
+		{"lo", "127.0.0.1", true},
+		{"lo", "0.0.0.0", true},
+		{"lo", "192.0.2.1", false},
+		{"mwgp-nonexist0", "127.0.0.1", false},
+		{"", "localhost", false},
+	} {
+		_, err := parseBindOptions(c.device, c.address)
+		if (err == nil) != c.valid {
+			t.Errorf("parseBindOptions(%q, %q) = %v, expected valid=%v", c.device, c.address, err, c.valid)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_BindDevice(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	table := NewWireGuardIndexTranslationTable()
+	table.ServerListen, err = parseBindOptions("lo", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.BindDevice = "lo"
+	conn, err := table.dialUDP(server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		// SO_BINDTODEVICE requires CAP_NET_RAW on old kernels
+		t.Skipf("cannot bind to lo: %s", err.Error())
+	}
+	_ = conn.Close()
+
+	table.BindDevice = "mwgp-nonexist0"
+	_, err = table.dialUDP(server.LocalAddr().(*net.UDPAddr))
+	if err == nil || !strings.Contains(err.Error(), "mwgp-nonexist0") {
+		t.Errorf("expected an error with the interface name, got %v", err)
+	}
+}
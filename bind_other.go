@@ -0,0 +1,15 @@
+//go:build !linux
+
+package mwgp
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const bindDeviceSupported = false
+
+func bindSocketToDevice(fd uintptr, device string) (err error) {
+	err = fmt.Errorf("SO_BINDTODEVICE is not supported on %s", runtime.GOOS)
+	return
+}
@@ -0,0 +1,70 @@
+package mwgp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes in config.
+//
+// It can be either a number, or a string with a suffix like "512KiB", "4MiB" and "1MB".
+type ByteSize int
+
+var byteSizeSuffixes = []struct {
+	suffix string
+	scale  int64
+}{
+	// longer suffixes first
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+// ParseByteSize parses a number of bytes with an optional suffix.
+func ParseByteSize(s string) (size ByteSize, err error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	scale := int64(1)
+	for _, bs := range byteSizeSuffixes {
+		if strings.HasSuffix(s, bs.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, bs.suffix))
+			scale = bs.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		err = fmt.Errorf("invalid byte size %q", orig)
+		return
+	}
+	v := n * float64(scale)
+	if v > float64(int(^uint(0)>>1)) {
+		err = fmt.Errorf("byte size %q is too large", orig)
+		return
+	}
+	size = ByteSize(v)
+	return
+}
+
+func (b *ByteSize) UnmarshalJSON(bytes []byte) (err error) {
+	s := strings.TrimSpace(string(bytes))
+	if s == "null" {
+		return
+	}
+	if strings.HasPrefix(s, "\"") {
+		s, err = strconv.Unquote(s)
+		if err != nil {
+			return
+		}
+	}
+	*b, err = ParseByteSize(s)
+	return
+}
@@ -0,0 +1,43 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestByteSize_UnmarshalJSON(t *testing.T) {
+	cases := map[string]ByteSize{
+		`65536`:      65536,
+		`"65536"`:    65536,
+		`"512KiB"`:   512 << 10,
+		`"4MiB"`:     4 << 20,
+		`"4 MiB"`:    4 << 20,
+		`"1.5MiB"`:   3 << 19,
+		`"1MB"`:      1000 * 1000,
+		`"2M"`:       2 << 20,
+		`"1GiB"`:     1 << 30,
+		`"100B"`:     100,
+		`null`:       0,
+		`"0"`:        0,
+		`1048576.0`:  1 << 20,
+		`"  8KiB  "`: 8 << 10,
+	}
+	for input, expected := range cases {
+		var b ByteSize
+		err := json.Unmarshal([]byte(input), &b)
+		if err != nil {
+			t.Errorf("failed to unmarshal %s: %s", input, err.Error())
+			continue
+		}
+		if b != expected {
+			t.Errorf("%s is unmarshalled to %d, expected %d", input, b, expected)
+		}
+	}
+
+	for _, input := range []string{`"4 megabytes"`, `"MiB"`, `"-1KiB"`, `true`, `"4TiB"`} {
+		var b ByteSize
+		if err := json.Unmarshal([]byte(input), &b); err == nil {
+			t.Errorf("invalid byte size %s is accepted as %d", input, b)
+		}
+	}
+}
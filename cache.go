@@ -3,9 +3,10 @@ package mwgp
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
+	"net/netip"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,24 +27,43 @@ type WGITCachePeer struct {
 	ServerDestination         string         `json:"sdst"`
 	ServerSourceValidateLevel int            `json:"ssvl"`
 	ObfuscateEnabled          bool           `json:"obfe"`
+	SessionID                 string         `json:"sid,omitempty"`
+
+	// the unix nano of the last packet, 0 in the cache files of the old versions
+	LastActive int64 `json:"lact,omitempty"`
+
+	// the local port of the socket to the server destination, 0 if it is not a UDP socket
+	UpstreamLocalPort int `json:"ulport,omitempty"`
+
+	// the pinned upstream port range of the peer, 0 if it is not pinned
+	UpstreamPortMin int `json:"upmin,omitempty"`
+	UpstreamPortMax int `json:"upmax,omitempty"`
+
+	// the send_proxy_protocol of the peer
+	SendProxyProtocol bool `json:"sppv2,omitempty"`
 }
 
 func (cp *WGITCachePeer) FromWGITPeer(peer *Peer) (err error) {
 	cp.ClientOriginIndex = peer.clientOriginIndex
 	cp.ClientProxyIndex = peer.clientProxyIndex
 	cp.ClientPublicKey = peer.clientPublicKey
-	cp.ClientDestination = peer.clientDestination.String()
+	cp.ClientDestination = peer.clientAddr().String()
 	cp.ClientSourceValidateLevel = peer.clientSourceValidateLevel
 
 	cp.ServerOriginIndex = peer.serverOriginIndex
 	cp.ServerProxyIndex = peer.serverProxyIndex
 	cp.ServerPublicKey = peer.serverPublicKey
-	if peer.serverDestination != nil {
-		cp.ServerDestination = peer.serverDestination.String()
+	if destination := peer.serverAddr(); destination != nil {
+		cp.ServerDestination = destination.String()
 	}
 	cp.ServerSourceValidateLevel = peer.serverSourceValidateLevel
 
 	cp.ObfuscateEnabled = peer.obfuscateEnabled
+	cp.SessionID = peer.sessionID
+	cp.LastActive = atomic.LoadInt64(&peer.lastActive)
+	cp.UpstreamPortMin = peer.upstreamPortMin
+	cp.UpstreamPortMax = peer.upstreamPortMax
+	cp.SendProxyProtocol = peer.sendProxyProtocol
 
 	return
 }
@@ -77,12 +97,23 @@ func (cp *WGITCachePeer) WGITPeer() (peer *Peer, err error) {
 	}
 	peer.serverSourceValidateLevel = cp.ServerSourceValidateLevel
 
-	peer.clientCookieGenerator.Init(peer.clientPublicKey.NoisePublicKey)
-	peer.serverCookieGenerator.Init(peer.serverPublicKey.NoisePublicKey)
+	// the clientCookieGenerator is shared by the sessions of the client public key, assigned by the table
+	peer.serverCookieGenerator.Init(peer.clientPublicKey.NoisePublicKey)
 
-	peer.lastActive.Store(time.Now())
+	if cp.LastActive != 0 {
+		peer.touch(time.Unix(0, cp.LastActive))
+	} else {
+		peer.touch(time.Now())
+	}
 
 	peer.obfuscateEnabled = cp.ObfuscateEnabled
+	peer.sessionID = cp.SessionID
+	if peer.sessionID == "" {
+		peer.sessionID = newSessionID()
+	}
+	peer.upstreamPortMin = cp.UpstreamPortMin
+	peer.upstreamPortMax = cp.UpstreamPortMax
+	peer.sendProxyProtocol = cp.SendProxyProtocol
 
 	return
 }
@@ -93,6 +124,26 @@ type WGITCacheTable struct {
 
 type WGITCacheJar struct {
 	WGITCacheConfig
+
+	// logger, timeout and upstreamLocalPort are set by the WireGuardIndexTranslationTable
+	logger Logger
+
+	// the peers without packet in the timeout are not loaded
+	timeout time.Duration
+
+	// upstreamLocalPort returns the local port of the socket to the server destination, 0 if there is none
+	upstreamLocalPort func(addr *net.UDPAddr) int
+
+	// upstreamLocalPorts are the local ports of the sockets to the server destinations of the loaded peers,
+	// the sockets are bound to them again if they are still free (see restoreUpstreamConns).
+	upstreamLocalPorts map[netip.AddrPort]int
+}
+
+func (c *WGITCacheJar) loggerOrDefault() Logger {
+	if c.logger == nil {
+		return defaultLogger
+	}
+	return c.logger
 }
 
 func (c *WGITCacheJar) SaveLocked(clientMap map[uint32]*Peer) (err error) {
@@ -106,9 +157,13 @@ func (c *WGITCacheJar) SaveLocked(clientMap map[uint32]*Peer) (err error) {
 		cp := WGITCachePeer{}
 		ferr := cp.FromWGITPeer(peer)
 		if ferr != nil {
-			log.Printf("[error] failed to convert peer to cache peer: %s\n", ferr.Error())
+			c.loggerOrDefault().Errorf("failed to convert peer to cache peer: %s", ferr.Error())
 			continue
 		}
+		// the pinned sockets are always bound to the pinned ports instead
+		if destination := peer.serverAddr(); c.upstreamLocalPort != nil && destination != nil && peer.upstreamPortMin == 0 {
+			cp.UpstreamLocalPort = c.upstreamLocalPort(destination)
+		}
 		ct.ClientMap = append(ct.ClientMap, cp)
 	}
 
@@ -154,16 +209,28 @@ func (c *WGITCacheJar) LoadLocked(serverMap map[uint32]*Peer, clientMap map[uint
 		return
 	}
 
+	c.upstreamLocalPorts = make(map[netip.AddrPort]int)
+	deadline := time.Now().Add(-c.timeout)
 	for _, cp := range ct.ClientMap {
 		peer, ferr := cp.WGITPeer()
 		if ferr != nil {
-			log.Printf("[error] failed to convert cache peer to peer: %s\n", ferr.Error())
+			c.loggerOrDefault().Errorf("failed to convert cache peer to peer: %s", ferr.Error())
+			continue
+		}
+		if c.timeout > 0 && peer.lastActiveTime().Before(deadline) {
+			c.loggerOrDefault().Debugf("cache peer %s (session %s) is expired, skipped", peer.clientAddr().String(), peer.sessionID)
 			continue
 		}
 		clientMap[peer.clientProxyIndex] = peer
 		if peer.serverProxyIndex != 0 {
 			serverMap[peer.serverProxyIndex] = peer
 		}
+		if cp.UpstreamLocalPort != 0 {
+			key := upstreamKey(peer.serverDestination)
+			if _, ok := c.upstreamLocalPorts[key]; !ok {
+				c.upstreamLocalPorts[key] = cp.UpstreamLocalPort
+			}
+		}
 	}
 
 	return
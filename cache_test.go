@@ -0,0 +1,73 @@
+package mwgp
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWGITCacheJar_RestoreUpstream(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	_, serverPK := e2eGenerateKey(t)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	config := WGITCacheConfig{CacheFilePath: filepath.Join(t.TempDir(), "cache.json")}
+
+	saved := NewWireGuardIndexTranslationTable()
+	saved.Logger = NewStdLogger(LogLevelError)
+	saved.CacheJar.WGITCacheConfig = config
+	saved.CacheJar.upstreamLocalPort = saved.upstreamLocalPortOf
+	uc, err := saved.upstreamConnOf(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, lastActive := range []time.Time{now, now.Add(-time.Hour)} {
+		peer := &Peer{
+			clientProxyIndex:  uint32(0x1000 + i),
+			serverProxyIndex:  uint32(0x2000 + i),
+			clientPublicKey:   clientPK,
+			serverPublicKey:   serverPK,
+			clientDestination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000 + i},
+			serverDestination: serverAddr,
+			sessionID:         newSessionID(),
+		}
+		peer.touch(lastActive)
+		saved.clientMap.storeLocked(peer.clientProxyIndex, peer)
+		saved.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	}
+	if err = saved.CacheJar.SaveLocked(saved.serverMap.snapshotLocked()); err != nil {
+		t.Fatal(err)
+	}
+	saved.closeUpstreamConns()
+	saved.loopWaitGroup.Wait()
+
+	restored := NewWireGuardIndexTranslationTable()
+	restored.Logger = NewStdLogger(LogLevelError)
+	restored.CacheJar.WGITCacheConfig = config
+	restored.CacheJar.timeout = time.Minute
+	clientMap, serverMap := make(map[uint32]*Peer), make(map[uint32]*Peer)
+	if err = restored.CacheJar.LoadLocked(serverMap, clientMap); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		restored.closeUpstreamConns()
+		restored.loopWaitGroup.Wait()
+	}()
+	if len(clientMap) != 1 || clientMap[0x1000] == nil {
+		t.Fatalf("expected only the active peer to be loaded, got %d peers", len(clientMap))
+	}
+	if !clientMap[0x1000].lastActiveTime().Equal(now) {
+		t.Errorf("expected the last active time %s, got %s", now, clientMap[0x1000].lastActiveTime())
+	}
+
+	restored.restoreUpstreamConns(restored.CacheJar.upstreamLocalPorts)
+	if port := restored.upstreamLocalPortOf(serverAddr); port != uc.localPort {
+		t.Errorf("expected the socket to the server from port %d, got %d", uc.localPort, port)
+	}
+}
@@ -0,0 +1,378 @@
+package mwgp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packet Capture:
+//
+// With the CaptureFile, the packets on the side facing the other mwgp are written to a pcapng file at each stage:
+// "received-raw" as read from the socket, "after-deobfuscate", "before-obfuscate" and "sent-raw" as written to
+// the socket. Each packet is prefixed with an IPv4 or IPv6 and a UDP header of its real addresses, so the file can be
+// opened by Wireshark and the plain stages are decoded as WireGuard. Each record has a comment of the stage,
+// the direction, the session (the receiver index, or the sender index of a MessageInitiation, only for the plain
+// stages) and the packet flags.
+//
+// It is a debugging facility, which stops after CaptureLimitPackets (default 10000) records, so it can be left
+// configured in the field for a while. The capture holds the traffic of the clients, it must be handled as sensitive.
+
+const (
+	defaultCaptureLimitPackets = 10000
+
+	// kCaptureMaxPayload keeps the synthesized IP packet in the 16-bit total length.
+	kCaptureMaxPayload = 65535 - 40 - 8
+
+	// the stages of the packets, see "Packet Capture"
+	kCaptureReceivedRaw      = "received-raw"
+	kCaptureAfterDeobfuscate = "after-deobfuscate"
+	kCaptureBeforeObfuscate  = "before-obfuscate"
+	kCaptureSentRaw          = "sent-raw"
+
+	// the blocks and options of pcapng, see draft-ietf-opsawg-pcapng
+	kPcapngSectionHeaderBlock  = 0x0A0D0D0A
+	kPcapngInterfaceDescBlock  = 1
+	kPcapngEnhancedPacketBlock = 6
+	kPcapngByteOrderMagic      = 0x1A2B3C4D
+	kPcapngOptionEnd           = 0
+	kPcapngOptionComment       = 1
+	kPcapngLinkTypeRaw         = 101
+)
+
+func validateCaptureLimitPackets(limit int) (err error) {
+	if limit < 0 {
+		err = fmt.Errorf("capture_limit_packets must not be negative, got %d", limit)
+		return
+	}
+	return
+}
+
+// packetCapture writes the packets to the CaptureFile, see "Packet Capture".
+type packetCapture struct {
+	path   string
+	limit  int
+	logger Logger
+
+	// active is 1 between open() and the limit or close(), accessed atomically,
+	// so that the packets are not locked for once the capture stops.
+	active int32
+
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	count  int
+	buffer []byte
+}
+
+// newPacketCapture returns nil without the path.
+func newPacketCapture(path string, limit int) *packetCapture {
+	if path == "" {
+		return nil
+	}
+	if limit <= 0 {
+		limit = defaultCaptureLimitPackets
+	}
+	return &packetCapture{
+		path:  path,
+		limit: limit,
+	}
+}
+
+// open creates the file and starts the capture.
+func (c *packetCapture) open(logger Logger) (err error) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.logger = logger
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		err = fmt.Errorf("failed to open capture file %s: %w", c.path, err)
+		return
+	}
+	c.writer = bufio.NewWriterSize(c.file, 1<<16)
+	c.count = 0
+
+	// section header block and interface description block
+	b := c.buffer[:0]
+	b = appendUint32s(b, kPcapngSectionHeaderBlock, 28, kPcapngByteOrderMagic)
+	b = appendUint32s(b, 1, 0xffffffff, 0xffffffff, 28)
+	b = appendUint32s(b, kPcapngInterfaceDescBlock, 20)
+	b = appendUint32s(b, kPcapngLinkTypeRaw, 0, 20)
+	c.buffer = b
+	_, _ = c.writer.Write(b)
+
+	c.logger.Warnf("capture: writing up to %d packets to %s, the capture contains the traffic of the clients "+
+		"with their addresses, handle it as sensitive and delete it once done", c.limit, c.path)
+	atomic.StoreInt32(&c.active, 1)
+	return
+}
+
+// close stops the capture and flushes the file, it is safe to be called more than once.
+func (c *packetCapture) close() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopLocked()
+}
+
+func (c *packetCapture) stopLocked() {
+	atomic.StoreInt32(&c.active, 0)
+	if c.file == nil {
+		return
+	}
+	err := c.writer.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.writer = nil, nil
+	if err != nil {
+		c.logger.Errorf("capture: failed to write %s: %s", c.path, err.Error())
+		return
+	}
+	c.logger.Infof("capture: stopped with %d packets written to %s", c.count, c.path)
+}
+
+// record writes the packet at the stage, the received is set for the packets read from the transport.
+func (c *packetCapture) record(stage string, s2c, received bool, transport PacketTransport, packet *Packet) {
+	if atomic.LoadInt32(&c.active) == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return
+	}
+
+	local := transportLocalAddr(transport)
+	var remote netip.AddrPort
+	if received {
+		remote = packet.Source.AddrPort()
+	} else if packet.Destination != nil {
+		remote = packet.Destination.AddrPort()
+	} else if ut, ok := transport.(*UDPTransport); ok && ut.Conn() != nil {
+		if raddr, ok := ut.Conn().RemoteAddr().(*net.UDPAddr); ok {
+			remote = raddr.AddrPort()
+		}
+	}
+	src, dst := local, remote
+	if received {
+		src, dst = remote, local
+	}
+	comment := captureComment(stage, s2c, packet)
+
+	payload := packet.Slice()
+	if len(payload) > kCaptureMaxPayload {
+		payload = payload[:kCaptureMaxPayload]
+	}
+	b := c.buffer[:0]
+	b = appendUint32s(b, kPcapngEnhancedPacketBlock, 0, 0)
+	now := uint64(time.Now().UnixMicro())
+	b = appendUint32s(b, uint32(now>>32), uint32(now), 0, 0)
+	headerEnd := len(b)
+	b = appendIPUDPHeader(b, src, dst, len(payload))
+	b = append(b, payload...)
+	captured := len(b) - headerEnd
+	b = appendPadding(b)
+	b = appendUint32s(b, kPcapngOptionComment|uint32(len(comment))<<16)
+	b = append(b, comment...)
+	b = appendPadding(b)
+	b = appendUint32s(b, kPcapngOptionEnd)
+	b = appendUint32s(b, uint32(len(b)+4))
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[20:], uint32(captured))
+	binary.LittleEndian.PutUint32(b[24:], uint32(captured+packet.Length-len(payload)))
+	c.buffer = b
+
+	_, err := c.writer.Write(b)
+	if err != nil {
+		c.stopLocked()
+		return
+	}
+	c.count++
+	if c.count >= c.limit {
+		c.stopLocked()
+	}
+}
+
+// captureComment returns the comment of the record, see "Packet Capture".
+func captureComment(stage string, s2c bool, packet *Packet) string {
+	var sb strings.Builder
+	sb.WriteString("stage=")
+	sb.WriteString(stage)
+	if s2c {
+		sb.WriteString(" direction=server_to_client")
+	} else {
+		sb.WriteString(" direction=client_to_server")
+	}
+	if stage == kCaptureAfterDeobfuscate || stage == kCaptureBeforeObfuscate {
+		index, err := packet.ReceiverIndex()
+		if err != nil {
+			index, err = packet.SenderIndex()
+		}
+		if err == nil {
+			_, _ = fmt.Fprintf(&sb, " session=0x%08x", index)
+		}
+	}
+	var flags []string
+	for _, f := range []struct {
+		flag uint64
+		name string
+	}{
+		{PacketFlagDeobfuscatedAfterReceived, "deobfuscated"},
+		{PacketFlagObfuscateBeforeSend, "obfuscate"},
+		{PacketFlagDropped, "dropped"},
+		{PacketFlagUnrecognized, "unrecognized"},
+		{PacketFlagInvalid, "invalid"},
+	} {
+		if packet.Flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) > 0 {
+		sb.WriteString(" flags=")
+		sb.WriteString(strings.Join(flags, ","))
+	}
+	return sb.String()
+}
+
+// appendUint32s appends the little-endian values, the 16-bit fields of pcapng are always in pairs
+// and appended as a uint32 of the second one << 16 | the first one.
+func appendUint32s(b []byte, values ...uint32) []byte {
+	for _, v := range values {
+		b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+	return b
+}
+
+func appendBigEndianUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendPadding pads the b to 32 bits, since each block and option of pcapng starts at a 32-bit boundary.
+func appendPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// appendIPUDPHeader appends the IPv4 (if both addresses are IPv4) or IPv6 header and the UDP header
+// of a datagram, an unknown address is the unspecified one. The UDP checksum is left 0.
+func appendIPUDPHeader(b []byte, src, dst netip.AddrPort, length int) []byte {
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	udpLength := 8 + length
+	if (srcAddr.Is4() || !srcAddr.IsValid()) && (dstAddr.Is4() || !dstAddr.IsValid()) {
+		if !srcAddr.IsValid() {
+			srcAddr = netip.IPv4Unspecified()
+		}
+		if !dstAddr.IsValid() {
+			dstAddr = netip.IPv4Unspecified()
+		}
+		start := len(b)
+		b = append(b, 0x45, 0)
+		b = appendBigEndianUint16(b, uint16(20+udpLength))
+		b = append(b, 0, 0, 0, 0, 64, 17, 0, 0)
+		src4, dst4 := srcAddr.As4(), dstAddr.As4()
+		b = append(b, src4[:]...)
+		b = append(b, dst4[:]...)
+		var sum uint32
+		for i := start; i < start+20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		binary.BigEndian.PutUint16(b[start+10:], ^uint16(sum))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = appendBigEndianUint16(b, uint16(udpLength))
+		b = append(b, 17, 64)
+		src16, dst16 := srcAddr.As16(), dstAddr.As16()
+		b = append(b, src16[:]...)
+		b = append(b, dst16[:]...)
+	}
+	b = appendBigEndianUint16(b, src.Port())
+	b = appendBigEndianUint16(b, dst.Port())
+	b = appendBigEndianUint16(b, uint16(udpLength))
+	b = append(b, 0, 0)
+	return b
+}
+
+// wrapObfuscator captures the raw packets read and written by the obfuscator,
+// receivedS2C is the direction of the packets read.
+func (c *packetCapture) wrapObfuscator(o *WireGuardObfuscator, receivedS2C bool) {
+	readFunc, readBatchFunc := o.ReadFunc, o.ReadBatchFunc
+	if readFunc == nil {
+		readFunc = defaultReadFunc
+	}
+	if readBatchFunc == nil {
+		readBatchFunc = defaultReadBatchFunc
+	}
+	writeFunc, writeBatchFunc := o.WriteFunc, o.WriteBatchFunc
+	if writeFunc == nil {
+		writeFunc = defaultWriteFunc
+	}
+	if writeBatchFunc == nil {
+		writeBatchFunc = defaultWriteBatchFunc
+	}
+	o.ReadFunc = c.wrapReadFunc(kCaptureReceivedRaw, receivedS2C, readFunc)
+	o.ReadBatchFunc = c.wrapReadBatchFunc(kCaptureReceivedRaw, receivedS2C, readBatchFunc)
+	o.WriteFunc = c.wrapWriteFunc(kCaptureSentRaw, !receivedS2C, writeFunc)
+	o.WriteBatchFunc = c.wrapWriteBatchFunc(kCaptureSentRaw, !receivedS2C, writeBatchFunc)
+}
+
+// wrapReadFunc captures the packets read by the readFunc at the stage.
+func (c *packetCapture) wrapReadFunc(stage string, s2c bool,
+	readFunc func(transport PacketTransport, packet *Packet) (err error)) func(transport PacketTransport, packet *Packet) (err error) {
+	return func(transport PacketTransport, packet *Packet) (err error) {
+		err = readFunc(transport, packet)
+		if err == nil {
+			c.record(stage, s2c, true, transport, packet)
+		}
+		return
+	}
+}
+
+func (c *packetCapture) wrapReadBatchFunc(stage string, s2c bool,
+	readBatchFunc func(transport PacketTransport, packets []*Packet) (n int, err error)) func(transport PacketTransport, packets []*Packet) (n int, err error) {
+	return func(transport PacketTransport, packets []*Packet) (n int, err error) {
+		n, err = readBatchFunc(transport, packets)
+		if err == nil {
+			for _, packet := range packets[:n] {
+				c.record(stage, s2c, true, transport, packet)
+			}
+		}
+		return
+	}
+}
+
+// wrapWriteFunc captures the packets passed to the writeFunc at the stage, whether they are written or not.
+func (c *packetCapture) wrapWriteFunc(stage string, s2c bool,
+	writeFunc func(transport PacketTransport, packet *Packet) (err error)) func(transport PacketTransport, packet *Packet) (err error) {
+	return func(transport PacketTransport, packet *Packet) (err error) {
+		c.record(stage, s2c, false, transport, packet)
+		return writeFunc(transport, packet)
+	}
+}
+
+func (c *packetCapture) wrapWriteBatchFunc(stage string, s2c bool,
+	writeBatchFunc func(transport PacketTransport, packets []*Packet) (failed int, err error)) func(transport PacketTransport, packets []*Packet) (failed int, err error) {
+	return func(transport PacketTransport, packets []*Packet) (failed int, err error) {
+		for _, packet := range packets {
+			c.record(stage, s2c, false, transport, packet)
+		}
+		return writeBatchFunc(transport, packets)
+	}
+}
@@ -0,0 +1,133 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type captureTestRecord struct {
+	payload []byte
+	comment string
+	src     net.IP
+	srcPort uint16
+}
+
+// readCaptureTestFile parses the pcapng file written by the packetCapture.
+func readCaptureTestFile(t *testing.T, path string) (records []captureTestRecord) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 48 || binary.LittleEndian.Uint32(data) != kPcapngSectionHeaderBlock ||
+		binary.LittleEndian.Uint32(data[8:]) != kPcapngByteOrderMagic {
+		t.Fatalf("invalid section header block: %x", data)
+	}
+	if binary.LittleEndian.Uint32(data[28:]) != kPcapngInterfaceDescBlock || binary.LittleEndian.Uint16(data[36:]) != kPcapngLinkTypeRaw {
+		t.Fatalf("invalid interface description block: %x", data[28:48])
+	}
+	for b := data[48:]; len(b) > 0; {
+		length := binary.LittleEndian.Uint32(b[4:])
+		if binary.LittleEndian.Uint32(b) != kPcapngEnhancedPacketBlock || length%4 != 0 || int(length) > len(b) ||
+			binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("invalid enhanced packet block: %x", b)
+		}
+		captured := binary.LittleEndian.Uint32(b[20:])
+		ip := b[28 : 28+captured]
+		if ip[0]>>4 != 4 || ip[9] != 17 {
+			t.Fatalf("expected IPv4 UDP packet: %x", ip)
+		}
+		record := captureTestRecord{
+			payload: ip[28:],
+			src:     net.IP(ip[12:16]),
+			srcPort: binary.BigEndian.Uint16(ip[20:]),
+		}
+		option := b[28+(captured+3)/4*4:]
+		if code := binary.LittleEndian.Uint16(option); code == kPcapngOptionComment {
+			record.comment = string(option[4 : 4+binary.LittleEndian.Uint16(option[2:])])
+		}
+		records = append(records, record)
+		b = b[length:]
+	}
+	return
+}
+
+func TestPacketCapture(t *testing.T) {
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	// the packets written to the receiver and read back, as the side of mwgp-server facing mwgp-client
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	capture := newPacketCapture(path, 6)
+	var obfuscator WireGuardObfuscator
+	obfuscator.InitializeWithKey([]byte("kisekimo, mahoumo"))
+	capture.wrapObfuscator(&obfuscator, false)
+	readFunc := capture.wrapReadFunc(kCaptureAfterDeobfuscate, false, obfuscator.ReadPacketWithDeobfuscate)
+	writeFunc := capture.wrapWriteFunc(kCaptureBeforeObfuscate, true, obfuscator.WritePacketWithObfuscate)
+	if err := capture.open(NewStdLogger(LogLevelError)); err != nil {
+		t.Fatal(err)
+	}
+	defer capture.close()
+
+	_ = receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	senderTransport, receiverTransport := NewUDPTransport(sender), NewUDPTransport(receiver)
+	plain := make([][]byte, 3)
+	for i := range plain {
+		packet := newBatchTestPackets(1)[0]
+		packet.Length = 32 + i
+		packet.Data[0] = 4
+		binary.LittleEndian.PutUint32(packet.Data[4:], 0x1a2b3c00+uint32(i))
+		packet.Destination = receiver.LocalAddr().(*net.UDPAddr)
+		packet.Flags = PacketFlagObfuscateBeforeSend
+		plain[i] = append([]byte(nil), packet.Slice()...)
+		if err := writeFunc(senderTransport, packet); err != nil {
+			t.Fatal(err)
+		}
+		received := newBatchTestPackets(1)[0]
+		if err := readFunc(receiverTransport, received); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capture.close()
+
+	records := readCaptureTestFile(t, path)
+	if len(records) != 6 {
+		t.Fatalf("expected the capture stopped at 6 packets, got %d", len(records))
+	}
+	stages := []string{
+		"stage=before-obfuscate direction=server_to_client session=0x1a2b3c00 flags=obfuscate",
+		"stage=sent-raw direction=server_to_client flags=obfuscate",
+		"stage=received-raw direction=client_to_server",
+		"stage=after-deobfuscate direction=client_to_server session=0x1a2b3c00 flags=deobfuscated",
+	}
+	for i, stage := range stages {
+		if records[i].comment != stage {
+			t.Errorf("record #%d: expected comment %q, got %q", i, stage, records[i].comment)
+		}
+	}
+	if !bytes.Equal(records[0].payload, plain[0]) || !bytes.Equal(records[3].payload, plain[0]) {
+		t.Error("expected the plain packet before the obfuscation and after the deobfuscation")
+	}
+	if !bytes.Equal(records[1].payload, records[2].payload) || bytes.Equal(records[1].payload, plain[0]) {
+		t.Error("expected the same obfuscated packet sent and received")
+	}
+	if records[2].srcPort != uint16(sender.LocalAddr().(*net.UDPAddr).Port) || !records[2].src.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected source %s:%d of the received packet", records[2].src, records[2].srcPort)
+	}
+	if !strings.HasPrefix(records[5].comment, "stage=sent-raw") {
+		t.Errorf("expected the last record sent-raw, got %q", records[5].comment)
+	}
+}
@@ -4,62 +4,343 @@ import (
 	"context"
 	"fmt"
 	"golang.zx2c4.com/wireguard/device"
-	"log"
 	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ClientConfig struct {
-	Server                    string         `json:"server"`
-	Listen                    string         `json:"listen"`
-	Timeout                   int            `json:"timeout,omitempty"`
-	Resolver                  string         `json:"resolver,omitempty"`
-	ClientSourceValidateLevel int            `json:"csvl,omitempty"`
-	ServerSourceValidateLevel int            `json:"ssvl,omitempty"`
-	MaxPacketSize             int            `json:"max_packet_size,omitempty"`
-	ClientPublicKey           NoisePublicKey `json:"client_pubkey"`
-	ServerPublicKey           NoisePublicKey `json:"server_pubkey"`
-	ObfuscateKey              string         `json:"obfs"`
+	// Server is the address of mwgp-server, or a port range like "example.com:20000-20100",
+	// then the destination port is switched every HopInterval, see portHopTransport.
+	Server                    string          `json:"server"`
+	Listen                    ListenAddresses `json:"listen"`
+	Timeout                   Duration        `json:"timeout,omitempty"`
+	CleanupInterval           Duration        `json:"cleanup_interval,omitempty"`
+	Resolver                  string          `json:"resolver,omitempty"`
+	ClientSourceValidateLevel int             `json:"csvl,omitempty"`
+	ServerSourceValidateLevel int             `json:"ssvl,omitempty"`
+	MaxPacketSize             int             `json:"max_packet_size,omitempty"`
+	ClientPublicKey           NoisePublicKey  `json:"client_pubkey"`
+	ServerPublicKey           NoisePublicKey  `json:"server_pubkey"`
+	ObfuscateKey              string          `json:"obfs"`
+
+	// Servers are the endpoints of mwgp-server to fail over between, instead of a single Server,
+	// each one is a "host:port" string or a ClientConfigServer, see clientFailover.
+	Servers []ClientConfigServer `json:"servers,omitempty"`
+
+	// FailoverWindow is how long the packets sent to the active server can go unreplied
+	// before the sessions are switched to the next one, default to 20s.
+	// FailoverProbeInterval is the interval to probe the failed servers, default to 10s,
+	// which requires "preflight" to be enabled on mwgp-server.
+	FailoverWindow        Duration `json:"failover_window,omitempty"`
+	FailoverProbeInterval Duration `json:"failover_probe_interval,omitempty"`
+
+	// ObfuscateSecondaryKeys are the old obfuscation keys still accepted during the key rotation.
+	ObfuscateSecondaryKeys []string `json:"obfs_secondary,omitempty"`
+
+	// ObfuscateMode is ObfuscateModeXOR (default) or ObfuscateModeAuthenticated,
+	// it changes the wire format so it must be the same on both ends.
+	ObfuscateMode string `json:"obfs_mode,omitempty"`
+
+	// ObfuscateMinKeyLength is the min length of the obfs and obfs_secondary keys in bytes, default to 8.
+	ObfuscateMinKeyLength int `json:"obfs_min_key_length,omitempty"`
+
+	// ObfuscatePadding is the optional padding policy for MessageTransport packets.
+	ObfuscatePadding *ObfuscatePaddingConfig `json:"obfs_padding,omitempty"`
+
+	// Preflight checks the obfuscation settings with mwgp-server before forwarding the first handshake
+	// to a server address, and drops the handshakes if they are mismatched, see preflightClient.
+	// It requires "preflight" to be enabled on mwgp-server as well.
+	Preflight bool `json:"preflight,omitempty"`
+
+	// Transport is TransportUDP (default) or TransportTCP, which forwards to the "tcp_listen" of mwgp-server
+	// with the same address as the "server", see tcpFrameConn.
+	Transport string `json:"transport,omitempty"`
+
+	// WebSocket forwards to mwgp-server over WebSocket instead of UDP if set.
+	// The "server" defaults to the host and port of its URL.
+	WebSocket *WebSocketClientConfig `json:"websocket,omitempty"`
+
+	// SOCKS5 forwards to mwgp-server through a SOCKS5 proxy with UDP ASSOCIATE if set, see socks5Transport.
+	SOCKS5 *SOCKS5Config `json:"socks5,omitempty"`
+
+	// AllowedSources are the addresses or CIDRs the packets are accepted from, only the loopback addresses
+	// if it is empty. MaxClients caps the number of distinct client addresses, see "Client Sources".
+	AllowedSources []string `json:"allowed_sources,omitempty"`
+	MaxClients     int      `json:"max_clients,omitempty"`
+
+	// ValidateWireGuard only forwards the plausible WireGuard packets from the clients without a session,
+	// see "WireGuard Validation".
+	ValidateWireGuard bool `json:"validate_wireguard,omitempty"`
+
+	// MetricsListen is the address of the HTTP server exposing Prometheus metrics at /metrics.
+	MetricsListen string `json:"metrics_listen,omitempty"`
+
+	// DebugListen is the address of the HTTP server exposing net/http/pprof and expvar at /debug/,
+	// it must be a loopback address unless DebugAllowRemote.
+	DebugListen      string `json:"debug_listen,omitempty"`
+	DebugAllowRemote bool   `json:"debug_allow_remote,omitempty"`
+
+	// CaptureFile is the pcapng file the packets to and from mwgp-server are written to for debugging,
+	// up to CaptureLimitPackets (default 10000), see "Packet Capture" in capture.go.
+	// The capture contains the traffic of the clients, it must be handled as sensitive.
+	CaptureFile         string `json:"capture_file,omitempty"`
+	CaptureLimitPackets int    `json:"capture_limit_packets,omitempty"`
+
+	// FwMark is the SO_MARK set on the listening and the forwarding sockets (Linux only).
+	FwMark int `json:"fwmark,omitempty"`
+
+	// DSCP (0-63) and TTL (1-255) are set on the listening and the forwarding sockets if not 0,
+	// so that the tunnel traffic can be classified by the routers.
+	DSCP int `json:"dscp,omitempty"`
+	TTL  int `json:"ttl,omitempty"`
+
+	// PreserveTOS carries the TOS (the DSCP and the ECN bits) of each packet over the relay (Linux only),
+	// see "ToS Preservation" in tos.go.
+	PreserveTOS bool `json:"preserve_tos,omitempty"`
+
+	// PathMTUDiscovery sets the DF bit on the UDP sockets to mwgp-server (Linux only), and lowers the padding
+	// of the packets exceeding the path MTU, see "Path MTU Discovery" in pmtud.go.
+	PathMTUDiscovery bool `json:"pmtu_discovery,omitempty"`
+
+	// RecvBuffer and SendBuffer are the SO_RCVBUF and SO_SNDBUF of the listening and the forwarding sockets,
+	// in bytes or a string like "4MiB".
+	RecvBuffer ByteSize `json:"recv_buffer,omitempty"`
+	SendBuffer ByteSize `json:"send_buffer,omitempty"`
+
+	// BindDevice (Linux only) and BindAddress are the interface and the local address
+	// of the sockets forwarding to the mwgp-server.
+	BindDevice  string `json:"bind_device,omitempty"`
+	BindAddress string `json:"bind_address,omitempty"`
+
+	// HopInterval is the interval to switch the destination port if the Server is a port range,
+	// default to 30s.
+	HopInterval Duration `json:"hop_interval,omitempty"`
+
+	// NATKeepalive sends an obfuscated dummy packet to mwgp-server if nothing is sent to it in the interval
+	// while any session is active, to hold the NAT mapping open, see isNATKeepalive.
+	NATKeepalive Duration `json:"nat_keepalive,omitempty"`
+
+	// ResolveInterval is the interval to re-resolve the server address.
+	// The server address will also be re-resolved immediately
+	// if several handshakes in a row got no response from the server.
+	ResolveInterval Duration `json:"resolve_interval,omitempty"`
+
+	// IPPreference is IPPreferenceIPv4 (default), IPPreferenceIPv6 or IPPreferenceAuto,
+	// it decides which address is tried first if the server has both A and AAAA records.
+	IPPreference string `json:"ip_preference,omitempty"`
+
+	// Workers is the number of UDP sockets listening on the Listen address.
+	// With Workers > 1, the sockets are opened with SO_REUSEPORT and each one
+	// has its own read loop, which is only available on Linux and BSDs.
+	Workers int `json:"workers,omitempty"`
+
+	// BatchSize is the max number of packets read or written in a single syscall (Linux only).
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// ForwardTableShards is the number of the shards of the forward table, a power of two (default 64),
+	// more shards reduce the lock contention between the workers with many clients.
+	ForwardTableShards int `json:"forward_table_shards,omitempty"`
+
+	// UDPOffload enables UDP GRO/GSO with batch_size > 1 if the kernel supports them (Linux only).
+	UDPOffload bool `json:"udp_offload,omitempty"`
+
+	// LatencySampleRate samples one of every this many packets for the latency histograms, 0 (default) disables them.
+	LatencySampleRate int `json:"latency_sample_rate,omitempty"`
+
+	// Trace logs the metadata of each forwarded packet (rate-limited, never the payload) for debugging,
+	// see "Packet Trace" in trace.go. It can be changed by reload.
+	Trace bool `json:"trace,omitempty"`
+
+	// LogLevel is one of "debug", "info" (default), "warn" and "error",
+	// the logs below the level are suppressed.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// LogFormat is "text" (default) or "json", which writes one JSON object per line.
+	LogFormat string `json:"log_format,omitempty"`
+
 	WGITCacheConfig
 
 	// Deprecated: use Resolver instead
 	DNS string `json:"dns,omitempty"`
 }
 
+const (
+	defaultClientResolveInterval = 5 * time.Minute
+	kClientResolveIntervalMax    = 24 * time.Hour
+
+	// kClientReresolveUnrepliedThreshold is the number of handshakes in a row
+	// without server response before we re-resolve the server address.
+	kClientReresolveUnrepliedThreshold = 3
+)
+
 type Client struct {
+	// Logger defaults to a StdLogger with the log_level,
+	// it can be replaced before Start().
+	Logger Logger
+
+	// TransportFactory creates the transports instead of the UDP sockets if not nil,
+	// it can be set before Start().
+	TransportFactory PacketTransportFactory
+
+	// OnSessionCreated and OnSessionExpired are called once a session is created or removed if not nil,
+	// they can be set before Start(), see SessionInfo.
+	OnSessionCreated func(info SessionInfo)
+	OnSessionExpired func(info SessionInfo)
+
 	wgitTable        *WireGuardIndexTranslationTable
 	server           string
 	cachedServerPeer ServerConfigPeer
 	resolver         UDPAddrResolver
+	resolveInterval  time.Duration
+	resolveNowChan   chan struct{}
+	ipPreference     string
+
+	// serverAddr is the resolved address of server, *net.UDPAddr
+	serverAddr atomic.Value
+
+	// failover is nil unless there are multiple Servers
+	failover *clientFailover
+
+	obfuscator    *WireGuardObfuscator
+	capture       *packetCapture
+	preflight     *preflightClient
+	metricsListen string
+	debugListen   string
+
+	// config is the running config, used to find out what is changed in Reload().
+	config     *ClientConfig
+	reloadLock sync.Mutex
 }
 
 func NewClientWithConfig(config *ClientConfig) (outClient *Client, err error) {
+	defer func() {
+		err = categorize(ErrConfig, err)
+	}()
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+
 	client := Client{}
-	client.server = config.Server
+	client.Logger, err = NewLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		return
+	}
+	client.config = config
+	if len(config.Servers) > 1 {
+		failoverWindow := defaultFailoverWindow
+		if config.FailoverWindow > 0 {
+			failoverWindow = time.Duration(config.FailoverWindow)
+		}
+		probeInterval := defaultFailoverProbeInterval
+		if config.FailoverProbeInterval > 0 {
+			probeInterval = time.Duration(config.FailoverProbeInterval)
+		}
+		client.failover = newClientFailover(config.Servers, failoverWindow, probeInterval, client.Logger)
+	}
+	var serverPortMax int
+	client.server, serverPortMax, err = splitPortRange(config.Server)
+	if err != nil {
+		err = fmt.Errorf("invalid server address %s: %w", config.Server, err)
+		return
+	}
+	if len(config.Servers) == 1 {
+		client.server = config.Servers[0].Address
+	}
+	if config.WebSocket != nil {
+		var hostport string
+		_, hostport, err = parseWebSocketURL(config.WebSocket.URL)
+		if err != nil {
+			return
+		}
+		if client.server == "" {
+			client.server = hostport
+		}
+	}
+	client.metricsListen = config.MetricsListen
+	client.debugListen = config.DebugListen
+	client.resolveInterval = defaultClientResolveInterval
+	if config.ResolveInterval > 0 {
+		client.resolveInterval = time.Duration(config.ResolveInterval)
+	}
+	client.resolveNowChan = make(chan struct{}, 1)
+	client.ipPreference = config.IPPreference
 	client.wgitTable = NewWireGuardIndexTranslationTable()
-	client.wgitTable.ClientListen, err = net.ResolveUDPAddr("udp", config.Listen)
+	client.wgitTable.Logger = client.Logger
+	client.wgitTable.DSCP = config.DSCP
+	client.wgitTable.TTL = config.TTL
+	client.wgitTable.PreserveTOS = config.PreserveTOS
+	client.wgitTable.PathMTUDiscovery = config.PathMTUDiscovery
+	client.wgitTable.RecvBuffer = int(config.RecvBuffer)
+	client.wgitTable.SendBuffer = int(config.SendBuffer)
+	client.wgitTable.ServerListen, err = parseBindOptions(config.BindDevice, config.BindAddress)
 	if err != nil {
-		err = fmt.Errorf("invalid listen address %s: %w", config.Listen, err)
 		return
 	}
+	client.wgitTable.BindDevice = config.BindDevice
+	if config.FwMark != 0 {
+		if fwmarkSupported {
+			client.wgitTable.FwMark = config.FwMark
+		} else {
+			client.Logger.Warnf("option \"fwmark\" is not supported on %s, ignored", runtime.GOOS)
+		}
+	}
+	name, systemd, err := config.Listen.systemd()
+	if err != nil {
+		return
+	}
+	if systemd {
+		client.wgitTable.ClientListenSystemd = true
+		client.wgitTable.ClientListenFDName = name
+	} else {
+		var ranges []ListenRange
+		ranges, err = resolveListenAddrs(config.Listen)
+		if err != nil {
+			return
+		}
+		client.wgitTable.setClientListen(ranges)
+	}
+	client.wgitTable.ClientListenWorkers = config.Workers
+	if config.BatchSize > 0 {
+		client.wgitTable.BatchSize = config.BatchSize
+	}
+	if config.ForwardTableShards > 0 {
+		client.wgitTable.ForwardTableShards = config.ForwardTableShards
+	}
+	client.wgitTable.UDPOffload = config.UDPOffload
+	client.wgitTable.LatencySampleRate = config.LatencySampleRate
+	client.wgitTable.SetTrace(config.Trace)
+	// the random tail makes almost every packet to mwgp-server of a different length, which defeats GSO,
+	// and a GSO write failed with EMSGSIZE cannot be written again packet by packet
+	client.wgitTable.serverGSODisabled = config.ObfuscatePadding != nil && config.ObfuscatePadding.MaxRandomTail > 0 ||
+		config.PathMTUDiscovery
 	if config.Timeout > 0 {
-		client.wgitTable.Timeout = time.Duration(config.Timeout) * time.Second
+		client.wgitTable.Timeout = time.Duration(config.Timeout)
 	}
+	client.wgitTable.CleanupInterval = time.Duration(config.CleanupInterval)
 	if config.MaxPacketSize > 0 {
 		client.wgitTable.MaxPacketSize = uint(config.MaxPacketSize)
 	}
+	allowedSources, err := parseAllowedSources(config.AllowedSources)
+	if err != nil {
+		return
+	}
+	client.wgitTable.setAllowedSources(allowedSources)
+	client.wgitTable.MaxClients = config.MaxClients
+	client.wgitTable.ValidateWireGuard = config.ValidateWireGuard
 	client.wgitTable.ExtractPeerFunc = client.generateServerPeer
+	client.wgitTable.ServerUnreachableThreshold = kClientReresolveUnrepliedThreshold
+	client.wgitTable.ServerUnreachableFunc = client.resolveNow
 	client.cachedServerPeer.serverPublicKey = config.ServerPublicKey
 	client.cachedServerPeer.ClientPublicKey = &config.ClientPublicKey
 	client.wgitTable.CacheJar.WGITCacheConfig = config.WGITCacheConfig
 	resolver := config.Resolver
 	if config.DNS != "" {
-		if resolver == "" {
-			resolver = fmt.Sprintf("dns+udp://%s", config.DNS)
-		} else {
-			err = fmt.Errorf("option \"dns\" and \"resolver\" is conflicted with each other")
-			return
-		}
+		resolver = fmt.Sprintf("dns+udp://%s", config.DNS)
 	}
 	client.resolver, err = newUDPAddrResolver(resolver)
 	if err != nil {
@@ -67,46 +348,459 @@ func NewClientWithConfig(config *ClientConfig) (outClient *Client, err error) {
 		return
 	}
 
+	obfuscateKey, obfuscateSecondaryKeys, err := parseObfuscateKeys(config.ObfuscateKey, config.ObfuscateSecondaryKeys, config.ObfuscateMinKeyLength)
+	if err != nil {
+		return
+	}
+	defer zeroObfuscateKeys(obfuscateKey, obfuscateSecondaryKeys)
+	warnWeakObfuscateKeys(client.Logger, obfuscateKey, obfuscateSecondaryKeys)
 	var obfuscator WireGuardObfuscator
-	obfuscator.Initialize(config.ObfuscateKey)
-	client.wgitTable.ServerWriteToUDPFunc = func(conn *net.UDPConn, packet *Packet) (err error) {
+	obfuscator.InitializeWithKey(obfuscateKey, obfuscateSecondaryKeys...)
+	obfuscator.Padding = config.ObfuscatePadding
+	obfuscator.Authenticated, err = parseObfuscateMode(config.ObfuscateMode)
+	if err != nil {
+		return
+	}
+	client.wgitTable.ServerWriteFunc = func(transport PacketTransport, packet *Packet) (err error) {
 		packet.Flags |= PacketFlagObfuscateBeforeSend
-		return obfuscator.WriteToUDPWithObfuscate(conn, packet)
+		return obfuscator.WritePacketWithObfuscate(transport, packet)
+	}
+	client.wgitTable.ServerReadFunc = obfuscator.ReadPacketWithDeobfuscate
+	client.wgitTable.ServerWriteBatchFunc = func(transport PacketTransport, packets []*Packet) (failed int, err error) {
+		for _, packet := range packets {
+			packet.Flags |= PacketFlagObfuscateBeforeSend
+		}
+		return obfuscator.WriteBatchWithObfuscate(transport, packets)
+	}
+	client.wgitTable.ServerReadBatchFunc = obfuscator.ReadBatchWithDeobfuscate
+	client.obfuscator = &obfuscator
+	if capture := newPacketCapture(config.CaptureFile, config.CaptureLimitPackets); capture != nil {
+		capture.wrapObfuscator(&obfuscator, true)
+		table := client.wgitTable
+		table.ServerReadFunc = capture.wrapReadFunc(kCaptureAfterDeobfuscate, true, table.ServerReadFunc)
+		table.ServerReadBatchFunc = capture.wrapReadBatchFunc(kCaptureAfterDeobfuscate, true, table.ServerReadBatchFunc)
+		table.ServerWriteFunc = capture.wrapWriteFunc(kCaptureBeforeObfuscate, false, table.ServerWriteFunc)
+		table.ServerWriteBatchFunc = capture.wrapWriteBatchFunc(kCaptureBeforeObfuscate, false, table.ServerWriteBatchFunc)
+		client.capture = capture
+	}
+	if config.WebSocket != nil {
+		webSocketConfig := *config.WebSocket
+		client.wgitTable.DialServerFunc = func(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+			return newWebSocketClientTransport(&webSocketConfig, raddr, client.wgitTable.tcpDialer(),
+				int(client.wgitTable.MaxPacketSize), client.Logger)
+		}
+	}
+	client.wgitTable.NATKeepalive = time.Duration(config.NATKeepalive)
+	if serverPortMax != 0 {
+		hopInterval := defaultHopInterval
+		if config.HopInterval > 0 {
+			hopInterval = time.Duration(config.HopInterval)
+		}
+		client.wgitTable.DialServerFunc = func(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+			conn, err := client.wgitTable.listenUDP()
+			if err != nil {
+				return
+			}
+			transport = newPortHopTransport(conn, raddr, serverPortMax, hopInterval, client.Logger)
+			return
+		}
+	}
+	if config.Transport == TransportTCP {
+		client.wgitTable.DialServerFunc = func(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+			transport = newTCPClientTransport(raddr, client.wgitTable.tcpDialer(), int(client.wgitTable.MaxPacketSize), client.Logger)
+			return
+		}
+	}
+	if config.SOCKS5 != nil {
+		socks5Config := *config.SOCKS5
+		client.wgitTable.DialServerFunc = func(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+			conn, err := client.wgitTable.listenUDP()
+			if err != nil {
+				return
+			}
+			transport = newSOCKS5Transport(&socks5Config, raddr, conn, client.wgitTable.tcpDialer(), client.Logger)
+			return
+		}
+	}
+	if config.Preflight || client.failover != nil {
+		// the failover probes the failed servers with the preflight requests
+		client.preflight = newPreflightClient(config.ServerPublicKey, client.obfuscator, client.Logger, client.wgitTable.closeChan)
+		client.wgitTable.ControlPacketFunc = client.preflight.handle
+		if config.Preflight {
+			client.wgitTable.PreflightFunc = client.preflight.check
+		}
 	}
-	client.wgitTable.ServerReadFromUDPFunc = obfuscator.ReadFromUDPWithDeobfuscate
 
 	outClient = &client
 	return
 }
 
 func (c *Client) generateServerPeer(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
-	if c.cachedServerPeer.forwardToAddress == nil {
+	serverAddr, _ := c.serverAddr.Load().(*net.UDPAddr)
+	if serverAddr == nil {
 		err = fmt.Errorf("forward_to address is not resolved yet")
 		return
 	}
-	fi = &c.cachedServerPeer
+	serverPeer := c.cachedServerPeer
+	serverPeer.forwardToAddress = serverAddr
+	fi = &serverPeer
 	return
 }
 
-func (c *Client) Start() (err error) {
-	go func() {
-		for {
-			sa, rerr := c.resolver.ResolveUDPAddr(context.Background(), c.server)
-			if rerr != nil {
-				log.Printf("[error] failed to resolve server addr %s: %s, retry in 10 seconds", c.server, rerr.Error())
-				time.Sleep(10 * time.Second)
+// resolveNow asks the resolve loop to re-resolve the server address immediately.
+func (c *Client) resolveNow() {
+	select {
+	case c.resolveNowChan <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) resolveLoop() {
+	ticker := time.NewTicker(c.resolveInterval)
+	defer ticker.Stop()
+
+	var endpointChanged <-chan struct{}
+	if c.failover != nil {
+		endpointChanged = c.failover.changed
+	}
+	failover := false
+	for {
+		server := c.activeServer()
+		addrs, rerr := resolveUDPAddrs(c.wgitTable.context(), c.resolver, server, c.ipPreference)
+		if rerr != nil {
+			c.Logger.Errorf("failed to resolve server addr %s: %s, retry in 10 seconds", server, rerr.Error())
+			select {
+			case <-time.After(10 * time.Second):
 				continue
+			case <-endpointChanged:
+				continue
+			case <-c.wgitTable.closeChan:
+				return
+			}
+		}
+		oldAddr, _ := c.serverAddr.Load().(*net.UDPAddr)
+		sa := selectServerAddr(addrs, oldAddr, failover)
+		failover = false
+		if oldAddr == nil || !oldAddr.IP.Equal(sa.IP) || oldAddr.Port != sa.Port {
+			if oldAddr != nil {
+				c.Logger.Infof("server address of %s changed: %s => %s", server, oldAddr.String(), sa.String())
+			}
+			c.serverAddr.Store(sa)
+			select {
+			case c.wgitTable.UpdateAllServerDestinationChan <- sa:
+			case <-c.wgitTable.closeChan:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-c.resolveNowChan:
+			c.Logger.Infof("no response from server %s, re-resolve server address", server)
+			failover = true
+		case <-endpointChanged:
+		case <-c.wgitTable.closeChan:
+			return
+		}
+	}
+}
+
+// selectServerAddr keeps using the current address as long as it is still resolved,
+// or moves to the next one if failover is set, so that all the addresses are tried in turn.
+func selectServerAddr(addrs []*net.UDPAddr, current *net.UDPAddr, failover bool) (selected *net.UDPAddr) {
+	selected = addrs[0]
+	if current == nil {
+		return
+	}
+	for i, addr := range addrs {
+		if addr.IP.Equal(current.IP) && addr.Port == current.Port {
+			if failover {
+				i = (i + 1) % len(addrs)
 			}
-			if c.cachedServerPeer.forwardToAddress == nil ||
-				!c.cachedServerPeer.forwardToAddress.IP.Equal(sa.IP) ||
-				c.cachedServerPeer.forwardToAddress.Port != sa.Port {
-				c.cachedServerPeer.forwardToAddress = sa
-				c.wgitTable.UpdateAllServerDestinationChan <- sa
+			selected = addrs[i]
+			return
+		}
+	}
+	return
+}
+
+func (c *Client) Start() (err error) {
+	// the metrics, debug and control listeners are served until Start returns
+	serversDone := make(chan struct{})
+	var serverListeners []net.Listener
+	defer func() {
+		if err != nil {
+			// release them now, so that Start can be retried
+			for _, listener := range serverListeners {
+				_ = listener.Close()
 			}
-			time.Sleep(5 * time.Minute)
 		}
+		close(serversDone)
 	}()
-	log.Printf("[info] listen on %s ...\n", c.wgitTable.ClientListen)
+	if c.metricsListen != "" {
+		var ms *metricsServer
+		ms, err = newMetricsServer(c.metricsListen, c.Logger, c.Stats)
+		if err != nil {
+			return
+		}
+		serverListeners = append(serverListeners, ms.listener)
+		go ms.Serve(serversDone)
+	}
+	if c.debugListen != "" {
+		var ds *debugServer
+		ds, err = newDebugServer(c.debugListen, c.Logger, c.Stats)
+		if err != nil {
+			return
+		}
+		serverListeners = append(serverListeners, ds.listener)
+		go ds.Serve(serversDone)
+	}
+	err = c.capture.open(c.Logger)
+	if err != nil {
+		return
+	}
+	defer c.capture.close()
+	if c.wgitTable.Logger != c.Logger {
+		// replaced after NewClientWithConfig()
+		c.wgitTable.Logger = c.Logger
+		if c.preflight != nil {
+			c.preflight.logger = c.Logger
+		}
+		if c.failover != nil {
+			c.failover.logger = c.Logger
+		}
+	}
+	c.wgitTable.TransportFactory = c.TransportFactory
+	c.wgitTable.OnSessionCreated = c.OnSessionCreated
+	c.wgitTable.OnSessionExpired = c.OnSessionExpired
+	go c.resolveLoop()
+	if c.failover != nil {
+		go c.failoverLoop()
+	}
+	c.obfuscator.logKeyFingerprints(c.Logger, "client")
+	c.Logger.Infof("listen on %s ...", c.wgitTable.clientListenString())
 	err = c.wgitTable.Serve()
+	// all the packets are processed, see "Key Hygiene" in obfs.go
+	c.obfuscator.Close()
+	return
+}
+
+// Stop closes the listening sockets and waits for all in-flight packets to be
+// processed, then the Start() will return with nil error.
+//
+// It is safe to be called concurrently and more than once.
+func (c *Client) Stop() (err error) {
+	err = c.wgitTable.Close()
+	return
+}
+
+// Run starts the client and stops it once the ctx is done.
+// It returns the error of Start(), which is nil if the client is stopped.
+func (c *Client) Run(ctx context.Context) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Stop()
+		case <-done:
+		}
+	}()
+	err = c.Start()
+	return
+}
+
+// Reload applies the config to the running client, without dropping the active sessions.
+//
+// Timeout, obfuscation key and allowed_sources are applied immediately,
+// changes to other options are ignored with a warning, since they require a restart.
+// The config is checked by Validate() first, and the listen address cannot be changed,
+// Reload returns an error without applying anything otherwise.
+func (c *Client) Reload(config *ClientConfig) (err error) {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+	defer func() {
+		err = categorize(ErrConfig, err)
+	}()
+	// nothing is applied unless NewClientWithConfig would accept the config as well
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+
+	_, systemd, err := config.Listen.systemd()
+	if err != nil {
+		return
+	}
+	if systemd || c.wgitTable.ClientListenSystemd {
+		if config.Listen.String() != c.config.Listen.String() {
+			err = fmt.Errorf("listen address cannot be changed by reload: %s => %s", c.config.Listen, config.Listen)
+			return
+		}
+	} else {
+		ranges, rerr := resolveListenAddrs(config.Listen)
+		if rerr != nil {
+			err = rerr
+			return
+		}
+		if !sameListenRanges(ranges, c.wgitTable.clientListenRanges()) {
+			err = fmt.Errorf("listen address cannot be changed by reload: %s => %s", c.wgitTable.clientListenString(), config.Listen)
+			return
+		}
+	}
+	allowedSources, err := parseAllowedSources(config.AllowedSources)
+	if err != nil {
+		return
+	}
+	obfuscateKey, obfuscateSecondaryKeys, err := parseObfuscateKeys(config.ObfuscateKey, config.ObfuscateSecondaryKeys, config.ObfuscateMinKeyLength)
+	if err != nil {
+		return
+	}
+	defer zeroObfuscateKeys(obfuscateKey, obfuscateSecondaryKeys)
+	warnWeakObfuscateKeys(c.Logger, obfuscateKey, obfuscateSecondaryKeys)
+	if c.obfuscator.Authenticated && len(obfuscateKey) == 0 {
+		err = fmt.Errorf("obfs_mode %q requires obfs to be set", ObfuscateModeAuthenticated)
+		return
+	}
+
+	old := c.config
+	applied := *old
+	if config.Server != old.Server || !reflect.DeepEqual(config.Servers, old.Servers) || config.Resolver != old.Resolver || config.DNS != old.DNS {
+		warnRestartRequired(c.Logger, "server/servers")
+	}
+	if config.FailoverWindow != old.FailoverWindow || config.FailoverProbeInterval != old.FailoverProbeInterval {
+		warnRestartRequired(c.Logger, "failover_window/failover_probe_interval")
+	}
+	if config.ClientPublicKey != old.ClientPublicKey || config.ServerPublicKey != old.ServerPublicKey {
+		warnRestartRequired(c.Logger, "client_pubkey/server_pubkey")
+	}
+	if config.ClientSourceValidateLevel != old.ClientSourceValidateLevel || config.ServerSourceValidateLevel != old.ServerSourceValidateLevel {
+		warnRestartRequired(c.Logger, "csvl/ssvl")
+	}
+	if config.MaxPacketSize != old.MaxPacketSize {
+		warnRestartRequired(c.Logger, "max_packet_size")
+	}
+	if config.CleanupInterval != old.CleanupInterval {
+		warnRestartRequired(c.Logger, "cleanup_interval")
+	}
+	if config.Workers != old.Workers || config.BatchSize != old.BatchSize {
+		warnRestartRequired(c.Logger, "workers/batch_size")
+	}
+	if config.ForwardTableShards != old.ForwardTableShards {
+		warnRestartRequired(c.Logger, "forward_table_shards")
+	}
+	if config.UDPOffload != old.UDPOffload {
+		warnRestartRequired(c.Logger, "udp_offload")
+	}
+	if config.LatencySampleRate != old.LatencySampleRate {
+		warnRestartRequired(c.Logger, "latency_sample_rate")
+	}
+	if config.CaptureFile != old.CaptureFile || config.CaptureLimitPackets != old.CaptureLimitPackets {
+		warnRestartRequired(c.Logger, "capture_file/capture_limit_packets")
+	}
+	if config.MaxClients != old.MaxClients {
+		warnRestartRequired(c.Logger, "max_clients")
+	}
+	if config.ValidateWireGuard != old.ValidateWireGuard {
+		warnRestartRequired(c.Logger, "validate_wireguard")
+	}
+	if config.MetricsListen != old.MetricsListen {
+		warnRestartRequired(c.Logger, "metrics_listen")
+	}
+	if config.DebugListen != old.DebugListen || config.DebugAllowRemote != old.DebugAllowRemote {
+		warnRestartRequired(c.Logger, "debug_listen/debug_allow_remote")
+	}
+	if config.FwMark != old.FwMark {
+		warnRestartRequired(c.Logger, "fwmark")
+	}
+	if config.DSCP != old.DSCP || config.TTL != old.TTL {
+		warnRestartRequired(c.Logger, "dscp/ttl")
+	}
+	if config.PreserveTOS != old.PreserveTOS {
+		warnRestartRequired(c.Logger, "preserve_tos")
+	}
+	if config.PathMTUDiscovery != old.PathMTUDiscovery {
+		warnRestartRequired(c.Logger, "pmtu_discovery")
+	}
+	if config.RecvBuffer != old.RecvBuffer || config.SendBuffer != old.SendBuffer {
+		warnRestartRequired(c.Logger, "recv_buffer/send_buffer")
+	}
+	if config.BindDevice != old.BindDevice || config.BindAddress != old.BindAddress {
+		warnRestartRequired(c.Logger, "bind_device/bind_address")
+	}
+	if config.HopInterval != old.HopInterval {
+		warnRestartRequired(c.Logger, "hop_interval")
+	}
+	if config.NATKeepalive != old.NATKeepalive {
+		warnRestartRequired(c.Logger, "nat_keepalive")
+	}
+	if config.ResolveInterval != old.ResolveInterval || config.IPPreference != old.IPPreference {
+		warnRestartRequired(c.Logger, "resolve_interval/ip_preference")
+	}
+	if config.Preflight != old.Preflight {
+		warnRestartRequired(c.Logger, "preflight")
+	}
+	if config.Transport != old.Transport || !reflect.DeepEqual(config.WebSocket, old.WebSocket) ||
+		!reflect.DeepEqual(config.SOCKS5, old.SOCKS5) {
+		warnRestartRequired(c.Logger, "transport/websocket/socks5")
+	}
+	if !reflect.DeepEqual(config.ObfuscatePadding, old.ObfuscatePadding) {
+		warnRestartRequired(c.Logger, "obfs_padding")
+	}
+	if config.ObfuscateMode != old.ObfuscateMode {
+		warnRestartRequired(c.Logger, "obfs_mode")
+	}
+	if config.CacheFilePath != old.CacheFilePath {
+		warnRestartRequired(c.Logger, "cache_file_path")
+	}
+	if config.LogLevel != old.LogLevel || config.LogFormat != old.LogFormat {
+		warnRestartRequired(c.Logger, "log_level/log_format")
+	}
+
+	if config.Timeout != old.Timeout {
+		timeout := defaultTimeout
+		if config.Timeout > 0 {
+			timeout = time.Duration(config.Timeout)
+		}
+		c.wgitTable.SetTimeout(timeout)
+		applied.Timeout = config.Timeout
+		c.Logger.Infof("reload: timeout changed to %s", timeout)
+	}
+	if config.Trace != old.Trace {
+		c.wgitTable.SetTrace(config.Trace)
+		applied.Trace = config.Trace
+		c.Logger.Infof("reload: trace changed to %v", config.Trace)
+	}
+	if !reflect.DeepEqual(config.AllowedSources, old.AllowedSources) {
+		c.wgitTable.setAllowedSources(allowedSources)
+		applied.AllowedSources = config.AllowedSources
+		c.Logger.Infof("reload: allowed_sources changed")
+	}
+	applied.ObfuscateKey = config.ObfuscateKey
+	applied.ObfuscateSecondaryKeys = config.ObfuscateSecondaryKeys
+	applied.ObfuscateMinKeyLength = config.ObfuscateMinKeyLength
+	if !c.obfuscator.hasKey(obfuscateKey, obfuscateSecondaryKeys...) {
+		c.obfuscator.SetKey(obfuscateKey, obfuscateSecondaryKeys...)
+		c.Logger.Infof("reload: obfuscation key changed")
+		c.obfuscator.logKeyFingerprints(c.Logger, "client")
+		if c.preflight != nil {
+			c.preflight.reset()
+		}
+	}
+	c.config = &applied
+	return
+}
+
+// Sessions returns the active sessions, see WireGuardIndexTranslationTable.Snapshot().
+func (c *Client) Sessions() []SessionInfo {
+	return c.wgitTable.Snapshot()
+}
+
+// Stats returns a snapshot of the counters of the forward table.
+func (c *Client) Stats() (stats Stats) {
+	stats = c.wgitTable.Stats()
+	c.obfuscator.fillStats(&stats)
+	if c.failover != nil {
+		c.failover.fillStats(&stats)
+	}
 	return
 }
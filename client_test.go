@@ -0,0 +1,98 @@
+package mwgp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_Stop(t *testing.T) {
+	var pk NoisePublicKey
+	err := pk.FromBase64("mCXTsTRyjQKV74eWR2Ka1LIdIptCG9K0FXlrG2NC4EQ=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          "127.0.0.1:1",
+		Listen:          ListenAddresses{"127.0.0.1:0"},
+		ClientPublicKey: pk,
+		ServerPublicKey: pk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startErrChan := make(chan error, 1)
+	go func() {
+		startErrChan <- client.Start()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	_ = client.Stop()
+	_ = client.Stop()
+
+	select {
+	case err = <-startErrChan:
+		if err != nil {
+			t.Fatalf("Start() returned error after Stop(): %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() does not return after Stop()")
+	}
+
+	// the listen port should be released
+	conn, err := net.ListenUDP("udp", client.wgitTable.clientTransport.(*UDPTransport).Conn().LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("listen port is not released: %s", err.Error())
+	}
+	_ = conn.Close()
+}
+
+func TestSelectServerAddr(t *testing.T) {
+	addrs := []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1"), Port: 1000},
+		{IP: net.ParseIP("192.0.2.2"), Port: 1000},
+		{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+	}
+	cases := []struct {
+		current  *net.UDPAddr
+		failover bool
+		expected int
+	}{
+		{nil, false, 0},
+		{nil, true, 0},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}, false, 1},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}, true, 2},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}, true, 0},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1001}, false, 0},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 1000}, true, 0},
+	}
+	for i, c := range cases {
+		selected := selectServerAddr(addrs, c.current, c.failover)
+		if selected != addrs[c.expected] {
+			t.Errorf("case %d: expected %s, got %s", i, addrs[c.expected], selected)
+		}
+	}
+}
+
+func TestValidateDebugListen(t *testing.T) {
+	for _, c := range []struct {
+		listen      string
+		allowRemote bool
+		valid       bool
+	}{
+		{"", false, true},
+		{"127.0.0.1:6060", false, true},
+		{"[::1]:6060", false, true},
+		{"localhost:6060", false, true},
+		{":6060", false, false},
+		{"0.0.0.0:6060", false, false},
+		{"192.0.2.1:6060", false, false},
+		{":6060", true, true},
+	} {
+		err := validateDebugListen(c.listen, c.allowRemote)
+		if (err == nil) != c.valid {
+			t.Errorf("validateDebugListen(%q, %v) = %v, expected valid=%v", c.listen, c.allowRemote, err, c.valid)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package mwgp
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// Client ACL:
+//
+// The "allowed_clients" and "denied_clients" of mwgp-server are lists of addresses or CIDRs, IPv4 or IPv6.
+// A MessageInitiation from a client, which would create a new session, is dropped silently and counted
+// as the DeniedClientPackets if its source address is in the denied_clients, or not in the allowed_clients
+// unless it is empty. The IPv4-mapped IPv6 addresses are matched as IPv4.
+//
+// The established sessions are not checked per packet, only on Reload(), which evicts the ones not allowed anymore
+// and keeps the others. Each list is a binary trie of the prefixes, so a lookup is at most 32 or 128 steps
+// regardless of the length of the list.
+
+// prefixSet is a set of prefixes matching the addresses in any of them.
+type prefixSet struct {
+	v4 *prefixTrieNode
+	v6 *prefixTrieNode
+}
+
+type prefixTrieNode struct {
+	children [2]*prefixTrieNode
+
+	// end is set if a prefix ends at the node, all the addresses under it are in the set, and it has no children.
+	end bool
+}
+
+// addrBit returns the i-th bit of the address, from the most significant one.
+func addrBit(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-i%8)) & 1
+}
+
+func (s *prefixSet) add(prefix netip.Prefix) {
+	prefix = unmapPrefix(prefix).Masked()
+	root := &s.v6
+	if prefix.Addr().Is4() {
+		root = &s.v4
+	}
+	if *root == nil {
+		*root = &prefixTrieNode{}
+	}
+	addr := prefix.Addr().AsSlice()
+	node := *root
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.end {
+			// covered by a shorter prefix
+			return
+		}
+		b := addrBit(addr, i)
+		if node.children[b] == nil {
+			node.children[b] = &prefixTrieNode{}
+		}
+		node = node.children[b]
+	}
+	node.end = true
+	node.children = [2]*prefixTrieNode{}
+}
+
+// contains reports whether the addr is in any prefix of the set.
+func (s *prefixSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	node := s.v6
+	if addr.Is4() {
+		node = s.v4
+	}
+	var bytes [16]byte
+	if addr.Is4() {
+		v4 := addr.As4()
+		copy(bytes[:], v4[:])
+	} else {
+		bytes = addr.As16()
+	}
+	for i := 0; node != nil; i++ {
+		if node.end {
+			return true
+		}
+		if i >= addr.BitLen() {
+			return false
+		}
+		node = node.children[addrBit(bytes[:], i)]
+	}
+	return false
+}
+
+// parsePrefixSet parses the addresses or CIDRs of the option, nil if the list is empty.
+func parsePrefixSet(option string, list []string) (s *prefixSet, err error) {
+	if len(list) == 0 {
+		return
+	}
+	s = &prefixSet{}
+	for i, entry := range list {
+		var prefix netip.Prefix
+		if strings.Contains(entry, "/") {
+			prefix, err = netip.ParsePrefix(entry)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(entry)
+			if err == nil && addr.Zone() != "" {
+				err = fmt.Errorf("zone is not supported")
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid %s[%d] %q: %w", option, i, entry, err)
+			return
+		}
+		s.add(prefix)
+	}
+	return
+}
+
+// clientACL is the allowed_clients and denied_clients, see "Client ACL".
+type clientACL struct {
+	// allowed is nil to allow all the clients not denied.
+	allowed *prefixSet
+	denied  *prefixSet
+}
+
+// parseClientACL returns nil if both lists are empty.
+func parseClientACL(allowed []string, denied []string) (acl *clientACL, err error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return
+	}
+	acl = &clientACL{}
+	acl.allowed, err = parsePrefixSet("allowed_clients", allowed)
+	if err != nil {
+		return
+	}
+	acl.denied, err = parsePrefixSet("denied_clients", denied)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// permits reports whether the client at the addr is allowed, true if the acl is nil.
+func (acl *clientACL) permits(addr netip.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	if acl.denied != nil && acl.denied.contains(addr) {
+		return false
+	}
+	return acl.allowed == nil || acl.allowed.contains(addr)
+}
+
+// permitsUDPAddr is the permits for a *net.UDPAddr, false if it is not a valid address.
+func (acl *clientACL) permitsUDPAddr(src *net.UDPAddr) bool {
+	if acl == nil {
+		return true
+	}
+	if src == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(src.IP)
+	return ok && acl.permits(addr)
+}
+
+// setClientACL replaces the clientACL, which is checked by allowClientSource.
+func (t *WireGuardIndexTranslationTable) setClientACL(acl *clientACL) {
+	t.clientACL.Store(acl)
+}
+
+func (t *WireGuardIndexTranslationTable) loadClientACL() (acl *clientACL) {
+	acl, _ = t.clientACL.Load().(*clientACL)
+	return
+}
+
+// allowClientSource checks the source of the MessageInitiation packet from client with the clientACL.
+func (t *WireGuardIndexTranslationTable) allowClientSource(packet *Packet) bool {
+	if packet.MessageType() != device.MessageInitiationType {
+		return true
+	}
+	if t.loadClientACL().permitsUDPAddr(packet.Source) {
+		return true
+	}
+	atomic.AddUint64(&t.stats.deniedClientPackets, 1)
+	return false
+}
@@ -0,0 +1,107 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestClientACL(t *testing.T) {
+	acl, err := parseClientACL(
+		[]string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.7", "::ffff:203.0.113.0/120", "192.0.2.0/25"},
+		[]string{"192.0.2.128/25", "2001:db8:dead::/48"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, permitted := range map[string]bool{
+		"192.0.2.1":          true,
+		"192.0.2.127":        true,
+		"192.0.2.128":        false,
+		"::ffff:192.0.2.1":   true,
+		"::ffff:192.0.2.200": false,
+		"198.51.100.7":       true,
+		"198.51.100.8":       false,
+		"203.0.113.9":        true,
+		"2001:db8::1":        true,
+		"2001:db8:dead::1":   false,
+		"2001:db9::1":        false,
+		"10.0.0.1":           false,
+	} {
+		if acl.permits(netip.MustParseAddr(addr)) != permitted {
+			t.Errorf("expected %s permitted: %v", addr, permitted)
+		}
+	}
+
+	denyAll, _ := parseClientACL(nil, []string{"0.0.0.0/0"})
+	if denyAll.permits(netip.MustParseAddr("192.0.2.1")) || !denyAll.permits(netip.MustParseAddr("2001:db8::1")) {
+		t.Errorf("expected only the IPv4 clients denied by 0.0.0.0/0")
+	}
+	if acl, _ = parseClientACL(nil, nil); acl != nil || !acl.permits(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("expected all the clients permitted without the lists")
+	}
+	for _, invalid := range [][]string{{"192.0.2.0/33"}, {"example.com"}, {"fe80::1%eth0"}} {
+		if _, err = parseClientACL(invalid, nil); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestClientACL_Reload(t *testing.T) {
+	sk, serverPK := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	serverConfig := func(denied ...string) *ServerConfig {
+		return &ServerConfig{
+			Listen: ListenAddresses{"127.0.0.1:0"},
+			Servers: []*ServerConfigServer{{
+				PrivateKey: &sk,
+				Peers:      []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820", ClientPublicKey: &clientPK}},
+			}},
+			AllowedClients: []string{"192.0.2.0/24"},
+			DeniedClients:  denied,
+		}
+	}
+	server, err := NewServerWithConfig(serverConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Logger = NewStdLogger(LogLevelError)
+	table := server.wgitTable
+	table.Logger = server.Logger
+
+	initiation := func(src string) *Packet {
+		packet := &Packet{Data: make([]byte, device.MessageInitiationSize), Length: device.MessageInitiationSize}
+		binary.LittleEndian.PutUint32(packet.Data, device.MessageInitiationType)
+		packet.Source = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(src))
+		return packet
+	}
+	if !table.allowClientSource(initiation("192.0.2.1:1000")) || table.allowClientSource(initiation("198.51.100.1:1000")) {
+		t.Errorf("expected only the allowed clients accepted")
+	}
+	if stats := table.Stats(); stats.DeniedClientPackets != 1 {
+		t.Errorf("expected 1 denied packet, got %d", stats.DeniedClientPackets)
+	}
+
+	for i, src := range []string{"192.0.2.1:1000", "192.0.2.2:1000"} {
+		peer := &Peer{
+			clientPublicKey:   clientPK,
+			serverPublicKey:   serverPK,
+			clientProxyIndex:  uint32(0x1000 + i),
+			clientDestination: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(src)),
+			serverDestination: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820},
+			sessionID:         newSessionID(),
+		}
+		table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	}
+	if err = server.Reload(serverConfig("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.clientMap.loadLocked(0x1000); table.clientMap.lenLocked() != 1 || !ok {
+		t.Errorf("expected only the session from the denied client evicted, got %d sessions", table.clientMap.lenLocked())
+	}
+	if table.allowClientSource(initiation("192.0.2.2:1000")) {
+		t.Errorf("expected the new denied_clients applied")
+	}
+}
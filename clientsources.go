@@ -0,0 +1,86 @@
+package mwgp
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+)
+
+// Client Sources:
+//
+// mwgp-client relays the packets from any source reaching its listen address with its keys, so an exposed listen port
+// would turn it into an open relay. The "allowed_sources" of mwgp-client is a list of the addresses or CIDRs
+// the packets are accepted from, only the loopback addresses (127.0.0.0/8 and ::1) if it is empty.
+// All the packets from the other sources, not only the handshakes, are dropped silently before they are handled,
+// and counted as the DeniedSourcePackets. Set it to ["0.0.0.0/0", "::/0"] to accept the packets from anywhere.
+//
+// The "max_clients" of mwgp-client caps the number of the distinct source addresses (IP and port) in the forward
+// table, each one is a WireGuard instance forwarded by mwgp-client. Once it is reached, a MessageInitiation from
+// a new source address is dropped and counted as the ClientsRejected, until the sessions of another one expire.
+// The sessions of the existing source addresses are not limited by it.
+
+// defaultAllowedSources is the allowed_sources if it is empty.
+var defaultAllowedSources = []string{"127.0.0.0/8", "::1"}
+
+// parseAllowedSources parses the allowed_sources, the defaultAllowedSources if it is empty.
+func parseAllowedSources(list []string) (s *prefixSet, err error) {
+	if len(list) == 0 {
+		list = defaultAllowedSources
+	}
+	s, err = parsePrefixSet("allowed_sources", list)
+	return
+}
+
+// validateMaxClients checks the max_clients.
+func validateMaxClients(maxClients int) (err error) {
+	if maxClients < 0 {
+		err = fmt.Errorf("max_clients must not be negative")
+	}
+	return
+}
+
+// setAllowedSources replaces the allowed_sources, which is checked by allowSource.
+func (t *WireGuardIndexTranslationTable) setAllowedSources(s *prefixSet) {
+	t.allowedSources.Store(s)
+}
+
+// allowSource checks the source of any packet from client with the allowed_sources, true if it is not set.
+func (t *WireGuardIndexTranslationTable) allowSource(packet *Packet) bool {
+	s, _ := t.allowedSources.Load().(*prefixSet)
+	if s == nil {
+		return true
+	}
+	if packet.Source != nil {
+		if addr, ok := netip.AddrFromSlice(packet.Source.IP); ok && s.contains(addr) {
+			return true
+		}
+	}
+	atomic.AddUint64(&t.stats.deniedSourcePackets, 1)
+	return false
+}
+
+// acceptsClientSourceLocked reports whether a new session from the src is allowed by the MaxClients,
+// which is true if there is a session from the src already. The mapLock must be held.
+func (t *WireGuardIndexTranslationTable) acceptsClientSourceLocked(src netip.AddrPort) bool {
+	if t.MaxClients <= 0 {
+		return true
+	}
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	sources := make(map[netip.AddrPort]struct{}, t.MaxClients)
+	found := false
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		destination := peer.clientAddr()
+		if destination == nil {
+			return true
+		}
+		source := destination.AddrPort()
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		if source == src {
+			found = true
+			return false
+		}
+		sources[source] = struct{}{}
+		return true
+	})
+	return found || len(sources) < t.MaxClients
+}
@@ -0,0 +1,100 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_AllowSource(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	newPacket := func(messageType uint32, src string) *Packet {
+		packet := table.obtainPacket()
+		packet.Length = device.MessageInitiationSize
+		binary.LittleEndian.PutUint32(packet.Data, messageType)
+		packet.Source = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(src))
+		return packet
+	}
+	if !table.allowSource(newPacket(device.MessageInitiationType, "192.0.2.1:1000")) {
+		t.Errorf("expected all the sources allowed without allowed_sources")
+	}
+
+	allowed, err := parseAllowedSources(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.setAllowedSources(allowed)
+	for _, src := range []string{"127.0.0.1:1000", "127.1.2.3:1000", "[::ffff:127.0.0.1]:1000", "[::1]:1000"} {
+		if !table.allowSource(newPacket(device.MessageInitiationType, src)) {
+			t.Errorf("expected %s allowed by default", src)
+		}
+	}
+
+	// the spoofed sources are dropped before they are handled, the transport messages as well
+	spoofed := []string{"192.0.2.1:1000", "10.0.0.1:1000", "192.168.1.2:51820", "[::ffff:192.0.2.1]:1000", "[2001:db8::1]:1000", "[fe80::1]:1000"}
+	for _, src := range spoofed {
+		table.dispatchClientPacket(newPacket(device.MessageInitiationType, src))
+		table.dispatchClientPacket(newPacket(device.MessageTransportType, src))
+	}
+	if stats := table.Stats(); stats.DeniedSourcePackets != uint64(2*len(spoofed)) || stats.DroppedPackets != uint64(2*len(spoofed)) {
+		t.Errorf("expected %d denied packets, got %d denied and %d dropped", 2*len(spoofed), stats.DeniedSourcePackets, stats.DroppedPackets)
+	}
+
+	allowed, err = parseAllowedSources([]string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.setAllowedSources(allowed)
+	if !table.allowSource(newPacket(device.MessageTransportType, "192.168.1.2:51820")) ||
+		table.allowSource(newPacket(device.MessageTransportType, "127.0.0.1:1000")) {
+		t.Errorf("expected only the allowed_sources allowed once it is set")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_MaxClients(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = time.Minute
+	table.Logger = NewStdLogger(LogLevelError)
+	table.MaxClients = 2
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820}}
+		return
+	}
+	var sender uint32
+	for _, step := range []struct {
+		src      string
+		accepted bool
+	}{
+		{"127.0.0.1:1000", true},
+		{"127.0.0.1:1000", true},
+		{"[::ffff:127.0.0.2]:1000", true},
+		{"127.0.0.2:1000", true},
+		// the spoofed sources cannot take more room in the forward table
+		{"127.0.0.3:1000", false},
+		{"127.0.0.1:1001", false},
+		{"[::1]:1000", false},
+	} {
+		sender++
+		src := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(step.src))
+		if _, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: sender}); (err == nil) != step.accepted {
+			t.Errorf("%s: expected accepted: %v, got %v", step.src, step.accepted, err)
+		}
+	}
+	if stats := table.Stats(); stats.ClientsRejected != 3 || stats.ActiveSessions != 4 {
+		t.Errorf("expected 3 clients rejected with 4 sessions, got %d with %d", stats.ClientsRejected, stats.ActiveSessions)
+	}
+
+	// room for another client once the sessions of a client are gone
+	table.removePeers(func(peer *Peer) bool {
+		return peer.clientDestination.Port == 1000 && peer.clientDestination.IP.Equal(net.IPv4(127, 0, 0, 1))
+	}, "test")
+	if _, err := table.processClientMessageInitiation(net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.3:1000")), nil,
+		&device.MessageInitiation{Sender: 0x1000}); err != nil {
+		t.Errorf("expected a new client accepted after the sessions of another one are removed: %v", err)
+	}
+}
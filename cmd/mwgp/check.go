@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var checkCmd = cobra.Command{
+	Use:     "check -c config.json",
+	Short:   "Validate a server or client config without starting it",
+	Long:    "Validate a server or client config with all the checks done at the startup, without binding any socket, and print every problem found.",
+	Example: "mwgp check -c config.json",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		configPath, _ := cmd.Flags().GetString("config")
+		if configPath == "" {
+			err = fmt.Errorf("excepted a config file with -c")
+			return
+		}
+		err = checkConfig(configPath)
+		return
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	checkCmd.Flags().StringP("config", "c", "", "config file path")
+	rootCmd.AddCommand(&checkCmd)
+}
+
+// readServerOrClientConfig reads a client config or a server config,
+// told by the keys only in the client config.
+func readServerOrClientConfig(configPath string) (serverConfig *mwgp.ServerConfig, clientConfig *mwgp.ClientConfig, err error) {
+	var keys map[string]interface{}
+	err = readConfig(configPath, &keys)
+	if err != nil {
+		return
+	}
+	for _, key := range []string{"server", "client_pubkey", "server_pubkey"} {
+		if _, ok := keys[key]; ok {
+			clientConfig = &mwgp.ClientConfig{}
+			err = readConfig(configPath, clientConfig)
+			return
+		}
+	}
+	serverConfig = &mwgp.ServerConfig{}
+	err = readConfig(configPath, serverConfig)
+	return
+}
+
+func checkConfig(configPath string) (err error) {
+	kind := "server"
+	serverConfig, clientConfig, err := readServerOrClientConfig(configPath)
+	if err == nil {
+		if clientConfig != nil {
+			kind = "client"
+			err = clientConfig.Validate()
+		} else {
+			err = serverConfig.Validate()
+		}
+	}
+	if err != nil {
+		var problems mwgp.ConfigErrors
+		if !errors.As(err, &problems) {
+			problems = mwgp.ConfigErrors{err}
+		}
+		for _, problem := range problems {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", problem.Error())
+		}
+		err = fmt.Errorf("%d problem(s) found in %s config %s", len(problems), kind, configPath)
+		return
+	}
+	fmt.Printf("%s config %s is valid\n", kind, configPath)
+	return
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"github.com/spf13/cobra"
+)
+
+var checkObfsCmd = cobra.Command{
+	Use:     "check-obfs config.json",
+	Short:   "Self-test the obfuscation settings and print the key fingerprints",
+	Long:    "Self-test the obfuscation settings in a server or client config, and print the key fingerprints to be compared with the other end.",
+	Example: "mwgp check-obfs config.json",
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) != 1 {
+			err = fmt.Errorf("excepted 1 argument as config file")
+			return
+		}
+		err = checkObfs(args[0])
+		return
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(&checkObfsCmd)
+}
+
+// obfsConfig is the obfuscation options shared by the server and client config.
+type obfsConfig struct {
+	ObfuscateKey           string
+	ObfuscateSecondaryKeys []string
+	ObfuscateMode          string
+	ObfuscateMinKeyLength  int
+	ObfuscatePadding       *mwgp.ObfuscatePaddingConfig
+}
+
+func readObfsConfig(configPath string) (config obfsConfig, err error) {
+	serverConfig, clientConfig, err := readServerOrClientConfig(configPath)
+	if err != nil {
+		return
+	}
+	if clientConfig != nil {
+		config = obfsConfig{clientConfig.ObfuscateKey, clientConfig.ObfuscateSecondaryKeys, clientConfig.ObfuscateMode,
+			clientConfig.ObfuscateMinKeyLength, clientConfig.ObfuscatePadding}
+	} else {
+		config = obfsConfig{serverConfig.ObfuscateKey, serverConfig.ObfuscateSecondaryKeys, serverConfig.ObfuscateMode,
+			serverConfig.ObfuscateMinKeyLength, serverConfig.ObfuscatePadding}
+	}
+	return
+}
+
+func checkObfs(configPath string) (err error) {
+	config, err := readObfsConfig(configPath)
+	if err != nil {
+		return
+	}
+
+	key, err := mwgp.ParseObfuscateKey(config.ObfuscateKey)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs: %w", err)
+		return
+	}
+	if len(key) == 0 {
+		err = fmt.Errorf("obfuscation is not enabled in %s", configPath)
+		return
+	}
+	minKeyLength := mwgp.ObfuscatorMinKeyLength(config.ObfuscateMinKeyLength)
+	obfuscator, err := mwgp.NewWireGuardObfuscator(string(key), minKeyLength)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs: %w", err)
+		return
+	}
+	fmt.Printf("protocol version: %d\n", mwgp.ObfuscateProtocolVersion)
+	fmt.Printf("key fingerprint: %s\n", obfuscator.KeyFingerprint())
+	if werr := mwgp.ValidateObfuscationKey(config.ObfuscateKey); werr != nil {
+		fmt.Printf("warning: %s\n", werr.Error())
+	}
+	for i, sk := range config.ObfuscateSecondaryKeys {
+		var secondaryKey []byte
+		secondaryKey, err = mwgp.ParseObfuscateKey(sk)
+		if err != nil {
+			err = fmt.Errorf("invalid obfs_secondary[%d]: %w", i, err)
+			return
+		}
+		var secondary *mwgp.WireGuardObfuscator
+		secondary, err = mwgp.NewWireGuardObfuscator(string(secondaryKey), minKeyLength)
+		if err != nil {
+			err = fmt.Errorf("invalid obfs_secondary[%d]: %w", i, err)
+			return
+		}
+		fmt.Printf("secondary key fingerprint: %s\n", secondary.KeyFingerprint())
+		if werr := mwgp.ValidateObfuscationKey(sk); werr != nil {
+			fmt.Printf("warning: %s\n", werr.Error())
+		}
+	}
+
+	switch config.ObfuscateMode {
+	case "", mwgp.ObfuscateModeXOR:
+		fmt.Printf("mode: %s\n", mwgp.ObfuscateModeXOR)
+	case mwgp.ObfuscateModeAuthenticated:
+		obfuscator.Authenticated = true
+		fmt.Printf("mode: %s\n", mwgp.ObfuscateModeAuthenticated)
+	default:
+		err = fmt.Errorf("invalid obfs_mode %q", config.ObfuscateMode)
+		return
+	}
+	obfuscator.Padding = config.ObfuscatePadding
+
+	err = obfuscator.SelfTest()
+	if err != nil {
+		err = fmt.Errorf("self-test failed: %w", err)
+		return
+	}
+	fmt.Printf("self-test passed\n")
+	return
+}
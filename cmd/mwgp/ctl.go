@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net/netip"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var ctlCmd = cobra.Command{
+	Use:   "ctl -s control.sock command",
+	Short: "Inspect and manage a running mwgp server through its control_socket",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = fmt.Errorf("excepted a command")
+		return
+	},
+	SilenceUsage: true,
+}
+
+var ctlSessionsCmd = cobra.Command{
+	Use:   "sessions",
+	Short: "List the active sessions",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var sessions []mwgp.SessionInfo
+		err = callControlSocket("sessions", nil, &sessions)
+		if err != nil {
+			return
+		}
+		printSessions(sessions)
+		return
+	},
+}
+
+var ctlKickCmd = cobra.Command{
+	Use:     "kick [session-id] [--peer pubkey] [--client address/cidr] [--idle duration]",
+	Short:   "Evict the sessions matching all the conditions given, the clients handshake again as new ones",
+	Example: "mwgp ctl kick 1a2b3c4d\nmwgp ctl kick --peer <client pubkey>\nmwgp ctl kick --client 192.0.2.0/24 --idle 10m",
+	Args:    cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var params mwgp.ControlKickParams
+		if len(args) > 0 {
+			params.SessionID = args[0]
+		}
+		if peer, _ := cmd.Flags().GetString("peer"); peer != "" {
+			params.PeerID = &mwgp.NoisePublicKey{}
+			err = params.PeerID.FromBase64(peer)
+			if err != nil {
+				err = fmt.Errorf("invalid peer pubkey %s: %w", peer, err)
+				return
+			}
+		}
+		params.ClientAddress, _ = cmd.Flags().GetString("client")
+		idle, _ := cmd.Flags().GetDuration("idle")
+		params.IdleLongerThan = mwgp.Duration(idle)
+		var result mwgp.ControlKickResult
+		err = callControlSocket("kick", &params, &result)
+		if err != nil {
+			return
+		}
+		fmt.Printf("%d session(s) evicted\n", result.Evicted)
+		return
+	},
+}
+
+var ctlAddPeerCmd = cobra.Command{
+	Use:     "add-peer server-pubkey peer.json",
+	Short:   "Add a peer to the server, until the next reload",
+	Example: `mwgp ctl add-peer <server pubkey> '{"pubkey": "<client pubkey>", "forward_to": "192.0.2.1:51820"}'`,
+	Args:    cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		params := mwgp.ControlPeerParams{Peer: &mwgp.ServerConfigPeer{}}
+		err = params.ServerPublicKey.FromBase64(args[0])
+		if err != nil {
+			err = fmt.Errorf("invalid server pubkey %s: %w", args[0], err)
+			return
+		}
+		err = json.Unmarshal([]byte(args[1]), params.Peer)
+		if err != nil {
+			err = fmt.Errorf("invalid peer: %w", err)
+			return
+		}
+		err = callControlSocket("add_peer", &params, nil)
+		return
+	},
+}
+
+var ctlRemovePeerCmd = cobra.Command{
+	Use:   "remove-peer server-pubkey [client-pubkey]",
+	Short: "Remove a peer from the server, the fallback peer without client-pubkey, until the next reload",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var params mwgp.ControlPeerParams
+		err = params.ServerPublicKey.FromBase64(args[0])
+		if err != nil {
+			err = fmt.Errorf("invalid server pubkey %s: %w", args[0], err)
+			return
+		}
+		if len(args) > 1 {
+			params.ClientPublicKey = &mwgp.NoisePublicKey{}
+			err = params.ClientPublicKey.FromBase64(args[1])
+			if err != nil {
+				err = fmt.Errorf("invalid client pubkey %s: %w", args[1], err)
+				return
+			}
+		}
+		err = callControlSocket("remove_peer", &params, nil)
+		return
+	},
+}
+
+var ctlBansCmd = cobra.Command{
+	Use:   "bans",
+	Short: "List the source IPs banned by the probe_ban",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var bans []mwgp.ProbeBan
+		err = callControlSocket("bans", nil, &bans)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintf(w, "SOURCE\tREMAINING\n")
+		for _, b := range bans {
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", b.Source, b.BannedUntil.Sub(now).Truncate(time.Second))
+		}
+		_ = w.Flush()
+		return
+	},
+}
+
+var ctlUnbanCmd = cobra.Command{
+	Use:   "unban source-ip",
+	Short: "Lift the ban of a source IP by the probe_ban",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var params mwgp.ControlUnbanParams
+		params.Source, err = netip.ParseAddr(args[0])
+		if err != nil {
+			err = fmt.Errorf("invalid source IP %s: %w", args[0], err)
+			return
+		}
+		err = callControlSocket("unban", &params, nil)
+		return
+	},
+}
+
+var ctlReloadCmd = cobra.Command{
+	Use:   "reload",
+	Short: "Reload the config file, the same as SIGHUP",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = callControlSocket("reload", nil, nil)
+		return
+	},
+}
+
+var ctlStatsCmd = cobra.Command{
+	Use:   "stats",
+	Short: "Dump the stats as JSON",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var stats json.RawMessage
+		err = callControlSocket("stats", nil, &stats)
+		if err != nil {
+			return
+		}
+		var b []byte
+		b, err = json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return
+		}
+		fmt.Println(string(b))
+		return
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{&ctlSessionsCmd, &ctlKickCmd, &ctlAddPeerCmd, &ctlRemovePeerCmd, &ctlBansCmd, &ctlUnbanCmd, &ctlReloadCmd, &ctlStatsCmd} {
+		cmd.SilenceUsage = true
+		ctlCmd.AddCommand(cmd)
+	}
+	ctlKickCmd.Flags().String("peer", "", "evict the sessions of the client pubkey")
+	ctlKickCmd.Flags().String("client", "", "evict the sessions from the client address or CIDR")
+	ctlKickCmd.Flags().Duration("idle", 0, "evict the sessions idle longer than it")
+	ctlCmd.PersistentFlags().StringP("socket", "s", "", "control_socket path of the server")
+	_ = viper.BindPFlag("control-socket", ctlCmd.PersistentFlags().Lookup("socket"))
+	_ = viper.BindEnv("control-socket", "MWGP_CONTROL_SOCKET")
+	rootCmd.AddCommand(&ctlCmd)
+}
+
+func callControlSocket(method string, params interface{}, result interface{}) (err error) {
+	path := viper.GetString("control-socket")
+	if path == "" {
+		err = fmt.Errorf("excepted the control_socket path with -s")
+		return
+	}
+	err = mwgp.CallControlSocket(path, method, params, result)
+	return
+}
+
+func printSessions(sessions []mwgp.SessionInfo) {
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "SESSION\tPEER\tCLIENT\tUPSTREAM\tAGE\tIDLE\tRX BYTES\tTX BYTES\n")
+	for _, s := range sessions {
+		age := "-"
+		if !s.CreatedAt.IsZero() {
+			age = now.Sub(s.CreatedAt).Truncate(time.Second).String()
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", s.SessionID, s.PeerID, s.ClientAddress, s.UpstreamAddress,
+			age, now.Sub(s.LastActiveAt).Truncate(time.Second), s.ClientToServerBytes, s.ServerToClientBytes)
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"github.com/spf13/cobra"
+)
+
+var genKeyCmd = cobra.Command{
+	Use:     "genkey",
+	Aliases: []string{"genpsk"},
+	Short:   "Generate a random obfuscation key",
+	Long:    "Generate a random obfuscation key of 32 bytes, and print it in base64 to be used as obfs of both ends.",
+	Example: "mwgp genkey > obfs.key",
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) != 0 {
+			err = fmt.Errorf("excepted no argument")
+			return
+		}
+		key, err := mwgp.GenerateObfuscationKey()
+		if err != nil {
+			return
+		}
+		fmt.Println(key)
+		return
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(&genKeyCmd)
+}
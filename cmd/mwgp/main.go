@@ -2,14 +2,15 @@ package main
 
 import (
 	"fmt"
-	"github.com/flynn/json5"
 	"github.com/haruue-net/mwgp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	_ "github.com/haruue-net/mwgp/resolvers/dns"
 	_ "github.com/haruue-net/mwgp/resolvers/hn2etxt"
@@ -21,7 +22,7 @@ var (
 
 var rootCmd = cobra.Command{
 	Use:     "mwgp",
-	Version: MWGPVersion,
+	Version: fmt.Sprintf("%s (obfs protocol v%d)", MWGPVersion, mwgp.ObfuscateProtocolVersion),
 }
 
 var serverCmd = cobra.Command{
@@ -59,14 +60,24 @@ var clientCmd = cobra.Command{
 	},
 }
 
-func ensureCacheConfig(cc *mwgp.WGITCacheConfig, instanceSuffix string) {
+// newLogger creates the logger used before the server or client is created,
+// an invalid option is reported by mwgp.New{Server,Client}WithConfig.
+func newLogger(logLevel, logFormat string) mwgp.Logger {
+	logger, err := mwgp.NewLogger(logLevel, logFormat)
+	if err != nil {
+		logger = mwgp.NewStdLogger(mwgp.LogLevelInfo)
+	}
+	return logger
+}
+
+func ensureCacheConfig(logger mwgp.Logger, cc *mwgp.WGITCacheConfig, instanceSuffix string) {
 	if viper.GetBool("no-cache") {
-		log.Printf("[info] forward table cache has been disabled\n")
+		logger.Infof("forward table cache has been disabled")
 		cc.CacheFilePath = ""
 		return
 	}
 	if viper.GetBool("skip-load-cache") {
-		log.Printf("[info] forward table cache loading is disabled\n")
+		logger.Infof("forward table cache loading is disabled")
 		cc.SkipLoadCache = true
 		return
 	}
@@ -82,10 +93,10 @@ func ensureCacheConfig(cc *mwgp.WGITCacheConfig, instanceSuffix string) {
 		defaultCacheDir = filepath.Join(defaultCacheDir, "mwgp")
 		err = os.MkdirAll(defaultCacheDir, 0755)
 		if err != nil {
-			log.Printf("[error] forward table cache path not set and cannot create default cache dir at %s, forward table cache will be disabled: %s\n", defaultCacheDir, err.Error())
+			logger.Errorf("forward table cache path not set and cannot create default cache dir at %s, forward table cache will be disabled: %s", defaultCacheDir, err.Error())
 		}
 		cc.CacheFilePath = filepath.Join(defaultCacheDir, fmt.Sprintf("wgit-cache-%s.json", instanceSuffix))
-		log.Printf("[warn] forward table cache path not set, using %s\n", cc.CacheFilePath)
+		logger.Warnf("forward table cache path not set, using %s", cc.CacheFilePath)
 	}
 }
 
@@ -96,54 +107,116 @@ func init() {
 	rootCmd.PersistentFlags().String("cache-file", "", "forward table cache file path")
 	rootCmd.PersistentFlags().Bool("no-cache", false, "disable forward table cache")
 	rootCmd.PersistentFlags().Bool("skip-load-cache", false, "skip loading forward table cache (but still save it)")
+	rootCmd.PersistentFlags().String("format", "", "config file format, json, yaml or toml, detected by the file extension if not set")
+	rootCmd.PersistentFlags().Bool("expand-env", false, "replace ${VAR} and ${VAR:-default} in the config values with the environment variables")
 
 	_ = viper.BindPFlag("cache-file", rootCmd.PersistentFlags().Lookup("cache-file"))
 	_ = viper.BindPFlag("no-cache", rootCmd.PersistentFlags().Lookup("no-cache"))
 	_ = viper.BindPFlag("skip-load-cache", rootCmd.PersistentFlags().Lookup("skip-load-cache"))
+	_ = viper.BindPFlag("format", rootCmd.PersistentFlags().Lookup("format"))
+	_ = viper.BindPFlag("expand-env", rootCmd.PersistentFlags().Lookup("expand-env"))
 
 	_ = viper.BindEnv("cache-file", "MWGP_CACHE_FILE")
 	_ = viper.BindEnv("no-cache", "MWGP_NO_CACHE")
 	_ = viper.BindEnv("skip-load-cache", "MWGP_SKIP_LOAD_CACHE")
+	_ = viper.BindEnv("format", "MWGP_CONFIG_FORMAT")
+	_ = viper.BindEnv("expand-env", "MWGP_EXPAND_ENV")
 
 	viper.AutomaticEnv()
 }
 
-func startServer(configPath string) (err error) {
-	config, err := ioutil.ReadFile(configPath)
+// readConfig reads the config file in the format of the --format flag, or by its extension,
+// and expands the environment variables in it with --expand-env.
+func readConfig(configPath string, config interface{}) (err error) {
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return
+	}
+	format := viper.GetString("format")
+	if format == "" {
+		format = mwgp.ConfigFormatOf(configPath)
+	}
+	if viper.GetBool("expand-env") {
+		err = mwgp.UnmarshalConfigWithEnv(configBytes, format, config, nil)
+		return
+	}
+	err = mwgp.UnmarshalConfig(configBytes, format, config)
+	return
+}
+
+func loadServerConfig(configPath string) (serverConfig *mwgp.ServerConfig, err error) {
+	serverConfig = &mwgp.ServerConfig{}
+	err = readConfig(configPath, serverConfig)
 	if err != nil {
 		return
 	}
-	serverConfig := mwgp.ServerConfig{}
-	err = json5.Unmarshal(config, &serverConfig)
+	ensureCacheConfig(newLogger(serverConfig.LogLevel, serverConfig.LogFormat), &serverConfig.WGITCacheConfig, serverConfig.Listen.String())
+	return
+}
+
+func startServer(configPath string) (err error) {
+	serverConfig, err := loadServerConfig(configPath)
 	if err != nil {
 		return
 	}
-	ensureCacheConfig(&serverConfig.WGITCacheConfig, serverConfig.Listen)
-	server, err := mwgp.NewServerWithConfig(&serverConfig)
+	server, err := mwgp.NewServerWithConfig(serverConfig)
 	if err != nil {
 		return
 	}
+	server.SandboxPaths = []string{configPath}
+	server.ReloadFunc = func() (err error) {
+		serverConfig, err := loadServerConfig(configPath)
+		if err != nil {
+			return
+		}
+		return server.Reload(serverConfig)
+	}
+	go reloadOnSIGHUP(server.Logger, server.ReloadFunc)
+	go drainOnSIGUSR1(server.Logger, server.Drain)
 	return server.Start()
 }
 
-func startClient(configPath string) (err error) {
-	config, err := ioutil.ReadFile(configPath)
+func loadClientConfig(configPath string) (clientConfig *mwgp.ClientConfig, err error) {
+	clientConfig = &mwgp.ClientConfig{}
+	err = readConfig(configPath, clientConfig)
 	if err != nil {
 		return
 	}
-	clientConfig := mwgp.ClientConfig{}
-	err = json5.Unmarshal(config, &clientConfig)
+	ensureCacheConfig(newLogger(clientConfig.LogLevel, clientConfig.LogFormat), &clientConfig.WGITCacheConfig, clientConfig.Listen.String())
+	return
+}
+
+func startClient(configPath string) (err error) {
+	clientConfig, err := loadClientConfig(configPath)
 	if err != nil {
 		return
 	}
-	ensureCacheConfig(&clientConfig.WGITCacheConfig, clientConfig.Listen)
-	client, err := mwgp.NewClientWithConfig(&clientConfig)
+	client, err := mwgp.NewClientWithConfig(clientConfig)
 	if err != nil {
 		return
 	}
+	go reloadOnSIGHUP(client.Logger, func() (err error) {
+		clientConfig, err := loadClientConfig(configPath)
+		if err != nil {
+			return
+		}
+		return client.Reload(clientConfig)
+	})
 	return client.Start()
 }
 
+func reloadOnSIGHUP(logger mwgp.Logger, reload func() (err error)) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		logger.Infof("SIGHUP received, reloading config ...")
+		err := reload()
+		if err != nil {
+			logger.Errorf("failed to reload config, the running config is kept: %s", err.Error())
+		}
+	}
+}
+
 func main() {
 	err := rootCmd.Execute()
 	if err != nil {
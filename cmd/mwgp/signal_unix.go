@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/haruue-net/mwgp"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// drainOnSIGUSR1 calls the drain func once SIGUSR1 is received.
+func drainOnSIGUSR1(logger mwgp.Logger, drain func()) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	<-sigChan
+	signal.Stop(sigChan)
+	logger.Infof("SIGUSR1 received, draining ...")
+	drain()
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import (
+	"github.com/haruue-net/mwgp"
+)
+
+// drainOnSIGUSR1 does nothing, there is no SIGUSR1 on Windows.
+func drainOnSIGUSR1(logger mwgp.Logger, drain func()) {
+}
@@ -0,0 +1,108 @@
+package mwgp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expandConfigEnv replaces the ${VAR} in the string values (not the keys) of the decoded config values,
+// the path is the location of the values in the config for the error messages.
+func expandConfigEnv(values interface{}, path string, lookupEnv func(key string) (string, bool)) (expanded interface{}, err error) {
+	switch v := values.(type) {
+	case string:
+		expanded, err = expandEnv(v, lookupEnv)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", strings.TrimPrefix(path, "."), err)
+			return
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// report the first error in a stable order
+		sort.Strings(keys)
+		for _, key := range keys {
+			v[key], err = expandConfigEnv(v[key], path+"."+key, lookupEnv)
+			if err != nil {
+				return
+			}
+		}
+		expanded = v
+	case []interface{}:
+		for i := range v {
+			v[i], err = expandConfigEnv(v[i], fmt.Sprintf("%s[%d]", path, i), lookupEnv)
+			if err != nil {
+				return
+			}
+		}
+		expanded = v
+	default:
+		expanded = values
+	}
+	return
+}
+
+// expandEnv replaces ${VAR} in s with the environment variable, which must be set,
+// and ${VAR:-default} with the default if the environment variable is unset or empty.
+// $$ is a literal $, and a $ not followed by { or $ is kept as-is.
+func expandEnv(s string, lookupEnv func(key string) (string, bool)) (expanded string, err error) {
+	if !strings.Contains(s, "$") {
+		expanded = s
+		return
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				err = fmt.Errorf("unterminated ${ in %q", s)
+				return
+			}
+			expr := s[i+2 : i+2+end]
+			i += 2 + end
+			name, defaultValue, hasDefault := strings.Cut(expr, ":-")
+			if !isEnvName(name) {
+				err = fmt.Errorf("invalid environment variable name %q in %q", name, s)
+				return
+			}
+			value, ok := lookupEnv(name)
+			switch {
+			case hasDefault && value == "":
+				value = defaultValue
+			case !ok:
+				err = fmt.Errorf("environment variable %s is not set", name)
+				return
+			}
+			sb.WriteString(value)
+		default:
+			sb.WriteByte('$')
+		}
+	}
+	expanded = sb.String()
+	return
+}
+
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
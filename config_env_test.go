@@ -0,0 +1,132 @@
+package mwgp
+
+import (
+	"strings"
+	"testing"
+)
+
+func testLookupEnv(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (value string, ok bool) {
+		value, ok = env[key]
+		return
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	lookupEnv := testLookupEnv(map[string]string{"HOST": "example.com", "EMPTY": "", "DOLLAR": "$HOST"})
+	for input, expected := range map[string]string{
+		"":                          "",
+		"${HOST}:27015":             "example.com:27015",
+		"${HOST}${HOST}":            "example.comexample.com",
+		"${PORT:-27015}":            "27015",
+		"${EMPTY:-default}":         "default",
+		"${EMPTY}":                  "",
+		"${HOST:-default}":          "example.com",
+		"${PORT:-}":                 "",
+		"${PORT:-a:-b}":             "a:-b",
+		"pa$$word":                  "pa$word",
+		"$${HOST}":                  "${HOST}",
+		"$$$${HOST}":                "$${HOST}",
+		"pa$word$":                  "pa$word$",
+		"${DOLLAR}":                 "$HOST",
+		"price: $5, host: ${HOST}.": "price: $5, host: example.com.",
+	} {
+		output, err := expandEnv(input, lookupEnv)
+		if err != nil || output != expected {
+			t.Errorf("expected %q expanded to %q, got %q (%v)", input, expected, output, err)
+		}
+	}
+	for _, input := range []string{"${PORT}", "${HOST", "${}", "${1HOST}", "${HO-ST}", "${HOST:default}"} {
+		if output, err := expandEnv(input, lookupEnv); err == nil {
+			t.Errorf("expected %q to be rejected, got %q", input, output)
+		}
+	}
+}
+
+func TestUnmarshalConfigWithEnv(t *testing.T) {
+	lookupEnv := testLookupEnv(map[string]string{
+		"MWGP_LISTEN":   "0.0.0.0:1999",
+		"MWGP_UPSTREAM": "192.0.2.2",
+		"MWGP_PEER_KEY": "DWcOygSJTBokgg2/OIL9EYhErtn5o84+K9tzWseh+ZI=",
+		"MWGP_OBFS_KEY": "pa$$word from env",
+		"MWGP_PRIV_KEY": "l3TOFYUrEKvmkqYapJkplkNvp+kfTAv9Gb+OdTMY6FY=",
+		"MWGP_KEY_NAME": "timeout",
+	})
+	for format, data := range map[string]string{
+		ConfigFormatJSON: `{
+			"listen": "${MWGP_LISTEN}",
+			"obfs": "${MWGP_OBFS_KEY}",
+			"obfs_secondary": ["pa$$word", "$5 ${MWGP_MISSING:-dollars}"],
+			"servers": [{
+				"privkey": "${MWGP_PRIV_KEY}",
+				"peers": [
+					{"forward_to": "${MWGP_UPSTREAM}:51820", "pubkey": "${MWGP_PEER_KEY}"},
+					{"forward_to": "${MWGP_FALLBACK:-127.0.0.1}:51821"}
+				]
+			}]
+		}`,
+		ConfigFormatYAML: `
+listen: ${MWGP_LISTEN}
+obfs: ${MWGP_OBFS_KEY}
+obfs_secondary: ["pa$$word", "$5 ${MWGP_MISSING:-dollars}"]
+servers:
+  - privkey: ${MWGP_PRIV_KEY}
+    peers:
+      - forward_to: ${MWGP_UPSTREAM}:51820
+        pubkey: ${MWGP_PEER_KEY}
+      - forward_to: ${MWGP_FALLBACK:-127.0.0.1}:51821
+`,
+		ConfigFormatTOML: `
+listen = "${MWGP_LISTEN}"
+obfs = "${MWGP_OBFS_KEY}"
+obfs_secondary = ["pa$$word", "$5 ${MWGP_MISSING:-dollars}"]
+[[servers]]
+privkey = "${MWGP_PRIV_KEY}"
+[[servers.peers]]
+forward_to = "${MWGP_UPSTREAM}:51820"
+pubkey = "${MWGP_PEER_KEY}"
+[[servers.peers]]
+forward_to = "${MWGP_FALLBACK:-127.0.0.1}:51821"
+`,
+	} {
+		var config ServerConfig
+		err := UnmarshalConfigWithEnv([]byte(data), format, &config, lookupEnv)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if config.Listen.String() != "0.0.0.0:1999" || len(config.Servers) != 1 || len(config.Servers[0].Peers) != 2 {
+			t.Fatalf("%s: unexpected config %+v", format, config)
+		}
+		// the value of the environment variable is not expanded again
+		if config.ObfuscateKey != "pa$$word from env" {
+			t.Errorf("%s: unexpected obfs %q", format, config.ObfuscateKey)
+		}
+		if strings.Join(config.ObfuscateSecondaryKeys, ",") != "pa$word,$5 dollars" {
+			t.Errorf("%s: unexpected obfs_secondary %q", format, config.ObfuscateSecondaryKeys)
+		}
+		peers := config.Servers[0].Peers
+		if peers[0].ForwardTo != "192.0.2.2:51820" || peers[0].ClientPublicKey == nil ||
+			peers[0].ClientPublicKey.Base64() != "DWcOygSJTBokgg2/OIL9EYhErtn5o84+K9tzWseh+ZI=" ||
+			peers[1].ForwardTo != "127.0.0.1:51821" || config.Servers[0].PrivateKey == nil {
+			t.Errorf("%s: unexpected peers %+v %+v", format, peers[0], peers[1])
+		}
+
+		// not expanded without the env
+		config = ServerConfig{}
+		if err = UnmarshalConfig([]byte(strings.ReplaceAll(data, "${MWGP_PRIV_KEY}", "l3TOFYUrEKvmkqYapJkplkNvp+kfTAv9Gb+OdTMY6FY=")), format, &config); err == nil {
+			t.Errorf("%s: expected the pubkey not expanded to be rejected", format)
+		}
+	}
+
+	// the keys are not expanded
+	var config ClientConfig
+	err := UnmarshalConfigWithEnv([]byte("${MWGP_KEY_NAME}: 90s\n"), ConfigFormatYAML, &config, lookupEnv)
+	if err == nil || !strings.Contains(err.Error(), "${MWGP_KEY_NAME}") {
+		t.Errorf("expected the key not to be expanded, got %v", err)
+	}
+
+	err = UnmarshalConfigWithEnv([]byte(`{"servers": [{"peers": [{"forward_to": "${MWGP_MISSING}:51820"}]}]}`), ConfigFormatJSON, &ServerConfig{}, lookupEnv)
+	if err == nil || !strings.Contains(err.Error(), "servers[0].peers[0].forward_to") || !strings.Contains(err.Error(), "MWGP_MISSING") {
+		t.Errorf("expected an error of the unset variable at its location, got %v", err)
+	}
+}
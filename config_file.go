@@ -0,0 +1,117 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/flynn/json5"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config File Formats:
+//
+// The config file is JSON (JSON5 actually, with comments and trailing commas), YAML or TOML.
+// A YAML or TOML config is decoded into the generic values first, then converted to JSON and decoded
+// by the json tags and the UnmarshalJSON of the config structs, so that all formats have the same keys
+// and the same values, such as "25s" for a Duration or "4MiB" for a ByteSize.
+// The unknown keys in a YAML or TOML config are rejected, so that a typo like "tiemout" is not ignored silently.
+// The JSON config still accepts them, as it always did.
+//
+// With UnmarshalConfigWithEnv (--expand-env), the ${VAR} and ${VAR:-default} in the string values
+// are replaced with the environment variables before they are decoded, see expandConfigEnv.
+
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// ConfigFormatOf returns the format of the config file by its extension, default to ConfigFormatJSON.
+func ConfigFormatOf(path string) (format string) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = ConfigFormatYAML
+	case ".toml":
+		format = ConfigFormatTOML
+	default:
+		format = ConfigFormatJSON
+	}
+	return
+}
+
+// UnmarshalConfig decodes the config file in the format (ConfigFormat*) into the config,
+// which is usually a *ServerConfig or a *ClientConfig.
+func UnmarshalConfig(data []byte, format string, config interface{}) (err error) {
+	err = categorize(ErrConfig, unmarshalConfig(data, format, config, nil))
+	return
+}
+
+// UnmarshalConfigWithEnv is UnmarshalConfig with the ${VAR} in the string values replaced
+// with the environment variables from the lookupEnv (os.LookupEnv if nil), see expandConfigEnv.
+func UnmarshalConfigWithEnv(data []byte, format string, config interface{}, lookupEnv func(key string) (string, bool)) (err error) {
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	err = categorize(ErrConfig, unmarshalConfig(data, format, config, lookupEnv))
+	return
+}
+
+func unmarshalConfig(data []byte, format string, config interface{}, lookupEnv func(key string) (string, bool)) (err error) {
+	var values interface{}
+	switch format {
+	case "", ConfigFormatJSON:
+		if lookupEnv == nil {
+			err = json5.Unmarshal(data, config)
+			return
+		}
+		format = ConfigFormatJSON
+		err = json5.Unmarshal(data, &values)
+		if err != nil {
+			return
+		}
+	case ConfigFormatYAML:
+		err = yaml.Unmarshal(data, &values)
+		if err != nil {
+			err = fmt.Errorf("invalid yaml config: %w", err)
+			return
+		}
+	case ConfigFormatTOML:
+		err = toml.Unmarshal(data, &values)
+		if err != nil {
+			err = fmt.Errorf("invalid toml config: %w", err)
+			return
+		}
+	default:
+		err = fmt.Errorf("invalid config format %q, must be one of %s, %s, %s", format, ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML)
+		return
+	}
+	if values == nil {
+		// an empty file
+		values = map[string]interface{}{}
+	}
+	if lookupEnv != nil {
+		values, err = expandConfigEnv(values, "", lookupEnv)
+		if err != nil {
+			return
+		}
+	}
+	bs, err := json.Marshal(values)
+	if err != nil {
+		err = fmt.Errorf("invalid %s config: %w", format, err)
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	if format != ConfigFormatJSON {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(config)
+	if err != nil {
+		err = fmt.Errorf("invalid %s config: %w", format, err)
+		return
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package mwgp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// kConfigFixtureDir has the same server and client configs in every format,
+// with every field set to a non-zero value.
+const kConfigFixtureDir = "testdata/config"
+
+// checkConfigFieldsSet reports the exported fields of the config not set by the fixture,
+// the first element of a slice is checked as well.
+func checkConfigFieldsSet(t *testing.T, path string, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			t.Errorf("%s is not set", path)
+			return
+		}
+		checkConfigFieldsSet(t, path, v.Elem())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			t.Errorf("%s is not set", path)
+			return
+		}
+		checkConfigFieldsSet(t, path+"[0]", v.Index(0))
+	case reflect.Struct:
+		if v.Type().PkgPath() != reflect.TypeOf(ServerConfig{}).PkgPath() {
+			// such as the keys
+			if v.IsZero() {
+				t.Errorf("%s is not set", path)
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() || field.Tag.Get("json") == "-" {
+				continue
+			}
+			checkConfigFieldsSet(t, path+"."+field.Name, v.Field(i))
+		}
+	default:
+		if v.IsZero() {
+			t.Errorf("%s is not set", path)
+		}
+	}
+}
+
+func testUnmarshalConfig(t *testing.T, name string, newConfig func() interface{}) {
+	var expected interface{}
+	for _, format := range []string{ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML} {
+		path := filepath.Join(kConfigFixtureDir, name+"."+format)
+		if got := ConfigFormatOf(path); got != format {
+			t.Errorf("expected format %s of %s, got %s", format, path, got)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := newConfig()
+		err = UnmarshalConfig(data, format, config)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if expected == nil {
+			expected = config
+			checkConfigFieldsSet(t, name, reflect.ValueOf(config))
+			continue
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s is not the same as %s.json:\n%+v\n%+v", path, name, config, expected)
+		}
+	}
+}
+
+func TestUnmarshalConfig(t *testing.T) {
+	testUnmarshalConfig(t, "server", func() interface{} { return &ServerConfig{} })
+	testUnmarshalConfig(t, "client", func() interface{} { return &ClientConfig{} })
+}
+
+func TestUnmarshalConfig_UnknownFields(t *testing.T) {
+	for format, data := range map[string]string{
+		ConfigFormatYAML: "listen: 127.0.0.1:1999\ntiemout: 90s\n",
+		ConfigFormatTOML: "listen = \"127.0.0.1:1999\"\ntiemout = \"90s\"\n",
+	} {
+		err := UnmarshalConfig([]byte(data), format, &ClientConfig{})
+		if err == nil || !strings.Contains(err.Error(), "tiemout") {
+			t.Errorf("%s: expected the unknown field to be rejected, got %v", format, err)
+		}
+	}
+	data := "servers:\n  - privkey: l3TOFYUrEKvmkqYapJkplkNvp+kfTAv9Gb+OdTMY6FY=\n    peers:\n      - forward_to: 127.0.0.1:51820\n        pubky: x\n"
+	if err := UnmarshalConfig([]byte(data), ConfigFormatYAML, &ServerConfig{}); err == nil || !strings.Contains(err.Error(), "pubky") {
+		t.Errorf("expected the unknown field of a peer to be rejected, got %v", err)
+	}
+	if err := UnmarshalConfig([]byte("listen = "), ConfigFormatTOML, &ServerConfig{}); err == nil {
+		t.Errorf("expected an invalid toml config to be rejected")
+	}
+	if err := UnmarshalConfig(nil, "ini", &ServerConfig{}); err == nil {
+		t.Errorf("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,358 @@
+package mwgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Config Validation:
+//
+// ServerConfig.Validate() and ClientConfig.Validate() check everything NewServerWithConfig and
+// NewClientWithConfig check, which call them first, without binding any socket or changing the config.
+// All the problems are reported at once as ConfigErrors, instead of only the first one.
+
+// ConfigErrors is the problems found in a config.
+// errors.Is and errors.As match any of them, and errors.Is matches ErrConfig.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e ConfigErrors) Is(target error) bool {
+	if target == ErrConfig {
+		return true
+	}
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e ConfigErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends the err if it is not nil.
+func (e *ConfigErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// err returns nil if there is no problem, or the only problem as-is in the ErrConfig.
+func (e ConfigErrors) err() (err error) {
+	switch len(e) {
+	case 0:
+	case 1:
+		err = categorize(ErrConfig, e[0])
+	default:
+		err = e
+	}
+	return
+}
+
+// validate checks the server the same as Initialize(), without reading the private key into it.
+func (s *ServerConfigServer) validate(forwardResolve forwardResolveOptions) (errs ConfigErrors) {
+	if len(s.Peers) == 0 {
+		errs.add(fmt.Errorf("no peers"))
+	}
+
+	if s.PrivateKey == nil {
+		if s.PrivateKeyFile == "" {
+			errs.add(fmt.Errorf("no server private key provided"))
+		} else {
+			var privateKey NoisePrivateKey
+			if err := privateKey.ReadFromFile(s.PrivateKeyFile); err != nil {
+				errs.add(fmt.Errorf("cannot read private key from file %s: %w", s.PrivateKeyFile, err))
+			}
+		}
+	} else if s.PrivateKeyFile != "" {
+		errs.add(fmt.Errorf("cannot specify both privkey and privkey_file"))
+	}
+
+	fallbackIndex := -1
+	peerIndex := make(map[NoisePublicKey]int, len(s.Peers))
+	for pi, p := range s.Peers {
+		if p.isFallback() {
+			if fallbackIndex >= 0 {
+				errs.add(fmt.Errorf("multiple fallback peers found: peer[%d] and peer[%d]", fallbackIndex, pi))
+			} else {
+				fallbackIndex = pi
+			}
+		} else if pj, ok := peerIndex[*p.ClientPublicKey]; ok {
+			errs.add(fmt.Errorf("peer[%d] has the same pubkey %s as peer[%d]", pi, p.ClientPublicKey.Base64(), pj))
+		} else {
+			peerIndex[*p.ClientPublicKey] = pi
+		}
+		ft, err := s.newPeerForwardTarget(pi, p, forwardResolve)
+		errs.add(err)
+		if err == nil {
+			_, err = s.newPeerForwardFailover(pi, p, ft, forwardResolve)
+			errs.add(err)
+		}
+		_, _, err = p.parseUpstreamPort(pi)
+		errs.add(err)
+		errs.add(p.validateRateLimit(pi))
+	}
+	return
+}
+
+// validateUpstreamPorts checks that no two peers of the servers pin the same upstream port.
+func validateUpstreamPorts(servers []*ServerConfigServer) (errs ConfigErrors) {
+	type pinned struct {
+		name             string
+		portMin, portMax int
+	}
+	var pins []pinned
+	for si, s := range servers {
+		for pi, p := range s.Peers {
+			portMin, portMax, err := p.parseUpstreamPort(pi)
+			if err != nil || portMin == 0 {
+				continue
+			}
+			name := fmt.Sprintf("server[%d]: peer[%d]", si, pi)
+			for _, other := range pins {
+				if portMin <= other.portMax && other.portMin <= portMax {
+					errs.add(fmt.Errorf("%s has the upstream_port %s conflicted with %s", name, p.UpstreamPort, other.name))
+				}
+			}
+			pins = append(pins, pinned{name: name, portMin: portMin, portMax: portMax})
+		}
+	}
+	return
+}
+
+// Validate checks the config the same as NewServerWithConfig, see ConfigErrors.
+func (config *ServerConfig) Validate() (err error) {
+	var errs ConfigErrors
+	if len(config.Servers) == 0 {
+		errs.add(errors.New("no server defined"))
+	}
+	errs.add(validateIPPreference(config.IPPreference))
+	errs.add(config.ResolveInterval.validate("resolve_interval", kServerResolveIntervalMax))
+	forwardResolve := forwardResolveOptions{
+		preference: config.IPPreference,
+		interval:   time.Duration(config.ResolveInterval),
+	}
+	for si, s := range config.Servers {
+		for _, serr := range s.validate(forwardResolve) {
+			errs.add(fmt.Errorf("server[%d]: %w", si, serr))
+		}
+	}
+	errs = append(errs, validateUpstreamPorts(config.Servers)...)
+	errs.add(config.Timeout.validate("timeout", kTimeoutMax))
+	errs.add(config.CleanupInterval.validate("cleanup_interval", kTimeoutMax))
+	errs.add(validateForwardTableShards(config.ForwardTableShards))
+	errs.add(validateLatencySampleRate(config.LatencySampleRate))
+	errs.add(validateCaptureLimitPackets(config.CaptureLimitPackets))
+	if _, perr := parsePrivileges(config.User, config.Group); perr != nil {
+		errs.add(perr)
+	} else if config.User != "" && config.FwMark != 0 {
+		errs.add(fmt.Errorf("option \"fwmark\" cannot be used with \"user\", the sockets to servers are created without the privileges to set it"))
+	}
+	if config.Sandbox && !sandboxSupported {
+		errs.add(fmt.Errorf("option \"sandbox\" is not supported on %s", runtime.GOOS))
+	}
+	errs.add(config.AccountingInterval.validate("accounting_interval", kAccountingIntervalMax))
+	_, lerr := NewLogger(config.LogLevel, config.LogFormat)
+	errs.add(lerr)
+	errs.add(validateDebugListen(config.DebugListen, config.DebugAllowRemote))
+	errs.add(validateDSCPAndTTL(config.DSCP, config.TTL))
+	errs.add(validatePreserveTOS(config.PreserveTOS, config.UDPOffload))
+	_, berr := parseBindOptions(config.BindDevice, config.BindAddress)
+	errs.add(berr)
+	if _, systemd, lerr := config.Listen.systemd(); lerr != nil {
+		errs.add(lerr)
+	} else if !systemd {
+		_, lerr = resolveListenRanges(config.Listen)
+		errs.add(lerr)
+	}
+	errs.add(validateMaxPacketSize(config.MaxPacketSize))
+	errs.add(validateMaxSessions(config.MaxSessions, config.MaxSessionsPolicy))
+	if config.HandshakeRateLimit != nil {
+		errs.add(config.HandshakeRateLimit.validate())
+	}
+	if config.ProbeBan != nil {
+		errs.add(config.ProbeBan.validate())
+	}
+	if config.RateLimit != nil {
+		errs.add(config.RateLimit.validate("rate_limit"))
+	}
+	_, aerr := parseClientACL(config.AllowedClients, config.DeniedClients)
+	errs.add(aerr)
+	if config.UpstreamHealth != nil {
+		errs.add(config.UpstreamHealth.validate())
+	}
+	for _, forward := range []struct{ option, address string }{
+		{"fallback_forward", config.FallbackForward},
+		{"drain_forward", config.DrainForward},
+	} {
+		if forward.address == "" {
+			continue
+		}
+		if _, rerr := resolveUDPAddrs(context.Background(), &defaultUDPAddrResolver{}, forward.address, config.IPPreference); rerr != nil {
+			errs.add(fmt.Errorf("invalid %s address %s: %w", forward.option, forward.address, rerr))
+		}
+	}
+
+	obfuscateKey, obfuscateSecondaryKeys, oerr := parseObfuscateKeys(config.ObfuscateKey, config.ObfuscateSecondaryKeys, config.ObfuscateMinKeyLength)
+	errs.add(oerr)
+	zeroObfuscateKeys(obfuscateKey, obfuscateSecondaryKeys)
+	// an invalid obfs is reported once above
+	obfuscateEnabled := oerr != nil || len(obfuscateKey) > 0
+	authenticated, oerr := parseObfuscateMode(config.ObfuscateMode)
+	errs.add(oerr)
+	if authenticated && !obfuscateEnabled {
+		errs.add(fmt.Errorf("obfs_mode %q requires obfs to be set", config.ObfuscateMode))
+	}
+	if config.ObfuscateStrict && !obfuscateEnabled {
+		errs.add(fmt.Errorf("obfs_strict requires obfs to be set"))
+	}
+	if config.UniformDrop {
+		if !obfuscateEnabled {
+			errs.add(fmt.Errorf("uniform_drop requires obfs to be set"))
+		}
+		if config.FallbackForward != "" {
+			errs.add(fmt.Errorf("option \"fallback_forward\" cannot be used with \"uniform_drop\", it relays the packets to be dropped"))
+		}
+		if config.Preflight {
+			errs.add(fmt.Errorf("option \"preflight\" cannot be used with \"uniform_drop\", it replies to the packets to be dropped"))
+		}
+	}
+	if config.ObfuscatePadding != nil {
+		errs = append(errs, config.ObfuscatePadding.validate()...)
+	}
+	if config.ObfuscateReplayFilter != nil {
+		if !obfuscateEnabled {
+			errs.add(fmt.Errorf("obfs_replay_filter requires obfs to be set"))
+		}
+		errs.add(config.ObfuscateReplayFilter.validate())
+	}
+	if config.WebSocket != nil {
+		errs.add(config.WebSocket.validate())
+	}
+	if config.TCPListen != "" {
+		if _, terr := net.ResolveTCPAddr("tcp", config.TCPListen); terr != nil {
+			errs.add(fmt.Errorf("invalid tcp_listen address %s: %w", config.TCPListen, terr))
+		}
+	}
+	err = errs.err()
+	return
+}
+
+// Validate checks the config the same as NewClientWithConfig, see ConfigErrors.
+func (config *ClientConfig) Validate() (err error) {
+	var errs ConfigErrors
+	errs.add(config.Timeout.validate("timeout", kTimeoutMax))
+	errs.add(config.CleanupInterval.validate("cleanup_interval", kTimeoutMax))
+	errs.add(validateForwardTableShards(config.ForwardTableShards))
+	errs.add(validateLatencySampleRate(config.LatencySampleRate))
+	errs.add(validateCaptureLimitPackets(config.CaptureLimitPackets))
+	errs.add(config.ResolveInterval.validate("resolve_interval", kClientResolveIntervalMax))
+	errs.add(config.HopInterval.validate("hop_interval", kHopIntervalMax))
+	errs.add(config.NATKeepalive.validate("nat_keepalive", kNATKeepaliveMax))
+	errs.add(validateIPPreference(config.IPPreference))
+	errs.add(config.FailoverWindow.validate("failover_window", kFailoverWindowMax))
+	errs.add(config.FailoverProbeInterval.validate("failover_probe_interval", kFailoverProbeIntervalMax))
+	if len(config.Servers) > 0 {
+		if config.Server != "" {
+			errs.add(fmt.Errorf("option \"server\" and \"servers\" is conflicted with each other"))
+		}
+		if config.WebSocket != nil {
+			errs.add(fmt.Errorf("option \"servers\" is not supported with \"websocket\""))
+		}
+		errs.add(validateClientServers(config.Servers))
+	}
+	_, lerr := NewLogger(config.LogLevel, config.LogFormat)
+	errs.add(lerr)
+
+	_, serverPortMax, serr := splitPortRange(config.Server)
+	if serr != nil {
+		errs.add(fmt.Errorf("invalid server address %s: %w", config.Server, serr))
+	}
+	errs.add(validateTransport(config.Transport))
+	if serverPortMax != 0 && (config.Transport == TransportTCP || config.WebSocket != nil) {
+		errs.add(fmt.Errorf("port range of \"server\" requires the udp transport"))
+	}
+	if config.WebSocket != nil {
+		if config.Transport == TransportTCP {
+			errs.add(fmt.Errorf("option \"transport\" and \"websocket\" is conflicted with each other"))
+		}
+		_, _, werr := parseWebSocketURL(config.WebSocket.URL)
+		errs.add(werr)
+		_, _, werr = webSocketTimeouts(config.WebSocket.ReadTimeout, config.WebSocket.WriteTimeout)
+		errs.add(werr)
+	}
+	if config.SOCKS5 != nil {
+		if config.Transport == TransportTCP || config.WebSocket != nil || serverPortMax != 0 {
+			errs.add(fmt.Errorf("option \"socks5\" requires the udp transport to a single server port"))
+		}
+		errs.add(config.SOCKS5.validate())
+	}
+	if config.PathMTUDiscovery {
+		if !pathMTUDiscoverySupported {
+			errs.add(fmt.Errorf("option \"pmtu_discovery\" is not supported on %s", runtime.GOOS))
+		} else if config.Transport == TransportTCP || config.WebSocket != nil || config.SOCKS5 != nil {
+			errs.add(fmt.Errorf("option \"pmtu_discovery\" requires the udp transport without \"socks5\""))
+		}
+	}
+	_, aerr := parseAllowedSources(config.AllowedSources)
+	errs.add(aerr)
+	errs.add(validateMaxPacketSize(config.MaxPacketSize))
+	errs.add(validateMaxClients(config.MaxClients))
+	errs.add(validateDebugListen(config.DebugListen, config.DebugAllowRemote))
+	errs.add(validateDSCPAndTTL(config.DSCP, config.TTL))
+	errs.add(validatePreserveTOS(config.PreserveTOS, config.UDPOffload))
+	_, berr := parseBindOptions(config.BindDevice, config.BindAddress)
+	errs.add(berr)
+	if _, systemd, lerr := config.Listen.systemd(); lerr != nil {
+		errs.add(lerr)
+	} else if !systemd {
+		_, lerr = resolveListenAddrs(config.Listen)
+		errs.add(lerr)
+	}
+	if config.Workers > 1 && !reusePortSupported {
+		errs.add(fmt.Errorf("option \"workers\" requires SO_REUSEPORT, which is not supported on %s", runtime.GOOS))
+	}
+	resolver := config.Resolver
+	if config.DNS != "" {
+		resolver = fmt.Sprintf("dns+udp://%s", config.DNS)
+	}
+	if config.DNS != "" && config.Resolver != "" {
+		errs.add(fmt.Errorf("option \"dns\" and \"resolver\" is conflicted with each other"))
+	} else if _, rerr := newUDPAddrResolver(resolver); rerr != nil {
+		errs.add(fmt.Errorf("failed to create resolver: %w", rerr))
+	}
+
+	obfuscateKey, obfuscateSecondaryKeys, oerr := parseObfuscateKeys(config.ObfuscateKey, config.ObfuscateSecondaryKeys, config.ObfuscateMinKeyLength)
+	errs.add(oerr)
+	zeroObfuscateKeys(obfuscateKey, obfuscateSecondaryKeys)
+	obfuscateEnabled := oerr != nil || len(obfuscateKey) > 0
+	authenticated, oerr := parseObfuscateMode(config.ObfuscateMode)
+	errs.add(oerr)
+	if authenticated && !obfuscateEnabled {
+		errs.add(fmt.Errorf("obfs_mode %q requires obfs to be set", config.ObfuscateMode))
+	}
+	if config.ObfuscatePadding != nil {
+		errs = append(errs, config.ObfuscatePadding.validate()...)
+	}
+	err = errs.err()
+	return
+}
@@ -0,0 +1,105 @@
+package mwgp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfig_Validate(t *testing.T) {
+	sk, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	config := ServerConfig{
+		Listen:       ListenAddresses{"127.0.0.1:0"},
+		Timeout:      Duration(48 * time.Hour),
+		ObfuscateKey: "short",
+		DSCP:         64,
+		ObfuscatePadding: &ObfuscatePaddingConfig{
+			MaxLength: -1,
+		},
+		Servers: []*ServerConfigServer{{
+			PrivateKey: &sk,
+			Peers: []*ServerConfigPeer{
+				{ForwardTo: "127.0.0.1:51820", ClientPublicKey: &clientPK},
+				{ForwardTo: "127.0.0.1:51821", ClientPublicKey: &clientPK},
+				{ForwardTo: "127.0.0.1"},
+			},
+		}},
+	}
+	err := config.Validate()
+	var problems ConfigErrors
+	if !errors.As(err, &problems) || len(problems) != 6 {
+		t.Fatalf("expected 6 problems, got %v", err)
+	}
+	for _, expected := range []string{"timeout", "obfs", "dscp", "obfs_padding.max_length", "server[0]: peer[1] has the same pubkey", "server[0]: peer[2]"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected a problem of %q in %q", expected, err.Error())
+		}
+	}
+	var rangeErr *DurationRangeError
+	if !errors.As(err, &rangeErr) || rangeErr.Option != "timeout" {
+		t.Errorf("expected DurationRangeError for timeout, got %v", err)
+	}
+	if _, serr := NewServerWithConfig(&config); serr == nil || serr.Error() != err.Error() {
+		t.Errorf("expected NewServerWithConfig to fail the same, got %v", serr)
+	}
+	if config.Servers[0].peerIndex != nil || config.Servers[0].Peers[0].forwardTarget != nil {
+		t.Errorf("config is changed by Validate()")
+	}
+
+	config.Timeout = 0
+	config.ObfuscateKey = "long enough password"
+	config.DSCP = 0
+	config.ObfuscatePadding.MaxLength = 0
+	config.Servers[0].Peers = config.Servers[0].Peers[:1]
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConfig_Validate(t *testing.T) {
+	config := ClientConfig{
+		Listen:         ListenAddresses{"127.0.0.1:0"},
+		Server:         "127.0.0.1:1",
+		Transport:      "sctp",
+		ObfuscateMode:  ObfuscateModeAuthenticated,
+		Workers:        2,
+		AllowedSources: []string{"127.0.0.1", "192.168.1.0/33"},
+		MaxClients:     -1,
+		ObfuscatePadding: &ObfuscatePaddingConfig{
+			MinLength:   -1,
+			Probability: 1.5,
+		},
+	}
+	err := config.Validate()
+	var problems ConfigErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	expected := []string{"transport", "obfs_mode", "allowed_sources[1]", "max_clients",
+		"obfs_padding.min_length", "obfs_padding.probability"}
+	if !reusePortSupported {
+		expected = append(expected, "workers")
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("expected %d problems, got %v", len(expected), err)
+	}
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("expected a problem of %q in %q", e, err.Error())
+		}
+	}
+
+	// a single problem is returned as-is
+	config.Transport = ""
+	config.ObfuscateKey = "long enough password"
+	config.Workers = 0
+	config.AllowedSources = nil
+	config.MaxClients = 0
+	config.ObfuscatePadding = &ObfuscatePaddingConfig{MinLength: 1000, Probability: 1}
+	config.Listen = ListenAddresses{"127.0.0.1:abc"}
+	if err = config.Validate(); err == nil || errors.As(err, &problems) {
+		t.Errorf("expected a single error, got %v", err)
+	}
+}
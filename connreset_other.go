@@ -0,0 +1,14 @@
+//go:build !windows
+
+package mwgp
+
+const udpConnResetSupported = false
+
+func disableUDPConnReset(fd uintptr) (err error) {
+	return
+}
+
+// isUDPConnResetError is always false, the ICMP errors are syscall.ECONNREFUSED on other systems.
+func isUDPConnResetError(err error) bool {
+	return false
+}
@@ -0,0 +1,29 @@
+package mwgp
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const udpConnResetSupported = true
+
+// disableUDPConnReset turns off the SIO_UDP_CONNRESET of the UDP socket.
+//
+// By default, Windows reports the ICMP port unreachable of a datagram sent before as WSAECONNRESET
+// on the next read of the socket, such as whenever the server is restarted,
+// which is not an error of the socket itself.
+func disableUDPConnReset(fd uintptr) (err error) {
+	enabled := uint32(0)
+	var returned uint32
+	err = windows.WSAIoctl(windows.Handle(fd), windows.SIO_UDP_CONNRESET,
+		(*byte)(unsafe.Pointer(&enabled)), uint32(unsafe.Sizeof(enabled)), nil, 0, &returned, nil, 0)
+	return
+}
+
+// isUDPConnResetError reports whether the error is the WSAECONNRESET (ICMP port unreachable)
+// or WSAENETRESET (ICMP TTL expired) reported by a previous write.
+func isUDPConnResetError(err error) bool {
+	return errors.Is(err, windows.WSAECONNRESET) || errors.Is(err, windows.WSAENETRESET)
+}
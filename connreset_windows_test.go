@@ -0,0 +1,64 @@
+package mwgp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestUDPConnReset sends to a closed port, the ICMP port unreachable is reported as WSAECONNRESET
+// on the next read unless the SIO_UDP_CONNRESET is disabled.
+func TestUDPConnReset(t *testing.T) {
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().(*net.UDPAddr)
+	_ = closed.Close()
+
+	readAfterUnreachable := func(conn *net.UDPConn) (err error) {
+		_, err = conn.WriteToUDP([]byte("ping"), closedAddr)
+		if err != nil {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err = conn.ReadFromUDP(make([]byte, 16))
+		return
+	}
+
+	conns, err := listenUDPWorkers(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns[0].Close()
+	err = readAfterUnreachable(conns[0])
+	if !isUDPConnResetError(err) {
+		t.Skipf("WSAECONNRESET is not reported without SIO_UDP_CONNRESET disabled, got %v", err)
+	}
+	if classifyReadError(err) != readErrorTransient {
+		t.Errorf("expected WSAECONNRESET to be transient")
+	}
+
+	table := NewWireGuardIndexTranslationTable()
+	conns, err = listenUDPWorkers(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 1, table.socketControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns[0].Close()
+	var netErr net.Error
+	if err = readAfterUnreachable(conns[0]); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected a timeout with SIO_UDP_CONNRESET disabled, got %v", err)
+	}
+
+	upstream, err := table.dialUDP(closedAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	_, _ = upstream.Write([]byte("ping"))
+	_ = upstream.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err = upstream.Read(make([]byte, 16)); isUDPConnResetError(err) {
+		t.Errorf("expected SIO_UDP_CONNRESET disabled on the upstream socket, got %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+package mwgp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Control Socket:
+//
+// The "control_socket" of mwgp-server is a unix domain socket to inspect and manage the running server,
+// which is used by "mwgp ctl". A request is a JSON object in a line, {"method": "...", "params": {...}},
+// answered by a line of {"result": ...} or {"error": "..."}, and a connection might send more than one.
+//
+// The methods are:
+//
+//   - "sessions": the SessionInfo of the active sessions.
+//   - "kick" (ControlKickParams): evicts the sessions selected, see EvictSessions().
+//   - "add_peer" and "remove_peer" (ControlPeerParams): see AddPeer() and RemovePeer().
+//   - "reload": calls the Server.ReloadFunc.
+//   - "stats": the Stats.
+//   - "bans": the sources banned by the probe_ban, see ProbeBans().
+//   - "unban" (ControlUnbanParams): lifts the ban of a source, see ProbeUnban().
+//
+// There is no authentication, anyone able to connect to the socket controls the server. So the socket is
+// created with mode 0600, and it is refused in a world-writable directory, where others might replace it.
+
+const (
+	// kControlRequestMaxSize is the max length of a request line.
+	kControlRequestMaxSize = 1 << 20
+
+	// kControlIdleTimeout closes a connection without a request in time.
+	kControlIdleTimeout = 5 * time.Minute
+
+	// kControlCallTimeout is the timeout of CallControlSocket, a reload might resolve the forward_to host names.
+	kControlCallTimeout = time.Minute
+)
+
+// ControlKickParams is the params of the "kick" method, the fields set select the sessions, see SessionFilter.
+type ControlKickParams struct {
+	SessionID string          `json:"session_id,omitempty"`
+	PeerID    *NoisePublicKey `json:"peer_id,omitempty"`
+
+	// ClientAddress is an address or a CIDR.
+	ClientAddress string `json:"client,omitempty"`
+
+	IdleLongerThan Duration `json:"idle,omitempty"`
+}
+
+func (p *ControlKickParams) filter() (filter SessionFilter, err error) {
+	filter = SessionFilter{
+		PeerID:         p.PeerID,
+		SessionID:      p.SessionID,
+		IdleLongerThan: time.Duration(p.IdleLongerThan),
+	}
+	if p.ClientAddress != "" {
+		if strings.Contains(p.ClientAddress, "/") {
+			filter.ClientAddress, err = netip.ParsePrefix(p.ClientAddress)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(p.ClientAddress)
+			filter.ClientAddress = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid client %s: %w", p.ClientAddress, err)
+			return
+		}
+	}
+	if filter.isZero() {
+		err = fmt.Errorf("no session selected")
+		return
+	}
+	return
+}
+
+// ControlKickResult is the result of the "kick" method.
+type ControlKickResult struct {
+	Evicted int `json:"evicted"`
+}
+
+// ControlPeerParams is the params of the "add_peer" and "remove_peer" methods.
+type ControlPeerParams struct {
+	ServerPublicKey NoisePublicKey `json:"server_pubkey"`
+
+	// ClientPublicKey is the peer to remove, nil for the fallback peer.
+	ClientPublicKey *NoisePublicKey `json:"pubkey,omitempty"`
+
+	// Peer is the peer to add, in the same format as the config.
+	Peer *ServerConfigPeer `json:"peer,omitempty"`
+}
+
+// ControlUnbanParams is the params of the "unban" method.
+type ControlUnbanParams struct {
+	Source netip.Addr `json:"source"`
+}
+
+type controlRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type controlResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// controlHandler handles the params of a method, the result is encoded as JSON.
+type controlHandler func(params json.RawMessage) (result interface{}, err error)
+
+type controlServer struct {
+	listener *net.UnixListener
+	handlers map[string]controlHandler
+	logger   Logger
+
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+	connsWG   sync.WaitGroup
+}
+
+func newControlServer(path string, logger Logger, handlers map[string]controlHandler) (cs *controlServer, err error) {
+	err = prepareControlSocket(path)
+	if err != nil {
+		err = errorf(ErrConfig, "invalid control_socket %s: %w", path, err)
+		return
+	}
+	cs = &controlServer{
+		handlers: handlers,
+		logger:   logger,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	cs.listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to listen on control socket %s: %w", path, err)
+		return
+	}
+	err = chmodControlSocket(path)
+	if err != nil {
+		_ = cs.listener.Close()
+		err = errorf(ErrNetwork, "failed to chmod control socket %s: %w", path, err)
+		return
+	}
+	return
+}
+
+// Serve serves the control socket until closeChan is closed, the socket file is removed then.
+func (cs *controlServer) Serve(closeChan <-chan struct{}) {
+	go func() {
+		<-closeChan
+		_ = cs.listener.Close()
+		cs.connsLock.Lock()
+		for conn := range cs.conns {
+			_ = conn.Close()
+		}
+		cs.conns = nil
+		cs.connsLock.Unlock()
+	}()
+	cs.logger.Infof("control socket listen on %s ...", cs.listener.Addr())
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				cs.logger.Errorf("control socket stopped: %s", err.Error())
+			}
+			break
+		}
+		cs.connsLock.Lock()
+		if cs.conns == nil {
+			cs.connsLock.Unlock()
+			_ = conn.Close()
+			break
+		}
+		cs.conns[conn] = struct{}{}
+		cs.connsWG.Add(1)
+		cs.connsLock.Unlock()
+		go cs.handleConn(conn)
+	}
+	cs.connsWG.Wait()
+}
+
+func (cs *controlServer) handleConn(conn net.Conn) {
+	defer cs.connsWG.Done()
+	defer func() {
+		_ = conn.Close()
+		cs.connsLock.Lock()
+		delete(cs.conns, conn)
+		cs.connsLock.Unlock()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), kControlRequestMaxSize)
+	encoder := json.NewEncoder(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(kControlIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		var response controlResponse
+		result, err := cs.handle(scanner.Bytes())
+		if err != nil {
+			response.Error = err.Error()
+		} else {
+			response.Result = result
+		}
+		if encoder.Encode(&response) != nil {
+			return
+		}
+	}
+}
+
+func (cs *controlServer) handle(line []byte) (result interface{}, err error) {
+	var request controlRequest
+	err = json.Unmarshal(line, &request)
+	if err != nil {
+		err = fmt.Errorf("invalid request: %w", err)
+		return
+	}
+	handler, ok := cs.handlers[request.Method]
+	if !ok {
+		err = fmt.Errorf("unknown method %q", request.Method)
+		return
+	}
+	cs.logger.Debugf("control socket: %s", request.Method)
+	result, err = handler(request.Params)
+	return
+}
+
+// decodeControlParams decodes the params of a method into v.
+func decodeControlParams(params json.RawMessage, v interface{}) (err error) {
+	if len(params) == 0 {
+		err = fmt.Errorf("missing params")
+		return
+	}
+	err = json.Unmarshal(params, v)
+	if err != nil {
+		err = fmt.Errorf("invalid params: %w", err)
+		return
+	}
+	return
+}
+
+func (s *Server) controlHandlers() map[string]controlHandler {
+	return map[string]controlHandler{
+		"sessions": func(params json.RawMessage) (result interface{}, err error) {
+			result = s.Sessions()
+			return
+		},
+		"stats": func(params json.RawMessage) (result interface{}, err error) {
+			result = s.Stats()
+			return
+		},
+		"kick": func(params json.RawMessage) (result interface{}, err error) {
+			var p ControlKickParams
+			err = decodeControlParams(params, &p)
+			if err != nil {
+				return
+			}
+			filter, err := p.filter()
+			if err != nil {
+				return
+			}
+			evicted := s.EvictSessions(filter)
+			if evicted == 0 {
+				err = fmt.Errorf("no session matched")
+				return
+			}
+			result = ControlKickResult{Evicted: evicted}
+			return
+		},
+		"add_peer": func(params json.RawMessage) (result interface{}, err error) {
+			var p ControlPeerParams
+			err = decodeControlParams(params, &p)
+			if err != nil {
+				return
+			}
+			if p.Peer == nil {
+				err = fmt.Errorf("missing peer")
+				return
+			}
+			err = s.AddPeer(p.ServerPublicKey, p.Peer)
+			return
+		},
+		"remove_peer": func(params json.RawMessage) (result interface{}, err error) {
+			var p ControlPeerParams
+			err = decodeControlParams(params, &p)
+			if err != nil {
+				return
+			}
+			err = s.RemovePeer(p.ServerPublicKey, p.ClientPublicKey)
+			return
+		},
+		"bans": func(params json.RawMessage) (result interface{}, err error) {
+			result = s.ProbeBans()
+			return
+		},
+		"unban": func(params json.RawMessage) (result interface{}, err error) {
+			var p ControlUnbanParams
+			err = decodeControlParams(params, &p)
+			if err != nil {
+				return
+			}
+			if !p.Source.IsValid() {
+				err = fmt.Errorf("missing source")
+				return
+			}
+			if !s.ProbeUnban(p.Source) {
+				err = fmt.Errorf("%s is not banned", p.Source)
+				return
+			}
+			return
+		},
+		"reload": func(params json.RawMessage) (result interface{}, err error) {
+			if s.ReloadFunc == nil {
+				err = fmt.Errorf("reload is not supported by this server")
+				return
+			}
+			err = s.ReloadFunc()
+			return
+		},
+	}
+}
+
+// CallControlSocket calls the method of the server at the control socket path,
+// and decodes the result into the result if not nil, see "Control Socket".
+func CallControlSocket(path string, method string, params interface{}, result interface{}) (err error) {
+	request := controlRequest{Method: method}
+	if params != nil {
+		request.Params, err = json.Marshal(params)
+		if err != nil {
+			return
+		}
+	}
+	conn, err := net.DialTimeout("unix", path, kControlCallTimeout)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to connect to control socket %s: %w", path, err)
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(kControlCallTimeout))
+	err = json.NewEncoder(conn).Encode(&request)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to send to control socket %s: %w", path, err)
+		return
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to receive from control socket %s: %w", path, err)
+		return
+	}
+	if response.Error != "" {
+		err = errors.New(response.Error)
+		return
+	}
+	if result != nil && len(response.Result) > 0 {
+		err = json.Unmarshal(response.Result, result)
+	}
+	return
+}
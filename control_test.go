@@ -0,0 +1,250 @@
+//go:build !windows
+
+package mwgp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestControlSocket(t *testing.T) {
+	sk, serverPK := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	_, addedPK := e2eGenerateKey(t)
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{"127.0.0.1:0"},
+		Servers: []*ServerConfigServer{{
+			PrivateKey: &sk,
+			Peers:      []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820", ClientPublicKey: &clientPK}},
+		}},
+		ControlSocket: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Logger = NewStdLogger(LogLevelError)
+	var reloaded int32
+	server.ReloadFunc = func() (err error) {
+		atomic.AddInt32(&reloaded, 1)
+		return
+	}
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+	defer func() {
+		_ = server.Stop()
+		if err := <-started; err != nil {
+			t.Error(err)
+		}
+		// the control socket is closed along with the table, but not waited for
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("expected the control socket removed on stop")
+				break
+			}
+		}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err = os.Lstat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("control socket is not created")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if fi, _ := os.Lstat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the control socket in mode 0600, got %s", fi.Mode().Perm())
+	}
+
+	table := server.wgitTable
+	peer := &Peer{
+		clientPublicKey:   clientPK,
+		serverPublicKey:   serverPK,
+		clientProxyIndex:  0x1000,
+		clientDestination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000},
+		serverDestination: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820},
+		sessionID:         newSessionID(),
+		createdAt:         time.Now(),
+	}
+	peer.touch(peer.createdAt)
+	table.mapLock.Lock()
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.mapLock.Unlock()
+
+	var sessions []SessionInfo
+	if err = CallControlSocket(path, "sessions", nil, &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].SessionID != peer.sessionID || sessions[0].PeerID != clientPK.Base64() ||
+		sessions[0].ClientAddress != "192.0.2.1:1000" || !sessions[0].CreatedAt.Equal(peer.createdAt) {
+		t.Errorf("unexpected sessions: %+v", sessions)
+	}
+
+	var kicked ControlKickResult
+	if err = CallControlSocket(path, "kick", &ControlKickParams{SessionID: peer.sessionID}, &kicked); err != nil || kicked.Evicted != 1 {
+		t.Errorf("expected the session kicked, got %+v, %v", kicked, err)
+	}
+	if err = CallControlSocket(path, "kick", &ControlKickParams{SessionID: peer.sessionID}, &kicked); err == nil {
+		t.Errorf("expected an error to kick a removed session")
+	}
+	if stats := server.Stats(); stats.ActiveSessions != 0 {
+		t.Errorf("expected no session after kicked, got %d", stats.ActiveSessions)
+	}
+
+	added := &ServerConfigPeer{ForwardTo: "127.0.0.1:51821", ClientPublicKey: &addedPK}
+	if err = CallControlSocket(path, "add_peer", &ControlPeerParams{ServerPublicKey: serverPK, Peer: added}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if sp := server.servers[0].matchPeer(addedPK); sp == nil || sp.ForwardTo != added.ForwardTo {
+		t.Errorf("expected the peer added, got %+v", sp)
+	}
+	if err = CallControlSocket(path, "remove_peer", &ControlPeerParams{ServerPublicKey: serverPK, ClientPublicKey: &addedPK}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = CallControlSocket(path, "remove_peer", &ControlPeerParams{ServerPublicKey: serverPK, ClientPublicKey: &addedPK}, nil); err == nil {
+		t.Errorf("expected an error to remove a removed peer")
+	}
+
+	if err = CallControlSocket(path, "reload", nil, nil); err != nil || atomic.LoadInt32(&reloaded) != 1 {
+		t.Errorf("expected the ReloadFunc called once, got %v", err)
+	}
+	var stats Stats
+	if err = CallControlSocket(path, "stats", nil, &stats); err != nil || stats.TotalSessionsCreated != 0 {
+		t.Errorf("unexpected stats: %+v, %v", stats, err)
+	}
+	if err = CallControlSocket(path, "shutdown", nil, nil); err == nil {
+		t.Errorf("expected an error for an unknown method")
+	}
+	if err = CallControlSocket(path, "kick", nil, nil); err == nil {
+		t.Errorf("expected an error for missing params")
+	}
+}
+
+func TestControlSocket_Refused(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "public")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newControlServer(filepath.Join(dir, "control.sock"), NewStdLogger(LogLevelError), nil); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected the world-writable directory refused, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newControlServer(path, NewStdLogger(LogLevelError), nil); err == nil {
+		t.Errorf("expected a regular file not replaced")
+	}
+
+	// a socket left by a previous process is replaced, but not the one in use
+	path = filepath.Join(t.TempDir(), "control.sock")
+	cs, err := newControlServer(path, NewStdLogger(LogLevelError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newControlServer(path, NewStdLogger(LogLevelError), nil); err == nil {
+		t.Errorf("expected a socket in use not replaced")
+	}
+	cs.listener.SetUnlinkOnClose(false)
+	_ = cs.listener.Close()
+	cs, err = newControlServer(path, NewStdLogger(LogLevelError), nil)
+	if err != nil {
+		t.Fatalf("expected a stale socket replaced, got %v", err)
+	}
+	_ = cs.listener.Close()
+}
+
+func TestServer_StartFailureReleasesListeners(t *testing.T) {
+	sk, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	path := filepath.Join(t.TempDir(), "control.sock")
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsListen, debugListen := e2eFreeTCPAddr(t), e2eFreeTCPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{"127.0.0.1:0"},
+		Servers: []*ServerConfigServer{{
+			PrivateKey: &sk,
+			Peers:      []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820", ClientPublicKey: &clientPK}},
+		}},
+		MetricsListen: metricsListen,
+		DebugListen:   debugListen,
+		ControlSocket: path,
+		TCPListen:     occupied.Addr().String(),
+		LogLevel:      "error",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tcp_listen fails after the other listeners are started
+	if err = server.Start(); err == nil {
+		t.Fatal("expected the occupied tcp_listen failed")
+	}
+	for _, listen := range []string{metricsListen, debugListen} {
+		l, lerr := net.Listen("tcp", listen)
+		if lerr != nil {
+			t.Errorf("expected %s released: %s", listen, lerr.Error())
+			continue
+		}
+		_ = l.Close()
+	}
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the control socket removed, got %v", err)
+	}
+
+	// and it can be retried
+	_ = occupied.Close()
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err = os.Lstat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("control socket is not created by the retry")
+		}
+	}
+	_ = server.Stop()
+	if err = <-started; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClient_StartFailureReleasesListeners(t *testing.T) {
+	metricsListen := e2eFreeTCPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Listen:        ListenAddresses{"127.0.0.1:0"},
+		Server:        "127.0.0.1:1",
+		MetricsListen: metricsListen,
+		// the capture file fails to be opened after the metrics listener is started
+		CaptureFile: filepath.Join(t.TempDir(), "missing", "capture.pcapng"),
+		LogLevel:    "error",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Start(); err == nil {
+		t.Fatal("expected the capture file failed")
+	}
+	l, err := net.Listen("tcp", metricsListen)
+	if err != nil {
+		t.Fatalf("expected %s released: %s", metricsListen, err.Error())
+	}
+	_ = l.Close()
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+
+package mwgp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// prepareControlSocket refuses the control socket in a world-writable directory,
+// and removes the socket left by a previous process.
+func prepareControlSocket(path string) (err error) {
+	dir, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	if dir.Mode().Perm()&0002 != 0 {
+		err = fmt.Errorf("directory %s is world-writable", filepath.Dir(path))
+		return
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		err = fmt.Errorf("%s exists and is not a socket", path)
+		return
+	}
+	if conn, derr := net.Dial("unix", path); derr == nil {
+		_ = conn.Close()
+		err = fmt.Errorf("%s is in use by another process", path)
+		return
+	}
+	err = os.Remove(path)
+	return
+}
+
+func chmodControlSocket(path string) (err error) {
+	err = os.Chmod(path, 0600)
+	return
+}
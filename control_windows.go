@@ -0,0 +1,15 @@
+package mwgp
+
+import (
+	"fmt"
+)
+
+// prepareControlSocket refuses the control socket, since the file mode cannot restrict it on Windows.
+func prepareControlSocket(path string) (err error) {
+	err = fmt.Errorf("control_socket is not supported on windows")
+	return
+}
+
+func chmodControlSocket(path string) (err error) {
+	return
+}
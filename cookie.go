@@ -0,0 +1,43 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Cookie Reply:
+//
+// A WireGuard server under load answers a MessageInitiation with a MessageCookieReply instead of a MessageResponse,
+// and only handles the next MessageInitiation with a valid MAC2, which is computed from the cookie in the reply.
+// The MessageCookieReply is always passed through to the client, which retries the handshake after REKEY_TIMEOUT.
+//
+// The retry is a new session in the forward table, so the cookie consumed for a session must outlive it: the cookie
+// generator is shared by all the sessions of a client public key to the same server public key. If the sender index
+// of a MessageInitiation is patched, its MAC1 and MAC2 are regenerated with the shared cookie generator, as the client
+// cannot decrypt the cookie of a patched MessageInitiation. Otherwise the packet is forwarded as is, with the MAC2
+// of the client, and the cookie generator only records its MAC1, so that the MessageCookieReply to it is consumed.
+//
+// The MAC2 is obfuscated with the rest of the message, only a zero MAC2 is stripped with the packet[1] set to 0x01,
+// see obfs.go. The packet[1] is written by the obfuscation only, and its flags are interpreted by the message type,
+// so the "MAC2 was zeroed" of a handshake message never collides with the flags of a MessageTransport.
+
+// cookieGeneratorOf returns the cookie generator for the MessageInitiation of the client public key of the account
+// to the server public key, shared by the sessions of the client public key, see "Cookie Reply".
+func (t *WireGuardIndexTranslationTable) cookieGeneratorOf(a *peerAccount, serverPublicKey NoisePublicKey) (cg *device.CookieGenerator) {
+	t.accountsLock.Lock()
+	defer t.accountsLock.Unlock()
+	if a.cookieGenerator == nil || a.cookieServerPublicKey != serverPublicKey {
+		a.cookieGenerator = &device.CookieGenerator{}
+		a.cookieGenerator.Init(serverPublicKey.NoisePublicKey)
+		a.cookieServerPublicKey = serverPublicKey
+	}
+	cg = a.cookieGenerator
+	return
+}
+
+// recordMAC1 records the MAC1 of an unpatched MessageInitiation in the cookie generator of the peer,
+// which is required to consume the MessageCookieReply to it. The packet itself is not modified.
+func (p *Peer) recordMAC1(packet *Packet) {
+	var msg [device.MessageInitiationSize]byte
+	copy(msg[:], packet.Slice())
+	p.clientCookieGenerator.AddMacs(msg[:])
+}
@@ -0,0 +1,300 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// e2eCookieFront is a UDP relay in front of a WireGuard server, which acts as the server always under load:
+// a MessageInitiation without a valid MAC2 is answered with a MessageCookieReply instead of being forwarded.
+type e2eCookieFront struct {
+	conn     *net.UDPConn
+	upstream *net.UDPAddr
+	checker  device.CookieChecker
+	client   atomic.Value
+
+	cookieReplies uint64
+	forwarded     uint64
+}
+
+func newE2ECookieFront(tb testing.TB, upstream string, serverPK NoisePublicKey) (f *e2eCookieFront) {
+	var err error
+	f = &e2eCookieFront{}
+	f.checker.Init(serverPK.NoisePublicKey)
+	f.upstream, err = net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = f.conn.Close() })
+	go f.relay()
+	return
+}
+
+func (f *e2eCookieFront) relay() {
+	buf := make([]byte, defaultMaxPacketSize)
+	for {
+		n, src, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if src.IP.Equal(f.upstream.IP) && src.Port == f.upstream.Port {
+			if client, ok := f.client.Load().(*net.UDPAddr); ok {
+				_, _ = f.conn.WriteToUDP(buf[:n], client)
+			}
+			continue
+		}
+		f.client.Store(src)
+		msg := buf[:n]
+		if n == device.MessageInitiationSize && msg[0] == device.MessageInitiationType {
+			if !f.checker.CheckMAC1(msg) {
+				continue
+			}
+			if !f.checker.CheckMAC2(msg, []byte(src.String())) {
+				reply, err := f.checker.CreateReply(msg, binary.LittleEndian.Uint32(msg[4:]), []byte(src.String()))
+				if err != nil {
+					continue
+				}
+				var b bytes.Buffer
+				_ = binary.Write(&b, binary.LittleEndian, reply)
+				_, _ = f.conn.WriteToUDP(b.Bytes(), src)
+				atomic.AddUint64(&f.cookieReplies, 1)
+				continue
+			}
+			atomic.AddUint64(&f.forwarded, 1)
+		}
+		_, _ = f.conn.WriteToUDP(msg, f.upstream)
+	}
+}
+
+func (f *e2eCookieFront) Addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func TestEndToEndCookieReply(t *testing.T) {
+	const obfsKey = "the server is under load"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+	front := newE2ECookieFront(t, netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), uint16(wgServerPort)).String(), serverPK)
+
+	padding := &ObfuscatePaddingConfig{MinLength: 256, MaxRandomTail: 64}
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       front.Addr(),
+					},
+				},
+			},
+		},
+		ObfuscateKey:     obfsKey,
+		ObfuscatePadding: padding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:           mwgpServerListen,
+		Listen:           ListenAddresses{mwgpClientListen},
+		ClientPublicKey:  clientPK,
+		ServerPublicKey:  serverPK,
+		ObfuscateKey:     obfsKey,
+		ObfuscatePadding: padding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+
+	// the client retries the handshake with the cookie after REKEY_TIMEOUT
+	msg := tuntest.Ping(serverIP, clientIP)
+	wgClient.tun.Outbound <- msg
+	select {
+	case msgRecv := <-wgServer.tun.Inbound:
+		if !bytes.Equal(msg, msgRecv) {
+			t.Fatalf("ping %s => %s: message mismatch", clientIP, serverIP)
+		}
+	case <-time.After(device.RekeyTimeout + 10*time.Second):
+		t.Fatalf("ping %s => %s: timeout with %d cookie replies", clientIP, serverIP, atomic.LoadUint64(&front.cookieReplies))
+	}
+	wgServer.ping(t, wgClient)
+
+	if atomic.LoadUint64(&front.cookieReplies) == 0 || atomic.LoadUint64(&front.forwarded) == 0 {
+		t.Errorf("expected the handshake completed with a cookie, got %d cookie replies and %d initiations forwarded",
+			atomic.LoadUint64(&front.cookieReplies), atomic.LoadUint64(&front.forwarded))
+	}
+}
+
+// testCookieInitiation returns a MessageInitiation of the sender with the macs of the cg.
+func testCookieInitiation(table *WireGuardIndexTranslationTable, cg *device.CookieGenerator, sender uint32) (packet *Packet) {
+	packet = table.obtainPacket()
+	packet.Length = device.MessageInitiationSize
+	binary.LittleEndian.PutUint32(packet.Data, device.MessageInitiationType)
+	binary.LittleEndian.PutUint32(packet.Data[4:], sender)
+	for i := 8; i < kMessageInitiationTypeMAC2Offset-16; i++ {
+		packet.Data[i] = byte(i)
+	}
+	cg.AddMacs(packet.Slice())
+	return
+}
+
+func TestWireGuardIndexTranslationTable_CookieReply(t *testing.T) {
+	_, serverPK := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = time.Minute
+	table.Logger = NewStdLogger(LogLevelError)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, serverPublicKey: serverPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820}}
+		return
+	}
+	var checker device.CookieChecker
+	checker.Init(serverPK.NoisePublicKey)
+	var wgClient device.CookieGenerator
+	wgClient.Init(serverPK.NoisePublicKey)
+	src := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:1000"))
+	upstream := []byte("127.0.0.1:2000")
+
+	// an unpatched MessageInitiation is answered with a cookie reply, which is consumed and passed through
+	peer, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := testCookieInitiation(table, &wgClient, 1)
+	origin := append([]byte(nil), packet.Slice()...)
+	peer.recordMAC1(packet)
+	if !bytes.Equal(packet.Slice(), origin) {
+		t.Errorf("expected the unpatched MessageInitiation not modified")
+	}
+	reply, err := checker.CreateReply(packet.Slice(), peer.clientProxyIndex, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.processServerMessageCookieReply(src, reply); err != nil {
+		t.Errorf("expected the cookie reply passed through: %v", err)
+	}
+	if !wgClient.ConsumeReply(reply) {
+		t.Errorf("expected the cookie reply to an unpatched MessageInitiation consumed by the client")
+	}
+
+	// the retry is a new session, whose MAC2 is valid once it is patched
+	peer2, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer2.clientCookieGenerator != peer.clientCookieGenerator {
+		t.Errorf("expected the cookie generator shared by the sessions of the client public key")
+	}
+	packet = testCookieInitiation(table, &wgClient, 2)
+	if !checker.CheckMAC2(packet.Slice(), upstream) {
+		t.Errorf("expected a valid MAC2 from the client")
+	}
+	_ = packet.SetSenderIndex(0x12345678)
+	packet.FixMACs(peer2.clientCookieGenerator)
+	if !checker.CheckMAC1(packet.Slice()) || !checker.CheckMAC2(packet.Slice(), upstream) {
+		t.Errorf("expected a valid MAC2 of the patched MessageInitiation")
+	}
+
+	// the reply to a patched MessageInitiation is consumed by the table only
+	reply, err = checker.CreateReply(packet.Slice(), peer2.clientProxyIndex, []byte("127.0.0.1:2001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.processServerMessageCookieReply(src, reply); err != nil {
+		t.Errorf("expected the cookie reply passed through: %v", err)
+	}
+	packet.FixMACs(peer2.clientCookieGenerator)
+	if !checker.CheckMAC2(packet.Slice(), []byte("127.0.0.1:2001")) {
+		t.Errorf("expected the cookie of the patched MessageInitiation consumed")
+	}
+
+	// an unknown reply is still an error
+	reply.Receiver = 0xdeadbeef
+	if _, err = table.processServerMessageCookieReply(src, reply); err == nil {
+		t.Errorf("expected the cookie reply to an unknown session dropped")
+	}
+}
+
+func TestWireGuardObfuscator_MAC2(t *testing.T) {
+	_, serverPK := e2eGenerateKey(t)
+	var checker device.CookieChecker
+	checker.Init(serverPK.NoisePublicKey)
+	var cg device.CookieGenerator
+	cg.Init(serverPK.NoisePublicKey)
+	table := NewWireGuardIndexTranslationTable()
+	upstream := []byte("127.0.0.1:2000")
+
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	obfuscator.Padding = &ObfuscatePaddingConfig{MinLength: 256, MaxRandomTail: 64}
+
+	packet := testCookieInitiation(table, &cg, 1)
+	reply, err := checker.CreateReply(packet.Slice(), 1, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cg.ConsumeReply(reply) {
+		t.Fatal("failed to consume the cookie reply")
+	}
+
+	for _, mac2 := range []bool{false, true} {
+		packet = testCookieInitiation(table, &cg, 2)
+		if !mac2 {
+			for i := kMessageInitiationTypeMAC2Offset; i < device.MessageInitiationSize; i++ {
+				packet.Data[i] = 0
+			}
+		}
+		origin := append([]byte(nil), packet.Slice()...)
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		obfuscator.Obfuscate(packet)
+		if packet.Length < device.MessageInitiationSize+kObfuscateNonceLength {
+			t.Fatalf("mac2 %v: unexpected obfuscated length %d", mac2, packet.Length)
+		}
+		obfuscator.Deobfuscate(packet)
+		if !bytes.Equal(packet.Slice(), origin) {
+			t.Errorf("mac2 %v: expected %x, got %x", mac2, origin, packet.Slice())
+		}
+		if mac2 && !checker.CheckMAC2(packet.Slice(), upstream) {
+			t.Errorf("expected a valid MAC2 after the obfuscation")
+		}
+	}
+
+	// the flags of a MessageTransport in the packet[1] are never read as "MAC2 was zeroed" of a MessageInitiation
+	packet = table.obtainPacket()
+	packet.Length = device.MessageTransportSize
+	packet.Data[0] = device.MessageTransportType
+	packet.Flags |= PacketFlagObfuscateBeforeSend
+	obfuscator.Obfuscate(packet)
+	obfuscator.Deobfuscate(packet)
+	if packet.Length != device.MessageTransportSize || packet.ReservedByte(1) != 0 {
+		t.Errorf("expected the MessageTransport restored, got %x", packet.Slice())
+	}
+}
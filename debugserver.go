@@ -0,0 +1,107 @@
+package mwgp
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// debugServer exposes net/http/pprof at /debug/pprof/ and expvar at /debug/vars.
+//
+// The handlers are registered on its own mux instead of the http.DefaultServeMux,
+// so that nothing is exposed unless the debug_listen is set.
+type debugServer struct {
+	listener  net.Listener
+	server    *http.Server
+	statsFunc func() Stats
+	logger    Logger
+}
+
+// validateDebugListen refuses the non-loopback debug_listen address unless allowRemote,
+// since pprof exposes the command line and the memory of the process.
+func validateDebugListen(listen string, allowRemote bool) (err error) {
+	if listen == "" || allowRemote {
+		return
+	}
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		err = fmt.Errorf("invalid debug_listen address %s: %w", listen, err)
+		return
+	}
+	if addr.IP == nil || !addr.IP.IsLoopback() {
+		err = fmt.Errorf("debug_listen address %s is not a loopback address, set debug_allow_remote to bind it anyway", listen)
+		return
+	}
+	return
+}
+
+func newDebugServer(listen string, logger Logger, statsFunc func() Stats) (ds *debugServer, err error) {
+	ds = &debugServer{
+		statsFunc: statsFunc,
+		logger:    logger,
+	}
+	ds.listener, err = net.Listen("tcp", listen)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to listen on debug addr %s: %w", listen, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", ds.handleVars)
+	ds.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return
+}
+
+// Serve serves the debug endpoints until closeChan is closed.
+func (ds *debugServer) Serve(closeChan <-chan struct{}) {
+	go func() {
+		<-closeChan
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if ds.server.Shutdown(ctx) != nil {
+			// a running CPU profile or trace might take longer
+			_ = ds.server.Close()
+		}
+	}()
+	ds.logger.Infof("debug listen on %s ...", ds.listener.Addr())
+	err := ds.server.Serve(ds.listener)
+	if err != nil && err != http.ErrServerClosed {
+		ds.logger.Errorf("debug server stopped: %s", err.Error())
+	}
+}
+
+// handleVars writes the published expvar variables along with the Stats as "mwgp",
+// in the same format as expvar.Handler().
+//
+// The Stats is not published to the global expvar registry,
+// since there might be more than one Server or Client in a process.
+func (ds *debugServer) handleVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			_, _ = fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		_, _ = fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	stats, _ := json.Marshal(ds.statsFunc())
+	if !first {
+		_, _ = fmt.Fprintf(w, ",\n")
+	}
+	_, _ = fmt.Fprintf(w, "%q: %s", "mwgp", stats)
+	_, _ = fmt.Fprintf(w, "\n}\n")
+}
@@ -0,0 +1,65 @@
+package mwgp
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Drain:
+//
+// Before a planned restart, Drain() stops the table from accepting the new clients, while the established
+// sessions are still forwarded until they expire. A client is new unless it has completed a handshake
+// (see latestPeers), so the rekeys of the established clients are still accepted.
+// The MessageInitiation of a new client is dropped, or relayed to the DrainForward address if set,
+// such as another mwgp-server (or the one started to replace this), along with the following packets
+// from the same source, see fallbackSession.
+
+const (
+	drainStateNone = iota
+	drainStateDraining
+	// drainStateDrained is set once all the sessions are expired.
+	drainStateDrained
+)
+
+var errDraining = errors.New("draining, new sessions are not accepted")
+
+// Drain stops accepting new clients, it cannot be undone.
+func (t *WireGuardIndexTranslationTable) Drain() {
+	if !atomic.CompareAndSwapInt32(&t.drainState, drainStateNone, drainStateDraining) {
+		return
+	}
+	t.mapLock.RLock()
+	remaining := t.clientMap.lenLocked()
+	t.mapLock.RUnlock()
+	if t.DrainForward != nil {
+		t.Logger.Infof("draining: new clients are relayed to %s, %d sessions remaining", t.DrainForward, remaining)
+	} else {
+		t.Logger.Infof("draining: new clients are dropped, %d sessions remaining", remaining)
+	}
+}
+
+// Draining reports whether Drain() is called.
+func (t *WireGuardIndexTranslationTable) Draining() bool {
+	return atomic.LoadInt32(&t.drainState) != drainStateNone
+}
+
+// acceptsClientLocked reports whether a MessageInitiation from the client can create a new peer.
+func (t *WireGuardIndexTranslationTable) acceptsClientLocked(clientPublicKey NoisePublicKey) bool {
+	if !t.Draining() {
+		return true
+	}
+	latest := t.latestPeers[clientPublicKey]
+	if latest == nil {
+		return false
+	}
+	current, _ := t.clientMap.loadLocked(latest.clientProxyIndex)
+	return current == latest
+}
+
+// checkDrainedLocked logs once all the sessions are expired after Drain().
+func (t *WireGuardIndexTranslationTable) checkDrainedLocked() {
+	if t.clientMap.lenLocked() != 0 || !atomic.CompareAndSwapInt32(&t.drainState, drainStateDraining, drainStateDrained) {
+		return
+	}
+	t.Logger.Infof("drained: no session remaining")
+}
@@ -0,0 +1,81 @@
+package mwgp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration in config.
+//
+// It can be either a number of seconds (for backward compatibility),
+// or a duration string like "90s", "2m" and "500ms".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() (result []byte, err error) {
+	result = []byte(strconv.Quote(time.Duration(d).String()))
+	return
+}
+
+func (d *Duration) UnmarshalJSON(bytes []byte) (err error) {
+	s := strings.TrimSpace(string(bytes))
+	if s == "null" {
+		return
+	}
+	if strings.HasPrefix(s, "\"") {
+		s, err = strconv.Unquote(s)
+		if err != nil {
+			return
+		}
+		var td time.Duration
+		td, err = time.ParseDuration(s)
+		if err != nil {
+			err = fmt.Errorf("invalid duration %q: %w", s, err)
+			return
+		}
+		*d = Duration(td)
+		return
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		err = fmt.Errorf("invalid duration %s: must be a number of seconds or a duration string", s)
+		return
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return
+}
+
+// DurationRangeError is returned when a duration in config is not in (0, Max].
+type DurationRangeError struct {
+	Option string
+	Value  time.Duration
+	Max    time.Duration
+}
+
+func (e *DurationRangeError) Error() string {
+	if e.Value <= 0 {
+		return fmt.Sprintf("option %q must be positive, got %s", e.Option, e.Value)
+	}
+	return fmt.Sprintf("option %q must not exceed %s, got %s", e.Option, e.Max, e.Value)
+}
+
+func (e *DurationRangeError) Is(target error) bool {
+	return target == ErrConfig
+}
+
+// validate checks the duration unless it is not set (zero).
+func (d Duration) validate(option string, max time.Duration) (err error) {
+	if d == 0 {
+		return
+	}
+	if d < 0 || time.Duration(d) > max {
+		err = &DurationRangeError{
+			Option: option,
+			Value:  time.Duration(d),
+			Max:    max,
+		}
+		return
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	cases := map[string]time.Duration{
+		`60`:      60 * time.Second,
+		`0.5`:     500 * time.Millisecond,
+		`"90s"`:   90 * time.Second,
+		`"2m"`:    2 * time.Minute,
+		`"500ms"`: 500 * time.Millisecond,
+		`"1h30m"`: 90 * time.Minute,
+	}
+	for input, expected := range cases {
+		var d Duration
+		err := json.Unmarshal([]byte(input), &d)
+		if err != nil {
+			t.Errorf("failed to unmarshal %s: %s", input, err.Error())
+			continue
+		}
+		if time.Duration(d) != expected {
+			t.Errorf("%s is unmarshalled to %s, expected %s", input, time.Duration(d), expected)
+		}
+
+		// round trip
+		bs, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rd Duration
+		err = json.Unmarshal(bs, &rd)
+		if err != nil || rd != d {
+			t.Errorf("%s cannot be round tripped via %s", input, bs)
+		}
+	}
+
+	for _, input := range []string{`"60"`, `"1 minute"`, `true`, `"-"`} {
+		var d Duration
+		if err := json.Unmarshal([]byte(input), &d); err == nil {
+			t.Errorf("invalid duration %s is accepted as %s", input, time.Duration(d))
+		}
+	}
+}
+
+func TestDuration_Validate(t *testing.T) {
+	var config ClientConfig
+	err := json.Unmarshal([]byte(`{"listen": "127.0.0.1:0", "server": "127.0.0.1:1", "timeout": 60000}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewClientWithConfig(&config)
+	var rangeErr *DurationRangeError
+	if !errors.As(err, &rangeErr) || rangeErr.Option != "timeout" {
+		t.Errorf("expected DurationRangeError for timeout, got %v", err)
+	}
+
+	config.Timeout = Duration(-time.Second)
+	_, err = NewClientWithConfig(&config)
+	if !errors.As(err, &rangeErr) {
+		t.Errorf("expected DurationRangeError for negative timeout, got %v", err)
+	}
+
+	config.Timeout = Duration(90 * time.Second)
+	client, err := NewClientWithConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.wgitTable.Timeout != 90*time.Second {
+		t.Errorf("unexpected timeout %s", client.wgitTable.Timeout)
+	}
+}
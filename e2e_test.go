@@ -0,0 +1,605 @@
+package mwgp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type e2eWireGuardDevice struct {
+	tun *tuntest.ChannelTUN
+	dev *device.Device
+	ip  netip.Addr
+}
+
+func newE2EWireGuardDevice(tb testing.TB, ip netip.Addr, sk NoisePrivateKey, peerPK NoisePublicKey, peerIP netip.Addr, endpoint string) (d *e2eWireGuardDevice, port int) {
+	return newE2EWireGuardDeviceWithBind(tb, conn.NewDefaultBind(), ip, sk, peerPK, peerIP, endpoint)
+}
+
+func newE2EWireGuardDeviceWithBind(tb testing.TB, bind conn.Bind, ip netip.Addr, sk NoisePrivateKey, peerPK NoisePublicKey, peerIP netip.Addr, endpoint string) (d *e2eWireGuardDevice, port int) {
+	d = &e2eWireGuardDevice{
+		tun: tuntest.NewChannelTUN(),
+		ip:  ip,
+	}
+	d.dev = device.NewDevice(d.tun.TUN(), bind, device.NewLogger(device.LogLevelError, fmt.Sprintf("wg(%s): ", ip)))
+	cfg := fmt.Sprintf("private_key=%s\nlisten_port=0\nreplace_peers=true\npublic_key=%s\nprotocol_version=1\nreplace_allowed_ips=true\nallowed_ip=%s/32\n",
+		hex.EncodeToString(sk.NoisePrivateKey[:]), hex.EncodeToString(peerPK.NoisePublicKey[:]), peerIP)
+	if endpoint != "" {
+		cfg += fmt.Sprintf("endpoint=%s\n", endpoint)
+	}
+	err := d.dev.IpcSet(cfg)
+	if err != nil {
+		tb.Fatalf("failed to configure wireguard device: %s", err.Error())
+	}
+	err = d.dev.Up()
+	if err != nil {
+		tb.Fatalf("failed to bring up wireguard device: %s", err.Error())
+	}
+	tb.Cleanup(d.dev.Close)
+
+	uapi, err := d.dev.IpcGet()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(uapi))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "listen_port=") {
+			port, _ = strconv.Atoi(strings.TrimPrefix(scanner.Text(), "listen_port="))
+		}
+	}
+	return
+}
+
+func (d *e2eWireGuardDevice) ping(tb testing.TB, dst *e2eWireGuardDevice) {
+	msg := tuntest.Ping(dst.ip, d.ip)
+	d.tun.Outbound <- msg
+	select {
+	case msgRecv := <-dst.tun.Inbound:
+		if !bytes.Equal(msg, msgRecv) {
+			tb.Fatalf("ping %s => %s: message mismatch", d.ip, dst.ip)
+		}
+	case <-time.After(10 * time.Second):
+		tb.Fatalf("ping %s => %s: timeout", d.ip, dst.ip)
+	}
+}
+
+// e2eSniffer is a UDP relay between the mwgp-client and the mwgp-server,
+// which records every packet passing through it.
+type e2eSniffer struct {
+	conn      *net.UDPConn
+	upstream  *net.UDPAddr
+	lock      sync.Mutex
+	client    *net.UDPAddr
+	packets   [][]byte
+	closeChan chan struct{}
+}
+
+func newE2ESniffer(tb testing.TB, upstream string) (s *e2eSniffer) {
+	var err error
+	s = &e2eSniffer{
+		closeChan: make(chan struct{}),
+	}
+	s.upstream, err = net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		close(s.closeChan)
+		_ = s.conn.Close()
+	})
+	go s.relay()
+	return
+}
+
+func (s *e2eSniffer) relay() {
+	buf := make([]byte, defaultMaxPacketSize)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.packets = append(s.packets, append([]byte(nil), buf[:n]...))
+		dst := s.upstream
+		if src.IP.Equal(s.upstream.IP) && src.Port == s.upstream.Port {
+			dst = s.client
+		} else {
+			s.client = src
+		}
+		s.lock.Unlock()
+		if dst != nil {
+			_, _ = s.conn.WriteToUDP(buf[:n], dst)
+		}
+	}
+}
+
+func (s *e2eSniffer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func e2eFreeUDPAddr(tb testing.TB) string {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+func e2eFreeTCPAddr(tb testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func e2eGenerateKey(tb testing.TB) (sk NoisePrivateKey, pk NoisePublicKey) {
+	_, err := rand.Read(sk.NoisePrivateKey[:])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sk.NoisePrivateKey[0] &= 248
+	sk.NoisePrivateKey[31] = (sk.NoisePrivateKey[31] & 127) | 64
+	pk = sk.PublicKey()
+	return
+}
+
+func TestEndToEndObfuscation(t *testing.T) {
+	testEndToEndObfuscation(t, ObfuscateModeXOR)
+}
+
+func TestEndToEndObfuscationAuthenticated(t *testing.T) {
+	testEndToEndObfuscation(t, ObfuscateModeAuthenticated)
+}
+
+func testEndToEndObfuscation(t *testing.T, obfsMode string) {
+	const obfsKey = "kisekimo, mahoumo, muryoudewaarimasen"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	mwgpServerMetricsListen := e2eFreeTCPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen:            ListenAddresses{mwgpServerListen},
+		MetricsListen:     mwgpServerMetricsListen,
+		LatencySampleRate: 1,
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey:  obfsKey,
+		ObfuscateMode: obfsMode,
+		// the server uses batch I/O (on Linux) while the client does not, so both paths are covered
+		BatchSize: 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	sniffer := newE2ESniffer(t, mwgpServerListen)
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	mwgpClientDebugListen := e2eFreeTCPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          sniffer.Addr(),
+		Listen:          ListenAddresses{mwgpClientListen},
+		DebugListen:     mwgpClientDebugListen,
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+		ObfuscateMode:   obfsMode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	for name, stats := range map[string]Stats{"server": server.Stats(), "client": client.Stats()} {
+		if stats.ActiveSessions == 0 || stats.TotalSessionsCreated == 0 {
+			t.Errorf("%s: no session in stats: %+v", name, stats)
+		}
+		if stats.PacketsForwarded < 4 || stats.BytesForwarded == 0 {
+			t.Errorf("%s: too few packets forwarded in stats: %+v", name, stats)
+		}
+		for _, ps := range stats.Peers {
+			if ps.ClientToServerPackets == 0 || ps.ServerToClientPackets == 0 {
+				t.Errorf("%s: peer has no traffic in stats: %+v", name, ps)
+			}
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", mwgpServerMetricsListen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{
+		"mwgp_sessions_active ",
+		"mwgp_forwarded_packets_total ",
+		"mwgp_received_packets_total{obfuscated=\"true\"} ",
+		fmt.Sprintf("mwgp_peer_packets_total{peer=%q,", clientPK.Base64()),
+		"mwgp_packet_latency_seconds_count{direction=\"client_to_server\",type=\"handshake\"} ",
+		"mwgp_packet_latency_seconds_bucket{direction=\"server_to_client\",type=\"transport\",le=\"+Inf\"} ",
+	} {
+		var found bool
+		for _, line := range strings.Split(string(metrics), "\n") {
+			if strings.HasPrefix(line, prefix) && !strings.HasSuffix(line, " 0") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("metric %s not found or zero in:\n%s", prefix, metrics)
+		}
+	}
+
+	for path, expected := range map[string]string{
+		"/debug/pprof/goroutine?debug=1": "goroutine profile:",
+		"/debug/vars":                    `"ActiveSessions":1`,
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", mwgpClientDebugListen, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("%s: %q not found in:\n%s", path, expected, body)
+		}
+	}
+	_ = client.Stop()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", mwgpClientDebugListen)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if i >= 50 {
+			t.Fatalf("debug server still listening on %s after Stop()", mwgpClientDebugListen)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	sniffer.lock.Lock()
+	defer sniffer.lock.Unlock()
+	if len(sniffer.packets) == 0 {
+		t.Fatal("no packet passed through the sniffer")
+	}
+	for i, p := range sniffer.packets {
+		if len(p) >= 4 && p[0] >= 1 && p[0] <= 4 && p[1] == 0 && p[2] == 0 && p[3] == 0 {
+			t.Errorf("packet #%d on the wire has a plaintext WireGuard header: %x", i, p[:4])
+		}
+	}
+}
+
+func TestEndToEndReload(t *testing.T) {
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	serverConfig := func(obfsKey string, timeout time.Duration, peerPKs ...NoisePublicKey) *ServerConfig {
+		sk := serverSK
+		var peers []*ServerConfigPeer
+		for i := range peerPKs {
+			peers = append(peers, &ServerConfigPeer{
+				ClientPublicKey: &peerPKs[i],
+				ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+			})
+		}
+		return &ServerConfig{
+			Listen:  ListenAddresses{mwgpServerListen},
+			Timeout: Duration(timeout),
+			Servers: []*ServerConfigServer{
+				{
+					PrivateKey: &sk,
+					Address:    "127.0.0.1",
+					Peers:      peers,
+				},
+			},
+			ObfuscateKey: obfsKey,
+		}
+	}
+	server, err := NewServerWithConfig(serverConfig("old password", 0, clientPK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	clientConfig := func(obfsKey string) *ClientConfig {
+		return &ClientConfig{
+			Server:          mwgpServerListen,
+			Listen:          ListenAddresses{mwgpClientListen},
+			ClientPublicKey: clientPK,
+			ServerPublicKey: serverPK,
+			ObfuscateKey:    obfsKey,
+		}
+	}
+	client, err := NewClientWithConfig(clientConfig("old password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+
+	// reload mid-traffic, the unchanged peer should not lose any packet
+	droppedBefore := server.Stats().DroppedPackets
+	reloadErrChan := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		reloadErrChan <- server.Reload(serverConfig("old password", 90*time.Second, clientPK, otherPK))
+	}()
+	for i := 0; i < 20; i++ {
+		wgClient.ping(t, wgServer)
+		wgServer.ping(t, wgClient)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err = <-reloadErrChan; err != nil {
+		t.Fatalf("failed to reload: %s", err.Error())
+	}
+	stats := server.Stats()
+	if stats.DroppedPackets != droppedBefore {
+		t.Errorf("%d packets dropped during reload", stats.DroppedPackets-droppedBefore)
+	}
+	if stats.ActiveSessions != 1 || stats.SessionsExpired != 0 {
+		t.Errorf("the session is not kept during reload: %+v", stats)
+	}
+
+	// the listen address cannot be changed
+	changedListen := serverConfig("old password", 90*time.Second, clientPK)
+	changedListen.Listen = ListenAddresses{e2eFreeUDPAddr(t)}
+	if err = server.Reload(changedListen); err == nil {
+		t.Errorf("listen address change is not rejected")
+	}
+
+	// a config rejected by NewServerWithConfig (or NewClientWithConfig) is rejected without applying anything
+	invalidServer := serverConfig("invalid password", 90*time.Second, clientPK)
+	invalidServer.MaxPacketSize = 1
+	if err = server.Reload(invalidServer); err == nil || !strings.Contains(err.Error(), "max_packet_size") {
+		t.Errorf("invalid max_packet_size is not rejected, got %v", err)
+	}
+	invalidClient := clientConfig("invalid password")
+	invalidClient.ObfuscatePadding = &ObfuscatePaddingConfig{Probability: 2}
+	if err = client.Reload(invalidClient); err == nil || !strings.Contains(err.Error(), "obfs_padding") {
+		t.Errorf("invalid obfs_padding is not rejected, got %v", err)
+	}
+	wgClient.ping(t, wgServer)
+
+	// a new obfuscation key on both ends
+	if err = server.Reload(serverConfig("new password", 90*time.Second, clientPK, otherPK)); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Reload(clientConfig("new password")); err != nil {
+		t.Fatal(err)
+	}
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	// the session of a removed peer is evicted
+	if err = server.Reload(serverConfig("new password", 90*time.Second, otherPK)); err != nil {
+		t.Fatal(err)
+	}
+	if stats = server.Stats(); stats.ActiveSessions != 0 {
+		t.Errorf("the session of removed peer is not evicted: %+v", stats)
+	}
+}
+
+func TestEndToEndPeerAPI(t *testing.T) {
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &otherPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	if err = server.AddPeer(serverPK, &ServerConfigPeer{
+		ClientPublicKey: &clientPK,
+		ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.AddPeer(serverPK, &ServerConfigPeer{
+		ClientPublicKey: &clientPK,
+		ForwardTo:       ":1",
+	}); err == nil {
+		t.Errorf("duplicated peer is not rejected")
+	}
+	if err = server.AddPeer(otherPK, &ServerConfigPeer{ForwardTo: ":1"}); err == nil {
+		t.Errorf("peer of unknown server is not rejected")
+	}
+	if err = server.AddPeer(serverPK, &ServerConfigPeer{}); err == nil {
+		t.Errorf("peer without forward_to is not rejected")
+	}
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+
+	// removing another peer keeps the session
+	if err = server.RemovePeer(serverPK, &otherPK); err != nil {
+		t.Fatal(err)
+	}
+	if stats := server.Stats(); stats.ActiveSessions != 1 {
+		t.Errorf("the session is not kept: %+v", stats)
+	}
+	wgServer.ping(t, wgClient)
+
+	if err = server.RemovePeer(serverPK, &clientPK); err != nil {
+		t.Fatal(err)
+	}
+	if stats := server.Stats(); stats.ActiveSessions != 0 {
+		t.Errorf("the session of removed peer is not evicted: %+v", stats)
+	}
+	if err = server.RemovePeer(serverPK, &clientPK); err == nil {
+		t.Errorf("removing an absent peer is not rejected")
+	}
+	if err = server.RemovePeer(serverPK, nil); err == nil {
+		t.Errorf("removing an absent fallback peer is not rejected")
+	}
+}
+
+func TestEndToEndShortDatagrams(t *testing.T) {
+	const obfsKey = "short datagrams"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	for _, listen := range []string{mwgpClientListen, mwgpServerListen} {
+		addr := netip.MustParseAddrPort(listen)
+		for _, length := range []int{0, 1, 3} {
+			if _, err = attacker.WriteToUDPAddrPort(make([]byte, length), addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+	if stats := client.Stats(); stats.PacketPanics != 0 || stats.DroppedPackets < 3 {
+		t.Errorf("expected the short datagrams dropped without a panic on mwgp-client, got %d dropped and %d panics", stats.DroppedPackets, stats.PacketPanics)
+	}
+	if stats := server.Stats(); stats.PacketPanics != 0 {
+		t.Errorf("expected the short datagrams dropped without a panic on mwgp-server, got %d panics", stats.PacketPanics)
+	}
+}
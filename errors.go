@@ -0,0 +1,65 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error Categories:
+//
+// The errors returned by mwgp are matched by errors.Is to one of the categories below,
+// so that an embedding application can branch on them without parsing the messages:
+//
+//   - ErrConfig: an invalid config, returned by Validate(), NewServerWithConfig, NewClientWithConfig,
+//     Reload() and UnmarshalConfig, including the ConfigErrors and the DurationRangeError.
+//   - ErrNetwork: a socket cannot be listened on or bound, a name cannot be resolved,
+//     or the sockets fail while serving.
+//   - ErrProtocol: a packet is malformed, or not acceptable by the WireGuard protocol.
+//   - ErrCrypto: a packet cannot be decrypted, or the obfuscation fails.
+//
+// An error might be in more than one category, e.g. an unresolvable forward_to is both ErrConfig and ErrNetwork.
+// The messages are not changed by the categories, and carry the addresses or the public keys involved,
+// but never a private key or an obfuscation key.
+
+var (
+	ErrConfig   = errors.New("config error")
+	ErrNetwork  = errors.New("network error")
+	ErrProtocol = errors.New("protocol error")
+	ErrCrypto   = errors.New("crypto error")
+)
+
+// categorizedError is an error in a category, with the message of the error as-is.
+type categorizedError struct {
+	category error
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+func (e *categorizedError) Is(target error) bool {
+	return target == e.category
+}
+
+// categorize puts the err into the category, nil if the err is nil, or as-is if it is in the category already.
+func categorize(category error, err error) error {
+	if err == nil || errors.Is(err, category) {
+		return err
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+// newError is errors.New in the category.
+func newError(category error, text string) error {
+	return &categorizedError{category: category, err: errors.New(text)}
+}
+
+// errorf is fmt.Errorf in the category, the categories of the error wrapped by %w are kept.
+func errorf(category error, format string, a ...interface{}) error {
+	return categorize(category, fmt.Errorf(format, a...))
+}
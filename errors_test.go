@@ -0,0 +1,163 @@
+package mwgp
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCategorize(t *testing.T) {
+	if categorize(ErrConfig, nil) != nil {
+		t.Errorf("expected nil categorized to nil")
+	}
+	inner := errorf(ErrNetwork, "failed to listen on %s: %w", "127.0.0.1:1000", os.ErrPermission)
+	err := errorf(ErrConfig, "server[0]: %w", inner)
+	if err.Error() != "server[0]: failed to listen on 127.0.0.1:1000: permission denied" {
+		t.Errorf("message is changed by the categories: %s", err)
+	}
+	for _, target := range []error{ErrConfig, ErrNetwork, os.ErrPermission, inner} {
+		if !errors.Is(err, target) {
+			t.Errorf("expected %q matched by %q", err, target)
+		}
+	}
+	if errors.Is(err, ErrProtocol) || errors.Is(err, ErrCrypto) {
+		t.Errorf("expected %q not matched by the other categories", err)
+	}
+	if again := categorize(ErrConfig, err); again != err {
+		t.Errorf("expected an error in the category as-is")
+	}
+	var rangeErr *DurationRangeError
+	if !errors.As(categorize(ErrNetwork, Duration(-1).validate("timeout", time.Hour)), &rangeErr) {
+		t.Errorf("expected errors.As through the category")
+	}
+
+	if _, err = (&Packet{}).ReceiverIndex(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected ErrProtocol for an empty packet, got %v", err)
+	}
+	if !errors.Is(errTCPFrameTooLarge, ErrProtocol) || !errors.Is(errPreflightTimeout, ErrNetwork) {
+		t.Errorf("expected the sentinel errors in the categories")
+	}
+}
+
+func TestErrConfig(t *testing.T) {
+	sk, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	listen := ListenAddresses{e2eFreeUDPAddr(t)}
+	serverConfig := func() *ServerConfig {
+		return &ServerConfig{
+			Listen: listen,
+			Servers: []*ServerConfigServer{{
+				PrivateKey: &sk,
+				Peers:      []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820", ClientPublicKey: &clientPK}},
+			}},
+		}
+	}
+	clientConfig := func() *ClientConfig {
+		return &ClientConfig{
+			Server:          "127.0.0.1:1",
+			Listen:          listen,
+			ClientPublicKey: clientPK,
+			ServerPublicKey: clientPK,
+		}
+	}
+	server, err := NewServerWithConfig(serverConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientWithConfig(clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func() error{
+		"server single problem": func() error {
+			c := serverConfig()
+			c.Servers = nil
+			return c.Validate()
+		},
+		"server problems": func() error {
+			c := serverConfig()
+			c.Servers = nil
+			c.Timeout = Duration(48 * time.Hour)
+			return c.Validate()
+		},
+		"server peer": func() error {
+			c := serverConfig()
+			c.Servers[0].Peers[0].ForwardTo = "127.0.0.1"
+			_, err := NewServerWithConfig(c)
+			return err
+		},
+		"server duration": func() error {
+			c := serverConfig()
+			c.ResolveInterval = -1
+			_, err := NewServerWithConfig(c)
+			return err
+		},
+		"server reload listen": func() error {
+			c := serverConfig()
+			c.Listen = ListenAddresses{e2eFreeUDPAddr(t)}
+			return server.Reload(c)
+		},
+		"server reload servers": func() error {
+			c := serverConfig()
+			c.Servers = nil
+			return server.Reload(c)
+		},
+		"server reload obfs": func() error {
+			c := serverConfig()
+			c.ObfuscateKey = "short"
+			return server.Reload(c)
+		},
+		"client single problem": func() error {
+			c := clientConfig()
+			c.Transport = "sctp"
+			return c.Validate()
+		},
+		"client problems": func() error {
+			c := clientConfig()
+			c.Transport = "sctp"
+			c.HopInterval = -1
+			_, err := NewClientWithConfig(c)
+			return err
+		},
+		"client reload listen": func() error {
+			c := clientConfig()
+			c.Listen = ListenAddresses{e2eFreeUDPAddr(t)}
+			return client.Reload(c)
+		},
+		"client reload timeout": func() error {
+			c := clientConfig()
+			c.Timeout = -1
+			return client.Reload(c)
+		},
+		"unmarshal format": func() error {
+			return UnmarshalConfig([]byte("{}"), "ini", &ServerConfig{})
+		},
+		"unmarshal json": func() error {
+			return UnmarshalConfig([]byte(`{"timeout": "forever"}`), ConfigFormatJSON, &ServerConfig{})
+		},
+		"unmarshal yaml": func() error {
+			return UnmarshalConfig([]byte("unknown: 1"), ConfigFormatYAML, &ServerConfig{})
+		},
+		"unmarshal env": func() error {
+			return UnmarshalConfigWithEnv([]byte(`{"obfs": "${MWGP_TEST_UNSET}"}`), ConfigFormatJSON, &ServerConfig{}, func(string) (string, bool) {
+				return "", false
+			})
+		},
+	}
+	for name, f := range cases {
+		err := f()
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+			continue
+		}
+		if !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected ErrConfig, got %v", name, err)
+		}
+		if strings.Contains(err.Error(), sk.Base64()) {
+			t.Errorf("%s: the private key is leaked in %q", name, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package mwgp
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Session Eviction:
+//
+// EvictSessions cuts off the sessions selected by a SessionFilter immediately, instead of at the timeout,
+// such as all the sessions of a compromised client key. The evicted sessions are removed from the forward table,
+// their upstream sockets are closed unless other sessions still use them, and the OnSessionExpired is called
+// with the SessionEndEvicted.
+//
+// An evicted client is not blocked, a new handshake of it creates a new session as usual,
+// remove its peer as well (see RemovePeer) to keep it out.
+
+// SessionFilter selects the sessions matching all the fields set, the zero SessionFilter selects none.
+type SessionFilter struct {
+	// PeerID is the client public key.
+	PeerID *NoisePublicKey
+
+	// SessionID is the random ID in the logs of the session, see SessionInfo.
+	SessionID string
+
+	// ClientAddress is the address or the network the client packets come from, like 192.0.2.1/32 or 2001:db8::/32.
+	ClientAddress netip.Prefix
+
+	// IdleLongerThan selects the sessions without any packet for longer than it.
+	IdleLongerThan time.Duration
+}
+
+func (f *SessionFilter) isZero() bool {
+	return f.PeerID == nil && f.SessionID == "" && !f.ClientAddress.IsValid() && f.IdleLongerThan <= 0
+}
+
+// match reports whether the peer is selected at the now,
+// the ClientAddress must have been unmapped, see unmapPrefix.
+func (f *SessionFilter) match(peer *Peer, now time.Time) bool {
+	if f.PeerID != nil && peer.clientPublicKey != *f.PeerID {
+		return false
+	}
+	if f.SessionID != "" && peer.sessionID != f.SessionID {
+		return false
+	}
+	if f.ClientAddress.IsValid() {
+		destination := peer.clientAddr()
+		if destination == nil {
+			return false
+		}
+		addr, ok := netip.AddrFromSlice(destination.IP)
+		if !ok || !f.ClientAddress.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	if f.IdleLongerThan > 0 && now.Sub(peer.lastActiveTime()) <= f.IdleLongerThan {
+		return false
+	}
+	return true
+}
+
+// unmapPrefix returns the IPv4 prefix of an IPv4-mapped IPv6 prefix, so that it matches the IPv4 addresses.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.IsValid() || !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked()
+}
+
+// evictSessions removes the peers selected by the filter, and closes their upstream sockets not used anymore.
+func (t *WireGuardIndexTranslationTable) evictSessions(filter SessionFilter, now time.Time) (count int) {
+	if filter.isZero() {
+		return
+	}
+	filter.ClientAddress = unmapPrefix(filter.ClientAddress)
+	removed := t.removePeers(func(peer *Peer) bool {
+		return filter.match(peer, now)
+	}, SessionEndEvicted)
+	t.closeUpstreamConnsOf(removed)
+	count = len(removed)
+	return
+}
+
+// closeUpstreamConnsOf closes the sockets the removed peers are forwarded through, unless other peers use them.
+func (t *WireGuardIndexTranslationTable) closeUpstreamConnsOf(removed []*Peer) {
+	if len(removed) == 0 {
+		return
+	}
+	// with the mapLock held, a new peer either is counted below, or creates a new socket
+	t.mapLock.RLock()
+	defer t.mapLock.RUnlock()
+	inUse := make(map[netip.AddrPort]struct{})
+	pinnedInUse := make(map[NoisePublicKey]struct{})
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		if peer.upstreamPortMin != 0 {
+			pinnedInUse[peer.clientPublicKey] = struct{}{}
+		} else if destination := peer.serverAddr(); destination != nil {
+			inUse[upstreamKey(destination)] = struct{}{}
+		}
+		return true
+	})
+
+	t.upstreamConnsLock.Lock()
+	defer t.upstreamConnsLock.Unlock()
+	for _, peer := range removed {
+		if peer.upstreamPortMin != 0 {
+			if _, ok := pinnedInUse[peer.clientPublicKey]; ok {
+				continue
+			}
+			if p := t.pinnedUpstreams[peer.clientPublicKey]; p != nil {
+				if p.uc != nil {
+					_ = p.uc.transport.Close()
+				}
+				delete(t.pinnedUpstreams, peer.clientPublicKey)
+			}
+			continue
+		}
+		destination := peer.serverAddr()
+		if destination == nil {
+			continue
+		}
+		key := upstreamKey(destination)
+		if _, ok := inUse[key]; ok {
+			continue
+		}
+		if uc := t.upstreamConns[key]; uc != nil {
+			_ = uc.transport.Close()
+			delete(t.upstreamConns, key)
+		}
+	}
+}
+
+// EvictSessions removes the sessions selected by the filter immediately, and returns the number of them,
+// see "Session Eviction".
+func (s *Server) EvictSessions(filter SessionFilter) (count int) {
+	count = s.wgitTable.evictSessions(filter, time.Now())
+	if count > 0 {
+		s.Logger.Infof("%d sessions evicted", count)
+	}
+	return
+}
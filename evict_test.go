@@ -0,0 +1,99 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_EvictSessions(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	var serverAddrs []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		serverAddrs = append(serverAddrs, server.LocalAddr().(*net.UDPAddr))
+	}
+
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = time.Minute
+	table.Logger = NewStdLogger(LogLevelError)
+	var sp *ServerConfigPeer
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = sp
+		return
+	}
+	expired := make(chan SessionInfo, 16)
+	table.OnSessionExpired = func(info SessionInfo) { expired <- info }
+	table.sessionEvents = make(chan sessionEvent, kSessionEventQueueSize)
+	table.loopWaitGroup.Add(1)
+	go table.sessionHookLoop()
+	defer func() {
+		_ = table.Close()
+		table.closeUpstreamConns()
+		table.loopWaitGroup.Wait()
+	}()
+
+	newPeer := func(pk *NoisePublicKey, src string, server int) (peer *Peer) {
+		sp = &ServerConfigPeer{ClientPublicKey: pk, forwardToAddress: serverAddrs[server]}
+		peer, err := table.processClientMessageInitiation(net.UDPAddrFromAddrPort(netip.MustParseAddrPort(src)), nil,
+			&device.MessageInitiation{Sender: uint32(0x1000 + server)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = table.upstreamConnOfPeer(peer, peer.serverDestination); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	now := time.Now()
+	a := newPeer(&clientPK, "192.0.2.1:1000", 0)
+	b := newPeer(&otherPK, "[::ffff:198.51.100.1]:1000", 0)
+	c := newPeer(&otherPK, "198.51.100.2:1000", 1)
+	c.touch(now.Add(-2 * time.Minute))
+	upstreamOpen := func(server int) bool {
+		table.upstreamConnsLock.RLock()
+		defer table.upstreamConnsLock.RUnlock()
+		return table.upstreamConns[upstreamKey(serverAddrs[server])] != nil
+	}
+
+	if count := table.evictSessions(SessionFilter{}, now); count != 0 {
+		t.Errorf("expected the zero filter to select nothing, got %d", count)
+	}
+
+	for _, step := range []struct {
+		filter   SessionFilter
+		evicted  *Peer
+		upstream [2]bool
+	}{
+		{SessionFilter{PeerID: &otherPK, IdleLongerThan: time.Minute}, c, [2]bool{true, false}},
+		{SessionFilter{ClientAddress: netip.MustParsePrefix("::ffff:198.51.100.0/120")}, b, [2]bool{true, false}},
+		{SessionFilter{SessionID: a.sessionID, ClientAddress: netip.MustParsePrefix("192.0.2.0/24")}, a, [2]bool{false, false}},
+	} {
+		if count := table.evictSessions(step.filter, now); count != 1 {
+			t.Fatalf("%+v: expected 1 session evicted, got %d", step.filter, count)
+		}
+		select {
+		case info := <-expired:
+			if info.SessionID != step.evicted.sessionID || info.EndReason != SessionEndEvicted {
+				t.Errorf("%+v: unexpected session evicted: %+v", step.filter, info)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%+v: OnSessionExpired is not called", step.filter)
+		}
+		for i, open := range step.upstream {
+			if upstreamOpen(i) != open {
+				t.Errorf("%+v: expected the upstream socket to server %d open: %v", step.filter, i, open)
+			}
+		}
+	}
+	if stats := table.Stats(); stats.ActiveSessions != 0 {
+		t.Errorf("expected all the sessions evicted, got %d", stats.ActiveSessions)
+	}
+}
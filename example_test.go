@@ -0,0 +1,53 @@
+package mwgp_test
+
+import (
+	"context"
+	"github.com/haruue-net/mwgp"
+	"log"
+	"os"
+	"os/signal"
+)
+
+// ExampleNewServer runs mwgp-server and mwgp-client in the same program without a config file.
+// The WireGuard client connects to 127.0.0.1:1820, and the WireGuard server listens on 127.0.0.1:51820.
+func ExampleNewServer() {
+	var serverPrivateKey mwgp.NoisePrivateKey
+	var clientPublicKey, serverPublicKey mwgp.NoisePublicKey
+	if err := serverPrivateKey.FromBase64("iKNpZ0e4fjsGOtu6iQ0sHHdCMGb1sJYeyeBdFFTVY3o="); err != nil {
+		log.Fatal(err)
+	}
+	if err := clientPublicKey.FromBase64("Cb4mSPq1vhZS1yl6NlLnXlOiGMDTIRDvxhqWXgx9j10="); err != nil {
+		log.Fatal(err)
+	}
+	serverPublicKey = serverPrivateKey.PublicKey()
+
+	server, err := mwgp.NewServer(
+		mwgp.ServerListen("127.0.0.1:1821"),
+		mwgp.ServerPeer(serverPrivateKey, clientPublicKey, "127.0.0.1:51820"),
+		mwgp.ServerObfuscateKey("kisekimo, mahoumo, muryoudewaarimasen"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := mwgp.NewClientWithConfig(&mwgp.ClientConfig{
+		Server:          "127.0.0.1:1821",
+		Listen:          mwgp.ListenAddresses{"127.0.0.1:1820"},
+		ClientPublicKey: clientPublicKey,
+		ServerPublicKey: serverPublicKey,
+		ObfuscateKey:    "kisekimo, mahoumo, muryoudewaarimasen",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		if err := server.Run(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	if err := client.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package mwgp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Expiration:
+//
+// A session expires once no packet of it is seen in either direction for the Timeout, every forwarded packet
+// (from the client or from the server) refreshes it. The expired sessions, and the sockets to the servers no longer
+// used by any session, are removed by a periodic sweep every CleanupInterval, which is the Timeout if not set.
+// A shorter CleanupInterval reaps them more promptly at the cost of scanning the table more often.
+//
+// The sweep might run up to a CleanupInterval after a session expires, so the expiration is also checked lazily
+// on every packet looked up by the index: a packet of an expired session is dropped as if the session is gone,
+// even if the sweep has not removed it yet.
+
+// cleanupInterval returns the interval of the sweep for the timeout.
+func (t *WireGuardIndexTranslationTable) cleanupInterval(timeout time.Duration) time.Duration {
+	if t.CleanupInterval > 0 {
+		return t.CleanupInterval
+	}
+	return timeout
+}
+
+// setActiveTimeout records the Timeout checked by isExpired, which might be called outside the main loop.
+func (t *WireGuardIndexTranslationTable) setActiveTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&t.activeTimeout, int64(timeout))
+}
+
+// isExpired reports whether the peer is idle for longer than the Timeout at now, see "Expiration".
+// Nothing expires before Serve() is called.
+func (t *WireGuardIndexTranslationTable) isExpired(peer *Peer, now time.Time) bool {
+	timeout := time.Duration(atomic.LoadInt64(&t.activeTimeout))
+	if timeout <= 0 {
+		// not served yet
+		return false
+	}
+	return peer.lastActiveTime().Before(now.Add(-timeout))
+}
@@ -0,0 +1,149 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newExpireTestTable returns a table with an established session, as if it is served with the Timeout.
+func newExpireTestTable(t *testing.T) (table *WireGuardIndexTranslationTable, peer *Peer) {
+	_, clientPK := e2eGenerateKey(t)
+	table = NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.Timeout = time.Minute
+	table.setActiveTimeout(table.Timeout)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}}
+		return
+	}
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	peer, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.processServerMessageResponse(peer.serverDestination, &device.MessageResponse{Sender: 0x2000, Receiver: peer.clientProxyIndex}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// expireTestTransport returns a MessageTransport of the peer, from the server if s2c.
+func expireTestTransport(peer *Peer, s2c bool) (packet *Packet) {
+	packet = &Packet{Data: make([]byte, device.MessageTransportSize), Length: device.MessageTransportSize}
+	binary.LittleEndian.PutUint32(packet.Data, device.MessageTransportType)
+	if s2c {
+		binary.LittleEndian.PutUint32(packet.Data[4:], peer.clientProxyIndex)
+		packet.Source = peer.serverDestination
+	} else {
+		binary.LittleEndian.PutUint32(packet.Data[4:], peer.serverProxyIndex)
+		packet.Source = peer.clientDestination
+	}
+	return
+}
+
+func TestWireGuardIndexTranslationTable_ExpireBidirectional(t *testing.T) {
+	for _, s2c := range []bool{false, true} {
+		table, peer := newExpireTestTable(t)
+
+		// only one direction is active for 3 timeouts, the other one is idle
+		for i := 0; i < 6; i++ {
+			peer.touch(time.Now().Add(-table.Timeout / 2))
+			if _, err := table.processMessageTransport(expireTestTransport(peer, s2c), s2c); err != nil {
+				t.Fatalf("s2c=%t: %s", s2c, err.Error())
+			}
+			table.handlePeersExpireCheck(time.Now().Add(table.Timeout / 2))
+		}
+		if table.Stats().ActiveSessions != 1 {
+			t.Errorf("s2c=%t: expected the session active in one direction not expired", s2c)
+		}
+
+		table.handlePeersExpireCheck(time.Now().Add(2 * table.Timeout))
+		if table.Stats().ActiveSessions != 0 {
+			t.Errorf("s2c=%t: expected the idle session expired", s2c)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_ExpireLazily(t *testing.T) {
+	table, peer := newExpireTestTable(t)
+
+	// the sweep has not run yet, but nothing is forwarded after the timeout
+	peer.touch(time.Now().Add(-2 * table.Timeout))
+	for _, s2c := range []bool{false, true} {
+		if _, err := table.processMessageTransport(expireTestTransport(peer, s2c), s2c); err == nil {
+			t.Errorf("s2c=%t: expected the packet of the expired session dropped", s2c)
+		}
+	}
+	if _, err := table.processServerMessageCookieReply(peer.serverDestination, &device.MessageCookieReply{Receiver: peer.clientProxyIndex}); err == nil {
+		t.Errorf("expected the cookie reply of the expired session dropped")
+	}
+	// a packet of the expired session must not keep it alive
+	if !table.isExpired(peer, time.Now()) {
+		t.Errorf("expected the dropped packets not refreshing the session")
+	}
+	if table.Stats().ActiveSessions != 1 {
+		t.Errorf("expected the session kept until the sweep")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_CleanupInterval(t *testing.T) {
+	network := newMemNetwork()
+	listen := netip.AddrPortFrom(memNetworkIP, 1000)
+	upstream := netip.AddrPortFrom(memNetworkIP, 2000)
+	client, err := network.bind(0, netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := network.bind(upstream.Port(), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.TransportFactory = network
+	table.ClientListen = net.UDPAddrFromAddrPort(listen)
+	table.Timeout = time.Second
+	table.CleanupInterval = 50 * time.Millisecond
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: net.UDPAddrFromAddrPort(upstream)}
+		return
+	}
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	initiation[0] = device.MessageInitiationType
+	binary.LittleEndian.PutUint32(initiation[4:], 0x1000)
+	for attempt := 0; ; attempt++ {
+		_ = client.send(initiation, listen)
+		select {
+		case <-server.inbox:
+		case <-time.After(100 * time.Millisecond):
+			if attempt < 50 {
+				continue
+			}
+			t.Fatal("the MessageInitiation is not forwarded")
+		}
+		break
+	}
+	created := time.Now()
+
+	// swept within a CleanupInterval after the Timeout, instead of up to another Timeout
+	for table.Stats().ActiveSessions != 0 {
+		if time.Since(created) > table.Timeout*8/5 {
+			t.Fatalf("expected the session removed by the sweep every %s", table.CleanupInterval)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(created); elapsed < table.Timeout {
+		t.Errorf("expected the session removed after the timeout, got %s", elapsed)
+	}
+}
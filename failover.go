@@ -0,0 +1,274 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultFailoverWindow is longer than the passive keepalive of WireGuard (10s),
+	// so that a server only replying the data packets with keepalives is not considered failed.
+	defaultFailoverWindow = 20 * time.Second
+	kFailoverWindowMax    = time.Hour
+
+	defaultFailoverProbeInterval = 10 * time.Second
+	kFailoverProbeIntervalMax    = time.Hour
+
+	// kFailoverCheckIntervalMax bounds the delay to detect a failed endpoint after the window.
+	kFailoverCheckIntervalMax = time.Second
+)
+
+// ClientConfigServer is an endpoint of mwgp-server in the "servers" of mwgp-client.
+// It can be written as a plain "host:port" string in the config.
+type ClientConfigServer struct {
+	Address string `json:"address"`
+
+	// Priority decides which endpoint is used, the smaller the preferred.
+	// The endpoints with the same priority are used in the order they are listed.
+	Priority int `json:"priority,omitempty"`
+}
+
+func (s *ClientConfigServer) UnmarshalJSON(b []byte) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("\"")) {
+		*s = ClientConfigServer{}
+		return json.Unmarshal(b, &s.Address)
+	}
+	type plain ClientConfigServer
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+// clientEndpoint is a server endpoint of mwgp-client.
+type clientEndpoint struct {
+	server   string
+	priority int
+
+	// suspect is set once no reply is seen from the endpoint in the window,
+	// and cleared once it replies a probe.
+	suspect bool
+	probing bool
+}
+
+// clientFailover selects the active server endpoint of mwgp-client.
+//
+// The health of the active endpoint is checked passively: it is suspect once the packets expecting a reply
+// (see expectsReply) are sent to it for the window without any packet received,
+// then all the sessions are switched to the next endpoint.
+// The suspect endpoints are probed with the preflight requests every probeInterval,
+// a recovered endpoint is switched back to if it is preferred over the active one.
+type clientFailover struct {
+	endpoints     []*clientEndpoint
+	window        time.Duration
+	probeInterval time.Duration
+	logger        Logger
+
+	// changed is signaled once the active endpoint is switched.
+	changed chan struct{}
+
+	lock       sync.Mutex
+	active     int
+	switchedAt time.Time
+
+	// failovers is the number of the switches, accessed atomically
+	failovers uint64
+}
+
+func newClientFailover(servers []ClientConfigServer, window, probeInterval time.Duration, logger Logger) (f *clientFailover) {
+	f = &clientFailover{
+		window:        window,
+		probeInterval: probeInterval,
+		logger:        logger,
+		changed:       make(chan struct{}, 1),
+		switchedAt:    time.Now(),
+	}
+	for _, s := range servers {
+		f.endpoints = append(f.endpoints, &clientEndpoint{server: s.Address, priority: s.Priority})
+	}
+	sort.SliceStable(f.endpoints, func(i, j int) bool {
+		return f.endpoints[i].priority < f.endpoints[j].priority
+	})
+	return
+}
+
+// activeServer returns the server of the active endpoint.
+func (f *clientFailover) activeServer() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.endpoints[f.active].server
+}
+
+// check marks the active endpoint suspect and switches to the next one
+// if the unreplied packets have been sent to it for the window.
+func (f *clientFailover) check(unrepliedSince, now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if unrepliedSince.IsZero() {
+		return
+	}
+	if unrepliedSince.Before(f.switchedAt) {
+		// the endpoint has not been tried for the window yet
+		unrepliedSince = f.switchedAt
+	}
+	if now.Sub(unrepliedSince) < f.window {
+		return
+	}
+	current := f.endpoints[f.active]
+	current.suspect = true
+	next := -1
+	for i, e := range f.endpoints {
+		if !e.suspect {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		// all of them are suspect, keep trying them in turn
+		next = (f.active + 1) % len(f.endpoints)
+	}
+	f.logger.Warnf("no response from server %s in %s, switch to server %s", current.server, f.window, f.endpoints[next].server)
+	f.switchLocked(next, now)
+}
+
+// startProbes returns the suspect endpoints not being probed, they are marked being probed.
+func (f *clientFailover) startProbes() (endpoints []*clientEndpoint) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, e := range f.endpoints {
+		if e.suspect && !e.probing {
+			e.probing = true
+			endpoints = append(endpoints, e)
+		}
+	}
+	return
+}
+
+// probeDone clears the suspect of the endpoint if the probe is replied,
+// and switches back to it if it is preferred.
+func (f *clientFailover) probeDone(e *clientEndpoint, replied bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	e.probing = false
+	if !replied || !e.suspect {
+		return
+	}
+	e.suspect = false
+	current := f.endpoints[f.active]
+	if e == current {
+		f.logger.Infof("server %s is recovered", e.server)
+		return
+	}
+	if !current.suspect && current.priority <= e.priority {
+		f.logger.Infof("server %s is recovered, keep using server %s", e.server, current.server)
+		return
+	}
+	f.logger.Infof("server %s is recovered, switch back from server %s", e.server, current.server)
+	for i := range f.endpoints {
+		if f.endpoints[i] == e {
+			f.switchLocked(i, time.Now())
+			break
+		}
+	}
+}
+
+func (f *clientFailover) switchLocked(i int, now time.Time) {
+	f.active = i
+	f.switchedAt = now
+	atomic.AddUint64(&f.failovers, 1)
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (f *clientFailover) fillStats(stats *Stats) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, e := range f.endpoints {
+		stats.ServerEndpoints = append(stats.ServerEndpoints, ServerEndpointStats{
+			Address: e.server,
+			Active:  i == f.active,
+			Suspect: e.suspect,
+		})
+	}
+	stats.ServerFailovers = atomic.LoadUint64(&f.failovers)
+}
+
+// activeServer returns the server currently forwarded to.
+func (c *Client) activeServer() string {
+	if c.failover == nil {
+		return c.server
+	}
+	return c.failover.activeServer()
+}
+
+// failoverLoop checks the active endpoint and probes the suspect ones until the client is closed.
+func (c *Client) failoverLoop() {
+	f := c.failover
+	checkInterval := f.window / 4
+	if checkInterval > kFailoverCheckIntervalMax {
+		checkInterval = kFailoverCheckIntervalMax
+	}
+	checkTicker := time.NewTicker(checkInterval)
+	defer checkTicker.Stop()
+	probeTicker := time.NewTicker(f.probeInterval)
+	defer probeTicker.Stop()
+	for {
+		select {
+		case now := <-checkTicker.C:
+			serverAddr, _ := c.serverAddr.Load().(*net.UDPAddr)
+			if serverAddr != nil {
+				f.check(c.wgitTable.upstreamUnrepliedSince(upstreamKey(serverAddr)), now)
+			}
+		case <-probeTicker.C:
+			for _, e := range f.startProbes() {
+				e := e
+				c.wgitTable.goBackground(func() { c.probeEndpoint(e) })
+			}
+		case <-c.wgitTable.closeChan:
+			return
+		}
+	}
+}
+
+// probeEndpoint sends a preflight request to the endpoint, and marks it recovered if it is replied.
+func (c *Client) probeEndpoint(e *clientEndpoint) {
+	replied := false
+	defer func() {
+		c.failover.probeDone(e, replied)
+	}()
+	addrs, err := resolveUDPAddrs(c.wgitTable.context(), c.resolver, e.server, c.ipPreference)
+	if err != nil {
+		c.Logger.Debugf("failed to resolve server addr %s to probe: %s", e.server, err.Error())
+		return
+	}
+	uc, err := c.wgitTable.upstreamConnOf(addrs[0])
+	if err != nil {
+		c.Logger.Debugf("failed to probe server %s: %s", e.server, err.Error())
+		return
+	}
+	replied = c.preflight.probe(uc.transport, addrs[0])
+}
+
+// validateClientServers validates the "servers" of mwgp-client.
+func validateClientServers(servers []ClientConfigServer) (err error) {
+	for _, s := range servers {
+		var portMax int
+		_, portMax, err = splitPortRange(s.Address)
+		if err == nil && portMax != 0 {
+			err = fmt.Errorf("port range is not supported")
+		}
+		if err == nil {
+			_, _, err = net.SplitHostPort(s.Address)
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid server address %s in \"servers\": %w", s.Address, err)
+			return
+		}
+	}
+	return
+}
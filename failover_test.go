@@ -0,0 +1,93 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientConfigServer_UnmarshalJSON(t *testing.T) {
+	var config ClientConfig
+	err := json.Unmarshal([]byte(`{"servers": ["a.example.com:1000", {"address": "b.example.com:1000", "priority": -1}]}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ClientConfigServer{
+		{Address: "a.example.com:1000"},
+		{Address: "b.example.com:1000", Priority: -1},
+	}
+	if !reflect.DeepEqual(config.Servers, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config.Servers)
+	}
+}
+
+func TestClientFailover_Check(t *testing.T) {
+	f := newClientFailover([]ClientConfigServer{
+		{Address: "c:1", Priority: 1},
+		{Address: "a:1"},
+		{Address: "b:1"},
+	}, time.Second, time.Second, NewStdLogger(LogLevelError))
+	if s := f.activeServer(); s != "a:1" {
+		t.Fatalf("expected the preferred a:1 to be active, got %s", s)
+	}
+
+	now := f.switchedAt
+	f.check(time.Time{}, now.Add(time.Hour))
+	f.check(now, now.Add(time.Second/2))
+	if s := f.activeServer(); s != "a:1" {
+		t.Fatalf("expected a:1 to be active in the window, got %s", s)
+	}
+	now = now.Add(time.Second)
+	f.check(now.Add(-time.Second), now)
+	if s := f.activeServer(); s != "b:1" {
+		t.Fatalf("expected b:1 to be active, got %s", s)
+	}
+
+	// the unreplied packets sent before the switch do not count
+	f.check(now.Add(-time.Hour), now.Add(time.Second/2))
+	if s := f.activeServer(); s != "b:1" {
+		t.Fatalf("expected b:1 to be active in the window, got %s", s)
+	}
+	now = now.Add(time.Second)
+	f.check(now.Add(-time.Second), now)
+	now = now.Add(time.Second)
+	f.check(now.Add(-time.Second), now)
+	if s := f.activeServer(); s != "a:1" {
+		t.Fatalf("expected to try a:1 again after all are suspect, got %s", s)
+	}
+
+	probes := f.startProbes()
+	if len(probes) != 3 || len(f.startProbes()) != 0 {
+		t.Fatalf("expected 3 endpoints to be probed once, got %d", len(probes))
+	}
+	f.probeDone(probes[2], true)
+	if s := f.activeServer(); s != "c:1" {
+		t.Fatalf("expected to switch to the recovered c:1, got %s", s)
+	}
+	f.probeDone(probes[1], true)
+	if s := f.activeServer(); s != "b:1" {
+		t.Fatalf("expected to switch back to the preferred b:1, got %s", s)
+	}
+	f.probeDone(probes[0], false)
+
+	var stats Stats
+	f.fillStats(&stats)
+	if stats.ServerFailovers != 5 || !stats.ServerEndpoints[0].Suspect || !stats.ServerEndpoints[1].Active {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestClientConfig_ServersConflict(t *testing.T) {
+	for _, config := range []*ClientConfig{
+		{Server: "a.example.com:1000", Servers: []ClientConfigServer{{Address: "b.example.com:1000"}}},
+		{Servers: []ClientConfigServer{{Address: "a.example.com:1000-1001"}}},
+		{Servers: []ClientConfigServer{{Address: "a.example.com"}}},
+		{Servers: []ClientConfigServer{{Address: "a.example.com:1000"}}, WebSocket: &WebSocketClientConfig{URL: "wss://example.com/"}},
+	} {
+		config.Listen = ListenAddresses{"127.0.0.1:0"}
+		if _, err := NewClientWithConfig(config); err == nil {
+			t.Errorf("expected an error with %+v", config)
+		}
+	}
+}
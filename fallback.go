@@ -0,0 +1,233 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// kFallbackMaxSessions bounds the sockets opened for the fallback sessions,
+	// packets from new sources are dropped once it is reached.
+	kFallbackMaxSessions = 4096
+)
+
+// fallbackSession relays the unrecognized packets from a client source to the FallbackForward address verbatim,
+// and relays the responses back, so that the port looks like the fallback service under scanning.
+//
+// Unlike the Peer, there is no index to tell the sessions apart,
+// so each session has its own socket connected to the FallbackForward address.
+//
+// The same relay carries the new sessions to the DrainForward address while the table is draining,
+// those packets are deobfuscated before relayed, and the responses are obfuscated if the client's are.
+type fallbackSession struct {
+	key               netip.AddrPort
+	clientDestination *net.UDPAddr
+	clientTransport   PacketTransport
+	transport         PacketTransport
+	forward           *net.UDPAddr
+
+	// drain is set for the sessions relayed to the DrainForward address
+	drain     bool
+	obfuscate bool
+
+	// unix nano of the last packet, accessed atomically
+	lastActive int64
+}
+
+func (s *fallbackSession) touch(now time.Time) {
+	atomic.StoreInt64(&s.lastActive, now.UnixNano())
+}
+
+func (s *fallbackSession) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+// isPlainWireGuardPacket reports whether the packet starts with a valid WireGuard message header.
+func isPlainWireGuardPacket(packet *Packet) bool {
+	messageType := packet.MessageType()
+	return packet.Length >= 4 && messageType >= device.MessageInitiationType && messageType <= device.MessageTransportType &&
+		packet.ReservedByte(1) == 0 && packet.ReservedByte(2) == 0 && packet.ReservedByte(3) == 0
+}
+
+// shouldFallback reports whether the packet from client should be forwarded to the FallbackForward address.
+func (t *WireGuardIndexTranslationTable) shouldFallback(packet *Packet) bool {
+	if t.FallbackForward == nil {
+		return false
+	}
+	if packet.Flags&PacketFlagUnrecognized != 0 {
+		return true
+	}
+	if packet.Flags&(PacketFlagDropped|PacketFlagDeobfuscatedAfterReceived) != 0 {
+		return false
+	}
+	return !isPlainWireGuardPacket(packet)
+}
+
+func (t *WireGuardIndexTranslationTable) handleFallbackClientPacket(packet *Packet) {
+	t.relayClientPacket(packet, false)
+}
+
+// relayClientPacket relays the packet with the session of its source, which is created on the first packet
+// to the DrainForward address if drain is set, or the FallbackForward address otherwise.
+func (t *WireGuardIndexTranslationTable) relayClientPacket(packet *Packet, drain bool) {
+	session, err := t.fallbackSessionOf(packet, drain)
+	if err != nil {
+		t.logPacketf(LogLevelDebug, "failed to relay packet from client %s: %s", packet.Source.String(), err.Error())
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+		return
+	}
+	session.touch(time.Now())
+	if session.drain {
+		atomic.AddUint64(&t.stats.drainPackets, 1)
+	} else {
+		atomic.AddUint64(&t.stats.fallbackPackets, 1)
+	}
+
+	packet.Flags = 0
+	packet.Destination = session.forward
+	packet.transport = session.transport
+	t.sendPacket(t.serverWriteChan, packet)
+}
+
+// isDrainRelayed reports whether the packet is from a source relayed to the DrainForward address.
+func (t *WireGuardIndexTranslationTable) isDrainRelayed(packet *Packet) bool {
+	if t.DrainForward == nil || !t.Draining() {
+		return false
+	}
+	t.fallbackSessionsLock.Lock()
+	session := t.fallbackSessions[packet.Source.AddrPort()]
+	t.fallbackSessionsLock.Unlock()
+	return session != nil && session.drain
+}
+
+// fallbackSessionOf returns the relay session of the packet source, it is created on the first packet.
+func (t *WireGuardIndexTranslationTable) fallbackSessionOf(packet *Packet, drain bool) (session *fallbackSession, err error) {
+	key := packet.Source.AddrPort()
+
+	t.fallbackSessionsLock.Lock()
+	defer t.fallbackSessionsLock.Unlock()
+	if session = t.fallbackSessions[key]; session != nil {
+		return
+	}
+	if t.fallbackSessionsClosed {
+		err = net.ErrClosed
+		return
+	}
+	if len(t.fallbackSessions) >= kFallbackMaxSessions {
+		err = fmt.Errorf("too many fallback sessions")
+		return
+	}
+	forward := t.FallbackForward
+	if drain {
+		forward = t.DrainForward
+	}
+	transport, err := t.dialPacket(forward)
+	if err != nil {
+		return
+	}
+	session = &fallbackSession{
+		key:               key,
+		clientDestination: cloneUDPAddr(packet.Source),
+		clientTransport:   packet.transport,
+		transport:         transport,
+		forward:           forward,
+		drain:             drain,
+		obfuscate:         packet.Flags&PacketFlagDeobfuscatedAfterReceived != 0,
+	}
+	session.touch(time.Now())
+	t.fallbackSessions[key] = session
+	t.loopWaitGroup.Add(1)
+	go t.fallbackReadLoop(session)
+	if drain {
+		t.logPacketf(LogLevelInfo, "relay new session from client %s to drain_forward %s", session.clientDestination, forward)
+	} else {
+		t.logPacketf(LogLevelInfo, "forward unrecognized packets from client %s to fallback %s", session.clientDestination, forward)
+	}
+	return
+}
+
+func (t *WireGuardIndexTranslationTable) fallbackReadLoop(session *fallbackSession) {
+	defer t.loopWaitGroup.Done()
+	for {
+		packet := t.obtainPacket()
+		err := defaultReadFunc(session.transport, packet)
+		if err != nil {
+			t.recyclePacket(packet)
+			if !t.isClosed() && !errors.Is(err, net.ErrClosed) {
+				t.Logger.Debugf("fallback session of client %s is closed: %s", session.clientDestination, err.Error())
+			}
+			t.closeFallbackSession(session)
+			return
+		}
+		session.touch(time.Now())
+		if session.drain {
+			atomic.AddUint64(&t.stats.drainPackets, 1)
+		} else {
+			atomic.AddUint64(&t.stats.fallbackPackets, 1)
+		}
+
+		// the fallback sessions are sent verbatim, without PacketFlagObfuscateBeforeSend
+		if session.obfuscate {
+			packet.Flags |= PacketFlagObfuscateBeforeSend
+		}
+		packet.Destination = session.clientDestination
+		packet.transport = session.clientTransport
+		if !t.sendPacket(t.clientWriteChan, packet) {
+			return
+		}
+	}
+}
+
+// closeFallbackSession removes the session and closes its socket.
+func (t *WireGuardIndexTranslationTable) closeFallbackSession(session *fallbackSession) {
+	t.fallbackSessionsLock.Lock()
+	defer t.fallbackSessionsLock.Unlock()
+	if t.fallbackSessions[session.key] == session {
+		delete(t.fallbackSessions, session.key)
+	}
+	_ = session.transport.Close()
+}
+
+// upgradeFallbackSession closes the fallback session of the source once it sends a valid MessageInitiation,
+// so that its following packets are only handled as WireGuard.
+func (t *WireGuardIndexTranslationTable) upgradeFallbackSession(source *net.UDPAddr) {
+	if t.FallbackForward == nil {
+		return
+	}
+	t.fallbackSessionsLock.Lock()
+	session := t.fallbackSessions[source.AddrPort()]
+	t.fallbackSessionsLock.Unlock()
+	if session != nil {
+		t.Logger.Infof("client %s is upgraded from fallback", session.clientDestination)
+		t.closeFallbackSession(session)
+	}
+}
+
+// expireFallbackSessions closes the sessions without any packet since the deadline.
+func (t *WireGuardIndexTranslationTable) expireFallbackSessions(deadline time.Time) {
+	t.fallbackSessionsLock.Lock()
+	defer t.fallbackSessionsLock.Unlock()
+	for key, session := range t.fallbackSessions {
+		if session.lastActiveTime().Before(deadline) {
+			delete(t.fallbackSessions, key)
+			_ = session.transport.Close()
+		}
+	}
+}
+
+// closeFallbackSessions closes all the sessions, no more sessions can be created after it.
+func (t *WireGuardIndexTranslationTable) closeFallbackSessions() {
+	t.fallbackSessionsLock.Lock()
+	defer t.fallbackSessionsLock.Unlock()
+	t.fallbackSessionsClosed = true
+	for key, session := range t.fallbackSessions {
+		delete(t.fallbackSessions, key)
+		_ = session.transport.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package mwgp
+
+import (
+	"bytes"
+	"golang.zx2c4.com/wireguard/device"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_Fallback(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// the decoy echoes with a prefix
+	decoy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	decoyReceived := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := decoy.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			decoyReceived <- append([]byte(nil), buf[:n]...)
+			_, _ = decoy.WriteToUDPAddrPort(append([]byte("decoy:"), buf[:n]...), addr)
+		}
+	}()
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	var clientPublicKey NoisePublicKey
+	tableAddr := netip.MustParseAddrPort(e2eFreeUDPAddr(t))
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = net.UDPAddrFromAddrPort(tableAddr)
+	table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.ClientReadFunc = obfuscator.ReadPacketWithDeobfuscate
+	table.ClientWriteFunc = obfuscator.WritePacketWithObfuscate
+	table.FallbackForward = decoy.LocalAddr().(*net.UDPAddr)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{
+			ClientPublicKey:  &clientPublicKey,
+			forwardToAddress: server.LocalAddr().(*net.UDPAddr),
+		}
+		return
+	}
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// garbage is relayed to the decoy and back verbatim
+	garbage := []byte("\x00\x00\x00\x01 garbage from a prober, neither obfuscated nor WireGuard")
+	buf := make([]byte, 1500)
+	for i := 0; ; i++ {
+		// retry until the table is listening
+		_, err = client.WriteToUDPAddrPort(garbage, tableAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		var n int
+		n, _, err = client.ReadFromUDPAddrPort(buf)
+		if err == nil {
+			if !bytes.Equal(buf[:n], append([]byte("decoy:"), garbage...)) {
+				t.Fatalf("unexpected response from decoy: %q", buf[:n])
+			}
+			break
+		}
+		if i >= 50 {
+			t.Fatalf("garbage is not relayed to decoy: %s", err.Error())
+		}
+	}
+	if received := <-decoyReceived; !bytes.Equal(received, garbage) {
+		t.Fatalf("decoy received %q, expected %q", received, garbage)
+	}
+	if stats := table.Stats(); stats.FallbackSessions != 1 || stats.ActiveSessions != 0 {
+		t.Fatalf("unexpected stats: fallback=%d active=%d", stats.FallbackSessions, stats.ActiveSessions)
+	}
+
+	// the same source is upgraded once it sends a valid obfuscated handshake
+	packet := Packet{Data: make([]byte, 1500)}
+	packet.Data[0] = device.MessageInitiationType
+	packet.Length = device.MessageInitiationSize
+	packet.Flags = PacketFlagObfuscateBeforeSend
+	obfuscator.Obfuscate(&packet)
+	_, err = client.WriteToUDPAddrPort(packet.Slice(), tableAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := table.Stats()
+		if stats.FallbackSessions == 0 && stats.ActiveSessions == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fallback session is not upgraded: fallback=%d active=%d", stats.FallbackSessions, stats.ActiveSessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case received := <-decoyReceived:
+		t.Errorf("decoy received the handshake: %q", received)
+	default:
+	}
+}
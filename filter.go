@@ -0,0 +1,177 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packet Filter:
+//
+// SetPacketFilter installs a PacketFilterFunc deciding the packets from clients, so that a library user can plug
+// their own GeoIP, fail2ban-style or anomaly detection logic in, without mwgp taking on the dependencies.
+// It is called with the MessageInitiation creating new sessions, or with every packet from clients if the
+// FilterAllPackets is set, after they are deobfuscated and before they are dispatched.
+//
+// The filter runs in the main loop, the hot path of every session, so it must return quickly and never block.
+// Wrap the slow filters, such as the ones querying a remote service, with NewAsyncPacketFilter.
+
+// FilterDecision is the result of a PacketFilterFunc.
+type FilterDecision int
+
+const (
+	// FilterAccept handles the packet as usual.
+	FilterAccept FilterDecision = iota
+
+	// FilterDrop drops the packet silently.
+	FilterDrop
+
+	// FilterFallback relays the packet to the FallbackForward address like the unrecognized packets,
+	// it is dropped if there is no FallbackForward.
+	FilterFallback
+)
+
+func (d FilterDecision) String() string {
+	switch d {
+	case FilterAccept:
+		return "accept"
+	case FilterDrop:
+		return "drop"
+	case FilterFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// PacketFilterFunc decides a packet from the client at the src, isNewSession is set for a MessageInitiation.
+//
+// It runs on the hot path, so it must not block, see "Packet Filter". The src and p are only valid during the call,
+// and must not be modified.
+type PacketFilterFunc func(src *net.UDPAddr, p *Packet, isNewSession bool) FilterDecision
+
+const (
+	// kAsyncPacketFilterMaxEntries bounds the sources an async filter remembers,
+	// the sources beyond it are accepted without a verdict until the expired ones are removed.
+	kAsyncPacketFilterMaxEntries = 65536
+
+	// kAsyncPacketFilterWorkers is the max number of verdicts an async filter evaluates at the same time.
+	kAsyncPacketFilterWorkers = 16
+)
+
+type asyncFilterVerdict struct {
+	decision FilterDecision
+	pending  bool
+	expire   time.Time
+}
+
+// asyncPacketFilter evaluates the filter in the background, see NewAsyncPacketFilter.
+type asyncPacketFilter struct {
+	filter  PacketFilterFunc
+	ttl     time.Duration
+	workers chan struct{}
+
+	verdicts     map[netip.Addr]*asyncFilterVerdict
+	verdictsLock sync.Mutex
+}
+
+// NewAsyncPacketFilter wraps a slow filter, so that it is evaluated in the background instead of on the hot path.
+//
+// The verdict is remembered per source IP for the ttl, and applies to all the packets from the IP.
+// A packet is accepted while the verdict of its source is pending, or if there are too many sources
+// or filters in progress. The filter is called with the copies of the src and p, which can be retained.
+func NewAsyncPacketFilter(filter PacketFilterFunc, ttl time.Duration) PacketFilterFunc {
+	f := &asyncPacketFilter{
+		filter:   filter,
+		ttl:      ttl,
+		workers:  make(chan struct{}, kAsyncPacketFilterWorkers),
+		verdicts: make(map[netip.Addr]*asyncFilterVerdict),
+	}
+	return f.decide
+}
+
+func (f *asyncPacketFilter) decide(src *net.UDPAddr, p *Packet, isNewSession bool) FilterDecision {
+	addr := src.AddrPort().Addr().Unmap()
+	now := time.Now()
+
+	f.verdictsLock.Lock()
+	defer f.verdictsLock.Unlock()
+	if v := f.verdicts[addr]; v != nil && (v.pending || now.Before(v.expire)) {
+		if v.pending {
+			return FilterAccept
+		}
+		return v.decision
+	}
+	if len(f.verdicts) >= kAsyncPacketFilterMaxEntries {
+		f.removeExpiredLocked(now)
+		if len(f.verdicts) >= kAsyncPacketFilterMaxEntries {
+			return FilterAccept
+		}
+	}
+	select {
+	case f.workers <- struct{}{}:
+	default:
+		return FilterAccept
+	}
+	f.verdicts[addr] = &asyncFilterVerdict{pending: true}
+	data := make([]byte, p.Length)
+	copy(data, p.Slice())
+	packet := &Packet{Data: data, Length: p.Length, Source: cloneUDPAddr(src), Flags: p.Flags}
+	go f.evaluate(addr, packet, isNewSession)
+	return FilterAccept
+}
+
+func (f *asyncPacketFilter) evaluate(addr netip.Addr, packet *Packet, isNewSession bool) {
+	defer func() { <-f.workers }()
+	decision := FilterAccept
+	defer func() {
+		f.verdictsLock.Lock()
+		f.verdicts[addr] = &asyncFilterVerdict{decision: decision, expire: time.Now().Add(f.ttl)}
+		f.verdictsLock.Unlock()
+	}()
+	decision = f.filter(packet.Source, packet, isNewSession)
+}
+
+func (f *asyncPacketFilter) removeExpiredLocked(now time.Time) {
+	for addr, v := range f.verdicts {
+		if !v.pending && !now.Before(v.expire) {
+			delete(f.verdicts, addr)
+		}
+	}
+}
+
+// SetPacketFilter installs the filter of the packets from clients, nil removes it, see "Packet Filter".
+// It can be called at any time.
+func (s *Server) SetPacketFilter(filter PacketFilterFunc) {
+	s.wgitTable.setPacketFilter(filter)
+}
+
+func (t *WireGuardIndexTranslationTable) setPacketFilter(filter PacketFilterFunc) {
+	t.packetFilter.Store(filter)
+}
+
+// filterClientPacket calls the packet filter with the packet from client, and handles the packet unless accepted.
+func (t *WireGuardIndexTranslationTable) filterClientPacket(packet *Packet) (accepted bool) {
+	filter, _ := t.packetFilter.Load().(PacketFilterFunc)
+	if filter == nil {
+		return true
+	}
+	isNewSession := packet.MessageType() == device.MessageInitiationType && !t.shouldFallback(packet)
+	if !isNewSession && !t.FilterAllPackets {
+		return true
+	}
+	decision := filter(packet.Source, packet, isNewSession)
+	if decision == FilterAccept {
+		return true
+	}
+	atomic.AddUint64(&t.stats.filteredPackets, 1)
+	if decision == FilterFallback && t.FallbackForward != nil {
+		t.relayClientPacket(packet, false)
+		return
+	}
+	t.countDroppedPacket()
+	t.recyclePacket(packet)
+	return
+}
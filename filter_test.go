@@ -0,0 +1,102 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_FilterClientPacket(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	newPacket := func(messageType uint32, src string) *Packet {
+		packet := table.obtainPacket()
+		packet.Length = device.MessageInitiationSize
+		binary.LittleEndian.PutUint32(packet.Data, messageType)
+		packet.Source = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(src))
+		return packet
+	}
+	if !table.filterClientPacket(newPacket(device.MessageInitiationType, "192.0.2.1:1000")) {
+		t.Errorf("expected all the packets accepted without a filter")
+	}
+
+	var calls []bool
+	table.setPacketFilter(func(src *net.UDPAddr, p *Packet, isNewSession bool) FilterDecision {
+		calls = append(calls, isNewSession)
+		if src.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			return FilterDrop
+		}
+		if src.IP.Equal(net.IPv4(192, 0, 2, 2)) {
+			// dropped as well without a FallbackForward
+			return FilterFallback
+		}
+		return FilterAccept
+	})
+	for _, step := range []struct {
+		messageType uint32
+		src         string
+		all         bool
+		accepted    bool
+	}{
+		{device.MessageInitiationType, "192.0.2.1:1000", false, false},
+		{device.MessageInitiationType, "192.0.2.2:1000", false, false},
+		{device.MessageInitiationType, "192.0.2.3:1000", false, true},
+		{device.MessageTransportType, "192.0.2.1:1000", false, true},
+		{device.MessageTransportType, "192.0.2.1:1000", true, false},
+	} {
+		table.FilterAllPackets = step.all
+		if accepted := table.filterClientPacket(newPacket(step.messageType, step.src)); accepted != step.accepted {
+			t.Errorf("%+v: expected accepted: %v", step, step.accepted)
+		}
+	}
+	if fmt.Sprint(calls) != "[true true true false]" {
+		t.Errorf("unexpected isNewSession of the calls: %v", calls)
+	}
+	if stats := table.Stats(); stats.FilteredPackets != 3 {
+		t.Errorf("expected 3 filtered packets, got %d", stats.FilteredPackets)
+	}
+}
+
+func TestNewAsyncPacketFilter(t *testing.T) {
+	release := make(chan struct{})
+	filtered := make(chan []byte, 4)
+	filter := NewAsyncPacketFilter(func(src *net.UDPAddr, p *Packet, isNewSession bool) FilterDecision {
+		<-release
+		filtered <- p.Slice()
+		if src.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			return FilterDrop
+		}
+		return FilterAccept
+	}, time.Minute)
+
+	packet := &Packet{Data: []byte{1, 2, 3, 4}, Length: 4}
+	src := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:1000"))
+	if filter(src, packet, true) != FilterAccept || filter(src, packet, true) != FilterAccept {
+		t.Errorf("expected the packets accepted while the verdict is pending")
+	}
+	packet.Data[0] = 0
+	close(release)
+	select {
+	case data := <-filtered:
+		if data[0] != 1 {
+			t.Errorf("expected the filter called with a copy of the packet")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the filter is not called")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for filter(src, packet, false) != FilterDrop {
+		if time.Now().After(deadline) {
+			t.Fatal("the verdict is not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(filtered) != 0 {
+		t.Errorf("expected the filter called once per source")
+	}
+}
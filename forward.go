@@ -0,0 +1,210 @@
+package mwgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServerResolveInterval = 5 * time.Minute
+	kServerResolveIntervalMax    = 24 * time.Hour
+
+	// defaultServerReresolveWriteErrors is the number of consecutive write errors
+	// on the socket to a server destination before we re-resolve the forward_to host names.
+	defaultServerReresolveWriteErrors = 3
+
+	// kForwardResolveTimeout is the timeout of a single resolution of the forward_to address.
+	kForwardResolveTimeout = 5 * time.Second
+
+	// kForwardResolveRetryInterval is the interval between resolutions after a failure,
+	// so that the handshakes of a busy peer do not flood the DNS server.
+	kForwardResolveRetryInterval = time.Second
+)
+
+// forwardResolveOptions are the options to resolve the forward_to addresses, set by the Server.
+type forwardResolveOptions struct {
+	resolver   UDPAddrResolver
+	preference string
+	interval   time.Duration
+}
+
+// forwardTarget is the forward_to address of a server peer.
+//
+// A host name is resolved on the first use and cached for the resolve interval,
+// so that the server can start before the host name is resolvable, and picks up the DNS changes.
+// The cached address is kept if the re-resolution fails.
+// An IP address is resolved in newForwardTarget() and never re-resolved.
+type forwardTarget struct {
+	address string
+	forwardResolveOptions
+
+	lock     sync.Mutex
+	addr     *net.UDPAddr
+	expireAt time.Time
+	lastErr  error
+	static   bool
+	// failover moves to the next resolved address on the next resolution, see invalidate().
+	failover bool
+}
+
+// newForwardTarget validates the syntax of the address, it does not resolve the host names.
+func newForwardTarget(address string, options forwardResolveOptions) (ft *forwardTarget, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	if port == "" {
+		err = fmt.Errorf("missing port in address %s", address)
+		return
+	}
+	ft = &forwardTarget{
+		address:               address,
+		forwardResolveOptions: options,
+	}
+	if ft.resolver == nil {
+		ft.resolver = &defaultUDPAddrResolver{}
+	}
+	portNumber, perr := strconv.ParseUint(port, 10, 16)
+	if perr != nil {
+		// a service name, resolved with the host
+		return
+	}
+	if host == "" {
+		ft.addr = &net.UDPAddr{Port: int(portNumber)}
+		ft.static = true
+		return
+	}
+	if ip, ierr := netip.ParseAddr(host); ierr == nil {
+		ft.addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(portNumber)))
+		ft.static = true
+	}
+	return
+}
+
+// resolve returns the cached address, or resolves the address if the cache is expired.
+//
+// If the re-resolution failed, the stale address is returned along with the err,
+// and it is used without re-resolution for kForwardResolveRetryInterval.
+// The changed is set if the returned address is different from the cached one.
+// The resolution is aborted once the ctx is done, such as the forward table is closed.
+func (ft *forwardTarget) resolve(ctx context.Context, now time.Time) (addr *net.UDPAddr, changed bool, err error) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	if ft.static || now.Before(ft.expireAt) {
+		addr = ft.addr
+		if addr == nil {
+			err = ft.lastErr
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kForwardResolveTimeout)
+	defer cancel()
+	addrs, err := resolveUDPAddrs(ctx, ft.resolver, ft.address, ft.preference)
+	if err != nil {
+		ft.lastErr = err
+		ft.expireAt = now.Add(kForwardResolveRetryInterval)
+		addr = ft.addr
+		return
+	}
+	addr = selectServerAddr(addrs, ft.addr, ft.failover)
+	changed = ft.addr == nil || !addr.IP.Equal(ft.addr.IP) || addr.Port != ft.addr.Port
+	ft.addr = addr
+	ft.expireAt = now.Add(ft.interval)
+	ft.lastErr = nil
+	ft.failover = false
+	return
+}
+
+// resolved returns the cached address without resolution, nil if it is never resolved.
+func (ft *forwardTarget) resolved() (addr *net.UDPAddr) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	addr = ft.addr
+	return
+}
+
+// invalidate expires the cache if the host name is resolved to the addr,
+// and the next resolution moves to another address if the host name has more than one.
+// It returns false if the target is an IP address or is not resolved to the addr.
+func (ft *forwardTarget) invalidate(addr netip.AddrPort) (ok bool) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	if ft.static || ft.addr == nil || upstreamKey(ft.addr) != addr {
+		return
+	}
+	ft.expireAt = time.Time{}
+	ft.failover = true
+	ok = true
+	return
+}
+
+type forwardTargetKey struct {
+	address    string
+	preference string
+	interval   time.Duration
+}
+
+func (ft *forwardTarget) key() forwardTargetKey {
+	return forwardTargetKey{
+		address:    ft.address,
+		preference: ft.preference,
+		interval:   ft.interval,
+	}
+}
+
+// inheritForwardTargets replaces the forward targets of the servers with the same ones of the oldServers,
+// so that the resolved addresses are kept across Reload(), and the sessions are not evicted.
+// The forwardFailover of a peer is kept as well if the peer has the same forward targets.
+func inheritForwardTargets(servers []*ServerConfigServer, oldServers []*ServerConfigServer) {
+	type failoverKey struct {
+		server  NoisePublicKey
+		peer    NoisePublicKey
+		targets string
+	}
+	keyOf := func(cs *ServerConfigServer, p *ServerConfigPeer) (key failoverKey) {
+		key.server = cs.publicKey
+		if !p.isFallback() {
+			key.peer = *p.ClientPublicKey
+		}
+		key.targets = p.failover.key()
+		return
+	}
+	oldTargets := make(map[forwardTargetKey]*forwardTarget)
+	oldFailovers := make(map[failoverKey]*forwardFailover)
+	for _, cs := range oldServers {
+		for _, p := range cs.Peers {
+			for _, ft := range p.forwardTargets() {
+				oldTargets[ft.key()] = ft
+			}
+			if p.failover != nil {
+				oldFailovers[keyOf(cs, p)] = p.failover
+			}
+		}
+	}
+	for _, cs := range servers {
+		for _, p := range cs.Peers {
+			if ft, ok := oldTargets[p.forwardTarget.key()]; ok {
+				p.forwardTarget = ft
+			}
+			if p.failover == nil {
+				continue
+			}
+			if f, ok := oldFailovers[keyOf(cs, p)]; ok {
+				p.failover = f
+				continue
+			}
+			for _, c := range p.failover.candidates {
+				if ft, ok := oldTargets[c.target.key()]; ok {
+					c.target = ft
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forward Failover:
+//
+// A server peer with "forward_backups" has several forward targets, the "forward_to" and the backups.
+// New sessions are forwarded to the active one, which is the one with the smallest priority at the beginning.
+//
+// Every UpstreamHealthInterval, the active target is failed over to the next one not failed
+// once its server destination is unhealthy (see upstreamUnhealthyReason), and the sessions of the peer
+// forwarded to it are migrated to the new target. The new server does not know the sessions,
+// so the WireGuard clients handshake again with it once their packets are not replied.
+//
+// A failed target preferred over the active one is failed back to after its failback delay.
+// The delay is doubled (up to kForwardFailbackDelayMax) if the target fails again within the delay
+// after being failed back to, so that a flapping target is not switched back and forth.
+
+const (
+	defaultForwardFailbackDelay = time.Minute
+	kForwardFailbackDelayMax    = time.Hour
+)
+
+// ServerConfigForward is a backup in the "forward_backups" of a server peer.
+// It can be written as a plain "host:port" string in the config.
+type ServerConfigForward struct {
+	// Address is the same as the "forward_to", the server address is used if the host is omitted.
+	Address string `json:"address"`
+
+	// Priority decides which target is used, the smaller the preferred. The "forward_to" has the priority 0,
+	// and the targets with the same priority are used in the order they are listed, the "forward_to" first.
+	Priority int `json:"priority,omitempty"`
+}
+
+func (f *ServerConfigForward) UnmarshalJSON(b []byte) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("\"")) {
+		*f = ServerConfigForward{}
+		return json.Unmarshal(b, &f.Address)
+	}
+	type plain ServerConfigForward
+	return json.Unmarshal(b, (*plain)(f))
+}
+
+// forwardCandidate is a forward target of a forwardFailover.
+type forwardCandidate struct {
+	target   *forwardTarget
+	priority int
+
+	// failed is set once the target is failed over from, and cleared once it is active and healthy.
+	failed   bool
+	failedAt time.Time
+
+	// delay is the failback delay of the target, doubled if it fails again within the delay after failed back to.
+	delay time.Duration
+}
+
+// forwardFailover selects the active forward target of a server peer with "forward_backups".
+type forwardFailover struct {
+	candidates []*forwardCandidate
+
+	lock       sync.Mutex
+	active     int
+	switchedAt time.Time
+
+	// failovers is the number of the switches, accessed atomically
+	failovers uint64
+}
+
+// newPeerForwardFailover returns the forwardFailover of the peer with the primary target of the ForwardTo,
+// nil if the peer has no ForwardBackups.
+func (s *ServerConfigServer) newPeerForwardFailover(pi int, p *ServerConfigPeer, primary *forwardTarget, forwardResolve forwardResolveOptions) (f *forwardFailover, err error) {
+	if len(p.ForwardBackups) == 0 {
+		return
+	}
+	f = &forwardFailover{}
+	f.candidates = append(f.candidates, &forwardCandidate{target: primary})
+	seen := map[string]bool{primary.address: true}
+	for bi, b := range p.ForwardBackups {
+		var ft *forwardTarget
+		ft, err = s.newPeerForwardTargetOf(pi, fmt.Sprintf("forward_backups[%d]", bi), b.Address, forwardResolve)
+		if err != nil {
+			return
+		}
+		if seen[ft.address] {
+			err = fmt.Errorf("peer[%d] has duplicated forward target %s in forward_backups[%d]", pi, ft.address, bi)
+			return
+		}
+		seen[ft.address] = true
+		f.candidates = append(f.candidates, &forwardCandidate{target: ft, priority: b.Priority})
+	}
+	sort.SliceStable(f.candidates, func(i, j int) bool {
+		return f.candidates[i].priority < f.candidates[j].priority
+	})
+	return
+}
+
+// key identifies the failover by the targets, a failover of the same key is inherited across Reload().
+func (f *forwardFailover) key() string {
+	var b strings.Builder
+	for _, c := range f.candidates {
+		_, _ = fmt.Fprintf(&b, "%s/%s/%s/%d;", c.target.address, c.target.preference, c.target.interval, c.priority)
+	}
+	return b.String()
+}
+
+// activeTarget returns the target new sessions are forwarded to.
+func (f *forwardFailover) activeTarget() *forwardTarget {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.candidates[f.active].target
+}
+
+// check fails over from the active target if it is unhealthy, with the reason returned,
+// or fails back to a failed target preferred over the active one once its failback delay is passed.
+// The next is nil if the active target is not switched.
+func (f *forwardFailover) check(now time.Time, failbackDelay time.Duration, unhealthyReason func(addr *net.UDPAddr) string) (previous, next *forwardTarget, reason string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	current := f.candidates[f.active]
+	if addr := current.target.resolved(); addr != nil {
+		reason = unhealthyReason(addr)
+	}
+	if reason != "" {
+		if current.delay > 0 && now.Sub(f.switchedAt) < current.delay {
+			// flapping, failed again soon after being switched to
+			current.delay *= 2
+			if current.delay > kForwardFailbackDelayMax {
+				current.delay = kForwardFailbackDelayMax
+			}
+		} else {
+			current.delay = failbackDelay
+		}
+		current.failed = true
+		current.failedAt = now
+		n := -1
+		for i, c := range f.candidates {
+			if !c.failed {
+				n = i
+				break
+			}
+		}
+		if n < 0 {
+			// all of them are failed, keep trying them in turn
+			n = (f.active + 1) % len(f.candidates)
+		}
+		previous, next = current.target, f.candidates[n].target
+		f.switchLocked(n, now)
+		return
+	}
+	current.failed = false
+	for i := 0; i < f.active; i++ {
+		c := f.candidates[i]
+		if !c.failed || now.Sub(c.failedAt) < c.delay {
+			continue
+		}
+		if addr := c.target.resolved(); addr != nil && unhealthyReason(addr) != "" {
+			continue
+		}
+		previous, next = current.target, c.target
+		f.switchLocked(i, now)
+		return
+	}
+	return
+}
+
+func (f *forwardFailover) switchLocked(i int, now time.Time) {
+	f.active = i
+	f.switchedAt = now
+	atomic.AddUint64(&f.failovers, 1)
+}
+
+// forwardTargets returns the forward targets of the peer, the ForwardTo and the ForwardBackups.
+func (p *ServerConfigPeer) forwardTargets() (targets []*forwardTarget) {
+	if p.failover == nil {
+		targets = append(targets, p.forwardTarget)
+		return
+	}
+	for _, c := range p.failover.candidates {
+		targets = append(targets, c.target)
+	}
+	return
+}
+
+// activeForwardTarget returns the forward target new sessions of the peer are forwarded to.
+func (p *ServerConfigPeer) activeForwardTarget() *forwardTarget {
+	if p.failover == nil {
+		return p.forwardTarget
+	}
+	return p.failover.activeTarget()
+}
+
+// forwardsTo reports whether the addr is the resolved address of a forward target of the peer.
+func (p *ServerConfigPeer) forwardsTo(addr *net.UDPAddr) bool {
+	for _, ft := range p.forwardTargets() {
+		if resolved := ft.resolved(); resolved != nil && upstreamKey(resolved) == upstreamKey(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the name of the peer in the logs.
+func (p *ServerConfigPeer) name() string {
+	if p.isFallback() {
+		return "fallback peer"
+	}
+	return "peer " + p.ClientPublicKey.Base64()
+}
+
+// forwardFailoverLoop checks the forward targets of the peers with "forward_backups"
+// every UpstreamHealthInterval until the server is stopped.
+func (s *Server) forwardFailoverLoop() {
+	ticker := time.NewTicker(s.wgitTable.UpstreamHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.checkForwardFailovers(now)
+		case <-s.wgitTable.closeChan:
+			return
+		}
+	}
+}
+
+// checkForwardFailovers switches the active forward targets of the peers, see forwardFailover.check.
+func (s *Server) checkForwardFailovers(now time.Time) {
+	s.serversLock.RLock()
+	servers := s.servers
+	s.serversLock.RUnlock()
+
+	unhealthyReason := func(addr *net.UDPAddr) string {
+		return s.wgitTable.upstreamUnhealthyReasonOf(upstreamKey(addr), now)
+	}
+	for _, cs := range servers {
+		for _, p := range cs.Peers {
+			if p.failover == nil {
+				continue
+			}
+			previous, next, reason := p.failover.check(now, s.forwardFailbackDelay, unhealthyReason)
+			if next == nil {
+				continue
+			}
+			if reason != "" {
+				s.Logger.Warnf("forward target %s of %s is unhealthy: %s, fail over to %s", previous.address, p.name(), reason, next.address)
+			} else {
+				s.Logger.Infof("fail back to forward target %s of %s from %s", next.address, p.name(), previous.address)
+			}
+			s.migrateForwardTarget(cs, p, previous, next)
+		}
+	}
+}
+
+// migrateForwardTarget moves the sessions of the peer from the previous forward target to the next one.
+func (s *Server) migrateForwardTarget(cs *ServerConfigServer, p *ServerConfigPeer, previous, next *forwardTarget) {
+	addr, err := s.resolveForwardTarget(next)
+	if err != nil {
+		s.Logger.Warnf("sessions of %s are not migrated: %s", p.name(), err.Error())
+		return
+	}
+	// the target switched to is given a new window, it might have been unhealthy before
+	s.wgitTable.resetUpstreamHealth(upstreamKey(addr))
+	from := previous.resolved()
+	if from == nil {
+		return
+	}
+	count := s.wgitTable.migratePeers(func(peer *Peer) bool {
+		return peer.serverPublicKey == cs.publicKey && cs.matchPeer(peer.clientPublicKey) == p &&
+			upstreamKey(peer.serverAddr()) == upstreamKey(from)
+	}, addr)
+	if count > 0 {
+		s.Logger.Infof("%d sessions of %s are migrated from server %s to %s", count, p.name(), from.String(), addr.String())
+	}
+}
+
+// fillForwardStats fills the forward targets of the peers with "forward_backups".
+func (s *Server) fillForwardStats(stats *Stats) {
+	s.serversLock.RLock()
+	servers := s.servers
+	s.serversLock.RUnlock()
+
+	for _, cs := range servers {
+		for _, p := range cs.Peers {
+			f := p.failover
+			if f == nil {
+				continue
+			}
+			ps := PeerForwardStats{
+				ServerPublicKey: cs.publicKey.Base64(),
+				Failovers:       atomic.LoadUint64(&f.failovers),
+			}
+			if !p.isFallback() {
+				ps.ClientPublicKey = p.ClientPublicKey.Base64()
+			}
+			f.lock.Lock()
+			for i, c := range f.candidates {
+				ps.Targets = append(ps.Targets, ForwardTargetStats{
+					Address: c.target.address,
+					Active:  i == f.active,
+					Failed:  c.failed,
+				})
+			}
+			f.lock.Unlock()
+			stats.PeerForwards = append(stats.PeerForwards, ps)
+		}
+	}
+}
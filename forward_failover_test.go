@@ -0,0 +1,197 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfigForward_UnmarshalJSON(t *testing.T) {
+	var backups []ServerConfigForward
+	err := json.Unmarshal([]byte(`[":51830", {"address": "192.0.2.4:51820", "priority": 1}]`), &backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0] != (ServerConfigForward{Address: ":51830"}) ||
+		backups[1] != (ServerConfigForward{Address: "192.0.2.4:51820", Priority: 1}) {
+		t.Errorf("unexpected backups %+v", backups)
+	}
+}
+
+func TestForwardFailover_Check(t *testing.T) {
+	cs := &ServerConfigServer{Address: "192.0.2.1"}
+	p := &ServerConfigPeer{
+		ForwardTo: ":51820",
+		ForwardBackups: []ServerConfigForward{
+			{Address: "192.0.2.3:51820", Priority: 1},
+			{Address: "192.0.2.2:51820"},
+		},
+	}
+	primary, err := cs.newPeerForwardTarget(0, p, cs.forwardResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cs.newPeerForwardFailover(0, p, primary, cs.forwardResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, c := range f.candidates {
+		order = append(order, c.target.address)
+	}
+	if strings.Join(order, ",") != "192.0.2.1:51820,192.0.2.2:51820,192.0.2.3:51820" {
+		t.Fatalf("expected the targets sorted by the priority, got %s", order)
+	}
+
+	unhealthy := make(map[string]bool)
+	unhealthyReason := func(addr *net.UDPAddr) string {
+		if unhealthy[addr.String()] {
+			return "unreachable"
+		}
+		return ""
+	}
+	const delay = time.Minute
+	now := time.Now()
+	expectSwitch := func(expected string) {
+		t.Helper()
+		_, next, _ := f.check(now, delay, unhealthyReason)
+		if expected == "" {
+			if next != nil {
+				t.Fatalf("expected not switched, switched to %s", next.address)
+			}
+			return
+		}
+		if next == nil || next.address != expected || f.activeTarget() != next {
+			t.Fatalf("expected switched to %s, got %v", expected, next)
+		}
+	}
+
+	expectSwitch("")
+	unhealthy["192.0.2.1:51820"] = true
+	expectSwitch("192.0.2.2:51820")
+	expectSwitch("")
+
+	// failed back after the delay once the target is not unhealthy
+	now = now.Add(delay)
+	expectSwitch("")
+	unhealthy["192.0.2.1:51820"] = false
+	expectSwitch("192.0.2.1:51820")
+
+	// the delay is doubled once it fails again soon after failed back to
+	now = now.Add(time.Second)
+	unhealthy["192.0.2.1:51820"] = true
+	expectSwitch("192.0.2.2:51820")
+	unhealthy["192.0.2.1:51820"] = false
+	now = now.Add(delay)
+	expectSwitch("")
+	now = now.Add(delay)
+	expectSwitch("192.0.2.1:51820")
+
+	// all of them are tried in turn
+	for _, addr := range order {
+		unhealthy[addr] = true
+	}
+	expectSwitch("192.0.2.2:51820")
+	expectSwitch("192.0.2.3:51820")
+	expectSwitch("192.0.2.1:51820")
+	if f.failovers != 7 {
+		t.Errorf("expected 7 failovers, got %d", f.failovers)
+	}
+
+	p.ForwardBackups = append(p.ForwardBackups, ServerConfigForward{Address: ":51820", Priority: 2})
+	if _, err = cs.newPeerForwardFailover(0, p, primary, cs.forwardResolve); err == nil {
+		t.Errorf("expected an error of the duplicated forward target")
+	}
+}
+
+func TestServer_ForwardFailover(t *testing.T) {
+	serverSK, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	var backend [2]*net.UDPAddr
+	for i := range backend {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		backend[i] = conn.LocalAddr().(*net.UDPAddr)
+	}
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{"127.0.0.1:0"},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       backend[0].String(),
+						ForwardBackups:  []ServerConfigForward{{Address: backend[1].String()}},
+					},
+					{ClientPublicKey: &otherPK, ForwardTo: backend[0].String()},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Logger = &testLogger{}
+	server.wgitTable.Logger = server.Logger
+	defer func() {
+		server.wgitTable.closeUpstreamConns()
+		server.wgitTable.loopWaitGroup.Wait()
+	}()
+
+	cs := server.servers[0]
+	var peers []*Peer
+	for i, pk := range []NoisePublicKey{clientPK, otherPK} {
+		peer := &Peer{
+			clientPublicKey:   pk,
+			serverPublicKey:   cs.publicKey,
+			clientProxyIndex:  uint32(0x1000 + i),
+			clientDestination: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1000 + i},
+			serverDestination: backend[0],
+		}
+		server.wgitTable.clientMap.storeLocked(peer.clientProxyIndex, peer)
+		peers = append(peers, peer)
+	}
+	uc, err := server.wgitTable.upstreamConnOf(backend[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	server.checkForwardFailovers(now)
+	if stats := server.Stats(); len(stats.PeerForwards) != 1 || !stats.PeerForwards[0].Targets[0].Active {
+		t.Fatalf("expected the forward_to active, got %+v", stats.PeerForwards)
+	}
+
+	// no reply from the forward_to in the window
+	initiation := &Packet{Data: make([]byte, device.MessageInitiationSize), Length: device.MessageInitiationSize}
+	binary.LittleEndian.PutUint32(initiation.Data[0:4], device.MessageInitiationType)
+	uc.sent(initiation, now.Add(-defaultUpstreamHealthWindow))
+	server.checkForwardFailovers(now)
+	if peers[0].serverDestination.String() != backend[1].String() {
+		t.Errorf("expected the session migrated to %s, got %s", backend[1], peers[0].serverDestination)
+	}
+	if peers[1].serverDestination.String() != backend[0].String() {
+		t.Errorf("expected the session of the peer without forward_backups kept on %s, got %s", backend[0], peers[1].serverDestination)
+	}
+	addr, err := server.resolveForwardTarget(cs.matchPeer(clientPK).activeForwardTarget())
+	if err != nil || addr.String() != backend[1].String() {
+		t.Errorf("expected new sessions forwarded to %s, got %v (%v)", backend[1], addr, err)
+	}
+	stats := server.Stats()
+	if len(stats.PeerForwards) != 1 || stats.PeerForwards[0].Failovers != 1 ||
+		!stats.PeerForwards[0].Targets[0].Failed || !stats.PeerForwards[0].Targets[1].Active {
+		t.Errorf("expected failed over to the backup in the stats, got %+v", stats.PeerForwards)
+	}
+	if stats.PeerForwards[0].ClientPublicKey != clientPK.Base64() {
+		t.Errorf("expected the peer %s in the stats, got %s", clientPK.Base64(), stats.PeerForwards[0].ClientPublicKey)
+	}
+}
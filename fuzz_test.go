@@ -0,0 +1,255 @@
+package mwgp
+
+import (
+	"bytes"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"testing"
+)
+
+const (
+	kFuzzMTU             = 1500
+	kFuzzMaxPacketLength = kFuzzMTU + 64
+	kFuzzObfuscateKey    = "fuzz"
+)
+
+// fuzzMessageLength returns the length of a valid-shaped message of the type,
+// the length is only used for MessageTransport.
+func fuzzMessageLength(messageType byte, length uint16) int {
+	switch messageType {
+	case device.MessageInitiationType:
+		return device.MessageInitiationSize
+	case device.MessageResponseType:
+		return device.MessageResponseSize
+	case device.MessageCookieReplyType:
+		return device.MessageCookieReplySize
+	default:
+		return device.MessageTransportSize + int(length)%(kFuzzMTU-device.MessageTransportSize+1)
+	}
+}
+
+// newFuzzMessage returns a valid-shaped WireGuard message filled with the payload.
+func newFuzzMessage(messageType byte, length uint16, payload []byte, zeroMAC2 bool) (p *Packet) {
+	messageType = messageType%4 + 1
+	p = &Packet{Data: make([]byte, kFuzzMaxPacketLength)}
+	p.Length = fuzzMessageLength(messageType, length)
+	for i := 4; i < p.Length && len(payload) > 0; i++ {
+		p.Data[i] = payload[(i-4)%len(payload)]
+	}
+	p.Data[0] = messageType
+	if zeroMAC2 {
+		switch messageType {
+		case device.MessageInitiationType:
+			memset(p.Data[kMessageInitiationTypeMAC2Offset:p.Length], 0)
+		case device.MessageResponseType:
+			memset(p.Data[kMessageResponseTypeMAC2Offset:p.Length], 0)
+		}
+	}
+	return
+}
+
+func memset(b []byte, c byte) {
+	for i := range b {
+		b[i] = c
+	}
+}
+
+func FuzzDeobfuscate(f *testing.F) {
+	var seeder WireGuardObfuscator
+	seeder.Initialize(kFuzzObfuscateKey)
+	for _, messageType := range []byte{device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType, device.MessageTransportType} {
+		for _, authenticated := range []bool{false, true} {
+			seeder.Authenticated = authenticated
+			p := newFuzzMessage(messageType-1, 64, []byte{0x5a}, true)
+			p.Flags |= PacketFlagObfuscateBeforeSend
+			seeder.Obfuscate(p)
+			f.Add(append([]byte(nil), p.Slice()...), authenticated)
+		}
+	}
+
+	var xor, authenticated WireGuardObfuscator
+	xor.Initialize(kFuzzObfuscateKey)
+	xor.Padding = &ObfuscatePaddingConfig{MinLength: 256}
+	authenticated.Initialize(kFuzzObfuscateKey)
+	authenticated.Authenticated = true
+
+	f.Fuzz(func(t *testing.T, data []byte, isAuthenticated bool) {
+		if len(data) > kFuzzMaxPacketLength {
+			return
+		}
+		o := &xor
+		if isAuthenticated {
+			o = &authenticated
+		}
+		p := &Packet{Data: make([]byte, kFuzzMaxPacketLength)}
+		p.Length = copy(p.Data, data)
+		o.Deobfuscate(p)
+
+		if p.Length > len(data) {
+			t.Fatalf("deobfuscated length %d exceeds the input length %d", p.Length, len(data))
+		}
+		if p.Flags&PacketFlagDropped != 0 {
+			if p.Flags&PacketFlagDeobfuscatedAfterReceived != 0 {
+				t.Fatalf("packet is both dropped and deobfuscated")
+			}
+			return
+		}
+		if p.Flags&PacketFlagDeobfuscatedAfterReceived != 0 {
+			if p.Length < device.MinMessageSize {
+				t.Fatalf("deobfuscated length %d is shorter than a WireGuard message", p.Length)
+			}
+			if p.Data[0] < 1 || p.Data[0] > 4 || p.Data[1] != 0 || p.Data[2] != 0 || p.Data[3] != 0 {
+				t.Fatalf("deobfuscated to an invalid WireGuard header %x", p.Data[:4])
+			}
+		} else if p.Length != len(data) || !bytes.Equal(p.Slice(), data) {
+			t.Fatalf("plain packet is modified")
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, messageType := range []byte{device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType, device.MessageTransportType} {
+		f.Add(messageType-1, uint16(64), []byte{0x5a}, true, false, uint16(0), byte(0), false)
+		f.Add(messageType-1, uint16(1400), []byte{0x01, 0x02}, false, true, uint16(7), byte(0x80), true)
+	}
+
+	f.Fuzz(func(t *testing.T, messageType byte, length uint16, payload []byte, zeroMAC2 bool,
+		padding bool, corruptOffset uint16, corruptXOR byte, authenticated bool) {
+		var sender, receiver WireGuardObfuscator
+		sender.Initialize(kFuzzObfuscateKey)
+		receiver.Initialize(kFuzzObfuscateKey)
+		sender.Authenticated = authenticated
+		receiver.Authenticated = authenticated
+		if padding {
+			sender.Padding = &ObfuscatePaddingConfig{MinLength: 256, MaxRandomTail: 64, MaxLength: kFuzzMTU}
+		}
+
+		p := newFuzzMessage(messageType, length, payload, zeroMAC2)
+		original := append([]byte(nil), p.Slice()...)
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		sender.Obfuscate(p)
+		if p.Flags&PacketFlagDropped != 0 {
+			// no room for the tag
+			return
+		}
+		obfuscatedLength := p.Length
+		if obfuscatedLength > kFuzzMaxPacketLength {
+			t.Fatalf("obfuscated length %d exceeds the buffer", obfuscatedLength)
+		}
+		corrupted := corruptXOR != 0
+		if corrupted {
+			p.Data[int(corruptOffset)%p.Length] ^= corruptXOR
+		}
+
+		p.Flags = 0
+		receiver.Deobfuscate(p)
+		if p.Length > obfuscatedLength {
+			t.Fatalf("deobfuscated length %d exceeds the obfuscated length %d", p.Length, obfuscatedLength)
+		}
+		deobfuscated := p.Flags&PacketFlagDeobfuscatedAfterReceived != 0
+		dropped := p.Flags&PacketFlagDropped != 0
+		switch {
+		case !corrupted:
+			if !deobfuscated || dropped || !bytes.Equal(p.Slice(), original) {
+				t.Fatalf("message type %d with length %d is not restored, flags %b", original[0], len(original), p.Flags)
+			}
+		case authenticated:
+			// a corrupted packet is never accepted as an obfuscated one,
+			// but it might look like a plain WireGuard packet passed through in the non-strict mode
+			if deobfuscated {
+				t.Fatalf("corrupted message type %d with length %d is accepted", original[0], len(original))
+			}
+		case deobfuscated:
+			if p.Length < device.MinMessageSize {
+				t.Fatalf("deobfuscated length %d is shorter than a WireGuard message", p.Length)
+			}
+		}
+	})
+}
+
+// FuzzServerClientPacket feeds the packets from the clients through the deobfuscation
+// and the demultiplexer of the server.
+func FuzzServerClientPacket(f *testing.F) {
+	serverSK, serverPK := e2eGenerateKey(f)
+	_, clientPK := e2eGenerateKey(f)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{"192.0.2.1:1000"},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "192.0.2.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       "192.0.2.1:2000",
+					},
+				},
+			},
+		},
+		ObfuscateKey:          kFuzzObfuscateKey,
+		ObfuscateMinKeyLength: len(kFuzzObfuscateKey),
+		LogLevel:              "error",
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	table := server.wgitTable
+	table.TransportFactory = newMemNetwork()
+	f.Cleanup(func() {
+		_ = table.Close()
+		table.closeUpstreamConns()
+	})
+
+	// an established session with the receiver index 0x01020304 from the server
+	const serverProxyIndex = 0x01020304
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 3000}
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x11111111,
+		clientDestination: source,
+		serverOriginIndex: 0x22222222,
+		serverProxyIndex:  serverProxyIndex,
+		serverDestination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2000},
+		serverPublicKey:   serverPK,
+		clientPublicKey:   clientPK,
+	}
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+
+	var seeder WireGuardObfuscator
+	seeder.Initialize(kFuzzObfuscateKey)
+	for _, messageType := range []byte{device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType, device.MessageTransportType} {
+		p := newFuzzMessage(messageType-1, 64, []byte{0x04, 0x03, 0x02, 0x01}, true)
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		seeder.Obfuscate(p)
+		f.Add(append([]byte(nil), p.Slice()...))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > kFuzzMaxPacketLength {
+			return
+		}
+		p := table.obtainPacket()
+		p.Length = copy(p.Data, data)
+		p.Source = source
+		server.obfuscator.Deobfuscate(p)
+		if p.Flags&PacketFlagDropped != 0 {
+			table.recyclePacket(p)
+			return
+		}
+		table.handleClientPacket(p)
+	drain:
+		for {
+			select {
+			case p = <-table.serverWriteChan:
+			case p = <-table.serverWriteHandshakeChan:
+			default:
+				break drain
+			}
+			if p.Length > len(data) {
+				t.Fatalf("forwarded length %d exceeds the input length %d", p.Length, len(data))
+			}
+			table.recyclePacket(p)
+		}
+	})
+}
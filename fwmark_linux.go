@@ -0,0 +1,11 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const fwmarkSupported = true
+
+func setSocketFwMark(fd uintptr, mark int) (err error) {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+}
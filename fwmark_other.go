@@ -0,0 +1,15 @@
+//go:build !linux
+
+package mwgp
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const fwmarkSupported = false
+
+func setSocketFwMark(fd uintptr, mark int) (err error) {
+	err = fmt.Errorf("SO_MARK is not supported on %s", runtime.GOOS)
+	return
+}
@@ -0,0 +1,154 @@
+package mwgp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Latency Histogram:
+//
+// With LatencySampleRate N > 0, every read loop stamps one of every N packets it reads with the monotonic time
+// the read returns, and the write loop counts the time until the write of the packet completes into the histogram
+// of its direction and kind (handshake or transport), which are exported as Stats.Latency.
+//
+// The stamp is kept in the packet from the reading to the writing, so the latency covers the queues, the forward
+// table and the obfuscation, but not the time spent in the socket buffers. The packets not sampled only cost
+// a countdown of the read loop, and with a zero LatencySampleRate the whole feature is a branch per read
+// and another per write.
+
+// latencyBucketBounds are the upper bounds of the buckets of the histograms, the last bucket has no bound.
+var latencyBucketBounds = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+}
+
+const kLatencyBuckets = len(latencyBucketBounds) + 1
+
+func validateLatencySampleRate(rate int) (err error) {
+	if rate < 0 {
+		err = fmt.Errorf("latency_sample_rate must not be negative, got %d", rate)
+		return
+	}
+	return
+}
+
+// latencyEpoch is the origin of the stamps, so that a stamp is the monotonic time since it.
+var latencyEpoch = time.Now()
+
+// monotonicStamp returns a stamp of now, which is never 0 as a 0 stamp marks a packet not sampled.
+func monotonicStamp() int64 {
+	return int64(time.Since(latencyEpoch)) | 1
+}
+
+// latencyHistogram is the histogram of a direction and a kind, all fields must be accessed atomically.
+type latencyHistogram struct {
+	// buckets are not cumulative, each counts the packets between the bound of the previous bucket and its own one.
+	buckets [kLatencyBuckets]uint64
+	count   uint64
+	sum     uint64
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	bucket := 0
+	for bucket < len(latencyBucketBounds) && latency > latencyBucketBounds[bucket] {
+		bucket++
+	}
+	atomic.AddUint64(&h.buckets[bucket], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(latency))
+}
+
+// latencySampler stamps the packets read by a read loop, it is only used by the goroutine of the read loop.
+type latencySampler struct {
+	rate      int
+	countdown int
+}
+
+// sample stamps one of every rate packets.
+func (s *latencySampler) sample(packets []*Packet) {
+	if s.rate <= 0 {
+		return
+	}
+	var stamp int64
+	for _, packet := range packets {
+		s.countdown--
+		if s.countdown > 0 {
+			continue
+		}
+		s.countdown = s.rate
+		if stamp == 0 {
+			stamp = monotonicStamp()
+		}
+		packet.received = stamp
+	}
+}
+
+// observeLatency counts the latency of the packet written if it is sampled,
+// a retained packet is not counted since it is not written yet.
+func (t *WireGuardIndexTranslationTable) observeLatency(packet *Packet, s2c bool) {
+	if packet.received == 0 || packet.Flags&PacketFlagRetained != 0 {
+		return
+	}
+	direction, kind := 0, 0
+	if s2c {
+		direction = 1
+	}
+	if isHandshakePacket(packet) {
+		kind = 1
+	}
+	t.stats.latency[direction][kind].observe(time.Duration(monotonicStamp() - packet.received))
+}
+
+// LatencyStats is the histogram of the time from reading a packet to writing it, see "Latency Histogram".
+type LatencyStats struct {
+	// Direction is "client_to_server" or "server_to_client", Handshake is set for the handshake packets,
+	// otherwise the histogram is of the transport packets.
+	Direction string
+	Handshake bool
+
+	// Buckets are not cumulative, each counts the packets slower than the previous bucket
+	// and not slower than its UpperBound, which is 0 for the last one without bound.
+	Buckets []LatencyBucket
+	Count   uint64
+	Sum     time.Duration
+}
+
+// LatencyBucket is a bucket of the LatencyStats.
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// latencyStats returns the histograms, or nil without the LatencySampleRate.
+func (t *WireGuardIndexTranslationTable) latencyStats() (ls []LatencyStats) {
+	if t.LatencySampleRate <= 0 {
+		return
+	}
+	for direction, name := range [...]string{"client_to_server", "server_to_client"} {
+		for kind := range t.stats.latency[direction] {
+			h := &t.stats.latency[direction][kind]
+			s := LatencyStats{
+				Direction: name,
+				Handshake: kind == 1,
+				Buckets:   make([]LatencyBucket, kLatencyBuckets),
+				Count:     atomic.LoadUint64(&h.count),
+				Sum:       time.Duration(atomic.LoadUint64(&h.sum)),
+			}
+			for i := range s.Buckets {
+				if i < len(latencyBucketBounds) {
+					s.Buckets[i].UpperBound = latencyBucketBounds[i]
+				}
+				s.Buckets[i].Count = atomic.LoadUint64(&h.buckets[i])
+			}
+			ls = append(ls, s)
+		}
+	}
+	return
+}
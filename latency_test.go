@@ -0,0 +1,76 @@
+package mwgp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencySampler(t *testing.T) {
+	sampler := latencySampler{rate: 3}
+	packets := newBatchTestPackets(8)
+	sampler.sample(packets[:4])
+	sampler.sample(packets[4:])
+	for i, packet := range packets {
+		if sampled := packet.received != 0; sampled != (i%3 == 0) {
+			t.Errorf("packet #%d: sampled = %v", i, sampled)
+		}
+	}
+
+	disabled := latencySampler{}
+	packets = newBatchTestPackets(4)
+	disabled.sample(packets)
+	for i, packet := range packets {
+		if packet.received != 0 {
+			t.Errorf("packet #%d is sampled with the rate 0", i)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	if table.Stats().Latency != nil {
+		t.Fatal("expected no latency histograms without the LatencySampleRate")
+	}
+	table.LatencySampleRate = 1
+
+	h := &table.stats.latency[1][0]
+	for _, latency := range []time.Duration{0, 50 * time.Microsecond, 51 * time.Microsecond, 3 * time.Millisecond, time.Second} {
+		h.observe(latency)
+	}
+	stats := table.Stats().Latency
+	if len(stats) != 4 {
+		t.Fatalf("expected 4 histograms, got %d", len(stats))
+	}
+	var s LatencyStats
+	for _, ls := range stats {
+		if ls.Direction == "server_to_client" && !ls.Handshake {
+			s = ls
+		} else if ls.Count != 0 {
+			t.Errorf("unexpected packets in the %s histogram of handshake=%v", ls.Direction, ls.Handshake)
+		}
+	}
+	expected := []uint64{2, 1, 0, 0, 0, 0, 1, 0, 1}
+	if len(s.Buckets) != len(expected) {
+		t.Fatalf("expected %d buckets, got %d", len(expected), len(s.Buckets))
+	}
+	for i, bucket := range s.Buckets {
+		if bucket.Count != expected[i] {
+			t.Errorf("bucket #%d (%s): expected %d, got %d", i, bucket.UpperBound, expected[i], bucket.Count)
+		}
+	}
+	if s.Buckets[len(s.Buckets)-1].UpperBound != 0 {
+		t.Error("expected no upper bound of the last bucket")
+	}
+	if s.Count != 5 || s.Sum != time.Second+3*time.Millisecond+101*time.Microsecond {
+		t.Errorf("unexpected count %d and sum %s", s.Count, s.Sum)
+	}
+
+	packet := newBatchTestPackets(1)[0]
+	packet.Data[0] = 1
+	packet.Length = 148
+	packet.received = monotonicStamp()
+	table.observeLatency(packet, false)
+	if table.stats.latency[0][1].count != 1 {
+		t.Error("expected the sampled handshake counted as client_to_server")
+	}
+}
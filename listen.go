@@ -0,0 +1,222 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Multiple Listen Addresses:
+//
+// The "listen" of mwgp-server and mwgp-client is a single address, or a list of them, such as
+//
+//	"listen": ["0.0.0.0:1000", "[::]:443", "0.0.0.0:20000-20100"]
+//
+// The table reads every socket in its own loop, and remembers the socket a client is seen on
+// (Peer.clientTransport), so the replies are sent from the same address and port.
+// Each address is a listener in the Stats, with the packets and bytes received and sent on it.
+// The systemd socket activation ("systemd" or "systemd:NAME") cannot be listed with others.
+
+// ListenAddresses is the "listen" option, a string or an array of strings in the config,
+// an empty one listens on a random port as the empty string did.
+type ListenAddresses []string
+
+func (l *ListenAddresses) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err == nil {
+		*l = ListenAddresses{s}
+		return
+	}
+	var ss []string
+	err = json.Unmarshal(b, &ss)
+	if err != nil {
+		err = fmt.Errorf("listen must be a string or an array of strings: %w", err)
+		return
+	}
+	*l = ss
+	return
+}
+
+func (l ListenAddresses) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l ListenAddresses) String() string {
+	return strings.Join(l, ",")
+}
+
+// addresses returns the addresses to listen on, a single empty one if there is none.
+func (l ListenAddresses) addresses() []string {
+	if len(l) == 0 {
+		return []string{""}
+	}
+	return l
+}
+
+// systemd returns the fd name if the listen is the systemd socket activation, see parseSystemdListen.
+func (l ListenAddresses) systemd() (name string, ok bool, err error) {
+	for _, listen := range l {
+		if _, lok := parseSystemdListen(listen); lok {
+			if len(l) > 1 {
+				err = fmt.Errorf("listen address %s cannot be listed with others", listen)
+				return
+			}
+			name, ok = parseSystemdListen(listen)
+			return
+		}
+	}
+	return
+}
+
+// ListenRange is an address the table listens on for the clients,
+// with every port from the Addr.Port to the PortMax if the PortMax is set, see splitPortRange.
+type ListenRange struct {
+	Addr    *net.UDPAddr
+	PortMax int
+}
+
+func (r ListenRange) String() string {
+	if r.PortMax == 0 || r.PortMax == r.Addr.Port {
+		return r.Addr.String()
+	}
+	return fmt.Sprintf("%s-%d", r.Addr, r.PortMax)
+}
+
+// resolveListenRanges resolves the addresses of mwgp-server, each of them can be a port range.
+func resolveListenRanges(l ListenAddresses) (ranges []ListenRange, err error) {
+	seen := make(map[string]bool)
+	for _, listen := range l.addresses() {
+		var r ListenRange
+		r.Addr, r.PortMax, err = resolveListenPortRange(listen)
+		if err != nil {
+			return
+		}
+		if seen[r.String()] {
+			err = fmt.Errorf("duplicated listen address %s", listen)
+			return
+		}
+		seen[r.String()] = true
+		ranges = append(ranges, r)
+	}
+	return
+}
+
+// resolveListenAddrs resolves the addresses of mwgp-client, port ranges are not supported.
+func resolveListenAddrs(l ListenAddresses) (ranges []ListenRange, err error) {
+	seen := make(map[string]bool)
+	for _, listen := range l.addresses() {
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			err = fmt.Errorf("invalid listen address %s: %w", listen, err)
+			return
+		}
+		if seen[addr.String()] {
+			err = fmt.Errorf("duplicated listen address %s", listen)
+			return
+		}
+		seen[addr.String()] = true
+		ranges = append(ranges, ListenRange{Addr: addr})
+	}
+	return
+}
+
+// sameListenRanges reports whether a and b listen on the same addresses in the same order.
+func sameListenRanges(a, b []ListenRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// setClientListen sets the ClientListen of the table to the first range and the ClientListenExtra to the rest.
+func (t *WireGuardIndexTranslationTable) setClientListen(ranges []ListenRange) {
+	t.ClientListen, t.ClientListenPortMax = ranges[0].Addr, ranges[0].PortMax
+	t.ClientListenExtra = ranges[1:]
+}
+
+// clientListenRanges returns the ClientListen and the ClientListenExtra.
+func (t *WireGuardIndexTranslationTable) clientListenRanges() (ranges []ListenRange) {
+	ranges = append(ranges, ListenRange{Addr: t.ClientListen, PortMax: t.ClientListenPortMax})
+	ranges = append(ranges, t.ClientListenExtra...)
+	return
+}
+
+// clientListener is the counters of the sockets of a listen address, all fields must be accessed atomically
+// except the address and the transports.
+type clientListener struct {
+	packetsReceived uint64
+	bytesReceived   uint64
+	packetsSent     uint64
+	bytesSent       uint64
+
+	address    string
+	transports []PacketTransport
+}
+
+func (l *clientListener) countReceived(packets []*Packet) {
+	var bytes uint64
+	for _, packet := range packets {
+		bytes += uint64(packet.Length)
+	}
+	atomic.AddUint64(&l.packetsReceived, uint64(len(packets)))
+	atomic.AddUint64(&l.bytesReceived, bytes)
+}
+
+// countSent counts the packets written, skipping the ones with writeFailed.
+func (l *clientListener) countSent(packets []*Packet) {
+	var count, bytes uint64
+	for _, packet := range packets {
+		if packet.writeFailed {
+			continue
+		}
+		count++
+		bytes += uint64(packet.Length)
+	}
+	atomic.AddUint64(&l.packetsSent, count)
+	atomic.AddUint64(&l.bytesSent, bytes)
+}
+
+// clientListenerOf returns the listener of the transport, nil for the ExtraClientTransports.
+func (t *WireGuardIndexTranslationTable) clientListenerOf(transport PacketTransport) *clientListener {
+	return t.clientListenerMap[transport]
+}
+
+// setClientListeners sets the listeners for the Stats and the counting in the loops,
+// it must be called before the loops start.
+func (t *WireGuardIndexTranslationTable) setClientListeners(listeners []*clientListener) {
+	m := make(map[PacketTransport]*clientListener)
+	for _, listener := range listeners {
+		for _, transport := range listener.transports {
+			m[transport] = listener
+		}
+	}
+	t.mapLock.Lock()
+	t.clientListeners = listeners
+	t.mapLock.Unlock()
+	t.clientListenerMap = m
+}
+
+// listenerStatsLocked returns the counters of the listeners, it must be called with the mapLock held.
+func (t *WireGuardIndexTranslationTable) listenerStatsLocked() (stats []ListenerStats) {
+	for _, listener := range t.clientListeners {
+		stats = append(stats, ListenerStats{
+			Address:         listener.address,
+			PacketsReceived: atomic.LoadUint64(&listener.packetsReceived),
+			BytesReceived:   atomic.LoadUint64(&listener.bytesReceived),
+			PacketsSent:     atomic.LoadUint64(&listener.packetsSent),
+			BytesSent:       atomic.LoadUint64(&listener.bytesSent),
+		})
+	}
+	return
+}
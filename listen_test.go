@@ -0,0 +1,147 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestListenAddresses_JSON(t *testing.T) {
+	for _, c := range []struct {
+		json     string
+		expected ListenAddresses
+		invalid  bool
+	}{
+		{json: `"0.0.0.0:1000"`, expected: ListenAddresses{"0.0.0.0:1000"}},
+		{json: `["0.0.0.0:1000", "[::]:443"]`, expected: ListenAddresses{"0.0.0.0:1000", "[::]:443"}},
+		{json: `[]`, expected: ListenAddresses{}},
+		{json: `1000`, invalid: true},
+		{json: `[1000]`, invalid: true},
+	} {
+		var l ListenAddresses
+		err := json.Unmarshal([]byte(c.json), &l)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.json)
+			}
+			continue
+		}
+		if err != nil || l.String() != c.expected.String() || len(l) != len(c.expected) {
+			t.Errorf("%s: expected %q, got %q (%v)", c.json, c.expected, l, err)
+			continue
+		}
+		bs, err := json.Marshal(l)
+		var roundTrip ListenAddresses
+		if err == nil {
+			err = json.Unmarshal(bs, &roundTrip)
+		}
+		if err != nil || roundTrip.String() != l.String() {
+			t.Errorf("%s: marshalled to %s (%v)", c.json, bs, err)
+		}
+	}
+
+	if bs, _ := json.Marshal(ListenAddresses{"0.0.0.0:1000"}); string(bs) != `"0.0.0.0:1000"` {
+		t.Errorf("expected a single address marshalled as a string, got %s", bs)
+	}
+}
+
+func TestResolveListenRanges(t *testing.T) {
+	ranges, err := resolveListenRanges(ListenAddresses{"127.0.0.1:1000", "127.0.0.1:2000-2010"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].String() != "127.0.0.1:1000" || ranges[1].String() != "127.0.0.1:2000-2010" {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+	if ranges, err = resolveListenRanges(nil); err != nil || len(ranges) != 1 || ranges[0].Addr.Port != 0 {
+		t.Errorf("expected a random port for no listen address, got %v (%v)", ranges, err)
+	}
+
+	for _, l := range []ListenAddresses{
+		{"127.0.0.1:1000", "127.0.0.1:1000"},
+		{"127.0.0.1:1000", "127.0.0.1:abc"},
+	} {
+		if _, err = resolveListenRanges(l); err == nil {
+			t.Errorf("%s: expected an error", l)
+		}
+	}
+	if _, _, err = (ListenAddresses{"systemd", "127.0.0.1:1000"}).systemd(); err == nil {
+		t.Errorf("expected an error of systemd listed with others")
+	}
+	if _, err = resolveListenAddrs(ListenAddresses{"127.0.0.1:2000-2010"}); err == nil {
+		t.Errorf("expected an error of port range on mwgp-client")
+	}
+}
+
+func TestEndToEndMultipleListen(t *testing.T) {
+	const obfsKey = "multiple listen"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	unusedListen, usedListen := e2eFreeUDPAddr(t), e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{unusedListen, usedListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		// the upstream socket of mwgp-client is connected,
+		// so the replies must be sent from the listen address it sent to
+		Server:          usedListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	stats := server.Stats()
+	if len(stats.Listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %+v", stats.Listeners)
+	}
+	unused, used := stats.Listeners[0], stats.Listeners[1]
+	if unused.Address != unusedListen || used.Address != usedListen {
+		t.Errorf("expected listeners %s and %s, got %s and %s", unusedListen, usedListen, unused.Address, used.Address)
+	}
+	if unused.PacketsReceived != 0 || unused.PacketsSent != 0 {
+		t.Errorf("expected no packets on %s, got %+v", unusedListen, unused)
+	}
+	if used.PacketsReceived == 0 || used.PacketsSent == 0 || used.BytesReceived == 0 || used.BytesSent == 0 {
+		t.Errorf("expected packets received and sent on %s, got %+v", usedListen, used)
+	}
+	if cs := client.Stats(); len(cs.Listeners) != 1 || cs.Listeners[0].PacketsReceived == 0 {
+		t.Errorf("expected packets received on the listener of mwgp-client, got %+v", cs.Listeners)
+	}
+}
@@ -0,0 +1,327 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is the logging interface used by mwgp.
+//
+// The default one is a StdLogger writing to the stdlib log package,
+// library users can set the Server.Logger or Client.Logger to an adapter of zap, slog, etc. before Start().
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = [...]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	if l < LogLevelDebug || l > LogLevelError {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses the log_level option, an empty string is LogLevelInfo.
+func ParseLogLevel(s string) (level LogLevel, err error) {
+	if s == "" {
+		level = LogLevelInfo
+		return
+	}
+	for l, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			level = LogLevel(l)
+			return
+		}
+	}
+	err = fmt.Errorf("invalid log_level %q, must be one of %s", s, strings.Join(logLevelNames[:], ", "))
+	return
+}
+
+// StdLogger writes the messages with a "[level] " prefix to the stdlib log package,
+// the messages below the Level are suppressed.
+type StdLogger struct {
+	Level LogLevel
+}
+
+func NewStdLogger(level LogLevel) *StdLogger {
+	return &StdLogger{Level: level}
+}
+
+func (l *StdLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.Level {
+		return
+	}
+	_ = log.Output(3, "["+level.String()+"] "+fmt.Sprintf(format, args...))
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args...)
+}
+
+func (l *StdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args...)
+}
+
+func (l *StdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args...)
+}
+
+func (l *StdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args...)
+}
+
+// LogField is a key-value pair attached to the log messages, such as the session_id.
+type LogField struct {
+	Key   string
+	Value string
+}
+
+// FieldLogger is implemented by the Logger supporting structured fields.
+// The loggers without it, such as the StdLogger, just ignore the fields.
+type FieldLogger interface {
+	Logger
+	WithFields(fields ...LogField) Logger
+}
+
+// JSONLogger writes one JSON object per line with the ts, level, msg and the attached fields,
+// the messages below the Level are suppressed.
+type JSONLogger struct {
+	Level LogLevel
+
+	// Output is the writer of the lines, default to the output of the stdlib log package.
+	Output io.Writer
+
+	fields []LogField
+	lock   *sync.Mutex
+}
+
+func NewJSONLogger(level LogLevel, output io.Writer) *JSONLogger {
+	return &JSONLogger{
+		Level:  level,
+		Output: output,
+		lock:   &sync.Mutex{},
+	}
+}
+
+func (l *JSONLogger) WithFields(fields ...LogField) Logger {
+	nl := *l
+	nl.fields = make([]LogField, 0, len(l.fields)+len(fields))
+	nl.fields = append(nl.fields, l.fields...)
+	nl.fields = append(nl.fields, fields...)
+	return &nl
+}
+
+func (l *JSONLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.Level {
+		return
+	}
+	var b bytes.Buffer
+	writeField := func(key, value string) {
+		kb, _ := json.Marshal(key)
+		vb, _ := json.Marshal(value)
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(vb)
+	}
+	b.WriteByte('{')
+	writeField("ts", time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	writeField("level", level.String())
+	b.WriteByte(',')
+	writeField("msg", fmt.Sprintf(format, args...))
+	for _, f := range l.fields {
+		b.WriteByte(',')
+		writeField(f.Key, f.Value)
+	}
+	b.WriteString("}\n")
+
+	output := l.Output
+	if output == nil {
+		output = log.Writer()
+	}
+	if l.lock != nil {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+	}
+	_, _ = output.Write(b.Bytes())
+}
+
+func (l *JSONLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args...)
+}
+
+func (l *JSONLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args...)
+}
+
+func (l *JSONLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args...)
+}
+
+func (l *JSONLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args...)
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// defaultLogger is used if no Logger is set.
+var defaultLogger Logger = NewStdLogger(LogLevelInfo)
+
+// NewLogger creates a logger from the log_level and log_format options.
+func NewLogger(logLevel, logFormat string) (logger Logger, err error) {
+	level, err := ParseLogLevel(logLevel)
+	if err != nil {
+		return
+	}
+	switch logFormat {
+	case "", LogFormatText:
+		logger = NewStdLogger(level)
+	case LogFormatJSON:
+		logger = NewJSONLogger(level, nil)
+	default:
+		err = fmt.Errorf("invalid log_format %q, must be one of %s, %s", logFormat, LogFormatText, LogFormatJSON)
+	}
+	return
+}
+
+const (
+	// kPacketLogRate is the number of the per-packet log messages of a category allowed per second,
+	// and kPacketLogBurst is the max number of them at once, so that a flood of garbage packets cannot fill the disk.
+	kPacketLogRate  = 5
+	kPacketLogBurst = 5
+
+	// kPacketLogSummaryInterval is how often the number of the suppressed messages is logged.
+	kPacketLogSummaryInterval = 10 * time.Second
+)
+
+// logRateLimiter is a token bucket of the log messages,
+// the number of suppressed messages is reported with the next allowed one, or taken by takeSuppressed.
+type logRateLimiter struct {
+	lock       sync.Mutex
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+func (r *logRateLimiter) allow(now time.Time) (allowed bool, suppressed int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.last.IsZero() {
+		r.tokens = kPacketLogBurst
+	} else if elapsed := now.Sub(r.last); elapsed > 0 {
+		r.tokens += elapsed.Seconds() * kPacketLogRate
+		if r.tokens > kPacketLogBurst {
+			r.tokens = kPacketLogBurst
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		r.suppressed++
+		return
+	}
+	r.tokens--
+	allowed = true
+	suppressed = r.suppressed
+	r.suppressed = 0
+	return
+}
+
+// takeSuppressed returns the number of the suppressed messages not reported yet.
+func (r *logRateLimiter) takeSuppressed() (suppressed int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	suppressed = r.suppressed
+	r.suppressed = 0
+	return
+}
+
+// logCategory is the level and the format of a log message,
+// the messages of the same category are "similar" ones, whatever the arguments are.
+type logCategory struct {
+	level  LogLevel
+	format string
+}
+
+// categoryLogLimiter rate-limits the log messages of each logCategory independently,
+// so that a flood of one kind of garbage does not hide the others.
+// The formats must be constants, or the categories grow without bound.
+type categoryLogLimiter struct {
+	lock     sync.RWMutex
+	limiters map[logCategory]*logRateLimiter
+}
+
+func (l *categoryLogLimiter) allow(category logCategory, now time.Time) (allowed bool, suppressed int) {
+	l.lock.RLock()
+	r := l.limiters[category]
+	l.lock.RUnlock()
+	if r == nil {
+		l.lock.Lock()
+		if l.limiters == nil {
+			l.limiters = make(map[logCategory]*logRateLimiter)
+		}
+		r = l.limiters[category]
+		if r == nil {
+			r = &logRateLimiter{}
+			l.limiters[category] = r
+		}
+		l.lock.Unlock()
+	}
+	allowed, suppressed = r.allow(now)
+	return
+}
+
+// takeSuppressed returns the number of the suppressed messages not reported yet of each category.
+func (l *categoryLogLimiter) takeSuppressed() (suppressed map[logCategory]int) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for category, r := range l.limiters {
+		if n := r.takeSuppressed(); n > 0 {
+			if suppressed == nil {
+				suppressed = make(map[logCategory]int)
+			}
+			suppressed[category] = n
+		}
+	}
+	return
+}
+
+// logf logs with the level-specific method of the logger.
+func logf(logger Logger, level LogLevel, format string, args ...interface{}) {
+	switch level {
+	case LogLevelDebug:
+		logger.Debugf(format, args...)
+	case LogLevelInfo:
+		logger.Infof(format, args...)
+	case LogLevelWarn:
+		logger.Warnf(format, args...)
+	default:
+		logger.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,207 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdLogger_Level(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	logger, err := NewLogger("warn", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+
+	out := buf.String()
+	for _, suppressed := range []string{"debug 1", "info 2"} {
+		if strings.Contains(out, suppressed) {
+			t.Errorf("%q should be suppressed, got:\n%s", suppressed, out)
+		}
+	}
+	for _, logged := range []string{"[warn] warn 3", "[error] error 4"} {
+		if !strings.Contains(out, logged) {
+			t.Errorf("%q should be logged, got:\n%s", logged, out)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(LogLevelInfo, &buf)
+
+	peer := &Peer{
+		clientDestination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000},
+		serverDestination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2000},
+		sessionID:         newSessionID(),
+	}
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = logger
+	table.peerLogger(peer).Infof("expire peer %q", "quoted")
+	logger.Debugf("suppressed")
+	logger.Warnf("no fields")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d:\n%s", len(lines), buf.String())
+	}
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("invalid json line %q: %s", lines[0], err.Error())
+	}
+	expected := map[string]string{
+		"level":      "info",
+		"msg":        `expire peer "quoted"`,
+		"peer_id":    peer.clientPublicKey.Base64(),
+		"session_id": peer.sessionID,
+		"src":        "192.0.2.1:1000",
+		"dst":        "192.0.2.2:2000",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, entry[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["ts"]); err != nil {
+		t.Errorf("invalid ts %q: %s", entry["ts"], err.Error())
+	}
+
+	entry = nil
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("invalid json line %q: %s", lines[1], err.Error())
+	}
+	if entry["level"] != "warn" || entry["session_id"] != "" {
+		t.Errorf("unexpected line %q", lines[1])
+	}
+
+	if _, err := NewLogger("", "xml"); err == nil {
+		t.Errorf("NewLogger with log_format \"xml\" should fail")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]LogLevel{
+		"":      LogLevelInfo,
+		"debug": LogLevelDebug,
+		"INFO":  LogLevelInfo,
+		"warn":  LogLevelWarn,
+		"error": LogLevelError,
+	}
+	for s, expected := range cases {
+		level, err := ParseLogLevel(s)
+		if err != nil {
+			t.Errorf("ParseLogLevel(%q): %s", s, err.Error())
+			continue
+		}
+		if level != expected {
+			t.Errorf("ParseLogLevel(%q) = %s, expected %s", s, level, expected)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("ParseLogLevel(\"verbose\") should fail")
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "[debug] "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.lines = append(l.lines, "[info] "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "[warn] "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "[error] "+fmt.Sprintf(format, args...))
+}
+
+func TestWireGuardIndexTranslationTable_LogPacketf(t *testing.T) {
+	logger := &testLogger{}
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = logger
+
+	for i := 0; i < kPacketLogBurst*3; i++ {
+		table.logPacketf(LogLevelWarn, "bad packet %d", i)
+	}
+	// the limiters of each category are independent
+	table.logPacketf(LogLevelWarn, "write error")
+	table.logPacketf(LogLevelDebug, "bad packet %d", 0)
+
+	if len(logger.lines) != kPacketLogBurst+2 {
+		t.Fatalf("expected %d lines, got %d: %v", kPacketLogBurst+2, len(logger.lines), logger.lines)
+	}
+	if logger.lines[kPacketLogBurst] != "[warn] write error" || logger.lines[kPacketLogBurst+1] != "[debug] bad packet 0" {
+		t.Errorf("unexpected lines %q", logger.lines[kPacketLogBurst:])
+	}
+	if suppressed := table.Stats().SuppressedLogs; suppressed != kPacketLogBurst*2 {
+		t.Errorf("expected %d suppressed, got %d", kPacketLogBurst*2, suppressed)
+	}
+
+	logger.lines = nil
+	table.logSuppressedSummary(kPacketLogSummaryInterval)
+	expected := fmt.Sprintf("[warn] suppressed %d similar messages in the last %s: \"bad packet %%d\"", kPacketLogBurst*2, kPacketLogSummaryInterval)
+	if len(logger.lines) != 1 || logger.lines[0] != expected {
+		t.Errorf("expected the summary %q, got %q", expected, logger.lines)
+	}
+	logger.lines = nil
+	table.logSuppressedSummary(kPacketLogSummaryInterval)
+	if len(logger.lines) != 0 {
+		t.Errorf("expected the suppressed messages summarized once, got %q", logger.lines)
+	}
+}
+
+func TestLogRateLimiter(t *testing.T) {
+	var limiter logRateLimiter
+	now := time.Now()
+	for i := 0; i < kPacketLogBurst*2; i++ {
+		allowed, _ := limiter.allow(now)
+		if allowed != (i < kPacketLogBurst) {
+			t.Fatalf("message %d: expected allowed %v", i, i < kPacketLogBurst)
+		}
+	}
+	// a token is refilled in 1/kPacketLogRate second
+	if allowed, _ := limiter.allow(now.Add(time.Second / kPacketLogRate / 2)); allowed {
+		t.Errorf("expected suppressed before a token is refilled")
+	}
+	allowed, suppressed := limiter.allow(now.Add(time.Second / kPacketLogRate))
+	if !allowed || suppressed != kPacketLogBurst+1 {
+		t.Errorf("expected allowed with %d suppressed, got %v, %d", kPacketLogBurst+1, allowed, suppressed)
+	}
+	if allowed, _ = limiter.allow(now.Add(time.Second / kPacketLogRate)); allowed {
+		t.Errorf("expected suppressed after the refilled token is used")
+	}
+	if suppressed = limiter.takeSuppressed(); suppressed != 1 {
+		t.Errorf("expected 1 suppressed not reported, got %d", suppressed)
+	}
+
+	// the bucket is refilled up to the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < kPacketLogBurst; i++ {
+		if allowed, _ = limiter.allow(now); !allowed {
+			t.Fatalf("message %d: expected allowed after a long time", i)
+		}
+	}
+	if allowed, _ = limiter.allow(now); allowed {
+		t.Errorf("expected no more than %d messages at once", kPacketLogBurst)
+	}
+}
@@ -0,0 +1,290 @@
+package mwgp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// metricsServer exposes the Stats in the Prometheus text format.
+type metricsServer struct {
+	listener  net.Listener
+	server    *http.Server
+	statsFunc func() Stats
+	logger    Logger
+}
+
+func newMetricsServer(listen string, logger Logger, statsFunc func() Stats) (ms *metricsServer, err error) {
+	ms = &metricsServer{
+		statsFunc: statsFunc,
+		logger:    logger,
+	}
+	ms.listener, err = net.Listen("tcp", listen)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to listen on metrics addr %s: %w", listen, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", ms.handleMetrics)
+	ms.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return
+}
+
+// Serve serves the metrics until closeChan is closed.
+func (ms *metricsServer) Serve(closeChan <-chan struct{}) {
+	go func() {
+		<-closeChan
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = ms.server.Shutdown(ctx)
+	}()
+	ms.logger.Infof("metrics listen on %s ...", ms.listener.Addr())
+	err := ms.server.Serve(ms.listener)
+	if err != nil && err != http.ErrServerClosed {
+		ms.logger.Errorf("metrics server stopped: %s", err.Error())
+	}
+}
+
+func (ms *metricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := ms.statsFunc()
+
+	var b bytes.Buffer
+	writeMetric := func(name, typ, help string) {
+		_, _ = fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	writeMetric("mwgp_sessions_active", "gauge", "Number of peers in the forward table.")
+	_, _ = fmt.Fprintf(&b, "mwgp_sessions_active %d\n", stats.ActiveSessions)
+	writeMetric("mwgp_sessions_created_total", "counter", "Number of peers created by handshake initiation.")
+	_, _ = fmt.Fprintf(&b, "mwgp_sessions_created_total %d\n", stats.TotalSessionsCreated)
+	writeMetric("mwgp_sessions_expired_total", "counter", "Number of peers removed by timeout.")
+	_, _ = fmt.Fprintf(&b, "mwgp_sessions_expired_total %d\n", stats.SessionsExpired)
+	writeMetric("mwgp_sessions_evicted_total", "counter", "Number of least recently active peers removed since the forward table is full.")
+	_, _ = fmt.Fprintf(&b, "mwgp_sessions_evicted_total %d\n", stats.SessionsEvicted)
+	writeMetric("mwgp_sessions_rejected_total", "counter", "Number of handshake initiations dropped since the forward table is full.")
+	_, _ = fmt.Fprintf(&b, "mwgp_sessions_rejected_total %d\n", stats.SessionsRejected)
+	writeMetric("mwgp_session_events_dropped_total", "counter", "Number of session events not passed to the session hooks since they are too slow.")
+	_, _ = fmt.Fprintf(&b, "mwgp_session_events_dropped_total %d\n", stats.SessionEventsDropped)
+	writeMetric("mwgp_handshakes_rate_limited_total", "counter", "Number of handshake initiations dropped by the per-source-IP rate limit.")
+	_, _ = fmt.Fprintf(&b, "mwgp_handshakes_rate_limited_total %d\n", stats.HandshakesRateLimited)
+	writeMetric("mwgp_denied_client_packets_total", "counter", "Number of handshake initiations dropped by the allowed_clients and denied_clients.")
+	_, _ = fmt.Fprintf(&b, "mwgp_denied_client_packets_total %d\n", stats.DeniedClientPackets)
+	writeMetric("mwgp_denied_source_packets_total", "counter", "Number of packets dropped by the allowed_sources of mwgp-client.")
+	_, _ = fmt.Fprintf(&b, "mwgp_denied_source_packets_total %d\n", stats.DeniedSourcePackets)
+	writeMetric("mwgp_clients_rejected_total", "counter", "Number of handshake initiations from new client addresses dropped by the max_clients.")
+	_, _ = fmt.Fprintf(&b, "mwgp_clients_rejected_total %d\n", stats.ClientsRejected)
+	writeMetric("mwgp_invalid_client_packets_total", "counter", "Number of packets from new clients dropped by the validate_wireguard of mwgp-client.")
+	_, _ = fmt.Fprintf(&b, "mwgp_invalid_client_packets_total %d\n", stats.InvalidClientPackets)
+	writeMetric("mwgp_probe_bans_total", "counter", "Number of times the source IPs are banned for too many invalid packets.")
+	_, _ = fmt.Fprintf(&b, "mwgp_probe_bans_total %d\n", stats.ProbeBans)
+	writeMetric("mwgp_probe_bans_active", "gauge", "Number of the source IPs banned for too many invalid packets.")
+	_, _ = fmt.Fprintf(&b, "mwgp_probe_bans_active %d\n", stats.ProbeBansActive)
+	writeMetric("mwgp_probe_banned_packets_total", "counter", "Number of packets dropped from the banned source IPs.")
+	_, _ = fmt.Fprintf(&b, "mwgp_probe_banned_packets_total %d\n", stats.ProbeBannedPackets)
+	writeMetric("mwgp_filtered_packets_total", "counter", "Number of packets from clients dropped or relayed to the fallback address by the packet filter.")
+	_, _ = fmt.Fprintf(&b, "mwgp_filtered_packets_total %d\n", stats.FilteredPackets)
+	writeMetric("mwgp_fallback_sessions_active", "gauge", "Number of sources relayed to the fallback address.")
+	_, _ = fmt.Fprintf(&b, "mwgp_fallback_sessions_active %d\n", stats.FallbackSessions)
+	writeMetric("mwgp_fallback_packets_total", "counter", "Number of packets relayed between the unrecognized sources and the fallback address.")
+	_, _ = fmt.Fprintf(&b, "mwgp_fallback_packets_total %d\n", stats.FallbackPackets)
+	writeMetric("mwgp_draining", "gauge", "Whether the new sessions are refused for a planned restart.")
+	draining := 0
+	if stats.Draining {
+		draining = 1
+	}
+	_, _ = fmt.Fprintf(&b, "mwgp_draining %d\n", draining)
+	writeMetric("mwgp_handshakes_drained_total", "counter", "Number of handshake initiations of new clients dropped or relayed to the drain_forward address while draining.")
+	_, _ = fmt.Fprintf(&b, "mwgp_handshakes_drained_total %d\n", stats.HandshakesDrained)
+	writeMetric("mwgp_drain_sessions_active", "gauge", "Number of sources relayed to the drain_forward address.")
+	_, _ = fmt.Fprintf(&b, "mwgp_drain_sessions_active %d\n", stats.DrainSessions)
+	writeMetric("mwgp_drain_packets_total", "counter", "Number of packets relayed between the new clients and the drain_forward address.")
+	_, _ = fmt.Fprintf(&b, "mwgp_drain_packets_total %d\n", stats.DrainPackets)
+	writeMetric("mwgp_nat_keepalives_sent_total", "counter", "Number of NAT keepalives sent to mwgp-server.")
+	_, _ = fmt.Fprintf(&b, "mwgp_nat_keepalives_sent_total %d\n", stats.NATKeepalivesSent)
+	writeMetric("mwgp_nat_keepalives_received_total", "counter", "Number of NAT keepalives received from mwgp-client and dropped.")
+	_, _ = fmt.Fprintf(&b, "mwgp_nat_keepalives_received_total %d\n", stats.NATKeepalivesReceived)
+	writeMetric("mwgp_forwarded_packets_total", "counter", "Number of forwarded packets.")
+	_, _ = fmt.Fprintf(&b, "mwgp_forwarded_packets_total %d\n", stats.PacketsForwarded)
+	writeMetric("mwgp_forwarded_bytes_total", "counter", "Number of forwarded bytes.")
+	_, _ = fmt.Fprintf(&b, "mwgp_forwarded_bytes_total %d\n", stats.BytesForwarded)
+	writeMetric("mwgp_dropped_packets_total", "counter", "Number of received packets that are not forwarded.")
+	_, _ = fmt.Fprintf(&b, "mwgp_dropped_packets_total %d\n", stats.DroppedPackets)
+	writeMetric("mwgp_queue_dropped_packets_total", "counter", "Number of non-handshake packets dropped since the relay is saturated.")
+	_, _ = fmt.Fprintf(&b, "mwgp_queue_dropped_packets_total %d\n", stats.QueueDroppedPackets)
+	writeMetric("mwgp_oversized_packets_total", "counter", "Number of received packets dropped since they are larger than the max_packet_size.")
+	_, _ = fmt.Fprintf(&b, "mwgp_oversized_packets_total %d\n", stats.OversizedPackets)
+	if len(stats.Latency) > 0 {
+		writeMetric("mwgp_packet_latency_seconds", "histogram", "Time from reading a sampled packet to writing it.")
+		for _, ls := range stats.Latency {
+			kind := "transport"
+			if ls.Handshake {
+				kind = "handshake"
+			}
+			labels := fmt.Sprintf("direction=%q,type=%q", ls.Direction, kind)
+			var cumulative uint64
+			for _, bucket := range ls.Buckets {
+				cumulative += bucket.Count
+				le := "+Inf"
+				if bucket.UpperBound > 0 {
+					le = strconv.FormatFloat(bucket.UpperBound.Seconds(), 'g', -1, 64)
+				}
+				_, _ = fmt.Fprintf(&b, "mwgp_packet_latency_seconds_bucket{%s,le=%q} %d\n", labels, le, cumulative)
+			}
+			_, _ = fmt.Fprintf(&b, "mwgp_packet_latency_seconds_sum{%s} %g\n", labels, ls.Sum.Seconds())
+			_, _ = fmt.Fprintf(&b, "mwgp_packet_latency_seconds_count{%s} %d\n", labels, ls.Count)
+		}
+	}
+	writeMetric("mwgp_udp_errors_total", "counter", "Number of errors on UDP sockets.")
+	_, _ = fmt.Fprintf(&b, "mwgp_udp_errors_total{op=\"read\"} %d\n", stats.ReadErrors)
+	_, _ = fmt.Fprintf(&b, "mwgp_udp_errors_total{op=\"write\"} %d\n", stats.WriteErrors)
+	writeMetric("mwgp_path_mtu_retries_total", "counter", "Number of times a packet to server is written again with less padding after EMSGSIZE.")
+	_, _ = fmt.Fprintf(&b, "mwgp_path_mtu_retries_total %d\n", stats.PathMTURetries)
+	writeMetric("mwgp_packet_panics_total", "counter", "Number of panics recovered in processing a packet.")
+	_, _ = fmt.Fprintf(&b, "mwgp_packet_panics_total %d\n", stats.PacketPanics)
+	writeMetric("mwgp_bandwidth_limited_packets_total", "counter", "Number of packets dropped by the rate limit.")
+	_, _ = fmt.Fprintf(&b, "mwgp_bandwidth_limited_packets_total %d\n", stats.BandwidthLimitedPackets)
+	writeMetric("mwgp_suppressed_logs_total", "counter", "Number of per-packet log messages suppressed by the rate limit.")
+	_, _ = fmt.Fprintf(&b, "mwgp_suppressed_logs_total %d\n", stats.SuppressedLogs)
+	writeMetric("mwgp_received_packets_total", "counter", "Number of received packets from the obfuscated side.")
+	_, _ = fmt.Fprintf(&b, "mwgp_received_packets_total{obfuscated=\"true\"} %d\n", stats.ObfuscatedPackets)
+	_, _ = fmt.Fprintf(&b, "mwgp_received_packets_total{obfuscated=\"false\"} %d\n", stats.PlainPackets)
+	writeMetric("mwgp_plain_dropped_packets_total", "counter", "Number of non-obfuscated packets dropped in the strict mode.")
+	_, _ = fmt.Fprintf(&b, "mwgp_plain_dropped_packets_total %d\n", stats.PlainDroppedPackets)
+	writeMetric("mwgp_deobfuscate_failures_total", "counter", "Number of packets failed to be deobfuscated.")
+	_, _ = fmt.Fprintf(&b, "mwgp_deobfuscate_failures_total %d\n", stats.DeobfuscateFailures)
+	writeMetric("mwgp_secondary_key_packets_total", "counter", "Number of packets deobfuscated with a secondary obfuscation key.")
+	_, _ = fmt.Fprintf(&b, "mwgp_secondary_key_packets_total %d\n", stats.SecondaryKeyPackets)
+	writeMetric("mwgp_replayed_packets_total", "counter", "Number of replayed handshake packets dropped by the replay filter.")
+	_, _ = fmt.Fprintf(&b, "mwgp_replayed_packets_total %d\n", stats.ReplayedPackets)
+	writeMetric("mwgp_random_errors_total", "counter", "Number of failures of the entropy source.")
+	_, _ = fmt.Fprintf(&b, "mwgp_random_errors_total %d\n", stats.RandomErrors)
+
+	if len(stats.ServerEndpoints) > 0 {
+		writeMetric("mwgp_server_endpoint_active", "gauge", "Whether the server endpoint is the active one.")
+		for _, es := range stats.ServerEndpoints {
+			active := 0
+			if es.Active {
+				active = 1
+			}
+			_, _ = fmt.Fprintf(&b, "mwgp_server_endpoint_active{endpoint=%q} %d\n", es.Address, active)
+		}
+		writeMetric("mwgp_server_endpoint_suspect", "gauge", "Whether the server endpoint has not replied in the failover window.")
+		for _, es := range stats.ServerEndpoints {
+			suspect := 0
+			if es.Suspect {
+				suspect = 1
+			}
+			_, _ = fmt.Fprintf(&b, "mwgp_server_endpoint_suspect{endpoint=%q} %d\n", es.Address, suspect)
+		}
+		writeMetric("mwgp_server_failovers_total", "counter", "Number of times the active server endpoint is switched.")
+		_, _ = fmt.Fprintf(&b, "mwgp_server_failovers_total %d\n", stats.ServerFailovers)
+	}
+
+	if len(stats.Upstreams) > 0 {
+		writeMetric("mwgp_upstream_healthy", "gauge", "Whether the server destination is healthy.")
+		for _, us := range stats.Upstreams {
+			healthy := 0
+			if us.Healthy {
+				healthy = 1
+			}
+			_, _ = fmt.Fprintf(&b, "mwgp_upstream_healthy{upstream=%q} %d\n", us.Address, healthy)
+		}
+		writeMetric("mwgp_upstream_last_reply_timestamp_seconds", "gauge", "Unix time of the last packet received from the server destination.")
+		for _, us := range stats.Upstreams {
+			if !us.LastReply.IsZero() {
+				_, _ = fmt.Fprintf(&b, "mwgp_upstream_last_reply_timestamp_seconds{upstream=%q} %d\n", us.Address, us.LastReply.Unix())
+			}
+		}
+		writeMetric("mwgp_upstream_send_errors", "gauge", "Number of consecutive send errors to the server destination.")
+		for _, us := range stats.Upstreams {
+			_, _ = fmt.Fprintf(&b, "mwgp_upstream_send_errors{upstream=%q} %d\n", us.Address, us.ConsecutiveSendErrors)
+		}
+	}
+
+	if len(stats.PeerForwards) > 0 {
+		peerLabels := func(ps PeerForwardStats) string {
+			peer := ps.ClientPublicKey
+			if peer == "" {
+				peer = "fallback"
+			}
+			return fmt.Sprintf("server=%q,peer=%q", ps.ServerPublicKey, peer)
+		}
+		writeMetric("mwgp_peer_forward_active", "gauge", "Whether the forward target is the active one of the server peer.")
+		for _, ps := range stats.PeerForwards {
+			for _, ts := range ps.Targets {
+				active := 0
+				if ts.Active {
+					active = 1
+				}
+				_, _ = fmt.Fprintf(&b, "mwgp_peer_forward_active{%s,target=%q} %d\n", peerLabels(ps), ts.Address, active)
+			}
+		}
+		writeMetric("mwgp_peer_forward_failovers_total", "counter", "Number of times the active forward target of the server peer is switched.")
+		for _, ps := range stats.PeerForwards {
+			_, _ = fmt.Fprintf(&b, "mwgp_peer_forward_failovers_total{%s} %d\n", peerLabels(ps), ps.Failovers)
+		}
+	}
+
+	if len(stats.Listeners) > 0 {
+		writeMetric("mwgp_listener_packets_total", "counter", "Number of packets received and sent on a listen address.")
+		for _, ls := range stats.Listeners {
+			_, _ = fmt.Fprintf(&b, "mwgp_listener_packets_total{listen=%q,direction=\"received\"} %d\n", ls.Address, ls.PacketsReceived)
+			_, _ = fmt.Fprintf(&b, "mwgp_listener_packets_total{listen=%q,direction=\"sent\"} %d\n", ls.Address, ls.PacketsSent)
+		}
+		writeMetric("mwgp_listener_bytes_total", "counter", "Number of bytes received and sent on a listen address.")
+		for _, ls := range stats.Listeners {
+			_, _ = fmt.Fprintf(&b, "mwgp_listener_bytes_total{listen=%q,direction=\"received\"} %d\n", ls.Address, ls.BytesReceived)
+			_, _ = fmt.Fprintf(&b, "mwgp_listener_bytes_total{listen=%q,direction=\"sent\"} %d\n", ls.Address, ls.BytesSent)
+		}
+	}
+
+	writeMetric("mwgp_peer_packets_total", "counter", "Number of forwarded packets of a peer.")
+	for _, ps := range stats.Peers {
+		labels := peerMetricLabels(&ps)
+		_, _ = fmt.Fprintf(&b, "mwgp_peer_packets_total{%s,direction=\"client_to_server\"} %d\n", labels, ps.ClientToServerPackets)
+		_, _ = fmt.Fprintf(&b, "mwgp_peer_packets_total{%s,direction=\"server_to_client\"} %d\n", labels, ps.ServerToClientPackets)
+	}
+	writeMetric("mwgp_peer_bytes_total", "counter", "Number of forwarded bytes of a peer.")
+	for _, ps := range stats.Peers {
+		labels := peerMetricLabels(&ps)
+		_, _ = fmt.Fprintf(&b, "mwgp_peer_bytes_total{%s,direction=\"client_to_server\"} %d\n", labels, ps.ClientToServerBytes)
+		_, _ = fmt.Fprintf(&b, "mwgp_peer_bytes_total{%s,direction=\"server_to_client\"} %d\n", labels, ps.ServerToClientBytes)
+	}
+	writeMetric("mwgp_peer_bandwidth_limited_packets_total", "counter", "Number of packets of a peer dropped by the rate limit.")
+	for _, ps := range stats.Peers {
+		labels := peerMetricLabels(&ps)
+		_, _ = fmt.Fprintf(&b, "mwgp_peer_bandwidth_limited_packets_total{%s,direction=\"client_to_server\"} %d\n", labels, ps.ClientToServerBandwidthLimited)
+		_, _ = fmt.Fprintf(&b, "mwgp_peer_bandwidth_limited_packets_total{%s,direction=\"server_to_client\"} %d\n", labels, ps.ServerToClientBandwidthLimited)
+	}
+
+	writeMetric("mwgp_account_packets_total", "counter", "Number of forwarded packets of a client public key, kept in the accounting file.")
+	for _, as := range stats.Accounts {
+		_, _ = fmt.Fprintf(&b, "mwgp_account_packets_total{peer=%q,direction=\"client_to_server\"} %d\n", as.ClientPublicKey, as.RxPackets)
+		_, _ = fmt.Fprintf(&b, "mwgp_account_packets_total{peer=%q,direction=\"server_to_client\"} %d\n", as.ClientPublicKey, as.TxPackets)
+	}
+	writeMetric("mwgp_account_bytes_total", "counter", "Number of forwarded bytes of a client public key, kept in the accounting file.")
+	for _, as := range stats.Accounts {
+		_, _ = fmt.Fprintf(&b, "mwgp_account_bytes_total{peer=%q,direction=\"client_to_server\"} %d\n", as.ClientPublicKey, as.RxBytes)
+		_, _ = fmt.Fprintf(&b, "mwgp_account_bytes_total{peer=%q,direction=\"server_to_client\"} %d\n", as.ClientPublicKey, as.TxBytes)
+	}
+	writeMetric("mwgp_account_last_handshake_forwarded_timestamp_seconds", "gauge", "Unix time the last handshake initiation of a client public key is forwarded.")
+	for _, as := range stats.Accounts {
+		if !as.LastHandshakeForwarded.IsZero() {
+			_, _ = fmt.Fprintf(&b, "mwgp_account_last_handshake_forwarded_timestamp_seconds{peer=%q} %d\n", as.ClientPublicKey, as.LastHandshakeForwarded.Unix())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(b.Bytes())
+}
+
+func peerMetricLabels(ps *PeerStats) string {
+	return fmt.Sprintf("peer=%q,peer_id=\"%08x\"", ps.ClientPublicKey, ps.ClientProxyIndex)
+}
@@ -0,0 +1,119 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// NAT Keepalive:
+//
+// With the NATKeepalive, mwgp-client sends a NAT keepalive to a server destination if nothing is sent to it
+// for the interval while any peer is forwarded to it, so that the NAT mapping of the socket is held open
+// even if the persistent keepalive of WireGuard is disabled or longer than the NAT timeout.
+// The peers forwarded to the same server destination share the socket (see upstreamConn),
+// so a single NAT keepalive holds the mapping for all of them.
+//
+// The NAT keepalive is shaped as a MessageTransport to the receiver index 0, which is never a proxy index
+// (see generateProxyIndexLocked), with a random content of a random length like the data packets.
+// It is obfuscated as the data packets, and dropped by mwgp-server without being forwarded.
+//
+//	[0:4]   MessageTransportType
+//	[4:8]   receiver index 0
+//	[8:16]  kNATKeepaliveMagic, in place of the counter
+//	[16:]   random, a multiple of 16 bytes in [16, kNATKeepaliveContentMax]
+
+const (
+	kNATKeepaliveMagic      = 0x616b6e2d7067776d // "mwgp-nka" in little endian
+	kNATKeepaliveContentMax = 16 * 8
+
+	kNATKeepaliveMax = time.Hour
+
+	// kNATKeepaliveChecksPerInterval is how many times the sockets are checked in an interval,
+	// a socket is silent for at most the interval.
+	kNATKeepaliveChecksPerInterval = 4
+	kNATKeepaliveCheckIntervalMin  = 10 * time.Millisecond
+)
+
+// isNATKeepalive reports whether the packet is a NAT keepalive.
+func isNATKeepalive(packet *Packet) bool {
+	if packet.Length < device.MessageTransportSize || packet.MessageType() != device.MessageTransportType {
+		return false
+	}
+	receiverIndex, _ := packet.ReceiverIndex()
+	counter, _ := packet.Counter()
+	return receiverIndex == 0 && counter == kNATKeepaliveMagic
+}
+
+// handleNATKeepalive drops the NAT keepalive received from mwgp-client.
+func (t *WireGuardIndexTranslationTable) handleNATKeepalive(packet *Packet) {
+	atomic.AddUint64(&t.stats.natKeepalivesReceived, 1)
+	t.recyclePacket(packet)
+}
+
+// natKeepaliveLoop sends the NAT keepalives until the table is closed.
+func (t *WireGuardIndexTranslationTable) natKeepaliveLoop() {
+	defer t.loopWaitGroup.Done()
+	t.natKeepaliveRandom.init(nil)
+	checkInterval := t.NATKeepalive / kNATKeepaliveChecksPerInterval
+	if checkInterval < kNATKeepaliveCheckIntervalMin {
+		checkInterval = kNATKeepaliveCheckIntervalMin
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			// sent before the next check if it would be silent for the interval by then
+			t.sendNATKeepalives(now, now.Add(checkInterval-t.NATKeepalive))
+		case <-t.closeChan:
+			return
+		}
+	}
+}
+
+// sendNATKeepalives sends a NAT keepalive to each server destination in use,
+// if nothing is sent to it since the deadline.
+func (t *WireGuardIndexTranslationTable) sendNATKeepalives(now, deadline time.Time) {
+	inUse := make(map[netip.AddrPort]struct{})
+	t.mapLock.RLock()
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		inUse[upstreamKey(peer.serverAddr())] = struct{}{}
+		return true
+	})
+	t.mapLock.RUnlock()
+
+	var idle []*upstreamConn
+	t.upstreamConnsLock.RLock()
+	for key := range inUse {
+		if uc := t.upstreamConns[key]; uc != nil && !uc.lastActiveTime().After(deadline) {
+			idle = append(idle, uc)
+		}
+	}
+	t.upstreamConnsLock.RUnlock()
+
+	for _, uc := range idle {
+		// not sent(), since the NAT keepalive is never replied
+		uc.touch(now)
+		packet := t.obtainPacket()
+		t.marshalNATKeepalive(packet)
+		packet.Destination = net.UDPAddrFromAddrPort(uc.addr)
+		packet.transport = uc.transport
+		packet.upstream = uc
+		if t.sendPacket(t.serverWriteChan, packet) {
+			atomic.AddUint64(&t.stats.natKeepalivesSent, 1)
+		}
+	}
+}
+
+func (t *WireGuardIndexTranslationTable) marshalNATKeepalive(packet *Packet) {
+	contentLength := 16 * (1 + t.natKeepaliveRandom.Intn(kNATKeepaliveContentMax/16))
+	packet.Length = device.MessageTransportHeaderSize + contentLength
+	binary.LittleEndian.PutUint32(packet.Data[0:4], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(packet.Data[4:8], 0)
+	binary.LittleEndian.PutUint64(packet.Data[8:16], kNATKeepaliveMagic)
+	_, _ = t.natKeepaliveRandom.Read(packet.Data[device.MessageTransportHeaderSize:packet.Length])
+}
@@ -0,0 +1,52 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"testing"
+)
+
+func TestNATKeepalive(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.natKeepaliveRandom.init(nil)
+
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("nat keepalive")
+	obfuscator.Padding = &ObfuscatePaddingConfig{MinLength: 128, MaxRandomTail: 64}
+
+	lengths := map[int]bool{}
+	for i := 0; i < 32; i++ {
+		packet := &Packet{Data: make([]byte, device.MaxMessageSize)}
+		table.marshalNATKeepalive(packet)
+		if !isNATKeepalive(packet) {
+			t.Fatalf("expected a NAT keepalive")
+		}
+		if (packet.Length-device.MessageTransportHeaderSize)%16 != 0 || packet.Length < device.MessageTransportSize {
+			t.Fatalf("unexpected length %d", packet.Length)
+		}
+		lengths[packet.Length] = true
+
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		obfuscator.Obfuscate(packet)
+		if isPlainWireGuardHeader(packet.Data) || isNATKeepalive(packet) {
+			t.Fatalf("expected the NAT keepalive to be obfuscated")
+		}
+		packet.Flags = 0
+		obfuscator.Deobfuscate(packet)
+		if packet.Flags&PacketFlagDeobfuscatedAfterReceived == 0 || !isNATKeepalive(packet) {
+			t.Fatalf("expected a NAT keepalive after deobfuscated")
+		}
+	}
+	if len(lengths) < 2 {
+		t.Errorf("expected random lengths, got %v", lengths)
+	}
+
+	// a MessageTransport of a session is never a NAT keepalive
+	packet := &Packet{Data: make([]byte, device.MaxMessageSize), Length: device.MessageTransportSize}
+	binary.LittleEndian.PutUint32(packet.Data[0:4], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(packet.Data[4:8], 0x11223344)
+	binary.LittleEndian.PutUint64(packet.Data[8:16], kNATKeepaliveMagic)
+	if isNATKeepalive(packet) {
+		t.Errorf("expected a MessageTransport to a proxy index not to be a NAT keepalive")
+	}
+}
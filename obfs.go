@@ -1,11 +1,23 @@
 package mwgp
 
 import (
+	"bufio"
+	"crypto/rand"
 	"crypto/sha256"
-	"github.com/cespare/xxhash/v2"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20"
 	"golang.zx2c4.com/wireguard/device"
-	"math/rand"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +35,9 @@ import (
 // A.1c. As for MessageTransport with length < 256,
 //       we generate a 16-bytes random bytes (will be used as nonce), and attach it to the end of message,
 //       and set packet[1] to 0x01.
+// A.1d. If the padding is configured, MessageTransport may also be padded with random bytes,
+//       followed by a 2-bytes trailer of the padding length and a 16-bytes nonce,
+//       and set packet[1] to 0x03. The trailer is obfuscated with the XOR pattern next to the header.
 // A.2.  Use the end 16-bytes of message as nonce to obfuscate the message.
 // A.3.  Generate the XOR patterns to obfuscate the packets with XXHASH64(NONCE+N*USERKEYHASH),
 //       where (N-1) is the index of 8-bytes in the packet data,
@@ -37,13 +52,27 @@ import (
 // B.2.  Use the final 16-bytes of packet data as the nonce.
 // B.3.  Generate the XOR patterns with the same method in the A.3.
 // B.4.  Deobfuscate the first 8-bytes of the packet to find out its message type.
+//       If the message type, flags or packet length is invalid, retry with each secondary key (if any),
+//       so that the key can be rotated without updating all clients at the same time.
+//       The packet length must be at least the fixed message length (or the transport header length) plus the suffix,
+//       the packet is dropped if it is still invalid, so we never read beyond the received data.
+// B.4a. If the replay filter is enabled, drop MessageInitiation, MessageResponse, and MessageCookieReply
+//       with a nonce seen recently. MessageTransport is not checked, WireGuard has its own replay protection for it.
 // B.5a. As for MessageInitiation, MessageResponse, and MessageCookieReply,
 //       set the packet length to its fixed message length, drop the rest data.
 //       if its packet[1] is 0x01, set packet[1] to 0, and drop the MAC2.
 // B.5b. As for MessageTransport,
 //       if its packet[1] is 0x01, set packet[1] to 0, and reduce its length by 16 bytes.
+// B.5c. if its packet[1] is 0x03, also deobfuscate the trailer,
+//       and reduce its length by the padding length and the trailer length.
 // B.6.  Deobfuscate the rest data.
 //
+// D. Authenticated mode
+// D.1.  After A.4, append an 8-bytes tag SIPHASH24(TAGKEY, PACKET) to the obfuscated packet,
+//       where TAGKEY is derived from USERKEYHASH.
+// D.2.  Before B.2, verify and remove the tag, drop the packet silently if the tag mismatched.
+//       The key that verified the tag is used to deobfuscate the packet, no retry in B.4.
+//
 // C. Modified XXHASH64
 // C.1.  Modified XXHASH64 is a patched XXHASH64 function which must returns a pattern that changes original WireGuard protocol.
 //       So the packets of original WireGuard protocol can be distinguished from obfuscated packets.
@@ -53,33 +82,694 @@ const (
 	kObfuscateSuffixAsNonceMinLength = 256
 	kObfuscateNonceLength            = 16
 	kObfuscateXORKeyLength           = 8
+	kObfuscateRandomBufferSize       = 4096
+	kObfuscatePaddingTrailerLength   = 2
+	kObfuscateTagLength              = 8
+
+	// flags in packet[1] of obfuscated packets, interpreted by the message type.
+	// packet[1] is reserved by WireGuard, nothing but the obfuscation writes to it.
+	kObfuscateFlagNonce   = 0x01
+	kObfuscateFlagPadding = 0x02
+	kObfuscateFlagNoMAC2  = 0x01
+
+	// defaultObfuscateKeyMinLength is the min length of the obfuscation keys in bytes,
+	// the shorter keys are rejected unless a lower min length is configured.
+	defaultObfuscateKeyMinLength = 8
+
+	// defaultObfuscatePaddingMaxLength is the max UDP payload size
+	// that does not get fragmented in an IPv6 network with 1500 MTU.
+	defaultObfuscatePaddingMaxLength = 1452
 
 	kMessageInitiationTypeMAC2Offset = 132
 	kMessageResponseTypeMAC2Offset   = 76
 )
 
+// obfuscateRandomSource provides the random bytes used for padding and nonce.
+//
+// It reads from crypto/rand through a buffer, so we don't need a syscall for every packet.
+// If crypto/rand fails, it falls back to a ChaCha20 keystream seeded in init(),
+// which is still unpredictable for anyone who does not know the obfuscation key.
+type obfuscateRandomSource struct {
+	errors   uint64 // keep 64-bit aligned for atomic operations
+	lock     sync.Mutex
+	once     sync.Once
+	reader   *bufio.Reader
+	fallback *chacha20.Cipher
+
+	// intnBuf is read by Intn under the lock, a local buffer would escape to the heap.
+	intnBuf [4]byte
+}
+
+// init seeds the source, only the first call takes effect.
+func (r *obfuscateRandomSource) init(userKeyHash []byte) {
+	r.once.Do(func() {
+		r.doInit(userKeyHash)
+	})
+}
+
+func (r *obfuscateRandomSource) doInit(userKeyHash []byte) {
+	r.reader = bufio.NewReaderSize(rand.Reader, kObfuscateRandomBufferSize)
+
+	var seed [8 + sha256.Size + chacha20.KeySize]byte
+	binary.LittleEndian.PutUint64(seed[:8], uint64(time.Now().UnixNano()))
+	copy(seed[8:], userKeyHash)
+	_, _ = io.ReadFull(rand.Reader, seed[8+sha256.Size:])
+	key := sha256.Sum256(seed[:])
+	var nonce [chacha20.NonceSize]byte
+	r.fallback, _ = chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	zeroBytes(seed[:])
+	zeroBytes(key[:])
+}
+
+func (r *obfuscateRandomSource) Read(b []byte) (n int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n, err = r.readLocked(b)
+	return
+}
+
+func (r *obfuscateRandomSource) readLocked(b []byte) (n int, err error) {
+	n, err = io.ReadFull(r.reader, b)
+	if err != nil {
+		if atomic.AddUint64(&r.errors, 1) == 1 {
+			defaultLogger.Errorf("failed to read from crypto/rand, fallback to chacha20 keystream: %s", err.Error())
+		}
+		for i := range b {
+			b[i] = 0
+		}
+		r.fallback.XORKeyStream(b, b)
+		n, err = len(b), nil
+		r.reader.Reset(rand.Reader)
+	}
+	return
+}
+
+// Intn returns a uniform random number in [0, n).
+func (r *obfuscateRandomSource) Intn(n int) int {
+	limit := uint32(1<<32 - (1<<32)%uint64(n))
+	for {
+		r.lock.Lock()
+		_, _ = r.readLocked(r.intnBuf[:])
+		v := binary.LittleEndian.Uint32(r.intnBuf[:])
+		r.lock.Unlock()
+		if limit == 0 || v < limit {
+			return int(v % uint32(n))
+		}
+	}
+}
+
+// ObfuscatePaddingConfig is the padding policy for MessageTransport packets.
+type ObfuscatePaddingConfig struct {
+	// MinLength pads shorter packets (such as keepalive) up to this length.
+	MinLength int `json:"min_length,omitempty"`
+
+	// MaxRandomTail appends extra random bytes of a random length in [0, MaxRandomTail].
+	MaxRandomTail int `json:"max_random_tail,omitempty"`
+
+	// Probability is the chance for a packet to be padded, in (0, 1].
+	// 0 means all packets will be padded.
+	Probability float64 `json:"probability,omitempty"`
+
+	// MaxLength is the max length of the padded packet, default to 1452.
+	// The padding will be clamped (or skipped) to keep the packet not exceeding this length,
+	// the WireGuard payload will never be truncated.
+	// With the pmtu_discovery of mwgp-client, it is lowered further for the servers of a smaller path MTU,
+	// see "Path MTU Discovery".
+	MaxLength int `json:"max_length,omitempty"`
+}
+
+func (c *ObfuscatePaddingConfig) enabled() bool {
+	return c != nil && (c.MinLength > 0 || c.MaxRandomTail > 0)
+}
+
+// validate checks the obfs_padding, which would otherwise be clamped silently for each packet.
+func (c *ObfuscatePaddingConfig) validate() (errs ConfigErrors) {
+	for _, length := range []struct {
+		option string
+		value  int
+	}{
+		{"min_length", c.MinLength},
+		{"max_random_tail", c.MaxRandomTail},
+		{"max_length", c.MaxLength},
+	} {
+		if length.value < 0 {
+			errs.add(fmt.Errorf("obfs_padding.%s must not be negative", length.option))
+		}
+	}
+	if !(c.Probability >= 0 && c.Probability <= 1) {
+		errs.add(fmt.Errorf("obfs_padding.probability must be in [0, 1], got %v", c.Probability))
+	}
+	return
+}
+
+// WireGuardObfuscator obfuscates and deobfuscates the WireGuard packets.
+//
+// It is safe for concurrent use: Obfuscate, Deobfuscate and the Read/Write wrappers keep the state
+// of a packet on the stack, the key is replaced atomically by SetKey, the random source is locked,
+// and the counters are atomic. So a single obfuscator can be shared by all the read and write loops.
+// The exported fields are not protected, they must be set before the obfuscator is used.
 type WireGuardObfuscator struct {
-	enabled     bool
+	// keep 64-bit aligned for atomic operations
+	stats  obfuscatorStats
+	random obfuscateRandomSource
+
+	// key is the current *obfuscateKey, nil if the obfuscation is disabled.
+	key atomic.Value
+
+	// Padding is the optional padding policy for MessageTransport packets.
+	Padding *ObfuscatePaddingConfig
+
+	// Strict drops non-obfuscated WireGuard packets instead of passing them through,
+	// so that an active prober cannot confirm the WireGuard endpoint behind us.
+	Strict bool
+
+	// ReplayFilter drops the replayed handshake packets if it is not nil.
+	ReplayFilter *ObfuscateReplayFilter
+
+	// Authenticated appends a tag to every obfuscated packet and drops the packets with a wrong tag.
+	// It changes the wire format, so both ends must be configured with the same mode.
+	Authenticated bool
+
+	// Uniform tries every key on each packet instead of stopping at the first match,
+	// see "Uniform Drop" in uniform.go.
+	Uniform bool
+
+	// BlockFunc is called with each packet read before it is deobfuscated if not nil, the packet is dropped
+	// without any further work if it returns true. mwgp-server uses it for the probe_ban.
+	BlockFunc func(packet *Packet) (blocked bool)
+
+	ReadFunc  func(transport PacketTransport, packet *Packet) (err error)
+	WriteFunc func(transport PacketTransport, packet *Packet) (err error)
+
+	ReadBatchFunc  func(transport PacketTransport, packets []*Packet) (n int, err error)
+	WriteBatchFunc func(transport PacketTransport, packets []*Packet) (failed int, err error)
+}
+
+const (
+	kObfuscateKeyPrefixHex    = "hex:"
+	kObfuscateKeyPrefixBase64 = "base64:"
+	kObfuscateKeyPrefixFile   = "file:"
+	kObfuscateKeyPrefixEnv    = "env:"
+)
+
+// ParseObfuscateKey decodes the obfuscation key in the config.
+//
+// Keys prefixed with "file:" or "env:" are read from the file (trailing newlines are trimmed)
+// or the environment variable first, so that the secret can be kept out of the config.
+// Keys prefixed with "hex:" or "base64:" are decoded (surrounding whitespaces are ignored),
+// other keys are used as-is for backward compatibility.
+func ParseObfuscateKey(s string) (key []byte, err error) {
+	s, err = resolveObfuscateKey(s)
+	if err != nil {
+		return
+	}
+	switch {
+	case strings.HasPrefix(s, kObfuscateKeyPrefixHex):
+		key, err = hex.DecodeString(strings.TrimSpace(s[len(kObfuscateKeyPrefixHex):]))
+		if err != nil {
+			var invalidByte hex.InvalidByteError
+			if errors.As(err, &invalidByte) {
+				// the error message contains the invalid byte, which is a part of the key
+				err = fmt.Errorf("invalid hex key: invalid character")
+				return
+			}
+			err = fmt.Errorf("invalid hex key: %w", err)
+			return
+		}
+	case strings.HasPrefix(s, kObfuscateKeyPrefixBase64):
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s[len(kObfuscateKeyPrefixBase64):]))
+		if err != nil {
+			err = fmt.Errorf("invalid base64 key: %w", err)
+			return
+		}
+	default:
+		key = []byte(s)
+		return
+	}
+	if len(key) == 0 {
+		err = fmt.Errorf("empty key after decoding %q", s)
+		return
+	}
+	return
+}
+
+const (
+	ObfuscateModeXOR           = "xor"
+	ObfuscateModeAuthenticated = "authenticated"
+)
+
+// parseObfuscateMode parses the obfs_mode in the config, empty is the same as ObfuscateModeXOR.
+func parseObfuscateMode(mode string) (authenticated bool, err error) {
+	switch mode {
+	case "", ObfuscateModeXOR:
+	case ObfuscateModeAuthenticated:
+		authenticated = true
+	default:
+		err = fmt.Errorf("invalid obfs_mode %q, must be %q or %q", mode, ObfuscateModeXOR, ObfuscateModeAuthenticated)
+	}
+	return
+}
+
+// resolveObfuscateKey returns the content of the file or the environment variable of the "file:" or "env:" key,
+// other keys are returned as-is.
+func resolveObfuscateKey(s string) (resolved string, err error) {
+	switch {
+	case strings.HasPrefix(s, kObfuscateKeyPrefixFile):
+		path := s[len(kObfuscateKeyPrefixFile):]
+		bs, rerr := os.ReadFile(path)
+		if rerr != nil {
+			err = fmt.Errorf("failed to read key file: %w", rerr)
+			return
+		}
+		resolved = strings.TrimRight(string(bs), "\r\n")
+		if resolved == "" {
+			err = fmt.Errorf("key file %s is empty", path)
+			return
+		}
+	case strings.HasPrefix(s, kObfuscateKeyPrefixEnv):
+		name := s[len(kObfuscateKeyPrefixEnv):]
+		var ok bool
+		resolved, ok = os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", name)
+			return
+		}
+		if resolved == "" {
+			err = fmt.Errorf("environment variable %s is empty", name)
+			return
+		}
+	default:
+		resolved = s
+	}
+	return
+}
+
+// checkObfuscateKeyLength rejects the key shorter than the minLength, defaultObfuscateKeyMinLength if it is 0.
+func checkObfuscateKeyLength(key []byte, minLength int) (err error) {
+	if minLength == 0 {
+		minLength = defaultObfuscateKeyMinLength
+	}
+	if len(key) < minLength {
+		err = fmt.Errorf("key is shorter than %d bytes", minLength)
+		return
+	}
+	return
+}
+
+// parseObfuscateKeys parses the primary and secondary obfuscation keys in the config,
+// the non-empty keys shorter than the minLength (obfs_min_key_length) are rejected.
+func parseObfuscateKeys(primary string, secondary []string, minLength int) (key []byte, secondaryKeys [][]byte, err error) {
+	if minLength < 0 {
+		err = fmt.Errorf("obfs_min_key_length must not be negative, got %d", minLength)
+		return
+	}
+	key, err = ParseObfuscateKey(primary)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs: %w", err)
+		return
+	}
+	if len(key) > 0 {
+		err = checkObfuscateKeyLength(key, minLength)
+		if err != nil {
+			err = fmt.Errorf("invalid obfs: %w, set obfs_min_key_length to accept it", err)
+			return
+		}
+	}
+	if len(key) == 0 && len(secondary) > 0 {
+		err = fmt.Errorf("obfs_secondary requires obfs to be set")
+		return
+	}
+	for i, sk := range secondary {
+		var k []byte
+		k, err = ParseObfuscateKey(sk)
+		if err != nil {
+			err = fmt.Errorf("invalid obfs_secondary[%d]: %w", i, err)
+			return
+		}
+		if len(k) == 0 {
+			err = fmt.Errorf("obfs_secondary[%d] is empty", i)
+			return
+		}
+		err = checkObfuscateKeyLength(k, minLength)
+		if err != nil {
+			err = fmt.Errorf("invalid obfs_secondary[%d]: %w, set obfs_min_key_length to accept it", i, err)
+			return
+		}
+		secondaryKeys = append(secondaryKeys, k)
+	}
+	return
+}
+
+// ObfuscatorOption is an option of NewWireGuardObfuscator.
+type ObfuscatorOption func(options *obfuscatorOptions)
+
+type obfuscatorOptions struct {
+	allowDisabled bool
+	minKeyLength  int
+	secondaryKeys []string
+}
+
+// ObfuscatorAllowDisabled accepts an empty key, which disables the obfuscation.
+func ObfuscatorAllowDisabled() ObfuscatorOption {
+	return func(options *obfuscatorOptions) {
+		options.allowDisabled = true
+	}
+}
+
+// ObfuscatorMinKeyLength sets the min length of the keys in bytes, 0 means the default 8 bytes.
+func ObfuscatorMinKeyLength(length int) ObfuscatorOption {
+	return func(options *obfuscatorOptions) {
+		options.minKeyLength = length
+	}
+}
+
+// ObfuscatorSecondaryKeys sets the secondary keys, see SetKey().
+func ObfuscatorSecondaryKeys(keys ...string) ObfuscatorOption {
+	return func(options *obfuscatorOptions) {
+		options.secondaryKeys = append(options.secondaryKeys, keys...)
+	}
+}
+
+// NewWireGuardObfuscator returns the obfuscator with the userKey.
+//
+// Unlike Initialize, an empty userKey is rejected unless ObfuscatorAllowDisabled is set,
+// since it silently disables the obfuscation, and the keys shorter than the ObfuscatorMinKeyLength are rejected.
+func NewWireGuardObfuscator(userKey string, opts ...ObfuscatorOption) (o *WireGuardObfuscator, err error) {
+	var options obfuscatorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.minKeyLength < 0 {
+		err = fmt.Errorf("min key length must not be negative, got %d", options.minKeyLength)
+		return
+	}
+	if userKey == "" {
+		if !options.allowDisabled {
+			err = fmt.Errorf("obfuscation key is empty")
+			return
+		}
+		if len(options.secondaryKeys) > 0 {
+			err = fmt.Errorf("secondary keys require the key to be set")
+			return
+		}
+	} else if err = checkObfuscateKeyLength([]byte(userKey), options.minKeyLength); err != nil {
+		err = fmt.Errorf("invalid obfuscation key: %w", err)
+		return
+	}
+	for i, sk := range options.secondaryKeys {
+		if sk == "" {
+			continue
+		}
+		if err = checkObfuscateKeyLength([]byte(sk), options.minKeyLength); err != nil {
+			err = fmt.Errorf("invalid secondary key %d: %w", i, err)
+			return
+		}
+	}
+	o = &WireGuardObfuscator{}
+	o.Initialize(userKey, options.secondaryKeys...)
+	return
+}
+
+// Initialize sets the obfuscation key, see SetKey() for the secondaryKeys.
+// The key is not checked, use NewWireGuardObfuscator to reject the empty or short keys.
+func (o *WireGuardObfuscator) Initialize(userKey string, secondaryKeys ...string) {
+	key := []byte(userKey)
+	var sks [][]byte
+	for _, sk := range secondaryKeys {
+		sks = append(sks, []byte(sk))
+	}
+	o.InitializeWithKey(key, sks...)
+	zeroObfuscateKeys(key, sks)
+}
+
+// InitializeWithKey sets the obfuscation key, see SetKey() for the secondaryKeys.
+//
+// Unlike SetKey, the previous keys are zeroed, so it must not be called while packets are being processed.
+func (o *WireGuardObfuscator) InitializeWithKey(userKey []byte, secondaryKeys ...[]byte) {
+	old := o.loadKey()
+	o.SetKey(userKey, secondaryKeys...)
+	if old != nil {
+		old.clear()
+	}
+}
+
+// Close disables the obfuscation and zeroes the keys, see "Key Hygiene".
+// It must not be called while packets are being processed,
+// mwgp-server and mwgp-client call it once the Serve() returns.
+func (o *WireGuardObfuscator) Close() {
+	o.InitializeWithKey(nil)
+}
+
+// Key Hygiene:
+//
+// The obfuscation keys are only hashed into the obfuscateUserKey, the keys themselves are never retained,
+// and the keys parsed from the config are zeroed once they are set. The obfuscateUserKey is derived in place
+// and only referenced by pointer, so that the key material is never copied. It is zeroed when the obfuscator is
+// re-initialized or closed, and mwgp-server and mwgp-client close it once they are stopped. The keys replaced by
+// a reload are left to the garbage collector instead, since the packets being processed may still use them.
+// The keys in the config strings cannot be zeroed, which is a limitation of Go.
+//
+// The tags of the authenticated mode and the hashes of the keys are compared in constant time, and nothing derived
+// from the keys except the truncated fingerprint is logged or returned in an error, which is checked by
+// TestKeyHygieneLogging.
+
+// obfuscateKey is immutable once created, so that it can be replaced atomically, until it is zeroed by clear().
+type obfuscateKey struct {
+	obfuscateUserKey
+	secondary []obfuscateUserKey
+}
+
+type obfuscateUserKey struct {
 	userKeyHash [sha256.Size]byte
 
-	ReadFromUDPFunc func(conn *net.UDPConn, packet *Packet) (err error)
-	WriteToUDPFunc  func(conn *net.UDPConn, packet *Packet) (err error)
+	// tagKey is the SipHash key for the authenticated mode.
+	tagKey [2]uint64
+
+	// keystreamWords and keystreamTail are computed from the userKeyHash for the obfuscateKeystream.
+	keystreamWords [4]uint64
+	keystreamTail  [2]uint64
+
+	fingerprint string
 }
 
-func (o *WireGuardObfuscator) Initialize(userKey string) {
+const (
+	kObfuscateTagKeyContext         = "mwgp authenticated obfuscation tag"
+	kObfuscateFingerprintKeyContext = "mwgp obfuscation key fingerprint"
+
+	// kObfuscateKeyFingerprintLength is the length of the key fingerprint in bytes,
+	// it is short enough to be useless except for comparing with another fingerprint.
+	kObfuscateKeyFingerprintLength = 4
+)
+
+// init derives the key in place, so that the key material is never copied, see "Key Hygiene".
+func (k *obfuscateUserKey) init(userKey []byte) {
+	h := sha256.New()
+	h.Write(userKey)
+	h.Sum(k.userKeyHash[:0])
+
+	h.Reset()
+	h.Write([]byte(kObfuscateTagKeyContext))
+	h.Write(k.userKeyHash[:])
+	var tagKey [sha256.Size]byte
+	h.Sum(tagKey[:0])
+	k.tagKey[0] = binary.LittleEndian.Uint64(tagKey[0:8])
+	k.tagKey[1] = binary.LittleEndian.Uint64(tagKey[8:16])
+	zeroBytes(tagKey[:])
+
+	h.Reset()
+	h.Write([]byte(kObfuscateFingerprintKeyContext))
+	h.Write(k.userKeyHash[:])
+	var fingerprint [sha256.Size]byte
+	h.Sum(fingerprint[:0])
+	k.fingerprint = hex.EncodeToString(fingerprint[:kObfuscateKeyFingerprintLength])
+	zeroBytes(fingerprint[:])
+
+	k.initKeystream()
+}
+
+// clear zeroes the key material, the fingerprint is kept since it is logged anyway.
+func (k *obfuscateUserKey) clear() {
+	zeroBytes(k.userKeyHash[:])
+	k.tagKey = [2]uint64{}
+	k.keystreamWords = [4]uint64{}
+	k.keystreamTail = [2]uint64{}
+}
+
+func (k *obfuscateUserKey) tag(b []byte) uint64 {
+	return sipHash24(k.tagKey[0], k.tagKey[1], b)
+}
+
+// verifyTag reports whether the tag matches the data, in constant time.
+func (k *obfuscateUserKey) verifyTag(data []byte, tag []byte) bool {
+	var expected [kObfuscateTagLength]byte
+	binary.LittleEndian.PutUint64(expected[:], k.tag(data))
+	return subtle.ConstantTimeCompare(expected[:], tag) == 1
+}
+
+func (k *obfuscateKey) clear() {
+	k.obfuscateUserKey.clear()
+	for i := range k.secondary {
+		k.secondary[i].clear()
+	}
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// zeroObfuscateKeys zeroes the keys returned by parseObfuscateKeys once they are set to the obfuscator.
+func zeroObfuscateKeys(key []byte, secondaryKeys [][]byte) {
+	zeroBytes(key)
+	for _, sk := range secondaryKeys {
+		zeroBytes(sk)
+	}
+}
+
+// SetKey replaces the key, an empty key disables the obfuscation.
+//
+// Packets are always obfuscated with the userKey. The secondaryKeys are only tried
+// if a packet cannot be deobfuscated with the userKey, which allows the key rotation:
+// add the new key as the primary and the old key as a secondary one,
+// then drop the old key once SecondaryKeyPacketCount() stops increasing.
+// Empty secondaryKeys are ignored.
+//
+// It is safe to be called while packets are being processed,
+// every packet is processed with either the old keys or the new ones.
+// So the old keys are not zeroed but left to the garbage collector, use InitializeWithKey() or Close() to zero them.
+// The userKey and secondaryKeys are not retained, the caller may zero them once it returns.
+func (o *WireGuardObfuscator) SetKey(userKey []byte, secondaryKeys ...[]byte) {
 	if len(userKey) == 0 {
-		o.enabled = false
+		o.key.Store((*obfuscateKey)(nil))
 		return
 	}
-	o.enabled = true
-	rand.Seed(time.Now().Unix())
-	h := sha256.New()
-	h.Write([]byte(userKey))
-	h.Sum(o.userKeyHash[:0])
+	key := &obfuscateKey{}
+	key.obfuscateUserKey.init(userKey)
+	for _, sk := range secondaryKeys {
+		if len(sk) == 0 {
+			continue
+		}
+		key.secondary = append(key.secondary, obfuscateUserKey{})
+		key.secondary[len(key.secondary)-1].init(sk)
+	}
+	o.random.init(key.userKeyHash[:])
+	o.key.Store(key)
+}
+
+// hasKey reports whether the keys are the same as the current ones.
+func (o *WireGuardObfuscator) hasKey(userKey []byte, secondaryKeys ...[]byte) bool {
+	key := o.loadKey()
+	if key == nil || len(userKey) == 0 {
+		return key == nil && len(userKey) == 0
+	}
+	sameHash := func(k []byte, userKey *obfuscateUserKey) bool {
+		hash := sha256.Sum256(k)
+		defer zeroBytes(hash[:])
+		return subtle.ConstantTimeCompare(hash[:], userKey.userKeyHash[:]) == 1
+	}
+	if !sameHash(userKey, &key.obfuscateUserKey) {
+		return false
+	}
+	n := 0
+	for _, sk := range secondaryKeys {
+		if len(sk) == 0 {
+			continue
+		}
+		if n >= len(key.secondary) || !sameHash(sk, &key.secondary[n]) {
+			return false
+		}
+		n++
+	}
+	return n == len(key.secondary)
+}
+
+func (o *WireGuardObfuscator) loadKey() (key *obfuscateKey) {
+	key, _ = o.key.Load().(*obfuscateKey)
+	return
+}
+
+func (o *WireGuardObfuscator) enabled() bool {
+	return o.loadKey() != nil
+}
+
+// KeyFingerprint returns a short fingerprint of the primary key, or an empty string if the obfuscation is disabled.
+// Both ends log it at startup, so mismatched keys are obvious from the logs.
+//
+// The fingerprint is the first 32 bits of a hash derived from the userKeyHash,
+// so it does not expose any bit used by the obfuscation and cannot be reversed.
+// But anyone who reads it can still test guesses of the key offline,
+// a short or dictionary word key should be considered as exposed along with its fingerprint,
+// use a long random key (such as "base64:" with 32 random bytes) if the logs are not private.
+func (o *WireGuardObfuscator) KeyFingerprint() string {
+	key := o.loadKey()
+	if key == nil {
+		return ""
+	}
+	return key.fingerprint
+}
+
+func (o *WireGuardObfuscator) logKeyFingerprints(logger Logger, side string) {
+	key := o.loadKey()
+	if key == nil {
+		logger.Infof("%s obfuscation disabled", side)
+		return
+	}
+	mode := ObfuscateModeXOR
+	if o.Authenticated {
+		mode = ObfuscateModeAuthenticated
+	}
+	var secondary []string
+	for _, sk := range key.secondary {
+		secondary = append(secondary, sk.fingerprint)
+	}
+	if len(secondary) > 0 {
+		logger.Infof("%s obfuscation enabled, mode: %s, key fingerprint: %s, secondary key fingerprints: %s",
+			side, mode, key.fingerprint, strings.Join(secondary, ", "))
+	} else {
+		logger.Infof("%s obfuscation enabled, mode: %s, key fingerprint: %s", side, mode, key.fingerprint)
+	}
+}
+
+// obfuscatorStats is the counters of received packets, all fields must be accessed atomically.
+type obfuscatorStats struct {
+	plainPackets        uint64
+	plainDroppedPackets uint64
+	obfuscatedPackets   uint64
+	deobfuscateFailures uint64
+	secondaryKeyPackets uint64
+	replayedPackets     uint64
+}
+
+// PlainDroppedPacketCount returns how many non-obfuscated packets are dropped in the strict mode.
+func (o *WireGuardObfuscator) PlainDroppedPacketCount() uint64 {
+	return atomic.LoadUint64(&o.stats.plainDroppedPackets)
+}
+
+// SecondaryKeyPacketCount returns how many packets are deobfuscated with a secondary key.
+func (o *WireGuardObfuscator) SecondaryKeyPacketCount() uint64 {
+	return atomic.LoadUint64(&o.stats.secondaryKeyPackets)
+}
+
+func (o *WireGuardObfuscator) fillStats(s *Stats) {
+	s.PlainPackets = atomic.LoadUint64(&o.stats.plainPackets)
+	s.PlainDroppedPackets = atomic.LoadUint64(&o.stats.plainDroppedPackets)
+	s.ObfuscatedPackets = atomic.LoadUint64(&o.stats.obfuscatedPackets)
+	s.DeobfuscateFailures = atomic.LoadUint64(&o.stats.deobfuscateFailures)
+	s.SecondaryKeyPackets = atomic.LoadUint64(&o.stats.secondaryKeyPackets)
+	s.ReplayedPackets = atomic.LoadUint64(&o.stats.replayedPackets)
+	s.RandomErrors = atomic.LoadUint64(&o.random.errors)
+}
+
+// RandomErrorCount returns how many times the entropy source failed
+// and the fallback keystream was used instead.
+func (o *WireGuardObfuscator) RandomErrorCount() uint64 {
+	return atomic.LoadUint64(&o.random.errors)
 }
 
 func (o *WireGuardObfuscator) Obfuscate(packet *Packet) {
-	if !o.enabled {
+	key := o.loadKey()
+	if key == nil {
 		return
 	}
 	if packet.Flags&PacketFlagObfuscateBeforeSend == 0 {
@@ -99,85 +789,258 @@ func (o *WireGuardObfuscator) Obfuscate(packet *Packet) {
 
 	messageType := packet.MessageType()
 	var obfsPartLength int
+	var trailerOffset int
 	switch messageType {
 	case device.MessageInitiationType:
-		packet.Length = device.MessageInitiationSize + kObfuscateNonceLength + rand.Int()%kObfuscateRandomSuffixMaxLength
+		packet.Length = device.MessageInitiationSize + kObfuscateNonceLength + o.randomSuffixLength(packet, device.MessageInitiationSize)
 		obfsPartLength = device.MessageInitiationSize
 		if isAllZero(packet.Data[kMessageInitiationTypeMAC2Offset:device.MessageInitiationSize]) {
-			packet.Data[1] = 0x01
+			packet.Data[1] = kObfuscateFlagNoMAC2
 			obfsPartLength = kMessageInitiationTypeMAC2Offset
 		}
-		_, _ = rand.Read(packet.Data[obfsPartLength:packet.Length])
+		_, _ = o.random.Read(packet.Data[obfsPartLength:packet.Length])
 	case device.MessageResponseType:
-		packet.Length = device.MessageResponseSize + kObfuscateNonceLength + rand.Int()%kObfuscateRandomSuffixMaxLength
+		packet.Length = device.MessageResponseSize + kObfuscateNonceLength + o.randomSuffixLength(packet, device.MessageResponseSize)
 		obfsPartLength = device.MessageResponseSize
 		if isAllZero(packet.Data[kMessageResponseTypeMAC2Offset:device.MessageResponseSize]) {
-			packet.Data[1] = 0x01
+			packet.Data[1] = kObfuscateFlagNoMAC2
 			obfsPartLength = kMessageResponseTypeMAC2Offset
 		}
-		_, _ = rand.Read(packet.Data[obfsPartLength:packet.Length])
+		_, _ = o.random.Read(packet.Data[obfsPartLength:packet.Length])
 	case device.MessageCookieReplyType:
-		packet.Length = device.MessageCookieReplySize + kObfuscateNonceLength + rand.Int()%kObfuscateRandomSuffixMaxLength
+		packet.Length = device.MessageCookieReplySize + kObfuscateNonceLength + o.randomSuffixLength(packet, device.MessageCookieReplySize)
 		obfsPartLength = device.MessageCookieReplySize
-		_, _ = rand.Read(packet.Data[obfsPartLength:packet.Length])
+		_, _ = o.random.Read(packet.Data[obfsPartLength:packet.Length])
 	case device.MessageTransportType:
 		obfsPartLength = device.MessageTransportHeaderSize
-		if packet.Length < kObfuscateSuffixAsNonceMinLength {
-			packet.Data[1] = 0x01
+		paddingLength := o.transportPaddingLength(packet)
+		if paddingLength >= 0 {
+			packet.Data[1] = kObfuscateFlagNonce | kObfuscateFlagPadding
+			trailerOffset = packet.Length + paddingLength
+			_, _ = o.random.Read(packet.Data[packet.Length:trailerOffset])
+			binary.LittleEndian.PutUint16(packet.Data[trailerOffset:], uint16(paddingLength))
+			packet.Length = trailerOffset + kObfuscatePaddingTrailerLength + kObfuscateNonceLength
+			_, _ = o.random.Read(packet.Data[packet.Length-kObfuscateNonceLength : packet.Length])
+		} else if packet.Length < kObfuscateSuffixAsNonceMinLength {
+			packet.Data[1] = kObfuscateFlagNonce
 			packet.Length += kObfuscateNonceLength
-			_, _ = rand.Read(packet.Data[packet.Length-kObfuscateNonceLength : packet.Length])
+			_, _ = o.random.Read(packet.Data[packet.Length-kObfuscateNonceLength : packet.Length])
 		}
 	default:
 		return
 	}
 
-	var nonce [kObfuscateNonceLength]byte
-	copy(nonce[:], packet.Data[packet.Length-kObfuscateNonceLength:])
-
-	var digest xxhash.Digest
-	digest.Reset()
-	_, _ = digest.Write(nonce[:])
+	var keystream obfuscateKeystream
+	keystream.reset(packet.Data[packet.Length-kObfuscateNonceLength:packet.Length], &key.obfuscateUserKey)
 	for i := 0; i < obfsPartLength; i += kObfuscateXORKeyLength {
-		_, _ = digest.Write(o.userKeyHash[:])
-		var xorKey [kObfuscateXORKeyLength]byte
-		digest.Sum(xorKey[:0])
+		pattern := keystream.next()
 		if i == 0 {
-			o.modifyHashMaskForWireGuardHeaderConflict(xorKey[:])
+			pattern = o.modifyHashMaskForWireGuardHeaderConflict(pattern)
 		}
-		for j := i; j < i+kObfuscateXORKeyLength && j < obfsPartLength; j++ {
-			packet.Data[j] ^= xorKey[j-i]
+		end := i + kObfuscateXORKeyLength
+		if end > obfsPartLength {
+			end = obfsPartLength
 		}
+		xorPattern(packet.Data[i:end], pattern)
+	}
+
+	if trailerOffset > 0 {
+		xorPattern(packet.Data[trailerOffset:trailerOffset+kObfuscatePaddingTrailerLength], keystream.next())
+	}
+
+	if o.Authenticated {
+		if packet.Length+kObfuscateTagLength > len(packet.Data) {
+			packet.Flags |= PacketFlagDropped
+			return
+		}
+		binary.LittleEndian.PutUint64(packet.Data[packet.Length:], key.tag(packet.Data[:packet.Length]))
+		packet.Length += kObfuscateTagLength
+	}
+}
+
+// randomSuffixLength returns the length of the random suffix of a handshake packet of the size,
+// clamped to keep the obfuscated packet within the packet.maxLength, see "Path MTU Discovery".
+func (o *WireGuardObfuscator) randomSuffixLength(packet *Packet, size int) (length int) {
+	length = o.random.Intn(kObfuscateRandomSuffixMaxLength)
+	if packet.maxLength <= 0 {
+		return
+	}
+	room := packet.maxLength - size - kObfuscateNonceLength
+	if o.Authenticated {
+		room -= kObfuscateTagLength
+	}
+	if room < 0 {
+		room = 0
 	}
+	if length > room {
+		length = room
+	}
+	return
+}
+
+// paddingOverhead returns the bytes appended to a padded MessageTransport packet besides the padding.
+func (o *WireGuardObfuscator) paddingOverhead() (overhead int) {
+	overhead = kObfuscatePaddingTrailerLength + kObfuscateNonceLength
+	if o.Authenticated {
+		overhead += kObfuscateTagLength
+	}
+	return
+}
+
+// transportPaddingLength decides the padding length for a MessageTransport packet,
+// returns -1 if the packet should not be padded.
+func (o *WireGuardObfuscator) transportPaddingLength(packet *Packet) (length int) {
+	length = -1
+	p := o.Padding
+	if !p.enabled() {
+		return
+	}
+	if p.Probability > 0 && p.Probability < 1 {
+		const precision = 1 << 24
+		if float64(o.random.Intn(precision)) >= p.Probability*precision {
+			return
+		}
+	}
+
+	overhead := o.paddingOverhead()
+	paddingLength := 0
+	if packet.Length+overhead < p.MinLength {
+		paddingLength = p.MinLength - packet.Length - overhead
+	}
+	if p.MaxRandomTail > 0 {
+		paddingLength += o.random.Intn(p.MaxRandomTail + 1)
+	}
+
+	maxLength := p.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultObfuscatePaddingMaxLength
+	}
+	if packet.maxLength > 0 && packet.maxLength < maxLength {
+		maxLength = packet.maxLength
+	}
+	if maxLength > len(packet.Data) {
+		maxLength = len(packet.Data)
+	}
+	if packet.Length+overhead+paddingLength > maxLength {
+		paddingLength = maxLength - packet.Length - overhead
+	}
+	if paddingLength < 0 || paddingLength > 0xffff {
+		return
+	}
+	length = paddingLength
+	return
 }
 
 func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
-	if !o.enabled {
+	key := o.loadKey()
+	if key == nil {
 		return
 	}
 	if packet.Length < device.MinMessageSize {
 		// wtf
+		o.dropUnrecognized(packet)
 		return
 	}
-	if packet.Data[0] >= 1 && packet.Data[0] <= 4 && packet.Data[1] == 0 && packet.Data[2] == 0 && packet.Data[3] == 0 {
+	if isPlainWireGuardPacket(packet) {
 		// non-obfuscated WireGuard packet
+		atomic.AddUint64(&o.stats.plainPackets, 1)
+		if o.Strict {
+			atomic.AddUint64(&o.stats.plainDroppedPackets, 1)
+			packet.Flags |= PacketFlagDropped
+		}
+		return
+	}
+
+	if o.Authenticated {
+		o.deobfuscateAuthenticated(key, packet)
 		return
 	}
 
 	var nonce [kObfuscateNonceLength]byte
 	copy(nonce[:], packet.Data[packet.Length-kObfuscateNonceLength:])
 
-	var digest xxhash.Digest
-	digest.Reset()
-	_, _ = digest.Write(nonce[:])
+	// decode first 8 bytes for message type,
+	// the secondary keys are only tried if the primary one failed, or with Uniform.
+	var keystream obfuscateKeystream
+	var header [kObfuscateXORKeyLength]byte
+	matched := o.decodeHeader(&keystream, nonce[:], &key.obfuscateUserKey, packet, header[:])
+	var secondary bool
+	for i := range key.secondary {
+		if matched && !o.Uniform {
+			break
+		}
+		var secondaryKeystream obfuscateKeystream
+		var secondaryHeader [kObfuscateXORKeyLength]byte
+		if o.decodeHeader(&secondaryKeystream, nonce[:], &key.secondary[i], packet, secondaryHeader[:]) && !matched {
+			matched, secondary = true, true
+			keystream, header = secondaryKeystream, secondaryHeader
+		}
+	}
+	if !matched {
+		// wtf?
+		o.dropUnrecognized(packet)
+		return
+	}
+	if secondary {
+		atomic.AddUint64(&o.stats.secondaryKeyPackets, 1)
+	}
+	o.deobfuscateWithHeader(&keystream, nonce, header, packet)
+}
+
+// deobfuscateAuthenticated verifies and removes the tag, then deobfuscates the packet with the key verified the tag.
+// The packet is dropped if the tag is mismatched with all keys or the header is invalid.
+func (o *WireGuardObfuscator) deobfuscateAuthenticated(key *obfuscateKey, packet *Packet) {
+	if packet.Length < device.MinMessageSize+kObfuscateNonceLength+kObfuscateTagLength {
+		o.dropUnrecognized(packet)
+		return
+	}
+	tagOffset := packet.Length - kObfuscateTagLength
+	tag := packet.Data[tagOffset:packet.Length]
+	// the secondary keys are only tried if the primary one failed, or with Uniform.
+	var userKey *obfuscateUserKey
+	if key.obfuscateUserKey.verifyTag(packet.Data[:tagOffset], tag) {
+		userKey = &key.obfuscateUserKey
+	}
+	var secondary bool
+	for i := range key.secondary {
+		if userKey != nil && !o.Uniform {
+			break
+		}
+		if key.secondary[i].verifyTag(packet.Data[:tagOffset], tag) && userKey == nil {
+			userKey, secondary = &key.secondary[i], true
+		}
+	}
+	if userKey == nil {
+		o.dropUnrecognized(packet)
+		return
+	}
+	if secondary {
+		atomic.AddUint64(&o.stats.secondaryKeyPackets, 1)
+	}
+	packet.Length = tagOffset
 
-	// decode first 8 bytes for message type
-	_, _ = digest.Write(o.userKeyHash[:])
-	var xorKey [kObfuscateXORKeyLength]byte
-	digest.Sum(xorKey[:0])
-	o.modifyHashMaskForWireGuardHeaderConflict(xorKey[:])
-	for i := 0; i < kObfuscateXORKeyLength; i++ {
-		packet.Data[i] ^= xorKey[i]
+	var nonce [kObfuscateNonceLength]byte
+	copy(nonce[:], packet.Data[packet.Length-kObfuscateNonceLength:])
+	var keystream obfuscateKeystream
+	var header [kObfuscateXORKeyLength]byte
+	if !o.decodeHeader(&keystream, nonce[:], userKey, packet, header[:]) {
+		o.dropDeobfuscateFailure(packet)
+		return
 	}
+	o.deobfuscateWithHeader(&keystream, nonce, header, packet)
+}
+
+// deobfuscateWithHeader deobfuscates the rest of the packet after the header is decoded by decodeHeader().
+func (o *WireGuardObfuscator) deobfuscateWithHeader(keystream *obfuscateKeystream,
+	nonce [kObfuscateNonceLength]byte, header [kObfuscateXORKeyLength]byte, packet *Packet) {
+	if o.ReplayFilter != nil && header[0] != device.MessageTransportType {
+		if o.ReplayFilter.Check(nonce, time.Now()) {
+			atomic.AddUint64(&o.stats.replayedPackets, 1)
+			packet.Flags |= PacketFlagDropped
+			return
+		}
+	}
+	copy(packet.Data, header[:])
 
 	memset := func(b []byte, c byte) {
 		for i := range b {
@@ -187,20 +1050,21 @@ func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
 
 	messageType := packet.MessageType()
 	var obfsPartLength int
+	var padded bool
 	switch messageType {
 	case device.MessageInitiationType:
 		packet.Length = device.MessageInitiationSize
 		obfsPartLength = device.MessageInitiationSize
-		if packet.Data[1] == 0x01 {
-			packet.Data[1] = 0
+		if packet.ReservedByte(1) == kObfuscateFlagNoMAC2 {
+			_ = packet.SetReservedByte(1, 0)
 			obfsPartLength = kMessageInitiationTypeMAC2Offset
 			memset(packet.Data[kMessageInitiationTypeMAC2Offset:device.MessageInitiationSize], 0)
 		}
 	case device.MessageResponseType:
 		packet.Length = device.MessageResponseSize
 		obfsPartLength = device.MessageResponseSize
-		if packet.Data[1] == 0x01 {
-			packet.Data[1] = 0
+		if packet.ReservedByte(1) == kObfuscateFlagNoMAC2 {
+			_ = packet.SetReservedByte(1, 0)
 			obfsPartLength = kMessageResponseTypeMAC2Offset
 			memset(packet.Data[kMessageResponseTypeMAC2Offset:device.MessageResponseSize], 0)
 		}
@@ -209,54 +1073,211 @@ func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
 		obfsPartLength = device.MessageCookieReplySize
 	case device.MessageTransportType:
 		obfsPartLength = device.MessageTransportHeaderSize
-		if packet.Data[1] == 0x01 {
-			packet.Data[1] = 0
+		if flags := packet.ReservedByte(1); flags&kObfuscateFlagNonce != 0 {
+			padded = flags&kObfuscateFlagPadding != 0
+			_ = packet.SetReservedByte(1, 0)
 			packet.Length -= kObfuscateNonceLength
 		}
-	default:
-		// wtf?
-		return
 	}
 
 	// decode the rest
 	for i := kObfuscateXORKeyLength; i < obfsPartLength; i += kObfuscateXORKeyLength {
-		_, _ = digest.Write(o.userKeyHash[:])
-		digest.Sum(xorKey[:0])
-		for j := i; j < i+kObfuscateXORKeyLength && j < obfsPartLength; j++ {
-			packet.Data[j] ^= xorKey[j-i]
+		end := i + kObfuscateXORKeyLength
+		if end > obfsPartLength {
+			end = obfsPartLength
 		}
+		xorPattern(packet.Data[i:end], keystream.next())
 	}
 
+	if padded {
+		trailerOffset := packet.Length - kObfuscatePaddingTrailerLength
+		if trailerOffset < device.MessageTransportSize {
+			// wtf?
+			o.dropDeobfuscateFailure(packet)
+			return
+		}
+		xorPattern(packet.Data[trailerOffset:trailerOffset+kObfuscatePaddingTrailerLength], keystream.next())
+		paddingLength := int(binary.LittleEndian.Uint16(packet.Data[trailerOffset:]))
+		if trailerOffset-paddingLength < device.MessageTransportSize {
+			// wtf?
+			o.dropDeobfuscateFailure(packet)
+			return
+		}
+		packet.Length = trailerOffset - paddingLength
+	}
+
+	atomic.AddUint64(&o.stats.obfuscatedPackets, 1)
 	packet.Flags |= PacketFlagDeobfuscatedAfterReceived
 }
 
-func (o *WireGuardObfuscator) WriteToUDPWithObfuscate(conn *net.UDPConn, packet *Packet) (err error) {
+// dropUnrecognized drops the packet that is neither obfuscated with any key nor a plain WireGuard packet,
+// it must be called before the packet is modified, so that it can be forwarded verbatim to the fallback.
+func (o *WireGuardObfuscator) dropUnrecognized(packet *Packet) {
+	o.dropDeobfuscateFailure(packet)
+	packet.Flags |= PacketFlagUnrecognized
+}
+
+// dropDeobfuscateFailure drops the packet that cannot be deobfuscated,
+// the packet must not be forwarded since its length and content are not trustworthy.
+func (o *WireGuardObfuscator) dropDeobfuscateFailure(packet *Packet) {
+	atomic.AddUint64(&o.stats.deobfuscateFailures, 1)
+	packet.Flags |= PacketFlagDropped | PacketFlagInvalid
+}
+
+// deobfuscateReceived deobfuscates the packet just read unless it is blocked by the BlockFunc.
+func (o *WireGuardObfuscator) deobfuscateReceived(packet *Packet) {
+	packet.receivedLength = packet.Length
+	if packet.isOversized() {
+		// dropped by the table
+		packet.Flags |= PacketFlagDropped
+		return
+	}
+	if o.BlockFunc != nil && o.BlockFunc(packet) {
+		packet.Flags |= PacketFlagDropped | PacketFlagBlocked
+		return
+	}
+	o.Deobfuscate(packet)
+}
+
+// decodeHeader decodes the first 8 bytes of the packet with the userKey into the header
+// and reports whether it is a valid obfuscated WireGuard packet.
+// The packet is not modified, and the keystream is left ready for decoding the rest.
+func (o *WireGuardObfuscator) decodeHeader(keystream *obfuscateKeystream, nonce []byte, userKey *obfuscateUserKey, packet *Packet, header []byte) bool {
+	keystream.reset(nonce, userKey)
+	copy(header, packet.Data[:kObfuscateXORKeyLength])
+	xorPattern(header, o.modifyHashMaskForWireGuardHeaderConflict(keystream.next()))
+	return isValidDeobfuscatedHeader(header, packet.Length)
+}
+
+// isValidDeobfuscatedHeader checks the message type and the flags in the deobfuscated header,
+// and whether the obfuscated packet is long enough for that message type.
+func isValidDeobfuscatedHeader(header []byte, length int) bool {
+	if header[2] != 0 || header[3] != 0 {
+		return false
+	}
+	switch header[0] {
+	case device.MessageInitiationType:
+		return header[1]&^kObfuscateFlagNoMAC2 == 0 && length >= device.MessageInitiationSize+kObfuscateNonceLength
+	case device.MessageResponseType:
+		return header[1]&^kObfuscateFlagNoMAC2 == 0 && length >= device.MessageResponseSize+kObfuscateNonceLength
+	case device.MessageCookieReplyType:
+		return header[1] == 0 && length >= device.MessageCookieReplySize+kObfuscateNonceLength
+	case device.MessageTransportType:
+		switch header[1] {
+		case 0:
+			return length >= device.MessageTransportSize
+		case kObfuscateFlagNonce:
+			return length >= device.MessageTransportSize+kObfuscateNonceLength
+		case kObfuscateFlagNonce | kObfuscateFlagPadding:
+			return length >= device.MessageTransportSize+kObfuscatePaddingTrailerLength+kObfuscateNonceLength
+		}
+	}
+	return false
+}
+
+// errObfuscatePacketTooLarge is returned if there is no room for the tag in the authenticated mode.
+var errObfuscatePacketTooLarge = newError(ErrProtocol, "packet is too large to be obfuscated, lower the MTU of WireGuard")
+
+func (o *WireGuardObfuscator) WritePacketWithObfuscate(transport PacketTransport, packet *Packet) (err error) {
 	o.Obfuscate(packet)
-	if o.WriteToUDPFunc == nil {
-		o.WriteToUDPFunc = defaultWriteToUDPFunc
+	if packet.Flags&PacketFlagDropped != 0 {
+		err = errObfuscatePacketTooLarge
+		return
+	}
+	writeFunc := o.WriteFunc
+	if writeFunc == nil {
+		writeFunc = defaultWriteFunc
 	}
-	err = o.WriteToUDPFunc(conn, packet)
+	err = writeFunc(transport, packet)
 	if err != nil {
 		return
 	}
 	return
 }
 
-func (o *WireGuardObfuscator) ReadFromUDPWithDeobfuscate(conn *net.UDPConn, packet *Packet) (err error) {
-	if o.ReadFromUDPFunc == nil {
-		o.ReadFromUDPFunc = defaultReadFromUDPFunc
+func (o *WireGuardObfuscator) ReadPacketWithDeobfuscate(transport PacketTransport, packet *Packet) (err error) {
+	readFunc := o.ReadFunc
+	if readFunc == nil {
+		readFunc = defaultReadFunc
 	}
-	err = o.ReadFromUDPFunc(conn, packet)
+	err = readFunc(transport, packet)
 	if err != nil {
 		return
 	}
-	o.Deobfuscate(packet)
+	o.deobfuscateReceived(packet)
 	return
 }
 
-func (o *WireGuardObfuscator) modifyHashMaskForWireGuardHeaderConflict(b []byte) {
-	if b[0]&0b11111000 == 0 && b[1]&0b11111110 == 0 {
-		b[0] |= 0b11010111
-		b[1] |= 0b01101001
+func (o *WireGuardObfuscator) WriteBatchWithObfuscate(transport PacketTransport, packets []*Packet) (failed int, err error) {
+	// move the dropped packets to the end, they are still recycled by the caller
+	n := 0
+	for i, packet := range packets {
+		o.Obfuscate(packet)
+		if packet.Flags&PacketFlagDropped != 0 {
+			continue
+		}
+		packets[n], packets[i] = packets[i], packets[n]
+		n++
+	}
+	writeBatchFunc := o.WriteBatchFunc
+	if writeBatchFunc == nil {
+		writeBatchFunc = defaultWriteBatchFunc
+	}
+	if n > 0 {
+		failed, err = writeBatchFunc(transport, packets[:n])
+	}
+	if n < len(packets) {
+		for _, packet := range packets[n:] {
+			packet.writeFailed = true
+		}
+		failed += len(packets) - n
+		if err == nil {
+			err = errObfuscatePacketTooLarge
+		}
+	}
+	return
+}
+
+func (o *WireGuardObfuscator) ReadBatchWithDeobfuscate(transport PacketTransport, packets []*Packet) (n int, err error) {
+	readBatchFunc := o.ReadBatchFunc
+	if readBatchFunc == nil {
+		readBatchFunc = defaultReadBatchFunc
+	}
+	n, err = readBatchFunc(transport, packets)
+	if err != nil {
+		return
+	}
+	for _, packet := range packets[:n] {
+		o.deobfuscateReceived(packet)
+	}
+	return
+}
+
+// Deprecated: use WritePacketWithObfuscate instead.
+func (o *WireGuardObfuscator) WriteToUDPWithObfuscate(conn *net.UDPConn, packet *Packet) (err error) {
+	return o.WritePacketWithObfuscate(NewUDPTransport(conn), packet)
+}
+
+// Deprecated: use ReadPacketWithDeobfuscate instead.
+func (o *WireGuardObfuscator) ReadFromUDPWithDeobfuscate(conn *net.UDPConn, packet *Packet) (err error) {
+	return o.ReadPacketWithDeobfuscate(NewUDPTransport(conn), packet)
+}
+
+// Deprecated: use WriteBatchWithObfuscate instead.
+func (o *WireGuardObfuscator) WriteBatchToUDPWithObfuscate(conn *net.UDPConn, packets []*Packet) (failed int, err error) {
+	return o.WriteBatchWithObfuscate(NewUDPTransport(conn), packets)
+}
+
+// Deprecated: use ReadBatchWithDeobfuscate instead.
+func (o *WireGuardObfuscator) ReadBatchFromUDPWithDeobfuscate(conn *net.UDPConn, packets []*Packet) (n int, err error) {
+	return o.ReadBatchWithDeobfuscate(NewUDPTransport(conn), packets)
+}
+
+// modifyHashMaskForWireGuardHeaderConflict returns the first pattern modified (see C.1),
+// the first 2 bytes are the top 16 bits.
+func (o *WireGuardObfuscator) modifyHashMaskForWireGuardHeaderConflict(pattern uint64) uint64 {
+	if pattern>>56&0b11111000 == 0 && pattern>>48&0b11111110 == 0 {
+		pattern |= 0b11010111<<56 | 0b01101001<<48
 	}
+	return pattern
 }
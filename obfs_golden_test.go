@@ -0,0 +1,96 @@
+package mwgp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// kObfuscateGoldenFile has the vectors of the obfuscated wire format of ObfuscateProtocolVersion.
+// They must never be changed unless the ObfuscateProtocolVersion is bumped.
+const kObfuscateGoldenFile = "testdata/obfs_golden.json"
+
+type obfuscateGoldenVector struct {
+	Name          string                  `json:"name"`
+	Key           string                  `json:"key"`
+	Authenticated bool                    `json:"authenticated,omitempty"`
+	Padding       *ObfuscatePaddingConfig `json:"padding,omitempty"`
+
+	// Random is repeated as the random source of the nonce and the padding, zeros if empty.
+	Random string `json:"random,omitempty"`
+
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// cyclicReader makes the nonces and the padding of the obfuscator deterministic.
+type cyclicReader struct {
+	b []byte
+	i int
+}
+
+func (r *cyclicReader) Read(b []byte) (n int, err error) {
+	for n = range b {
+		if len(r.b) == 0 {
+			b[n] = 0
+			continue
+		}
+		b[n] = r.b[r.i%len(r.b)]
+		r.i++
+	}
+	n = len(b)
+	return
+}
+
+// newGoldenObfuscator returns the obfuscator of the vector with the deterministic random source.
+func newGoldenObfuscator(t *testing.T, v *obfuscateGoldenVector) (obfuscator *WireGuardObfuscator) {
+	random, err := hex.DecodeString(v.Random)
+	if err != nil {
+		t.Fatalf("%s: invalid random: %s", v.Name, err)
+	}
+	obfuscator = &WireGuardObfuscator{}
+	obfuscator.random.once.Do(func() {
+		obfuscator.random.reader = bufio.NewReader(&cyclicReader{b: random})
+	})
+	obfuscator.Authenticated = v.Authenticated
+	obfuscator.Padding = v.Padding
+	obfuscator.Initialize(v.Key)
+	return
+}
+
+func TestWireGuardObfuscator_Golden(t *testing.T) {
+	bs, err := os.ReadFile(kObfuscateGoldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []obfuscateGoldenVector
+	if err = json.Unmarshal(bs, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for i := range vectors {
+		v := &vectors[i]
+		input, ierr := hex.DecodeString(v.Input)
+		output, oerr := hex.DecodeString(v.Output)
+		if ierr != nil || oerr != nil {
+			t.Fatalf("%s: invalid input or output", v.Name)
+		}
+
+		obfuscator := newGoldenObfuscator(t, v)
+		p := Packet{Data: make([]byte, defaultMaxPacketSize), Flags: PacketFlagObfuscateBeforeSend}
+		p.Length = copy(p.Data, input)
+		obfuscator.Obfuscate(&p)
+		if !bytes.Equal(p.Data[:p.Length], output) {
+			t.Errorf("%s: obfuscated packet mismatched\nexpected %x\ngot      %x", v.Name, output, p.Data[:p.Length])
+		}
+
+		p = Packet{Data: make([]byte, defaultMaxPacketSize)}
+		p.Length = copy(p.Data, output)
+		obfuscator.Deobfuscate(&p)
+		if p.Flags&PacketFlagDropped != 0 || !bytes.Equal(p.Data[:p.Length], input) {
+			t.Errorf("%s: deobfuscated packet mismatched\nexpected %x\ngot      %x", v.Name, input, p.Data[:p.Length])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package mwgp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+)
+
+// kObfuscateGeneratedKeyLength is the length of the keys from GenerateObfuscationKey, as `wg genpsk`.
+const kObfuscateGeneratedKeyLength = 32
+
+// kObfuscateKeyMinEntropyBits is the estimated entropy below which a key is considered weak.
+const kObfuscateKeyMinEntropyBits = 48
+
+// GenerateObfuscationKey returns a new random key of 32 bytes, encoded as "base64:..."
+// so that it is decoded to the same bytes by ParseObfuscateKey.
+func GenerateObfuscationKey() (key string, err error) {
+	var b [kObfuscateGeneratedKeyLength]byte
+	_, err = rand.Read(b[:])
+	if err != nil {
+		err = errorf(ErrCrypto, "failed to generate key: %w", err)
+		return
+	}
+	key = kObfuscateKeyPrefixBase64 + base64.StdEncoding.EncodeToString(b[:])
+	return
+}
+
+// ValidateObfuscationKey parses the key as ParseObfuscateKey, and returns an error
+// if it is weak (see estimateObfuscateKeyEntropy). An empty key (disabled) is not weak.
+func ValidateObfuscationKey(s string) (err error) {
+	key, err := ParseObfuscateKey(s)
+	if err != nil {
+		return
+	}
+	err = validateObfuscateKey(key)
+	return
+}
+
+func validateObfuscateKey(key []byte) (err error) {
+	if len(key) == 0 {
+		return
+	}
+	bits := estimateObfuscateKeyEntropy(key)
+	if bits < kObfuscateKeyMinEntropyBits {
+		err = fmt.Errorf("key is weak (about %d bits of entropy, at least %d bits are recommended), "+
+			"use `mwgp genkey` to generate a strong one", int(bits), kObfuscateKeyMinEntropyBits)
+		return
+	}
+	return
+}
+
+// estimateObfuscateKeyEntropy roughly estimates the entropy of the key in bits,
+// as each byte is chosen from the character classes (lower, upper, digit, other printable, or any byte)
+// found in the key, but no more than the distinct bytes of the key.
+//
+// It is only meant to catch the obviously weak keys, such as "password" or "aaaaaaaaaaaa".
+func estimateObfuscateKeyEntropy(key []byte) (bits float64) {
+	var lower, upper, digit, punct, binary bool
+	var seen [256]bool
+	distinct := 0
+	for _, c := range key {
+		if !seen[c] {
+			seen[c] = true
+			distinct++
+		}
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c >= 0x20 && c < 0x7f:
+			punct = true
+		default:
+			binary = true
+		}
+	}
+	pool := 0
+	if binary {
+		pool = 256
+	} else {
+		for _, class := range []struct {
+			found bool
+			size  int
+		}{{lower, 26}, {upper, 26}, {digit, 10}, {punct, 33}} {
+			if class.found {
+				pool += class.size
+			}
+		}
+	}
+	if distinct < pool {
+		pool = distinct
+	}
+	if pool <= 1 {
+		return
+	}
+	bits = float64(len(key)) * math.Log2(float64(pool))
+	return
+}
+
+// warnWeakObfuscateKeys logs a warning for each weak key in the config.
+func warnWeakObfuscateKeys(logger Logger, key []byte, secondaryKeys [][]byte) {
+	if err := validateObfuscateKey(key); err != nil {
+		logger.Warnf("obfs: %s", err.Error())
+	}
+	for i, sk := range secondaryKeys {
+		if err := validateObfuscateKey(sk); err != nil {
+			logger.Warnf("obfs_secondary[%d]: %s", i, err.Error())
+		}
+	}
+}
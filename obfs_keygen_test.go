@@ -0,0 +1,61 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestGenerateObfuscationKey(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		encoded, err := GenerateObfuscationKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[encoded] {
+			t.Fatalf("key %s is generated twice", encoded)
+		}
+		seen[encoded] = true
+		key, err := ParseObfuscateKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != kObfuscateGeneratedKeyLength {
+			t.Fatalf("expected a key of %d bytes, got %d bytes", kObfuscateGeneratedKeyLength, len(key))
+		}
+		for _, reencoded := range []string{
+			"hex:" + hex.EncodeToString(key),
+			"base64:" + base64.StdEncoding.EncodeToString(key),
+		} {
+			k, err := ParseObfuscateKey(reencoded)
+			if err != nil || !bytes.Equal(k, key) {
+				t.Errorf("key %s is not the same as %s: %v", reencoded, encoded, err)
+			}
+		}
+		// the encoded string is a valid plain key as well, but never the same key
+		if bytes.Equal([]byte(encoded), key) {
+			t.Errorf("key %s is ambiguous", encoded)
+		}
+		if err = ValidateObfuscationKey(encoded); err != nil {
+			t.Errorf("generated key %s is weak: %s", encoded, err)
+		}
+	}
+}
+
+func TestValidateObfuscationKey(t *testing.T) {
+	for _, key := range []string{"password", "aaaaaaaaaaaaaaaaaaaaaaaa", "12345678", "hex:0000000000000000"} {
+		if err := ValidateObfuscationKey(key); err == nil {
+			t.Errorf("expected key %q to be weak", key)
+		}
+	}
+	for _, key := range []string{"", "correct horse battery staple", "hex:8f3a91c2d4e5b6a7f8091a2b3c4d5e6f", "Tr0ub4dor&3xyzQ!"} {
+		if err := ValidateObfuscationKey(key); err != nil {
+			t.Errorf("expected key %q not to be weak: %s", key, err)
+		}
+	}
+	if err := ValidateObfuscationKey("hex:xyz"); err == nil {
+		t.Errorf("expected an invalid key to be rejected")
+	}
+}
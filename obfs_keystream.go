@@ -0,0 +1,109 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// obfuscateKeystream generates the XOR patterns XXHASH64(NONCE+N*USERKEYHASH) of a packet (see A.3 in obfs.go),
+// with the patterns in big endian as the bytes of xxhash.Digest.Sum().
+//
+// It is the XXHASH64 specialized for the input, with the identical output. The NONCE (16 bytes)
+// and the USERKEYHASH (32 bytes) are always split into the same 32-bytes stripes:
+//
+//	NONCE[0:16] + USERKEYHASH[0:16], then USERKEYHASH[16:32] + USERKEYHASH[0:16] for each next pattern
+//
+// with USERKEYHASH[16:32] left as the tail. So the words of the USERKEYHASH and the rounds of the tail
+// are computed once per key (see obfuscateUserKey), only a stripe is processed for each next pattern,
+// and no bytes are copied into a buffer as xxhash.Digest.Write() does.
+type obfuscateKeystream struct {
+	key            *obfuscateUserKey
+	v1, v2, v3, v4 uint64
+	total          uint64
+}
+
+const (
+	kXXHashPrime1 uint64 = 11400714785074694791
+	kXXHashPrime2 uint64 = 14029467366897019727
+	kXXHashPrime3 uint64 = 1609587929392839161
+	kXXHashPrime4 uint64 = 9650029242287828579
+)
+
+// kObfuscateKeystreamFirstTotal is the length of the NONCE and the first USERKEYHASH.
+const kObfuscateKeystreamFirstTotal = kObfuscateNonceLength + 32
+
+func xxhashRound(acc, input uint64) uint64 {
+	acc += input * kXXHashPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	acc *= kXXHashPrime1
+	return acc
+}
+
+func xxhashMergeRound(acc, val uint64) uint64 {
+	val = xxhashRound(0, val)
+	acc ^= val
+	acc = acc*kXXHashPrime1 + kXXHashPrime4
+	return acc
+}
+
+// initKeystream computes the words of the userKeyHash for the obfuscateKeystream.
+func (k *obfuscateUserKey) initKeystream() {
+	for i := range k.keystreamWords {
+		k.keystreamWords[i] = binary.LittleEndian.Uint64(k.userKeyHash[8*i:])
+	}
+	k.keystreamTail[0] = xxhashRound(0, k.keystreamWords[2])
+	k.keystreamTail[1] = xxhashRound(0, k.keystreamWords[3])
+}
+
+// reset starts the patterns of the 16-bytes nonce, the nonce can be modified after it.
+func (ks *obfuscateKeystream) reset(nonce []byte, key *obfuscateUserKey) {
+	prime1 := kXXHashPrime1
+	ks.key = key
+	ks.v1 = xxhashRound(prime1+kXXHashPrime2, binary.LittleEndian.Uint64(nonce[0:8]))
+	ks.v2 = xxhashRound(kXXHashPrime2, binary.LittleEndian.Uint64(nonce[8:16]))
+	ks.v3 = xxhashRound(0, key.keystreamWords[0])
+	ks.v4 = xxhashRound(-prime1, key.keystreamWords[1])
+	ks.total = 0
+}
+
+// next returns the next pattern.
+func (ks *obfuscateKeystream) next() (pattern uint64) {
+	if ks.total == 0 {
+		ks.total = kObfuscateKeystreamFirstTotal
+	} else {
+		ks.v1 = xxhashRound(ks.v1, ks.key.keystreamWords[2])
+		ks.v2 = xxhashRound(ks.v2, ks.key.keystreamWords[3])
+		ks.v3 = xxhashRound(ks.v3, ks.key.keystreamWords[0])
+		ks.v4 = xxhashRound(ks.v4, ks.key.keystreamWords[1])
+		ks.total += 32
+	}
+
+	h := bits.RotateLeft64(ks.v1, 1) + bits.RotateLeft64(ks.v2, 7) + bits.RotateLeft64(ks.v3, 12) + bits.RotateLeft64(ks.v4, 18)
+	h = xxhashMergeRound(h, ks.v1)
+	h = xxhashMergeRound(h, ks.v2)
+	h = xxhashMergeRound(h, ks.v3)
+	h = xxhashMergeRound(h, ks.v4)
+	h += ks.total
+	for _, k1 := range ks.key.keystreamTail {
+		h ^= k1
+		h = bits.RotateLeft64(h, 27)*kXXHashPrime1 + kXXHashPrime4
+	}
+	h ^= h >> 33
+	h *= kXXHashPrime2
+	h ^= h >> 29
+	h *= kXXHashPrime3
+	h ^= h >> 32
+	pattern = h
+	return
+}
+
+// xorPattern XORs b (up to 8 bytes) with the pattern in big endian.
+func xorPattern(b []byte, pattern uint64) {
+	if len(b) >= kObfuscateXORKeyLength {
+		binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(b)^pattern)
+		return
+	}
+	for i := range b {
+		b[i] ^= byte(pattern >> (56 - 8*i))
+	}
+}
@@ -0,0 +1,95 @@
+package mwgp
+
+import (
+	"bytes"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// SelfTest obfuscates synthetic packets of all message types, deobfuscates them with
+// another obfuscator with the same keys, and verifies they are restored byte-for-byte.
+//
+// It covers the all-zero MAC2 path of the handshake messages and the nonce path of the short transport messages.
+// The counters and the replay filter of o are not touched.
+func (o *WireGuardObfuscator) SelfTest() (err error) {
+	key := o.loadKey()
+	if key == nil {
+		err = newError(ErrConfig, "obfuscation is disabled")
+		return
+	}
+	sender := o.cloneForSelfTest(key)
+	receiver := o.cloneForSelfTest(key)
+
+	cases := []struct {
+		name        string
+		messageType byte
+		length      int
+		zeroMAC2    bool
+	}{
+		{"MessageInitiation", device.MessageInitiationType, device.MessageInitiationSize, false},
+		{"MessageInitiation with zero MAC2", device.MessageInitiationType, device.MessageInitiationSize, true},
+		{"MessageResponse", device.MessageResponseType, device.MessageResponseSize, false},
+		{"MessageResponse with zero MAC2", device.MessageResponseType, device.MessageResponseSize, true},
+		{"MessageCookieReply", device.MessageCookieReplyType, device.MessageCookieReplySize, false},
+		{"keepalive MessageTransport", device.MessageTransportType, device.MessageTransportSize, false},
+		{"short MessageTransport", device.MessageTransportType, kObfuscateSuffixAsNonceMinLength - 1, false},
+		{"MessageTransport", device.MessageTransportType, kObfuscateSuffixAsNonceMinLength, false},
+		{"large MessageTransport", device.MessageTransportType, 1420, false},
+	}
+	packet := Packet{Data: make([]byte, defaultMaxPacketSize)}
+	original := make([]byte, defaultMaxPacketSize)
+	for _, c := range cases {
+		packet.Reset()
+		packet.Length = c.length
+		packet.Data[0] = c.messageType
+		packet.Data[1] = 0
+		packet.Data[2] = 0
+		packet.Data[3] = 0
+		for i := 4; i < c.length; i++ {
+			packet.Data[i] = byte(i*7 + int(c.messageType))
+		}
+		if c.zeroMAC2 {
+			mac2Offset := kMessageInitiationTypeMAC2Offset
+			if c.messageType == device.MessageResponseType {
+				mac2Offset = kMessageResponseTypeMAC2Offset
+			}
+			for i := mac2Offset; i < c.length; i++ {
+				packet.Data[i] = 0
+			}
+		}
+		copy(original, packet.Slice())
+
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		sender.Obfuscate(&packet)
+		if packet.Flags&PacketFlagDropped != 0 {
+			err = errorf(ErrCrypto, "%s: dropped by obfuscate", c.name)
+			return
+		}
+		if bytes.Equal(packet.Data[:4], original[:4]) {
+			err = errorf(ErrCrypto, "%s: header is not obfuscated", c.name)
+			return
+		}
+
+		packet.Flags = 0
+		receiver.Deobfuscate(&packet)
+		if packet.Flags&PacketFlagDropped != 0 || packet.Flags&PacketFlagDeobfuscatedAfterReceived == 0 {
+			err = errorf(ErrCrypto, "%s: failed to deobfuscate", c.name)
+			return
+		}
+		if !bytes.Equal(packet.Slice(), original[:c.length]) {
+			err = errorf(ErrCrypto, "%s: deobfuscated to %d bytes but not restored byte-for-byte", c.name, packet.Length)
+			return
+		}
+	}
+	return
+}
+
+// cloneForSelfTest returns a new obfuscator with the same key and wire format as o.
+func (o *WireGuardObfuscator) cloneForSelfTest(key *obfuscateKey) (c *WireGuardObfuscator) {
+	c = &WireGuardObfuscator{
+		Padding:       o.Padding,
+		Authenticated: o.Authenticated,
+	}
+	c.random.init(key.userKeyHash[:])
+	c.key.Store(key)
+	return
+}
@@ -1,9 +1,23 @@
 package mwgp
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/cespare/xxhash/v2"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestWireGuardObfuscator_Obfuscate(t *testing.T) {
@@ -17,11 +31,54 @@ func TestWireGuardObfuscator_Obfuscate(t *testing.T) {
 	}
 }
 
+func TestWireGuardObfuscator_ObfuscatePadding(t *testing.T) {
+	paddings := []*ObfuscatePaddingConfig{
+		{MinLength: 128},
+		{MaxRandomTail: 256},
+		{MinLength: 1200, MaxRandomTail: 64, Probability: 0.5},
+		{MinLength: 1500, MaxLength: 1400},
+	}
+	for _, padding := range paddings {
+		for i := device.MinMessageSize; i <= 1500; i++ {
+			testObfuscateWithPadding(t, device.MessageTransportType, i, false, padding)
+		}
+	}
+}
+
+func TestWireGuardObfuscator_ObfuscatePaddingClamp(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	obfuscator.Padding = &ObfuscatePaddingConfig{MinLength: 1420, MaxRandomTail: 1000, MaxLength: 1420}
+
+	for _, length := range []int{32, 1000, 1400, 1410, 1420} {
+		p := Packet{Data: make([]byte, 1500)}
+		p.Data[0] = device.MessageTransportType
+		p.Length = length
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		obfuscator.Obfuscate(&p)
+		if length <= 1420-kObfuscatePaddingTrailerLength-kObfuscateNonceLength && p.Length != 1420 {
+			t.Errorf("packet with length %d should be padded to 1420, got %d", length, p.Length)
+		}
+		if length > 1420-kObfuscatePaddingTrailerLength-kObfuscateNonceLength && p.Length > length {
+			t.Errorf("packet with length %d should not be padded, got %d", length, p.Length)
+		}
+		obfuscator.Deobfuscate(&p)
+		if p.Length != length {
+			t.Errorf("packet with length %d is deobfuscated to length %d", length, p.Length)
+		}
+	}
+}
+
 func testObfuscate(t *testing.T, messageType byte, messageLength int, allZeroMAC2 bool) {
+	testObfuscateWithPadding(t, messageType, messageLength, allZeroMAC2, nil)
+}
+
+func testObfuscateWithPadding(t *testing.T, messageType byte, messageLength int, allZeroMAC2 bool, padding *ObfuscatePaddingConfig) {
 	var obfuscator WireGuardObfuscator
 
 	obfuscator.Initialize("test")
-	var p Packet
+	obfuscator.Padding = padding
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
 	p.Data[0] = messageType
 	p.Data[1] = 0
 	p.Data[2] = 0
@@ -47,6 +104,7 @@ func testObfuscate(t *testing.T, messageType byte, messageLength int, allZeroMAC
 	//t.Logf("origin packet: length=%d data=%v\n", p.Length, p.Data[:p.Length])
 
 	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
 
 	p.Flags |= PacketFlagObfuscateBeforeSend
 	obfuscator.Obfuscate(&p)
@@ -78,11 +136,115 @@ func testObfuscate(t *testing.T, messageType byte, messageLength int, allZeroMAC
 	//t.Logf("deobfuscated packet: length=%d data=%v\n", p.Length, p.Data[:p.Length])
 }
 
+func TestWireGuardObfuscator_Concurrent(t *testing.T) {
+	const goroutines = 16
+	const packets = 200
+
+	obfuscator := &WireGuardObfuscator{
+		Padding:      &ObfuscatePaddingConfig{MinLength: 128, MaxRandomTail: 64, Probability: 0.5},
+		ReplayFilter: NewObfuscateReplayFilter(ObfuscateReplayFilterConfig{}),
+	}
+	obfuscator.Initialize("test")
+
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	var received int64
+	go func() {
+		p := Packet{Data: make([]byte, defaultMaxPacketSize)}
+		for {
+			p.Flags = 0
+			if obfuscator.ReadFromUDPWithDeobfuscate(receiver, &p) != nil {
+				return
+			}
+			if p.Flags&PacketFlagDeobfuscatedAfterReceived != 0 {
+				atomic.AddInt64(&received, 1)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			p := Packet{Data: make([]byte, defaultMaxPacketSize)}
+			origin := make([]byte, 1400)
+			for i := 0; i < packets; i++ {
+				length := device.MessageInitiationSize
+				origin[0] = device.MessageInitiationType
+				if i%2 == 1 {
+					length = device.MessageTransportSize + (g*packets+i)%(len(origin)-device.MessageTransportSize)
+					origin[0] = device.MessageTransportType
+				}
+				_, _ = rand.Read(origin[4:length])
+
+				p.Length = copy(p.Data, origin[:length])
+				p.Flags = PacketFlagObfuscateBeforeSend
+				obfuscator.Obfuscate(&p)
+				p.Flags = 0
+				obfuscator.Deobfuscate(&p)
+				if p.Flags&PacketFlagDropped != 0 || !bytes.Equal(p.Data[:p.Length], origin[:length]) {
+					t.Errorf("goroutine %d packet %d: obfuscate/deobfuscate failed", g, i)
+					return
+				}
+
+				p.Length = copy(p.Data, origin[:length])
+				p.Flags = PacketFlagObfuscateBeforeSend
+				p.Destination = receiver.LocalAddr().(*net.UDPAddr)
+				if err := obfuscator.WriteToUDPWithObfuscate(sender, &p); err != nil {
+					t.Errorf("goroutine %d packet %d: %s", g, i, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&received) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&received) == 0 {
+		t.Errorf("no packet is received")
+	}
+}
+
+func TestObfuscateKeystream(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		var nonce [kObfuscateNonceLength]byte
+		var userKey [32]byte
+		_, _ = rand.Read(nonce[:])
+		_, _ = rand.Read(userKey[:])
+		var key obfuscateUserKey
+		key.init(userKey[:])
+
+		var keystream obfuscateKeystream
+		keystream.reset(nonce[:], &key)
+		digest := xxhash.New()
+		_, _ = digest.Write(nonce[:])
+		for n := 0; n < 256; n++ {
+			_, _ = digest.Write(key.userKeyHash[:])
+			if expected, actual := digest.Sum64(), keystream.next(); expected != actual {
+				t.Fatalf("pattern %d: expected %016x, got %016x", n, expected, actual)
+			}
+		}
+	}
+}
+
 func BenchmarkWireGuardObfuscator_Obfuscate(b *testing.B) {
 	var obfuscator WireGuardObfuscator
 
 	obfuscator.Initialize("test")
-	var p Packet
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
 	p.Data[0] = 4
 	p.Data[1] = 0
 	p.Data[2] = 0
@@ -92,11 +254,14 @@ func BenchmarkWireGuardObfuscator_Obfuscate(b *testing.B) {
 	p.Flags |= PacketFlagObfuscateBeforeSend
 
 	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		p = originPacket
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
 		b.StartTimer()
 		obfuscator.Obfuscate(&p)
 	}
@@ -106,7 +271,7 @@ func BenchmarkWireGuardObfuscator_Deobfuscate(b *testing.B) {
 	var obfuscator WireGuardObfuscator
 
 	obfuscator.Initialize("test")
-	var p Packet
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
 	p.Data[0] = 4
 	p.Data[1] = 0
 	p.Data[2] = 0
@@ -117,12 +282,596 @@ func BenchmarkWireGuardObfuscator_Deobfuscate(b *testing.B) {
 	obfuscator.Obfuscate(&p)
 
 	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
+		b.StartTimer()
+		obfuscator.Deobfuscate(&p)
+	}
+}
+
+// benchmarkObfuscateTransport benchmarks the Obfuscate (or the Deobfuscate) of a MessageTransport of the length.
+func benchmarkObfuscateTransport(b *testing.B, length int, deobfuscate bool) {
+	var obfuscator WireGuardObfuscator
+
+	obfuscator.Initialize("test")
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
+	p.Data[0] = device.MessageTransportType
+	p.Length = length
+	_, _ = rand.Read(p.Data[4:p.Length])
+	p.Flags |= PacketFlagObfuscateBeforeSend
+	if deobfuscate {
+		obfuscator.Obfuscate(&p)
+	}
+
+	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
+		b.StartTimer()
+		if deobfuscate {
+			obfuscator.Deobfuscate(&p)
+		} else {
+			obfuscator.Obfuscate(&p)
+		}
+	}
+}
+
+func BenchmarkWireGuardObfuscator_Obfuscate1400(b *testing.B) {
+	benchmarkObfuscateTransport(b, 1400, false)
+}
+
+func BenchmarkWireGuardObfuscator_Deobfuscate1400(b *testing.B) {
+	benchmarkObfuscateTransport(b, 1400, true)
+}
+
+func BenchmarkWireGuardObfuscator_Obfuscate148(b *testing.B) {
+	benchmarkObfuscateTransport(b, 148, false)
+}
+
+func BenchmarkWireGuardObfuscator_Deobfuscate148(b *testing.B) {
+	benchmarkObfuscateTransport(b, 148, true)
+}
+
+func BenchmarkWireGuardObfuscator_ObfuscateInitiation(b *testing.B) {
+	var obfuscator WireGuardObfuscator
+
+	obfuscator.Initialize("test")
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
+	p.Data[0] = device.MessageInitiationType
+	p.Length = device.MessageInitiationSize
+	_, _ = rand.Read(p.Data[4:kMessageInitiationTypeMAC2Offset])
+	p.Flags |= PacketFlagObfuscateBeforeSend
+
+	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
+		b.StartTimer()
+		obfuscator.Obfuscate(&p)
+	}
+}
+
+func BenchmarkWireGuardObfuscator_DeobfuscateInitiation(b *testing.B) {
+	var obfuscator WireGuardObfuscator
+
+	obfuscator.Initialize("test")
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
+	p.Data[0] = device.MessageInitiationType
+	p.Length = device.MessageInitiationSize
+	_, _ = rand.Read(p.Data[4:kMessageInitiationTypeMAC2Offset])
+	p.Flags |= PacketFlagObfuscateBeforeSend
+	obfuscator.Obfuscate(&p)
+
+	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		p = originPacket
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
 		b.StartTimer()
 		obfuscator.Deobfuscate(&p)
 	}
 }
+
+func TestWireGuardObfuscator_Strict(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	obfuscator.Strict = true
+
+	p := Packet{Data: make([]byte, defaultMaxPacketSize)}
+	p.Data[0] = device.MessageInitiationType
+	p.Length = device.MessageInitiationSize
+	obfuscator.Deobfuscate(&p)
+	if p.Flags&PacketFlagDropped == 0 {
+		t.Errorf("non-obfuscated packet is not dropped in strict mode")
+	}
+	if obfuscator.PlainDroppedPacketCount() != 1 {
+		t.Errorf("expected 1 dropped packet, got %d", obfuscator.PlainDroppedPacketCount())
+	}
+
+	p.Reset()
+	p.Data[0] = device.MessageInitiationType
+	p.Data[1] = 0
+	p.Length = device.MessageInitiationSize
+	p.Flags |= PacketFlagObfuscateBeforeSend
+	obfuscator.Obfuscate(&p)
+	p.Flags = 0
+	obfuscator.Deobfuscate(&p)
+	if p.Flags&PacketFlagDropped != 0 {
+		t.Errorf("obfuscated packet is dropped in strict mode")
+	}
+	if p.Flags&PacketFlagDeobfuscatedAfterReceived == 0 {
+		t.Errorf("obfuscated packet is not deobfuscated in strict mode")
+	}
+}
+
+func TestParseObfuscateKey(t *testing.T) {
+	const plain = "kisekimo\x00\xff"
+	keyFile := filepath.Join(t.TempDir(), "obfs.key")
+	if err := os.WriteFile(keyFile, []byte(plain+"\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hexKeyFile := filepath.Join(t.TempDir(), "obfs.key")
+	if err := os.WriteFile(hexKeyFile, []byte("hex:"+hex.EncodeToString([]byte(plain))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MWGP_TEST_OBFS_KEY", "base64:"+base64.StdEncoding.EncodeToString([]byte(plain)))
+	t.Setenv("MWGP_TEST_OBFS_KEY_EMPTY", "")
+	encodings := []string{
+		plain,
+		"hex:" + hex.EncodeToString([]byte(plain)),
+		"hex: " + hex.EncodeToString([]byte(plain)) + "\n",
+		"base64:" + base64.StdEncoding.EncodeToString([]byte(plain)),
+		"base64:" + base64.StdEncoding.EncodeToString([]byte(plain)) + " ",
+		"file:" + keyFile,
+		"file:" + hexKeyFile,
+		"env:MWGP_TEST_OBFS_KEY",
+	}
+	obfuscators := make([]*WireGuardObfuscator, len(encodings))
+	for i, encoded := range encodings {
+		key, err := ParseObfuscateKey(encoded)
+		if err != nil {
+			t.Fatalf("failed to parse key %q: %s", encoded, err.Error())
+		}
+		if !bytes.Equal(key, []byte(plain)) {
+			t.Errorf("key %q is decoded to %x", encoded, key)
+		}
+		obfuscators[i] = &WireGuardObfuscator{}
+		obfuscators[i].InitializeWithKey(key)
+		if !obfuscators[0].hasKey(key) {
+			t.Errorf("key %q is not the same as %q", encoded, encodings[0])
+		}
+	}
+
+	// the packet obfuscated with any encoding of the key can be deobfuscated by the others
+	for i, o := range obfuscators {
+		for j, d := range obfuscators {
+			p := Packet{Data: make([]byte, 1500)}
+			p.Data[0] = device.MessageTransportType
+			p.Length = 148
+			_, _ = rand.Read(p.Data[4:p.Length])
+			original := append([]byte(nil), p.Slice()...)
+			p.Flags |= PacketFlagObfuscateBeforeSend
+			o.Obfuscate(&p)
+			d.Deobfuscate(&p)
+			if !bytes.Equal(p.Slice(), original) {
+				t.Errorf("packet obfuscated with key %q cannot be deobfuscated with key %q", encodings[i], encodings[j])
+			}
+		}
+	}
+
+	malformed := []string{"hex:xyz", "hex:012", "base64:!!!", "hex:", "base64: ",
+		"file:" + filepath.Join(t.TempDir(), "missing"), "env:MWGP_TEST_OBFS_KEY_UNSET", "env:MWGP_TEST_OBFS_KEY_EMPTY"}
+	for _, malformed := range malformed {
+		if _, err := ParseObfuscateKey(malformed); err == nil {
+			t.Errorf("malformed key %q is accepted", malformed)
+		}
+	}
+}
+
+func TestNewWireGuardObfuscator(t *testing.T) {
+	for _, c := range []struct {
+		key     string
+		opts    []ObfuscatorOption
+		enabled bool
+		invalid bool
+	}{
+		{key: "password", enabled: true},
+		{key: "", invalid: true},
+		{key: "", opts: []ObfuscatorOption{ObfuscatorAllowDisabled()}},
+		{key: "short", invalid: true},
+		{key: "short", opts: []ObfuscatorOption{ObfuscatorMinKeyLength(4)}, enabled: true},
+		{key: "password", opts: []ObfuscatorOption{ObfuscatorMinKeyLength(16)}, invalid: true},
+		{key: "password", opts: []ObfuscatorOption{ObfuscatorMinKeyLength(-1)}, invalid: true},
+		{key: "password", opts: []ObfuscatorOption{ObfuscatorSecondaryKeys("old password")}, enabled: true},
+		{key: "password", opts: []ObfuscatorOption{ObfuscatorSecondaryKeys("old")}, invalid: true},
+		{key: "", opts: []ObfuscatorOption{ObfuscatorAllowDisabled(), ObfuscatorSecondaryKeys("old password")}, invalid: true},
+	} {
+		obfuscator, err := NewWireGuardObfuscator(c.key, c.opts...)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.key, err)
+			continue
+		}
+		if obfuscator.enabled() != c.enabled {
+			t.Errorf("%q: expected enabled %v", c.key, c.enabled)
+		}
+	}
+
+	_, _, err := parseObfuscateKeys("password", []string{"old"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "obfs_secondary[0]") {
+		t.Errorf("expected an error of obfs_secondary[0], got %v", err)
+	}
+	if _, _, err = parseObfuscateKeys("hex:0011", nil, 2); err != nil {
+		t.Errorf("expected the 2 bytes key accepted, got %s", err)
+	}
+}
+
+func TestWireGuardObfuscator_SecondaryKeys(t *testing.T) {
+	var oldObfuscator, newObfuscator, rotatingObfuscator WireGuardObfuscator
+	oldObfuscator.Initialize("old")
+	newObfuscator.Initialize("new")
+	rotatingObfuscator.Initialize("new", "older", "old")
+
+	messages := []struct {
+		messageType byte
+		length      int
+	}{
+		{device.MessageInitiationType, device.MessageInitiationSize},
+		{device.MessageResponseType, device.MessageResponseSize},
+		{device.MessageCookieReplyType, device.MessageCookieReplySize},
+		{device.MessageTransportType, device.MessageTransportSize},
+		{device.MessageTransportType, 1280},
+	}
+	for _, m := range messages {
+		for _, o := range []*WireGuardObfuscator{&oldObfuscator, &newObfuscator} {
+			p := Packet{Data: make([]byte, 1500)}
+			p.Data[0] = m.messageType
+			p.Length = m.length
+			_, _ = rand.Read(p.Data[4:p.Length])
+			original := append([]byte(nil), p.Slice()...)
+			p.Flags |= PacketFlagObfuscateBeforeSend
+			o.Obfuscate(&p)
+			rotatingObfuscator.Deobfuscate(&p)
+			if !bytes.Equal(p.Slice(), original) {
+				t.Errorf("message type %d with length %d is not deobfuscated", m.messageType, m.length)
+			}
+		}
+	}
+	if count := rotatingObfuscator.SecondaryKeyPacketCount(); count != uint64(len(messages)) {
+		t.Errorf("expected %d packets deobfuscated with secondary keys, got %d", len(messages), count)
+	}
+
+	// packets are always obfuscated with the primary key
+	p := Packet{Data: make([]byte, 1500)}
+	p.Data[0] = device.MessageTransportType
+	p.Length = 148
+	original := append([]byte(nil), p.Slice()...)
+	p.Flags |= PacketFlagObfuscateBeforeSend
+	rotatingObfuscator.Obfuscate(&p)
+	oldObfuscator.Deobfuscate(&p)
+	if bytes.Equal(p.Slice(), original) {
+		t.Errorf("packet is obfuscated with a secondary key")
+	}
+}
+
+func TestWireGuardObfuscator_Authenticated(t *testing.T) {
+	var authenticated, rotating, xor WireGuardObfuscator
+	authenticated.Initialize("test")
+	authenticated.Authenticated = true
+	authenticated.Padding = &ObfuscatePaddingConfig{MinLength: 256, Probability: 0.5}
+	rotating.Initialize("new", "test")
+	rotating.Authenticated = true
+	xor.Initialize("test")
+
+	newPacket := func(messageType byte, length int) (p *Packet, original []byte) {
+		p = &Packet{Data: make([]byte, 1500)}
+		p.Data[0] = messageType
+		p.Length = length
+		_, _ = rand.Read(p.Data[4:p.Length])
+		original = append([]byte(nil), p.Slice()...)
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		return
+	}
+
+	messages := []struct {
+		messageType byte
+		length      int
+	}{
+		{device.MessageInitiationType, device.MessageInitiationSize},
+		{device.MessageResponseType, device.MessageResponseSize},
+		{device.MessageCookieReplyType, device.MessageCookieReplySize},
+		{device.MessageTransportType, device.MessageTransportSize},
+		{device.MessageTransportType, 1000},
+		{device.MessageTransportType, 1492},
+	}
+	for _, m := range messages {
+		for _, d := range []*WireGuardObfuscator{&authenticated, &rotating} {
+			p, original := newPacket(m.messageType, m.length)
+			authenticated.Obfuscate(p)
+			if p.Length > 1500 {
+				t.Errorf("message type %d with length %d is obfuscated to length %d", m.messageType, m.length, p.Length)
+				continue
+			}
+			d.Deobfuscate(p)
+			if p.Flags&PacketFlagDropped != 0 || !bytes.Equal(p.Slice(), original) {
+				t.Errorf("message type %d with length %d is not deobfuscated", m.messageType, m.length)
+			}
+		}
+
+		// any flipped bit is detected
+		p, _ := newPacket(m.messageType, m.length)
+		authenticated.Obfuscate(p)
+		captured := append([]byte(nil), p.Slice()...)
+		for _, i := range []int{0, 4, p.Length / 2, p.Length - kObfuscateTagLength - 1, p.Length - 1} {
+			p.Length = copy(p.Data, captured)
+			p.Flags = 0
+			p.Data[i] ^= 0x10
+			authenticated.Deobfuscate(p)
+			if p.Flags&PacketFlagDropped == 0 {
+				t.Errorf("message type %d with a flipped bit at %d is not dropped", m.messageType, i)
+			}
+		}
+
+		// packets in the other mode are rejected
+		p, _ = newPacket(m.messageType, m.length)
+		xor.Obfuscate(p)
+		authenticated.Deobfuscate(p)
+		if p.Flags&PacketFlagDropped == 0 {
+			t.Errorf("message type %d in xor mode is accepted in authenticated mode", m.messageType)
+		}
+		p, _ = newPacket(m.messageType, m.length)
+		authenticated.Obfuscate(p)
+		xor.Deobfuscate(p)
+		if p.Flags&PacketFlagDeobfuscatedAfterReceived != 0 {
+			t.Errorf("message type %d in authenticated mode is accepted in xor mode", m.messageType)
+		}
+	}
+	if count := rotating.SecondaryKeyPacketCount(); count != uint64(len(messages)) {
+		t.Errorf("expected %d packets deobfuscated with secondary keys, got %d", len(messages), count)
+	}
+
+	// no room for the tag
+	p, _ := newPacket(device.MessageTransportType, 1496)
+	if err := authenticated.WriteToUDPWithObfuscate(nil, p); err != errObfuscatePacketTooLarge {
+		t.Errorf("expected errObfuscatePacketTooLarge, got %v", err)
+	}
+}
+
+func TestWireGuardObfuscator_SelfTest(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	if err := obfuscator.SelfTest(); err == nil {
+		t.Errorf("self-test passed with obfuscation disabled")
+	}
+
+	obfuscator.Initialize("test")
+	for _, authenticated := range []bool{false, true} {
+		for _, padding := range []*ObfuscatePaddingConfig{nil, {MinLength: 512, MaxRandomTail: 64}} {
+			obfuscator.Authenticated = authenticated
+			obfuscator.Padding = padding
+			if err := obfuscator.SelfTest(); err != nil {
+				t.Errorf("self-test failed (authenticated=%v, padding=%+v): %s", authenticated, padding, err.Error())
+			}
+		}
+	}
+	var stats Stats
+	obfuscator.fillStats(&stats)
+	if stats.ObfuscatedPackets != 0 || stats.DeobfuscateFailures != 0 {
+		t.Errorf("self-test changed the counters: %+v", stats)
+	}
+}
+
+func TestWireGuardObfuscator_KeyFingerprint(t *testing.T) {
+	var a, b, c, disabled WireGuardObfuscator
+	a.Initialize("kisekimo")
+	b.InitializeWithKey([]byte("kisekimo"))
+	c.Initialize("mahoumo")
+	if fp := a.KeyFingerprint(); len(fp) != 8 {
+		t.Errorf("fingerprint %q is not 8 hex chars", fp)
+	}
+	if a.KeyFingerprint() != b.KeyFingerprint() {
+		t.Errorf("same key has different fingerprints: %s, %s", a.KeyFingerprint(), b.KeyFingerprint())
+	}
+	if a.KeyFingerprint() == c.KeyFingerprint() {
+		t.Errorf("different keys have the same fingerprint: %s", a.KeyFingerprint())
+	}
+	if key := a.loadKey(); strings.HasPrefix(hex.EncodeToString(key.userKeyHash[:]), a.KeyFingerprint()) {
+		t.Errorf("fingerprint exposes the userKeyHash")
+	}
+	if fp := disabled.KeyFingerprint(); fp != "" {
+		t.Errorf("fingerprint of disabled obfuscator: %q", fp)
+	}
+}
+
+func TestWireGuardObfuscator_DeobfuscateLength(t *testing.T) {
+	// a short packet is never deobfuscated to a longer message
+	for _, messageType := range []byte{device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType, device.MessageTransportType} {
+		for flags := byte(0); flags < 4; flags++ {
+			header := []byte{messageType, flags, 0, 0}
+			for length := 0; length < device.MessageInitiationSize+kObfuscateNonceLength; length++ {
+				if !isValidDeobfuscatedHeader(header, length) {
+					continue
+				}
+				var minLength int
+				switch messageType {
+				case device.MessageInitiationType:
+					minLength = device.MessageInitiationSize + kObfuscateNonceLength
+				case device.MessageResponseType:
+					minLength = device.MessageResponseSize + kObfuscateNonceLength
+				case device.MessageCookieReplyType:
+					minLength = device.MessageCookieReplySize + kObfuscateNonceLength
+				case device.MessageTransportType:
+					minLength = device.MessageTransportHeaderSize
+					if flags != 0 {
+						minLength += kObfuscateNonceLength
+					}
+				}
+				if length < minLength {
+					t.Errorf("header %x is accepted with length %d", header, length)
+				}
+			}
+		}
+	}
+
+	// random packets of random lengths
+	for _, authenticated := range []bool{false, true} {
+		var obfuscator WireGuardObfuscator
+		obfuscator.Initialize("test")
+		obfuscator.Authenticated = authenticated
+		p := Packet{Data: make([]byte, 2048)}
+		var lengths [1]byte
+		for i := 0; i < 100000; i++ {
+			_, _ = rand.Read(lengths[:])
+			p.Reset()
+			p.Length = int(lengths[0]) + i%3*256
+			_, _ = rand.Read(p.Data[:p.Length])
+			received := p.Length
+			obfuscator.Deobfuscate(&p)
+			if p.Length > received || p.Length < 0 {
+				t.Fatalf("packet with length %d is deobfuscated to length %d", received, p.Length)
+			}
+			if p.Flags&(PacketFlagDropped|PacketFlagDeobfuscatedAfterReceived) == 0 && !isPlainWireGuardHeader(p.Data) {
+				t.Fatalf("invalid packet with length %d is neither dropped nor deobfuscated", received)
+			}
+		}
+	}
+}
+
+func isPlainWireGuardHeader(b []byte) bool {
+	return b[0] >= 1 && b[0] <= 4 && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
+
+func isZeroObfuscateUserKey(k *obfuscateUserKey) bool {
+	return k.userKeyHash == [32]byte{} && k.tagKey == [2]uint64{} &&
+		k.keystreamWords == [4]uint64{} && k.keystreamTail == [2]uint64{}
+}
+
+func TestWireGuardObfuscator_KeyHygiene(t *testing.T) {
+	var o WireGuardObfuscator
+	o.Initialize("kisekimo", "mahoumo")
+	old := o.loadKey()
+	o.Initialize("muryoudewaarimasen")
+	if !isZeroObfuscateUserKey(&old.obfuscateUserKey) || !isZeroObfuscateUserKey(&old.secondary[0]) {
+		t.Errorf("the previous keys are not zeroed by Initialize")
+	}
+	if old.fingerprint == "" {
+		t.Errorf("the fingerprint is cleared")
+	}
+	if isZeroObfuscateUserKey(&o.loadKey().obfuscateUserKey) {
+		t.Errorf("the new key is zeroed")
+	}
+
+	// the packets being processed may still use the keys replaced by SetKey
+	current := o.loadKey()
+	o.SetKey([]byte("kisekimo"))
+	if isZeroObfuscateUserKey(&current.obfuscateUserKey) {
+		t.Errorf("the previous key is zeroed by SetKey")
+	}
+
+	current = o.loadKey()
+	o.Close()
+	if o.enabled() {
+		t.Errorf("obfuscation is still enabled after Close")
+	}
+	if !isZeroObfuscateUserKey(&current.obfuscateUserKey) {
+		t.Errorf("the key is not zeroed by Close")
+	}
+	o.Close()
+
+	_, err := ParseObfuscateKey("hex:00secret")
+	if err == nil || strings.Contains(err.Error(), "'s'") {
+		t.Errorf("the error exposes the key: %v", err)
+	}
+}
+
+// TestKeyHygieneLogging checks that no key material is passed to the formatting, logging and error functions,
+// see "Key Hygiene" in obfs.go.
+func TestKeyHygieneLogging(t *testing.T) {
+	formatFuncs := map[string]bool{
+		"Print": true, "Printf": true, "Println": true, "Sprint": true, "Sprintf": true, "Sprintln": true,
+		"Fprint": true, "Fprintf": true, "Fprintln": true, "Errorf": true, "Fatalf": true, "Panicf": true,
+		"Debugf": true, "Infof": true, "Warnf": true, "Logf": true, "errorf": true, "newError": true,
+	}
+	keyFields := map[string]bool{
+		"ObfuscateKey": true, "ObfuscateSecondaryKeys": true, "obfuscateKey": true, "obfuscateSecondaryKeys": true,
+		"userKey": true, "secondaryKeys": true, "userKeyHash": true, "tagKey": true,
+		"keystreamWords": true, "keystreamTail": true, "PrivateKey": true, "NoisePrivateKey": true,
+	}
+	fset := token.NewFileSet()
+	checked := 0
+	err := filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != "." && (strings.HasPrefix(d.Name(), ".") || d.Name() == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		checked++
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			var name string
+			switch fun := call.Fun.(type) {
+			case *ast.SelectorExpr:
+				name = fun.Sel.Name
+			case *ast.Ident:
+				name = fun.Name
+			}
+			if !formatFuncs[name] {
+				return true
+			}
+			for _, arg := range call.Args {
+				ast.Inspect(arg, func(n ast.Node) bool {
+					if ident, ok := n.(*ast.Ident); ok && keyFields[ident.Name] {
+						t.Errorf("%s: %s is passed to %s", fset.Position(ident.Pos()), ident.Name, name)
+					}
+					return true
+				})
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked < 10 {
+		t.Fatalf("only %d files are checked", checked)
+	}
+}
@@ -5,23 +5,86 @@ import (
 	"fmt"
 	"golang.zx2c4.com/wireguard/device"
 	"net"
+	"net/netip"
+	"sync"
 )
 
 const (
 	defaultMaxPacketSize = 65536
+
+	// kMinMaxPacketSize is the min of the max_packet_size, which is the min MTU of IPv4,
+	// and in which an obfuscated handshake (up to 555 bytes with the random suffix and the tag) always fits.
+	kMinMaxPacketSize = 576
 )
 
+// validateMaxPacketSize checks the max_packet_size, 0 means the defaultMaxPacketSize.
+func validateMaxPacketSize(size int) (err error) {
+	if size != 0 && (size < kMinMaxPacketSize || size > defaultMaxPacketSize) {
+		err = fmt.Errorf("max_packet_size must be between %d and %d, got %d", kMinMaxPacketSize, defaultMaxPacketSize, size)
+	}
+	return
+}
+
 const (
 	PacketFlagDeobfuscatedAfterReceived = 1 << iota
 	PacketFlagObfuscateBeforeSend
+
+	// PacketFlagDropped is set by a ReadFromUDPFunc to tell the caller
+	// to ignore this packet, such as a non-obfuscated packet in the strict mode.
+	PacketFlagDropped
+
+	// PacketFlagUnrecognized is set with PacketFlagDropped if the packet is neither obfuscated
+	// nor a plain WireGuard packet, its data is left intact for the fallback forwarding.
+	PacketFlagUnrecognized
+
+	// PacketFlagInvalid is set with PacketFlagDropped if the packet cannot be deobfuscated,
+	// such as its decoded message type, length or tag is invalid.
+	PacketFlagInvalid
+
+	// PacketFlagRetained is set by a write func (or the PacketTransport it writes to) which keeps the packet
+	// after it returns, such as a packet queued until the stream connection is reestablished.
+	// The packet is then owned by the one setting it, and is never put back to the pool by the table.
+	PacketFlagRetained
+
+	// PacketFlagBlocked is set with PacketFlagDropped if the packet is dropped by the BlockFunc of the obfuscator
+	// before it is deobfuscated.
+	PacketFlagBlocked
 )
 
 type Packet struct {
-	Data        []byte
-	Length      int
+	Data   []byte
+	Length int
+
+	// Source may point to the storage inside the packet,
+	// so it must be copied if it is retained after the packet is put back to the pool.
 	Source      *net.UDPAddr
 	Destination *net.UDPAddr
 	Flags       uint64
+
+	// the transport this packet was received from, or should be sent to.
+	transport PacketTransport
+	// the upstreamConn of the transport if the packet is sent to a server.
+	upstream *upstreamConn
+
+	// the max length of the packet once it is obfuscated, 0 if not limited, see "Path MTU Discovery".
+	maxLength int
+	// writeFailed is set by the batch writes on the packets failed to be written, see retryPathMTUBatch.
+	writeFailed bool
+
+	// the TOS (or the traffic class) the packet is received with if hasTOS, see "ToS Preservation".
+	tos    byte
+	hasTOS bool
+
+	// the monotonic stamp of the time this packet was read if it is sampled, see "Latency Histogram".
+	received int64
+
+	// the length of the packet as read, before it is deobfuscated, and the record of "Packet Trace".
+	receivedLength int
+	trace          packetTraceRecord
+
+	// the storage of Source, to avoid an allocation for each received packet.
+	sourceAddr net.UDPAddr
+	sourceIP   [net.IPv6len]byte
 }
 
 func (p *Packet) Reset() {
@@ -30,12 +93,112 @@ func (p *Packet) Reset() {
 	p.Source = nil
 	p.Destination = nil
 	p.Flags = 0
+	p.transport = nil
+	p.upstream = nil
+	p.maxLength = 0
+	p.writeFailed = false
+	p.tos = 0
+	p.hasTOS = false
+	p.received = 0
+	p.receivedLength = 0
+	p.trace = packetTraceRecord{}
+}
+
+// setSourceAddrPort sets the Source without allocation.
+//
+// An IPv4-mapped IPv6 address received by a dual-stack socket is converted to the IPv4 address,
+// so that ::ffff:a.b.c.d and a.b.c.d are always treated as the same client.
+func (p *Packet) setSourceAddrPort(addr netip.AddrPort) {
+	var ip []byte
+	if addr.Addr().Is4In6() {
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	}
+	if addr.Addr().Is4() {
+		a4 := addr.Addr().As4()
+		ip = append(p.sourceIP[:0], a4[:]...)
+	} else {
+		a16 := addr.Addr().As16()
+		ip = append(p.sourceIP[:0], a16[:]...)
+	}
+	p.sourceAddr = net.UDPAddr{
+		IP:   ip,
+		Port: int(addr.Port()),
+		Zone: addr.Addr().Zone(),
+	}
+	p.Source = &p.sourceAddr
+}
+
+// cloneUDPAddr returns a copy of addr that does not share the memory with it.
+func cloneUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	if addr == nil {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), addr.IP...),
+		Port: addr.Port,
+		Zone: addr.Zone,
+	}
+}
+
+// PacketPool is a pool of Packet with Data of a fixed size.
+//
+// A Packet has exactly one owner at any time. The read loop gets it from the pool
+// and hands it over to the main loop, which hands it over to the write loop
+// through the channels, and whoever finally consumes it (the write loop after
+// writing it to the socket, or anyone who drops it) must Put() it back,
+// and never touch it anymore.
+//
+// The packet is read into its Data by the transport, and passed by the pointer
+// through the pipeline without being copied. A write func keeping the packet
+// after it returns takes it over with PacketFlagRetained instead of copying it.
+type PacketPool struct {
+	pool sync.Pool
+}
+
+// NewPacketPool returns the pool of the packets with the Data of the size.
+//
+// The Data has one more byte of capacity, which the packets are read into (see readBuffer),
+// so that a packet larger than the size is told from the one of the size and dropped (see isOversized)
+// instead of being forwarded truncated.
+func NewPacketPool(size uint) (pool *PacketPool) {
+	pool = &PacketPool{}
+	pool.pool.New = func() interface{} {
+		return &Packet{
+			Data: make([]byte, size, size+1),
+		}
+	}
+	return
+}
+
+func (p *PacketPool) Get() *Packet {
+	return p.pool.Get().(*Packet)
+}
+
+func (p *PacketPool) Put(packet *Packet) {
+	packet.Reset()
+	p.pool.Put(packet)
 }
 
 func (p *Packet) Slice() []byte {
 	return p.Data[:p.Length]
 }
 
+// readBuffer returns the whole capacity of the Data to read a packet into, see NewPacketPool.
+func (p *Packet) readBuffer() []byte {
+	return p.Data[:cap(p.Data)]
+}
+
+// isOversized reports whether the packet read is larger than the Data, whose content is truncated.
+func (p *Packet) isOversized() bool {
+	length := p.receivedLength
+	if length == 0 {
+		length = p.Length
+	}
+	return length > len(p.Data)
+}
+
+// MessageType returns the first byte of the packet, the type of a WireGuard message, -1 if the packet is empty.
+// The reserved bytes are not checked, they are used as flags by the obfuscation.
 func (p *Packet) MessageType() int {
 	if p.Length < 1 {
 		return -1
@@ -43,11 +206,56 @@ func (p *Packet) MessageType() int {
 	return int((p.Data)[0])
 }
 
-func (p *Packet) ReceiverIndex() (index uint32, err error) {
+// IsHandshake reports whether the packet is a MessageInitiation, a MessageResponse or a MessageCookieReply.
+func (p *Packet) IsHandshake() bool {
+	switch p.MessageType() {
+	case device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType:
+		return true
+	}
+	return false
+}
+
+// ReservedByte returns the i-th (1 to 3) byte of the message header, 0 if the packet is too short.
+func (p *Packet) ReservedByte(i int) byte {
+	if i < 1 || i > 3 || p.Length <= i {
+		return 0
+	}
+	return p.Data[i]
+}
+
+// SetReservedByte sets the i-th (1 to 3) byte of the message header.
+func (p *Packet) SetReservedByte(i int, v byte) (err error) {
+	if i < 1 || i > 3 {
+		err = fmt.Errorf("invalid reserved byte %d of the message header", i)
+		return
+	}
+	if p.Length <= i {
+		err = errorf(ErrProtocol, "packet is too short to set reserved byte %d", i)
+		return
+	}
+	p.Data[i] = v
+	return
+}
+
+// SenderIndex returns the sender_index of a MessageInitiation or a MessageResponse.
+func (p *Packet) SenderIndex() (index uint32, err error) {
 	messageType := p.MessageType()
 	switch messageType {
 	case device.MessageInitiationType:
-		index, err = p.getLEUint32Offset(8)
+		index, err = p.getLEUint32Offset(4)
+	case device.MessageResponseType:
+		index, err = p.getLEUint32Offset(4)
+	default:
+		err = errorf(ErrProtocol, "cannot get sender_index for message type %d", messageType)
+	}
+	return
+}
+
+// ReceiverIndex returns the receiver_index of a MessageResponse, a MessageCookieReply or a MessageTransport,
+// a MessageInitiation has none.
+func (p *Packet) ReceiverIndex() (index uint32, err error) {
+	messageType := p.MessageType()
+	switch messageType {
 	case device.MessageResponseType:
 		index, err = p.getLEUint32Offset(8)
 	case device.MessageCookieReplyType:
@@ -55,11 +263,26 @@ func (p *Packet) ReceiverIndex() (index uint32, err error) {
 	case device.MessageTransportType:
 		index, err = p.getLEUint32Offset(4)
 	default:
-		err = fmt.Errorf("cannot get receiver_index for message type %d", messageType)
+		err = errorf(ErrProtocol, "cannot get receiver_index for message type %d", messageType)
 	}
 	return
 }
 
+// Counter returns the counter of a MessageTransport.
+func (p *Packet) Counter() (counter uint64, err error) {
+	messageType := p.MessageType()
+	if messageType != device.MessageTransportType {
+		err = errorf(ErrProtocol, "cannot get counter for message type %d", messageType)
+		return
+	}
+	if p.Length < device.MessageTransportHeaderSize {
+		err = newError(ErrProtocol, "packet is too short to get counter")
+		return
+	}
+	counter = binary.LittleEndian.Uint64(p.Data[8:])
+	return
+}
+
 func (p *Packet) SetSenderIndex(index uint32) (err error) {
 	messageType := p.MessageType()
 	switch messageType {
@@ -68,7 +291,7 @@ func (p *Packet) SetSenderIndex(index uint32) (err error) {
 	case device.MessageResponseType:
 		err = p.putLEUint32Offset(4, index)
 	default:
-		err = fmt.Errorf("cannot set sender_index for message type %d", messageType)
+		err = errorf(ErrProtocol, "cannot set sender_index for message type %d", messageType)
 	}
 	return
 }
@@ -76,8 +299,6 @@ func (p *Packet) SetSenderIndex(index uint32) (err error) {
 func (p *Packet) SetReceiverIndex(index uint32) (err error) {
 	messageType := p.MessageType()
 	switch messageType {
-	case device.MessageInitiationType:
-		err = p.putLEUint32Offset(8, index)
 	case device.MessageResponseType:
 		err = p.putLEUint32Offset(8, index)
 	case device.MessageCookieReplyType:
@@ -85,14 +306,14 @@ func (p *Packet) SetReceiverIndex(index uint32) (err error) {
 	case device.MessageTransportType:
 		err = p.putLEUint32Offset(4, index)
 	default:
-		err = fmt.Errorf("cannot set receiver_index for message type %d", messageType)
+		err = errorf(ErrProtocol, "cannot set receiver_index for message type %d", messageType)
 	}
 	return
 }
 
 func (p *Packet) getLEUint32Offset(bytesOffset int) (value uint32, err error) {
 	if p.Length < bytesOffset+4 {
-		err = fmt.Errorf("packet is too short to get uint32 at offset %d", bytesOffset)
+		err = errorf(ErrProtocol, "packet is too short to get uint32 at offset %d", bytesOffset)
 		return
 	}
 	value = binary.LittleEndian.Uint32(p.Data[bytesOffset:])
@@ -101,7 +322,7 @@ func (p *Packet) getLEUint32Offset(bytesOffset int) (value uint32, err error) {
 
 func (p *Packet) putLEUint32Offset(bytesOffset int, value uint32) (err error) {
 	if p.Length < bytesOffset+4 {
-		err = fmt.Errorf("packet is too short to put uint32 at offset %d", bytesOffset)
+		err = errorf(ErrProtocol, "packet is too short to put uint32 at offset %d", bytesOffset)
 		return
 	}
 	binary.LittleEndian.PutUint32(p.Data[bytesOffset:], value)
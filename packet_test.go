@@ -0,0 +1,113 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"testing"
+)
+
+func TestPacket_Accessors(t *testing.T) {
+	newPacket := func(messageType uint32, length int) *Packet {
+		p := &Packet{Data: make([]byte, 256), Length: length}
+		binary.LittleEndian.PutUint32(p.Data, messageType)
+		for i := 4; i < len(p.Data); i += 4 {
+			binary.LittleEndian.PutUint32(p.Data[i:], uint32(i))
+		}
+		return p
+	}
+
+	initiation := newPacket(device.MessageInitiationType, device.MessageInitiationSize)
+	if index, err := initiation.SenderIndex(); err != nil || index != 4 {
+		t.Errorf("expected sender_index 4 of MessageInitiation, got %d (%v)", index, err)
+	}
+	if _, err := initiation.ReceiverIndex(); err == nil {
+		t.Errorf("expected no receiver_index of MessageInitiation")
+	}
+	if !initiation.IsHandshake() {
+		t.Errorf("expected MessageInitiation to be a handshake")
+	}
+
+	response := newPacket(device.MessageResponseType, device.MessageResponseSize)
+	if index, err := response.ReceiverIndex(); err != nil || index != 8 {
+		t.Errorf("expected receiver_index 8 of MessageResponse, got %d (%v)", index, err)
+	}
+	if err := response.SetReceiverIndex(0x1234); err != nil || binary.LittleEndian.Uint32(response.Data[8:]) != 0x1234 {
+		t.Errorf("failed to set receiver_index of MessageResponse: %v", err)
+	}
+
+	transport := newPacket(device.MessageTransportType, device.MessageTransportSize)
+	if index, err := transport.ReceiverIndex(); err != nil || index != 4 {
+		t.Errorf("expected receiver_index 4 of MessageTransport, got %d (%v)", index, err)
+	}
+	if counter, err := transport.Counter(); err != nil || counter != 8|12<<32 {
+		t.Errorf("expected counter %d of MessageTransport, got %d (%v)", uint64(8|12<<32), counter, err)
+	}
+	if _, err := transport.SenderIndex(); err == nil {
+		t.Errorf("expected no sender_index of MessageTransport")
+	}
+	if transport.IsHandshake() {
+		t.Errorf("expected MessageTransport not to be a handshake")
+	}
+	if err := transport.SetReservedByte(1, 0x80); err != nil || transport.ReservedByte(1) != 0x80 || transport.Data[1] != 0x80 {
+		t.Errorf("failed to set reserved byte 1: %v", err)
+	}
+	if err := transport.SetReservedByte(4, 0x80); err == nil {
+		t.Errorf("expected an error of setting the byte 4 as a reserved byte")
+	}
+
+	// nothing panics on the short packets
+	for _, messageType := range []uint32{device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType, device.MessageTransportType} {
+		for length := 0; length < 16; length++ {
+			p := newPacket(messageType, length)
+			if length == 0 && p.MessageType() != -1 {
+				t.Errorf("expected message type -1 of an empty packet, got %d", p.MessageType())
+			}
+			_, senderErr := p.SenderIndex()
+			_, receiverErr := p.ReceiverIndex()
+			_, counterErr := p.Counter()
+			if length < 4 && (senderErr == nil || receiverErr == nil || counterErr == nil) {
+				t.Errorf("type %d, length %d: expected errors, got %v, %v, %v", messageType, length, senderErr, receiverErr, counterErr)
+			}
+			if p.ReservedByte(3) != 0 && length <= 3 {
+				t.Errorf("type %d, length %d: expected reserved byte 0", messageType, length)
+			}
+			if err := p.SetReservedByte(3, 1); (err == nil) != (length > 3) {
+				t.Errorf("type %d, length %d: unexpected result of setting reserved byte 3: %v", messageType, length, err)
+			}
+		}
+	}
+}
+
+func TestValidateMaxPacketSize(t *testing.T) {
+	for _, size := range []int{0, kMinMaxPacketSize, 1500, defaultMaxPacketSize} {
+		if err := validateMaxPacketSize(size); err != nil {
+			t.Errorf("max_packet_size %d is rejected: %s", size, err.Error())
+		}
+	}
+	for _, size := range []int{-1, kMinMaxPacketSize - 1, defaultMaxPacketSize + 1} {
+		if err := validateMaxPacketSize(size); err == nil {
+			t.Errorf("max_packet_size %d is accepted", size)
+		}
+	}
+}
+
+func TestPacketPool_Oversized(t *testing.T) {
+	pool := NewPacketPool(600)
+	p := pool.Get()
+	if len(p.Data) != 600 || len(p.readBuffer()) != 601 {
+		t.Fatalf("unexpected buffer size %d and read buffer size %d", len(p.Data), len(p.readBuffer()))
+	}
+	p.Length = 600
+	if p.isOversized() {
+		t.Errorf("packet of the max size is oversized")
+	}
+	p.Length = 601
+	if !p.isOversized() {
+		t.Errorf("packet larger than the max size is not oversized")
+	}
+	// deobfuscated to a shorter one
+	p.receivedLength, p.Length = 601, device.MessageInitiationSize
+	if !p.isOversized() {
+		t.Errorf("packet received larger than the max size is not oversized after deobfuscated")
+	}
+}
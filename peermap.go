@@ -0,0 +1,154 @@
+package mwgp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Forward Table Shards:
+//
+// The clientMap and the serverMap are looked up for every forwarded packet by the read workers at the same time,
+// a single lock around them is contended by hundreds of clients even if it is only read-locked, since every
+// RLock() writes to the same cache line. So each of them is split into ForwardTableShards shards by a hash of
+// the proxy index (the only thing a MessageTransport carries), each with its own lock, and the forwarding path
+// only locks the shard of the index it looks up, see peerMap.load.
+//
+// The handshakes, the sweep and the other changes still hold the mapLock, which keeps the clientMap, the serverMap
+// and the latestPeers consistent with each other. They also lock the shard while changing it, so the rules are:
+//
+//   - a change holds the mapLock for writing, and the lock of the shard it changes (done by peerMap);
+//   - a lookup or an iteration holds the mapLock, reading or writing, and no lock of any shard;
+//   - a single lookup might hold only the lock of the shard instead, by peerMap.load.
+
+const (
+	// defaultForwardTableShards is the number of the shards of each map by default,
+	// which is enough for a few dozen of cores.
+	defaultForwardTableShards = 64
+	// kForwardTableShardsMax is the max ForwardTableShards allowed in config.
+	kForwardTableShardsMax = 4096
+)
+
+// validateForwardTableShards checks the ForwardTableShards in config, 0 means the default.
+func validateForwardTableShards(n int) (err error) {
+	if n < 0 || n > kForwardTableShardsMax || n&(n-1) != 0 {
+		err = fmt.Errorf("forward_table_shards must be a power of two in [1, %d], got %d", kForwardTableShardsMax, n)
+		return
+	}
+	return
+}
+
+// peerMap is a map of the proxy index to the Peer split into shards, see "Forward Table Shards".
+type peerMap struct {
+	shards []peerMapShard
+	// shift is the number of the bits dropped from the hash to get the shard, so there are 1 << (32 - shift) shards.
+	shift uint
+}
+
+type peerMapShard struct {
+	lock  sync.RWMutex
+	peers map[uint32]*Peer
+	// keep the locks of the shards in different cache lines
+	_ [32]byte
+}
+
+// newPeerMap creates a peerMap of n shards, n is rounded up to a power of two.
+func newPeerMap(n int) (m *peerMap) {
+	m = &peerMap{shift: 32}
+	for 1<<(32-m.shift) < n && m.shift > 0 {
+		m.shift--
+	}
+	m.shards = make([]peerMapShard, 1<<(32-m.shift))
+	for i := range m.shards {
+		m.shards[i].peers = make(map[uint32]*Peer)
+	}
+	return
+}
+
+func (m *peerMap) shardOf(index uint32) *peerMapShard {
+	// the indexes are chosen by the clients, so mix the bits before taking the high ones (Fibonacci hashing)
+	return &m.shards[uint64(index*0x9e3779b1)>>m.shift]
+}
+
+// load looks up the index with only the lock of its shard, for the forwarding path.
+func (m *peerMap) load(index uint32) (peer *Peer, ok bool) {
+	shard := m.shardOf(index)
+	shard.lock.RLock()
+	peer, ok = shard.peers[index]
+	shard.lock.RUnlock()
+	return
+}
+
+// loadLocked looks up the index with the mapLock held.
+func (m *peerMap) loadLocked(index uint32) (peer *Peer, ok bool) {
+	peer, ok = m.shardOf(index).peers[index]
+	return
+}
+
+// storeLocked adds the peer with the mapLock held for writing.
+func (m *peerMap) storeLocked(index uint32, peer *Peer) {
+	shard := m.shardOf(index)
+	shard.lock.Lock()
+	shard.peers[index] = peer
+	shard.lock.Unlock()
+}
+
+// deleteLocked removes the index with the mapLock held for writing.
+func (m *peerMap) deleteLocked(index uint32) {
+	shard := m.shardOf(index)
+	shard.lock.Lock()
+	delete(shard.peers, index)
+	shard.lock.Unlock()
+}
+
+// lenLocked returns the number of the peers with the mapLock held.
+func (m *peerMap) lenLocked() (n int) {
+	for i := range m.shards {
+		n += len(m.shards[i].peers)
+	}
+	return
+}
+
+// rangeLocked calls f for each peer shard by shard until f returns false, with the mapLock held.
+// f might delete the peer it is called with (with the mapLock held for writing).
+func (m *peerMap) rangeLocked(f func(index uint32, peer *Peer) bool) {
+	for i := range m.shards {
+		for index, peer := range m.shards[i].peers {
+			if !f(index, peer) {
+				return
+			}
+		}
+	}
+}
+
+// clearLocked removes all the peers with the mapLock held for writing.
+func (m *peerMap) clearLocked() {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.lock.Lock()
+		shard.peers = make(map[uint32]*Peer)
+		shard.lock.Unlock()
+	}
+}
+
+// snapshotLocked copies the peers into a plain map with the mapLock held, such as for the cache.
+func (m *peerMap) snapshotLocked() (peers map[uint32]*Peer) {
+	peers = make(map[uint32]*Peer, m.lenLocked())
+	m.rangeLocked(func(index uint32, peer *Peer) bool {
+		peers[index] = peer
+		return true
+	})
+	return
+}
+
+// reshardLocked moves the peers into n shards, it must be called before the map is shared by other goroutines.
+func (m *peerMap) reshardLocked(n int) {
+	resharded := newPeerMap(n)
+	if len(resharded.shards) == len(m.shards) {
+		return
+	}
+	m.rangeLocked(func(index uint32, peer *Peer) bool {
+		resharded.storeLocked(index, peer)
+		return true
+	})
+	*m = *resharded
+}
@@ -0,0 +1,161 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestPeerMap(t *testing.T) {
+	for _, c := range []struct{ n, shards int }{{0, 1}, {1, 1}, {3, 4}, {64, 64}, {100, 128}} {
+		if m := newPeerMap(c.n); len(m.shards) != c.shards {
+			t.Errorf("newPeerMap(%d): expected %d shards, got %d", c.n, c.shards, len(m.shards))
+		}
+	}
+
+	m := newPeerMap(8)
+	peers := make(map[uint32]*Peer)
+	for i := 0; i < 1000; i++ {
+		index := rand.Uint32()
+		peers[index] = &Peer{clientProxyIndex: index}
+		m.storeLocked(index, peers[index])
+	}
+	for index, peer := range peers {
+		if loaded, ok := m.load(index); !ok || loaded != peer {
+			t.Fatalf("index %08x: expected the stored peer", index)
+		}
+	}
+	used := 0
+	for i := range m.shards {
+		if len(m.shards[i].peers) > 0 {
+			used++
+		}
+	}
+	if used != len(m.shards) {
+		t.Errorf("expected the peers spread over %d shards, got %d", len(m.shards), used)
+	}
+
+	// delete while ranging, as the sweep does
+	m.rangeLocked(func(index uint32, peer *Peer) bool {
+		if index%2 == 0 {
+			m.deleteLocked(index)
+		}
+		return true
+	})
+	for index := range peers {
+		if _, ok := m.loadLocked(index); ok != (index%2 != 0) {
+			t.Fatalf("index %08x: expected in map %t, got %t", index, index%2 != 0, ok)
+		}
+	}
+
+	n := m.lenLocked()
+	m.reshardLocked(32)
+	if len(m.shards) != 32 || m.lenLocked() != n {
+		t.Errorf("expected %d peers in 32 shards, got %d peers in %d shards", n, m.lenLocked(), len(m.shards))
+	}
+	if snapshot := m.snapshotLocked(); len(snapshot) != n {
+		t.Errorf("expected %d peers in the snapshot, got %d", n, len(snapshot))
+	}
+	m.clearLocked()
+	if m.lenLocked() != 0 {
+		t.Errorf("expected no peer after clearLocked()")
+	}
+}
+
+func TestValidateForwardTableShards(t *testing.T) {
+	for _, n := range []int{0, 1, 64, kForwardTableShardsMax} {
+		if err := validateForwardTableShards(n); err != nil {
+			t.Errorf("%d: %s", n, err.Error())
+		}
+	}
+	for _, n := range []int{-1, 3, 100, 2 * kForwardTableShardsMax} {
+		if err := validateForwardTableShards(n); err == nil {
+			t.Errorf("%d: expected an error", n)
+		}
+	}
+}
+
+// BenchmarkWireGuardIndexTranslationTable_Contention forwards the packets of 10k sessions and creates new ones
+// from 64 goroutines, compare the shards=1 one (a single lock) with the others.
+func BenchmarkWireGuardIndexTranslationTable_Contention(b *testing.B) {
+	const (
+		goroutines = 64
+		sessions   = 10000
+		// one of them is a new handshake, others are the MessageTransport to look up
+		handshakeEvery = 100
+	)
+	for _, shards := range []int{1, 16, defaultForwardTableShards, 256} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			var clientPK NoisePublicKey
+			table := NewWireGuardIndexTranslationTable()
+			table.Logger = NewStdLogger(LogLevelError)
+			table.clientMap.reshardLocked(shards)
+			table.serverMap.reshardLocked(shards)
+			table.setActiveTimeout(table.Timeout)
+			serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}
+			table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+				fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: serverAddr}
+				return
+			}
+			var sender uint32
+			var senderLock sync.Mutex
+			handshake := func() (peer *Peer) {
+				senderLock.Lock()
+				sender++
+				index := sender
+				senderLock.Unlock()
+				src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(index)), Port: int(index)}
+				peer, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: index})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = table.processServerMessageResponse(serverAddr, &device.MessageResponse{Sender: index, Receiver: peer.clientProxyIndex}); err != nil {
+					b.Fatal(err)
+				}
+				return
+			}
+			packets := make([]*Packet, 0, 2*sessions)
+			for i := 0; i < sessions; i++ {
+				peer := handshake()
+				for _, s2c := range []bool{false, true} {
+					packet := &Packet{Data: make([]byte, device.MessageTransportSize), Length: device.MessageTransportSize}
+					binary.LittleEndian.PutUint32(packet.Data, device.MessageTransportType)
+					if s2c {
+						binary.LittleEndian.PutUint32(packet.Data[4:], peer.clientProxyIndex)
+						packet.Source = serverAddr
+					} else {
+						binary.LittleEndian.PutUint32(packet.Data[4:], peer.serverProxyIndex)
+						packet.Source = peer.clientDestination
+					}
+					packets = append(packets, packet)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; i < b.N; i += goroutines {
+						if i%handshakeEvery == 0 {
+							handshake()
+							continue
+						}
+						packet := packets[i%len(packets)]
+						if _, err := table.processMessageTransport(packet, i%2 == 1); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package mwgp
+
+import (
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Path MTU Discovery:
+//
+// The random suffix of the handshakes and the padding of the MessageTransport make the packets to mwgp-server
+// larger than the ones WireGuard sent, so that they might exceed the path MTU even if the MTU of WireGuard is right.
+// Such packets are fragmented, or silently dropped on the paths dropping the fragments,
+// and the handshakes then only work sometimes.
+//
+// With the PathMTUDiscovery (the pmtu_discovery of mwgp-client), the DF bit is set on the UDP sockets to the servers
+// (IP_PMTUDISC_DO of IP_MTU_DISCOVER and IPV6_MTU_DISCOVER), so that the kernel fails the write of a packet larger
+// than the path MTU it learned from the ICMP "fragmentation needed" with EMSGSIZE, instead of fragmenting it.
+//
+//   - Once a packet to server fails with EMSGSIZE, a ceiling of the obfuscated packet length is learned for its
+//     upstreamConn (the destination of the forward entries), which halves the padding (or the random suffix)
+//     of the packet, and the packet is obfuscated and written again within the ceiling, up to kPathMTURetryMax times.
+//   - The later packets to the same destination are padded within the ceiling, which rises by kPathMTUDecayStep bytes
+//     every kPathMTUDecayInterval back toward the configured max_length, in case the path MTU has grown.
+//   - The WireGuard payload is never truncated, a packet still too large without the padding is dropped as before,
+//     which can only be fixed by lowering the MTU of WireGuard.
+//
+// The obfuscation changes only the WireGuard message header in place (at most a MessageInitiation),
+// so that is all saved before the write to obfuscate the packet again, see pathMTUSnapshot.
+
+const (
+	// kPathMTURetryMax is the max number of times a packet failed with EMSGSIZE is written again.
+	kPathMTURetryMax = 4
+
+	// kPathMTUDecayStep and kPathMTUDecayInterval are how fast the learned ceiling rises back.
+	kPathMTUDecayStep     = 32
+	kPathMTUDecayInterval = 30 * time.Second
+)
+
+// setSocketDontFragmentFunc sets the DF bit on the socket, it is replaced in tests.
+var setSocketDontFragmentFunc = setSocketDontFragment
+
+// pathMTUDiscoveryControl returns the control function setting the DF bit on the UDP sockets,
+// nil without the PathMTUDiscovery, see "Path MTU Discovery".
+func (t *WireGuardIndexTranslationTable) pathMTUDiscoveryControl() socketControlFunc {
+	if !t.PathMTUDiscovery {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) (err error) {
+		if !strings.HasPrefix(network, "udp") {
+			return
+		}
+		cerr := c.Control(func(fd uintptr) {
+			err = setSocketDontFragmentFunc(fd, network)
+		})
+		if cerr != nil {
+			err = cerr
+		}
+		return
+	}
+}
+
+// isMessageTooLongError reports whether the write failed since the packet is larger than the path MTU.
+func isMessageTooLongError(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// pathMTUSnapshot is the part of a packet to server changed by the obfuscation, saved before it is written.
+type pathMTUSnapshot struct {
+	packet *Packet
+	length int
+	header [device.MessageInitiationSize]byte
+}
+
+// save saves the packet and clamps its padding to the ceiling learned for its upstream.
+func (s *pathMTUSnapshot) save(packet *Packet, now time.Time) {
+	s.packet = packet
+	s.length = packet.Length
+	copy(s.header[:], packet.Data[:packet.Length])
+	if packet.upstream != nil {
+		packet.maxLength = packet.upstream.paddingCeiling(now)
+	}
+}
+
+// restore reverts the packet to the one before it is obfuscated.
+func (s *pathMTUSnapshot) restore() {
+	copy(s.packet.Data[:s.length], s.header[:])
+	s.packet.Length = s.length
+}
+
+// paddingCeiling returns the max length of the obfuscated packets to the upstream learned by the
+// "Path MTU Discovery" and risen back by now, 0 if it is not limited.
+func (uc *upstreamConn) paddingCeiling(now time.Time) (ceiling int) {
+	learnedAt := atomic.LoadInt64(&uc.pathMTULearnedAt)
+	if learnedAt == 0 {
+		return
+	}
+	risen := int64(0)
+	if elapsed := now.UnixNano() - learnedAt; elapsed > 0 {
+		risen = elapsed / int64(kPathMTUDecayInterval) * kPathMTUDecayStep
+	}
+	if learned := int64(atomic.LoadInt32(&uc.pathMTUCeiling)); learned+risen < defaultMaxPacketSize {
+		ceiling = int(learned + risen)
+	}
+	return
+}
+
+// lowerPaddingCeiling sets the learned ceiling of the upstream if it is lower than the current one,
+// it is only called by the writeLoop.
+func (uc *upstreamConn) lowerPaddingCeiling(ceiling int, now time.Time) {
+	if current := uc.paddingCeiling(now); current != 0 && current <= ceiling {
+		return
+	}
+	atomic.StoreInt32(&uc.pathMTUCeiling, int32(ceiling))
+	atomic.StoreInt64(&uc.pathMTULearnedAt, now.UnixNano())
+}
+
+// savePathMTUSnapshots saves the packets to server before they are written, nil without the PathMTUDiscovery.
+func (t *WireGuardIndexTranslationTable) savePathMTUSnapshots(packets ...*Packet) (snapshots []pathMTUSnapshot) {
+	if !t.PathMTUDiscovery {
+		return
+	}
+	if len(t.pathMTUSnapshots) < len(packets) {
+		t.pathMTUSnapshots = make([]pathMTUSnapshot, len(packets))
+	}
+	snapshots = t.pathMTUSnapshots[:len(packets)]
+	now := time.Now()
+	for i, packet := range packets {
+		snapshots[i].save(packet, now)
+	}
+	return
+}
+
+// retryPathMTU writes the packet to server again with less padding while it fails with EMSGSIZE,
+// lowering the ceiling of its upstream each time, and returns the error of the last write, see "Path MTU Discovery".
+func (t *WireGuardIndexTranslationTable) retryPathMTU(snapshot *pathMTUSnapshot, err error) error {
+	packet := snapshot.packet
+	for i := 0; i < kPathMTURetryMax && isMessageTooLongError(err) && packet.upstream != nil; i++ {
+		failed := packet.Length
+		ceiling := snapshot.length + (failed-snapshot.length)/2
+		if ceiling >= failed {
+			break
+		}
+		packet.upstream.lowerPaddingCeiling(ceiling, time.Now())
+		atomic.AddUint64(&t.stats.pathMTURetries, 1)
+		t.logPacketf(LogLevelDebug, "packet of %d bytes to server dest=%s exceeds the path MTU, retry within %d bytes",
+			failed, packet.Destination.String(), ceiling)
+		snapshot.restore()
+		packet.maxLength = ceiling
+		err = t.writeSafely("server", t.ServerWriteFunc, packet.transport, packet)
+		if packet.Length >= failed {
+			// no padding left to remove
+			break
+		}
+	}
+	return err
+}
+
+// retryPathMTUBatch writes the failed packets of the batch to server again one by one after the batch failed
+// with EMSGSIZE, within the ceiling learned on the way, and returns the number of the packets still failed
+// and the last error. The failed packets are told apart by their writeFailed, since the batch writes skip them.
+func (t *WireGuardIndexTranslationTable) retryPathMTUBatch(snapshots []pathMTUSnapshot, failed int, err error) (int, error) {
+	if !isMessageTooLongError(err) {
+		return failed, err
+	}
+	failed, err = 0, nil
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		packet := snapshot.packet
+		if !packet.writeFailed {
+			continue
+		}
+		packet.writeFailed = false
+		snapshot.restore()
+		snapshot.save(packet, time.Now())
+		werr := t.writeSafely("server", t.ServerWriteFunc, packet.transport, packet)
+		if werr = t.retryPathMTU(snapshot, werr); werr != nil {
+			packet.writeFailed = true
+			failed++
+			err = werr
+		}
+	}
+	return failed, err
+}
@@ -0,0 +1,23 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+const pathMTUDiscoverySupported = true
+
+// setSocketDontFragment sets the IP_MTU_DISCOVER to IP_PMTUDISC_DO, and the IPV6_MTU_DISCOVER for IPv6 sockets.
+// A dual-stack socket sends IPv4 packets with the IP_MTU_DISCOVER, so both are set on it.
+func setSocketDontFragment(fd uintptr, network string) (err error) {
+	if !strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+	}
+	err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+	if err != nil {
+		return
+	}
+	// fails on an IPV6_V6ONLY socket
+	_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+	return
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package mwgp
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const pathMTUDiscoverySupported = false
+
+func setSocketDontFragment(fd uintptr, network string) (err error) {
+	err = fmt.Errorf("IP_MTU_DISCOVER is not supported on %s", runtime.GOOS)
+	return
+}
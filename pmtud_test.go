@@ -0,0 +1,235 @@
+package mwgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pathMTUTransport fails the writes of the packets larger than the mtu with EMSGSIZE,
+// as a socket with the DF bit does once the kernel learns the path MTU.
+type pathMTUTransport struct {
+	mtu     int
+	written [][]byte
+	failed  int
+}
+
+func (t *pathMTUTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	err = net.ErrClosed
+	return
+}
+
+func (t *pathMTUTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	if packet.Length > t.mtu {
+		t.failed++
+		err = &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.EMSGSIZE)}
+		return
+	}
+	t.written = append(t.written, append([]byte(nil), packet.Slice()...))
+	return
+}
+
+func (t *pathMTUTransport) Close() (err error) {
+	return
+}
+
+// newPathMTUTestTable returns a table writing to server with the obfuscator as mwgp-client does,
+// and the obfuscated batches are written as writeBatchToUDP does, which skips the failed packets.
+func newPathMTUTestTable(obfuscator *WireGuardObfuscator) (table *WireGuardIndexTranslationTable) {
+	table = NewWireGuardIndexTranslationTable()
+	table.Logger = &testLogger{}
+	table.PathMTUDiscovery = true
+	table.ServerWriteFunc = func(transport PacketTransport, packet *Packet) (err error) {
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		return obfuscator.WritePacketWithObfuscate(transport, packet)
+	}
+	table.ServerWriteBatchFunc = func(transport PacketTransport, packets []*Packet) (failed int, err error) {
+		for _, packet := range packets {
+			packet.Flags |= PacketFlagObfuscateBeforeSend
+		}
+		return obfuscator.WriteBatchWithObfuscate(transport, packets)
+	}
+	obfuscator.WriteBatchFunc = func(transport PacketTransport, packets []*Packet) (failed int, err error) {
+		for _, packet := range packets {
+			if werr := transport.WritePacket(packet, nil); werr != nil {
+				packet.writeFailed = true
+				failed++
+				err = werr
+			}
+		}
+		return
+	}
+	return
+}
+
+func newPathMTUTestPacket(transport *pathMTUTransport, upstream *upstreamConn, messageType byte, length int) (packet *Packet) {
+	packet = newBatchTestPackets(1)[0]
+	_, _ = rand.Read(packet.Data[:length])
+	binary.LittleEndian.PutUint32(packet.Data, uint32(messageType))
+	if messageType == device.MessageInitiationType {
+		// as mwgp-client sends it without the cookie
+		copy(packet.Data[kMessageInitiationTypeMAC2Offset:length], make([]byte, length))
+	}
+	packet.Length = length
+	packet.Destination = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	packet.transport = transport
+	packet.upstream = upstream
+	return
+}
+
+func TestWireGuardIndexTranslationTable_PathMTUDiscovery(t *testing.T) {
+	const mtu = 1000
+	for _, batchSize := range []int{1, 3} {
+		var obfuscator WireGuardObfuscator
+		obfuscator.Initialize("long enough password")
+		obfuscator.Padding = &ObfuscatePaddingConfig{MinLength: 1400}
+		table := newPathMTUTestTable(&obfuscator)
+		transport := &pathMTUTransport{mtu: mtu}
+		upstream := &upstreamConn{transport: transport}
+
+		var originals [][]byte
+		write := func(packets ...*Packet) {
+			for _, packet := range packets {
+				originals = append(originals, append([]byte(nil), packet.Slice()...))
+			}
+			if batchSize == 1 {
+				for _, packet := range packets {
+					table.writeServerPacket(packet)
+				}
+			} else {
+				table.writeBatch("server", nil, table.ServerWriteBatchFunc, packets)
+			}
+		}
+		var packets []*Packet
+		for i := 0; i < batchSize; i++ {
+			packets = append(packets, newPathMTUTestPacket(transport, upstream, device.MessageTransportType, 100))
+		}
+		write(packets...)
+		// the first failed packet of a batch is written again as it is before its padding is halved,
+		// and the rest of them within the ceiling learned
+		expected := 1
+		if batchSize > 1 {
+			expected = batchSize + 1
+		}
+		if transport.failed != expected {
+			t.Errorf("batch=%d: expected %d failed writes, got %d", batchSize, expected, transport.failed)
+		}
+		if ceiling := upstream.paddingCeiling(time.Now()); ceiling != 750 {
+			t.Errorf("batch=%d: expected the padding halved to 750 bytes, got %d", batchSize, ceiling)
+		}
+
+		// the random suffix of a handshake (up to 547 bytes) is halved until it fits
+		for i := 0; i < 8; i++ {
+			transport.mtu = device.MessageInitiationSize + kObfuscateNonceLength + 66
+			write(newPathMTUTestPacket(transport, upstream, device.MessageInitiationType, device.MessageInitiationSize))
+		}
+		transport.mtu = mtu
+
+		// never truncated
+		write(newPathMTUTestPacket(transport, upstream, device.MessageTransportType, mtu+1))
+		stats := table.Stats()
+		if stats.WriteErrors != 1 {
+			t.Errorf("batch=%d: expected the packet too large without padding failed, got %d", batchSize, stats.WriteErrors)
+		}
+		if stats.PathMTURetries == 0 {
+			t.Errorf("batch=%d: expected the retries counted", batchSize)
+		}
+
+		if len(transport.written) != len(originals)-1 {
+			t.Fatalf("batch=%d: expected %d packets written, got %d", batchSize, len(originals)-1, len(transport.written))
+		}
+		for i, data := range transport.written {
+			packet := Packet{Data: make([]byte, 2048), Length: len(data)}
+			copy(packet.Data, data)
+			obfuscator.Deobfuscate(&packet)
+			if packet.Flags&PacketFlagDropped != 0 || !bytes.Equal(packet.Slice(), originals[i]) {
+				t.Errorf("batch=%d: packet %d is not deobfuscated into the original", batchSize, i)
+			}
+		}
+	}
+}
+
+func TestUpstreamConn_PaddingCeiling(t *testing.T) {
+	var uc upstreamConn
+	now := time.Now()
+	if ceiling := uc.paddingCeiling(now); ceiling != 0 {
+		t.Fatalf("expected no ceiling, got %d", ceiling)
+	}
+	uc.lowerPaddingCeiling(1000, now)
+	uc.lowerPaddingCeiling(1100, now)
+	if ceiling := uc.paddingCeiling(now); ceiling != 1000 {
+		t.Errorf("expected the ceiling 1000, got %d", ceiling)
+	}
+	if ceiling := uc.paddingCeiling(now.Add(2*kPathMTUDecayInterval + time.Second)); ceiling != 1000+2*kPathMTUDecayStep {
+		t.Errorf("expected the ceiling risen to %d, got %d", 1000+2*kPathMTUDecayStep, ceiling)
+	}
+	later := now.Add(kPathMTUDecayInterval)
+	uc.lowerPaddingCeiling(1010, later)
+	if ceiling := uc.paddingCeiling(later); ceiling != 1010 {
+		t.Errorf("expected the ceiling lowered to 1010, got %d", ceiling)
+	}
+	if ceiling := uc.paddingCeiling(later.Add(24 * time.Hour)); ceiling != 0 {
+		t.Errorf("expected the ceiling risen back to unlimited, got %d", ceiling)
+	}
+}
+
+func TestWireGuardObfuscator_PacketMaxLength(t *testing.T) {
+	for _, authenticated := range []bool{false, true} {
+		var o WireGuardObfuscator
+		o.Initialize("long enough password")
+		o.Authenticated = authenticated
+		o.Padding = &ObfuscatePaddingConfig{MinLength: 1400, MaxRandomTail: 100}
+		for _, c := range []struct {
+			messageType byte
+			length      int
+			maxLength   int
+			expected    int
+		}{
+			{device.MessageInitiationType, device.MessageInitiationSize, 1, device.MessageInitiationSize + kObfuscateNonceLength},
+			{device.MessageTransportType, 100, 600, 600},
+			{device.MessageTransportType, 100, 0, 1400},
+		} {
+			for i := 0; i < 16; i++ {
+				packet := newPathMTUTestPacket(nil, nil, c.messageType, c.length)
+				packet.maxLength = c.maxLength
+				packet.Flags |= PacketFlagObfuscateBeforeSend
+				o.Obfuscate(packet)
+				expected := c.expected
+				if authenticated && c.messageType == device.MessageInitiationType {
+					expected += kObfuscateTagLength
+				}
+				if packet.Length < expected || c.maxLength > 1 && packet.Length > c.maxLength {
+					t.Errorf("authenticated=%v: expected type %d of %d bytes obfuscated within %d bytes, got %d",
+						authenticated, c.messageType, c.length, c.maxLength, packet.Length)
+				}
+			}
+		}
+	}
+}
+
+func TestClientConfig_ValidatePathMTUDiscovery(t *testing.T) {
+	config := ClientConfig{
+		Listen:           ListenAddresses{"127.0.0.1:0"},
+		Server:           "127.0.0.1:1",
+		Transport:        TransportTCP,
+		PathMTUDiscovery: true,
+	}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "pmtu_discovery") {
+		t.Errorf("expected pmtu_discovery rejected, got %v", err)
+	}
+	config.Transport = ""
+	err = config.Validate()
+	if pathMTUDiscoverySupported && err != nil {
+		t.Error(err)
+	} else if !pathMTUDiscoverySupported && err == nil {
+		t.Error("expected pmtu_discovery rejected")
+	}
+}
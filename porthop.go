@@ -0,0 +1,174 @@
+package mwgp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHopInterval = 30 * time.Second
+	kHopIntervalMax    = time.Hour
+
+	// kListenPortRangeMax is the max number of the ports listened by mwgp-server,
+	// a larger range should be redirected to a single port with a NAT rule instead.
+	kListenPortRangeMax = 1024
+)
+
+// splitPortRange splits the "host:min-max" into the "host:min" and the max.
+// The portMax is 0 if the hostport is not a port range.
+func splitPortRange(hostport string) (base string, portMax int, err error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || !strings.Contains(port, "-") {
+		base, err = hostport, nil
+		return
+	}
+	minString, maxString, _ := strings.Cut(port, "-")
+	portMin, err := strconv.Atoi(minString)
+	if err == nil {
+		portMax, err = strconv.Atoi(maxString)
+	}
+	if err != nil || portMin < 1 || portMax > 65535 || portMin >= portMax {
+		err = fmt.Errorf("invalid port range %q", port)
+		return
+	}
+	base = net.JoinHostPort(host, minString)
+	return
+}
+
+// resolveListenPortRange resolves the listen address of mwgp-server, which might be a port range.
+func resolveListenPortRange(listen string) (addr *net.UDPAddr, portMax int, err error) {
+	base, portMax, err := splitPortRange(listen)
+	if err != nil {
+		err = fmt.Errorf("invalid listen address %s: %w", listen, err)
+		return
+	}
+	addr, err = net.ResolveUDPAddr("udp", base)
+	if err != nil {
+		err = fmt.Errorf("invalid listen address %s: %w", listen, err)
+		return
+	}
+	if portMax != 0 && portMax-addr.Port+1 > kListenPortRangeMax {
+		err = fmt.Errorf("listen port range %s exceeds %d ports, redirect it to a single port with a NAT rule instead", listen, kListenPortRangeMax)
+		return
+	}
+	return
+}
+
+// portHopTransport is the PacketTransport of mwgp-client to a server port range,
+// it switches the destination port to a random one in the range every interval,
+// and keeps using the same local socket, so the server still sees the same client.
+//
+// The packets from any port in the range are read with the addr (the first port) as the source,
+// so that the hops are invisible to the forward table.
+type portHopTransport struct {
+	conn     *net.UDPConn
+	addr     netip.AddrPort
+	portMax  uint16
+	interval time.Duration
+	logger   Logger
+
+	// port is the current destination port
+	port uint32
+
+	// preserveTOS reads and writes the packets with their TOS, see "ToS Preservation".
+	preserveTOS bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ PacketTransport = (*portHopTransport)(nil)
+
+func newPortHopTransport(conn *net.UDPConn, addr *net.UDPAddr, portMax int, interval time.Duration, logger Logger) (t *portHopTransport) {
+	t = &portHopTransport{
+		conn:     conn,
+		addr:     upstreamKey(addr),
+		portMax:  uint16(portMax),
+		interval: interval,
+		logger:   logger,
+		closed:   make(chan struct{}),
+	}
+	t.port = uint32(t.randomPort())
+	go t.hopLoop()
+	return
+}
+
+// randomPort returns a random port in the range other than the current one.
+func (t *portHopTransport) randomPort() uint16 {
+	portMin := t.addr.Port()
+	n := int(t.portMax-portMin) + 1
+	current := atomic.LoadUint32(&t.port)
+	for {
+		port := portMin + uint16(rand.Intn(n))
+		if uint32(port) != current || n == 1 {
+			return port
+		}
+	}
+}
+
+func (t *portHopTransport) hopLoop() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			port := t.randomPort()
+			atomic.StoreUint32(&t.port, uint32(port))
+			t.logger.Debugf("port hopping: destination of %s changed to port %d", t.addr, port)
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// currentPort returns the destination port the packets are written to.
+func (t *portHopTransport) currentPort() uint16 {
+	return uint16(atomic.LoadUint32(&t.port))
+}
+
+// ReadPacket drops the packets from outside of the port range.
+func (t *portHopTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	for {
+		var source netip.AddrPort
+		if t.preserveTOS {
+			source, err = readMsgUDPWithTOS(t.conn, packet)
+		} else {
+			packet.Length, source, err = t.conn.ReadFromUDPAddrPort(packet.readBuffer())
+		}
+		if err != nil {
+			return
+		}
+		if source.Addr().Unmap() != t.addr.Addr() || source.Port() < t.addr.Port() || source.Port() > t.portMax {
+			continue
+		}
+		packet.setSourceAddrPort(t.addr)
+		addr = packet.Source
+		return
+	}
+}
+
+// WritePacket ignores the addr, the packet is written to the current port.
+func (t *portHopTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	dst := netip.AddrPortFrom(t.addr.Addr(), t.currentPort())
+	if t.preserveTOS && packet.hasTOS {
+		err = writeMsgUDPWithTOS(t.conn, packet, dst, dst.Addr())
+		return
+	}
+	_, err = t.conn.WriteToUDPAddrPort(packet.Slice(), dst)
+	return
+}
+
+func (t *portHopTransport) Close() (err error) {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.conn.Close()
+	})
+	return
+}
@@ -0,0 +1,163 @@
+package mwgp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSplitPortRange(t *testing.T) {
+	for _, c := range []struct {
+		hostport string
+		base     string
+		portMax  int
+		invalid  bool
+	}{
+		{hostport: "example.com:1000", base: "example.com:1000"},
+		{hostport: "example.com:20000-30000", base: "example.com:20000", portMax: 30000},
+		{hostport: "[2001:db8::1]:20000-20010", base: "[2001:db8::1]:20000", portMax: 20010},
+		{hostport: ":1000-1001", base: ":1000", portMax: 1001},
+		{hostport: "example.com:2000-1000", invalid: true},
+		{hostport: "example.com:1000-1000", invalid: true},
+		{hostport: "example.com:0-1000", invalid: true},
+		{hostport: "example.com:1000-65536", invalid: true},
+		{hostport: "example.com:a-b", invalid: true},
+	} {
+		base, portMax, err := splitPortRange(c.hostport)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.hostport)
+			}
+			continue
+		}
+		if err != nil || base != c.base || portMax != c.portMax {
+			t.Errorf("%s: expected %s and %d, got %s and %d (%v)", c.hostport, c.base, c.portMax, base, portMax, err)
+		}
+	}
+
+	if _, _, err := resolveListenPortRange(":1000-3000"); err == nil {
+		t.Errorf("expected an error of too many ports")
+	}
+}
+
+// e2eFreeUDPPortRange returns a range of n free UDP ports on the loopback.
+func e2eFreeUDPPortRange(tb testing.TB, n int) (portMin int) {
+	for attempt := 0; attempt < 20; attempt++ {
+		portMin = e2eFreeUDPPortRangeAttempt(n)
+		if portMin != 0 {
+			return
+		}
+	}
+	tb.Fatalf("no %d consecutive free UDP ports", n)
+	return
+}
+
+func e2eFreeUDPPortRangeAttempt(n int) (portMin int) {
+	first, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	conns := []*net.UDPConn{first}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	port := first.LocalAddr().(*net.UDPAddr).Port
+	if port+n-1 > 65535 {
+		return
+	}
+	for i := 1; i < n; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + i})
+		if err != nil {
+			return
+		}
+		conns = append(conns, conn)
+	}
+	portMin = port
+	return
+}
+
+func TestEndToEndPortHopping(t *testing.T) {
+	const obfsKey = "port hopping"
+	const ports = 4
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	portMin := e2eFreeUDPPortRange(t, ports)
+	mwgpServerListen := fmt.Sprintf("127.0.0.1:%d-%d", portMin, portMin+ports-1)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		HopInterval:     Duration(100 * time.Millisecond),
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+
+	var hop *portHopTransport
+	client.wgitTable.upstreamConnsLock.RLock()
+	for _, uc := range client.wgitTable.upstreamConns {
+		hop = uc.transport.(*portHopTransport)
+	}
+	client.wgitTable.upstreamConnsLock.RUnlock()
+
+	used := map[uint16]bool{}
+	for i := 0; i < 3; i++ {
+		port := hop.currentPort()
+		deadline := time.Now().Add(5 * time.Second)
+		for hop.currentPort() == port {
+			if time.Now().After(deadline) {
+				t.Fatalf("destination port %d is not switched", port)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		wgClient.ping(t, wgServer)
+		wgServer.ping(t, wgClient)
+		used[hop.currentPort()] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("expected at least 2 destination ports used, got %v", used)
+	}
+	if stats := server.Stats(); stats.TotalSessionsCreated != 1 {
+		t.Errorf("expected the session to be kept across the hops, got %d sessions created", stats.TotalSessionsCreated)
+	}
+}
@@ -0,0 +1,463 @@
+package mwgp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ObfuscateProtocolVersion is the version of the obfuscated wire format spoken by this build.
+// It must be bumped whenever the obfuscated packets become unreadable by older builds,
+// so that the preflight can tell the users which end to upgrade,
+// along with the vectors in testdata/obfs_golden.json locking the wire format.
+const ObfuscateProtocolVersion = 1
+
+// Preflight:
+//
+// With "preflight" enabled on both ends, mwgp-client sends a preflight request to a server destination
+// before forwarding the first MessageInitiation to it, and mwgp-server replies whether it accepts
+// the obfuscation settings of the client, so that a mismatch is logged precisely instead of
+// the handshakes timing out silently.
+//
+// The preflight messages are shaped as obfuscated MessageCookieReply (with the random suffix),
+// but obfuscated in the xor mode with a key derived from the WireGuard public key of the server,
+// so that they can be read even if the obfuscation keys or modes of both ends are mismatched.
+// They look the same as the data packets for anyone who does not know the server public key.
+//
+// The layout of the deobfuscated message is frozen, it must be readable by every version:
+//
+//	[0:4]   MessageCookieReplyType
+//	[4:12]  kPreflightMagic
+//	[12]    kind, kPreflightKindRequest or kPreflightKindReply
+//	[13]    ObfuscateProtocolVersion of the sender
+//	[14]    obfuscation mode of the sender, kPreflightMode*
+//	[15]    result, kPreflightResult* (reply only)
+//	[16:24] random nonce of the request, echoed in the reply
+//	[24:28] primary key fingerprint of the sender, zeros if the obfuscation is disabled
+//	[28:64] reserved, zeros
+
+const (
+	kPreflightKeyContext = "mwgp preflight"
+	kPreflightMagic      = "mwgp-pfl"
+
+	kPreflightKindRequest = 1
+	kPreflightKindReply   = 2
+
+	kPreflightModeDisabled      = 0
+	kPreflightModeXOR           = 1
+	kPreflightModeAuthenticated = 2
+
+	kPreflightResultAccept = 0
+	// kPreflightResultSecondaryKey accepts the client key, but only as a secondary key.
+	kPreflightResultSecondaryKey    = 1
+	kPreflightResultVersionMismatch = 2
+	kPreflightResultModeMismatch    = 3
+	kPreflightResultKeyMismatch     = 4
+
+	kPreflightNonceLength = 8
+
+	// kPreflightPacketSize is the max length of an obfuscated preflight message.
+	kPreflightPacketSize = device.MessageCookieReplySize + kObfuscateNonceLength + kObfuscateRandomSuffixMaxLength
+
+	// kPreflightAttempts requests are sent kPreflightAttemptTimeout apart before the preflight times out.
+	kPreflightAttempts       = 3
+	kPreflightAttemptTimeout = time.Second
+
+	// the result of a server destination is cached for kPreflightPassedTTL if the handshakes are forwarded,
+	// or kPreflightFailedTTL if they are dropped, so that a fixed config is picked up soon.
+	kPreflightPassedTTL = 10 * time.Minute
+	kPreflightFailedTTL = 10 * time.Second
+)
+
+// preflightMessage is the deobfuscated preflight request or reply.
+type preflightMessage struct {
+	kind        byte
+	version     byte
+	mode        byte
+	result      byte
+	nonce       [kPreflightNonceLength]byte
+	fingerprint [kObfuscateKeyFingerprintLength]byte
+}
+
+func (m *preflightMessage) marshal(packet *Packet) {
+	b := packet.Data[:device.MessageCookieReplySize]
+	for i := range b {
+		b[i] = 0
+	}
+	b[0] = device.MessageCookieReplyType
+	copy(b[4:12], kPreflightMagic)
+	b[12] = m.kind
+	b[13] = m.version
+	b[14] = m.mode
+	b[15] = m.result
+	copy(b[16:24], m.nonce[:])
+	copy(b[24:28], m.fingerprint[:])
+	packet.Length = device.MessageCookieReplySize
+}
+
+// unmarshal reports whether the deobfuscated packet is a preflight message.
+func (m *preflightMessage) unmarshal(packet *Packet) bool {
+	if packet.Flags&PacketFlagDeobfuscatedAfterReceived == 0 || packet.Length != device.MessageCookieReplySize {
+		return false
+	}
+	b := packet.Data[:device.MessageCookieReplySize]
+	if b[0] != device.MessageCookieReplyType || string(b[4:12]) != kPreflightMagic {
+		return false
+	}
+	m.kind = b[12]
+	m.version = b[13]
+	m.mode = b[14]
+	m.result = b[15]
+	copy(m.nonce[:], b[16:24])
+	copy(m.fingerprint[:], b[24:28])
+	return true
+}
+
+// newPreflightObfuscator returns the obfuscator of the preflight messages to the server with the public key.
+func newPreflightObfuscator(serverPublicKey NoisePublicKey) (o *WireGuardObfuscator) {
+	h := sha256.New()
+	h.Write([]byte(kPreflightKeyContext))
+	h.Write(serverPublicKey.NoisePublicKey[:])
+	o = &WireGuardObfuscator{}
+	o.SetKey(h.Sum(nil))
+	return
+}
+
+// decodePreflight deobfuscates a copy of the packet with the preflight obfuscator into the msg,
+// the packet itself is not modified.
+func decodePreflight(o *WireGuardObfuscator, packet *Packet, buffer *Packet, msg *preflightMessage) bool {
+	if packet.Length > len(buffer.Data) {
+		return false
+	}
+	buffer.Length = copy(buffer.Data, packet.Slice())
+	buffer.Flags = 0
+	o.Deobfuscate(buffer)
+	return msg.unmarshal(buffer)
+}
+
+// sendPreflight obfuscates the msg with the preflight obfuscator and writes it to the addr.
+func sendPreflight(o *WireGuardObfuscator, transport PacketTransport, addr *net.UDPAddr, msg *preflightMessage) (err error) {
+	packet := &Packet{Data: make([]byte, kPreflightPacketSize)}
+	msg.marshal(packet)
+	packet.Flags |= PacketFlagObfuscateBeforeSend
+	packet.Destination = addr
+	err = o.WritePacketWithObfuscate(transport, packet)
+	return
+}
+
+// preflightLocalParams returns the mode and the primary key fingerprint of the obfuscator.
+func preflightLocalParams(o *WireGuardObfuscator) (mode byte, fingerprint [kObfuscateKeyFingerprintLength]byte) {
+	key := o.loadKey()
+	if key == nil {
+		mode = kPreflightModeDisabled
+		return
+	}
+	mode = kPreflightModeXOR
+	if o.Authenticated {
+		mode = kPreflightModeAuthenticated
+	}
+	_, _ = hex.Decode(fingerprint[:], []byte(key.fingerprint))
+	return
+}
+
+func preflightModeString(mode byte) string {
+	switch mode {
+	case kPreflightModeDisabled:
+		return "disabled"
+	case kPreflightModeXOR:
+		return ObfuscateModeXOR
+	case kPreflightModeAuthenticated:
+		return ObfuscateModeAuthenticated
+	}
+	return fmt.Sprintf("unknown(%d)", mode)
+}
+
+// preflightReply returns the reply of the server with the obfuscator to the request.
+func preflightReply(o *WireGuardObfuscator, request *preflightMessage) (reply preflightMessage) {
+	reply.kind = kPreflightKindReply
+	reply.version = ObfuscateProtocolVersion
+	reply.nonce = request.nonce
+	reply.mode, reply.fingerprint = preflightLocalParams(o)
+	switch {
+	case request.version != ObfuscateProtocolVersion:
+		reply.result = kPreflightResultVersionMismatch
+	case request.mode != reply.mode:
+		reply.result = kPreflightResultModeMismatch
+	case request.mode == kPreflightModeDisabled || subtle.ConstantTimeCompare(request.fingerprint[:], reply.fingerprint[:]) == 1:
+		reply.result = kPreflightResultAccept
+	default:
+		reply.result = kPreflightResultKeyMismatch
+		key := o.loadKey()
+		for _, sk := range key.secondary {
+			var fingerprint [kObfuscateKeyFingerprintLength]byte
+			_, _ = hex.Decode(fingerprint[:], []byte(sk.fingerprint))
+			if subtle.ConstantTimeCompare(request.fingerprint[:], fingerprint[:]) == 1 {
+				reply.result = kPreflightResultSecondaryKey
+				break
+			}
+		}
+	}
+	return
+}
+
+// errPreflightTimeout is the result of a preflight without reply,
+// the handshakes are still forwarded since the server might not support or enable the preflight.
+var errPreflightTimeout = newError(ErrNetwork, "no preflight reply")
+
+// preflightClient runs the preflight of mwgp-client for each server destination.
+type preflightClient struct {
+	// obfuscator is the preflight obfuscator derived from the server public key,
+	// data is the obfuscator of the forwarded packets.
+	obfuscator *WireGuardObfuscator
+	data       *WireGuardObfuscator
+	logger     Logger
+	closeChan  <-chan struct{}
+
+	lock   sync.Mutex
+	checks map[netip.AddrPort]*preflightCheck
+}
+
+// preflightCheck is the preflight to a server destination,
+// the result fields are set before the done is closed.
+type preflightCheck struct {
+	nonce [kPreflightNonceLength]byte
+	done  chan struct{}
+
+	finished bool
+	forward  bool
+	err      error
+	expire   time.Time
+}
+
+func newPreflightClient(serverPublicKey NoisePublicKey, data *WireGuardObfuscator, logger Logger, closeChan <-chan struct{}) *preflightClient {
+	return &preflightClient{
+		obfuscator: newPreflightObfuscator(serverPublicKey),
+		data:       data,
+		logger:     logger,
+		closeChan:  closeChan,
+		checks:     make(map[netip.AddrPort]*preflightCheck),
+	}
+}
+
+// reset forgets all results, so that the next handshakes run the preflight again.
+func (p *preflightClient) reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.checks = make(map[netip.AddrPort]*preflightCheck)
+}
+
+// check runs the preflight to the addr through the transport if there is no cached result,
+// and reports whether the MessageInitiation should be forwarded to the addr.
+func (p *preflightClient) check(transport PacketTransport, addr *net.UDPAddr) (forward bool) {
+	key := upstreamKey(addr)
+	now := time.Now()
+	p.lock.Lock()
+	c := p.checks[key]
+	if c != nil && (!c.finished || now.Before(c.expire)) {
+		p.lock.Unlock()
+		select {
+		case <-c.done:
+			forward = c.forward
+		case <-p.closeChan:
+		}
+		return
+	}
+	c = &preflightCheck{done: make(chan struct{})}
+	_, _ = p.obfuscator.random.Read(c.nonce[:])
+	p.checks[key] = c
+	p.lock.Unlock()
+
+	p.run(transport, addr, c)
+	select {
+	case <-c.done:
+		forward = c.forward
+	case <-p.closeChan:
+	}
+	return
+}
+
+// run sends the requests until a reply is handled or it times out.
+func (p *preflightClient) run(transport PacketTransport, addr *net.UDPAddr, c *preflightCheck) {
+	request := p.request(c)
+	timer := time.NewTimer(kPreflightAttemptTimeout)
+	defer timer.Stop()
+	for attempt := 0; attempt < kPreflightAttempts; attempt++ {
+		err := sendPreflight(p.obfuscator, transport, addr, &request)
+		if err != nil {
+			p.logger.Debugf("failed to send preflight request to server %s: %s", addr, err.Error())
+		}
+		if attempt > 0 {
+			timer.Reset(kPreflightAttemptTimeout)
+		}
+		select {
+		case <-c.done:
+			return
+		case <-p.closeChan:
+			return
+		case <-timer.C:
+		}
+	}
+	p.finish(c, true, fmt.Errorf("%w in %s", errPreflightTimeout, kPreflightAttempts*kPreflightAttemptTimeout))
+	p.logger.Warnf("preflight to server %s: no reply in %s, forward the handshakes anyway, "+
+		"check that \"preflight\" is enabled on mwgp-server and \"server_pubkey\" is correct",
+		addr, kPreflightAttempts*kPreflightAttemptTimeout)
+}
+
+// probe sends a single request to the addr through the transport regardless of the cached result,
+// and reports whether it is replied and accepted in kPreflightAttemptTimeout.
+// It is used to find out whether a failed server endpoint is recovered, see clientFailover.
+func (p *preflightClient) probe(transport PacketTransport, addr *net.UDPAddr) (replied bool) {
+	key := upstreamKey(addr)
+	c := &preflightCheck{done: make(chan struct{})}
+	_, _ = p.obfuscator.random.Read(c.nonce[:])
+	p.lock.Lock()
+	p.checks[key] = c
+	p.lock.Unlock()
+
+	request := p.request(c)
+	err := sendPreflight(p.obfuscator, transport, addr, &request)
+	if err != nil {
+		p.logger.Debugf("failed to send preflight probe to server %s: %s", addr, err.Error())
+	}
+	timer := time.NewTimer(kPreflightAttemptTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+		replied = c.forward
+	case <-p.closeChan:
+	case <-timer.C:
+		// forget it, so that the next handshake runs a complete preflight
+		p.finish(c, true, errPreflightTimeout)
+		p.lock.Lock()
+		if p.checks[key] == c {
+			delete(p.checks, key)
+		}
+		p.lock.Unlock()
+	}
+	return
+}
+
+func (p *preflightClient) request(c *preflightCheck) (request preflightMessage) {
+	request.kind = kPreflightKindRequest
+	request.version = ObfuscateProtocolVersion
+	request.nonce = c.nonce
+	request.mode, request.fingerprint = preflightLocalParams(p.data)
+	return
+}
+
+// finish sets the result of the check unless it is already finished.
+func (p *preflightClient) finish(c *preflightCheck, forward bool, err error) (finished bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if c.finished {
+		return
+	}
+	c.finished = true
+	c.forward = forward
+	c.err = err
+	ttl := kPreflightPassedTTL
+	if !forward {
+		ttl = kPreflightFailedTTL
+	}
+	c.expire = time.Now().Add(ttl)
+	close(c.done)
+	finished = true
+	return
+}
+
+// handle is the ControlPacketFunc of the forward table, it consumes the preflight replies.
+func (p *preflightClient) handle(transport PacketTransport, packet *Packet) (handled bool) {
+	buffer := &Packet{Data: make([]byte, kPreflightPacketSize)}
+	var reply preflightMessage
+	if !decodePreflight(p.obfuscator, packet, buffer, &reply) || reply.kind != kPreflightKindReply {
+		return
+	}
+	handled = true
+
+	addr := packet.Source
+	p.lock.Lock()
+	c := p.checks[upstreamKey(addr)]
+	p.lock.Unlock()
+	if c == nil || c.nonce != reply.nonce {
+		return
+	}
+
+	mode, fingerprint := preflightLocalParams(p.data)
+	forward := false
+	var err error
+	switch {
+	case reply.version != ObfuscateProtocolVersion || reply.result == kPreflightResultVersionMismatch:
+		err = fmt.Errorf("server expects obfs protocol v%d, client speaks v%d", reply.version, ObfuscateProtocolVersion)
+	case reply.mode != mode || reply.result == kPreflightResultModeMismatch:
+		err = fmt.Errorf("obfs_mode mismatch: server %s, client %s", preflightModeString(reply.mode), preflightModeString(mode))
+	case reply.result == kPreflightResultKeyMismatch:
+		err = fmt.Errorf("key fingerprint mismatch: server %x, client %x", reply.fingerprint, fingerprint)
+	case reply.result == kPreflightResultAccept, reply.result == kPreflightResultSecondaryKey:
+		forward = true
+	default:
+		err = fmt.Errorf("unknown preflight result %d", reply.result)
+	}
+	if !p.finish(c, forward, err) {
+		return
+	}
+	switch {
+	case err != nil:
+		p.logger.Errorf("preflight to server %s failed: %s, the handshakes are dropped", addr, err.Error())
+	case reply.result == kPreflightResultSecondaryKey:
+		p.logger.Warnf("preflight to server %s passed, but the client key %x is only a secondary key of the server (primary %x), "+
+			"update the client before the old key is removed", addr, fingerprint, reply.fingerprint)
+	default:
+		p.logger.Infof("preflight to server %s passed: obfs protocol v%d, mode %s, key fingerprint %x",
+			addr, reply.version, preflightModeString(reply.mode), reply.fingerprint)
+	}
+	return
+}
+
+// handlePreflight is the ControlPacketFunc of mwgp-server,
+// it replies the preflight requests obfuscated for any of the servers.
+func (s *Server) handlePreflight(transport PacketTransport, packet *Packet) (handled bool) {
+	s.serversLock.RLock()
+	servers := s.servers
+	s.serversLock.RUnlock()
+
+	t := s.wgitTable
+	buffer := t.obtainPacket()
+	defer t.recyclePacket(buffer)
+	var request preflightMessage
+	var o *WireGuardObfuscator
+	for _, cs := range servers {
+		if cs.preflightObfuscator != nil && decodePreflight(cs.preflightObfuscator, packet, buffer, &request) {
+			o = cs.preflightObfuscator
+			break
+		}
+	}
+	if o == nil {
+		return
+	}
+	handled = true
+	if request.kind != kPreflightKindRequest {
+		return
+	}
+	if t.HandshakeRateLimiter != nil && !t.HandshakeRateLimiter.Allow(packet.Source.AddrPort().Addr(), time.Now()) {
+		atomic.AddUint64(&t.stats.handshakesRateLimited, 1)
+		return
+	}
+
+	reply := preflightReply(s.obfuscator, &request)
+	if reply.result != kPreflightResultAccept {
+		t.logPacketf(LogLevelInfo, "preflight from client %s rejected: client speaks obfs protocol v%d, mode %s, key fingerprint %x",
+			packet.Source, request.version, preflightModeString(request.mode), request.fingerprint)
+	}
+	err := sendPreflight(o, transport, packet.Source, &reply)
+	if err != nil {
+		t.logPacketf(LogLevelError, "failed to send preflight reply to client %s: %s", packet.Source, err.Error())
+	}
+	return
+}
@@ -0,0 +1,135 @@
+package mwgp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPreflightReply(t *testing.T) {
+	var server WireGuardObfuscator
+	server.Initialize("new", "old")
+	fingerprintOf := func(key string, authenticated bool) (mode byte, fingerprint [kObfuscateKeyFingerprintLength]byte) {
+		var o WireGuardObfuscator
+		o.Initialize(key)
+		o.Authenticated = authenticated
+		return preflightLocalParams(&o)
+	}
+
+	for _, c := range []struct {
+		name          string
+		version       byte
+		key           string
+		authenticated bool
+		expected      byte
+	}{
+		{"accept", ObfuscateProtocolVersion, "new", false, kPreflightResultAccept},
+		{"secondary key", ObfuscateProtocolVersion, "old", false, kPreflightResultSecondaryKey},
+		{"key mismatch", ObfuscateProtocolVersion, "wrong", false, kPreflightResultKeyMismatch},
+		{"mode mismatch", ObfuscateProtocolVersion, "new", true, kPreflightResultModeMismatch},
+		{"obfs disabled", ObfuscateProtocolVersion, "", false, kPreflightResultModeMismatch},
+		{"version mismatch", ObfuscateProtocolVersion + 1, "new", false, kPreflightResultVersionMismatch},
+	} {
+		request := preflightMessage{kind: kPreflightKindRequest, version: c.version, nonce: [8]byte{1, 2, 3}}
+		request.mode, request.fingerprint = fingerprintOf(c.key, c.authenticated)
+		reply := preflightReply(&server, &request)
+		if reply.result != c.expected {
+			t.Errorf("%s: expected result %d, got %d", c.name, c.expected, reply.result)
+		}
+		if reply.kind != kPreflightKindReply || reply.nonce != request.nonce || reply.version != ObfuscateProtocolVersion {
+			t.Errorf("%s: unexpected reply %+v", c.name, reply)
+		}
+	}
+}
+
+func TestPreflightMessage_Obfuscated(t *testing.T) {
+	_, serverPK := e2eGenerateKey(t)
+	_, anotherPK := e2eGenerateKey(t)
+	o := newPreflightObfuscator(serverPK)
+	msg := preflightMessage{kind: kPreflightKindRequest, version: ObfuscateProtocolVersion, mode: kPreflightModeXOR,
+		nonce: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, fingerprint: [4]byte{0xde, 0xad, 0xbe, 0xef}}
+
+	lengths := make(map[int]bool)
+	for i := 0; i < 16; i++ {
+		packet := &Packet{Data: make([]byte, kPreflightPacketSize)}
+		msg.marshal(packet)
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		o.Obfuscate(packet)
+		if isPlainWireGuardPacket(packet) || strings.Contains(string(packet.Slice()), kPreflightMagic) {
+			t.Fatalf("preflight message is not obfuscated: %x", packet.Slice())
+		}
+		lengths[packet.Length] = true
+
+		var decoded preflightMessage
+		buffer := &Packet{Data: make([]byte, kPreflightPacketSize)}
+		if !decodePreflight(o, packet, buffer, &decoded) || decoded != msg {
+			t.Fatalf("preflight message is not restored: %+v", decoded)
+		}
+		if decodePreflight(newPreflightObfuscator(anotherPK), packet, buffer, &decoded) {
+			t.Fatalf("preflight message is decoded with the key of another server")
+		}
+	}
+	if len(lengths) < 2 {
+		t.Errorf("preflight messages are not padded to random lengths")
+	}
+}
+
+func TestPreflightClient_Mismatch(t *testing.T) {
+	_, serverPK := e2eGenerateKey(t)
+	var data WireGuardObfuscator
+	data.Initialize("client")
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+
+	for _, c := range []struct {
+		name     string
+		reply    preflightMessage
+		forward  bool
+		expected string
+	}{
+		{
+			name:     "version mismatch",
+			reply:    preflightMessage{version: ObfuscateProtocolVersion + 1, result: kPreflightResultVersionMismatch},
+			expected: "[error] preflight to server 192.0.2.1:1000 failed: server expects obfs protocol v2, client speaks v1",
+		},
+		{
+			name:     "key mismatch",
+			reply:    preflightMessage{version: ObfuscateProtocolVersion, mode: kPreflightModeXOR, result: kPreflightResultKeyMismatch, fingerprint: [4]byte{0xde, 0xad, 0xbe, 0xef}},
+			expected: "key fingerprint mismatch: server deadbeef, client " + data.KeyFingerprint(),
+		},
+		{
+			name:     "mode mismatch",
+			reply:    preflightMessage{version: ObfuscateProtocolVersion, mode: kPreflightModeAuthenticated, result: kPreflightResultModeMismatch},
+			expected: "obfs_mode mismatch: server authenticated, client xor",
+		},
+		{
+			name:     "accept",
+			reply:    preflightMessage{version: ObfuscateProtocolVersion, mode: kPreflightModeXOR, result: kPreflightResultAccept},
+			forward:  true,
+			expected: "[info] preflight to server 192.0.2.1:1000 passed",
+		},
+	} {
+		logger := &testLogger{}
+		p := newPreflightClient(serverPK, &data, logger, make(chan struct{}))
+		check := &preflightCheck{nonce: [8]byte{1, 2, 3}, done: make(chan struct{})}
+		p.checks[upstreamKey(addr)] = check
+
+		c.reply.kind = kPreflightKindReply
+		c.reply.nonce = check.nonce
+		packet := &Packet{Data: make([]byte, kPreflightPacketSize), Source: addr}
+		c.reply.marshal(packet)
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		p.obfuscator.Obfuscate(packet)
+		packet.Flags = 0
+
+		if !p.handle(nil, packet) {
+			t.Fatalf("%s: preflight reply is not handled", c.name)
+		}
+		<-check.done
+		if check.forward != c.forward {
+			t.Errorf("%s: expected forward %v, got %v", c.name, c.forward, check.forward)
+		}
+		if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], c.expected) {
+			t.Errorf("%s: expected log %q, got %v", c.name, c.expected, logger.lines)
+		}
+	}
+}
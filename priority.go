@@ -0,0 +1,92 @@
+package mwgp
+
+import (
+	"sync/atomic"
+)
+
+// Handshake Priority:
+//
+// The packets are passed from the read loops to the main loop, and from the main loop to the write loop, through
+// the channels, which are full once the relay is saturated. A read loop blocked on a full channel leaves the packets
+// in the socket, where the kernel drops the new ones whatever they are. A lost MessageInitiation or MessageResponse
+// stalls the session for seconds until WireGuard retries it, while a few lost MessageTransport are invisible.
+//
+// So each of the channels has a small handshake queue along with it for the MessageInitiation, the MessageResponse
+// and the MessageCookieReply (see sendPacket), which is always drained before the channel by the loop reading them.
+// And a read loop drops the other packets (counted as QueueDroppedPackets) instead of waiting for a full channel,
+// so that it keeps reading the socket for the handshakes behind them. Only the handshakes wait for their queue.
+
+const (
+	// kPacketQueueSize is the capacity of the channels between the loops.
+	kPacketQueueSize = 64
+
+	// kHandshakeQueueSize is the capacity of the handshake queue of each channel.
+	kHandshakeQueueSize = 16
+)
+
+// isHandshakePacket reports whether the packet goes to the handshake queue.
+// An unrecognized packet relayed to the fallback is never one of them whatever its first byte is.
+func isHandshakePacket(packet *Packet) bool {
+	return packet.Flags&PacketFlagUnrecognized == 0 && packet.IsHandshake()
+}
+
+// handshakeChanOf returns the handshake queue of the ch, or nil if it is not a channel between the loops.
+func (t *WireGuardIndexTranslationTable) handshakeChanOf(ch chan<- *Packet) chan<- *Packet {
+	switch ch {
+	case t.clientReadChan:
+		return t.clientReadHandshakeChan
+	case t.serverReadChan:
+		return t.serverReadHandshakeChan
+	case t.clientWriteChan:
+		return t.clientWriteHandshakeChan
+	case t.serverWriteChan:
+		return t.serverWriteHandshakeChan
+	}
+	return nil
+}
+
+// sendPacket passes the packet to the ch, or the handshake queue of the ch for a handshake,
+// and returns false if the table is closed, where the packet is recycled.
+func (t *WireGuardIndexTranslationTable) sendPacket(ch chan<- *Packet, packet *Packet) (sent bool) {
+	if isHandshakePacket(packet) {
+		if handshakeChan := t.handshakeChanOf(ch); handshakeChan != nil {
+			ch = handshakeChan
+		}
+	}
+	select {
+	case ch <- packet:
+		sent = true
+	case <-t.closeChan:
+		t.recyclePacket(packet)
+	}
+	return
+}
+
+// sendReceivedPacket is the sendPacket for the read loops, which drops a packet other than the handshakes
+// instead of waiting if the ch is full. It returns false if the table is closed.
+func (t *WireGuardIndexTranslationTable) sendReceivedPacket(ch chan<- *Packet, packet *Packet) (ok bool) {
+	if isHandshakePacket(packet) {
+		return t.sendPacket(ch, packet)
+	}
+	ok = true
+	select {
+	case ch <- packet:
+	default:
+		atomic.AddUint64(&t.stats.queueDropped, 1)
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+	}
+	return
+}
+
+// receiveHandshake returns a packet already in the client or the server handshake queue without waiting,
+// s2c is set for the one from the server side.
+func receiveHandshake(clientChan, serverChan <-chan *Packet) (packet *Packet, s2c bool) {
+	select {
+	case packet = <-clientChan:
+	case packet = <-serverChan:
+		s2c = true
+	default:
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_HandshakePriority(t *testing.T) {
+	network := newMemNetwork()
+	listen := netip.AddrPortFrom(memNetworkIP, 1000)
+	upstream := netip.AddrPortFrom(memNetworkIP, 2000)
+	client, err := network.bind(0, netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := network.bind(upstream.Port(), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.TransportFactory = network
+	table.ClientListen = net.UDPAddrFromAddrPort(listen)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: net.UDPAddrFromAddrPort(upstream)}
+		return
+	}
+	// a saturated upstream, which takes a while for every MessageTransport
+	table.ServerWriteFunc = func(transport PacketTransport, packet *Packet) (err error) {
+		if packet.MessageType() == device.MessageTransportType {
+			time.Sleep(time.Millisecond)
+		}
+		return defaultWriteFunc(transport, packet)
+	}
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: net.UDPAddrFromAddrPort(client.local),
+		serverDestination: net.UDPAddrFromAddrPort(upstream),
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	transport := make([]byte, device.MessageTransportSize)
+	transport[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(transport[4:], peer.serverProxyIndex)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// far more than the upstream takes, but not so many that the socket itself overflows
+		defer wg.Done()
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for i := 0; i < 8; i++ {
+				_ = client.send(transport, listen)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	waitInitiation := func(deadline time.Time) bool {
+		for {
+			select {
+			case d := <-server.inbox:
+				if d.data[0] == device.MessageInitiationType {
+					return true
+				}
+			case <-time.After(time.Until(deadline)):
+				return false
+			}
+		}
+	}
+	// wait for the flood to saturate the relay
+	for table.Stats().QueueDroppedPackets == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		initiation := make([]byte, device.MessageInitiationSize)
+		initiation[0] = device.MessageInitiationType
+		binary.LittleEndian.PutUint32(initiation[4:], 0x1000+i)
+		sent := time.Now()
+		_ = client.send(initiation, listen)
+		if !waitInitiation(sent.Add(time.Second)) {
+			t.Fatalf("MessageInitiation #%d is not forwarded within 1s under the flood", i)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package mwgp
+
+import (
+	"fmt"
+	"os/user"
+	"runtime"
+	"strconv"
+)
+
+// Privilege Dropping:
+//
+// With the User (and the Group), mwgp-server is started as root only to bind the privileged ports. Once all the
+// listening sockets (the client ones, the metrics, debug and control ones, the WebSocket and TCP ones) are bound,
+// and before any packet is read, it switches to the user and the group with setgroups, setgid and setuid.
+// It fails to start if any of them fails, or if it is still root, or could become root again, afterwards.
+//
+// The sockets to the servers are created as the user, so the FwMark (which requires CAP_NET_ADMIN) cannot be used
+// with it, and the files written later, such as the accounting_file and the cache_file_path, must be writable
+// by the user.
+
+// privileges is the identity switched to, see "Privilege Dropping".
+type privileges struct {
+	user  string
+	group string
+	uid   int
+	gid   int
+}
+
+// parsePrivileges resolves the user and group options, it returns nil without them.
+// The user is a name or a numeric uid, its primary group is used if the group is not set.
+func parsePrivileges(userName, groupName string) (p *privileges, err error) {
+	if userName == "" && groupName == "" {
+		return
+	}
+	if !privilegeDropSupported {
+		err = fmt.Errorf("option \"user\" and \"group\" are not supported on %s", runtime.GOOS)
+		return
+	}
+	if userName == "" {
+		err = fmt.Errorf("option \"group\" requires \"user\" to be set")
+		return
+	}
+	p = &privileges{user: userName, group: groupName, gid: -1}
+	u, uerr := lookupUser(userName)
+	if uerr == nil {
+		p.uid, err = strconv.Atoi(u.Uid)
+		if err == nil {
+			p.gid, err = strconv.Atoi(u.Gid)
+		}
+		if err != nil {
+			err = fmt.Errorf("user %q has a non-numeric id: %w", userName, err)
+			return
+		}
+	} else if uid, aerr := strconv.Atoi(userName); aerr == nil && uid >= 0 {
+		// a numeric uid without an entry in the user database
+		p.uid = uid
+	} else {
+		err = fmt.Errorf("invalid user %q: %w", userName, uerr)
+		return
+	}
+	if groupName != "" {
+		p.gid, err = lookupGroupID(groupName)
+		if err != nil {
+			return
+		}
+	}
+	if p.gid < 0 {
+		err = fmt.Errorf("option \"group\" is required for user %q without an entry in the user database", userName)
+		return
+	}
+	if p.group == "" {
+		p.group = strconv.Itoa(p.gid)
+		if g, gerr := user.LookupGroupId(p.group); gerr == nil {
+			p.group = g.Name
+		}
+	}
+	if p.uid == 0 || p.gid == 0 {
+		err = fmt.Errorf("user %q and group %q must not be root", userName, p.group)
+		return
+	}
+	return
+}
+
+func lookupUser(name string) (u *user.User, err error) {
+	if _, aerr := strconv.Atoi(name); aerr == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroupID(name string) (gid int, err error) {
+	if gid, err = strconv.Atoi(name); err == nil && gid >= 0 {
+		return
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		err = fmt.Errorf("invalid group %q: %w", name, err)
+		return
+	}
+	gid, err = strconv.Atoi(g.Gid)
+	if err != nil {
+		err = fmt.Errorf("group %q has a non-numeric id: %w", name, err)
+	}
+	return
+}
+
+func (p *privileges) String() string {
+	return fmt.Sprintf("user %s (uid %d) and group %s (gid %d)", p.user, p.uid, p.group, p.gid)
+}
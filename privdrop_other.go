@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package mwgp
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const privilegeDropSupported = false
+
+func (p *privileges) drop() (err error) {
+	err = fmt.Errorf("dropping privileges is not supported on %s", runtime.GOOS)
+	return
+}
@@ -0,0 +1,48 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mwgp
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const privilegeDropSupported = true
+
+// drop switches the process to the privileges, see "Privilege Dropping".
+// The syscall package applies them to all the threads of the process.
+func (p *privileges) drop() (err error) {
+	if os.Geteuid() != 0 {
+		if os.Geteuid() == p.uid && os.Getegid() == p.gid {
+			// already started as the user, e.g. by the service manager
+			return
+		}
+		err = fmt.Errorf("failed to switch to %s: not running as root", p)
+		return
+	}
+	err = syscall.Setgroups([]int{p.gid})
+	if err != nil {
+		err = fmt.Errorf("failed to switch to %s: setgroups: %w", p, err)
+		return
+	}
+	err = syscall.Setgid(p.gid)
+	if err != nil {
+		err = fmt.Errorf("failed to switch to %s: setgid: %w", p, err)
+		return
+	}
+	err = syscall.Setuid(p.uid)
+	if err != nil {
+		err = fmt.Errorf("failed to switch to %s: setuid: %w", p, err)
+		return
+	}
+	if os.Getuid() == 0 || os.Geteuid() == 0 || os.Getgid() == 0 || os.Getegid() == 0 {
+		err = fmt.Errorf("still running as root after switching to %s", p)
+		return
+	}
+	if syscall.Setuid(0) == nil {
+		err = fmt.Errorf("root can be regained after switching to %s", p)
+		return
+	}
+	return
+}
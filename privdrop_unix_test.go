@@ -0,0 +1,113 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mwgp
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrivileges(t *testing.T) {
+	p, err := parsePrivileges("", "")
+	if p != nil || err != nil {
+		t.Errorf("expected nil without user and group, got %v, %v", p, err)
+	}
+	for _, c := range []struct {
+		user, group string
+		expected    string
+	}{
+		{"", "nogroup", "requires \"user\""},
+		{"root", "", "must not be root"},
+		{"0", "65534", "must not be root"},
+		{"mwgp-no-such-user", "", "invalid user"},
+		{"65534", "mwgp-no-such-group", "invalid group"},
+	} {
+		_, err = parsePrivileges(c.user, c.group)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("parsePrivileges(%q, %q): expected an error of %q, got %v", c.user, c.group, c.expected, err)
+		}
+	}
+
+	p, err = parsePrivileges("65534", "65534")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if p.uid != 65534 || p.gid != 65534 {
+		t.Errorf("expected uid and gid 65534, got %d and %d", p.uid, p.gid)
+	}
+}
+
+const kPrivilegeDropTestEnv = "MWGP_TEST_DROP_PRIVILEGES"
+
+// TestDropPrivileges drops the privileges in a child process, since it cannot be undone,
+// and checks that a socket bound before keeps working.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv(kPrivilegeDropTestEnv) == "1" {
+		testDropPrivilegesChild(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires to be run as root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skipf("user nobody is not available: %s", err.Error())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+	cmd.Env = append(os.Environ(), kPrivilegeDropTestEnv+"=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child process failed: %s\n%s", err.Error(), output)
+	}
+	if !strings.Contains(string(output), "--- PASS: TestDropPrivileges") {
+		t.Fatalf("child process did not pass:\n%s", output)
+	}
+}
+
+func testDropPrivilegesChild(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	defer conn.Close()
+
+	p, err := parsePrivileges("nobody", "")
+	if err != nil {
+		t.Fatalf("failed to parse privileges: %s", err.Error())
+	}
+	err = p.drop()
+	if err != nil {
+		t.Fatalf("failed to drop privileges: %s", err.Error())
+	}
+	if os.Geteuid() != p.uid || os.Getegid() != p.gid {
+		t.Fatalf("expected uid %d and gid %d, got %d and %d", p.uid, p.gid, os.Geteuid(), os.Getegid())
+	}
+	// a no-op once switched
+	if err = p.drop(); err != nil {
+		t.Errorf("expected dropping again to be a no-op, got %s", err.Error())
+	}
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err.Error())
+	}
+	defer sender.Close()
+	_, err = sender.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("failed to write: %s", err.Error())
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("failed to read on the socket bound before: %q, %v", buf[:n], err)
+	}
+	_, err = conn.WriteToUDP([]byte("pong"), addr)
+	if err != nil {
+		t.Fatalf("failed to write on the socket bound before: %s", err.Error())
+	}
+}
@@ -0,0 +1,282 @@
+package mwgp
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Probe Ban:
+//
+// The "probe_ban" of mwgp-server bans the source IPs keeping sending invalid packets, such as the scanners
+// probing the port, so that their packets are dropped before any deobfuscation work. A packet is invalid if it
+// cannot be deobfuscated: its decoded message type or length is invalid, or its tag is mismatched in the
+// authenticated mode. The unrecognized packets forwarded to the fallback_forward are not counted.
+//
+// A source IP is banned for the BanDuration once more than MaxFailures invalid packets are received from it
+// in the Window, unless it has an established session, whose handshake has been answered by the server.
+// IPv6 sources are counted and banned per /64 like the handshake_rate_limit. The sources are sharded and each shard
+// is bounded by an LRU list, so a flood of spoofed sources cannot exhaust the memory. The bans are listed and lifted
+// through the control socket.
+
+const (
+	defaultProbeBanMaxFailures = 10
+	defaultProbeBanWindow      = time.Minute
+	defaultProbeBanDuration    = 10 * time.Minute
+	defaultProbeBanMaxSources  = 65536
+)
+
+// ProbeBanConfig is the config of the auto-ban of the sources sending invalid packets, see "Probe Ban".
+type ProbeBanConfig struct {
+	// MaxFailures is the number of invalid packets allowed from a source IP in the Window, default to 10.
+	MaxFailures int `json:"max_failures,omitempty"`
+
+	// Window is the period the invalid packets are counted in, default to 1m.
+	Window Duration `json:"window,omitempty"`
+
+	// BanDuration is how long a source IP is banned for, default to 10m.
+	BanDuration Duration `json:"ban_duration,omitempty"`
+
+	// MaxSources is the max number of source IPs remembered, default to 65536.
+	// The least recently failed source IP is forgotten once it is exceeded.
+	MaxSources int `json:"max_sources,omitempty"`
+}
+
+func (c *ProbeBanConfig) validate() (err error) {
+	if c.MaxFailures < 0 {
+		err = fmt.Errorf("probe_ban.max_failures must not be negative")
+		return
+	}
+	if c.Window < 0 {
+		err = fmt.Errorf("probe_ban.window must not be negative")
+		return
+	}
+	if c.BanDuration < 0 {
+		err = fmt.Errorf("probe_ban.ban_duration must not be negative")
+		return
+	}
+	if c.MaxSources < 0 {
+		err = fmt.Errorf("probe_ban.max_sources must not be negative")
+		return
+	}
+	return
+}
+
+// ProbeBan is a banned source, IPv6 sources are the /64 prefixes.
+type ProbeBan struct {
+	Source      netip.Addr `json:"source"`
+	BannedUntil time.Time  `json:"banned_until"`
+}
+
+type probeBanList struct {
+	maxFailures int
+	window      time.Duration
+	banDuration time.Duration
+	shards      [kHandshakeRateLimitShards]probeBanShard
+}
+
+type probeBanShard struct {
+	lock       sync.Mutex
+	maxSources int
+	records    map[netip.Addr]*list.Element
+	lru        list.List
+}
+
+type probeBanRecord struct {
+	source      netip.Addr
+	failures    int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// newProbeBanList creates the ban list, zero values are replaced with the defaults.
+func newProbeBanList(config *ProbeBanConfig) (l *probeBanList) {
+	l = &probeBanList{
+		maxFailures: config.MaxFailures,
+		window:      time.Duration(config.Window),
+		banDuration: time.Duration(config.BanDuration),
+	}
+	if l.maxFailures <= 0 {
+		l.maxFailures = defaultProbeBanMaxFailures
+	}
+	if l.window <= 0 {
+		l.window = defaultProbeBanWindow
+	}
+	if l.banDuration <= 0 {
+		l.banDuration = defaultProbeBanDuration
+	}
+	maxSources := config.MaxSources
+	if maxSources <= 0 {
+		maxSources = defaultProbeBanMaxSources
+	}
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.maxSources = (maxSources + kHandshakeRateLimitShards - 1) / kHandshakeRateLimitShards
+		s.records = make(map[netip.Addr]*list.Element)
+	}
+	return
+}
+
+// banned reports whether the source IP is banned at the now.
+func (l *probeBanList) banned(source netip.Addr, now time.Time) bool {
+	source = aggregateSourceIP(source)
+	s := &l.shards[handshakeRateLimitShardOf(source)]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.records[source]
+	return ok && now.Before(e.Value.(*probeBanRecord).bannedUntil)
+}
+
+// fail counts an invalid packet from the source IP, and bans it once there are too many of them,
+// unless hasSession reports it has an established session.
+func (l *probeBanList) fail(source netip.Addr, now time.Time, hasSession func(source netip.Addr) bool) (banned bool) {
+	source = aggregateSourceIP(source)
+	s := &l.shards[handshakeRateLimitShardOf(source)]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var r *probeBanRecord
+	if e, ok := s.records[source]; ok {
+		s.lru.MoveToFront(e)
+		r = e.Value.(*probeBanRecord)
+	} else {
+		if s.lru.Len() >= s.maxSources {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.records, oldest.Value.(*probeBanRecord).source)
+		}
+		r = &probeBanRecord{source: source}
+		s.records[source] = s.lru.PushFront(r)
+	}
+	if now.Before(r.bannedUntil) {
+		// in flight before the ban
+		return
+	}
+	if now.Sub(r.windowStart) > l.window {
+		r.failures = 0
+		r.windowStart = now
+	}
+	r.failures++
+	if r.failures <= l.maxFailures {
+		return
+	}
+	// count again, so that the sessions are not looked up for every invalid packet
+	r.failures = 0
+	r.windowStart = now
+	if hasSession != nil && hasSession(source) {
+		return
+	}
+	r.bannedUntil = now.Add(l.banDuration)
+	banned = true
+	return
+}
+
+// unban lifts the ban of the source IP, and reports whether it was banned.
+func (l *probeBanList) unban(source netip.Addr, now time.Time) (unbanned bool) {
+	source = aggregateSourceIP(source)
+	s := &l.shards[handshakeRateLimitShardOf(source)]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.records[source]
+	if !ok {
+		return
+	}
+	unbanned = now.Before(e.Value.(*probeBanRecord).bannedUntil)
+	s.lru.Remove(e)
+	delete(s.records, source)
+	return
+}
+
+// list returns the sources banned at the now, sorted by the source.
+func (l *probeBanList) list(now time.Time) (bans []ProbeBan) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.lock.Lock()
+		for _, e := range s.records {
+			r := e.Value.(*probeBanRecord)
+			if now.Before(r.bannedUntil) {
+				bans = append(bans, ProbeBan{Source: r.source, BannedUntil: r.bannedUntil})
+			}
+		}
+		s.lock.Unlock()
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Source.Less(bans[j].Source)
+	})
+	return
+}
+
+// blockProbeSource is the BlockFunc of the obfuscator, which drops the packets from the banned sources.
+func (t *WireGuardIndexTranslationTable) blockProbeSource(packet *Packet) bool {
+	if t.probeBan == nil || packet.Source == nil {
+		return false
+	}
+	if !t.probeBan.banned(packet.Source.AddrPort().Addr(), time.Now()) {
+		return false
+	}
+	atomic.AddUint64(&t.stats.probeBannedPackets, 1)
+	return true
+}
+
+// countProbeFailure counts the invalid packet from client with the probeBan.
+func (t *WireGuardIndexTranslationTable) countProbeFailure(packet *Packet) {
+	if t.probeBan == nil || packet.Source == nil {
+		return
+	}
+	source := packet.Source.AddrPort().Addr()
+	if t.probeBan.fail(source, time.Now(), t.hasEstablishedSession) {
+		atomic.AddUint64(&t.stats.probeBans, 1)
+		t.logPacketf(LogLevelInfo, "banned client %s for %s after too many invalid packets", source, t.probeBan.banDuration)
+	}
+}
+
+// probeBansActive returns the number of the sources banned now.
+func (t *WireGuardIndexTranslationTable) probeBansActive() int {
+	if t.probeBan == nil {
+		return 0
+	}
+	return len(t.probeBan.list(time.Now()))
+}
+
+// hasEstablishedSession reports whether there is a session from the source IP (aggregated, see aggregateSourceIP),
+// whose handshake has been answered by the server.
+func (t *WireGuardIndexTranslationTable) hasEstablishedSession(source netip.Addr) (found bool) {
+	t.mapLock.RLock()
+	defer t.mapLock.RUnlock()
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		destination := peer.clientAddr()
+		if peer.serverOriginIndex == 0 || destination == nil {
+			return true
+		}
+		addr, ok := netip.AddrFromSlice(destination.IP)
+		found = ok && aggregateSourceIP(addr) == source
+		return !found
+	})
+	return
+}
+
+// ProbeBans returns the sources banned by the probe_ban, see "Probe Ban".
+func (s *Server) ProbeBans() (bans []ProbeBan) {
+	if s.wgitTable.probeBan == nil {
+		return
+	}
+	bans = s.wgitTable.probeBan.list(time.Now())
+	return
+}
+
+// ProbeUnban lifts the ban of the source IP by the probe_ban, and reports whether it was banned.
+func (s *Server) ProbeUnban(source netip.Addr) (unbanned bool) {
+	if s.wgitTable.probeBan == nil {
+		return
+	}
+	unbanned = s.wgitTable.probeBan.unban(source, time.Now())
+	if unbanned {
+		s.Logger.Infof("unbanned client %s", aggregateSourceIP(source))
+	}
+	return
+}
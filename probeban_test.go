@@ -0,0 +1,123 @@
+package mwgp
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestProbeBanList(t *testing.T) {
+	l := newProbeBanList(&ProbeBanConfig{MaxFailures: 3, Window: Duration(time.Minute), BanDuration: Duration(time.Hour), MaxSources: 64})
+	now := time.Now()
+	prober := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		if l.fail(prober, now, nil) {
+			t.Fatalf("banned after %d invalid packets", i+1)
+		}
+	}
+	if l.banned(prober, now) {
+		t.Errorf("banned before the max_failures is exceeded")
+	}
+	if !l.fail(netip.MustParseAddr("::ffff:192.0.2.1"), now, nil) || !l.banned(prober, now) {
+		t.Errorf("expected banned once the max_failures is exceeded")
+	}
+	if l.banned(prober, now.Add(time.Hour)) {
+		t.Errorf("expected the ban expired after the ban_duration")
+	}
+
+	// the failures out of the window are not counted
+	slow := netip.MustParseAddr("192.0.2.2")
+	for i := 0; i < 10; i++ {
+		if l.fail(slow, now.Add(time.Duration(i)*40*time.Second), nil) {
+			t.Fatalf("banned with the failures out of the window")
+		}
+	}
+
+	// never banned with an established session, IPv6 sources are counted per /64
+	withSession := netip.MustParseAddr("2001:db8::1")
+	hasSession := func(source netip.Addr) bool {
+		return source == netip.MustParseAddr("2001:db8::")
+	}
+	for i := 0; i < 10; i++ {
+		if l.fail(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)}), now, hasSession) {
+			t.Fatalf("banned with an established session")
+		}
+	}
+	if l.banned(withSession, now) {
+		t.Errorf("banned with an established session")
+	}
+	for i := 0; i < 4; i++ {
+		l.fail(netip.MustParseAddr("2001:db8:0:1::1"), now, hasSession)
+	}
+	if !l.banned(netip.MustParseAddr("2001:db8:0:1::ffff"), now) {
+		t.Errorf("expected the IPv6 source banned per /64")
+	}
+
+	bans := l.list(now)
+	if len(bans) != 2 || bans[0].Source != prober || bans[1].Source != netip.MustParseAddr("2001:db8:0:1::") {
+		t.Errorf("unexpected bans: %+v", bans)
+	}
+	if !l.unban(prober, now) || l.banned(prober, now) || l.unban(prober, now) {
+		t.Errorf("expected the ban lifted once")
+	}
+
+	// the memory usage is bounded
+	for i := 0; i < 10000; i++ {
+		l.fail(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), now, nil)
+	}
+	var n int
+	for i := range l.shards {
+		n += l.shards[i].lru.Len()
+	}
+	if n > 64+kHandshakeRateLimitShards {
+		t.Errorf("ban list holds %d sources, more than max sources", n)
+	}
+}
+
+func TestProbeBan_Server(t *testing.T) {
+	sk, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	listen := e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{listen},
+		Servers: []*ServerConfigServer{{
+			PrivateKey: &sk,
+			Peers:      []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820", ClientPublicKey: &clientPK}},
+		}},
+		ObfuscateKey:  "probe-ban-test-key",
+		ObfuscateMode: ObfuscateModeAuthenticated,
+		ProbeBan:      &ProbeBanConfig{MaxFailures: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Logger = NewStdLogger(LogLevelError)
+	go func() { _ = server.Start() }()
+	defer server.Stop()
+
+	conn, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	junk := bytes.Repeat([]byte{0xaa}, 128)
+	for deadline := time.Now().Add(5 * time.Second); server.Stats().ProbeBannedPackets == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the prober is not banned, stats: %+v", server.Stats())
+		}
+		_, _ = conn.Write(junk)
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := server.Stats()
+	if stats.ProbeBans != 1 || stats.ProbeBansActive != 1 {
+		t.Errorf("expected 1 active ban, got %d of %d", stats.ProbeBansActive, stats.ProbeBans)
+	}
+	if bans := server.ProbeBans(); len(bans) != 1 || bans[0].Source != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("unexpected bans: %+v", bans)
+	}
+	if !server.ProbeUnban(netip.MustParseAddr("127.0.0.1")) || len(server.ProbeBans()) != 0 {
+		t.Errorf("expected the ban lifted")
+	}
+}
@@ -0,0 +1,108 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+)
+
+// PROXY Protocol:
+//
+// With the "send_proxy_protocol" of a server peer, mwgp-server prepends a PROXY protocol v2 header to the first
+// packet of each session forwarded to the server, and to the next packet after the client roams, so that a relay
+// in front of the server which understands the PROXY protocol over UDP learns the real address of the client.
+// The source of the header is the client address, and the destination is the local address of the listener the
+// client packets arrived on, or the unspecified address if it is unknown or of the other family.
+//
+// The header is not sent back to the client, and the packets which do not fit in the max_packet_size
+// with the header are dropped.
+
+// kProxyProtocolV2Signature is the signature of the PROXY protocol v2 header.
+var kProxyProtocolV2Signature = [12]byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const (
+	kProxyProtocolV2CommandProxy = 0x21 // version 2, PROXY
+	kProxyProtocolV2FamilyUDP4   = 0x12 // AF_INET, SOCK_DGRAM
+	kProxyProtocolV2FamilyUDP6   = 0x22 // AF_INET6, SOCK_DGRAM
+
+	kProxyProtocolV2HeaderSize4 = 16 + 12
+	kProxyProtocolV2HeaderSize6 = 16 + 36
+)
+
+// appendProxyProtocolV2Header appends the PROXY protocol v2 header of a UDP packet from src to dst.
+// The dst is converted to the family of the src.
+func appendProxyProtocolV2Header(b []byte, src, dst netip.AddrPort) []byte {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	b = append(b, kProxyProtocolV2Signature[:]...)
+	b = append(b, kProxyProtocolV2CommandProxy)
+	if srcIP.Is4() {
+		if !dstIP.Is4() {
+			dstIP = netip.IPv4Unspecified()
+		}
+		s, d := srcIP.As4(), dstIP.As4()
+		b = append(b, kProxyProtocolV2FamilyUDP4, 0, 12)
+		b = append(b, s[:]...)
+		b = append(b, d[:]...)
+	} else {
+		s, d := srcIP.As16(), dstIP.As16()
+		if !dstIP.IsValid() {
+			d = netip.IPv6Unspecified().As16()
+		}
+		b = append(b, kProxyProtocolV2FamilyUDP6, 0, 36)
+		b = append(b, s[:]...)
+		b = append(b, d[:]...)
+	}
+	b = append(b, byte(src.Port()>>8), byte(src.Port()), byte(dst.Port()>>8), byte(dst.Port()))
+	return b
+}
+
+// proxyProtocolV2HeaderSize returns the size of the header appended by appendProxyProtocolV2Header for the src.
+func proxyProtocolV2HeaderSize(src netip.AddrPort) int {
+	if src.Addr().Unmap().Is4() {
+		return kProxyProtocolV2HeaderSize4
+	}
+	return kProxyProtocolV2HeaderSize6
+}
+
+// transportLocalAddr returns the local address of the transport, the zero value if it is unknown.
+func transportLocalAddr(transport PacketTransport) (addr netip.AddrPort) {
+	ut, ok := transport.(*UDPTransport)
+	if !ok || ut.Conn() == nil {
+		return
+	}
+	if laddr, ok := ut.Conn().LocalAddr().(*net.UDPAddr); ok {
+		addr = laddr.AddrPort()
+	}
+	return
+}
+
+// prependProxyProtocolHeader prepends the PROXY protocol v2 header to the packet from client to the peer,
+// if the peer has the send_proxy_protocol, and the packet is the MessageInitiation of the session,
+// or the header has not been sent for the current client address.
+// It returns false if the packet is too large with the header, which should be dropped.
+//
+// The proxyProtocolSource of the peer is only updated here by the MessageTransport in the main loop,
+// it is set by processClientMessageInitiation for the MessageInitiation, which is handled in another goroutine.
+func (t *WireGuardIndexTranslationTable) prependProxyProtocolHeader(peer *Peer, packet *Packet) bool {
+	if !peer.sendProxyProtocol {
+		return true
+	}
+	src := packet.Source.AddrPort()
+	initiation := packet.MessageType() == device.MessageInitiationType
+	if !initiation && peer.proxyProtocolSource == src {
+		return true
+	}
+	size := proxyProtocolV2HeaderSize(src)
+	if size+packet.Length > len(packet.Data) {
+		t.logPeerPacketf(peer, LogLevelWarn, "dropped type %d packet from client %s: %d bytes with the PROXY protocol header exceeds the max packet size %d",
+			packet.MessageType(), packet.Source.String(), size+packet.Length, len(packet.Data))
+		return false
+	}
+	copy(packet.Data[size:], packet.Data[:packet.Length])
+	appendProxyProtocolV2Header(packet.Data[:0], src, transportLocalAddr(packet.transport))
+	packet.Length += size
+	if !initiation {
+		peer.proxyProtocolSource = src
+	}
+	return true
+}
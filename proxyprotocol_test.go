@@ -0,0 +1,122 @@
+package mwgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestAppendProxyProtocolV2Header(t *testing.T) {
+	for _, c := range []struct {
+		src, dst string
+		expected string
+	}{
+		{
+			// signature, version 2 PROXY, AF_INET DGRAM, length 12, addresses, ports
+			"192.0.2.1:51820", "198.51.100.1:443",
+			"0d0a0d0a000d0a515549540a 21 12 000c c0000201 c6336401 ca6c 01bb",
+		},
+		{
+			"[::ffff:192.0.2.1]:1", "[::]:2",
+			"0d0a0d0a000d0a515549540a 21 12 000c c0000201 00000000 0001 0002",
+		},
+		{
+			// AF_INET6 DGRAM, length 36
+			"[2001:db8::1]:51820", "[2001:db8::2]:443",
+			"0d0a0d0a000d0a515549540a 21 22 0024 20010db8000000000000000000000001 20010db8000000000000000000000002 ca6c 01bb",
+		},
+		{
+			"[2001:db8::1]:51820", "192.0.2.1:443",
+			"0d0a0d0a000d0a515549540a 21 22 0024 20010db8000000000000000000000001 00000000000000000000ffffc0000201 ca6c 01bb",
+		},
+		{
+			"[2001:db8::1]:51820", "",
+			"0d0a0d0a000d0a515549540a 21 22 0024 20010db8000000000000000000000001 00000000000000000000000000000000 ca6c 0000",
+		},
+	} {
+		var dst netip.AddrPort
+		if c.dst != "" {
+			dst = netip.MustParseAddrPort(c.dst)
+		}
+		src := netip.MustParseAddrPort(c.src)
+		expected, _ := hex.DecodeString(strings.ReplaceAll(c.expected, " ", ""))
+		header := appendProxyProtocolV2Header([]byte{0xff}, src, dst)
+		if !bytes.Equal(header[1:], expected) || header[0] != 0xff {
+			t.Errorf("%s -> %s: expected %x, got %x", c.src, c.dst, expected, header[1:])
+		}
+		if proxyProtocolV2HeaderSize(src) != len(expected) {
+			t.Errorf("%s: expected header size %d, got %d", c.src, len(expected), proxyProtocolV2HeaderSize(src))
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_PrependProxyProtocolHeader(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	client := netip.MustParseAddrPort("192.0.2.1:1000")
+	peer := &Peer{sendProxyProtocol: true, proxyProtocolSource: client}
+	newPacket := func(messageType uint32, src netip.AddrPort, length int) *Packet {
+		packet := table.obtainPacket()
+		packet.Length = length
+		binary.LittleEndian.PutUint32(packet.Data, messageType)
+		packet.Data[length-1] = 0xee
+		packet.setSourceAddrPort(src)
+		return packet
+	}
+	for _, step := range []struct {
+		messageType uint32
+		src         netip.AddrPort
+		length      int
+		header      int
+	}{
+		{device.MessageInitiationType, client, device.MessageInitiationSize, kProxyProtocolV2HeaderSize4},
+		{device.MessageTransportType, client, 64, 0},
+		{device.MessageTransportType, netip.MustParseAddrPort("[2001:db8::1]:1000"), 64, kProxyProtocolV2HeaderSize6},
+		{device.MessageTransportType, netip.MustParseAddrPort("[2001:db8::1]:1000"), 64, 0},
+		{device.MessageTransportType, client, 64, kProxyProtocolV2HeaderSize4},
+	} {
+		packet := newPacket(step.messageType, step.src, step.length)
+		if !table.prependProxyProtocolHeader(peer, packet) {
+			t.Fatalf("%+v: dropped", step)
+		}
+		if packet.Length != step.length+step.header {
+			t.Fatalf("%+v: expected %d bytes, got %d", step, step.length+step.header, packet.Length)
+		}
+		if step.header > 0 && !bytes.Equal(packet.Data[:12], kProxyProtocolV2Signature[:]) {
+			t.Errorf("%+v: expected the PROXY protocol header", step)
+		}
+		if packet.Data[step.header] != byte(step.messageType) || packet.Data[packet.Length-1] != 0xee {
+			t.Errorf("%+v: the packet is not moved after the header", step)
+		}
+		table.recyclePacket(packet)
+	}
+
+	// the packet cannot grow beyond the max packet size
+	packet := newPacket(device.MessageTransportType, netip.MustParseAddrPort("192.0.2.2:1000"), int(table.MaxPacketSize)-8)
+	if table.prependProxyProtocolHeader(peer, packet) {
+		t.Errorf("expected the packet too large with the header dropped")
+	}
+
+	// the destination is the local address of the listener
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packet = newPacket(device.MessageInitiationType, client, device.MessageInitiationSize)
+	packet.transport = NewUDPTransport(conn)
+	table.prependProxyProtocolHeader(peer, packet)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if !bytes.Equal(packet.Data[20:24], []byte{127, 0, 0, 1}) || int(binary.BigEndian.Uint16(packet.Data[26:28])) != port {
+		t.Errorf("expected the destination 127.0.0.1:%d, got %x", port, packet.Data[16:28])
+	}
+
+	if !table.prependProxyProtocolHeader(&Peer{}, packet) || packet.Length != device.MessageInitiationSize+kProxyProtocolV2HeaderSize4 {
+		t.Errorf("expected no header without send_proxy_protocol")
+	}
+}
@@ -0,0 +1,164 @@
+package mwgp
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHandshakeRateLimitRate       = 10
+	defaultHandshakeRateLimitBurst      = 20
+	defaultHandshakeRateLimitMaxSources = 65536
+
+	// kHandshakeRateLimitShards is the number of independently locked shards of source IPs,
+	// so that the limiter on the receive path is rarely contended.
+	kHandshakeRateLimitShards = 16
+
+	// kHandshakeRateLimitIPv6PrefixLength aggregates the IPv6 sources,
+	// since a single host usually owns the whole /64.
+	kHandshakeRateLimitIPv6PrefixLength = 64
+)
+
+// HandshakeRateLimitConfig is the config of the per-source-IP rate limit for MessageInitiation packets.
+type HandshakeRateLimitConfig struct {
+	// Rate is the number of handshakes allowed per second from a source IP, default to 10.
+	Rate float64 `json:"rate,omitempty"`
+
+	// Burst is the max number of handshakes allowed at once from a source IP, default to 20.
+	Burst int `json:"burst,omitempty"`
+
+	// MaxSources is the max number of source IPs remembered, default to 65536.
+	// The least recently seen source IP is forgotten once it is exceeded.
+	MaxSources int `json:"max_sources,omitempty"`
+}
+
+func (c *HandshakeRateLimitConfig) validate() (err error) {
+	if c.Rate < 0 {
+		err = fmt.Errorf("handshake_rate_limit.rate must not be negative")
+		return
+	}
+	if c.Burst < 0 {
+		err = fmt.Errorf("handshake_rate_limit.burst must not be negative")
+		return
+	}
+	if c.MaxSources < 0 {
+		err = fmt.Errorf("handshake_rate_limit.max_sources must not be negative")
+		return
+	}
+	return
+}
+
+// HandshakeRateLimiter is a token bucket rate limiter per source IP.
+//
+// IPv6 sources are limited per /64. The source IPs are sharded by their hash,
+// each shard is bounded by an LRU list so that a flood of spoofed sources cannot exhaust the memory.
+type HandshakeRateLimiter struct {
+	rate   float64
+	burst  float64
+	shards [kHandshakeRateLimitShards]handshakeRateLimitShard
+}
+
+type handshakeRateLimitShard struct {
+	lock       sync.Mutex
+	maxSources int
+	buckets    map[netip.Addr]*list.Element
+	lru        list.List
+}
+
+type handshakeRateLimitBucket struct {
+	source  netip.Addr
+	tokens  float64
+	updated time.Time
+}
+
+// NewHandshakeRateLimiter creates a rate limiter, zero values are replaced with the defaults.
+func NewHandshakeRateLimiter(config HandshakeRateLimitConfig) (l *HandshakeRateLimiter) {
+	l = &HandshakeRateLimiter{}
+	l.rate = config.Rate
+	if l.rate <= 0 {
+		l.rate = defaultHandshakeRateLimitRate
+	}
+	l.burst = float64(config.Burst)
+	if l.burst <= 0 {
+		l.burst = defaultHandshakeRateLimitBurst
+	}
+	maxSources := config.MaxSources
+	if maxSources <= 0 {
+		maxSources = defaultHandshakeRateLimitMaxSources
+	}
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.maxSources = (maxSources + kHandshakeRateLimitShards - 1) / kHandshakeRateLimitShards
+		s.buckets = make(map[netip.Addr]*list.Element)
+	}
+	return
+}
+
+// Allow reports whether a handshake from the source IP is allowed, and takes a token if so.
+func (l *HandshakeRateLimiter) Allow(source netip.Addr, now time.Time) (allowed bool) {
+	source = aggregateSourceIP(source)
+	s := &l.shards[handshakeRateLimitShardOf(source)]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var b *handshakeRateLimitBucket
+	if e, ok := s.buckets[source]; ok {
+		s.lru.MoveToFront(e)
+		b = e.Value.(*handshakeRateLimitBucket)
+		b.tokens += now.Sub(b.updated).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	} else {
+		if s.lru.Len() >= s.maxSources {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*handshakeRateLimitBucket).source)
+		}
+		b = &handshakeRateLimitBucket{source: source, tokens: l.burst}
+		s.buckets[source] = s.lru.PushFront(b)
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return
+	}
+	b.tokens--
+	allowed = true
+	return
+}
+
+// Len returns the number of remembered source IPs.
+func (l *HandshakeRateLimiter) Len() (n int) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.lock.Lock()
+		n += s.lru.Len()
+		s.lock.Unlock()
+	}
+	return
+}
+
+// aggregateSourceIP returns the IPv4 address, or the /64 prefix of the IPv6 address, the source IP is limited by.
+func aggregateSourceIP(source netip.Addr) netip.Addr {
+	source = source.Unmap()
+	if source.Is6() {
+		source = netip.PrefixFrom(source.WithZone(""), kHandshakeRateLimitIPv6PrefixLength).Masked().Addr()
+	}
+	return source
+}
+
+// handshakeRateLimitShardOf is the FNV-1a hash of the address, without memory allocation.
+func handshakeRateLimitShardOf(addr netip.Addr) int {
+	a16 := addr.As16()
+	h := uint32(2166136261)
+	for _, c := range a16 {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return int(h % kHandshakeRateLimitShards)
+}
@@ -0,0 +1,87 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHandshakeRateLimiter(t *testing.T) {
+	l := NewHandshakeRateLimiter(HandshakeRateLimitConfig{
+		Rate:       10,
+		Burst:      20,
+		MaxSources: 64,
+	})
+	now := time.Now()
+	flooder := netip.MustParseAddr("192.0.2.1")
+	victim := netip.MustParseAddr("192.0.2.2")
+
+	var allowed int
+	for i := 0; i < 1000; i++ {
+		if l.Allow(flooder, now) {
+			allowed++
+		}
+	}
+	if allowed != 20 {
+		t.Errorf("expected burst of 20 handshakes, got %d", allowed)
+	}
+	if !l.Allow(victim, now) {
+		t.Errorf("handshake from another IP is starved by the flood")
+	}
+	if !l.Allow(flooder, now.Add(100*time.Millisecond)) {
+		t.Errorf("token is not refilled")
+	}
+	if l.Allow(flooder, now.Add(100*time.Millisecond)) {
+		t.Errorf("token is refilled too fast")
+	}
+
+	// the IPv4-mapped address is the same source, and IPv6 sources are limited per /64
+	if l.Allow(netip.MustParseAddr("::ffff:192.0.2.1"), now.Add(100*time.Millisecond)) {
+		t.Errorf("IPv4-mapped address bypasses the limit")
+	}
+	for i := 0; i < 20; i++ {
+		l.Allow(netip.MustParseAddr("2001:db8::1"), now)
+	}
+	if l.Allow(netip.MustParseAddr("2001:db8::ffff"), now) {
+		t.Errorf("IPv6 address in the same /64 bypasses the limit")
+	}
+	if !l.Allow(netip.MustParseAddr("2001:db8:0:1::1"), now) {
+		t.Errorf("IPv6 address in another /64 is limited")
+	}
+
+	// the memory usage is bounded
+	for i := 0; i < 10000; i++ {
+		l.Allow(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), now)
+	}
+	if n := l.Len(); n > 64+kHandshakeRateLimitShards {
+		t.Errorf("rate limiter holds %d sources, more than max sources", n)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_HandshakeRateLimit(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.HandshakeRateLimiter = NewHandshakeRateLimiter(HandshakeRateLimitConfig{Rate: 1, Burst: 1})
+
+	packet := func(messageType byte, ip net.IP) *Packet {
+		p := &Packet{Data: make([]byte, device.MessageInitiationSize)}
+		p.Data[0] = messageType
+		p.Length = device.MessageInitiationSize
+		p.Source = &net.UDPAddr{IP: ip, Port: 1000}
+		return p
+	}
+	flooder := net.IPv4(192, 0, 2, 1)
+	if !table.allowClientHandshake(packet(device.MessageInitiationType, flooder)) {
+		t.Errorf("first handshake is limited")
+	}
+	if table.allowClientHandshake(packet(device.MessageInitiationType, flooder)) {
+		t.Errorf("flood of handshakes is not limited")
+	}
+	if !table.allowClientHandshake(packet(device.MessageTransportType, flooder)) {
+		t.Errorf("transport packet is limited")
+	}
+	if !table.allowClientHandshake(packet(device.MessageInitiationType, net.IPv4(192, 0, 2, 2))) {
+		t.Errorf("handshake from another IP is starved by the flood")
+	}
+}
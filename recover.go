@@ -0,0 +1,94 @@
+package mwgp
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Packet Panic Recovery:
+//
+// A bug on a malformed packet must not crash the whole process, since anyone who can reach the listen address
+// could send it. The per-packet processing (reading with the ReadFunc and receiving in the read loops,
+// handling in the main loop and the handshake goroutines, and writing with the WriteFunc) recovers from a panic,
+// drops the packet with an error log, and counts it as the PacketPanics in the Stats.
+//
+// The packet is not recycled after a panic, since it might have been handed over to another loop.
+
+// recoverPacketPanic recovers a panic in handling the packet, it must be deferred directly.
+func (t *WireGuardIndexTranslationTable) recoverPacketPanic(side string, packet *Packet) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	source := "<nil>"
+	if packet.Source != nil {
+		source = packet.Source.String()
+	}
+	t.countPacketPanic(fmt.Sprintf("handling packet from %s %s", side, source), r)
+}
+
+func (t *WireGuardIndexTranslationTable) countPacketPanic(what string, r interface{}) {
+	atomic.AddUint64(&t.stats.packetPanics, 1)
+	t.countDroppedPacket()
+	t.logPacketf(LogLevelError, "recovered from a panic in %s, packet dropped: %v\n%s", what, r, debug.Stack())
+}
+
+// readBatchSafely is the readBatchFunc recovering from a panic, nothing is read after a panic.
+func (t *WireGuardIndexTranslationTable) readBatchSafely(side string, transport PacketTransport,
+	readBatchFunc func(transport PacketTransport, packets []*Packet) (n int, err error), packets []*Packet) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.countPacketPanic(fmt.Sprintf("reading from %s conn", side), r)
+			n, err = 0, nil
+		}
+	}()
+	n, err = readBatchFunc(transport, packets)
+	return
+}
+
+// writeSafely is the writeFunc recovering from a panic, which is returned as an error.
+func (t *WireGuardIndexTranslationTable) writeSafely(side string,
+	writeFunc func(transport PacketTransport, packet *Packet) (err error), transport PacketTransport, packet *Packet) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.countPacketPanic(fmt.Sprintf("writing to %s conn", side), r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	err = writeFunc(transport, packet)
+	return
+}
+
+// writeBatchSafely is the writeBatchFunc recovering from a panic, all the packets are failed after a panic.
+//
+// The failed packets are marked with writeFailed. The writeBatchFuncs outside of this package cannot mark them,
+// their failed packets are assumed to be the tail of the packets.
+func (t *WireGuardIndexTranslationTable) writeBatchSafely(side string,
+	writeBatchFunc func(transport PacketTransport, packets []*Packet) (failed int, err error), transport PacketTransport, packets []*Packet) (failed int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.countPacketPanic(fmt.Sprintf("writing to %s conn", side), r)
+			failed, err = len(packets), fmt.Errorf("panic: %v", r)
+		}
+		markWriteFailed(packets, failed)
+	}()
+	failed, err = writeBatchFunc(transport, packets)
+	return
+}
+
+// markWriteFailed marks the failed packets from the tail if fewer than failed of them are marked with writeFailed.
+func markWriteFailed(packets []*Packet, failed int) {
+	marked := 0
+	for _, packet := range packets {
+		if packet.writeFailed {
+			marked++
+		}
+	}
+	for i := len(packets) - 1; i >= 0 && marked < failed; i-- {
+		if !packets[i].writeFailed {
+			packets[i].writeFailed = true
+			marked++
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package mwgp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultObfuscateReplayWindow     = 5 * time.Minute
+	defaultObfuscateReplayMaxEntries = 65536
+
+	kObfuscateReplayWindowMax = time.Hour
+)
+
+// ObfuscateReplayFilterConfig is the config of the replay filter for obfuscated handshake packets.
+type ObfuscateReplayFilterConfig struct {
+	// Window is how long a seen nonce is remembered, default to 5 minutes.
+	Window Duration `json:"window,omitempty"`
+
+	// MaxEntries is the max number of nonces remembered, default to 65536.
+	// It bounds the memory usage to about 40 bytes per entry.
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+func (c *ObfuscateReplayFilterConfig) validate() (err error) {
+	err = c.Window.validate("obfs_replay_filter.window", kObfuscateReplayWindowMax)
+	if err != nil {
+		return
+	}
+	if c.MaxEntries < 0 {
+		err = fmt.Errorf("obfs_replay_filter.max_entries must not be negative")
+		return
+	}
+	return
+}
+
+// ObfuscateReplayFilter remembers the nonces of recently seen obfuscated packets,
+// so that a captured handshake packet cannot be replayed to probe the server.
+//
+// Nonces are stored in two generations which are rotated every window,
+// a nonce is remembered for at least one window and at most two windows.
+// If the current generation is full before the window ends, it is rotated early,
+// which shortens the window under a flood but keeps the memory usage bounded.
+type ObfuscateReplayFilter struct {
+	lock          sync.Mutex
+	window        time.Duration
+	maxGeneration int
+	current       map[[kObfuscateNonceLength]byte]struct{}
+	previous      map[[kObfuscateNonceLength]byte]struct{}
+	rotatedAt     time.Time
+}
+
+// NewObfuscateReplayFilter creates a replay filter, zero values are replaced with the defaults.
+func NewObfuscateReplayFilter(config ObfuscateReplayFilterConfig) (f *ObfuscateReplayFilter) {
+	f = &ObfuscateReplayFilter{}
+	f.window = time.Duration(config.Window)
+	if f.window <= 0 {
+		f.window = defaultObfuscateReplayWindow
+	}
+	maxEntries := config.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultObfuscateReplayMaxEntries
+	}
+	f.maxGeneration = (maxEntries + 1) / 2
+	f.current = make(map[[kObfuscateNonceLength]byte]struct{})
+	f.previous = make(map[[kObfuscateNonceLength]byte]struct{})
+	return
+}
+
+// Check reports whether the nonce is seen before, and remembers it if not.
+func (f *ObfuscateReplayFilter) Check(nonce [kObfuscateNonceLength]byte, now time.Time) (replayed bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if elapsed := now.Sub(f.rotatedAt); elapsed >= f.window || len(f.current) >= f.maxGeneration {
+		f.previous, f.current = f.current, f.previous
+		if elapsed >= 2*f.window {
+			for k := range f.previous {
+				delete(f.previous, k)
+			}
+		}
+		for k := range f.current {
+			delete(f.current, k)
+		}
+		f.rotatedAt = now
+	}
+
+	if _, replayed = f.current[nonce]; replayed {
+		return
+	}
+	if _, replayed = f.previous[nonce]; replayed {
+		return
+	}
+	f.current[nonce] = struct{}{}
+	return
+}
+
+// Len returns the number of remembered nonces.
+func (f *ObfuscateReplayFilter) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.current) + len(f.previous)
+}
@@ -0,0 +1,85 @@
+package mwgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"testing"
+	"time"
+)
+
+func TestObfuscateReplayFilter(t *testing.T) {
+	f := NewObfuscateReplayFilter(ObfuscateReplayFilterConfig{
+		Window:     Duration(time.Minute),
+		MaxEntries: 100,
+	})
+	now := time.Now()
+
+	var nonce [kObfuscateNonceLength]byte
+	nonce[0] = 1
+	if f.Check(nonce, now) {
+		t.Fatalf("new nonce is reported as replayed")
+	}
+	if !f.Check(nonce, now.Add(time.Second)) {
+		t.Errorf("replayed nonce is not detected")
+	}
+	if !f.Check(nonce, now.Add(time.Minute+time.Second)) {
+		t.Errorf("nonce is forgotten within the window")
+	}
+	if f.Check(nonce, now.Add(3*time.Minute)) {
+		t.Errorf("nonce is remembered after two windows")
+	}
+
+	// the memory usage is bounded
+	for i := 0; i < 1000; i++ {
+		binary.LittleEndian.PutUint32(nonce[4:], uint32(i))
+		f.Check(nonce, now.Add(3*time.Minute))
+	}
+	if n := f.Len(); n > 100 {
+		t.Errorf("replay filter holds %d entries, more than max entries", n)
+	}
+}
+
+func TestWireGuardObfuscator_ReplayFilter(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	obfuscator.ReplayFilter = NewObfuscateReplayFilter(ObfuscateReplayFilterConfig{})
+
+	for _, m := range []struct {
+		messageType byte
+		length      int
+		replayable  bool
+	}{
+		{device.MessageInitiationType, device.MessageInitiationSize, false},
+		{device.MessageResponseType, device.MessageResponseSize, false},
+		{device.MessageCookieReplyType, device.MessageCookieReplySize, false},
+		{device.MessageTransportType, device.MessageTransportSize, true},
+	} {
+		p := Packet{Data: make([]byte, 1500)}
+		p.Data[0] = m.messageType
+		p.Length = m.length
+		_, _ = rand.Read(p.Data[4:p.Length])
+		original := append([]byte(nil), p.Slice()...)
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		obfuscator.Obfuscate(&p)
+		captured := append([]byte(nil), p.Slice()...)
+
+		obfuscator.Deobfuscate(&p)
+		if p.Flags&PacketFlagDropped != 0 || !bytes.Equal(p.Slice(), original) {
+			t.Errorf("message type %d is not deobfuscated", m.messageType)
+		}
+
+		replayed := Packet{Data: make([]byte, 1500)}
+		replayed.Length = copy(replayed.Data, captured)
+		obfuscator.Deobfuscate(&replayed)
+		if dropped := replayed.Flags&PacketFlagDropped != 0; dropped == m.replayable {
+			t.Errorf("replayed message type %d: dropped=%v", m.messageType, dropped)
+		}
+	}
+	var stats Stats
+	obfuscator.fillStats(&stats)
+	if count := stats.ReplayedPackets; count != 3 {
+		t.Errorf("expected 3 replayed packets, got %d", count)
+	}
+}
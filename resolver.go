@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -11,6 +13,80 @@ type UDPAddrResolver interface {
 	ResolveUDPAddr(ctx context.Context, address string) (addr *net.UDPAddr, err error)
 }
 
+// UDPAddrsResolver is an optional interface of UDPAddrResolver that returns all the resolved addresses,
+// so that mwgp-client can try them in turn.
+type UDPAddrsResolver interface {
+	ResolveUDPAddrs(ctx context.Context, address string) (addrs []*net.UDPAddr, err error)
+}
+
+// The address family selection if a host name is resolved to both IPv4 and IPv6 addresses.
+const (
+	// IPPreferenceIPv4 puts IPv4 addresses first, which is the default.
+	IPPreferenceIPv4 = "prefer_ipv4"
+
+	// IPPreferenceIPv6 puts IPv6 addresses first.
+	IPPreferenceIPv6 = "prefer_ipv6"
+
+	// IPPreferenceAuto keeps the order of the resolver,
+	// the system resolver sorts the addresses by RFC 6724.
+	IPPreferenceAuto = "auto"
+)
+
+func validateIPPreference(preference string) (err error) {
+	switch preference {
+	case "", IPPreferenceIPv4, IPPreferenceIPv6, IPPreferenceAuto:
+	default:
+		err = fmt.Errorf("invalid ip_preference %q, must be %q, %q or %q",
+			preference, IPPreferenceIPv4, IPPreferenceIPv6, IPPreferenceAuto)
+	}
+	return
+}
+
+// resolveUDPAddrs resolves all the addresses of the address, ordered by the preference.
+// IPv4 addresses are always in the 4-bytes form.
+func resolveUDPAddrs(ctx context.Context, resolver UDPAddrResolver, address string, preference string) (addrs []*net.UDPAddr, err error) {
+	if r, ok := resolver.(UDPAddrsResolver); ok {
+		addrs, err = r.ResolveUDPAddrs(ctx, address)
+	} else {
+		var addr *net.UDPAddr
+		addr, err = resolver.ResolveUDPAddr(ctx, address)
+		addrs = []*net.UDPAddr{addr}
+	}
+	if err != nil {
+		err = categorize(ErrNetwork, err)
+		return
+	}
+	if len(addrs) == 0 {
+		err = errorf(ErrNetwork, "no address found for %s", address)
+		return
+	}
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			addr.IP = ip4
+		}
+	}
+	sortUDPAddrsByPreference(addrs, preference)
+	return
+}
+
+func sortUDPAddrsByPreference(addrs []*net.UDPAddr, preference string) {
+	var preferIPv4 bool
+	switch preference {
+	case IPPreferenceAuto:
+		return
+	case IPPreferenceIPv6:
+		preferIPv4 = false
+	default:
+		preferIPv4 = true
+	}
+	isPreferred := func(addr *net.UDPAddr) bool {
+		return (addr.IP.To4() != nil) == preferIPv4
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return isPreferred(addrs[i]) && !isPreferred(addrs[j])
+	})
+}
+
 type UDPAddrResolverCreator = func(url string) (resolver UDPAddrResolver, err error)
 
 var UDPAddrResolverCreators = map[string]UDPAddrResolverCreator{} // Type => Creator
@@ -21,6 +97,32 @@ func (d *defaultUDPAddrResolver) ResolveUDPAddr(ctx context.Context, address str
 	return net.ResolveUDPAddr("udp", address)
 }
 
+func (d *defaultUDPAddrResolver) ResolveUDPAddrs(ctx context.Context, address string) (addrs []*net.UDPAddr, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		portNumber, err = net.DefaultResolver.LookupPort(ctx, "udp", port)
+		if err != nil {
+			return
+		}
+	}
+	if host == "" {
+		addrs = []*net.UDPAddr{{Port: portNumber}}
+		return
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, &net.UDPAddr{IP: ip.IP, Port: portNumber, Zone: ip.Zone})
+	}
+	return
+}
+
 func newUDPAddrResolver(url string) (resolver UDPAddrResolver, err error) {
 	if url == "" {
 		resolver = &defaultUDPAddrResolver{}
@@ -0,0 +1,83 @@
+package mwgp
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type staticUDPAddrsResolver []*net.UDPAddr
+
+func (r staticUDPAddrsResolver) ResolveUDPAddr(ctx context.Context, address string) (addr *net.UDPAddr, err error) {
+	addr = r[0]
+	return
+}
+
+func (r staticUDPAddrsResolver) ResolveUDPAddrs(ctx context.Context, address string) (addrs []*net.UDPAddr, err error) {
+	for _, addr := range r {
+		addrs = append(addrs, &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return
+}
+
+func TestResolveUDPAddrs(t *testing.T) {
+	resolver := staticUDPAddrsResolver{
+		{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+		{IP: net.ParseIP("192.0.2.1"), Port: 1000},
+		{IP: net.ParseIP("2001:db8::2"), Port: 1000},
+		{IP: net.ParseIP("::ffff:192.0.2.2"), Port: 1000},
+	}
+	cases := []struct {
+		preference string
+		expected   []string
+	}{
+		{"", []string{"192.0.2.1:1000", "192.0.2.2:1000", "[2001:db8::1]:1000", "[2001:db8::2]:1000"}},
+		{IPPreferenceIPv4, []string{"192.0.2.1:1000", "192.0.2.2:1000", "[2001:db8::1]:1000", "[2001:db8::2]:1000"}},
+		{IPPreferenceIPv6, []string{"[2001:db8::1]:1000", "[2001:db8::2]:1000", "192.0.2.1:1000", "192.0.2.2:1000"}},
+		{IPPreferenceAuto, []string{"[2001:db8::1]:1000", "192.0.2.1:1000", "[2001:db8::2]:1000", "192.0.2.2:1000"}},
+	}
+	for _, c := range cases {
+		addrs, err := resolveUDPAddrs(context.Background(), resolver, "example.com:1000", c.preference)
+		if err != nil {
+			t.Fatalf("%q: %s", c.preference, err.Error())
+		}
+		if len(addrs) != len(c.expected) {
+			t.Fatalf("%q: expected %d addrs, got %d", c.preference, len(c.expected), len(addrs))
+		}
+		for i, addr := range addrs {
+			if addr.String() != c.expected[i] {
+				t.Errorf("%q: addrs[%d] expected %s, got %s", c.preference, i, c.expected[i], addr)
+			}
+			if ip4 := addr.IP.To4(); ip4 != nil && len(addr.IP) != net.IPv4len {
+				t.Errorf("%q: addrs[%d] %s is not in the 4-bytes form", c.preference, i, addr)
+			}
+		}
+	}
+
+	err := validateIPPreference("prefer_ipv5")
+	if err == nil {
+		t.Errorf("expected an error for invalid ip_preference")
+	}
+}
+
+func TestDefaultUDPAddrResolver_ResolveUDPAddrs(t *testing.T) {
+	resolver := &defaultUDPAddrResolver{}
+	cases := []struct {
+		address  string
+		expected string
+	}{
+		{"192.0.2.1:1000", "192.0.2.1:1000"},
+		{"[2001:db8::1]:1000", "[2001:db8::1]:1000"},
+		{"[::ffff:192.0.2.1]:1000", "192.0.2.1:1000"},
+		{":1000", ":1000"},
+	}
+	for _, c := range cases {
+		addrs, err := resolveUDPAddrs(context.Background(), resolver, c.address, "")
+		if err != nil {
+			t.Fatalf("%s: %s", c.address, err.Error())
+		}
+		if len(addrs) != 1 || addrs[0].String() != c.expected {
+			t.Errorf("%s: expected [%s], got %v", c.address, c.expected, addrs)
+		}
+	}
+}
@@ -77,3 +77,35 @@ func (r *udpResolver) ResolveUDPAddr(ctx context.Context, address string) (addr
 	}
 	return
 }
+
+// ResolveUDPAddrs returns all the resolved addresses in a random order, for load balancing.
+func (r *udpResolver) ResolveUDPAddrs(ctx context.Context, address string) (addrs []*net.UDPAddr, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	ips, err := r.resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		err = fmt.Errorf("cannot resolve host %s: %s", host, err.Error())
+		return
+	}
+	if len(ips) == 0 {
+		err = fmt.Errorf("no ip found for %s", host)
+		return
+	}
+	portNumber, err := r.resolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		err = fmt.Errorf("cannot resolve port %s: %s", port, err.Error())
+		return
+	}
+	rand.Shuffle(len(ips), func(i, j int) {
+		ips[i], ips[j] = ips[j], ips[i]
+	})
+	for _, ip := range ips {
+		addrs = append(addrs, &net.UDPAddr{
+			IP:   ip,
+			Port: portNumber,
+		})
+	}
+	return
+}
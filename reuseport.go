@@ -0,0 +1,53 @@
+package mwgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// listenUDPWorkers opens workers UDP sockets bound to the same addr.
+//
+// With workers > 1, all sockets are opened with SO_REUSEPORT,
+// so that the kernel can distribute incoming packets among them.
+// The control is applied to every socket if not nil.
+func listenUDPWorkers(addr *net.UDPAddr, workers int, control socketControlFunc) (conns []*net.UDPConn, err error) {
+	if workers <= 1 {
+		if control == nil {
+			var conn *net.UDPConn
+			conn, err = net.ListenUDP("udp", addr)
+			if err != nil {
+				return
+			}
+			conns = []*net.UDPConn{conn}
+			return
+		}
+		workers = 1
+	} else if !reusePortSupported {
+		err = fmt.Errorf("multiple workers requires SO_REUSEPORT, which is not supported on %s", runtime.GOOS)
+		return
+	} else {
+		control = chainSocketControl(reusePortControl, control)
+	}
+
+	lc := net.ListenConfig{Control: control}
+	laddr := addr.String()
+	for i := 0; i < workers; i++ {
+		var pc net.PacketConn
+		pc, err = lc.ListenPacket(context.Background(), "udp", laddr)
+		if err != nil {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+			conns = nil
+			return
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+		if i == 0 {
+			// in case of port 0, all other sockets should be bound to the port the first one got
+			laddr = pc.LocalAddr().String()
+		}
+	}
+	return
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package mwgp
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) (err error) {
+	err = fmt.Errorf("SO_REUSEPORT is not supported on %s", runtime.GOOS)
+	return
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+func reusePortControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
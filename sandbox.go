@@ -0,0 +1,70 @@
+package mwgp
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Sandbox:
+//
+// With the Sandbox (Linux only), once all the listening sockets are bound and the files are opened, and after the
+// "Privilege Dropping", mwgp-server restricts itself for the rest of its life:
+//
+// A seccomp filter allows only the syscalls used by the packet path and the Go runtime (reading and writing
+// sockets and files, epoll, futex, clock, timers, memory and signals, creating the sockets to servers, and
+// accepting on the metrics, debug and control sockets). Any other syscall, such as execve, ptrace or mount,
+// raises SIGSYS, which crashes the process with "SIGSYS: bad system call" and the traceback of the offending
+// goroutine instead of failing the syscall silently. It is applied to all the threads and inherited by the new
+// ones. The filter is only available on amd64 and arm64, it is skipped with a warning on the other architectures.
+//
+// A Landlock ruleset restricts the filesystem to reading /etc (for resolving the servers), the key files and the
+// SandboxPaths (such as the config file, so that it can be reloaded), and to reading and writing the directories
+// of the accounting_file, the cache_file_path and the control_socket. A file referenced by a reloaded config out
+// of them cannot be read. It requires every thread to be restricted, so it is skipped with a warning if the binary
+// is built with cgo (build it with CGO_ENABLED=0), and on kernels without Landlock.
+//
+// Both are skipped with a warning if the kernel does not support them, they never fail the start in that case.
+// Neither can be lifted, so the Sandbox cannot be changed by a reload.
+
+// sandbox is the filesystem access of the "Sandbox".
+type sandbox struct {
+	readPaths  []string
+	writePaths []string
+}
+
+// newSandbox collects the paths used by the server with the config, and the extra readable paths.
+func newSandbox(config *ServerConfig, extraReadPaths []string) (s *sandbox) {
+	s = &sandbox{}
+	s.addRead("/etc")
+	for _, key := range append([]string{config.ObfuscateKey}, config.ObfuscateSecondaryKeys...) {
+		if strings.HasPrefix(key, kObfuscateKeyPrefixFile) {
+			s.addRead(key[len(kObfuscateKeyPrefixFile):])
+		}
+	}
+	for _, server := range config.Servers {
+		s.addRead(server.PrivateKeyFile)
+	}
+	for _, path := range extraReadPaths {
+		s.addRead(path)
+	}
+	// the files are written to a temporary file in the same directory and renamed,
+	// and the control socket is removed on exit
+	for _, path := range []string{config.AccountingFile, config.CacheFilePath, config.ControlSocket} {
+		if path != "" {
+			s.addWrite(filepath.Dir(path))
+		}
+	}
+	return
+}
+
+func (s *sandbox) addRead(path string) {
+	if path != "" {
+		s.readPaths = append(s.readPaths, path)
+	}
+}
+
+func (s *sandbox) addWrite(path string) {
+	if path != "" {
+		s.writePaths = append(s.writePaths, path)
+	}
+}
@@ -0,0 +1,210 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const sandboxSupported = true
+
+const (
+	kSeccompSetModeFilter   = 1
+	kSeccompFilterFlagTSync = 1
+
+	kSeccompRetKillProcess = 0x80000000
+	kSeccompRetTrap        = 0x00030000
+	kSeccompRetAllow       = 0x7fff0000
+
+	// the offsets in struct seccomp_data
+	kSeccompDataNR   = 0
+	kSeccompDataArch = 4
+)
+
+// sandboxSyscalls are the syscalls allowed by the seccomp filter on every architecture,
+// see sandboxArchSyscalls for the others.
+var sandboxSyscalls = []uintptr{
+	// files and sockets
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREAD64, unix.SYS_PWRITE64,
+	unix.SYS_CLOSE, unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_LSEEK, unix.SYS_FCNTL, unix.SYS_IOCTL,
+	unix.SYS_OPENAT, unix.SYS_GETDENTS64, unix.SYS_UNLINKAT, unix.SYS_RENAMEAT2,
+	unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_FTRUNCATE, unix.SYS_FCHMOD, unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2,
+	unix.SYS_SOCKET, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_CONNECT, unix.SYS_ACCEPT4, unix.SYS_SHUTDOWN,
+	unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKOPT,
+	unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG, unix.SYS_SENDMMSG, unix.SYS_RECVMMSG,
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_PWAIT2, unix.SYS_PPOLL,
+	unix.SYS_EVENTFD2, unix.SYS_PIPE2,
+	// threads, memory and signals
+	unix.SYS_FUTEX, unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_EXIT, unix.SYS_EXIT_GROUP,
+	unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MADVISE, unix.SYS_BRK,
+	unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK,
+	unix.SYS_RESTART_SYSCALL, unix.SYS_GETPID, unix.SYS_GETTID, unix.SYS_TGKILL, unix.SYS_TKILL,
+	unix.SYS_SCHED_YIELD, unix.SYS_SCHED_GETAFFINITY, unix.SYS_RSEQ, unix.SYS_SET_ROBUST_LIST,
+	unix.SYS_GETRANDOM, unix.SYS_UNAME, unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+	// clock and timers
+	unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_GETRES, unix.SYS_GETTIMEOFDAY, unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE, unix.SYS_SETITIMER, unix.SYS_GETITIMER,
+}
+
+// apply restricts the process, see "Sandbox". The parts not supported by the kernel are skipped with a warning.
+func (s *sandbox) apply(logger Logger) (err error) {
+	err = s.applyLandlock(logger)
+	if err != nil {
+		return
+	}
+	err = s.applySeccomp(logger)
+	return
+}
+
+// landlockHandledAccess is the access restricted by the ruleset, which is the first version of Landlock,
+// so that it works on any kernel with Landlock.
+const landlockHandledAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+	unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+	unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+	unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+
+const (
+	landlockReadAccess  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockWriteAccess = landlockReadAccess | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK
+	// landlockFileAccess is the access that can be granted on a file rather than a directory
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE
+)
+
+func (s *sandbox) applyLandlock(logger Logger) (err error) {
+	attr := unix.LandlockRulesetAttr{Access_fs: landlockHandledAccess}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+			logger.Warnf("sandbox: landlock is not supported by the kernel, the filesystem is not restricted")
+			return
+		}
+		err = fmt.Errorf("sandbox: failed to create landlock ruleset: %w", errno)
+		return
+	}
+	defer unix.Close(int(fd))
+
+	for _, path := range s.readPaths {
+		err = addLandlockRule(int(fd), path, landlockReadAccess, logger)
+		if err != nil {
+			return
+		}
+	}
+	for _, path := range s.writePaths {
+		err = addLandlockRule(int(fd), path, landlockWriteAccess, logger)
+		if err != nil {
+			return
+		}
+	}
+
+	// landlock_restrict_self() applies to the calling thread only, so it is called on all the threads,
+	// which is not possible if any of them is created by cgo.
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno == syscall.ENOTSUP {
+		logger.Warnf("sandbox: landlock cannot be applied to the binary built with cgo, the filesystem is not restricted")
+		return
+	}
+	if errno != 0 {
+		err = fmt.Errorf("sandbox: failed to set no_new_privs: %w", errno)
+		return
+	}
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		err = fmt.Errorf("sandbox: failed to apply landlock ruleset: %w", errno)
+		return
+	}
+	logger.Infof("sandbox: filesystem restricted to reading %v and writing %v", s.readPaths, s.writePaths)
+	return
+}
+
+func addLandlockRule(rulesetFD int, path string, access uint64, logger Logger) (err error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Warnf("sandbox: %s does not exist, it cannot be accessed in the sandbox", path)
+			err = nil
+			return
+		}
+		err = fmt.Errorf("sandbox: failed to open %s: %w", path, err)
+		return
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	err = unix.Fstat(fd, &st)
+	if err != nil {
+		err = fmt.Errorf("sandbox: failed to stat %s: %w", path, err)
+		return
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFD), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		err = fmt.Errorf("sandbox: failed to add landlock rule for %s: %w", path, errno)
+	}
+	return
+}
+
+func (s *sandbox) applySeccomp(logger Logger) (err error) {
+	if sandboxAuditArch == 0 {
+		logger.Warnf("sandbox: seccomp filter is not available on %s, the syscalls are not restricted", runtime.GOARCH)
+		return
+	}
+	syscalls := append(append([]uintptr(nil), sandboxSyscalls...), sandboxArchSyscalls...)
+	filter := sandboxSeccompFilter(syscalls)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is required on the calling thread, and is set on the others along with the filter
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		err = fmt.Errorf("sandbox: failed to set no_new_privs: %w", err)
+		return
+	}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, kSeccompSetModeFilter, kSeccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EINVAL {
+			logger.Warnf("sandbox: seccomp filter is not supported by the kernel, the syscalls are not restricted")
+			return
+		}
+		err = fmt.Errorf("sandbox: failed to apply seccomp filter: %w", errno)
+		return
+	}
+	if r != 0 {
+		err = fmt.Errorf("sandbox: failed to apply seccomp filter to thread %d", r)
+		return
+	}
+	runtime.KeepAlive(filter)
+	logger.Infof("sandbox: syscalls restricted to %d allowed ones", len(syscalls))
+	return
+}
+
+// sandboxSeccompFilter returns the BPF program which kills the process on a foreign architecture,
+// allows the syscalls, and raises SIGSYS on the others.
+func sandboxSeccompFilter(syscalls []uintptr) (filter []unix.SockFilter) {
+	n := len(syscalls)
+	filter = append(filter,
+		unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: kSeccompDataArch},
+		unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: sandboxAuditArch},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: kSeccompRetKillProcess},
+		unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: kSeccompDataNR},
+	)
+	for i, nr := range syscalls {
+		// jump over the rest of the comparisons and the trap to the allow
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(n - i), K: uint32(nr)})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: kSeccompRetTrap},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: kSeccompRetAllow},
+	)
+	return
+}
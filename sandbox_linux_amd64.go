@@ -0,0 +1,12 @@
+package mwgp
+
+import "golang.org/x/sys/unix"
+
+// sandboxAuditArch is AUDIT_ARCH_X86_64, the architecture checked by the seccomp filter.
+const sandboxAuditArch = 0xc000003e
+
+// sandboxArchSyscalls are the syscalls allowed by the seccomp filter only found on amd64.
+var sandboxArchSyscalls = []uintptr{
+	unix.SYS_NEWFSTATAT, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_OPEN, unix.SYS_UNLINK, unix.SYS_RENAME, unix.SYS_RENAMEAT,
+	unix.SYS_POLL, unix.SYS_EPOLL_WAIT, unix.SYS_ARCH_PRCTL,
+}
@@ -0,0 +1,11 @@
+package mwgp
+
+import "golang.org/x/sys/unix"
+
+// sandboxAuditArch is AUDIT_ARCH_AARCH64, the architecture checked by the seccomp filter.
+const sandboxAuditArch = 0xc00000b7
+
+// sandboxArchSyscalls are the syscalls allowed by the seccomp filter only found on arm64.
+var sandboxArchSyscalls = []uintptr{
+	unix.SYS_FSTATAT,
+}
@@ -0,0 +1,8 @@
+//go:build linux && !amd64 && !arm64
+
+package mwgp
+
+// sandboxAuditArch is 0 since the seccomp filter is not available on the architecture.
+const sandboxAuditArch = 0
+
+var sandboxArchSyscalls []uintptr
@@ -0,0 +1,187 @@
+package mwgp
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const (
+	kSandboxTestEnv    = "MWGP_TEST_SANDBOX"
+	kSandboxTestDirEnv = "MWGP_TEST_SANDBOX_DIR"
+)
+
+func TestSandboxSeccompFilter(t *testing.T) {
+	syscalls := []uintptr{0, 1, 60}
+	filter := sandboxSeccompFilter(syscalls)
+	if len(filter) != len(syscalls)+6 {
+		t.Fatalf("expected %d instructions, got %d", len(syscalls)+6, len(filter))
+	}
+	allow := len(filter) - 1
+	for i := range syscalls {
+		pc := 4 + i
+		if target := pc + 1 + int(filter[pc].Jt); target != allow {
+			t.Errorf("comparison of syscall %d jumps to %d instead of the allow at %d", syscalls[i], target, allow)
+		}
+	}
+	if filter[allow].K != kSeccompRetAllow || filter[allow-1].K != kSeccompRetTrap || filter[2].K != kSeccompRetKillProcess {
+		t.Errorf("unexpected return values: %+v", filter)
+	}
+}
+
+func TestNewSandbox(t *testing.T) {
+	s := newSandbox(&ServerConfig{
+		ObfuscateKey:           "file:/run/secrets/obfs",
+		ObfuscateSecondaryKeys: []string{"env:MWGP_OBFS", "file:/run/secrets/obfs.old"},
+		Servers:                []*ServerConfigServer{{PrivateKeyFile: "/etc/mwgp/server.key"}, {}},
+		WGITCacheConfig:        WGITCacheConfig{CacheFilePath: "/var/cache/mwgp/server.json"},
+		AccountingFile:         "/var/lib/mwgp/accounting.json",
+		ControlSocket:          "/run/mwgp/control.sock",
+	}, []string{"/etc/mwgp/server.json"})
+	expectedRead := "/etc /run/secrets/obfs /run/secrets/obfs.old /etc/mwgp/server.key /etc/mwgp/server.json"
+	if read := strings.Join(s.readPaths, " "); read != expectedRead {
+		t.Errorf("expected readable paths %q, got %q", expectedRead, read)
+	}
+	expectedWrite := "/var/lib/mwgp /var/cache/mwgp /run/mwgp"
+	if write := strings.Join(s.writePaths, " "); write != expectedWrite {
+		t.Errorf("expected writable paths %q, got %q", expectedWrite, write)
+	}
+}
+
+// runSandboxTestChild runs the test in a child process with the sandbox, since it cannot be lifted.
+func runSandboxTestChild(t *testing.T, name string, dir string) (output string, err error) {
+	if _, serr := os.Stat("/proc/self/status"); serr != nil {
+		t.Skip("/proc is not available")
+	}
+	status, _ := os.ReadFile("/proc/self/status")
+	if !strings.Contains(string(status), "Seccomp:") {
+		t.Skip("seccomp is not supported by the kernel")
+	}
+	if sandboxAuditArch == 0 {
+		t.Skip("seccomp filter is not available on the architecture")
+	}
+	cmd := exec.Command(os.Args[0], fmt.Sprintf("-test.run=^%s$", name), "-test.v")
+	cmd.Env = append(os.Environ(), kSandboxTestEnv+"=1", kSandboxTestDirEnv+"="+dir)
+	bs, err := cmd.CombinedOutput()
+	output = string(bs)
+	return
+}
+
+// TestSandbox checks that the forwarding works with the sandbox.
+func TestSandbox(t *testing.T) {
+	if os.Getenv(kSandboxTestEnv) == "1" {
+		testSandboxChild(t, os.Getenv(kSandboxTestDirEnv))
+		return
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "outside"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "state"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := runSandboxTestChild(t, "TestSandbox", dir)
+	if err != nil {
+		t.Fatalf("child process failed: %s\n%s", err.Error(), output)
+	}
+	if !strings.Contains(output, "--- PASS: TestSandbox") {
+		t.Fatalf("child process did not pass:\n%s", output)
+	}
+	if !strings.Contains(output, "sandbox: syscalls restricted") {
+		t.Errorf("seccomp filter is not applied:\n%s", output)
+	}
+	if strings.Contains(output, "sandbox: filesystem restricted") && !strings.Contains(output, "outside: permission denied") {
+		t.Errorf("file outside of the sandbox can be read:\n%s", output)
+	}
+}
+
+func testSandboxChild(t *testing.T, dir string) {
+	const obfsKey = "kisekimo, mahoumo, muryoudewaarimasen"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey:   obfsKey,
+		AccountingFile: filepath.Join(dir, "state", "accounting.json"),
+		BatchSize:      16,
+		Sandbox:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	status, err := os.ReadFile("/proc/self/status")
+	if err == nil && !strings.Contains(string(status), "Seccomp:\t2") {
+		t.Errorf("seccomp filter is not applied:\n%s", status)
+	}
+	_, err = os.ReadFile(filepath.Join(dir, "outside"))
+	t.Logf("read outside: %v", err)
+}
+
+// TestSandboxViolation checks that a syscall not allowed crashes the process.
+func TestSandboxViolation(t *testing.T) {
+	if os.Getenv(kSandboxTestEnv) == "1" {
+		err := newSandbox(&ServerConfig{}, nil).apply(&testLogger{})
+		if err != nil {
+			t.Fatalf("failed to apply sandbox: %s", err.Error())
+		}
+		// getppid is not needed by the packet path
+		_ = syscall.Getppid()
+		t.Fatal("the syscall not allowed did not crash the process")
+		return
+	}
+	output, err := runSandboxTestChild(t, "TestSandboxViolation", "")
+	if err == nil {
+		t.Fatalf("expected the child process to crash:\n%s", output)
+	}
+	if !strings.Contains(output, "SIGSYS") {
+		t.Errorf("expected the crash by SIGSYS, got %s:\n%s", err.Error(), output)
+	}
+}
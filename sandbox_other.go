@@ -0,0 +1,15 @@
+//go:build !linux
+
+package mwgp
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const sandboxSupported = false
+
+func (s *sandbox) apply(logger Logger) (err error) {
+	err = fmt.Errorf("sandbox is not supported on %s", runtime.GOOS)
+	return
+}
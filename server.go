@@ -1,21 +1,35 @@
 package mwgp
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.zx2c4.com/wireguard/device"
-	"log"
 	"net"
+	"net/netip"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 type ServerConfigPeer struct {
-	ForwardTo        string `json:"forward_to"`
+	ForwardTo string `json:"forward_to"`
+
+	// forwardTarget resolves the ForwardTo lazily, shared by the copies of the peer.
+	// forwardToAddress is the resolved address, only set in the copy returned by ExtractPeerFunc.
+	forwardTarget    *forwardTarget
 	forwardToAddress *net.UDPAddr
 
+	// ForwardBackups are the backups of the ForwardTo, each one is a "host:port" string or a ServerConfigForward.
+	// New sessions are forwarded to the healthy one with the smallest priority, see forwardFailover.
+	ForwardBackups []ServerConfigForward `json:"forward_backups,omitempty"`
+
+	// failover is nil without the ForwardBackups, shared by the copies of the peer like the forwardTarget.
+	failover *forwardFailover
+
 	// ClientSourceValidateLevel is same config with the one in ServerConfigServer
 	// but intended to be used as a per-peer override.
 	ClientSourceValidateLevel int `json:"csvl,omitempty"`
@@ -26,6 +40,22 @@ type ServerConfigPeer struct {
 
 	ClientPublicKey *NoisePublicKey `json:"pubkey,omitempty"`
 
+	// UpstreamPort pins the local port (or a port in the range) the peer is forwarded to the server from,
+	// see upstreamConnOfPeer. Two peers cannot pin the same port.
+	UpstreamPort    PortRange `json:"upstream_port,omitempty"`
+	upstreamPortMin int
+	upstreamPortMax int
+
+	// RateLimit caps the bandwidth of the sessions of the peer, see bandwidthLimiter.
+	RateLimit *BandwidthLimitConfig `json:"rate_limit,omitempty"`
+
+	// bandwidth is nil without the RateLimit, shared by the copies of the peer like the forwardTarget.
+	bandwidth *bandwidthLimiter
+
+	// SendProxyProtocol prepends a PROXY protocol v2 header with the client address
+	// to the packets forwarded to the server, see "PROXY Protocol".
+	SendProxyProtocol bool `json:"send_proxy_protocol,omitempty"`
+
 	// required by cookie generator
 	serverPublicKey NoisePublicKey
 }
@@ -34,6 +64,28 @@ func (p ServerConfigPeer) isFallback() bool {
 	return p.ClientPublicKey == nil
 }
 
+// validateRateLimit checks the RateLimit if set.
+func (p *ServerConfigPeer) validateRateLimit(pi int) (err error) {
+	if p.RateLimit == nil {
+		return
+	}
+	err = p.RateLimit.validate(fmt.Sprintf("peer[%d]: rate_limit", pi))
+	return
+}
+
+// parseUpstreamPort returns the pinned upstream ports, 0 if the UpstreamPort is not set.
+func (p *ServerConfigPeer) parseUpstreamPort(pi int) (portMin, portMax int, err error) {
+	if p.UpstreamPort == "" {
+		return
+	}
+	portMin, portMax, err = p.UpstreamPort.parse()
+	if err != nil {
+		err = fmt.Errorf("peer[%d] has invalid upstream_port: %w", pi, err)
+		return
+	}
+	return
+}
+
 const (
 	SourceValidateLevelDefault = iota
 
@@ -72,97 +124,360 @@ type ServerConfigServer struct {
 	// ServerSourceValidateLevel specified the way to handle a MessageTransport
 	// packet that comes from a source address not matches to prior packets.
 	ServerSourceValidateLevel int `json:"ssvl,omitempty"`
+
+	// publicKey is computed from the PrivateKey in Initialize().
+	publicKey NoisePublicKey
+
+	// preflightObfuscator is the obfuscator of the preflight messages, derived from the publicKey in Initialize().
+	preflightObfuscator *WireGuardObfuscator
+
+	// forwardResolve is the options for resolving the forward_to addresses, set by the Server.
+	forwardResolve forwardResolveOptions
+
+	// peerIndex maps the client public key to the peer, built from Peers by indexPeers().
+	peerIndex    map[NoisePublicKey]*ServerConfigPeer
+	fallbackPeer *ServerConfigPeer
 }
 
 func (s *ServerConfigServer) Initialize() (err error) {
-	if len(s.Peers) == 0 {
-		err = fmt.Errorf("no peers")
+	err = s.validate(s.forwardResolve).err()
+	if err != nil {
 		return
 	}
 
 	if s.PrivateKey == nil {
-		if s.PrivateKeyFile == "" {
-			err = fmt.Errorf("no server private key provided")
-			return
-		}
-		s.PrivateKey = &NoisePrivateKey{}
-		err = s.PrivateKey.ReadFromFile(s.PrivateKeyFile)
+		privateKey := &NoisePrivateKey{}
+		err = privateKey.ReadFromFile(s.PrivateKeyFile)
 		if err != nil {
 			err = fmt.Errorf("cannot read private key from file %s: %w", s.PrivateKeyFile, err)
 			return
 		}
-	} else {
-		if s.PrivateKeyFile != "" {
-			err = fmt.Errorf("cannot specify both privkey and privkey_file")
-			return
-		}
+		s.PrivateKey = privateKey
 	}
 
-	var foundFallback bool
-	for pi, p := range s.Peers {
-		if p.ClientPublicKey == nil {
-			if foundFallback {
-				err = fmt.Errorf("multiple fallback peers found")
-				return
-			}
-			foundFallback = true
-		}
-
-		if len(p.ForwardTo) == 0 {
-			err = fmt.Errorf("peer[%d] has no forward_to address", pi)
-			return
-		}
+	s.publicKey = s.PrivateKey.PublicKey()
+	s.preflightObfuscator = newPreflightObfuscator(s.publicKey)
 
-		forwardToTokens := strings.Split(p.ForwardTo, ":")
-		if len(forwardToTokens) != 2 {
-			err = fmt.Errorf("peer[%d] has invalid forward_to address %s", pi, p.ForwardTo)
-			return
-		}
-		address := strings.TrimSpace(forwardToTokens[0])
-		port := strings.TrimSpace(forwardToTokens[1])
-		if len(address) == 0 {
-			address = s.Address
-		}
-		forwardToAddress := strings.Join([]string{address, port}, ":")
-		p.forwardToAddress, err = net.ResolveUDPAddr("udp", forwardToAddress)
+	for pi, p := range s.Peers {
+		err = s.initializePeer(pi, p)
 		if err != nil {
-			err = fmt.Errorf("peer[%d] has invalid forward_to address %s: %w", pi, p.ForwardTo, err)
 			return
 		}
+	}
+	s.indexPeers()
+	return
+}
 
-		if p.ClientSourceValidateLevel == SourceValidateLevelDefault {
-			p.ClientSourceValidateLevel = s.ClientSourceValidateLevel
-		}
-		if p.ServerSourceValidateLevel == SourceValidateLevelDefault {
-			p.ServerSourceValidateLevel = s.ServerSourceValidateLevel
+// indexPeers builds the peerIndex, so that the peer can be matched in O(1) for any number of peers.
+// It must be called again once the Peers is replaced.
+func (s *ServerConfigServer) indexPeers() {
+	s.peerIndex = make(map[NoisePublicKey]*ServerConfigPeer, len(s.Peers))
+	s.fallbackPeer = nil
+	for _, peer := range s.Peers {
+		if peer.isFallback() {
+			s.fallbackPeer = peer
+		} else {
+			s.peerIndex[*peer.ClientPublicKey] = peer
 		}
+	}
+}
+
+// initializePeer validates the forward_to address of the peer and fills the defaults from the server.
+// The forward_to host name is resolved on the first handshake of the peer, not here.
+func (s *ServerConfigServer) initializePeer(pi int, p *ServerConfigPeer) (err error) {
+	p.forwardTarget, err = s.newPeerForwardTarget(pi, p, s.forwardResolve)
+	if err != nil {
+		return
+	}
+	p.failover, err = s.newPeerForwardFailover(pi, p, p.forwardTarget, s.forwardResolve)
+	if err != nil {
+		return
+	}
+	p.upstreamPortMin, p.upstreamPortMax, err = p.parseUpstreamPort(pi)
+	if err != nil {
+		return
+	}
+	err = p.validateRateLimit(pi)
+	if err != nil {
+		return
+	}
+	p.bandwidth = newBandwidthLimiter(p.RateLimit)
 
-		p.serverPublicKey = s.PrivateKey.PublicKey()
+	if p.ClientSourceValidateLevel == SourceValidateLevelDefault {
+		p.ClientSourceValidateLevel = s.ClientSourceValidateLevel
+	}
+	if p.ServerSourceValidateLevel == SourceValidateLevelDefault {
+		p.ServerSourceValidateLevel = s.ServerSourceValidateLevel
+	}
+
+	p.serverPublicKey = s.publicKey
+	return
+}
+
+// newPeerForwardTarget returns the forwardTarget of the peer, with the server address if the host is omitted.
+func (s *ServerConfigServer) newPeerForwardTarget(pi int, p *ServerConfigPeer, forwardResolve forwardResolveOptions) (ft *forwardTarget, err error) {
+	ft, err = s.newPeerForwardTargetOf(pi, "forward_to", p.ForwardTo, forwardResolve)
+	return
+}
+
+// newPeerForwardTargetOf returns the forwardTarget of the forwardTo in the option of the peer,
+// with the server address if the host is omitted.
+func (s *ServerConfigServer) newPeerForwardTargetOf(pi int, option, forwardTo string, forwardResolve forwardResolveOptions) (ft *forwardTarget, err error) {
+	if len(forwardTo) == 0 {
+		err = fmt.Errorf("peer[%d] has no %s address", pi, option)
+		return
+	}
+
+	address, port, err := net.SplitHostPort(forwardTo)
+	if err != nil {
+		err = fmt.Errorf("peer[%d] has invalid %s address %s", pi, option, forwardTo)
+		return
+	}
+	address = strings.TrimSpace(address)
+	port = strings.TrimSpace(port)
+	if len(address) == 0 {
+		address = s.Address
+	}
+	if forwardResolve.interval <= 0 {
+		forwardResolve.interval = defaultServerResolveInterval
+	}
+	ft, err = newForwardTarget(net.JoinHostPort(address, port), forwardResolve)
+	if err != nil {
+		err = fmt.Errorf("peer[%d] has invalid %s address %s: %w", pi, option, forwardTo, err)
+		return
 	}
 	return
 }
 
 type ServerConfig struct {
-	Listen        string                `json:"listen"`
-	Timeout       int                   `json:"timeout,omitempty"`
-	MaxPacketSize int                   `json:"max_packet_size,omitempty"`
-	Servers       []*ServerConfigServer `json:"servers"`
-	ObfuscateKey  string                `json:"obfs"`
+	// Listen is the UDP address, or a port range like "0.0.0.0:20000-20100" for the port hopping clients,
+	// which listens on every port in the range. It can be a list of them, see ListenAddresses.
+	Listen          ListenAddresses       `json:"listen"`
+	Timeout         Duration              `json:"timeout,omitempty"`
+	CleanupInterval Duration              `json:"cleanup_interval,omitempty"`
+	MaxPacketSize   int                   `json:"max_packet_size,omitempty"`
+	Servers         []*ServerConfigServer `json:"servers"`
+	ObfuscateKey    string                `json:"obfs"`
+
+	// ObfuscateSecondaryKeys are the old obfuscation keys still accepted during the key rotation.
+	ObfuscateSecondaryKeys []string `json:"obfs_secondary,omitempty"`
+
+	// ObfuscateMode is ObfuscateModeXOR (default) or ObfuscateModeAuthenticated,
+	// it changes the wire format so it must be the same on both ends.
+	ObfuscateMode string `json:"obfs_mode,omitempty"`
+
+	// ObfuscateMinKeyLength is the min length of the obfs and obfs_secondary keys in bytes, default to 8.
+	ObfuscateMinKeyLength int `json:"obfs_min_key_length,omitempty"`
+
+	// MetricsListen is the address of the HTTP server exposing Prometheus metrics at /metrics.
+	MetricsListen string `json:"metrics_listen,omitempty"`
+
+	// DebugListen is the address of the HTTP server exposing net/http/pprof and expvar at /debug/,
+	// it must be a loopback address unless DebugAllowRemote.
+	DebugListen      string `json:"debug_listen,omitempty"`
+	DebugAllowRemote bool   `json:"debug_allow_remote,omitempty"`
+
+	// ControlSocket is the path of the unix domain socket to inspect and manage the running server,
+	// see "Control Socket" in control.go.
+	ControlSocket string `json:"control_socket,omitempty"`
+
+	// CaptureFile is the pcapng file the packets to and from mwgp-client are written to for debugging,
+	// up to CaptureLimitPackets (default 10000), see "Packet Capture" in capture.go.
+	// The capture contains the traffic of the clients, it must be handled as sensitive.
+	CaptureFile         string `json:"capture_file,omitempty"`
+	CaptureLimitPackets int    `json:"capture_limit_packets,omitempty"`
+
+	// User and Group are switched to once all the listening sockets are bound, so that mwgp-server can be started
+	// as root to listen on a privileged port without running as root, see "Privilege Dropping" in privdrop.go.
+	// The primary group of the User is used if the Group is not set (Unix only).
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// Sandbox restricts the syscalls with seccomp and the filesystem with Landlock once all the listening sockets
+	// are bound and the privileges are dropped, see "Sandbox" in sandbox.go (Linux only).
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// FwMark is the SO_MARK set on the listening and the forwarding sockets (Linux only).
+	FwMark int `json:"fwmark,omitempty"`
+
+	// DSCP (0-63) and TTL (1-255) are set on the listening and the forwarding sockets if not 0,
+	// so that the tunnel traffic can be classified by the routers.
+	DSCP int `json:"dscp,omitempty"`
+	TTL  int `json:"ttl,omitempty"`
+
+	// PreserveTOS carries the TOS (the DSCP and the ECN bits) of each packet over the relay (Linux only),
+	// see "ToS Preservation" in tos.go.
+	PreserveTOS bool `json:"preserve_tos,omitempty"`
+
+	// RecvBuffer and SendBuffer are the SO_RCVBUF and SO_SNDBUF of the listening and the forwarding sockets,
+	// in bytes or a string like "4MiB".
+	RecvBuffer ByteSize `json:"recv_buffer,omitempty"`
+	SendBuffer ByteSize `json:"send_buffer,omitempty"`
+
+	// BindDevice (Linux only) and BindAddress are the interface and the local address
+	// of the sockets forwarding to the WireGuard servers.
+	BindDevice  string `json:"bind_device,omitempty"`
+	BindAddress string `json:"bind_address,omitempty"`
+
+	// ObfuscatePadding is the optional padding policy for MessageTransport packets.
+	ObfuscatePadding *ObfuscatePaddingConfig `json:"obfs_padding,omitempty"`
+
+	// ObfuscateStrict drops all non-obfuscated packets from clients,
+	// vanilla WireGuard clients will not be able to connect.
+	ObfuscateStrict bool `json:"obfs_strict,omitempty"`
+
+	// UniformDrop drops every packet from clients that neither belongs to a session nor is a valid MessageInitiation
+	// the same way and in about the same time, see "Uniform Drop" in uniform.go. It implies ObfuscateStrict.
+	UniformDrop bool `json:"uniform_drop,omitempty"`
+
+	// ObfuscateReplayFilter drops the replayed obfuscated handshake packets from clients.
+	ObfuscateReplayFilter *ObfuscateReplayFilterConfig `json:"obfs_replay_filter,omitempty"`
+
+	// Preflight replies the preflight requests from mwgp-client, which tell the client
+	// whether its obfuscation settings are accepted, see preflightClient.
+	Preflight bool `json:"preflight,omitempty"`
+
+	// WebSocket accepts mwgp-client over WebSocket in addition to the UDP listen address if set.
+	WebSocket *WebSocketServerConfig `json:"websocket,omitempty"`
+
+	// TCPListen accepts mwgp-client with "transport": "tcp" on the TCP address in addition to UDP if set.
+	TCPListen string `json:"tcp_listen,omitempty"`
+
+	// BatchSize is the max number of packets read or written in a single syscall (Linux only).
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// ForwardTableShards is the number of the shards of the forward table, a power of two (default 64),
+	// more shards reduce the lock contention between the workers with many clients.
+	ForwardTableShards int `json:"forward_table_shards,omitempty"`
+
+	// UDPOffload enables UDP GRO/GSO with batch_size > 1 if the kernel supports them (Linux only).
+	UDPOffload bool `json:"udp_offload,omitempty"`
+
+	// LatencySampleRate samples one of every this many packets for the latency histograms, 0 (default) disables them.
+	LatencySampleRate int `json:"latency_sample_rate,omitempty"`
+
+	// Trace logs the metadata of each forwarded packet (rate-limited, never the payload) for debugging,
+	// see "Packet Trace" in trace.go. It can be changed by reload.
+	Trace bool `json:"trace,omitempty"`
+
+	// MaxSessions is the max number of peers in the forward table, 0 means unlimited.
+	// MaxSessionsPolicy is MaxSessionsPolicyReject (default) or MaxSessionsPolicyLRU,
+	// which decides what happens to a new handshake once the table is full.
+	MaxSessions       int    `json:"max_sessions,omitempty"`
+	MaxSessionsPolicy string `json:"max_sessions_policy,omitempty"`
+
+	// HandshakeRateLimit limits the handshake initiations from clients per source IP.
+	HandshakeRateLimit *HandshakeRateLimitConfig `json:"handshake_rate_limit,omitempty"`
+
+	// ProbeBan bans the source IPs sending too many invalid packets, see "Probe Ban" in probeban.go.
+	ProbeBan *ProbeBanConfig `json:"probe_ban,omitempty"`
+
+	// RateLimit caps the bandwidth of all the sessions together, see bandwidthLimiter.
+	RateLimit *BandwidthLimitConfig `json:"rate_limit,omitempty"`
+
+	// AllowedClients and DeniedClients are the addresses or CIDRs the new sessions are allowed or denied from,
+	// see "Client ACL" in clientacl.go.
+	AllowedClients []string `json:"allowed_clients,omitempty"`
+	DeniedClients  []string `json:"denied_clients,omitempty"`
+
+	// FallbackForward is the address of a decoy service, the packets from clients that are neither
+	// obfuscated nor plain WireGuard are forwarded to it verbatim, and its responses are relayed back.
+	FallbackForward string `json:"fallback_forward,omitempty"`
+
+	// DrainForward is the address the new clients are relayed to after Drain(), such as another mwgp-server,
+	// they are dropped if not set.
+	DrainForward string `json:"drain_forward,omitempty"`
+
+	// IPPreference is IPPreferenceIPv4 (default), IPPreferenceIPv6 or IPPreferenceAuto,
+	// it decides which address is used if a forward_to host has both A and AAAA records.
+	IPPreference string `json:"ip_preference,omitempty"`
+
+	// ResolveInterval is how long a resolved forward_to host name is cached.
+	// The forward_to host names are resolved on the first handshake, not at the startup.
+	ResolveInterval Duration `json:"resolve_interval,omitempty"`
+
+	// ReresolveWriteErrors is the number of consecutive write errors to a server destination
+	// before the forward_to host names resolved to it are re-resolved, default to 3, -1 to disable.
+	ReresolveWriteErrors int `json:"reresolve_write_errors,omitempty"`
+
+	// UpstreamHealth configures the health check of the server destinations, passive by default,
+	// see upstreamHealthLoop.
+	UpstreamHealth *UpstreamHealthConfig `json:"upstream_health,omitempty"`
+
+	// LogLevel is one of "debug", "info" (default), "warn" and "error",
+	// the logs below the level are suppressed.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// LogFormat is "text" (default) or "json", which writes one JSON object per line.
+	LogFormat string `json:"log_format,omitempty"`
+
+	// AccountingFile is where the traffic of each peer is written every AccountingInterval (default to 1m)
+	// and on shutdown, and read on startup to keep counting, see accounting.go.
+	AccountingFile     string   `json:"accounting_file,omitempty"`
+	AccountingInterval Duration `json:"accounting_interval,omitempty"`
+
 	WGITCacheConfig
 }
 
 type Server struct {
-	wgitTable *WireGuardIndexTranslationTable
-	servers   []*ServerConfigServer
+	// Logger defaults to a StdLogger with the log_level,
+	// it can be replaced before Start().
+	Logger Logger
+
+	// TransportFactory creates the transports instead of the UDP sockets if not nil,
+	// it can be set before Start().
+	TransportFactory PacketTransportFactory
+
+	// OnSessionCreated and OnSessionExpired are called once a session is created or removed if not nil,
+	// they can be set before Start(), see SessionInfo.
+	OnSessionCreated func(info SessionInfo)
+	OnSessionExpired func(info SessionInfo)
+
+	// ReloadFunc is called by the "reload" method of the control socket, such as reading the config file
+	// again and passing it to Reload(). The method fails if it is nil. It can be set before Start().
+	ReloadFunc func() (err error)
+
+	// FilterAllPackets passes every packet from clients to the packet filter instead of the MessageInitiation
+	// creating new sessions only, it can be set before Start(), see SetPacketFilter.
+	FilterAllPackets bool
+
+	// SandboxPaths are the extra paths readable in the "Sandbox", such as the config file read again by
+	// the ReloadFunc. It can be set before Start().
+	SandboxPaths []string
+
+	wgitTable     *WireGuardIndexTranslationTable
+	serversLock   sync.RWMutex
+	servers       []*ServerConfigServer
+	obfuscator    *WireGuardObfuscator
+	capture       *packetCapture
+	privileges    *privileges
+	sandbox       *sandbox
+	metricsListen string
+	debugListen   string
+	controlSocket string
+	webSocket     *WebSocketServerConfig
+	tcpListen     string
+
+	// forwardFailbackDelay is the failback delay of the peers with "forward_backups", see forwardFailover.
+	forwardFailbackDelay time.Duration
+
+	// config is the running config, used to find out what is changed in Reload().
+	config     *ServerConfig
+	reloadLock sync.Mutex
 }
 
 func NewServerWithConfig(config *ServerConfig) (outServer *Server, err error) {
-	if len(config.Servers) == 0 {
-		err = errors.New("no server defined")
+	defer func() {
+		err = categorize(ErrConfig, err)
+	}()
+	err = config.Validate()
+	if err != nil {
 		return
 	}
 
 	for si, s := range config.Servers {
+		s.forwardResolve.preference = config.IPPreference
+		s.forwardResolve.interval = time.Duration(config.ResolveInterval)
 		err = s.Initialize()
 		if err != nil {
 			err = fmt.Errorf("server[%d]: %w", si, err)
@@ -171,26 +486,164 @@ func NewServerWithConfig(config *ServerConfig) (outServer *Server, err error) {
 	}
 
 	server := Server{}
+	server.Logger, err = NewLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		return
+	}
+	server.config = config
 	server.servers = config.Servers
+	server.metricsListen = config.MetricsListen
+	server.debugListen = config.DebugListen
+	server.controlSocket = config.ControlSocket
+	server.privileges, err = parsePrivileges(config.User, config.Group)
+	if err != nil {
+		return
+	}
 	server.wgitTable = NewWireGuardIndexTranslationTable()
-	server.wgitTable.ClientListen, err = net.ResolveUDPAddr("udp", config.Listen)
+	server.wgitTable.Logger = server.Logger
+	server.wgitTable.DSCP = config.DSCP
+	server.wgitTable.TTL = config.TTL
+	server.wgitTable.PreserveTOS = config.PreserveTOS
+	server.wgitTable.RecvBuffer = int(config.RecvBuffer)
+	server.wgitTable.SendBuffer = int(config.SendBuffer)
+	server.wgitTable.ServerListen, err = parseBindOptions(config.BindDevice, config.BindAddress)
+	if err != nil {
+		return
+	}
+	server.wgitTable.BindDevice = config.BindDevice
+	if config.FwMark != 0 {
+		if fwmarkSupported {
+			server.wgitTable.FwMark = config.FwMark
+		} else {
+			server.Logger.Warnf("option \"fwmark\" is not supported on %s, ignored", runtime.GOOS)
+		}
+	}
+	name, systemd, err := config.Listen.systemd()
 	if err != nil {
-		err = fmt.Errorf("invalid listen address %s: %w", config.Listen, err)
 		return
 	}
+	if systemd {
+		server.wgitTable.ClientListenSystemd = true
+		server.wgitTable.ClientListenFDName = name
+	} else {
+		var ranges []ListenRange
+		ranges, err = resolveListenRanges(config.Listen)
+		if err != nil {
+			return
+		}
+		server.wgitTable.setClientListen(ranges)
+	}
 	if config.Timeout > 0 {
-		server.wgitTable.Timeout = time.Duration(config.Timeout) * time.Second
+		server.wgitTable.Timeout = time.Duration(config.Timeout)
 	}
+	server.wgitTable.CleanupInterval = time.Duration(config.CleanupInterval)
 	if config.MaxPacketSize > 0 {
 		server.wgitTable.MaxPacketSize = uint(config.MaxPacketSize)
 	}
+	if config.BatchSize > 0 {
+		server.wgitTable.BatchSize = config.BatchSize
+	}
+	if config.ForwardTableShards > 0 {
+		server.wgitTable.ForwardTableShards = config.ForwardTableShards
+	}
+	server.wgitTable.UDPOffload = config.UDPOffload
+	server.wgitTable.LatencySampleRate = config.LatencySampleRate
+	server.wgitTable.SetTrace(config.Trace)
+	server.wgitTable.MaxSessions = config.MaxSessions
+	server.wgitTable.MaxSessionsPolicy = config.MaxSessionsPolicy
+	server.wgitTable.bandwidthLimit = newBandwidthLimiter(config.RateLimit)
+	acl, err := parseClientACL(config.AllowedClients, config.DeniedClients)
+	if err != nil {
+		return
+	}
+	server.wgitTable.setClientACL(acl)
+	server.wgitTable.AccountingFile = config.AccountingFile
+	server.wgitTable.AccountingInterval = time.Duration(config.AccountingInterval)
+	if config.HandshakeRateLimit != nil {
+		server.wgitTable.HandshakeRateLimiter = NewHandshakeRateLimiter(*config.HandshakeRateLimit)
+	}
+	if config.ProbeBan != nil {
+		server.wgitTable.probeBan = newProbeBanList(config.ProbeBan)
+	}
+	server.wgitTable.UniformDrop = config.UniformDrop
+	if config.FallbackForward != "" {
+		var fallbackAddrs []*net.UDPAddr
+		fallbackAddrs, err = resolveUDPAddrs(context.Background(), &defaultUDPAddrResolver{}, config.FallbackForward, config.IPPreference)
+		if err != nil {
+			err = fmt.Errorf("invalid fallback_forward address %s: %w", config.FallbackForward, err)
+			return
+		}
+		server.wgitTable.FallbackForward = fallbackAddrs[0]
+	}
+	if config.DrainForward != "" {
+		var drainAddrs []*net.UDPAddr
+		drainAddrs, err = resolveUDPAddrs(context.Background(), &defaultUDPAddrResolver{}, config.DrainForward, config.IPPreference)
+		if err != nil {
+			err = fmt.Errorf("invalid drain_forward address %s: %w", config.DrainForward, err)
+			return
+		}
+		server.wgitTable.DrainForward = drainAddrs[0]
+	}
 	server.wgitTable.ExtractPeerFunc = server.extractPeer
+	server.wgitTable.UpstreamWriteErrorFunc = server.handleUpstreamWriteErrors
+	server.wgitTable.UpstreamWriteErrorThreshold = defaultServerReresolveWriteErrors
+	if config.ReresolveWriteErrors != 0 {
+		server.wgitTable.UpstreamWriteErrorThreshold = config.ReresolveWriteErrors
+	}
+	server.wgitTable.UpstreamHealthInterval = defaultUpstreamHealthInterval
+	if uh := config.UpstreamHealth; uh != nil {
+		if uh.Interval > 0 {
+			server.wgitTable.UpstreamHealthInterval = time.Duration(uh.Interval)
+		}
+		server.wgitTable.UpstreamHealthWindow = time.Duration(uh.Window)
+		server.wgitTable.UpstreamHealthProbe = uh.Mode == UpstreamHealthModeActive
+	}
+	server.forwardFailbackDelay = defaultForwardFailbackDelay
+	if config.UpstreamHealth != nil && config.UpstreamHealth.FailbackDelay > 0 {
+		server.forwardFailbackDelay = time.Duration(config.UpstreamHealth.FailbackDelay)
+	}
 	server.wgitTable.CacheJar.WGITCacheConfig = config.WGITCacheConfig
 
+	obfuscateKey, obfuscateSecondaryKeys, err := parseObfuscateKeys(config.ObfuscateKey, config.ObfuscateSecondaryKeys, config.ObfuscateMinKeyLength)
+	if err != nil {
+		return
+	}
+	defer zeroObfuscateKeys(obfuscateKey, obfuscateSecondaryKeys)
+	warnWeakObfuscateKeys(server.Logger, obfuscateKey, obfuscateSecondaryKeys)
 	var obfuscator WireGuardObfuscator
-	obfuscator.Initialize(config.ObfuscateKey)
-	server.wgitTable.ClientWriteToUDPFunc = obfuscator.WriteToUDPWithObfuscate
-	server.wgitTable.ClientReadFromUDPFunc = obfuscator.ReadFromUDPWithDeobfuscate
+	obfuscator.InitializeWithKey(obfuscateKey, obfuscateSecondaryKeys...)
+	obfuscator.Padding = config.ObfuscatePadding
+	obfuscator.Strict = config.ObfuscateStrict || config.UniformDrop
+	obfuscator.Uniform = config.UniformDrop
+	obfuscator.Authenticated, err = parseObfuscateMode(config.ObfuscateMode)
+	if err != nil {
+		return
+	}
+	if config.ObfuscateReplayFilter != nil {
+		obfuscator.ReplayFilter = NewObfuscateReplayFilter(*config.ObfuscateReplayFilter)
+	}
+	if server.wgitTable.probeBan != nil {
+		obfuscator.BlockFunc = server.wgitTable.blockProbeSource
+	}
+	server.wgitTable.ClientWriteFunc = obfuscator.WritePacketWithObfuscate
+	server.wgitTable.ClientReadFunc = obfuscator.ReadPacketWithDeobfuscate
+	server.wgitTable.ClientWriteBatchFunc = obfuscator.WriteBatchWithObfuscate
+	server.wgitTable.ClientReadBatchFunc = obfuscator.ReadBatchWithDeobfuscate
+	server.obfuscator = &obfuscator
+	if capture := newPacketCapture(config.CaptureFile, config.CaptureLimitPackets); capture != nil {
+		capture.wrapObfuscator(&obfuscator, false)
+		table := server.wgitTable
+		table.ClientReadFunc = capture.wrapReadFunc(kCaptureAfterDeobfuscate, false, table.ClientReadFunc)
+		table.ClientReadBatchFunc = capture.wrapReadBatchFunc(kCaptureAfterDeobfuscate, false, table.ClientReadBatchFunc)
+		table.ClientWriteFunc = capture.wrapWriteFunc(kCaptureBeforeObfuscate, true, table.ClientWriteFunc)
+		table.ClientWriteBatchFunc = capture.wrapWriteBatchFunc(kCaptureBeforeObfuscate, true, table.ClientWriteBatchFunc)
+		server.capture = capture
+	}
+	if config.Preflight {
+		server.wgitTable.ControlPacketFunc = server.handlePreflight
+	}
+	server.webSocket = config.WebSocket
+	server.tcpListen = config.TCPListen
 
 	outServer = &server
 	return
@@ -227,52 +680,619 @@ func (s *Server) extractPeer(msg *device.MessageInitiation) (sp *ServerConfigPee
 		return
 	}
 
-	if len(s.servers) == 0 {
-		err = fmt.Errorf("no server configured")
+	s.serversLock.RLock()
+	servers := s.servers
+	s.serversLock.RUnlock()
+
+	if len(servers) == 0 {
+		err = newError(ErrConfig, "no server configured")
 		return
 	}
 
+	// the rest of the servers are also tried after the match for the "Uniform Drop"
 	var matchedServer *ServerConfigServer
 	var peerPK NoisePublicKey
-	for _, server := range s.servers {
-		peerPK, err = tryDecryptPeerPKWith(*server.PrivateKey)
-		if err == nil {
-			matchedServer = server
+	for _, server := range servers {
+		if matchedServer != nil && !s.wgitTable.UniformDrop {
 			break
 		}
+		pk, derr := tryDecryptPeerPKWith(*server.PrivateKey)
+		if matchedServer != nil {
+			continue
+		}
+		if derr != nil {
+			err = derr
+			continue
+		}
+		matchedServer, peerPK, err = server, pk, nil
+	}
+	if matchedServer == nil {
+		err = errorf(ErrCrypto, "no server private key decrypted the message: %w", err)
+		return
+	}
+
+	matchedServerPeer := matchedServer.matchPeer(peerPK)
+	if matchedServerPeer == nil {
+		err = errorf(ErrProtocol, "no matched server peer for %s and no fallback server peer for server %s", peerPK.Base64(), matchedServer.publicKey.Base64())
+		return
+	}
+
+	copiedPeer := *matchedServerPeer
+	copiedPeer.ClientPublicKey = &peerPK
+	copiedPeer.forwardToAddress, err = s.resolveForwardTarget(matchedServerPeer.activeForwardTarget())
+	if err != nil {
+		return
 	}
+	sp = &copiedPeer
+	return
+}
+
+// resolveForwardTarget returns the resolved forward_to address,
+// or the stale one with a warning if the re-resolution failed.
+func (s *Server) resolveForwardTarget(ft *forwardTarget) (addr *net.UDPAddr, err error) {
+	addr, changed, err := ft.resolve(s.wgitTable.context(), time.Now())
 	if err != nil {
-		err = fmt.Errorf("no server private key decrypted the message: %w", err)
+		if addr == nil {
+			err = fmt.Errorf("failed to resolve forward_to address %s: %w", ft.address, err)
+			return
+		}
+		s.Logger.Warnf("failed to re-resolve forward_to address %s, keep using %s: %s", ft.address, addr.String(), err.Error())
+		err = nil
 		return
 	}
+	if changed {
+		s.Logger.Infof("forward_to address %s is resolved to %s", ft.address, addr.String())
+	}
+	return
+}
 
-	var matchedServerPeer *ServerConfigPeer
-	var fallbackServerPeer *ServerConfigPeer
-	for _, peer := range matchedServer.Peers {
-		if peer.isFallback() {
-			fallbackServerPeer = peer
-		} else {
-			if peer.ClientPublicKey.Equals(peerPK.NoisePublicKey) {
-				matchedServerPeer = peer
+// handleUpstreamWriteErrors is called by the forward table (in the write loop, so it must not block)
+// after consecutive write errors to the server destination.
+func (s *Server) handleUpstreamWriteErrors(addr netip.AddrPort) {
+	s.wgitTable.goBackground(func() { s.reresolveForwardTargets(addr) })
+}
+
+// reresolveForwardTargets re-resolves the forward_to host names resolved to the addr,
+// and evicts the sessions forwarded to the old addresses, so that the clients handshake again with the new ones.
+func (s *Server) reresolveForwardTargets(addr netip.AddrPort) (changed int) {
+	s.serversLock.RLock()
+	servers := s.servers
+	s.serversLock.RUnlock()
+
+	now := time.Now()
+	for _, cs := range servers {
+		for _, p := range cs.Peers {
+			for _, ft := range p.forwardTargets() {
+				if !ft.invalidate(addr) {
+					continue
+				}
+				newAddr, c, err := ft.resolve(s.wgitTable.context(), now)
+				if err != nil {
+					s.Logger.Warnf("failed to re-resolve forward_to address %s after write errors to %s: %s", ft.address, addr, err.Error())
+					continue
+				}
+				if c {
+					changed++
+					s.Logger.Infof("forward_to address %s is re-resolved after write errors: %s => %s", ft.address, addr, newAddr.String())
+				}
 			}
 		}
 	}
-	if matchedServerPeer == nil {
-		matchedServerPeer = fallbackServerPeer
+	if changed > 0 {
+		evicted := s.evictStaleSessions(servers)
+		s.Logger.Infof("%d forward_to addresses changed, %d sessions evicted", changed, evicted)
 	}
+	return
+}
+
+// matchPeer returns the peer for the client public key, or the fallback peer if no one matched.
+func (s *ServerConfigServer) matchPeer(peerPK NoisePublicKey) (matchedServerPeer *ServerConfigPeer) {
+	matchedServerPeer = s.peerIndex[peerPK]
 	if matchedServerPeer == nil {
-		err = fmt.Errorf("no matched server peer and no fallback server peer for server %s", matchedServer.PrivateKey.Base64())
+		matchedServerPeer = s.fallbackPeer
+	}
+	return
+}
+
+// Reload applies the config to the running server, without dropping the active sessions.
+//
+// Peers, timeout and obfuscation key are applied immediately.
+// Sessions of the removed peers (or peers forwarded to another address) are evicted,
+// other sessions are kept intact.
+// Changes to other options are ignored with a warning, since they require a restart.
+// The config is checked by Validate() first, and the listen address cannot be changed,
+// Reload returns an error without applying anything otherwise.
+func (s *Server) Reload(config *ServerConfig) (err error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	defer func() {
+		err = categorize(ErrConfig, err)
+	}()
+	// nothing is applied unless NewServerWithConfig would accept the config as well
+	err = config.Validate()
+	if err != nil {
 		return
 	}
 
-	copiedPeer := *matchedServerPeer
-	copiedPeer.ClientPublicKey = &peerPK
-	sp = &copiedPeer
+	_, systemd, err := config.Listen.systemd()
+	if err != nil {
+		return
+	}
+	if systemd || s.wgitTable.ClientListenSystemd {
+		if config.Listen.String() != s.config.Listen.String() {
+			err = fmt.Errorf("listen address cannot be changed by reload: %s => %s", s.config.Listen, config.Listen)
+			return
+		}
+	} else {
+		ranges, rerr := resolveListenRanges(config.Listen)
+		if rerr != nil {
+			err = rerr
+			return
+		}
+		if !sameListenRanges(ranges, s.wgitTable.clientListenRanges()) {
+			err = fmt.Errorf("listen address cannot be changed by reload: %s => %s", s.config.Listen, config.Listen)
+			return
+		}
+	}
+	for si, cs := range config.Servers {
+		cs.forwardResolve.preference = config.IPPreference
+		cs.forwardResolve.interval = time.Duration(config.ResolveInterval)
+		err = cs.Initialize()
+		if err != nil {
+			err = fmt.Errorf("server[%d]: %w", si, err)
+			return
+		}
+	}
+	obfuscateKey, obfuscateSecondaryKeys, err := parseObfuscateKeys(config.ObfuscateKey, config.ObfuscateSecondaryKeys, config.ObfuscateMinKeyLength)
+	if err != nil {
+		return
+	}
+	defer zeroObfuscateKeys(obfuscateKey, obfuscateSecondaryKeys)
+	warnWeakObfuscateKeys(s.Logger, obfuscateKey, obfuscateSecondaryKeys)
+	if s.obfuscator.Strict && len(obfuscateKey) == 0 {
+		err = fmt.Errorf("obfs_strict requires obfs to be set")
+		return
+	}
+	if s.obfuscator.Authenticated && len(obfuscateKey) == 0 {
+		err = fmt.Errorf("obfs_mode %q requires obfs to be set", ObfuscateModeAuthenticated)
+		return
+	}
+
+	acl, err := parseClientACL(config.AllowedClients, config.DeniedClients)
+	if err != nil {
+		return
+	}
+
+	old := s.config
+	for _, o := range restartOnlyOptions {
+		if o.changed(config, old) {
+			warnRestartRequired(s.Logger, o.name)
+		}
+	}
+
+	s.serversLock.RLock()
+	inheritForwardTargets(config.Servers, s.servers)
+	inheritBandwidthLimiters(config.Servers, s.servers)
+	s.serversLock.RUnlock()
+	s.serversLock.Lock()
+	s.servers = config.Servers
+	s.serversLock.Unlock()
+
+	if config.Timeout != old.Timeout {
+		timeout := defaultTimeout
+		if config.Timeout > 0 {
+			timeout = time.Duration(config.Timeout)
+		}
+		s.wgitTable.SetTimeout(timeout)
+		s.Logger.Infof("reload: timeout changed to %s", timeout)
+	}
+	if config.Trace != old.Trace {
+		s.wgitTable.SetTrace(config.Trace)
+		s.Logger.Infof("reload: trace changed to %v", config.Trace)
+	}
+	if !s.obfuscator.hasKey(obfuscateKey, obfuscateSecondaryKeys...) {
+		s.obfuscator.SetKey(obfuscateKey, obfuscateSecondaryKeys...)
+		s.Logger.Infof("reload: obfuscation key changed")
+		s.obfuscator.logKeyFingerprints(s.Logger, "server")
+	}
+
+	s.wgitTable.setClientACL(acl)
+	evicted := s.evictStaleSessions(config.Servers)
+
+	// keep the options that are not applied
+	applied := *config
+	for _, o := range restartOnlyOptions {
+		o.keep(&applied, old)
+	}
+	s.config = &applied
+
+	s.Logger.Infof("reload: %d servers applied, %d sessions evicted", len(config.Servers), evicted)
 	return
 }
 
+// evictStaleSessions evicts the sessions that no longer match a peer of the servers,
+// or match a peer forwarded to another address (none of its forward targets),
+// or from a client address not allowed by the allowed_clients and denied_clients.
+// The sessions of a peer whose forward_to host name is not resolved yet are evicted as well.
+func (s *Server) evictStaleSessions(servers []*ServerConfigServer) (count int) {
+	acl := s.wgitTable.loadClientACL()
+	count = s.wgitTable.evictPeers(func(peer *Peer) bool {
+		if !acl.permitsUDPAddr(peer.clientAddr()) {
+			return true
+		}
+		for _, cs := range servers {
+			if cs.publicKey != peer.serverPublicKey {
+				continue
+			}
+			sp := cs.matchPeer(peer.clientPublicKey)
+			if sp == nil {
+				return true
+			}
+			return !sp.forwardsTo(peer.serverAddr())
+		}
+		return true
+	})
+	return
+}
+
+// AddPeer adds a peer to the running server with the serverPublicKey.
+//
+// A peer without ClientPublicKey is added as the fallback peer.
+// It returns an error if the server is not found, or the peer (or the fallback peer) already exists.
+// Sessions that were matched by the fallback peer but now belong to the new peer are evicted.
+//
+// Peers added at runtime are not written back to the config file,
+// so they are dropped by the next Reload() unless they are added to the config file as well.
+func (s *Server) AddPeer(serverPublicKey NoisePublicKey, peer *ServerConfigPeer) (err error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	err = s.updatePeers(serverPublicKey, func(cs *ServerConfigServer) (peers []*ServerConfigPeer, err error) {
+		for _, p := range cs.Peers {
+			if p.isFallback() && peer.isFallback() {
+				err = fmt.Errorf("fallback peer already exists")
+				return
+			}
+			if !p.isFallback() && !peer.isFallback() && *p.ClientPublicKey == *peer.ClientPublicKey {
+				err = fmt.Errorf("peer %s already exists", peer.ClientPublicKey.Base64())
+				return
+			}
+		}
+		newPeer := *peer
+		err = cs.initializePeer(len(cs.Peers), &newPeer)
+		if err != nil {
+			return
+		}
+		peers = make([]*ServerConfigPeer, 0, len(cs.Peers)+1)
+		peers = append(peers, cs.Peers...)
+		peers = append(peers, &newPeer)
+		return
+	})
+	return
+}
+
+// RemovePeer removes the peer with the clientPublicKey from the running server with the serverPublicKey,
+// a nil clientPublicKey removes the fallback peer.
+//
+// Sessions of the removed peer are evicted, unless they are still matched by the fallback peer
+// with the same forward_to address.
+func (s *Server) RemovePeer(serverPublicKey NoisePublicKey, clientPublicKey *NoisePublicKey) (err error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	err = s.updatePeers(serverPublicKey, func(cs *ServerConfigServer) (peers []*ServerConfigPeer, err error) {
+		peers = make([]*ServerConfigPeer, 0, len(cs.Peers))
+		for _, p := range cs.Peers {
+			if p.isFallback() && clientPublicKey == nil {
+				continue
+			}
+			if !p.isFallback() && clientPublicKey != nil && *p.ClientPublicKey == *clientPublicKey {
+				continue
+			}
+			peers = append(peers, p)
+		}
+		if len(peers) == len(cs.Peers) {
+			if clientPublicKey == nil {
+				err = fmt.Errorf("no fallback peer")
+			} else {
+				err = fmt.Errorf("no peer %s", clientPublicKey.Base64())
+			}
+			return
+		}
+		return
+	})
+	return
+}
+
+// updatePeers replaces the peers of the server with the serverPublicKey by copy-on-write,
+// so that extractPeer() never sees a partially updated peer list.
+//
+// It must be called with the reloadLock held.
+func (s *Server) updatePeers(serverPublicKey NoisePublicKey, update func(cs *ServerConfigServer) (peers []*ServerConfigPeer, err error)) (err error) {
+	s.serversLock.RLock()
+	servers := s.servers
+	s.serversLock.RUnlock()
+
+	si := -1
+	for i, cs := range servers {
+		if cs.publicKey == serverPublicKey {
+			si = i
+			break
+		}
+	}
+	if si < 0 {
+		err = fmt.Errorf("no server with public key %s", serverPublicKey.Base64())
+		return
+	}
+
+	peers, err := update(servers[si])
+	if err != nil {
+		return
+	}
+	newServer := *servers[si]
+	newServer.Peers = peers
+	newServer.indexPeers()
+	newServers := make([]*ServerConfigServer, len(servers))
+	copy(newServers, servers)
+	newServers[si] = &newServer
+
+	s.serversLock.Lock()
+	s.servers = newServers
+	s.serversLock.Unlock()
+
+	config := *s.config
+	config.Servers = newServers
+	s.config = &config
+
+	evicted := s.evictStaleSessions(newServers)
+	s.Logger.Infof("peers of server %s updated, %d peers, %d sessions evicted", serverPublicKey.Base64(), len(peers), evicted)
+	return
+}
+
+// runningConfig returns the running config, which is replaced (never modified in place)
+// by Reload, AddPeer and RemovePeer.
+func (s *Server) runningConfig() *ServerConfig {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	return s.config
+}
+
+// restartOnlyOption is an option of the ServerConfig which is not applied by Reload,
+// fields returns the pointers to the fields of the option in the config.
+type restartOnlyOption struct {
+	name   string
+	fields func(c *ServerConfig) []interface{}
+}
+
+// changed reports whether the option of the config differs from the old one.
+func (o restartOnlyOption) changed(config, old *ServerConfig) bool {
+	return !reflect.DeepEqual(o.fields(config), o.fields(old))
+}
+
+// keep copies the option of the old config to the config.
+func (o restartOnlyOption) keep(config, old *ServerConfig) {
+	values := o.fields(old)
+	for i, field := range o.fields(config) {
+		reflect.ValueOf(field).Elem().Set(reflect.ValueOf(values[i]).Elem())
+	}
+}
+
+// restartOnlyOptions are warned by Reload if changed and kept until a restart,
+// the other options of the ServerConfig are applied by Reload.
+var restartOnlyOptions = []restartOnlyOption{
+	{"max_packet_size", func(c *ServerConfig) []interface{} { return []interface{}{&c.MaxPacketSize} }},
+	{"cleanup_interval", func(c *ServerConfig) []interface{} { return []interface{}{&c.CleanupInterval} }},
+	{"batch_size", func(c *ServerConfig) []interface{} { return []interface{}{&c.BatchSize} }},
+	{"forward_table_shards", func(c *ServerConfig) []interface{} { return []interface{}{&c.ForwardTableShards} }},
+	{"udp_offload", func(c *ServerConfig) []interface{} { return []interface{}{&c.UDPOffload} }},
+	{"latency_sample_rate", func(c *ServerConfig) []interface{} { return []interface{}{&c.LatencySampleRate} }},
+	{"capture_file/capture_limit_packets", func(c *ServerConfig) []interface{} {
+		return []interface{}{&c.CaptureFile, &c.CaptureLimitPackets}
+	}},
+	{"user/group", func(c *ServerConfig) []interface{} { return []interface{}{&c.User, &c.Group} }},
+	{"sandbox", func(c *ServerConfig) []interface{} { return []interface{}{&c.Sandbox} }},
+	{"reresolve_write_errors", func(c *ServerConfig) []interface{} { return []interface{}{&c.ReresolveWriteErrors} }},
+	{"max_sessions/max_sessions_policy", func(c *ServerConfig) []interface{} {
+		return []interface{}{&c.MaxSessions, &c.MaxSessionsPolicy}
+	}},
+	{"handshake_rate_limit", func(c *ServerConfig) []interface{} { return []interface{}{&c.HandshakeRateLimit} }},
+	{"probe_ban", func(c *ServerConfig) []interface{} { return []interface{}{&c.ProbeBan} }},
+	{"rate_limit", func(c *ServerConfig) []interface{} { return []interface{}{&c.RateLimit} }},
+	{"upstream_health", func(c *ServerConfig) []interface{} { return []interface{}{&c.UpstreamHealth} }},
+	{"fallback_forward", func(c *ServerConfig) []interface{} { return []interface{}{&c.FallbackForward} }},
+	{"drain_forward", func(c *ServerConfig) []interface{} { return []interface{}{&c.DrainForward} }},
+	{"metrics_listen", func(c *ServerConfig) []interface{} { return []interface{}{&c.MetricsListen} }},
+	{"debug_listen/debug_allow_remote", func(c *ServerConfig) []interface{} {
+		return []interface{}{&c.DebugListen, &c.DebugAllowRemote}
+	}},
+	{"control_socket", func(c *ServerConfig) []interface{} { return []interface{}{&c.ControlSocket} }},
+	{"fwmark", func(c *ServerConfig) []interface{} { return []interface{}{&c.FwMark} }},
+	{"dscp/ttl", func(c *ServerConfig) []interface{} { return []interface{}{&c.DSCP, &c.TTL} }},
+	{"preserve_tos", func(c *ServerConfig) []interface{} { return []interface{}{&c.PreserveTOS} }},
+	{"recv_buffer/send_buffer", func(c *ServerConfig) []interface{} { return []interface{}{&c.RecvBuffer, &c.SendBuffer} }},
+	{"bind_device/bind_address", func(c *ServerConfig) []interface{} { return []interface{}{&c.BindDevice, &c.BindAddress} }},
+	{"preflight", func(c *ServerConfig) []interface{} { return []interface{}{&c.Preflight} }},
+	{"websocket", func(c *ServerConfig) []interface{} { return []interface{}{&c.WebSocket} }},
+	{"tcp_listen", func(c *ServerConfig) []interface{} { return []interface{}{&c.TCPListen} }},
+	{"obfs_strict", func(c *ServerConfig) []interface{} { return []interface{}{&c.ObfuscateStrict} }},
+	{"uniform_drop", func(c *ServerConfig) []interface{} { return []interface{}{&c.UniformDrop} }},
+	{"obfs_padding", func(c *ServerConfig) []interface{} { return []interface{}{&c.ObfuscatePadding} }},
+	{"obfs_mode", func(c *ServerConfig) []interface{} { return []interface{}{&c.ObfuscateMode} }},
+	{"obfs_replay_filter", func(c *ServerConfig) []interface{} { return []interface{}{&c.ObfuscateReplayFilter} }},
+	{"cache_file_path", func(c *ServerConfig) []interface{} { return []interface{}{&c.WGITCacheConfig} }},
+	{"accounting_file/accounting_interval", func(c *ServerConfig) []interface{} {
+		return []interface{}{&c.AccountingFile, &c.AccountingInterval}
+	}},
+	{"log_level/log_format", func(c *ServerConfig) []interface{} { return []interface{}{&c.LogLevel, &c.LogFormat} }},
+}
+
+func warnRestartRequired(logger Logger, option string) {
+	logger.Warnf("reload: option %q is changed but it requires a restart to take effect", option)
+}
+
 func (s *Server) Start() (err error) {
-	log.Printf("[info] listen on %s ...\n", s.wgitTable.ClientListen)
+	// the metrics, debug and control listeners are served until Start returns
+	serversDone := make(chan struct{})
+	var serverListeners []net.Listener
+	defer func() {
+		if err != nil {
+			// release them now, so that Start can be retried
+			for _, listener := range serverListeners {
+				_ = listener.Close()
+			}
+		}
+		close(serversDone)
+	}()
+	if s.metricsListen != "" {
+		var ms *metricsServer
+		ms, err = newMetricsServer(s.metricsListen, s.Logger, s.Stats)
+		if err != nil {
+			return
+		}
+		serverListeners = append(serverListeners, ms.listener)
+		go ms.Serve(serversDone)
+	}
+	if s.debugListen != "" {
+		var ds *debugServer
+		ds, err = newDebugServer(s.debugListen, s.Logger, s.Stats)
+		if err != nil {
+			return
+		}
+		serverListeners = append(serverListeners, ds.listener)
+		go ds.Serve(serversDone)
+	}
+	if s.controlSocket != "" {
+		var cs *controlServer
+		cs, err = newControlServer(s.controlSocket, s.Logger, s.controlHandlers())
+		if err != nil {
+			return
+		}
+		serverListeners = append(serverListeners, cs.listener)
+		go cs.Serve(serversDone)
+	}
+	err = s.capture.open(s.Logger)
+	if err != nil {
+		return
+	}
+	defer s.capture.close()
+	if s.wgitTable.Logger != s.Logger {
+		// replaced after NewServerWithConfig()
+		s.wgitTable.Logger = s.Logger
+	}
+	s.wgitTable.TransportFactory = s.TransportFactory
+	s.wgitTable.OnSessionCreated = s.OnSessionCreated
+	s.wgitTable.OnSessionExpired = s.OnSessionExpired
+	s.wgitTable.FilterAllPackets = s.FilterAllPackets
+	var extraTransports []PacketTransport
+	closeExtraTransports := func() {
+		for _, transport := range extraTransports {
+			_ = transport.Close()
+		}
+	}
+	if s.webSocket != nil {
+		var ws *webSocketServerTransport
+		ws, err = newWebSocketServerTransport(s.webSocket, int(s.wgitTable.MaxPacketSize), s.Logger)
+		if err != nil {
+			return
+		}
+		extraTransports = append(extraTransports, ws)
+		s.Logger.Infof("listen on websocket %s%s ...", ws.Addr(), ws.path)
+	}
+	if s.tcpListen != "" {
+		var tt *tcpServerTransport
+		tt, err = newTCPServerTransport(s.tcpListen, int(s.wgitTable.MaxPacketSize), s.Logger)
+		if err != nil {
+			closeExtraTransports()
+			return
+		}
+		extraTransports = append(extraTransports, tt)
+		s.Logger.Infof("listen on tcp %s ...", tt.Addr())
+	}
+	s.wgitTable.ExtraClientTransports = extraTransports
+	if config := s.runningConfig(); config.Sandbox {
+		s.sandbox = newSandbox(config, s.SandboxPaths)
+	}
+	if s.privileges != nil || s.sandbox != nil {
+		s.wgitTable.ListenedFunc = s.listened
+	}
+	if s.wgitTable.UpstreamHealthInterval > 0 {
+		go s.forwardFailoverLoop()
+	}
+	s.obfuscator.logKeyFingerprints(s.Logger, "server")
+	s.Logger.Infof("listen on %s ...", s.wgitTable.clientListenString())
 	err = s.wgitTable.Serve()
+	// all the packets are processed, see "Key Hygiene" in obfs.go
+	s.obfuscator.Close()
+	return
+}
+
+// listened drops the privileges and applies the sandbox once all the sockets are listened.
+func (s *Server) listened() (err error) {
+	if s.privileges != nil {
+		err = s.dropPrivileges()
+		if err != nil {
+			return
+		}
+	}
+	if s.sandbox != nil {
+		err = s.sandbox.apply(s.Logger)
+	}
+	return
+}
+
+// dropPrivileges switches to the User and the Group once all the sockets are listened, see "Privilege Dropping".
+func (s *Server) dropPrivileges() (err error) {
+	err = s.privileges.drop()
+	if err != nil {
+		return
+	}
+	s.Logger.Infof("dropped privileges to %s", s.privileges)
+	return
+}
+
+// Stop closes the listening sockets and waits for all in-flight packets to be
+// processed, then the Start() will return with nil error.
+//
+// It is safe to be called concurrently and more than once.
+func (s *Server) Stop() (err error) {
+	err = s.wgitTable.Close()
+	return
+}
+
+// Run starts the server and stops it once the ctx is done.
+// It returns the error of Start(), which is nil if the server is stopped.
+func (s *Server) Run(ctx context.Context) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Stop()
+		case <-done:
+		}
+	}()
+	err = s.Start()
+	return
+}
+
+// Drain stops accepting new clients before a planned restart, the established sessions are forwarded
+// until they expire, the ActiveSessions of the Stats() is the number of them remaining.
+// The new clients are dropped, or relayed to the drain_forward address if set.
+//
+// It cannot be undone, and the Stop() is still immediate while draining.
+func (s *Server) Drain() {
+	s.wgitTable.Drain()
+}
+
+// Sessions returns the active sessions, see WireGuardIndexTranslationTable.Snapshot().
+func (s *Server) Sessions() []SessionInfo {
+	return s.wgitTable.Snapshot()
+}
+
+// Stats returns a snapshot of the counters of the forward table.
+func (s *Server) Stats() (stats Stats) {
+	stats = s.wgitTable.Stats()
+	s.obfuscator.fillStats(&stats)
+	s.fillForwardStats(&stats)
 	return
 }
@@ -0,0 +1,109 @@
+package mwgp
+
+import (
+	"time"
+)
+
+// Server Options:
+//
+// NewServer creates a Server from a list of ServerOption instead of a ServerConfig, for the programs embedding
+// mwgp-server with everything in memory. The options only fill a ServerConfig, which is validated and applied by
+// NewServerWithConfig, so a server created by either way behaves the same, and both can be reloaded with Reload().
+// A config file is just another source of the ServerConfig, see ServerConfigOption.
+
+// ServerOption is an option of NewServer.
+type ServerOption func(options *serverOptions)
+
+type serverOptions struct {
+	config           ServerConfig
+	logger           Logger
+	transportFactory PacketTransportFactory
+}
+
+// ServerConfigOption starts with a copy of the config, the following options are applied on top of it.
+func ServerConfigOption(config *ServerConfig) ServerOption {
+	return func(options *serverOptions) {
+		options.config = *config
+		options.config.Listen = append(ListenAddresses(nil), config.Listen...)
+		options.config.Servers = make([]*ServerConfigServer, len(config.Servers))
+		for si, s := range config.Servers {
+			server := *s
+			server.Peers = append([]*ServerConfigPeer(nil), s.Peers...)
+			options.config.Servers[si] = &server
+		}
+	}
+}
+
+// ServerListen adds the UDP listen addresses, see ServerConfig.Listen.
+func ServerListen(addrs ...string) ServerOption {
+	return func(options *serverOptions) {
+		options.config.Listen = append(options.config.Listen, addrs...)
+	}
+}
+
+// ServerPeer forwards the handshakes of the client public key to the server private key to the forwardTo address,
+// the peers of the same server private key are grouped into a ServerConfigServer.
+func ServerPeer(privateKey NoisePrivateKey, clientPublicKey NoisePublicKey, forwardTo string) ServerOption {
+	return func(options *serverOptions) {
+		var server *ServerConfigServer
+		for _, s := range options.config.Servers {
+			if s.PrivateKey != nil && *s.PrivateKey == privateKey {
+				server = s
+				break
+			}
+		}
+		if server == nil {
+			server = &ServerConfigServer{PrivateKey: &privateKey}
+			options.config.Servers = append(options.config.Servers, server)
+		}
+		server.Peers = append(server.Peers, &ServerConfigPeer{
+			ForwardTo:       forwardTo,
+			ClientPublicKey: &clientPublicKey,
+		})
+	}
+}
+
+// ServerObfuscateKey enables the obfuscation with the key, see ServerConfig.ObfuscateKey.
+func ServerObfuscateKey(key string) ServerOption {
+	return func(options *serverOptions) {
+		options.config.ObfuscateKey = key
+	}
+}
+
+// ServerTimeout is the timeout of the idle sessions, see ServerConfig.Timeout.
+func ServerTimeout(timeout time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.config.Timeout = Duration(timeout)
+	}
+}
+
+// ServerLogger replaces the Logger of the Server.
+func ServerLogger(logger Logger) ServerOption {
+	return func(options *serverOptions) {
+		options.logger = logger
+	}
+}
+
+// ServerTransportFactory creates the transports instead of the UDP sockets, see Server.TransportFactory.
+func ServerTransportFactory(factory PacketTransportFactory) ServerOption {
+	return func(options *serverOptions) {
+		options.transportFactory = factory
+	}
+}
+
+// NewServer creates a Server with the options, see "Server Options".
+func NewServer(opts ...ServerOption) (outServer *Server, err error) {
+	var options serverOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	outServer, err = NewServerWithConfig(&options.config)
+	if err != nil {
+		return
+	}
+	if options.logger != nil {
+		outServer.Logger = options.logger
+	}
+	outServer.TransportFactory = options.transportFactory
+	return
+}
@@ -0,0 +1,158 @@
+package mwgp
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+	const obfsKey = "everything in memory"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	logger := NewStdLogger(LogLevelError)
+	server, err := NewServer(
+		ServerListen(mwgpServerListen),
+		ServerPeer(serverSK, clientPK, netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), uint16(wgServerPort)).String()),
+		ServerObfuscateKey(obfsKey),
+		ServerTimeout(time.Minute),
+		ServerLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Logger != logger || server.config.Timeout != Duration(time.Minute) || len(server.servers) != 1 {
+		t.Errorf("expected the options applied, got %+v", server.config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- server.Run(ctx) }()
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.Run(ctx) }()
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+	if stats := server.Stats(); stats.ActiveSessions != 1 {
+		t.Errorf("expected 1 session on the server, got %d", stats.ActiveSessions)
+	}
+
+	cancel()
+	for name, done := range map[string]chan error{"server": serverDone, "client": clientDone} {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Errorf("%s: expected nil error once the ctx is done, got %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: still running after the ctx is done", name)
+		}
+	}
+}
+
+func TestNewServer_Config(t *testing.T) {
+	serverSK, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	config := &ServerConfig{
+		Listen: ListenAddresses{"127.0.0.1:0"},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Peers:      []*ServerConfigPeer{{ClientPublicKey: &clientPK, ForwardTo: "127.0.0.1:51820"}},
+			},
+		},
+	}
+	server, err := NewServer(ServerConfigOption(config), ServerPeer(serverSK, otherPK, "127.0.0.1:51821"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.servers) != 1 || len(server.servers[0].Peers) != 2 {
+		t.Errorf("expected the peer added to the server of the same private key, got %+v", server.servers)
+	}
+	if len(config.Servers[0].Peers) != 1 {
+		t.Errorf("expected the config not modified by the options")
+	}
+
+	// the options are validated the same as a config file
+	if _, err = NewServer(ServerListen("127.0.0.1:0")); err == nil {
+		t.Errorf("expected an error without a server")
+	}
+	if _, err = NewServer(ServerPeer(serverSK, clientPK, "127.0.0.1:51820"), ServerTimeout(-time.Second)); err == nil {
+		t.Errorf("expected an error with a negative timeout")
+	}
+}
+
+func TestServerConfig_ReloadOptions(t *testing.T) {
+	// the fields applied by Reload, the others must be in restartOnlyOptions
+	reloadable := map[string]bool{
+		"Listen":                 true,
+		"Timeout":                true,
+		"Servers":                true,
+		"ObfuscateKey":           true,
+		"ObfuscateSecondaryKeys": true,
+		"ObfuscateMinKeyLength":  true,
+		"Trace":                  true,
+		"AllowedClients":         true,
+		"DeniedClients":          true,
+		"IPPreference":           true,
+		"ResolveInterval":        true,
+	}
+	type field struct {
+		addr uintptr
+		typ  reflect.Type
+	}
+	config := &ServerConfig{}
+	restartOnly := make(map[field]string)
+	for _, o := range restartOnlyOptions {
+		for _, f := range o.fields(config) {
+			v := reflect.ValueOf(f)
+			restartOnly[field{v.Pointer(), v.Elem().Type()}] = o.name
+		}
+	}
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		option, ok := restartOnly[field{v.Field(i).Addr().Pointer(), v.Field(i).Type()}]
+		if ok && reloadable[name] {
+			t.Errorf("field %s is reloadable but also in the restart-only option %q", name, option)
+		} else if !ok && !reloadable[name] {
+			t.Errorf("field %s is neither reloadable nor in a restart-only option", name)
+		}
+	}
+
+	old := &ServerConfig{MaxPacketSize: 1500, DSCP: 46, ObfuscatePadding: &ObfuscatePaddingConfig{}}
+	config = &ServerConfig{MaxPacketSize: 1500, DSCP: 46, TTL: 64, ObfuscatePadding: &ObfuscatePaddingConfig{}}
+	for _, o := range restartOnlyOptions {
+		if changed := o.changed(config, old); changed != (o.name == "dscp/ttl") {
+			t.Errorf("option %q: expected changed %v", o.name, !changed)
+		}
+		o.keep(config, old)
+	}
+	if !reflect.DeepEqual(config, old) {
+		t.Errorf("expected the old options kept, got %+v", config)
+	}
+}
@@ -0,0 +1,210 @@
+package mwgp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerConfigServer_ManyPeers(t *testing.T) {
+	const peerCount = 65536
+	serverSK, _ := e2eGenerateKey(t)
+	peerPKs := make([]NoisePublicKey, peerCount)
+	peers := make([]*ServerConfigPeer, 0, peerCount+1)
+	for i := range peerPKs {
+		binary.LittleEndian.PutUint32(peerPKs[i].NoisePublicKey[:], uint32(i))
+		peers = append(peers, &ServerConfigPeer{
+			ClientPublicKey: &peerPKs[i],
+			ForwardTo:       fmt.Sprintf(":%d", 10000+i%50000),
+		})
+	}
+	peers = append(peers, &ServerConfigPeer{ForwardTo: ":1"})
+	s := &ServerConfigServer{
+		PrivateKey: &serverSK,
+		Address:    "127.0.0.1",
+		Peers:      peers,
+	}
+	if err := s.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 255, 256, 65535} {
+		peer := s.matchPeer(peerPKs[i])
+		if peer == nil || peer.forwardTarget.resolved().Port != 10000+i%50000 {
+			t.Errorf("peer #%d is not matched: %+v", i, peer)
+		}
+	}
+	var unknownPK NoisePublicKey
+	binary.LittleEndian.PutUint32(unknownPK.NoisePublicKey[:], peerCount)
+	if peer := s.matchPeer(unknownPK); peer == nil || !peer.isFallback() {
+		t.Errorf("unknown peer is not matched to the fallback peer: %+v", peer)
+	}
+}
+
+type fakeForwardResolver struct {
+	lock  sync.Mutex
+	addr  *net.UDPAddr
+	err   error
+	count int
+}
+
+func (r *fakeForwardResolver) set(addr string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addr = nil
+	if addr != "" {
+		r.addr = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr))
+	}
+	r.err = err
+}
+
+func (r *fakeForwardResolver) ResolveUDPAddr(ctx context.Context, address string) (addr *net.UDPAddr, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.count++
+	if r.err != nil {
+		err = r.err
+		return
+	}
+	addr = &net.UDPAddr{IP: r.addr.IP, Port: r.addr.Port}
+	return
+}
+
+func TestServer_ForwardTargetResolve(t *testing.T) {
+	serverSK, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	resolver := &fakeForwardResolver{}
+	resolver.set("", errors.New("no such host"))
+	serverConfig := func(forwardTo string) *ServerConfig {
+		sk, pk := serverSK, clientPK
+		cs := &ServerConfigServer{
+			PrivateKey: &sk,
+			Peers: []*ServerConfigPeer{
+				{ClientPublicKey: &pk, ForwardTo: forwardTo},
+			},
+		}
+		cs.forwardResolve.resolver = resolver
+		return &ServerConfig{
+			Listen:  ListenAddresses{"127.0.0.1:0"},
+			Servers: []*ServerConfigServer{cs},
+		}
+	}
+
+	if _, err := NewServerWithConfig(serverConfig("wg.example")); err == nil {
+		t.Fatalf("forward_to without port is not rejected")
+	}
+	// the host name is not resolvable at the startup
+	server, err := NewServerWithConfig(serverConfig("wg.example:51820"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Logger = &testLogger{}
+	server.wgitTable.Logger = server.Logger
+	ft := server.servers[0].matchPeer(clientPK).forwardTarget
+
+	resolve := func(now time.Time, expected string) {
+		t.Helper()
+		addr, _, err := ft.resolve(context.Background(), now)
+		if err != nil && expected != "" {
+			t.Fatalf("failed to resolve: %s", err.Error())
+		}
+		if expected == "" {
+			if addr != nil {
+				t.Fatalf("expected not resolved, got %s", addr)
+			}
+			return
+		}
+		if addr.String() != expected {
+			t.Fatalf("expected resolved to %s, got %s", expected, addr)
+		}
+	}
+	now := time.Now()
+	resolve(now, "")
+	// resolved once the DNS record is available, after the retry interval
+	resolver.set("192.0.2.1:51820", nil)
+	resolve(now, "")
+	now = now.Add(kForwardResolveRetryInterval)
+	resolve(now, "192.0.2.1:51820")
+
+	// cached until the resolve interval
+	resolver.set("192.0.2.2:51820", nil)
+	count := resolver.count
+	resolve(now.Add(defaultServerResolveInterval-time.Second), "192.0.2.1:51820")
+	if resolver.count != count {
+		t.Errorf("resolved again before the resolve interval")
+	}
+	now = now.Add(defaultServerResolveInterval)
+	resolve(now, "192.0.2.2:51820")
+
+	// the stale address is used if the re-resolution failed
+	resolver.set("", errors.New("no such host"))
+	addr, _, err := ft.resolve(context.Background(), now.Add(defaultServerResolveInterval))
+	if err == nil || addr == nil || addr.String() != "192.0.2.2:51820" {
+		t.Errorf("expected the stale address with an error, got %v, %v", addr, err)
+	}
+
+	// the session survives a reload with the same forward_to
+	peer := &Peer{
+		clientPublicKey:   clientPK,
+		serverPublicKey:   server.servers[0].publicKey,
+		clientProxyIndex:  0x11111111,
+		clientDestination: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1000},
+		serverDestination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 51820},
+	}
+	server.wgitTable.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	if err = server.Reload(serverConfig("wg.example:51820")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := server.Stats(); stats.ActiveSessions != 1 {
+		t.Fatalf("the session is evicted by reload: %+v", stats)
+	}
+
+	// the address changes mid-session, and the server destination keeps failing
+	resolver.set("192.0.2.3:51820", nil)
+	if changed := server.reresolveForwardTargets(netip.MustParseAddrPort("192.0.2.9:51820")); changed != 0 {
+		t.Errorf("forward_to not resolved to the failing address is re-resolved")
+	}
+	if changed := server.reresolveForwardTargets(netip.MustParseAddrPort("192.0.2.2:51820")); changed != 1 {
+		t.Fatalf("expected 1 forward_to re-resolved, got %d", changed)
+	}
+	if stats := server.Stats(); stats.ActiveSessions != 0 {
+		t.Errorf("the session forwarded to the old address is not evicted: %+v", stats)
+	}
+	addr, err = server.resolveForwardTarget(server.servers[0].matchPeer(clientPK).forwardTarget)
+	if err != nil || addr.String() != "192.0.2.3:51820" {
+		t.Errorf("expected the new address 192.0.2.3:51820, got %v, %v", addr, err)
+	}
+}
+
+func TestNewForwardTarget(t *testing.T) {
+	resolver := &fakeForwardResolver{}
+	for address, expected := range map[string]string{
+		"192.0.2.1:51820":    "192.0.2.1:51820",
+		"[2001:db8::1]:1000": "[2001:db8::1]:1000",
+		":1000":              ":1000",
+	} {
+		ft, err := newForwardTarget(address, forwardResolveOptions{resolver: resolver})
+		if err != nil {
+			t.Errorf("%s: %s", address, err.Error())
+			continue
+		}
+		addr, _, err := ft.resolve(context.Background(), time.Now())
+		if err != nil || addr.String() != expected {
+			t.Errorf("%s: expected %s, got %v, %v", address, expected, addr, err)
+		}
+	}
+	if resolver.count != 0 {
+		t.Errorf("IP addresses should not be resolved by the resolver")
+	}
+	for _, address := range []string{"wg.example", "wg.example:", "[2001:db8::1"} {
+		if _, err := newForwardTarget(address, forwardResolveOptions{}); err == nil {
+			t.Errorf("%s: invalid address is not rejected", address)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/flynn/json5"
 	"github.com/haruue-net/mwgp"
 	"testing"
+	"time"
 )
 
 func TestServerConfigMarshal(t *testing.T) {
@@ -29,8 +30,8 @@ func TestServerConfigMarshal(t *testing.T) {
 		t.Fatal(err)
 	}
 	c := mwgp.ServerConfig{
-		Listen:  ":2333",
-		Timeout: 300,
+		Listen:  mwgp.ListenAddresses{":2333"},
+		Timeout: mwgp.Duration(300 * time.Second),
 		Servers: []*mwgp.ServerConfigServer{
 			{
 				PrivateKey: &sk,
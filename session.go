@@ -0,0 +1,214 @@
+package mwgp
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Session Hooks:
+//
+// OnSessionCreated is called once a peer is created by a MessageInitiation, and OnSessionExpired is called
+// once it is removed from the forward table, by the timeout or not (see SessionInfo.EndReason).
+// They are called one by one in a single goroutine in the order of the events, apart from the packet forwarding,
+// so that a slow hook cannot stall it. The events are dropped (counted as SessionEventsDropped)
+// if kSessionEventQueueSize events are waiting for the hooks.
+// The hooks are not called for the peers remaining when the table is closed.
+
+const kSessionEventQueueSize = 1024
+
+const (
+	// SessionEndExpired is the peer without packet in the Timeout.
+	SessionEndExpired = "expired"
+
+	// SessionEndEvicted is the least recently active peer evicted for a new one since the forward table is full,
+	// or the peer evicted by Server.EvictSessions().
+	SessionEndEvicted = "evicted"
+
+	// SessionEndRemoved is the peer removed since its config is removed or changed,
+	// or its server destination is gone.
+	SessionEndRemoved = "removed"
+)
+
+// SessionInfo describes a session (a peer in the forward table) for the session hooks and Snapshot().
+type SessionInfo struct {
+	// PeerID is the client public key in base64,
+	// SessionID is the random ID in the logs of the session.
+	PeerID    string `json:"peer_id"`
+	SessionID string `json:"session_id"`
+
+	ClientAddress   string `json:"client"`
+	UpstreamAddress string `json:"upstream"`
+	// UpstreamLocalAddress is the local address of the socket to the upstream, only filled by Snapshot(),
+	// empty if there is no such socket (yet) or it is not a UDP socket.
+	UpstreamLocalAddress string `json:"upstream_local,omitempty"`
+
+	// CreatedAt is the zero time for the peers loaded from the forward table cache.
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"`
+
+	// the counters of the session, always 0 for OnSessionCreated
+	ClientToServerPackets uint64 `json:"c2s_packets"`
+	ClientToServerBytes   uint64 `json:"c2s_bytes"`
+	ServerToClientPackets uint64 `json:"s2c_packets"`
+	ServerToClientBytes   uint64 `json:"s2c_bytes"`
+
+	// Established is whether the server has answered the handshake of the session,
+	// and Obfuscated is whether the client obfuscates its packets (mwgp-server only).
+	Established bool `json:"established"`
+	Obfuscated  bool `json:"obfuscated"`
+
+	// EndReason is SessionEnd*, empty for OnSessionCreated.
+	EndReason string `json:"end_reason,omitempty"`
+}
+
+type sessionEvent struct {
+	hook func(info SessionInfo)
+	info SessionInfo
+}
+
+// sessionInfo returns the SessionInfo of the peer, the mapLock should be held
+// since the clientDestination might be changed by the roaming.
+func (p *Peer) sessionInfo() (info SessionInfo) {
+	v := p.sessionView()
+	info = v.sessionInfo()
+	return
+}
+
+// sessionView is the fields of a peer changed with the mapLock held, copied to build a SessionInfo without it.
+type sessionView struct {
+	peer              *Peer
+	clientDestination *net.UDPAddr
+	serverDestination *net.UDPAddr
+	established       bool
+	obfuscated        bool
+
+	// upstream is the socket to the server destination, nil if not found.
+	upstream *upstreamConn
+}
+
+// sessionView copies the fields of the peer, the mapLock should be held.
+func (p *Peer) sessionView() sessionView {
+	return sessionView{
+		peer:              p,
+		clientDestination: p.clientAddr(),
+		serverDestination: p.serverAddr(),
+		established:       p.IsServerReplied(),
+		obfuscated:        p.obfuscateEnabled,
+	}
+}
+
+// sessionInfo formats the view, no lock is needed since the addresses are replaced instead of changed.
+func (v *sessionView) sessionInfo() (info SessionInfo) {
+	p := v.peer
+	info = SessionInfo{
+		PeerID:                p.clientPublicKey.Base64(),
+		SessionID:             p.sessionID,
+		CreatedAt:             p.createdAt,
+		LastActiveAt:          p.lastActiveTime(),
+		ClientToServerPackets: atomic.LoadUint64(&p.stats.c2sPackets),
+		ClientToServerBytes:   atomic.LoadUint64(&p.stats.c2sBytes),
+		ServerToClientPackets: atomic.LoadUint64(&p.stats.s2cPackets),
+		ServerToClientBytes:   atomic.LoadUint64(&p.stats.s2cBytes),
+		Established:           v.established,
+		Obfuscated:            v.obfuscated,
+	}
+	if v.clientDestination != nil {
+		info.ClientAddress = v.clientDestination.String()
+	}
+	if v.serverDestination != nil {
+		info.UpstreamAddress = v.serverDestination.String()
+	}
+	if v.upstream != nil {
+		if ut, ok := v.upstream.transport.(*UDPTransport); ok {
+			info.UpstreamLocalAddress = ut.Conn().LocalAddr().String()
+		}
+	}
+	return
+}
+
+// sessionCreatedLocked queues the OnSessionCreated of the peer.
+func (t *WireGuardIndexTranslationTable) sessionCreatedLocked(peer *Peer) {
+	if t.OnSessionCreated == nil {
+		return
+	}
+	t.queueSessionEvent(sessionEvent{hook: t.OnSessionCreated, info: peer.sessionInfo()})
+}
+
+// sessionEndedLocked queues the OnSessionExpired of the peer removed for the reason.
+func (t *WireGuardIndexTranslationTable) sessionEndedLocked(peer *Peer, reason string) {
+	if t.OnSessionExpired == nil {
+		return
+	}
+	info := peer.sessionInfo()
+	info.EndReason = reason
+	t.queueSessionEvent(sessionEvent{hook: t.OnSessionExpired, info: info})
+}
+
+// queueSessionEvent queues the event without blocking, it is dropped if the queue is full.
+func (t *WireGuardIndexTranslationTable) queueSessionEvent(event sessionEvent) {
+	select {
+	case t.sessionEvents <- event:
+	default:
+		atomic.AddUint64(&t.stats.sessionEventsDropped, 1)
+		t.logPacketf(LogLevelWarn, "session hook is too slow, event of session %s is dropped", event.info.SessionID)
+	}
+}
+
+// sessionHookLoop calls the hooks of the queued events until the table is closed.
+func (t *WireGuardIndexTranslationTable) sessionHookLoop() {
+	defer t.loopWaitGroup.Done()
+	for {
+		select {
+		case event := <-t.sessionEvents:
+			event.hook(event.info)
+		case <-t.closeChan:
+			return
+		}
+	}
+}
+
+// Snapshot returns the SessionInfo of all the sessions in the forward table, sorted by the session ID.
+//
+// The locks are only held to copy the pointers and the few fields changed with them held,
+// the SessionInfo are formatted after that, so it can be called often on a large table.
+func (t *WireGuardIndexTranslationTable) Snapshot() (infos []SessionInfo) {
+	t.mapLock.RLock()
+	views := make([]sessionView, 0, t.clientMap.lenLocked())
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		views = append(views, peer.sessionView())
+		return true
+	})
+	t.mapLock.RUnlock()
+
+	t.upstreamConnsLock.RLock()
+	for i := range views {
+		views[i].upstream = t.upstreamConnOfViewLocked(&views[i])
+	}
+	t.upstreamConnsLock.RUnlock()
+
+	infos = make([]SessionInfo, len(views))
+	for i := range views {
+		infos[i] = views[i].sessionInfo()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].SessionID < infos[j].SessionID
+	})
+	return
+}
+
+// upstreamConnOfViewLocked returns the existing socket the session is forwarded with (see upstreamConnOfPeer),
+// with the upstreamConnsLock held.
+func (t *WireGuardIndexTranslationTable) upstreamConnOfViewLocked(v *sessionView) *upstreamConn {
+	if v.serverDestination == nil {
+		return nil
+	}
+	if v.peer.upstreamPortMin != 0 {
+		if p := t.pinnedUpstreams[v.peer.clientPublicKey]; p != nil &&
+			p.uc.pinnedTo(v.serverDestination, v.peer.upstreamPortMin, v.peer.upstreamPortMax) {
+			return p.uc
+		}
+	}
+	return t.upstreamConns[upstreamKey(v.serverDestination)]
+}
@@ -0,0 +1,192 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_SessionHooks(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = time.Minute
+	table.Logger = NewStdLogger(LogLevelError)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: serverAddr}
+		return
+	}
+
+	created := make(chan SessionInfo, 16)
+	expired := make(chan SessionInfo, 16)
+	table.OnSessionCreated = func(info SessionInfo) { created <- info }
+	table.OnSessionExpired = func(info SessionInfo) { expired <- info }
+	table.sessionEvents = make(chan sessionEvent, kSessionEventQueueSize)
+	table.loopWaitGroup.Add(1)
+	go table.sessionHookLoop()
+	defer func() {
+		_ = table.Close()
+		table.loopWaitGroup.Wait()
+	}()
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	peer, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.countForwardedPacket(peer, false, 148)
+	table.countForwardedPacket(peer, true, 92)
+	if _, err = table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 0x2000}); err != nil {
+		t.Fatal(err)
+	}
+
+	info := <-created
+	if info.PeerID != clientPK.Base64() || info.SessionID != peer.sessionID || info.ClientAddress != src.String() ||
+		info.UpstreamAddress != serverAddr.String() || info.CreatedAt.IsZero() || info.EndReason != "" {
+		t.Errorf("unexpected created session: %+v", info)
+	}
+
+	table.evictPeers(func(p *Peer) bool { return p != peer })
+	table.handlePeersExpireCheck(time.Now().Add(2 * table.Timeout))
+	for {
+		select {
+		case info = <-expired:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnSessionExpired is not called")
+		}
+		if info.SessionID == peer.sessionID {
+			break
+		}
+		if info.EndReason != SessionEndRemoved {
+			t.Errorf("expected the evicted session to be removed, got %s", info.EndReason)
+		}
+	}
+	if info.EndReason != SessionEndExpired || info.ClientToServerPackets != 1 || info.ClientToServerBytes != 148 ||
+		info.ServerToClientPackets != 1 || info.ServerToClientBytes != 92 || !info.LastActiveAt.Equal(peer.lastActiveTime()) {
+		t.Errorf("unexpected expired session: %+v", info)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_SessionHooksSlow(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}}
+		return
+	}
+	table.OnSessionCreated = func(info SessionInfo) {}
+
+	// the hook loop is not running, like a hook never returns
+	table.sessionEvents = make(chan sessionEvent, 2)
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	for sender := uint32(0x1000); sender < 0x1004; sender++ {
+		if _, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: sender}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := table.Stats(); stats.SessionEventsDropped != 2 || stats.ActiveSessions != 4 {
+		t.Errorf("expected 2 of 4 events dropped, got %d dropped and %d sessions", stats.SessionEventsDropped, stats.ActiveSessions)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_Snapshot(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: serverAddr}
+		return
+	}
+	defer func() {
+		table.closeUpstreamConns()
+		table.loopWaitGroup.Wait()
+	}()
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	established, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.processServerMessageResponse(serverAddr, &device.MessageResponse{Sender: 0x2000, Receiver: established.clientProxyIndex}); err != nil {
+		t.Fatal(err)
+	}
+	established.obfuscateEnabled = true
+	table.countForwardedPacket(established, false, 148)
+	pending, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: 0x3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := table.upstreamConnOf(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := table.Snapshot()
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	for _, info := range sessions {
+		if info.PeerID != clientPK.Base64() || info.ClientAddress != src.String() || info.UpstreamAddress != serverAddr.String() ||
+			!strings.HasSuffix(info.UpstreamLocalAddress, fmt.Sprintf(":%d", uc.localPort)) || info.CreatedAt.IsZero() {
+			t.Errorf("unexpected session: %+v", info)
+		}
+		switch info.SessionID {
+		case established.sessionID:
+			if !info.Established || !info.Obfuscated || info.ClientToServerPackets != 1 || info.ClientToServerBytes != 148 {
+				t.Errorf("unexpected established session: %+v", info)
+			}
+		case pending.sessionID:
+			if info.Established || info.Obfuscated {
+				t.Errorf("unexpected pending session: %+v", info)
+			}
+		default:
+			t.Errorf("unexpected session ID %s", info.SessionID)
+		}
+	}
+
+	// the control socket serializes it directly
+	data, err := json.Marshal(sessions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"peer_id", "session_id", "client", "upstream", "upstream_local", "created_at", "last_active_at",
+		"c2s_packets", "c2s_bytes", "s2c_packets", "s2c_bytes", "established", "obfuscated"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("expected the field %q in %s", key, data)
+		}
+	}
+}
+
+func BenchmarkWireGuardIndexTranslationTable_Snapshot(b *testing.B) {
+	const sessions = 20000
+	var clientPK NoisePublicKey
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}}
+		return
+	}
+	for sender := uint32(1); sender <= sessions; sender++ {
+		src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(sender)), Port: int(sender)}
+		if _, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: sender}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(table.Snapshot()) != sessions {
+			b.Fatal("unexpected number of sessions")
+		}
+	}
+}
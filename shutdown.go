@@ -0,0 +1,74 @@
+package mwgp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Shutdown:
+//
+// Close() closes the closeChan and cancels the context of the forward table, so that the loops exit,
+// and the DNS resolutions of the loops and the handlers, which use the context, are aborted instead of waiting
+// for their timeouts. Server.Run and Client.Run call Close() once their context is done.
+//
+// Serve() waits for the goroutines it started after closing the sockets, which unblocks the read loops:
+// the handlers first, then the background goroutines (such as persisting the cache), which cannot be started
+// any more once closed, and the loops last. A loop blocked on a PacketTransport ignoring Close() must not hang
+// the shutdown forever, so the loops are only waited for kCloseGracePeriod, after that Serve() returns anyway
+// with a warning, and the stuck goroutines are leaked.
+
+const (
+	kCloseGracePeriod = 5 * time.Second
+)
+
+// backgroundGroup tracks the goroutines started by goBackground, which might be started from any goroutine.
+type backgroundGroup struct {
+	lock      sync.Mutex
+	closed    bool
+	waitGroup sync.WaitGroup
+}
+
+// context returns the context of the forward table, which is canceled by Close().
+func (t *WireGuardIndexTranslationTable) context() context.Context {
+	return t.ctx
+}
+
+// goBackground runs f in a goroutine waited by Serve(), it is skipped if the table is being closed.
+func (t *WireGuardIndexTranslationTable) goBackground(f func()) {
+	t.background.lock.Lock()
+	defer t.background.lock.Unlock()
+	if t.background.closed {
+		return
+	}
+	t.background.waitGroup.Add(1)
+	go func() {
+		defer t.background.waitGroup.Done()
+		f()
+	}()
+}
+
+// waitBackground stops goBackground from starting new goroutines and waits for the running ones.
+func (t *WireGuardIndexTranslationTable) waitBackground() {
+	t.background.lock.Lock()
+	t.background.closed = true
+	t.background.lock.Unlock()
+	t.background.waitGroup.Wait()
+}
+
+// waitLoops waits for the loops up to the grace period, it reports false if some of them are still running.
+func (t *WireGuardIndexTranslationTable) waitLoops(grace time.Duration) (exited bool) {
+	done := make(chan struct{})
+	go func() {
+		t.loopWaitGroup.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		exited = true
+	case <-timer.C:
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package mwgp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitGoroutines waits for the number of the goroutines dropping to at most n, and returns the last number.
+func waitGoroutines(n int, timeout time.Duration) (count int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		count = runtime.NumGoroutine()
+		if count <= n || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_GoroutineLeak(t *testing.T) {
+	const cycles = 1000
+	network := newMemNetwork()
+	listen := netip.AddrPortFrom(memNetworkIP, 1000)
+	upstream := netip.AddrPortFrom(memNetworkIP, 2000)
+	client, err := network.bind(0, netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := network.bind(upstream.Port(), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.TransportFactory = network
+	table.ClientListen = net.UDPAddrFromAddrPort(listen)
+	table.Timeout = time.Minute
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: net.UDPAddrFromAddrPort(upstream)}
+		return
+	}
+
+	before := runtime.NumGoroutine()
+	served := make(chan error, 1)
+	go func() { served <- table.Serve() }()
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	initiation[0] = device.MessageInitiationType
+	var serving int
+	for i := 1; i <= cycles; i++ {
+		// each cycle creates a session and a socket to the server, and then removes them
+		binary.LittleEndian.PutUint32(initiation[4:], uint32(i))
+		for attempt := 0; ; attempt++ {
+			_ = client.send(initiation, listen)
+			select {
+			case <-server.inbox:
+			case <-time.After(100 * time.Millisecond):
+				if attempt < 50 {
+					continue
+				}
+				t.Fatalf("cycle %d: the MessageInitiation is not forwarded", i)
+			}
+			break
+		}
+		table.removePeers(func(peer *Peer) bool { return true }, "test")
+		table.closeIdleUpstreamConns(nil, nil, time.Now())
+		if i == 1 {
+			serving = runtime.NumGoroutine()
+		}
+	}
+	if count := waitGoroutines(serving, time.Second); count > serving {
+		t.Errorf("expected at most %d goroutines after %d sessions, got %d", serving, cycles, count)
+	}
+	if stats := table.Stats(); stats.TotalSessionsCreated != cycles || stats.ActiveSessions != 0 {
+		t.Errorf("expected %d sessions created and removed, got %d created and %d active", cycles, stats.TotalSessionsCreated, stats.ActiveSessions)
+	}
+
+	if err = table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	if count := waitGoroutines(before, time.Second); count > before {
+		t.Errorf("expected at most %d goroutines after Close(), got %d", before, count)
+	}
+}
+
+// stuckTransport is a PacketTransport whose ReadPacket ignores Close().
+type stuckTransport struct {
+	reading     chan struct{}
+	readingOnce sync.Once
+	release     chan struct{}
+}
+
+func (s *stuckTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	s.readingOnce.Do(func() { close(s.reading) })
+	<-s.release
+	err = net.ErrClosed
+	return
+}
+
+func (s *stuckTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	return
+}
+
+func (s *stuckTransport) Close() (err error) {
+	return
+}
+
+type stuckTransportFactory struct {
+	transport *stuckTransport
+}
+
+func (f *stuckTransportFactory) ListenPacket(addr *net.UDPAddr, workers int) (transports []PacketTransport, err error) {
+	transports = []PacketTransport{f.transport}
+	return
+}
+
+func (f *stuckTransportFactory) DialPacket(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+	transport = f.transport
+	return
+}
+
+func TestWireGuardIndexTranslationTable_CloseGracePeriod(t *testing.T) {
+	stuck := &stuckTransport{reading: make(chan struct{}), release: make(chan struct{})}
+	defer close(stuck.release)
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.TransportFactory = &stuckTransportFactory{transport: stuck}
+	table.ClientListen = net.UDPAddrFromAddrPort(netip.AddrPortFrom(memNetworkIP, 1000))
+	table.closeGracePeriod = 100 * time.Millisecond
+	served := make(chan error, 1)
+	go func() { served <- table.Serve() }()
+	<-stuck.reading
+
+	closed := make(chan struct{})
+	go func() {
+		_ = table.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() is blocked by a stuck transport")
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	// no more background goroutines once closed
+	started := false
+	table.goBackground(func() { started = true })
+	if started {
+		t.Errorf("expected no background goroutine started after Close()")
+	}
+}
+
+// blockingResolver blocks until the ctx is done.
+type blockingResolver struct{}
+
+func (r blockingResolver) ResolveUDPAddr(ctx context.Context, address string) (addr *net.UDPAddr, err error) {
+	<-ctx.Done()
+	err = ctx.Err()
+	return
+}
+
+func TestServer_ResolveCanceledByStop(t *testing.T) {
+	serverSK, _ := e2eGenerateKey(t)
+	_, clientPK := e2eGenerateKey(t)
+	cs := &ServerConfigServer{
+		PrivateKey: &serverSK,
+		Peers:      []*ServerConfigPeer{{ClientPublicKey: &clientPK, ForwardTo: "wg.example:51820"}},
+	}
+	cs.forwardResolve.resolver = blockingResolver{}
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen:  ListenAddresses{"127.0.0.1:0"},
+		Servers: []*ServerConfigServer{cs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := make(chan error, 1)
+	go func() {
+		_, err := server.resolveForwardTarget(server.servers[0].matchPeer(clientPK).forwardTarget)
+		resolved <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = server.Stop()
+	select {
+	case err = <-resolved:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the resolution canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the resolution is not canceled by Stop()")
+	}
+}
@@ -0,0 +1,36 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSipHash24(t *testing.T) {
+	// test vectors from the reference implementation of SipHash-2-4,
+	// with key 00 01 02 ... 0f and message 00 01 02 ... (len-1)
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	msg := make([]byte, 64)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for _, v := range []struct {
+		length int
+		hash   uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{7, 0xab0200f58b01d137},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+		{63, 0x958a324ceb064572},
+	} {
+		if h := sipHash24(k0, k1, msg[:v.length]); h != v.hash {
+			t.Errorf("sipHash24 of %d bytes: expected %016x, got %016x", v.length, v.hash, h)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package mwgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	kDSCPMax = 63
+	kTTLMax  = 255
+)
+
+// validateDSCPAndTTL checks the dscp and ttl options, 0 means not set.
+func validateDSCPAndTTL(dscp, ttl int) (err error) {
+	if dscp < 0 || dscp > kDSCPMax {
+		err = fmt.Errorf("dscp must be in [0, %d], got %d", kDSCPMax, dscp)
+		return
+	}
+	if ttl < 0 || ttl > kTTLMax {
+		err = fmt.Errorf("ttl must be in [1, %d], got %d", kTTLMax, ttl)
+		return
+	}
+	return
+}
+
+// socketControlFunc is the type of net.ListenConfig.Control and net.Dialer.Control.
+type socketControlFunc func(network, address string, c syscall.RawConn) (err error)
+
+// setSocketFwMarkFunc sets the SO_MARK of the socket, it is replaced in tests.
+var setSocketFwMarkFunc = setSocketFwMark
+
+// setReadBufferFunc and setWriteBufferFunc set the socket buffer sizes, they are replaced in tests.
+var (
+	setReadBufferFunc  = (*net.UDPConn).SetReadBuffer
+	setWriteBufferFunc = (*net.UDPConn).SetWriteBuffer
+)
+
+// chainSocketControl returns a control function calling all the non-nil fs in order,
+// or nil if there is none.
+func chainSocketControl(fs ...socketControlFunc) socketControlFunc {
+	var chained []socketControlFunc
+	for _, f := range fs {
+		if f != nil {
+			chained = append(chained, f)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) (err error) {
+		for _, f := range chained {
+			err = f(network, address, c)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// socketControl returns the control function applying the socket options of the table to every socket it opens.
+func (t *WireGuardIndexTranslationTable) socketControl() socketControlFunc {
+	return chainSocketControl(t.udpConnResetControl(), t.socketOptionsControl())
+}
+
+// udpConnResetControl returns the control function disabling the SIO_UDP_CONNRESET of the UDP sockets
+// (Windows only), see disableUDPConnReset. Failing to disable it is not fatal, since the read errors are retried.
+func (t *WireGuardIndexTranslationTable) udpConnResetControl() socketControlFunc {
+	if !udpConnResetSupported {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) (err error) {
+		if !strings.HasPrefix(network, "udp") {
+			return
+		}
+		err = c.Control(func(fd uintptr) {
+			if serr := disableUDPConnReset(fd); serr != nil {
+				t.sockoptWarnOnce[2].Do(func() {
+					t.Logger.Warnf("failed to disable SIO_UDP_CONNRESET on %s socket, ignored: %s", network, serr.Error())
+				})
+			}
+		})
+		return
+	}
+}
+
+// socketOptionsControl returns the control function applying the FwMark, DSCP and TTL.
+//
+// Failing to set the DSCP or TTL is not fatal, since the packets can still be forwarded without them,
+// it is only logged once per option.
+func (t *WireGuardIndexTranslationTable) socketOptionsControl() socketControlFunc {
+	if t.FwMark == 0 && t.DSCP == 0 && t.TTL == 0 {
+		return nil
+	}
+	fwmark, tos, ttl := t.FwMark, t.DSCP<<2, t.TTL
+	return func(network, address string, c syscall.RawConn) (err error) {
+		cerr := c.Control(func(fd uintptr) {
+			if tos != 0 {
+				if serr := setSocketTOS(fd, network, tos); serr != nil {
+					t.sockoptWarnOnce[0].Do(func() {
+						t.Logger.Warnf("failed to set dscp %d on %s socket, ignored: %s", tos>>2, network, serr.Error())
+					})
+				}
+			}
+			if ttl != 0 {
+				if serr := setSocketTTL(fd, network, ttl); serr != nil {
+					t.sockoptWarnOnce[1].Do(func() {
+						t.Logger.Warnf("failed to set ttl %d on %s socket, ignored: %s", ttl, network, serr.Error())
+					})
+				}
+			}
+			if fwmark != 0 {
+				err = setSocketFwMarkFunc(fd, fwmark)
+			}
+		})
+		if cerr != nil {
+			err = cerr
+		}
+		return
+	}
+}
+
+// dialUDP opens a UDP socket bound to the ServerListen (and the BindDevice) and connected to raddr.
+func (t *WireGuardIndexTranslationTable) dialUDP(raddr *net.UDPAddr) (conn *net.UDPConn, err error) {
+	conn, err = t.dialUDPFrom(raddr, 0)
+	return
+}
+
+// dialUDPFrom is dialUDP from the local port, unless the port of the ServerListen is specified.
+func (t *WireGuardIndexTranslationTable) dialUDPFrom(raddr *net.UDPAddr, localPort int) (conn *net.UDPConn, err error) {
+	d := net.Dialer{Control: chainSocketControl(t.socketControl(), t.bindDeviceControl(), t.pathMTUDiscoveryControl())}
+	if t.ServerListen != nil {
+		d.LocalAddr = t.ServerListen
+	}
+	if localPort != 0 && (t.ServerListen == nil || t.ServerListen.Port == 0) {
+		laddr := &net.UDPAddr{Port: localPort}
+		if t.ServerListen != nil {
+			laddr.IP, laddr.Zone = t.ServerListen.IP, t.ServerListen.Zone
+		}
+		d.LocalAddr = laddr
+	}
+	c, err := d.DialContext(context.Background(), "udp", raddr.String())
+	if err != nil {
+		return
+	}
+	conn = c.(*net.UDPConn)
+	t.setSocketBuffers(conn, "server")
+	return
+}
+
+// listenUDP opens an unconnected UDP socket bound to the ServerListen (and the BindDevice),
+// for the transports writing to more than one server address, such as the port hopping.
+func (t *WireGuardIndexTranslationTable) listenUDP() (conn *net.UDPConn, err error) {
+	lc := net.ListenConfig{Control: chainSocketControl(t.socketControl(), t.bindDeviceControl(), t.pathMTUDiscoveryControl())}
+	laddr := ":0"
+	if t.ServerListen != nil {
+		laddr = t.ServerListen.String()
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		return
+	}
+	conn = pc.(*net.UDPConn)
+	t.setSocketBuffers(conn, "server")
+	return
+}
+
+// tcpDialer returns a dialer of the TCP connections to the servers, such as the WebSocket transport,
+// bound to the IP of the ServerListen (and the BindDevice).
+func (t *WireGuardIndexTranslationTable) tcpDialer() (d *net.Dialer) {
+	d = &net.Dialer{Control: chainSocketControl(t.socketControl(), t.bindDeviceControl())}
+	if t.ServerListen != nil {
+		d.LocalAddr = &net.TCPAddr{IP: t.ServerListen.IP, Zone: t.ServerListen.Zone}
+	}
+	return
+}
+
+// setSocketBuffers sets the RecvBuffer and SendBuffer of the socket if not 0.
+//
+// The kernel might clamp them silently (net.core.rmem_max and wmem_max on Linux),
+// so the effective sizes are read back and logged once per side.
+// Failing to set them is not fatal, the default sizes are used instead.
+func (t *WireGuardIndexTranslationTable) setSocketBuffers(conn *net.UDPConn, side string) {
+	if t.RecvBuffer == 0 && t.SendBuffer == 0 {
+		return
+	}
+	var recvErr, sendErr error
+	if t.RecvBuffer > 0 {
+		recvErr = setReadBufferFunc(conn, t.RecvBuffer)
+	}
+	if t.SendBuffer > 0 {
+		sendErr = setWriteBufferFunc(conn, t.SendBuffer)
+	}
+
+	once := &t.socketBuffersLogOnce[0]
+	if side == "server" {
+		once = &t.socketBuffersLogOnce[1]
+	}
+	once.Do(func() {
+		recv, send, gerr := socketBufferSizes(conn)
+		for _, b := range []struct {
+			name      string
+			requested int
+			effective int
+			err       error
+		}{
+			{"recv_buffer", t.RecvBuffer, recv, recvErr},
+			{"send_buffer", t.SendBuffer, send, sendErr},
+		} {
+			switch {
+			case b.requested == 0:
+			case b.err != nil:
+				t.Logger.Warnf("failed to set %s of %s socket to %d, ignored: %s", b.name, side, b.requested, b.err.Error())
+			case gerr != nil:
+				t.Logger.Infof("%s of %s socket is set to %d", b.name, side, b.requested)
+			case b.effective < b.requested:
+				t.Logger.Warnf("%s of %s socket is clamped by the kernel: requested %d, effective %d", b.name, side, b.requested, b.effective)
+			default:
+				t.Logger.Infof("%s of %s socket is set to %d, effective %d", b.name, side, b.requested, b.effective)
+			}
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+)
+
+func TestWireGuardIndexTranslationTable_DSCPAndTTL(t *testing.T) {
+	const dscpEF = 46
+	const ttl = 7
+
+	table := NewWireGuardIndexTranslationTable()
+	table.DSCP = dscpEF
+	table.TTL = ttl
+
+	getsockopt := func(conn *net.UDPConn, level, opt int) (value int) {
+		rc, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cerr := rc.Control(func(fd uintptr) {
+			value, err = unix.GetsockoptInt(int(fd), level, opt)
+		})
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	conns, err := listenUDPWorkers(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 1, table.socketControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns[0].Close()
+	upstream, err := table.dialUDP(conns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	for name, conn := range map[string]*net.UDPConn{"listen": conns[0], "upstream": upstream} {
+		if tos := getsockopt(conn, unix.IPPROTO_IP, unix.IP_TOS); tos != dscpEF<<2 {
+			t.Errorf("%s: expected IP_TOS %#x, got %#x", name, dscpEF<<2, tos)
+		}
+		if v := getsockopt(conn, unix.IPPROTO_IP, unix.IP_TTL); v != ttl {
+			t.Errorf("%s: expected IP_TTL %d, got %d", name, ttl, v)
+		}
+	}
+
+	conn6, err := listenUDPWorkers(&net.UDPAddr{IP: net.IPv6loopback}, 1, table.socketControl())
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err.Error())
+	}
+	defer conn6[0].Close()
+	if tclass := getsockopt(conn6[0], unix.IPPROTO_IPV6, unix.IPV6_TCLASS); tclass != dscpEF<<2 {
+		t.Errorf("expected IPV6_TCLASS %#x, got %#x", dscpEF<<2, tclass)
+	}
+	if hops := getsockopt(conn6[0], unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS); hops != ttl {
+		t.Errorf("expected IPV6_UNICAST_HOPS %d, got %d", ttl, hops)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_PathMTUDiscovery_Sockopt(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.PathMTUDiscovery = true
+
+	getsockopt := func(conn *net.UDPConn, level, opt int) (value int) {
+		rc, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cerr := rc.Control(func(fd uintptr) {
+			value, err = unix.GetsockoptInt(int(fd), level, opt)
+		})
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	conns, err := listenUDPWorkers(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 1, table.socketControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns[0].Close()
+	if v := getsockopt(conns[0], unix.IPPROTO_IP, unix.IP_MTU_DISCOVER); v == unix.IP_PMTUDISC_DO {
+		t.Error("expected the DF bit not set on the listening socket")
+	}
+	upstream, err := table.dialUDP(conns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	if v := getsockopt(upstream, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER); v != unix.IP_PMTUDISC_DO {
+		t.Errorf("expected IP_MTU_DISCOVER %d, got %d", unix.IP_PMTUDISC_DO, v)
+	}
+
+	hopping, err := table.listenUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hopping.Close()
+	if hopping.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		t.Skip("IPv6 is not available")
+	}
+	if v := getsockopt(hopping, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER); v != unix.IPV6_PMTUDISC_DO {
+		t.Errorf("expected IPV6_MTU_DISCOVER %d, got %d", unix.IPV6_PMTUDISC_DO, v)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package mwgp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func setSocketTOS(fd uintptr, network string, tos int) (err error) {
+	err = fmt.Errorf("IP_TOS is not supported on %s", runtime.GOOS)
+	return
+}
+
+func setSocketTTL(fd uintptr, network string, ttl int) (err error) {
+	err = fmt.Errorf("IP_TTL is not supported on %s", runtime.GOOS)
+	return
+}
+
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	err = fmt.Errorf("reading the socket buffer sizes is not supported on %s", runtime.GOOS)
+	return
+}
@@ -0,0 +1,62 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"runtime"
+	"strings"
+)
+
+// setSocketTOS sets the IP_TOS, and the IPV6_TCLASS for IPv6 sockets.
+// A dual-stack socket sends IPv4 packets with the IP_TOS, so both are set on it.
+func setSocketTOS(fd uintptr, network string, tos int) (err error) {
+	if !strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+	}
+	err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	if err != nil {
+		return
+	}
+	// fails on an IPV6_V6ONLY socket
+	_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+	return
+}
+
+// setSocketTTL sets the IP_TTL, and the IPV6_UNICAST_HOPS for IPv6 sockets.
+func setSocketTTL(fd uintptr, network string, ttl int) (err error) {
+	if !strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl)
+	}
+	err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	if err != nil {
+		return
+	}
+	_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl)
+	return
+}
+
+// socketBufferSizes returns the SO_RCVBUF and SO_SNDBUF of the socket.
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		recv, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		if err != nil {
+			return
+		}
+		send, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if runtime.GOOS == "linux" {
+		// Linux reports twice the size set, which includes the bookkeeping overhead
+		recv /= 2
+		send /= 2
+	}
+	return
+}
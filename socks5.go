@@ -0,0 +1,405 @@
+package mwgp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS5 transport:
+//
+// With the "socks5" of mwgp-client, the packets to mwgp-server are sent through a SOCKS5 proxy (RFC 1928)
+// with UDP ASSOCIATE, for the networks where the proxy is the only way out. Each datagram to the relay address
+// of the proxy is prefixed with the SOCKS5 UDP request header addressed to mwgp-server, and the header is stripped
+// from the datagrams received from the relay.
+//
+// The association lives as long as its TCP control connection, which is kept open and re-established with backoff
+// once it is dropped. The local UDP socket is kept across the associations, so the pipeline above never notices.
+// The packets written while not associated are kept (up to kStreamPendingMax) and sent once associated again.
+
+const (
+	kSOCKS5Version = 5
+
+	kSOCKS5MethodNoAuth   = 0x00
+	kSOCKS5MethodUserPass = 0x02
+
+	kSOCKS5UserPassVersion = 1
+
+	kSOCKS5CommandUDPAssociate = 3
+
+	kSOCKS5AddrIPv4   = 1
+	kSOCKS5AddrDomain = 3
+	kSOCKS5AddrIPv6   = 4
+
+	kSOCKS5ReplySucceeded = 0
+)
+
+// SOCKS5Config is the config of the SOCKS5 proxy mwgp-client reaches mwgp-server through.
+type SOCKS5Config struct {
+	// Address is the "host:port" of the proxy, which must support UDP ASSOCIATE.
+	Address string `json:"address"`
+
+	// Username and Password authenticate to the proxy (RFC 1929) if Username is set.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (c *SOCKS5Config) validate() (err error) {
+	if c.Address == "" {
+		err = fmt.Errorf("socks5.address is required")
+		return
+	}
+	_, _, err = net.SplitHostPort(c.Address)
+	if err != nil {
+		err = fmt.Errorf("invalid socks5.address %s: %w", c.Address, err)
+		return
+	}
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		err = fmt.Errorf("socks5.username and socks5.password must not be longer than 255 bytes")
+		return
+	}
+	if c.Username == "" && c.Password != "" {
+		err = fmt.Errorf("socks5.password requires socks5.username")
+		return
+	}
+	return
+}
+
+// socks5Transport is the PacketTransport of mwgp-client to mwgp-server at the addr through a SOCKS5 proxy,
+// see "SOCKS5 transport".
+type socks5Transport struct {
+	config *SOCKS5Config
+	addr   *net.UDPAddr
+	conn   *net.UDPConn
+	dialer *net.Dialer
+	logger Logger
+
+	// relay is the netip.AddrPort of the current association, invalid if not associated.
+	relay atomic.Value
+
+	lock    sync.Mutex
+	control net.Conn
+	pending [][]byte
+	header  []byte
+	buffer  []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ PacketTransport = (*socks5Transport)(nil)
+
+// newSOCKS5Transport returns the transport over the local UDP conn, it associates in the background.
+func newSOCKS5Transport(config *SOCKS5Config, addr *net.UDPAddr, conn *net.UDPConn, dialer *net.Dialer, logger Logger) (t *socks5Transport) {
+	t = &socks5Transport{
+		config: config,
+		addr:   addr,
+		conn:   conn,
+		dialer: dialer,
+		logger: logger,
+		header: appendSOCKS5UDPHeader(nil, addr.AddrPort()),
+		closed: make(chan struct{}),
+	}
+	t.relay.Store(netip.AddrPort{})
+	go t.run()
+	return
+}
+
+// appendSOCKS5UDPHeader appends the UDP request header with the destination addr to b.
+func appendSOCKS5UDPHeader(b []byte, addr netip.AddrPort) []byte {
+	// RSV and FRAG
+	b = append(b, 0, 0, 0)
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = append(b, kSOCKS5AddrIPv4)
+	} else {
+		b = append(b, kSOCKS5AddrIPv6)
+	}
+	b = append(b, ip.AsSlice()...)
+	return append(b, byte(addr.Port()>>8), byte(addr.Port()))
+}
+
+// parseSOCKS5UDPHeader returns the length of the UDP request header of the datagram,
+// the fragments are not supported.
+func parseSOCKS5UDPHeader(b []byte) (length int, err error) {
+	if len(b) < 4 {
+		err = fmt.Errorf("datagram is too short")
+		return
+	}
+	if b[2] != 0 {
+		err = fmt.Errorf("fragment is not supported")
+		return
+	}
+	switch b[3] {
+	case kSOCKS5AddrIPv4:
+		length = 4 + net.IPv4len + 2
+	case kSOCKS5AddrIPv6:
+		length = 4 + net.IPv6len + 2
+	case kSOCKS5AddrDomain:
+		if len(b) < 5 {
+			err = fmt.Errorf("datagram is too short")
+			return
+		}
+		length = 4 + 1 + int(b[4]) + 2
+	default:
+		err = fmt.Errorf("unknown address type %d", b[3])
+		return
+	}
+	if len(b) < length {
+		err = fmt.Errorf("datagram is too short")
+		return
+	}
+	return
+}
+
+// run keeps the association until the transport is closed.
+func (t *socks5Transport) run() {
+	backoff := kStreamReconnectBackoffMin
+	for {
+		control, relay, err := t.associate()
+		if err == nil {
+			associatedAt := time.Now()
+			t.logger.Infof("socks5 %s associated with relay %s for %s", t.config.Address, relay, t.addr)
+			err = t.serve(control, relay)
+			if time.Since(associatedAt) > kStreamReconnectBackoffMax {
+				backoff = kStreamReconnectBackoffMin
+			}
+		}
+		select {
+		case <-t.closed:
+			return
+		default:
+		}
+		t.logger.Warnf("socks5 %s association for %s failed: %s, retry in %s", t.config.Address, t.addr, err.Error(), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-t.closed:
+			return
+		}
+		backoff *= 2
+		if backoff > kStreamReconnectBackoffMax {
+			backoff = kStreamReconnectBackoffMax
+		}
+	}
+}
+
+// associate connects to the proxy, authenticates and requests the UDP ASSOCIATE.
+func (t *socks5Transport) associate() (control net.Conn, relay netip.AddrPort, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kStreamDialTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	control, err = t.dialer.DialContext(ctx, "tcp", t.config.Address)
+	if err != nil {
+		return
+	}
+	_ = control.SetDeadline(time.Now().Add(kStreamDialTimeout))
+	relay, err = t.handshake(control)
+	if err != nil {
+		_ = control.Close()
+		return
+	}
+	_ = control.SetDeadline(time.Time{})
+	if relay.Addr().IsUnspecified() {
+		// the relay is on the proxy itself
+		proxyAddr := control.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+		relay = netip.AddrPortFrom(proxyAddr, relay.Port())
+	}
+	return
+}
+
+func (t *socks5Transport) handshake(control net.Conn) (relay netip.AddrPort, err error) {
+	reader := bufio.NewReader(control)
+	method := byte(kSOCKS5MethodNoAuth)
+	if t.config.Username != "" {
+		method = kSOCKS5MethodUserPass
+	}
+	_, err = control.Write([]byte{kSOCKS5Version, 1, method})
+	if err != nil {
+		return
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(reader, reply[:])
+	if err != nil {
+		return
+	}
+	if reply[0] != kSOCKS5Version {
+		err = errorf(ErrProtocol, "unexpected socks version %d", reply[0])
+		return
+	}
+	if reply[1] != method {
+		err = newError(ErrProtocol, "no acceptable authentication method")
+		return
+	}
+	if method == kSOCKS5MethodUserPass {
+		request := []byte{kSOCKS5UserPassVersion, byte(len(t.config.Username))}
+		request = append(request, t.config.Username...)
+		request = append(request, byte(len(t.config.Password)))
+		request = append(request, t.config.Password...)
+		_, err = control.Write(request)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(reader, reply[:])
+		if err != nil {
+			return
+		}
+		if reply[1] != 0 {
+			err = newError(ErrProtocol, "authentication failed")
+			return
+		}
+	}
+
+	// the address the datagrams are sent from is unknown behind NAT, so it is all zeros
+	_, err = control.Write([]byte{kSOCKS5Version, kSOCKS5CommandUDPAssociate, 0, kSOCKS5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return
+	}
+	var header [4]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		return
+	}
+	if header[1] != kSOCKS5ReplySucceeded {
+		err = errorf(ErrProtocol, "udp associate failed with reply %d", header[1])
+		return
+	}
+	var addr netip.Addr
+	switch header[3] {
+	case kSOCKS5AddrIPv4:
+		var ip [net.IPv4len]byte
+		_, err = io.ReadFull(reader, ip[:])
+		addr = netip.AddrFrom4(ip)
+	case kSOCKS5AddrIPv6:
+		var ip [net.IPv6len]byte
+		_, err = io.ReadFull(reader, ip[:])
+		addr = netip.AddrFrom16(ip)
+	default:
+		err = errorf(ErrProtocol, "unsupported relay address type %d", header[3])
+	}
+	if err != nil {
+		return
+	}
+	var port [2]byte
+	_, err = io.ReadFull(reader, port[:])
+	if err != nil {
+		return
+	}
+	relay = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(port[:]))
+	return
+}
+
+// serve flushes the pending packets to the relay, then waits for the control connection to be closed,
+// which ends the association.
+func (t *socks5Transport) serve(control net.Conn, relay netip.AddrPort) (err error) {
+	t.lock.Lock()
+	select {
+	case <-t.closed:
+		t.lock.Unlock()
+		_ = control.Close()
+		err = net.ErrClosed
+		return
+	default:
+	}
+	t.control = control
+	t.relay.Store(relay)
+	pending := t.pending
+	t.pending = nil
+	for _, b := range pending {
+		_ = t.writeLocked(b, relay)
+	}
+	t.lock.Unlock()
+
+	// nothing is expected on the control connection
+	_, err = io.Copy(io.Discard, control)
+	if err == nil {
+		err = io.EOF
+	}
+
+	t.lock.Lock()
+	t.relay.Store(netip.AddrPort{})
+	t.control = nil
+	t.lock.Unlock()
+	_ = control.Close()
+	return
+}
+
+// writeLocked sends the b to the relay with the UDP request header, t.lock must be held.
+func (t *socks5Transport) writeLocked(b []byte, relay netip.AddrPort) (err error) {
+	t.buffer = append(append(t.buffer[:0], t.header...), b...)
+	_, err = t.conn.WriteToUDPAddrPort(t.buffer, relay)
+	return
+}
+
+// ReadPacket returns the addr as the source, so that the packets match the server destination of the peers.
+// The datagrams not from the relay or malformed are ignored.
+func (t *socks5Transport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	for {
+		var n int
+		var source netip.AddrPort
+		buffer := packet.readBuffer()
+		n, source, err = t.conn.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			return
+		}
+		relay := t.relay.Load().(netip.AddrPort)
+		if !relay.IsValid() || source.Addr().Unmap() != relay.Addr().Unmap() || source.Port() != relay.Port() {
+			continue
+		}
+		length, herr := parseSOCKS5UDPHeader(buffer[:n])
+		if herr != nil {
+			t.logger.Debugf("socks5 %s: invalid datagram from relay %s: %s", t.config.Address, source, herr.Error())
+			continue
+		}
+		packet.Length = copy(buffer, buffer[length:n])
+		if n == len(buffer) {
+			// the datagram filling the buffer might be truncated, which is dropped as oversized
+			packet.Length = len(buffer)
+		}
+		packet.setSourceAddrPort(upstreamKey(t.addr))
+		addr = packet.Source
+		return
+	}
+}
+
+// WritePacket ignores the addr, the packet is queued if it is not associated yet.
+func (t *socks5Transport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	relay := t.relay.Load().(netip.AddrPort)
+	if !relay.IsValid() {
+		if len(t.pending) >= kStreamPendingMax {
+			t.pending = t.pending[1:]
+		}
+		t.pending = append(t.pending, append([]byte(nil), packet.Slice()...))
+		return
+	}
+	err = t.writeLocked(packet.Slice(), relay)
+	return
+}
+
+func (t *socks5Transport) Close() (err error) {
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		close(t.closed)
+		if t.control != nil {
+			_ = t.control.Close()
+		}
+		t.pending = nil
+		t.lock.Unlock()
+		err = t.conn.Close()
+	})
+	return
+}
@@ -0,0 +1,280 @@
+package mwgp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSOCKS5Proxy is a minimal SOCKS5 proxy supporting the UDP ASSOCIATE only.
+type testSOCKS5Proxy struct {
+	listener net.Listener
+	username string
+	password string
+
+	lock     sync.Mutex
+	controls []net.Conn
+}
+
+func newTestSOCKS5Proxy(t *testing.T, username, password string) (p *testSOCKS5Proxy) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = &testSOCKS5Proxy{listener: listener, username: username, password: password}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		p.dropAssociations()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return
+}
+
+// dropAssociations closes all the control connections, which ends their associations.
+func (p *testSOCKS5Proxy) dropAssociations() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.controls {
+		_ = conn.Close()
+	}
+	p.controls = nil
+}
+
+func (p *testSOCKS5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var greeting [2]byte
+	if _, err := io.ReadFull(reader, greeting[:]); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	if p.username == "" {
+		_, _ = conn.Write([]byte{kSOCKS5Version, kSOCKS5MethodNoAuth})
+	} else {
+		_, _ = conn.Write([]byte{kSOCKS5Version, kSOCKS5MethodUserPass})
+		var b [1]byte
+		_, _ = io.ReadFull(reader, b[:])
+		_, _ = io.ReadFull(reader, b[:])
+		username := make([]byte, b[0])
+		_, _ = io.ReadFull(reader, username)
+		_, _ = io.ReadFull(reader, b[:])
+		password := make([]byte, b[0])
+		_, _ = io.ReadFull(reader, password)
+		if string(username) != p.username || string(password) != p.password {
+			_, _ = conn.Write([]byte{kSOCKS5UserPassVersion, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{kSOCKS5UserPassVersion, 0})
+	}
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(reader, request); err != nil || request[1] != kSOCKS5CommandUDPAssociate {
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	// the relay on the proxy itself is replied as 0.0.0.0
+	_, _ = conn.Write([]byte{kSOCKS5Version, kSOCKS5ReplySucceeded, 0, kSOCKS5AddrIPv4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+	p.lock.Lock()
+	p.controls = append(p.controls, conn)
+	p.lock.Unlock()
+
+	go func() {
+		var client netip.AddrPort
+		buffer := make([]byte, 65536)
+		for {
+			n, source, err := relay.ReadFromUDPAddrPort(buffer)
+			if err != nil {
+				return
+			}
+			if !client.IsValid() || source == client {
+				client = source
+				length, err := parseSOCKS5UDPHeader(buffer[:n])
+				if err != nil || buffer[3] != kSOCKS5AddrIPv4 {
+					continue
+				}
+				dst := netip.AddrPortFrom(netip.AddrFrom4(*(*[4]byte)(buffer[4:8])), binary.BigEndian.Uint16(buffer[8:10]))
+				_, _ = relay.WriteToUDPAddrPort(buffer[length:n], dst)
+				continue
+			}
+			datagram := append(appendSOCKS5UDPHeader(nil, source), buffer[:n]...)
+			_, _ = relay.WriteToUDPAddrPort(datagram, client)
+		}
+	}()
+	_, _ = io.Copy(io.Discard, reader)
+}
+
+func TestParseSOCKS5UDPHeader(t *testing.T) {
+	for _, c := range []struct {
+		datagram []byte
+		length   int
+	}{
+		{appendSOCKS5UDPHeader(nil, netip.MustParseAddrPort("192.0.2.1:1000")), 10},
+		{appendSOCKS5UDPHeader(nil, netip.MustParseAddrPort("[::ffff:192.0.2.1]:1000")), 10},
+		{appendSOCKS5UDPHeader(nil, netip.MustParseAddrPort("[2001:db8::1]:1000")), 22},
+		{[]byte{0, 0, 0, kSOCKS5AddrDomain, 3, 'f', 'o', 'o', 0, 80, 'x'}, 10},
+		{[]byte{0, 0, 1, kSOCKS5AddrIPv4, 192, 0, 2, 1, 0, 80}, -1},
+		{[]byte{0, 0, 0, kSOCKS5AddrIPv6, 0x20, 0x01}, -1},
+		{[]byte{0, 0, 0, 9}, -1},
+	} {
+		length, err := parseSOCKS5UDPHeader(c.datagram)
+		if c.length < 0 && err == nil || c.length >= 0 && (err != nil || length != c.length) {
+			t.Errorf("%x: expected length %d, got %d, %v", c.datagram, c.length, length, err)
+		}
+	}
+}
+
+func TestSOCKS5Transport(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := echo.ReadFromUDPAddrPort(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDPAddrPort(buffer[:n], addr)
+		}
+	}()
+
+	proxy := newTestSOCKS5Proxy(t, "mwgp", "hunter2")
+	newTransport := func(password string) *socks5Transport {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &SOCKS5Config{Address: proxy.listener.Addr().String(), Username: "mwgp", Password: password}
+		if err = config.validate(); err != nil {
+			t.Fatal(err)
+		}
+		transport := newSOCKS5Transport(config, echo.LocalAddr().(*net.UDPAddr), conn, &net.Dialer{}, NewStdLogger(LogLevelError))
+		t.Cleanup(func() { _ = transport.Close() })
+		return transport
+	}
+	transport := newTransport("hunter2")
+	roundTrip := func(payload string) {
+		// written before associated, then queued
+		if err := transport.WritePacket(&Packet{Data: []byte(payload), Length: len(payload)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		packet := &Packet{Data: make([]byte, 2048)}
+		_ = transport.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		addr, err := transport.ReadPacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(packet.Slice()) != payload || addr.AddrPort() != echo.LocalAddr().(*net.UDPAddr).AddrPort() {
+			t.Fatalf("expected %q from %s, got %q from %s", payload, echo.LocalAddr(), packet.Slice(), addr)
+		}
+	}
+	roundTrip("first")
+	roundTrip("second")
+
+	// the association is re-established once the control connection is dropped
+	proxy.dropAssociations()
+	for deadline := time.Now().Add(5 * time.Second); transport.relay.Load().(netip.AddrPort).IsValid(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the association is not ended with the control connection")
+		}
+	}
+	roundTrip("third")
+
+	rejected := newTransport("wrong")
+	time.Sleep(200 * time.Millisecond)
+	if rejected.relay.Load().(netip.AddrPort).IsValid() {
+		t.Errorf("expected no association with a wrong password")
+	}
+}
+
+func TestEndToEndSOCKS5(t *testing.T) {
+	const obfsKey = "socks5 transport"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := e2eFreeUDPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: obfsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	proxy := newTestSOCKS5Proxy(t, "", "")
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+		SOCKS5:          &SOCKS5Config{Address: proxy.listener.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	// the session roams to the new relay after the association is re-established
+	proxy.dropAssociations()
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	_, err = NewClientWithConfig(&ClientConfig{
+		Listen:    ListenAddresses{"127.0.0.1:0"},
+		Transport: TransportTCP,
+		SOCKS5:    &SOCKS5Config{Address: proxy.listener.Addr().String()},
+	})
+	if err == nil {
+		t.Errorf("expected transport tcp and socks5 to be conflicted")
+	}
+}
@@ -0,0 +1,347 @@
+package mwgp
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of a mwgp-server or mwgp-client.
+type Stats struct {
+	// ActiveSessions is the number of peers in the forward table.
+	ActiveSessions int
+
+	// TotalSessionsCreated is the number of peers ever created by MessageInitiation.
+	TotalSessionsCreated uint64
+
+	// SessionsExpired is the number of peers removed by the timeout.
+	SessionsExpired uint64
+
+	// SessionsEvicted is the number of peers removed to make room for new ones
+	// with the MaxSessionsPolicyLRU, SessionsRejected is the number of MessageInitiation
+	// dropped with the MaxSessionsPolicyReject, both since the forward table is full.
+	SessionsEvicted  uint64
+	SessionsRejected uint64
+
+	// SessionEventsDropped is the number of events not passed to the session hooks since they are too slow.
+	SessionEventsDropped uint64
+
+	// HandshakesRateLimited is the number of MessageInitiation dropped by the HandshakeRateLimiter.
+	HandshakesRateLimited uint64
+
+	// DeniedClientPackets is the number of MessageInitiation dropped by the allowed_clients and denied_clients.
+	DeniedClientPackets uint64
+
+	// DeniedSourcePackets is the number of packets dropped by the allowed_sources of mwgp-client,
+	// ClientsRejected is the number of MessageInitiation from new client addresses dropped by the max_clients.
+	DeniedSourcePackets uint64
+	ClientsRejected     uint64
+
+	// InvalidClientPackets is the number of packets from new clients dropped by the validate_wireguard of mwgp-client.
+	InvalidClientPackets uint64
+
+	// ProbeBans is the number of times the source IPs are banned by the probe_ban, ProbeBansActive is the number
+	// of the source IPs banned now, and ProbeBannedPackets is the number of packets dropped from them.
+	ProbeBans          uint64
+	ProbeBansActive    int
+	ProbeBannedPackets uint64
+
+	// FilteredPackets is the number of packets from clients dropped or relayed to the FallbackForward address
+	// by the packet filter, see SetPacketFilter.
+	FilteredPackets uint64
+
+	// FallbackSessions is the number of sources relayed to the FallbackForward address,
+	// FallbackPackets counts their packets in both directions.
+	FallbackSessions int
+	FallbackPackets  uint64
+
+	// Draining is set once Drain() is called, then HandshakesDrained is the number of MessageInitiation
+	// of the new clients dropped or relayed to the DrainForward address, DrainSessions is the number of sources
+	// relayed to the DrainForward address, and DrainPackets counts their packets in both directions.
+	Draining          bool
+	HandshakesDrained uint64
+	DrainSessions     int
+	DrainPackets      uint64
+
+	// NATKeepalivesSent is the number of NAT keepalives sent by mwgp-client,
+	// NATKeepalivesReceived is the number of them dropped by mwgp-server.
+	NATKeepalivesSent     uint64
+	NATKeepalivesReceived uint64
+
+	// PacketsForwarded and BytesForwarded count the packets forwarded in both directions.
+	PacketsForwarded uint64
+	BytesForwarded   uint64
+
+	// DroppedPackets is the number of received packets that are not forwarded.
+	DroppedPackets uint64
+
+	// QueueDroppedPackets is the number of them dropped since the relay is saturated, which are never the handshakes,
+	// see "Handshake Priority".
+	QueueDroppedPackets uint64
+
+	// OversizedPackets is the number of them dropped since they are larger than the MaxPacketSize.
+	OversizedPackets uint64
+
+	// Latency is the histograms of the time from reading a packet to writing it, by direction and kind,
+	// only set with the LatencySampleRate.
+	Latency []LatencyStats
+
+	// ReadErrors and WriteErrors count the errors on UDP sockets.
+	ReadErrors  uint64
+	WriteErrors uint64
+
+	// PathMTURetries is the number of times a packet to server is written again with less padding
+	// since it is larger than the path MTU, see "Path MTU Discovery".
+	PathMTURetries uint64
+
+	// PacketPanics is the number of panics recovered in processing a packet, each of them dropped the packet.
+	PacketPanics uint64
+
+	// BandwidthLimitedPackets is the number of packets dropped by the rate_limit of the peers or the global one.
+	BandwidthLimitedPackets uint64
+
+	// SuppressedLogs is the number of the per-packet log messages suppressed by the rate limit.
+	SuppressedLogs uint64
+
+	// the counters of the obfuscator, only for the side facing the other mwgp
+	ObfuscatedPackets   uint64
+	PlainPackets        uint64
+	PlainDroppedPackets uint64
+	DeobfuscateFailures uint64
+	SecondaryKeyPackets uint64
+	ReplayedPackets     uint64
+	RandomErrors        uint64
+
+	// ServerEndpoints are the "servers" of mwgp-client, ServerFailovers is the number of times
+	// the active one is switched, both are only set with more than one server.
+	ServerEndpoints []ServerEndpointStats
+	ServerFailovers uint64
+
+	// Upstreams are the server destinations in use with their health, only set with the upstream health check.
+	Upstreams []UpstreamStats
+
+	// PeerForwards are the forward targets of the server peers with "forward_backups" on mwgp-server.
+	PeerForwards []PeerForwardStats
+
+	// Listeners are the listen addresses facing the clients, see ListenAddresses.
+	Listeners []ListenerStats
+
+	Peers []PeerStats
+
+	// Accounts are the traffic of each client public key since the first AccountingFile, see accounting.go.
+	Accounts []AccountStats
+}
+
+// ListenerStats is the counters of the sockets of a listen address.
+type ListenerStats struct {
+	Address string
+
+	PacketsReceived uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	BytesSent       uint64
+}
+
+// PeerForwardStats is the forward targets of a server peer with "forward_backups",
+// Failovers is the number of times the active one is switched.
+type PeerForwardStats struct {
+	ServerPublicKey string
+
+	// ClientPublicKey is empty for the fallback peer.
+	ClientPublicKey string
+
+	Targets   []ForwardTargetStats
+	Failovers uint64
+}
+
+// ForwardTargetStats is the state of a forward target of a server peer.
+type ForwardTargetStats struct {
+	Address string
+	Active  bool
+
+	// Failed is set once the target is failed over from, until it is active and healthy again.
+	Failed bool
+}
+
+// ServerEndpointStats is the state of a server endpoint of mwgp-client.
+type ServerEndpointStats struct {
+	Address string
+	Active  bool
+
+	// Suspect is set if the endpoint has not replied in the failover window, and is not recovered yet.
+	Suspect bool
+}
+
+// PeerStats is a snapshot of the counters of a single peer in the forward table.
+type PeerStats struct {
+	ClientPublicKey   string
+	ClientDestination string
+	ClientOriginIndex uint32
+	ClientProxyIndex  uint32
+	ServerDestination string
+	ServerOriginIndex uint32
+	ServerProxyIndex  uint32
+
+	// client -> server
+	ClientToServerPackets uint64
+	ClientToServerBytes   uint64
+
+	// server -> client
+	ServerToClientPackets uint64
+	ServerToClientBytes   uint64
+
+	// the packets dropped by the rate_limit, see allowBandwidth
+	ClientToServerBandwidthLimited uint64
+	ServerToClientBandwidthLimited uint64
+}
+
+// tableStats is the counters updated in the hot path, all fields must be accessed atomically.
+type tableStats struct {
+	sessionsCreated  uint64
+	sessionsExpired  uint64
+	sessionsEvicted  uint64
+	sessionsRejected uint64
+
+	sessionEventsDropped uint64
+
+	handshakesRateLimited uint64
+	deniedClientPackets   uint64
+	deniedSourcePackets   uint64
+	clientsRejected       uint64
+	invalidClientPackets  uint64
+	filteredPackets       uint64
+	probeBans             uint64
+	probeBannedPackets    uint64
+	fallbackPackets       uint64
+	handshakesDrained     uint64
+	drainPackets          uint64
+	natKeepalivesSent     uint64
+	natKeepalivesReceived uint64
+	packetsForwarded uint64
+	bytesForwarded   uint64
+	droppedPackets   uint64
+	queueDropped     uint64
+	oversizedPackets uint64
+	readErrors       uint64
+	writeErrors      uint64
+	pathMTURetries   uint64
+	packetPanics     uint64
+	suppressedLogs   uint64
+	bandwidthLimited uint64
+
+	// latency is indexed by the direction (s2c) and the kind (handshake), see "Latency Histogram"
+	latency [2][2]latencyHistogram
+}
+
+// peerStats is the per-peer counters, all fields must be accessed atomically.
+type peerStats struct {
+	c2sPackets uint64
+	c2sBytes   uint64
+	s2cPackets uint64
+	s2cBytes   uint64
+
+	c2sBandwidthLimited uint64
+	s2cBandwidthLimited uint64
+}
+
+func (s *peerStats) add(s2c bool, length int) {
+	if s2c {
+		atomic.AddUint64(&s.s2cPackets, 1)
+		atomic.AddUint64(&s.s2cBytes, uint64(length))
+	} else {
+		atomic.AddUint64(&s.c2sPackets, 1)
+		atomic.AddUint64(&s.c2sBytes, uint64(length))
+	}
+}
+
+func (t *WireGuardIndexTranslationTable) countForwardedPacket(peer *Peer, s2c bool, length int) {
+	atomic.AddUint64(&t.stats.packetsForwarded, 1)
+	atomic.AddUint64(&t.stats.bytesForwarded, uint64(length))
+	peer.stats.add(s2c, length)
+	if peer.account != nil {
+		peer.account.add(s2c, length)
+	}
+}
+
+func (t *WireGuardIndexTranslationTable) countDroppedPacket() {
+	atomic.AddUint64(&t.stats.droppedPackets, 1)
+}
+
+// Stats returns a snapshot of the counters.
+func (t *WireGuardIndexTranslationTable) Stats() (s Stats) {
+	s.TotalSessionsCreated = atomic.LoadUint64(&t.stats.sessionsCreated)
+	s.SessionsExpired = atomic.LoadUint64(&t.stats.sessionsExpired)
+	s.SessionsEvicted = atomic.LoadUint64(&t.stats.sessionsEvicted)
+	s.SessionsRejected = atomic.LoadUint64(&t.stats.sessionsRejected)
+	s.SessionEventsDropped = atomic.LoadUint64(&t.stats.sessionEventsDropped)
+	s.HandshakesRateLimited = atomic.LoadUint64(&t.stats.handshakesRateLimited)
+	s.DeniedClientPackets = atomic.LoadUint64(&t.stats.deniedClientPackets)
+	s.DeniedSourcePackets = atomic.LoadUint64(&t.stats.deniedSourcePackets)
+	s.ClientsRejected = atomic.LoadUint64(&t.stats.clientsRejected)
+	s.InvalidClientPackets = atomic.LoadUint64(&t.stats.invalidClientPackets)
+	s.FilteredPackets = atomic.LoadUint64(&t.stats.filteredPackets)
+	s.ProbeBans = atomic.LoadUint64(&t.stats.probeBans)
+	s.ProbeBannedPackets = atomic.LoadUint64(&t.stats.probeBannedPackets)
+	s.ProbeBansActive = t.probeBansActive()
+	s.FallbackPackets = atomic.LoadUint64(&t.stats.fallbackPackets)
+	s.Draining = t.Draining()
+	s.HandshakesDrained = atomic.LoadUint64(&t.stats.handshakesDrained)
+	s.DrainPackets = atomic.LoadUint64(&t.stats.drainPackets)
+	s.NATKeepalivesSent = atomic.LoadUint64(&t.stats.natKeepalivesSent)
+	s.NATKeepalivesReceived = atomic.LoadUint64(&t.stats.natKeepalivesReceived)
+
+	t.fallbackSessionsLock.Lock()
+	for _, session := range t.fallbackSessions {
+		if session.drain {
+			s.DrainSessions++
+		} else {
+			s.FallbackSessions++
+		}
+	}
+	t.fallbackSessionsLock.Unlock()
+	s.PacketsForwarded = atomic.LoadUint64(&t.stats.packetsForwarded)
+	s.BytesForwarded = atomic.LoadUint64(&t.stats.bytesForwarded)
+	s.DroppedPackets = atomic.LoadUint64(&t.stats.droppedPackets)
+	s.QueueDroppedPackets = atomic.LoadUint64(&t.stats.queueDropped)
+	s.OversizedPackets = atomic.LoadUint64(&t.stats.oversizedPackets)
+	s.ReadErrors = atomic.LoadUint64(&t.stats.readErrors)
+	s.WriteErrors = atomic.LoadUint64(&t.stats.writeErrors)
+	s.PathMTURetries = atomic.LoadUint64(&t.stats.pathMTURetries)
+	s.PacketPanics = atomic.LoadUint64(&t.stats.packetPanics)
+	s.SuppressedLogs = atomic.LoadUint64(&t.stats.suppressedLogs)
+	s.BandwidthLimitedPackets = atomic.LoadUint64(&t.stats.bandwidthLimited)
+
+	s.Latency = t.latencyStats()
+	s.Upstreams = t.upstreamStats()
+	s.Accounts = t.accountStats()
+
+	t.mapLock.RLock()
+	defer t.mapLock.RUnlock()
+
+	s.ActiveSessions = t.clientMap.lenLocked()
+	s.Listeners = t.listenerStatsLocked()
+	s.Peers = make([]PeerStats, 0, s.ActiveSessions)
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		ps := PeerStats{
+			ClientPublicKey:       peer.clientPublicKey.Base64(),
+			ClientOriginIndex:     peer.clientOriginIndex,
+			ClientProxyIndex:      peer.clientProxyIndex,
+			ServerOriginIndex:     peer.serverOriginIndex,
+			ServerProxyIndex:      peer.serverProxyIndex,
+			ClientToServerPackets: atomic.LoadUint64(&peer.stats.c2sPackets),
+			ClientToServerBytes:   atomic.LoadUint64(&peer.stats.c2sBytes),
+			ServerToClientPackets: atomic.LoadUint64(&peer.stats.s2cPackets),
+			ServerToClientBytes:   atomic.LoadUint64(&peer.stats.s2cBytes),
+
+			ClientToServerBandwidthLimited: atomic.LoadUint64(&peer.stats.c2sBandwidthLimited),
+			ServerToClientBandwidthLimited: atomic.LoadUint64(&peer.stats.s2cBandwidthLimited),
+		}
+		if destination := peer.clientAddr(); destination != nil {
+			ps.ClientDestination = destination.String()
+		}
+		if destination := peer.serverAddr(); destination != nil {
+			ps.ServerDestination = destination.String()
+		}
+		s.Peers = append(s.Peers, ps)
+		return true
+	})
+	return
+}
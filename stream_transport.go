@@ -0,0 +1,395 @@
+package mwgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// The stream transports carry the obfuscated packets over the TCP connections (raw TCP or WebSocket),
+// one packet per message, for the networks where UDP is blocked or throttled.
+
+const (
+	// kStreamDialTimeout bounds the TCP (and TLS, WebSocket) handshakes of a connection.
+	kStreamDialTimeout = 10 * time.Second
+
+	kStreamReconnectBackoffMin = time.Second
+	kStreamReconnectBackoffMax = 30 * time.Second
+
+	// kStreamQueueSize is the number of received messages waiting for the read loop of the table.
+	kStreamQueueSize = 256
+
+	// kStreamPendingMax is the number of packets kept while the client is (re)connecting,
+	// the oldest ones are dropped once it is reached.
+	kStreamPendingMax = 64
+)
+
+// streamConn is an established connection carrying the messages.
+//
+// readMessage must be called by a single goroutine, writeMessage and ping are safe to be called concurrently.
+type streamConn interface {
+	// readMessage reads the next message into b, and returns its length.
+	readMessage(b []byte) (n int, err error)
+
+	// writeMessage writes b as a single message.
+	writeMessage(b []byte) (err error)
+
+	// ping keeps the connection alive, and extends the read deadline of the other end.
+	ping() (err error)
+
+	Close() (err error)
+}
+
+type streamMessage struct {
+	packet *Packet
+	addr   netip.AddrPort
+}
+
+// takeStreamPacket moves the message received into the packet of the table, by swapping their buffers
+// if they are of the same size (the table and the transports share the MaxPacketSize), or copying it otherwise.
+// The message is left with the old buffer of the packet, to be put back to the pool of the transport.
+func takeStreamPacket(packet *Packet, message *Packet) {
+	if len(packet.Data) == len(message.Data) {
+		packet.Data, message.Data = message.Data, packet.Data
+		packet.Length = message.Length
+		return
+	}
+	packet.Length = copy(packet.Data, message.Slice())
+}
+
+// streamServerTransport is the PacketTransport of the stream connections from the clients.
+//
+// Every connection is identified by its TCP remote address, which is the packet.Source of the messages
+// received from it, so the Peer of a stream client is keyed on the connection.
+// A reconnected client comes from another address, which is handled as the client roaming.
+type streamServerTransport struct {
+	name           string
+	maxMessageSize int
+	logger         Logger
+
+	// pool holds the buffers the messages are read into, which are then swapped with the ones of the table.
+	pool     *PacketPool
+	incoming chan streamMessage
+
+	lock  sync.Mutex
+	conns map[netip.AddrPort]streamConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamServerTransport(name string, maxMessageSize int, logger Logger) *streamServerTransport {
+	return &streamServerTransport{
+		name:           name,
+		maxMessageSize: maxMessageSize,
+		logger:         logger,
+		pool:           NewPacketPool(uint(maxMessageSize)),
+		incoming:       make(chan streamMessage, kStreamQueueSize),
+		conns:          make(map[netip.AddrPort]streamConn),
+		closed:         make(chan struct{}),
+	}
+}
+
+// serveConn reads the conn from the remote until it is broken or the transport is closed.
+func (t *streamServerTransport) serveConn(conn streamConn, remote net.Addr) {
+	addr, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		_ = conn.Close()
+		t.logger.Errorf("invalid %s remote address %s: %s", t.name, remote, err.Error())
+		return
+	}
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	t.lock.Lock()
+	select {
+	case <-t.closed:
+		t.lock.Unlock()
+		_ = conn.Close()
+		return
+	default:
+	}
+	t.conns[addr] = conn
+	t.lock.Unlock()
+	t.logger.Debugf("%s client %s connected", t.name, addr)
+
+	err = t.readLoop(conn, addr)
+
+	t.lock.Lock()
+	if t.conns[addr] == conn {
+		delete(t.conns, addr)
+	}
+	t.lock.Unlock()
+	_ = conn.Close()
+	t.logger.Debugf("%s client %s disconnected: %v", t.name, addr, err)
+}
+
+func (t *streamServerTransport) readLoop(conn streamConn, addr netip.AddrPort) (err error) {
+	for {
+		message := t.pool.Get()
+		message.Length, err = conn.readMessage(message.Data)
+		if err != nil {
+			t.pool.Put(message)
+			return
+		}
+		select {
+		case t.incoming <- streamMessage{packet: message, addr: addr}:
+		case <-t.closed:
+			t.pool.Put(message)
+			err = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (t *streamServerTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	select {
+	case m := <-t.incoming:
+		takeStreamPacket(packet, m.packet)
+		t.pool.Put(m.packet)
+		packet.setSourceAddrPort(m.addr)
+		addr = packet.Source
+	case <-t.closed:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (t *streamServerTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	key := upstreamKey(addr)
+	t.lock.Lock()
+	conn := t.conns[key]
+	t.lock.Unlock()
+	if conn == nil {
+		err = fmt.Errorf("%s client %s is not connected", t.name, key)
+		return
+	}
+	err = conn.writeMessage(packet.Slice())
+	if err != nil {
+		// the read loop will clean it up
+		_ = conn.Close()
+	}
+	return
+}
+
+// Close closes all the connections, the listener is closed by the wrapping transport.
+func (t *streamServerTransport) Close() (err error) {
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		close(t.closed)
+		for _, conn := range t.conns {
+			_ = conn.Close()
+		}
+		t.lock.Unlock()
+	})
+	return
+}
+
+// streamClientTransport is the PacketTransport of mwgp-client to mwgp-server over a stream connection.
+//
+// It keeps a connection to the addr in the background with the dial function,
+// and reconnects with a backoff once it is lost. The packets written while (re)connecting are retained in a queue.
+type streamClientTransport struct {
+	// name describes the connection in the logs.
+	name         string
+	addr         *net.UDPAddr
+	dial         func(ctx context.Context) (conn streamConn, err error)
+	pingInterval time.Duration
+	logger       Logger
+
+	// pool holds the buffers the messages are read into, which are then swapped with the ones of the table.
+	pool     *PacketPool
+	incoming chan *Packet
+
+	lock sync.Mutex
+	conn streamConn
+	// pending are the packets retained by WritePacket while (re)connecting.
+	pending []*Packet
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ PacketTransport = (*streamClientTransport)(nil)
+
+func newStreamClientTransport(name string, addr *net.UDPAddr, dial func(ctx context.Context) (conn streamConn, err error),
+	pingInterval time.Duration, maxMessageSize int, logger Logger) (t *streamClientTransport) {
+	t = &streamClientTransport{
+		name:         name,
+		addr:         addr,
+		dial:         dial,
+		pingInterval: pingInterval,
+		logger:       logger,
+		pool:         NewPacketPool(uint(maxMessageSize)),
+		incoming:     make(chan *Packet, kStreamQueueSize),
+		closed:       make(chan struct{}),
+	}
+	go t.run()
+	return
+}
+
+// run keeps the connection until the transport is closed.
+func (t *streamClientTransport) run() {
+	backoff := kStreamReconnectBackoffMin
+	for {
+		conn, err := t.connect()
+		if err == nil {
+			connectedAt := time.Now()
+			t.logger.Infof("%s connected to %s", t.name, t.addr)
+			err = t.serve(conn)
+			if time.Since(connectedAt) > kStreamReconnectBackoffMax {
+				backoff = kStreamReconnectBackoffMin
+			}
+		}
+		select {
+		case <-t.closed:
+			return
+		default:
+		}
+		t.logger.Warnf("%s connection to %s failed: %s, reconnect in %s", t.name, t.addr, err.Error(), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-t.closed:
+			return
+		}
+		backoff *= 2
+		if backoff > kStreamReconnectBackoffMax {
+			backoff = kStreamReconnectBackoffMax
+		}
+	}
+}
+
+func (t *streamClientTransport) connect() (conn streamConn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kStreamDialTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	conn, err = t.dial(ctx)
+	return
+}
+
+// serve flushes the pending packets to the conn, then reads it until it is broken.
+func (t *streamClientTransport) serve(conn streamConn) (err error) {
+	t.lock.Lock()
+	select {
+	case <-t.closed:
+		t.lock.Unlock()
+		_ = conn.Close()
+		err = net.ErrClosed
+		return
+	default:
+	}
+	for _, packet := range t.pending {
+		err = conn.writeMessage(packet.Slice())
+		if err != nil {
+			break
+		}
+	}
+	t.pending = nil
+	if err == nil {
+		t.conn = conn
+	}
+	t.lock.Unlock()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	pingDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(t.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if conn.ping() != nil {
+					_ = conn.Close()
+					return
+				}
+			case <-pingDone:
+				return
+			}
+		}
+	}()
+
+	for {
+		message := t.pool.Get()
+		message.Length, err = conn.readMessage(message.Data)
+		if err != nil {
+			t.pool.Put(message)
+			break
+		}
+		select {
+		case t.incoming <- message:
+			continue
+		case <-t.closed:
+			t.pool.Put(message)
+			err = net.ErrClosed
+		}
+		break
+	}
+	close(pingDone)
+	t.lock.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.lock.Unlock()
+	_ = conn.Close()
+	return
+}
+
+// ReadPacket returns the addr as the source, so that the packets match the server destination of the peers.
+func (t *streamClientTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	select {
+	case message := <-t.incoming:
+		takeStreamPacket(packet, message)
+		t.pool.Put(message)
+		packet.setSourceAddrPort(upstreamKey(t.addr))
+		addr = packet.Source
+	case <-t.closed:
+		err = net.ErrClosed
+	}
+	return
+}
+
+// WritePacket ignores the addr, the packet is retained in the queue if it is not connected yet.
+func (t *streamClientTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	t.lock.Lock()
+	conn := t.conn
+	if conn == nil {
+		if len(t.pending) >= kStreamPendingMax {
+			t.pending = t.pending[1:]
+		}
+		packet.Flags |= PacketFlagRetained
+		t.pending = append(t.pending, packet)
+		t.lock.Unlock()
+		return
+	}
+	t.lock.Unlock()
+	err = conn.writeMessage(packet.Slice())
+	if err != nil {
+		// the read loop will reconnect
+		_ = conn.Close()
+	}
+	return
+}
+
+func (t *streamClientTransport) Close() (err error) {
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		close(t.closed)
+		if t.conn != nil {
+			err = t.conn.Close()
+		}
+		t.pending = nil
+		t.lock.Unlock()
+	})
+	return
+}
@@ -0,0 +1,226 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Systemd Socket Activation:
+//
+// With the socket activation, systemd binds the sockets of the .socket unit and passes them to the service
+// from the fd 3, see sd_listen_fds(3). LISTEN_FDS is the number of them, and LISTEN_FDNAMES is their
+// FileDescriptorName separated by ":", they are only for the process of LISTEN_PID.
+//
+// The listen address "systemd" serves all the UDP sockets passed, and "systemd:<name>" serves the ones
+// of the FileDescriptorName, so that the sockets of more than one instance can be passed to the same process.
+// With a listen address, the UDP socket passed and bound to the same address is used instead of binding it again,
+// the address is bound as usual if there is no such socket or the process is not socket-activated.
+
+const (
+	kSystemdListen         = "systemd"
+	kSystemdListenFDsStart = 3
+	kSystemdDefaultFDName  = "unknown"
+)
+
+type systemdSocket struct {
+	name string
+	conn *net.UDPConn
+}
+
+// systemdSockets are the UDP sockets passed by systemd, loaded once on the first use.
+var systemdSockets struct {
+	once      sync.Once
+	lock      sync.Mutex
+	activated bool
+	err       error
+
+	// sockets are the ones not taken yet, see takeSystemdSockets
+	sockets []systemdSocket
+}
+
+// parseSystemdListen reports whether the listen address is "systemd" or "systemd:<name>".
+func parseSystemdListen(listen string) (name string, ok bool) {
+	if listen == kSystemdListen {
+		ok = true
+		return
+	}
+	if strings.HasPrefix(listen, kSystemdListen+":") {
+		name, ok = strings.TrimPrefix(listen, kSystemdListen+":"), true
+	}
+	return
+}
+
+// parseSystemdListenFDs returns the names of the fds passed by systemd,
+// activated is false if they are not passed to the process of pid.
+func parseSystemdListenFDs(listenPID, listenFDs, listenFDNames string, pid int) (names []string, activated bool, err error) {
+	if listenPID == "" || listenFDs == "" {
+		return
+	}
+	p, err := strconv.Atoi(listenPID)
+	if err != nil {
+		err = fmt.Errorf("invalid LISTEN_PID %s: %w", listenPID, err)
+		return
+	}
+	if p != pid {
+		return
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		err = fmt.Errorf("invalid LISTEN_FDS %s", listenFDs)
+		return
+	}
+	if listenFDNames != "" {
+		names = strings.Split(listenFDNames, ":")
+	} else if n > 0 {
+		names = make([]string, n)
+		for i := range names {
+			names[i] = kSystemdDefaultFDName
+		}
+	}
+	if len(names) != n {
+		err = fmt.Errorf("LISTEN_FDNAMES %s does not match LISTEN_FDS %d", listenFDNames, n)
+		names = nil
+		return
+	}
+	activated = true
+	return
+}
+
+func loadSystemdSockets() {
+	names, activated, err := parseSystemdListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if err != nil {
+		systemdSockets.err = err
+		return
+	}
+	if !activated {
+		return
+	}
+	// not to be inherited by the child processes
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		files[i] = os.NewFile(uintptr(kSystemdListenFDsStart+i), name)
+	}
+	systemdSockets.activated = true
+	systemdSockets.sockets = udpSocketsOf(files, names)
+}
+
+// udpSocketsOf returns the UDP sockets of the files, the files of them are closed,
+// and the others (such as the TCP sockets) are left open.
+func udpSocketsOf(files []*os.File, names []string) (sockets []systemdSocket) {
+	for i, f := range files {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			continue
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			_ = pc.Close()
+			continue
+		}
+		// the conn has its own dup of the fd
+		_ = f.Close()
+		sockets = append(sockets, systemdSocket{name: names[i], conn: conn})
+	}
+	return
+}
+
+// takeSystemdSockets takes the UDP sockets passed by systemd that match,
+// a socket is taken only once.
+func takeSystemdSockets(match func(s systemdSocket) bool) (conns []*net.UDPConn, activated bool, err error) {
+	systemdSockets.once.Do(loadSystemdSockets)
+	systemdSockets.lock.Lock()
+	defer systemdSockets.lock.Unlock()
+	activated, err = systemdSockets.activated, systemdSockets.err
+	if err != nil {
+		return
+	}
+	remaining := systemdSockets.sockets[:0]
+	for _, s := range systemdSockets.sockets {
+		if match(s) {
+			conns = append(conns, s.conn)
+		} else {
+			remaining = append(remaining, s)
+		}
+	}
+	systemdSockets.sockets = remaining
+	return
+}
+
+// udpAddrBoundTo reports whether the local address of a socket is the addr to listen on.
+func udpAddrBoundTo(local net.Addr, addr *net.UDPAddr) bool {
+	l, ok := local.(*net.UDPAddr)
+	if !ok || addr.Port == 0 || l.Port != addr.Port {
+		return false
+	}
+	if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
+		return l.IP.IsUnspecified()
+	}
+	return l.IP.Equal(addr.IP) && l.Zone == addr.Zone
+}
+
+// listenSystemd returns the transports of the UDP sockets passed by systemd,
+// the ones named ClientListenFDName if set.
+func (t *WireGuardIndexTranslationTable) listenSystemd() (transports []PacketTransport, err error) {
+	conns, activated, err := takeSystemdSockets(func(s systemdSocket) bool {
+		return t.ClientListenFDName == "" || s.name == t.ClientListenFDName
+	})
+	if err != nil {
+		return
+	}
+	if !activated {
+		err = errors.New("not socket-activated by systemd")
+		return
+	}
+	if len(conns) == 0 {
+		if t.ClientListenFDName != "" {
+			err = fmt.Errorf("no UDP socket named %s is passed by systemd", t.ClientListenFDName)
+		} else {
+			err = errors.New("no UDP socket is passed by systemd")
+		}
+		return
+	}
+	for _, conn := range conns {
+		t.setSocketBuffers(conn, "client")
+		t.Logger.Infof("listen on %s passed by systemd", conn.LocalAddr())
+		transports = append(transports, NewUDPTransport(conn))
+	}
+	return
+}
+
+// listenSystemdOn returns the transport of the UDP socket passed by systemd and bound to the addr,
+// or nil if there is no such socket.
+func (t *WireGuardIndexTranslationTable) listenSystemdOn(addr *net.UDPAddr) (transports []PacketTransport) {
+	conns, _, _ := takeSystemdSockets(func(s systemdSocket) bool {
+		return udpAddrBoundTo(s.conn.LocalAddr(), addr)
+	})
+	for _, conn := range conns {
+		t.setSocketBuffers(conn, "client")
+		t.Logger.Infof("use the socket of %s passed by systemd", conn.LocalAddr())
+		transports = append(transports, NewUDPTransport(conn))
+	}
+	return
+}
+
+// clientListenString returns the listen address for the logs.
+func (t *WireGuardIndexTranslationTable) clientListenString() string {
+	if !t.ClientListenSystemd {
+		addrs := make([]string, 0, 1+len(t.ClientListenExtra))
+		for _, r := range t.clientListenRanges() {
+			addrs = append(addrs, r.String())
+		}
+		return strings.Join(addrs, ",")
+	}
+	if t.ClientListenFDName != "" {
+		return kSystemdListen + ":" + t.ClientListenFDName
+	}
+	return kSystemdListen
+}
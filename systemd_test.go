@@ -0,0 +1,142 @@
+package mwgp
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseSystemdListenFDs(t *testing.T) {
+	const pid = 1234
+	for _, c := range []struct {
+		pid, fds, fdNames string
+		names             []string
+		activated         bool
+		invalid           bool
+	}{
+		{},
+		{pid: "1234", fds: "2", fdNames: "wg0:wg1", names: []string{"wg0", "wg1"}, activated: true},
+		{pid: "1234", fds: "2", names: []string{"unknown", "unknown"}, activated: true},
+		{pid: "1234", fds: "0", activated: true},
+		{pid: "4321", fds: "2", fdNames: "wg0:wg1"},
+		{pid: "1234", fds: "2", fdNames: "wg0", invalid: true},
+		{pid: "1234", fds: "-1", invalid: true},
+		{pid: "a", fds: "1", invalid: true},
+	} {
+		names, activated, err := parseSystemdListenFDs(c.pid, c.fds, c.fdNames, pid)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%+v: expected an error", c)
+			}
+			continue
+		}
+		if err != nil || activated != c.activated || !reflect.DeepEqual(names, c.names) {
+			t.Errorf("%+v: got %v, %v (%v)", c, names, activated, err)
+		}
+	}
+
+	for _, c := range []struct {
+		listen string
+		name   string
+		ok     bool
+	}{
+		{listen: "systemd", ok: true},
+		{listen: "systemd:wg0", name: "wg0", ok: true},
+		{listen: ":1000"},
+		{listen: "systemd.example.com:1000"},
+	} {
+		name, ok := parseSystemdListen(c.listen)
+		if name != c.name || ok != c.ok {
+			t.Errorf("%s: expected %s and %v, got %s and %v", c.listen, c.name, c.ok, name, ok)
+		}
+	}
+}
+
+func TestUDPAddrBoundTo(t *testing.T) {
+	for _, c := range []struct {
+		local, addr string
+		bound       bool
+	}{
+		{local: "127.0.0.1:1000", addr: "127.0.0.1:1000", bound: true},
+		{local: "[::]:1000", addr: ":1000", bound: true},
+		{local: "0.0.0.0:1000", addr: "0.0.0.0:1000", bound: true},
+		{local: "127.0.0.1:1000", addr: ":1000"},
+		{local: "127.0.0.1:1000", addr: "127.0.0.1:1001"},
+		{local: "127.0.0.1:1000", addr: "127.0.0.2:1000"},
+		{local: "[::]:1000", addr: ":0"},
+	} {
+		local, _ := net.ResolveUDPAddr("udp", c.local)
+		addr, _ := net.ResolveUDPAddr("udp", c.addr)
+		if bound := udpAddrBoundTo(local, addr); bound != c.bound {
+			t.Errorf("%s bound to %s: expected %v, got %v", c.local, c.addr, c.bound, bound)
+		}
+	}
+}
+
+func TestListenSystemd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("net.FilePacketConn is not supported on windows")
+	}
+	var files []*os.File
+	var addrs []*net.UDPAddr
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := conn.File()
+		_ = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, conn.LocalAddr().(*net.UDPAddr))
+	}
+
+	systemdSockets.once.Do(loadSystemdSockets)
+	systemdSockets.lock.Lock()
+	systemdSockets.activated = true
+	systemdSockets.sockets = udpSocketsOf(files, []string{"wg0", "wg1", "wg0"})
+	systemdSockets.lock.Unlock()
+	t.Cleanup(func() {
+		systemdSockets.lock.Lock()
+		for _, s := range systemdSockets.sockets {
+			_ = s.conn.Close()
+		}
+		systemdSockets.activated = false
+		systemdSockets.sockets = nil
+		systemdSockets.lock.Unlock()
+	})
+
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListenSystemd = true
+	table.ClientListenFDName = "wg0"
+	transports, err := table.listenSystemd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transports) != 2 || localAddrOf(transports[0]) != addrs[0].String() || localAddrOf(transports[1]) != addrs[2].String() {
+		t.Errorf("expected the sockets named wg0, got %v", transports)
+	}
+	for _, transport := range transports {
+		_ = transport.Close()
+	}
+	if _, err = table.listenSystemd(); err == nil {
+		t.Errorf("expected an error since the sockets are taken")
+	}
+
+	// the socket bound to the listen address is used instead of binding it again
+	transports = table.listenSystemdOn(addrs[1])
+	if len(transports) != 1 || localAddrOf(transports[0]) != addrs[1].String() {
+		t.Errorf("expected the socket bound to %s, got %v", addrs[1], transports)
+	}
+	for _, transport := range transports {
+		_ = transport.Close()
+	}
+}
+
+func localAddrOf(transport PacketTransport) string {
+	return transport.(*UDPTransport).Conn().LocalAddr().String()
+}
@@ -0,0 +1,206 @@
+package mwgp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The TCP transport carries the obfuscated packets over a raw TCP connection,
+// each one is a frame with a 2-bytes big-endian length prefix.
+// A zero-length frame is a keepalive, which is never delivered.
+
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+
+	defaultTCPReadTimeout  = 90 * time.Second
+	defaultTCPWriteTimeout = 10 * time.Second
+
+	kTCPFrameHeaderLength = 2
+	kTCPFrameMaxLength    = 0xffff
+)
+
+var errTCPFrameTooLarge = newError(ErrProtocol, "tcp frame is too large")
+
+func validateTransport(transport string) (err error) {
+	switch transport {
+	case "", TransportUDP, TransportTCP:
+	default:
+		err = fmt.Errorf("invalid transport %q, must be %q or %q", transport, TransportUDP, TransportTCP)
+	}
+	return
+}
+
+// tcpFrameConn is an established TCP connection carrying the length-prefixed frames.
+type tcpFrameConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// maxMessageSize bounds the frames received, the connection is reset on a larger one.
+	maxMessageSize int
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// readHeader is the frame header being read, kept here so that it does not escape to the heap for every frame.
+	readHeader [kTCPFrameHeaderLength]byte
+
+	writeLock   sync.Mutex
+	writeBuffer []byte
+}
+
+func newTCPFrameConn(conn net.Conn, maxMessageSize int, readTimeout, writeTimeout time.Duration) *tcpFrameConn {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		// the default of Go, but the frames must never wait for the ACKs
+		_ = tc.SetNoDelay(true)
+	}
+	return &tcpFrameConn{
+		conn:           conn,
+		reader:         bufio.NewReader(conn),
+		maxMessageSize: maxMessageSize,
+		readTimeout:    readTimeout,
+		writeTimeout:   writeTimeout,
+	}
+}
+
+// readMessage reads the next non-empty frame into b, the read deadline is extended for every frame.
+func (c *tcpFrameConn) readMessage(b []byte) (n int, err error) {
+	for {
+		if c.readTimeout > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+		_, err = io.ReadFull(c.reader, c.readHeader[:])
+		if err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(c.readHeader[:]))
+		if length == 0 {
+			continue
+		}
+		if length > c.maxMessageSize || length > len(b) {
+			// the stream cannot be resynchronized, reset it rather than waiting for a graceful close
+			if tc, ok := c.conn.(*net.TCPConn); ok {
+				_ = tc.SetLinger(0)
+			}
+			err = fmt.Errorf("%w: %d bytes", errTCPFrameTooLarge, length)
+			return
+		}
+		_, err = io.ReadFull(c.reader, b[:length])
+		if err != nil {
+			return
+		}
+		n = length
+		return
+	}
+}
+
+// writeMessage writes b as a single frame.
+func (c *tcpFrameConn) writeMessage(b []byte) (err error) {
+	if len(b) > kTCPFrameMaxLength {
+		err = fmt.Errorf("%w: %d bytes", errTCPFrameTooLarge, len(b))
+		return
+	}
+	return c.writeFrame(b)
+}
+
+// ping writes a zero-length frame.
+func (c *tcpFrameConn) ping() (err error) {
+	return c.writeFrame(nil)
+}
+
+func (c *tcpFrameConn) writeFrame(payload []byte) (err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if cap(c.writeBuffer) < kTCPFrameHeaderLength+len(payload) {
+		c.writeBuffer = make([]byte, 0, kTCPFrameHeaderLength+len(payload))
+	}
+	frame := append(c.writeBuffer[:0], 0, 0)
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	frame = append(frame, payload...)
+	c.writeBuffer = frame
+
+	if c.writeTimeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err = c.conn.Write(frame)
+	return
+}
+
+func (c *tcpFrameConn) Close() (err error) {
+	return c.conn.Close()
+}
+
+// tcpServerTransport accepts the TCP connections from the clients.
+type tcpServerTransport struct {
+	*streamServerTransport
+	listener net.Listener
+}
+
+var _ PacketTransport = (*tcpServerTransport)(nil)
+
+func newTCPServerTransport(listen string, maxMessageSize int, logger Logger) (t *tcpServerTransport, err error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to listen on tcp_listen %s: %w", listen, err)
+		return
+	}
+	t = &tcpServerTransport{
+		streamServerTransport: newStreamServerTransport("tcp", maxMessageSize, logger),
+		listener:              listener,
+	}
+	go t.acceptLoop()
+	return
+}
+
+// Addr returns the address the transport is listening on.
+func (t *tcpServerTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *tcpServerTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+			}
+			// such as running out of the file descriptors, retry later
+			t.logger.Errorf("failed to accept tcp connection: %s", err.Error())
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-t.closed:
+				return
+			}
+		}
+		go t.serveConn(newTCPFrameConn(conn, t.maxMessageSize, defaultTCPReadTimeout, defaultTCPWriteTimeout), conn.RemoteAddr())
+	}
+}
+
+func (t *tcpServerTransport) Close() (err error) {
+	_ = t.streamServerTransport.Close()
+	err = t.listener.Close()
+	return
+}
+
+// newTCPClientTransport returns the transport to mwgp-server at the addr over TCP.
+func newTCPClientTransport(addr *net.UDPAddr, dialer *net.Dialer, maxMessageSize int, logger Logger) (t *streamClientTransport) {
+	dial := func(ctx context.Context) (sc streamConn, err error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return
+		}
+		sc = newTCPFrameConn(conn, maxMessageSize, defaultTCPReadTimeout, defaultTCPWriteTimeout)
+		return
+	}
+	t = newStreamClientTransport("tcp", addr, dial, defaultTCPReadTimeout/3, maxMessageSize, logger)
+	return
+}
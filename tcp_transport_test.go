@@ -0,0 +1,241 @@
+package mwgp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestTCPFramePair(t *testing.T) (client, server *tcpFrameConn) {
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	client = newTCPFrameConn(c, 2048, time.Second, time.Second)
+	server = newTCPFrameConn(s, 2048, time.Second, time.Second)
+	return
+}
+
+func TestTCPFrameConn_RoundTrip(t *testing.T) {
+	client, server := newTestTCPFramePair(t)
+	go func() {
+		_ = client.writeMessage([]byte("first"))
+		_ = client.ping()
+		// a frame split across the writes
+		_, _ = client.conn.Write([]byte{0x00})
+		_, _ = client.conn.Write([]byte{0x06, 's', 'e'})
+		_, _ = client.conn.Write([]byte("cond"))
+		_ = client.writeMessage(bytes.Repeat([]byte{0x5a}, 2048))
+	}()
+	buffer := make([]byte, 2048)
+	for _, expected := range [][]byte{[]byte("first"), []byte("second"), bytes.Repeat([]byte{0x5a}, 2048)} {
+		n, err := server.readMessage(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buffer[:n], expected) {
+			t.Fatalf("expected %d bytes %x..., got %d bytes %x...", len(expected), expected[:4], n, buffer[:4])
+		}
+	}
+}
+
+func TestTCPFrameConn_TooLarge(t *testing.T) {
+	client, server := newTestTCPFramePair(t)
+	go func() { _ = client.writeMessage(make([]byte, 2049)) }()
+	_, err := server.readMessage(make([]byte, 4096))
+	if !errors.Is(err, errTCPFrameTooLarge) {
+		t.Fatalf("expected errTCPFrameTooLarge, got %v", err)
+	}
+	if err = client.writeMessage(make([]byte, kTCPFrameMaxLength+1)); !errors.Is(err, errTCPFrameTooLarge) {
+		t.Fatalf("expected errTCPFrameTooLarge, got %v", err)
+	}
+}
+
+func TestEndToEndTCP(t *testing.T) {
+	const obfsKey = "tcp transport"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerTCPListen := e2eFreeTCPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{e2eFreeUDPAddr(t)},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: obfsKey,
+		TCPListen:    mwgpServerTCPListen,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerTCPListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+		Transport:       TransportTCP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	// the client reconnects after the connection is lost, and the session roams to the new connection
+	client.wgitTable.upstreamConnsLock.RLock()
+	for _, uc := range client.wgitTable.upstreamConns {
+		tt := uc.transport.(*streamClientTransport)
+		tt.lock.Lock()
+		if tt.conn != nil {
+			_ = tt.conn.Close()
+		}
+		tt.lock.Unlock()
+	}
+	client.wgitTable.upstreamConnsLock.RUnlock()
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+	if stats := server.Stats(); stats.TotalSessionsCreated != 1 {
+		t.Errorf("expected the session to be kept after reconnect, got %d sessions created", stats.TotalSessionsCreated)
+	}
+}
+
+func TestClientConfig_TransportConflict(t *testing.T) {
+	_, err := NewClientWithConfig(&ClientConfig{
+		Listen:    ListenAddresses{"127.0.0.1:0"},
+		Transport: TransportTCP,
+		WebSocket: &WebSocketClientConfig{URL: "wss://example.com/"},
+	})
+	if err == nil {
+		t.Fatal("expected transport tcp and websocket to be conflicted")
+	}
+	_, err = NewClientWithConfig(&ClientConfig{
+		Listen:    ListenAddresses{"127.0.0.1:0"},
+		Transport: "quic",
+	})
+	if err == nil {
+		t.Fatal("expected an error of the invalid transport")
+	}
+}
+
+func TestStreamClientTransport_RetainPending(t *testing.T) {
+	dial := func(ctx context.Context) (conn streamConn, err error) {
+		<-ctx.Done()
+		err = ctx.Err()
+		return
+	}
+	transport := newStreamClientTransport("test", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, dial,
+		time.Second, 1500, NewStdLogger(LogLevelError))
+	defer transport.Close()
+
+	table := NewWireGuardIndexTranslationTable()
+	packet := table.obtainPacket()
+	packet.Length = copy(packet.Data, "pending")
+	if err := transport.WritePacket(packet, nil); err != nil {
+		t.Fatal(err)
+	}
+	if packet.Flags&PacketFlagRetained == 0 {
+		t.Fatal("expected the packet retained while connecting")
+	}
+	table.recyclePacket(packet)
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if len(transport.pending) != 1 || transport.pending[0] != packet || string(packet.Slice()) != "pending" {
+		t.Fatal("expected the retained packet intact in the queue")
+	}
+}
+
+// BenchmarkWireGuardIndexTranslationTable_ForwardTransportTCP is the ForwardTransport benchmark
+// with the packets from the client over a TCP connection.
+func BenchmarkWireGuardIndexTranslationTable_ForwardTransportTCP(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	transport, err := newTCPServerTransport("127.0.0.1:0", 1500, NewStdLogger(LogLevelError))
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", transport.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	client := newTCPFrameConn(conn, 1500, 0, 0)
+
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.MaxPacketSize = 1500
+	table.ExtraClientTransports = []PacketTransport{transport}
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(conn.LocalAddr().String())),
+		serverDestination: server.LocalAddr().(*net.UDPAddr),
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	payload := make([]byte, 148)
+	payload[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(payload[4:], peer.serverProxyIndex)
+	buf := make([]byte, 1500)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = client.writeMessage(payload); err != nil {
+			b.Fatal(err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = server.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
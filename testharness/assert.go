@@ -0,0 +1,133 @@
+package testharness
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"testing"
+)
+
+const (
+	kMessageInitiationMAC2Offset = 132
+	kMessageResponseMAC2Offset   = 76
+)
+
+// MessageType returns the WireGuard message type of the b, 0 if it is too short.
+func MessageType(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b[0:4])
+}
+
+// Sender returns the sender index of a MessageInitiation or MessageResponse.
+func Sender(b []byte) uint32 {
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b[4:8])
+}
+
+// Receiver returns the receiver index of a MessageResponse, MessageCookieReply or MessageTransport.
+func Receiver(b []byte) uint32 {
+	switch MessageType(b) {
+	case device.MessageResponseType:
+		if len(b) >= 12 {
+			return binary.LittleEndian.Uint32(b[8:12])
+		}
+	case device.MessageCookieReplyType, device.MessageTransportType:
+		if len(b) >= 8 {
+			return binary.LittleEndian.Uint32(b[4:8])
+		}
+	}
+	return 0
+}
+
+// IsWireGuard reports whether the b looks like a plain WireGuard message:
+// a known message type with the reserved bytes zero and the length of the type.
+// MessageType() covers the reserved bytes, as they are the high bytes of the type.
+func IsWireGuard(b []byte) bool {
+	switch MessageType(b) {
+	case device.MessageInitiationType:
+		return len(b) == device.MessageInitiationSize
+	case device.MessageResponseType:
+		return len(b) == device.MessageResponseSize
+	case device.MessageCookieReplyType:
+		return len(b) == device.MessageCookieReplySize
+	case device.MessageTransportType:
+		return len(b) >= device.MessageTransportSize
+	}
+	return false
+}
+
+// ExpectWireGuard fails the test unless every datagram is a plain WireGuard message,
+// which is expected on the segments between the WireGuard endpoints and mwgp.
+func ExpectWireGuard(tb testing.TB, datagrams []Datagram) {
+	tb.Helper()
+	for _, d := range datagrams {
+		if !IsWireGuard(d.Data) {
+			tb.Errorf("%s => %s: expected a plain WireGuard message, got %d bytes %x", d.Src, d.Dst, len(d.Data), d.Data[:min(len(d.Data), 16)])
+		}
+	}
+}
+
+// ExpectObfuscated fails the test if any datagram looks like a plain WireGuard message,
+// which is expected on the segment between the mwgp client and the mwgp server.
+func ExpectObfuscated(tb testing.TB, datagrams []Datagram) {
+	tb.Helper()
+	for _, d := range datagrams {
+		if IsWireGuard(d.Data) {
+			tb.Errorf("%s => %s: message type %d with length %d is not obfuscated", d.Src, d.Dst, MessageType(d.Data), len(d.Data))
+		}
+	}
+}
+
+// ExpectZeroMAC2 fails the test unless the MAC2 of every MessageInitiation and MessageResponse is all zeros.
+func ExpectZeroMAC2(tb testing.TB, datagrams []Datagram) {
+	tb.Helper()
+	for _, d := range datagrams {
+		if !IsWireGuard(d.Data) {
+			continue
+		}
+		var mac2 []byte
+		switch MessageType(d.Data) {
+		case device.MessageInitiationType:
+			mac2 = d.Data[kMessageInitiationMAC2Offset:]
+		case device.MessageResponseType:
+			mac2 = d.Data[kMessageResponseMAC2Offset:]
+		default:
+			continue
+		}
+		for _, b := range mac2 {
+			if b != 0 {
+				tb.Errorf("%s => %s: expected zero MAC2 in message type %d, got %x", d.Src, d.Dst, MessageType(d.Data), mac2)
+				break
+			}
+		}
+	}
+}
+
+// ExpectMessages fails the test unless the message types of the datagrams are the types, in order.
+func ExpectMessages(tb testing.TB, datagrams []Datagram, types ...uint32) {
+	tb.Helper()
+	got := make([]uint32, 0, len(datagrams))
+	for _, d := range datagrams {
+		got = append(got, MessageType(d.Data))
+	}
+	if len(got) != len(types) {
+		tb.Errorf("expected message types %v, got %v", types, got)
+		return
+	}
+	for i := range got {
+		if got[i] != types[i] {
+			tb.Errorf("expected message types %v, got %v", types, got)
+			return
+		}
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
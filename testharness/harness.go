@@ -0,0 +1,231 @@
+package testharness
+
+import (
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+const (
+	kServerPort = 1000
+	kClientPort = 1001
+
+	defaultObfuscateKey = "testharness"
+)
+
+// Options are the options of the Harness, the zero value is valid.
+type Options struct {
+	ObfuscateKey  string
+	ObfuscateMode string
+
+	// Timeout is the forward table timeout of both the mwgp client and server.
+	Timeout time.Duration
+
+	// ConfigureServer and ConfigureClient modify the configs before the mwgp server and client are created.
+	ConfigureServer func(config *mwgp.ServerConfig)
+	ConfigureClient func(config *mwgp.ClientConfig)
+
+	// ServerLogger and ClientLogger replace the loggers of the mwgp server and client if set.
+	ServerLogger mwgp.Logger
+	ClientLogger mwgp.Logger
+}
+
+// Harness is the wire of a WireGuard connection through mwgp on a Network:
+//
+//	Initiator <=> mwgp Client <=> mwgp Server <=> Responder
+//
+// The segments are captured by the Network, use SentTo() and SentFrom() with the addresses to get them.
+type Harness struct {
+	Network   *Network
+	Client    *mwgp.Client
+	Server    *mwgp.Server
+	Initiator *Initiator
+	Responder *Responder
+
+	InitiatorAddr netip.AddrPort
+	ClientAddr    netip.AddrPort
+	ServerAddr    netip.AddrPort
+	ResponderAddr netip.AddrPort
+
+	initiatorSK mwgp.NoisePrivateKey
+	responderPK mwgp.NoisePublicKey
+
+	serverConfig mwgp.ServerConfig
+	serverLogger mwgp.Logger
+}
+
+// New starts the Harness, it is stopped by the tb.Cleanup().
+func New(tb testing.TB, options Options) (h *Harness) {
+	tb.Helper()
+	if options.ObfuscateKey == "" {
+		options.ObfuscateKey = defaultObfuscateKey
+	}
+	initiatorSK, initiatorPK, err := GenerateKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	responderSK, responderPK, err := GenerateKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	h = &Harness{
+		Network:    NewNetwork(),
+		ClientAddr: netip.AddrPortFrom(HostIP, kClientPort),
+		ServerAddr: netip.AddrPortFrom(HostIP, kServerPort),
+
+		initiatorSK: initiatorSK,
+		responderPK: responderPK,
+	}
+
+	responderSocket, err := h.Network.Listen(0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h.Responder = NewResponder(responderSocket, responderSK, initiatorPK)
+	h.ResponderAddr = responderSocket.LocalAddr()
+	go h.Responder.Serve()
+	tb.Cleanup(func() { _ = h.Responder.Close() })
+
+	serverConfig := &mwgp.ServerConfig{
+		Listen:  mwgp.ListenAddresses{h.ServerAddr.String()},
+		Timeout: mwgp.Duration(options.Timeout),
+		Servers: []*mwgp.ServerConfigServer{
+			{
+				PrivateKey: &responderSK,
+				Address:    HostIP.String(),
+				Peers: []*mwgp.ServerConfigPeer{
+					{
+						ClientPublicKey: &initiatorPK,
+						ForwardTo:       h.ResponderAddr.String(),
+					},
+				},
+			},
+		},
+		ObfuscateKey:  options.ObfuscateKey,
+		ObfuscateMode: options.ObfuscateMode,
+	}
+	if options.ConfigureServer != nil {
+		options.ConfigureServer(serverConfig)
+	}
+	h.serverConfig = *serverConfig
+	h.serverLogger = options.ServerLogger
+	h.Server = h.StartServer(tb, kServerPort)
+
+	clientConfig := &mwgp.ClientConfig{
+		Server:          h.ServerAddr.String(),
+		Listen:          mwgp.ListenAddresses{h.ClientAddr.String()},
+		Timeout:         mwgp.Duration(options.Timeout),
+		ClientPublicKey: initiatorPK,
+		ServerPublicKey: responderPK,
+		ObfuscateKey:    options.ObfuscateKey,
+		ObfuscateMode:   options.ObfuscateMode,
+		// the simulated hosts are not on the loopback
+		AllowedSources: []string{HostIP.String()},
+	}
+	if options.ConfigureClient != nil {
+		options.ConfigureClient(clientConfig)
+	}
+	h.Client, err = mwgp.NewClientWithConfig(clientConfig)
+	if err != nil {
+		tb.Fatalf("failed to create mwgp client: %s", err.Error())
+	}
+	h.Client.TransportFactory = h.Network
+	if options.ClientLogger != nil {
+		h.Client.Logger = options.ClientLogger
+	}
+	h.startService(tb, "mwgp client", kClientPort, h.Client.Start, h.Client.Stop)
+
+	h.Initiator = h.NewInitiator(tb)
+	h.InitiatorAddr = h.Initiator.LocalAddr()
+	return
+}
+
+// StartServer starts another mwgp server with the same config on the port,
+// it forwards to the same Responder, and is stopped by the tb.Cleanup().
+func (h *Harness) StartServer(tb testing.TB, port uint16) (server *mwgp.Server) {
+	tb.Helper()
+	config := h.serverConfig
+	config.Listen = mwgp.ListenAddresses{netip.AddrPortFrom(HostIP, port).String()}
+	server, err := mwgp.NewServerWithConfig(&config)
+	if err != nil {
+		tb.Fatalf("failed to create mwgp server: %s", err.Error())
+	}
+	server.TransportFactory = h.Network
+	if h.serverLogger != nil {
+		server.Logger = h.serverLogger
+	}
+	h.startService(tb, "mwgp server", port, server.Start, server.Stop)
+	return
+}
+
+// NewInitiator returns another Initiator with the same key pair on a new socket,
+// like a WireGuard client roamed or restarted.
+func (h *Harness) NewInitiator(tb testing.TB) (i *Initiator) {
+	tb.Helper()
+	socket, err := h.Network.Listen(0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	i = NewInitiator(socket, h.initiatorSK, h.responderPK)
+	tb.Cleanup(func() { _ = i.Close() })
+	return
+}
+
+// startService runs the start func until the stop func is called by the tb.Cleanup(),
+// it returns after the service is listening on the port.
+func (h *Harness) startService(tb testing.TB, name string, port uint16, start func() error, stop func() error) {
+	tb.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- start()
+	}()
+	tb.Cleanup(func() {
+		_ = stop()
+		<-done
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.Network.isListening(port) {
+		select {
+		case err := <-done:
+			tb.Fatalf("%s exited: %v", name, err)
+		case <-time.After(time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("%s is not listening on port %d", name, port)
+		}
+	}
+}
+
+// Handshake completes a handshake between the Initiator and the Responder through mwgp,
+// and returns the sender index of the MessageResponse seen by the Initiator.
+func (h *Harness) Handshake(tb testing.TB, sender uint32) (receiver uint32) {
+	tb.Helper()
+	receiver, err := h.Initiator.Handshake(h.ClientAddr, sender, 5*time.Second)
+	if err != nil {
+		tb.Fatalf("handshake: %s", err.Error())
+	}
+	return
+}
+
+// Echo sends a MessageTransport with the content to the Responder through mwgp,
+// and returns the content echoed back, or an error if nothing is echoed back in the timeout.
+func (h *Harness) Echo(receiver uint32, counter uint64, content []byte, timeout time.Duration) (echoed []byte, err error) {
+	err = h.Initiator.SendTransport(h.ClientAddr, receiver, counter, content)
+	if err != nil {
+		return
+	}
+	d, err := h.Initiator.Recv(timeout)
+	if err != nil {
+		return
+	}
+	if MessageType(d.Data) != device.MessageTransportType || len(d.Data) < device.MessageTransportHeaderSize {
+		err = fmt.Errorf("expected MessageTransport, got message type %d with length %d", MessageType(d.Data), len(d.Data))
+		return
+	}
+	echoed = d.Data[device.MessageTransportHeaderSize:]
+	return
+}
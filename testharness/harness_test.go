@@ -0,0 +1,420 @@
+package testharness
+
+import (
+	"bytes"
+	"errors"
+	"github.com/haruue-net/mwgp"
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHarness_HandshakeAndEcho(t *testing.T) {
+	for _, mode := range []string{mwgp.ObfuscateModeXOR, mwgp.ObfuscateModeAuthenticated} {
+		t.Run(mode, func(t *testing.T) {
+			h := New(t, Options{ObfuscateMode: mode})
+			receiver := h.Handshake(t, 0x11223344)
+			for counter := uint64(0); counter < 4; counter++ {
+				content := bytes.Repeat([]byte{byte(counter)}, 16*int(counter+1))
+				echoed, err := h.Echo(receiver, counter, content, 5*time.Second)
+				if err != nil {
+					t.Fatalf("echo #%d: %s", counter, err.Error())
+				}
+				if !bytes.Equal(echoed, content) {
+					t.Fatalf("echo #%d: content mismatch", counter)
+				}
+			}
+
+			// initiator => client => server => responder
+			ExpectWireGuard(t, h.Network.SentTo(h.ClientAddr))
+			ExpectObfuscated(t, h.Network.SentTo(h.ServerAddr))
+			ExpectWireGuard(t, h.Network.SentTo(h.ResponderAddr))
+			ExpectMessages(t, h.Network.SentTo(h.ResponderAddr), device.MessageInitiationType,
+				device.MessageTransportType, device.MessageTransportType, device.MessageTransportType, device.MessageTransportType)
+
+			// responder => server => client => initiator
+			ExpectWireGuard(t, h.Network.SentFrom(h.ResponderAddr))
+			ExpectObfuscated(t, h.Network.SentFrom(h.ServerAddr))
+			ExpectWireGuard(t, h.Network.SentTo(h.InitiatorAddr))
+			ExpectMessages(t, h.Network.SentTo(h.InitiatorAddr), device.MessageResponseType,
+				device.MessageTransportType, device.MessageTransportType, device.MessageTransportType, device.MessageTransportType)
+		})
+	}
+}
+
+func TestHarness_ZeroMAC2(t *testing.T) {
+	for _, mode := range []string{mwgp.ObfuscateModeXOR, mwgp.ObfuscateModeAuthenticated} {
+		t.Run(mode, func(t *testing.T) {
+			h := New(t, Options{ObfuscateMode: mode})
+			h.Handshake(t, 0x11223344)
+
+			// the all-zero MAC2 is dropped on the obfuscated segment, and restored on the both ends
+			ExpectZeroMAC2(t, h.Network.SentTo(h.ResponderAddr))
+			ExpectZeroMAC2(t, h.Network.SentTo(h.InitiatorAddr))
+		})
+	}
+}
+
+func TestHarness_IndexTranslation(t *testing.T) {
+	h := New(t, Options{})
+	another := h.NewInitiator(t)
+
+	// both initiators choose the same sender index
+	const sender = 0x00000001
+	receiver := h.Handshake(t, sender)
+	anotherReceiver, err := another.Handshake(h.ClientAddr, sender, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiations := h.Network.SentTo(h.ResponderAddr)
+	if len(initiations) != 2 {
+		t.Fatalf("expected 2 MessageInitiation to the responder, got %d", len(initiations))
+	}
+	if Sender(initiations[0].Data) == Sender(initiations[1].Data) {
+		t.Errorf("conflicted sender index %08x is not translated", sender)
+	}
+
+	// each initiator receives its own MessageTransport with the original index
+	for _, c := range []struct {
+		initiator *Initiator
+		receiver  uint32
+	}{
+		{h.Initiator, receiver},
+		{another, anotherReceiver},
+	} {
+		content := make([]byte, 32)
+		copy(content, c.initiator.LocalAddr().String())
+		err = c.initiator.SendTransport(h.ClientAddr, c.receiver, 0, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := c.initiator.Recv(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Receiver(d.Data) != sender || !bytes.Equal(d.Data[device.MessageTransportHeaderSize:], content) {
+			t.Errorf("%s received a MessageTransport to %08x of another initiator", c.initiator.LocalAddr(), Receiver(d.Data))
+		}
+	}
+
+	// the reserved bytes (including the packet[1] used as the flags by the obfuscator)
+	// never leak out of the obfuscated segment
+	for _, d := range append(h.Network.SentTo(h.ResponderAddr), h.Network.SentFrom(h.ClientAddr)...) {
+		if d.Data[1] != 0 || d.Data[2] != 0 || d.Data[3] != 0 {
+			t.Errorf("%s => %s: reserved bytes %x are not zero", d.Src, d.Dst, d.Data[1:4])
+		}
+	}
+}
+
+func TestHarness_TimeoutEviction(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	h := New(t, Options{Timeout: timeout})
+	receiver := h.Handshake(t, 0x11223344)
+	if _, err := h.Echo(receiver, 0, make([]byte, 16), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Server.Stats().ActiveSessions != 0 || h.Client.Stats().ActiveSessions != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the session is not expired after %s", timeout)
+		}
+		time.Sleep(timeout / 4)
+	}
+	if stats := h.Server.Stats(); stats.SessionsExpired != 1 {
+		t.Errorf("expected 1 session expired on the server, got %d", stats.SessionsExpired)
+	}
+
+	received := len(h.Responder.Received())
+	_, err := h.Echo(receiver, 1, make([]byte, 16), 3*timeout)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected no echo after the session expired, got %v", err)
+	}
+	if n := len(h.Responder.Received()); n != received {
+		t.Errorf("%d packets of the expired session are forwarded to the responder", n-received)
+	}
+
+	// a new handshake creates a new session
+	receiver = h.Handshake(t, 0x55667788)
+	if _, err := h.Echo(receiver, 0, make([]byte, 16), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHarness_Stop(t *testing.T) {
+	var network *Network
+	t.Run("harness", func(t *testing.T) {
+		h := New(t, Options{})
+		h.Handshake(t, 0x11223344)
+		network = h.Network
+	})
+	if n := network.OpenSockets(); n != 0 {
+		t.Errorf("%d sockets are not closed after the cleanup", n)
+	}
+}
+
+func TestHarness_Preflight(t *testing.T) {
+	for _, mode := range []string{mwgp.ObfuscateModeXOR, mwgp.ObfuscateModeAuthenticated} {
+		t.Run(mode, func(t *testing.T) {
+			logs := &LogRecorder{}
+			h := New(t, Options{
+				ObfuscateMode:   mode,
+				ConfigureServer: func(config *mwgp.ServerConfig) { config.Preflight = true },
+				ConfigureClient: func(config *mwgp.ClientConfig) { config.Preflight = true },
+				ClientLogger:    logs,
+			})
+			receiver := h.Handshake(t, 0x11223344)
+			if _, err := h.Echo(receiver, 0, make([]byte, 16), 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if logs.Find("preflight to server "+h.ServerAddr.String()+" passed") == "" {
+				t.Errorf("preflight is not passed, logs: %v", logs.Lines())
+			}
+
+			// the preflight request and reply go before the handshake, and they are obfuscated as well
+			ExpectObfuscated(t, h.Network.SentTo(h.ServerAddr))
+			ExpectObfuscated(t, h.Network.SentFrom(h.ServerAddr))
+			if n := len(h.Network.SentTo(h.ServerAddr)); n != 3 {
+				t.Errorf("expected a preflight request, a MessageInitiation and a MessageTransport to the server, got %d datagrams", n)
+			}
+
+			// the result is cached for the next handshakes
+			h.Network.ResetCaptured()
+			h.Handshake(t, 0x55667788)
+			if n := len(h.Network.SentTo(h.ServerAddr)); n != 1 {
+				t.Errorf("expected only the MessageInitiation to the server, got %d datagrams", n)
+			}
+		})
+	}
+}
+
+func TestHarness_PreflightMismatch(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		configureClient func(config *mwgp.ClientConfig)
+		expected        string
+	}{
+		{
+			name:            "key",
+			configureClient: func(config *mwgp.ClientConfig) { config.ObfuscateKey = "wrong key" },
+			expected:        "key fingerprint mismatch",
+		},
+		{
+			name:            "mode",
+			configureClient: func(config *mwgp.ClientConfig) { config.ObfuscateMode = mwgp.ObfuscateModeAuthenticated },
+			expected:        "obfs_mode mismatch: server xor, client authenticated",
+		},
+		{
+			name:            "disabled",
+			configureClient: func(config *mwgp.ClientConfig) { config.ObfuscateKey = "" },
+			expected:        "obfs_mode mismatch: server xor, client disabled",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			logs := &LogRecorder{}
+			h := New(t, Options{
+				ConfigureServer: func(config *mwgp.ServerConfig) { config.Preflight = true },
+				ConfigureClient: func(config *mwgp.ClientConfig) {
+					config.Preflight = true
+					c.configureClient(config)
+				},
+				ClientLogger: logs,
+			})
+			_, err := h.Initiator.Handshake(h.ClientAddr, 0x11223344, time.Second)
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatalf("expected the handshake to be dropped, got %v", err)
+			}
+			if n := len(h.Responder.Received()); n != 0 {
+				t.Errorf("%d packets are forwarded to the responder", n)
+			}
+			if logs.Find("[error] preflight to server") == "" || logs.Find(c.expected) == "" {
+				t.Errorf("expected an error with %q, logs: %v", c.expected, logs.Lines())
+			}
+		})
+	}
+}
+
+func TestHarness_PreflightNoReply(t *testing.T) {
+	logs := &LogRecorder{}
+	h := New(t, Options{
+		ConfigureClient: func(config *mwgp.ClientConfig) { config.Preflight = true },
+		ClientLogger:    logs,
+	})
+
+	// the server without preflight drops the requests, the handshake is forwarded after the timeout
+	receiver, err := h.Initiator.Handshake(h.ClientAddr, 0x11223344, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Echo(receiver, 0, make([]byte, 16), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Find("[warn] preflight to server") == "" {
+		t.Errorf("expected a warning of no preflight reply, logs: %v", logs.Lines())
+	}
+}
+
+func TestHarness_Failover(t *testing.T) {
+	standbyAddr := netip.AddrPortFrom(HostIP, kServerPort+2)
+	h := New(t, Options{
+		ConfigureServer: func(config *mwgp.ServerConfig) { config.Preflight = true },
+		ConfigureClient: func(config *mwgp.ClientConfig) {
+			config.Servers = []mwgp.ClientConfigServer{
+				{Address: standbyAddr.String(), Priority: 1},
+				{Address: config.Server},
+			}
+			config.Server = ""
+			config.FailoverWindow = mwgp.Duration(500 * time.Millisecond)
+			config.FailoverProbeInterval = mwgp.Duration(200 * time.Millisecond)
+		},
+	})
+	h.StartServer(t, standbyAddr.Port())
+	receiver := h.Handshake(t, 0x11223344)
+	if _, err := h.Echo(receiver, 0, make([]byte, 16), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectActiveServer(t, h, h.ServerAddr, 0)
+
+	// the packets to the stopped primary are not replied, the client fails over to the standby,
+	// the content is longer than a keepalive, which is not expected to be replied
+	_ = h.Server.Stop()
+	_, _ = h.Echo(receiver, 1, make([]byte, 64), 100*time.Millisecond)
+	expectActiveServer(t, h, standbyAddr, 1)
+	handshakeThrough(t, h, standbyAddr)
+
+	// and switches back once the primary is recovered
+	h.Server = h.StartServer(t, kServerPort)
+	expectActiveServer(t, h, h.ServerAddr, 2)
+	handshakeThrough(t, h, h.ServerAddr)
+}
+
+// expectActiveServer waits for the client to switch to the server.
+func expectActiveServer(t *testing.T, h *Harness, addr netip.AddrPort, failovers uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := h.Client.Stats()
+		for _, es := range stats.ServerEndpoints {
+			if es.Active && es.Address == addr.String() && stats.ServerFailovers == failovers {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected server %s to be active after %d failovers, got %+v after %d failovers",
+				addr, failovers, stats.ServerEndpoints, stats.ServerFailovers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// handshakeThrough completes a handshake and an echo through the server,
+// the sessions are switched to the server shortly after it becomes active.
+func handshakeThrough(t *testing.T, h *Harness, addr netip.AddrPort) {
+	t.Helper()
+	for sender := uint32(0x55667788); ; sender++ {
+		h.Network.ResetCaptured()
+		receiver := h.Handshake(t, sender)
+		if len(h.Network.SentTo(addr)) > 0 {
+			if _, err := h.Echo(receiver, 0, make([]byte, 16), 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		if sender-0x55667788 > 10 {
+			t.Fatalf("handshakes are not forwarded to server %s", addr)
+		}
+	}
+}
+
+func TestHarness_RoamingHandshake(t *testing.T) {
+	h := New(t, Options{})
+	const sender = 0x11223344
+	receiver := h.Handshake(t, sender)
+	if _, err := h.Echo(receiver, 0, make([]byte, 32), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	upstream := h.Responder.Received()[0].Src
+
+	// the client roams, and starts a new handshake from the new address
+	roamed := h.NewInitiator(t)
+	if _, err := roamed.Handshake(h.ClientAddr, 0x55667788, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server still sends with the previous session, which follows the client to the new address
+	content := bytes.Repeat([]byte{0x5a}, 32)
+	if err := h.Responder.Send(newMessageTransport(sender, 1, content), upstream); err != nil {
+		t.Fatal(err)
+	}
+	d, err := roamed.Recv(5 * time.Second)
+	if err != nil {
+		t.Fatalf("the previous session is not roamed: %s", err.Error())
+	}
+	if Receiver(d.Data) != sender || !bytes.Equal(d.Data[device.MessageTransportHeaderSize:], content) {
+		t.Errorf("expected a MessageTransport to %08x, got type %d to %08x", sender, MessageType(d.Data), Receiver(d.Data))
+	}
+	if _, err = h.Initiator.Recv(100 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected nothing to the old address, got %v", err)
+	}
+	if stats := h.Client.Stats(); stats.ActiveSessions != 2 {
+		t.Errorf("expected both sessions to be kept, got %d", stats.ActiveSessions)
+	}
+}
+
+func TestHarness_DrainForward(t *testing.T) {
+	nextHopAddr := netip.AddrPortFrom(HostIP, kServerPort+2)
+	h := New(t, Options{
+		ConfigureServer: func(config *mwgp.ServerConfig) { config.DrainForward = nextHopAddr.String() },
+	})
+	nextHop := h.StartServer(t, nextHopAddr.Port())
+	h.Server.Drain()
+
+	// the new client is relayed to the next hop
+	receiver := h.Handshake(t, 0x11223344)
+	content := bytes.Repeat([]byte{0x5a}, 32)
+	echoed, err := h.Echo(receiver, 0, content, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, content) {
+		t.Fatal("content mismatch")
+	}
+	if len(h.Network.SentTo(nextHopAddr)) == 0 {
+		t.Errorf("expected the packets relayed to the next hop")
+	}
+
+	stats := h.Server.Stats()
+	if !stats.Draining || stats.ActiveSessions != 0 || stats.HandshakesDrained == 0 || stats.DrainSessions != 1 {
+		t.Errorf("expected the session relayed by the draining server, got %+v", stats)
+	}
+	if stats := nextHop.Stats(); stats.TotalSessionsCreated != 1 {
+		t.Errorf("expected the session created on the next hop, got %d", stats.TotalSessionsCreated)
+	}
+}
+
+func TestHarness_NATKeepalive(t *testing.T) {
+	h := New(t, Options{
+		ConfigureClient: func(config *mwgp.ClientConfig) { config.NATKeepalive = mwgp.Duration(100 * time.Millisecond) },
+	})
+	receiver := h.Handshake(t, 0x11223344)
+	if _, err := h.Echo(receiver, 0, make([]byte, 32), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Server.Stats().NATKeepalivesReceived < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the NAT keepalives received by the server, got %+v", h.Server.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := h.Client.Stats().NATKeepalivesSent; sent < 3 {
+		t.Errorf("expected the NAT keepalives sent by the client, got %d", sent)
+	}
+
+	// obfuscated on the wire, and never forwarded to the WireGuard server
+	ExpectObfuscated(t, h.Network.SentTo(h.ServerAddr))
+	ExpectMessages(t, h.Network.SentTo(h.ResponderAddr), device.MessageInitiationType, device.MessageTransportType)
+}
@@ -0,0 +1,44 @@
+package testharness
+
+import (
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"strings"
+	"sync"
+)
+
+// LogRecorder is a mwgp.Logger recording every message, for the assertions on the logs.
+type LogRecorder struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+var _ mwgp.Logger = (*LogRecorder)(nil)
+
+func (r *LogRecorder) record(level, format string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf("[%s] %s", level, fmt.Sprintf(format, args...)))
+}
+
+func (r *LogRecorder) Debugf(format string, args ...interface{}) { r.record("debug", format, args...) }
+func (r *LogRecorder) Infof(format string, args ...interface{})  { r.record("info", format, args...) }
+func (r *LogRecorder) Warnf(format string, args ...interface{})  { r.record("warn", format, args...) }
+func (r *LogRecorder) Errorf(format string, args ...interface{}) { r.record("error", format, args...) }
+
+// Lines returns the recorded messages prefixed with their levels, such as "[warn] ...".
+func (r *LogRecorder) Lines() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// Find returns the first recorded message containing the substr, or an empty string if there is none.
+func (r *LogRecorder) Find(substr string) string {
+	for _, line := range r.Lines() {
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+	return ""
+}
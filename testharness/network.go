@@ -0,0 +1,253 @@
+// Package testharness runs the mwgp client and server with fake WireGuard endpoints
+// on an in-memory network, and captures every datagram on the wire for the assertions.
+//
+// No real socket is opened, so the tests built on it are fast and can run in parallel.
+package testharness
+
+import (
+	"errors"
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// HostIP is the only host of the Network, the addresses with other IPs are unreachable.
+var HostIP = netip.MustParseAddr("192.0.2.1")
+
+const (
+	kFirstEphemeralPort = 20000
+	kSocketQueueSize    = 256
+)
+
+// ErrTimeout is returned by Socket.Recv if no datagram is received in time.
+var ErrTimeout = errors.New("timeout")
+
+// Datagram is a datagram captured on the Network.
+type Datagram struct {
+	Src  netip.AddrPort
+	Dst  netip.AddrPort
+	Data []byte
+
+	// Dropped is set if nobody is listening on the Dst, or its queue is full.
+	Dropped bool
+}
+
+// Network is an in-memory UDP network, it is the mwgp.PacketTransportFactory of the mwgp client and server.
+type Network struct {
+	lock     sync.Mutex
+	nextPort uint16
+	sockets  map[uint16]*Socket
+	captured []Datagram
+}
+
+var _ mwgp.PacketTransportFactory = (*Network)(nil)
+
+func NewNetwork() *Network {
+	return &Network{
+		nextPort: kFirstEphemeralPort,
+		sockets:  make(map[uint16]*Socket),
+	}
+}
+
+// Listen opens a socket on the port, or on a free one if the port is 0.
+func (n *Network) Listen(port uint16) (s *Socket, err error) {
+	s, err = n.bind(port, netip.AddrPort{})
+	return
+}
+
+// bind opens a socket receiving only the datagrams from the remote if it is valid.
+func (n *Network) bind(port uint16, remote netip.AddrPort) (s *Socket, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if port == 0 {
+		for n.sockets[n.nextPort] != nil {
+			n.nextPort++
+		}
+		port = n.nextPort
+		n.nextPort++
+	}
+	if n.sockets[port] != nil {
+		err = fmt.Errorf("port %d is in use", port)
+		return
+	}
+	s = &Socket{
+		network: n,
+		local:   netip.AddrPortFrom(HostIP, port),
+		remote:  remote,
+		queue:   make(chan Datagram, kSocketQueueSize),
+		closed:  make(chan struct{}),
+	}
+	n.sockets[port] = s
+	return
+}
+
+func (n *Network) deliver(src, dst netip.AddrPort, b []byte) {
+	d := Datagram{
+		Src:  src,
+		Dst:  dst,
+		Data: append([]byte(nil), b...),
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s := n.sockets[dst.Port()]
+	if s == nil || dst.Addr() != HostIP || (s.remote.IsValid() && s.remote != src) {
+		d.Dropped = true
+	} else {
+		select {
+		case s.queue <- d:
+		default:
+			d.Dropped = true
+		}
+	}
+	n.captured = append(n.captured, d)
+}
+
+// Captured returns the captured datagrams matched by the match func, in the order they are sent.
+// All of them are returned if the match func is nil.
+func (n *Network) Captured(match func(d Datagram) bool) (datagrams []Datagram) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, d := range n.captured {
+		if match == nil || match(d) {
+			datagrams = append(datagrams, d)
+		}
+	}
+	return
+}
+
+// SentTo returns the captured datagrams sent to the dst.
+func (n *Network) SentTo(dst netip.AddrPort) []Datagram {
+	return n.Captured(func(d Datagram) bool {
+		return d.Dst == dst
+	})
+}
+
+// SentFrom returns the captured datagrams sent from the src.
+func (n *Network) SentFrom(src netip.AddrPort) []Datagram {
+	return n.Captured(func(d Datagram) bool {
+		return d.Src == src
+	})
+}
+
+// ResetCaptured discards the captured datagrams.
+func (n *Network) ResetCaptured() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.captured = nil
+}
+
+func (n *Network) isListening(port uint16) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.sockets[port] != nil
+}
+
+// OpenSockets returns the number of sockets not yet closed.
+func (n *Network) OpenSockets() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.sockets)
+}
+
+func (n *Network) ListenPacket(addr *net.UDPAddr, workers int) (transports []mwgp.PacketTransport, err error) {
+	s, err := n.Listen(uint16(addr.Port))
+	if err != nil {
+		return
+	}
+	transports = []mwgp.PacketTransport{s}
+	return
+}
+
+func (n *Network) DialPacket(raddr *net.UDPAddr) (transport mwgp.PacketTransport, err error) {
+	remote := raddr.AddrPort()
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	s, err := n.bind(0, remote)
+	if err != nil {
+		return
+	}
+	transport = s
+	return
+}
+
+// Socket is a UDP socket on the Network, it implements the mwgp.PacketTransport.
+type Socket struct {
+	network   *Network
+	local     netip.AddrPort
+	remote    netip.AddrPort
+	queue     chan Datagram
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// LocalAddr returns the address the socket is bound to.
+func (s *Socket) LocalAddr() netip.AddrPort {
+	return s.local
+}
+
+// Send sends the b to the dst, or to the remote if the socket is dialed.
+func (s *Socket) Send(b []byte, dst netip.AddrPort) (err error) {
+	select {
+	case <-s.closed:
+		err = net.ErrClosed
+		return
+	default:
+	}
+	if s.remote.IsValid() {
+		dst = s.remote
+	}
+	s.network.deliver(s.local, dst, b)
+	return
+}
+
+// Recv returns the next datagram received, it returns ErrTimeout if the timeout is positive and expired.
+func (s *Socket) Recv(timeout time.Duration) (d Datagram, err error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case d = <-s.queue:
+	case <-s.closed:
+		err = net.ErrClosed
+	case <-expired:
+		err = ErrTimeout
+	}
+	return
+}
+
+func (s *Socket) ReadPacket(packet *mwgp.Packet) (addr *net.UDPAddr, err error) {
+	d, err := s.Recv(0)
+	if err != nil {
+		return
+	}
+	packet.Length = copy(packet.Data, d.Data)
+	addr = net.UDPAddrFromAddrPort(d.Src)
+	return
+}
+
+func (s *Socket) WritePacket(packet *mwgp.Packet, addr *net.UDPAddr) (err error) {
+	var dst netip.AddrPort
+	if addr != nil {
+		dst = addr.AddrPort()
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	}
+	err = s.Send(packet.Slice(), dst)
+	return
+}
+
+func (s *Socket) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.network.lock.Lock()
+		if s.network.sockets[s.local.Port()] == s {
+			delete(s.network.sockets, s.local.Port())
+		}
+		s.network.lock.Unlock()
+	})
+	return
+}
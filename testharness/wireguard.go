@@ -0,0 +1,302 @@
+package testharness
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/haruue-net/mwgp"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tai64n"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// GenerateKey returns a new WireGuard key pair.
+func GenerateKey() (sk mwgp.NoisePrivateKey, pk mwgp.NoisePublicKey, err error) {
+	_, err = rand.Read(sk.NoisePrivateKey[:])
+	if err != nil {
+		return
+	}
+	sk.NoisePrivateKey[0] &= 248
+	sk.NoisePrivateKey[31] = (sk.NoisePrivateKey[31] & 127) | 64
+	pk = sk.PublicKey()
+	return
+}
+
+func mixHash(dst, h *[blake2s.Size]byte, data []byte) {
+	hash, _ := blake2s.New256(nil)
+	hash.Write(h[:])
+	hash.Write(data)
+	hash.Sum(dst[:0])
+}
+
+func marshalMessage(msg interface{}) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, msg)
+	return buf.Bytes()
+}
+
+// newMessageTransport returns a MessageTransport with the content as the encrypted payload,
+// the content is not really encrypted since mwgp never decrypts it.
+func newMessageTransport(receiver uint32, counter uint64, content []byte) (b []byte) {
+	b = make([]byte, device.MessageTransportHeaderSize, device.MessageTransportHeaderSize+len(content))
+	binary.LittleEndian.PutUint32(b[0:4], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(b[4:8], receiver)
+	binary.LittleEndian.PutUint64(b[8:16], counter)
+	b = append(b, content...)
+	return
+}
+
+// Initiator is a fake WireGuard client.
+//
+// It creates the MessageInitiation with the real Noise handshake, so that the mwgp server
+// can decrypt the public key of it, but it never completes the handshake.
+type Initiator struct {
+	*Socket
+	privateKey mwgp.NoisePrivateKey
+	publicKey  mwgp.NoisePublicKey
+	peerPK     mwgp.NoisePublicKey
+}
+
+func NewInitiator(socket *Socket, privateKey mwgp.NoisePrivateKey, peerPK mwgp.NoisePublicKey) *Initiator {
+	return &Initiator{
+		Socket:     socket,
+		privateKey: privateKey,
+		publicKey:  privateKey.PublicKey(),
+		peerPK:     peerPK,
+	}
+}
+
+// NewMessageInitiation returns a well-formed MessageInitiation with the MAC1 set and the MAC2 zero.
+func (i *Initiator) NewMessageInitiation(sender uint32) (b []byte, err error) {
+	var (
+		hash     [blake2s.Size]byte
+		chainKey [blake2s.Size]byte
+		key      [chacha20poly1305.KeySize]byte
+	)
+	ephemeral, _, err := GenerateKey()
+	if err != nil {
+		return
+	}
+	msg := device.MessageInitiation{
+		Type:   device.MessageInitiationType,
+		Sender: sender,
+	}
+	curve25519.ScalarBaseMult((*[32]byte)(&msg.Ephemeral), (*[32]byte)(&ephemeral.NoisePrivateKey))
+
+	// most implementation here is copied from device.Device.CreateMessageInitiation().
+	mixHash(&hash, &device.InitialHash, i.peerPK.NoisePublicKey[:])
+	device.KDF1(&chainKey, device.InitialChainKey[:], msg.Ephemeral[:])
+	mixHash(&hash, &hash, msg.Ephemeral[:])
+
+	ss := ephemeral.SharedSecret(i.peerPK.NoisePublicKey)
+	device.KDF2(&chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	aead.Seal(msg.Static[:0], device.ZeroNonce[:], i.publicKey.NoisePublicKey[:], hash[:])
+	mixHash(&hash, &hash, msg.Static[:])
+
+	ss = i.privateKey.SharedSecret(i.peerPK.NoisePublicKey)
+	device.KDF2(&chainKey, &key, chainKey[:], ss[:])
+	timestamp := tai64n.Now()
+	aead, _ = chacha20poly1305.New(key[:])
+	aead.Seal(msg.Timestamp[:0], device.ZeroNonce[:], timestamp[:], hash[:])
+
+	b = marshalMessage(&msg)
+	var cg device.CookieGenerator
+	cg.Init(i.peerPK.NoisePublicKey)
+	cg.AddMacs(b)
+	return
+}
+
+// SendInitiation sends a MessageInitiation with the sender index to the dst.
+func (i *Initiator) SendInitiation(dst netip.AddrPort, sender uint32) (err error) {
+	b, err := i.NewMessageInitiation(sender)
+	if err != nil {
+		return
+	}
+	err = i.Send(b, dst)
+	return
+}
+
+// SendTransport sends a MessageTransport to the dst.
+func (i *Initiator) SendTransport(dst netip.AddrPort, receiver uint32, counter uint64, content []byte) (err error) {
+	err = i.Send(newMessageTransport(receiver, counter, content), dst)
+	return
+}
+
+// Handshake sends a MessageInitiation to the dst, and returns the sender index of the MessageResponse.
+func (i *Initiator) Handshake(dst netip.AddrPort, sender uint32, timeout time.Duration) (receiver uint32, err error) {
+	err = i.SendInitiation(dst, sender)
+	if err != nil {
+		return
+	}
+	d, err := i.Recv(timeout)
+	if err != nil {
+		err = fmt.Errorf("failed to receive MessageResponse: %w", err)
+		return
+	}
+	if MessageType(d.Data) != device.MessageResponseType || len(d.Data) != device.MessageResponseSize {
+		err = fmt.Errorf("expected MessageResponse, got message type %d with length %d", MessageType(d.Data), len(d.Data))
+		return
+	}
+	if r := Receiver(d.Data); r != sender {
+		err = fmt.Errorf("expected MessageResponse to %08x, got %08x", sender, r)
+		return
+	}
+	receiver = Sender(d.Data)
+	return
+}
+
+// Responder is a fake WireGuard server.
+//
+// It answers the MessageInitiation from the known peers with a well-formed MessageResponse,
+// and echoes the MessageTransport back to the initiator.
+// The MessageResponse is not a valid Noise handshake, as mwgp never validates it.
+type Responder struct {
+	*Socket
+	privateKey mwgp.NoisePrivateKey
+	publicKey  mwgp.NoisePublicKey
+
+	lock     sync.Mutex
+	peers    map[mwgp.NoisePublicKey]struct{}
+	sessions map[uint32]uint32 // responder index -> initiator index
+	received []Datagram
+	done     chan struct{}
+}
+
+func NewResponder(socket *Socket, privateKey mwgp.NoisePrivateKey, peers ...mwgp.NoisePublicKey) (r *Responder) {
+	r = &Responder{
+		Socket:     socket,
+		privateKey: privateKey,
+		publicKey:  privateKey.PublicKey(),
+		peers:      make(map[mwgp.NoisePublicKey]struct{}),
+		sessions:   make(map[uint32]uint32),
+		done:       make(chan struct{}),
+	}
+	for _, pk := range peers {
+		r.peers[pk] = struct{}{}
+	}
+	return
+}
+
+// Serve handles the datagrams until the socket is closed.
+func (r *Responder) Serve() {
+	defer close(r.done)
+	for {
+		d, err := r.Recv(0)
+		if err != nil {
+			return
+		}
+		r.lock.Lock()
+		r.received = append(r.received, d)
+		r.lock.Unlock()
+		r.handle(d)
+	}
+}
+
+// Close closes the socket and waits for the Serve() to return.
+func (r *Responder) Close() (err error) {
+	err = r.Socket.Close()
+	<-r.done
+	return
+}
+
+// Received returns the datagrams received by the responder.
+func (r *Responder) Received() (datagrams []Datagram) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	datagrams = append(datagrams, r.received...)
+	return
+}
+
+func (r *Responder) handle(d Datagram) {
+	switch {
+	case MessageType(d.Data) == device.MessageInitiationType && len(d.Data) == device.MessageInitiationSize:
+		var msg device.MessageInitiation
+		_ = binary.Read(bytes.NewReader(d.Data), binary.LittleEndian, &msg)
+		initiatorPK, ok := r.consumeMessageInitiation(&msg)
+		if !ok {
+			return
+		}
+		response, err := r.newMessageResponse(msg.Sender, initiatorPK)
+		if err != nil {
+			return
+		}
+		_ = r.Send(response, d.Src)
+	case MessageType(d.Data) == device.MessageTransportType && len(d.Data) >= device.MessageTransportSize:
+		r.lock.Lock()
+		initiatorIndex, ok := r.sessions[Receiver(d.Data)]
+		r.lock.Unlock()
+		if !ok {
+			return
+		}
+		counter := binary.LittleEndian.Uint64(d.Data[8:16])
+		_ = r.Send(newMessageTransport(initiatorIndex, counter, d.Data[device.MessageTransportHeaderSize:]), d.Src)
+	}
+}
+
+// consumeMessageInitiation validates the MAC1 and returns the public key of the initiator.
+func (r *Responder) consumeMessageInitiation(msg *device.MessageInitiation) (initiatorPK mwgp.NoisePublicKey, ok bool) {
+	var checker device.CookieChecker
+	checker.Init(r.publicKey.NoisePublicKey)
+	if !checker.CheckMAC1(marshalMessage(msg)) {
+		return
+	}
+
+	// most implementation here is copied from device.Device.ConsumeMessageInitiation().
+	var (
+		hash     [blake2s.Size]byte
+		chainKey [blake2s.Size]byte
+		key      [chacha20poly1305.KeySize]byte
+	)
+	mixHash(&hash, &device.InitialHash, r.publicKey.NoisePublicKey[:])
+	mixHash(&hash, &hash, msg.Ephemeral[:])
+	device.KDF1(&chainKey, device.InitialChainKey[:], msg.Ephemeral[:])
+	ss := r.privateKey.SharedSecret(msg.Ephemeral)
+	device.KDF2(&chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err := aead.Open(initiatorPK.NoisePublicKey[:0], device.ZeroNonce[:], msg.Static[:], hash[:])
+	if err != nil {
+		return
+	}
+	_, ok = r.peers[initiatorPK]
+	return
+}
+
+func (r *Responder) newMessageResponse(receiver uint32, initiatorPK mwgp.NoisePublicKey) (b []byte, err error) {
+	msg := device.MessageResponse{
+		Type:     device.MessageResponseType,
+		Receiver: receiver,
+	}
+	_, err = rand.Read(msg.Ephemeral[:])
+	if err != nil {
+		return
+	}
+	_, err = rand.Read(msg.Empty[:])
+	if err != nil {
+		return
+	}
+
+	r.lock.Lock()
+	for {
+		var index [4]byte
+		_, _ = rand.Read(index[:])
+		msg.Sender = binary.LittleEndian.Uint32(index[:])
+		if _, ok := r.sessions[msg.Sender]; !ok && msg.Sender != 0 {
+			break
+		}
+	}
+	r.sessions[msg.Sender] = receiver
+	r.lock.Unlock()
+
+	b = marshalMessage(&msg)
+	var cg device.CookieGenerator
+	cg.Init(initiatorPK.NoisePublicKey)
+	cg.AddMacs(b)
+	return
+}
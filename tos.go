@@ -0,0 +1,98 @@
+package mwgp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+// ToS Preservation:
+//
+// WireGuard copies the ECN bits (and the DSCP) of the inner packets to the outer UDP datagrams, and back, so that
+// the ECN-aware congestion control (such as L4S) works through the tunnel. Since mwgp writes each packet it forwards
+// as a new datagram, the TOS (or the traffic class of IPv6) of the datagram is lost, and replaced with the dscp
+// option (or 0) of the socket.
+//
+// With the PreserveTOS (the preserve_tos), the TOS of each datagram is carried over the relay:
+//
+//   - IP_RECVTOS and IPV6_RECVTCLASS are set on the UDP sockets of the table, and each datagram is read with its
+//     TOS in the ancillary data (ReadMsgUDP, or recvmmsg with the batch_size).
+//   - The packet forwarded for it is written with the same value in the ancillary data (WriteMsgUDP, or sendmmsg),
+//     as the IP_TOS for an IPv4 destination, or the IPV6_TCLASS for an IPv6 one, whichever the received one was.
+//   - The packets generated by mwgp (such as the NAT keepalive) and the ones read from the other transports
+//     have no TOS, and are written with the one of the socket as before.
+//
+// It costs the ancillary data of every read and write, and the UDP offload is not used with it, since the segments
+// of a GRO or GSO datagram are not read or written with their own TOS.
+
+// kTOSControlSize is the size of the buffer of the ancillary data of the TOS, for any of IP_TOS and IPV6_TCLASS.
+const kTOSControlSize = 64
+
+// validatePreserveTOS checks the preserve_tos option, which cannot be used with the udp_offload.
+func validatePreserveTOS(preserveTOS, udpOffload bool) (err error) {
+	if !preserveTOS {
+		return
+	}
+	if !tosPreservationSupported {
+		err = fmt.Errorf("option \"preserve_tos\" is not supported on %s", runtime.GOOS)
+		return
+	}
+	if udpOffload {
+		err = fmt.Errorf("option \"udp_offload\" cannot be used with \"preserve_tos\", the offloaded packets are not read or written with their tos")
+		return
+	}
+	return
+}
+
+// enableTOSPreservation sets the UDP sockets of the transports to receive the TOS of the packets,
+// and makes them read and write the packets with the TOS, see "ToS Preservation".
+// It must be called before the transports are read or written, the other transports are ignored.
+func (t *WireGuardIndexTranslationTable) enableTOSPreservation(transports ...PacketTransport) {
+	if !t.PreserveTOS {
+		return
+	}
+	for _, transport := range transports {
+		var conn *net.UDPConn
+		var preserveTOS *bool
+		switch tt := transport.(type) {
+		case *UDPTransport:
+			conn, preserveTOS = tt.conn, &tt.preserveTOS
+		case *portHopTransport:
+			conn, preserveTOS = tt.conn, &tt.preserveTOS
+		default:
+			continue
+		}
+		if conn == nil {
+			continue
+		}
+		err := setRecvTOS(conn)
+		if err != nil {
+			t.sockoptWarnOnce[3].Do(func() {
+				t.Logger.Warnf("failed to receive the tos on %s socket, not preserved: %s", conn.LocalAddr().String(), err.Error())
+			})
+			continue
+		}
+		*preserveTOS = true
+	}
+}
+
+// readMsgUDPWithTOS reads a packet from the conn with its TOS, see "ToS Preservation".
+func readMsgUDPWithTOS(conn *net.UDPConn, packet *Packet) (source netip.AddrPort, err error) {
+	var oob [kTOSControlSize]byte
+	var oobn int
+	packet.Length, oobn, _, source, err = conn.ReadMsgUDPAddrPort(packet.readBuffer(), oob[:])
+	if err != nil {
+		return
+	}
+	packet.tos, packet.hasTOS = parseTOSControl(oob[:oobn])
+	return
+}
+
+// writeMsgUDPWithTOS writes the packet to the dst with its TOS, the dst is invalid for a connected conn,
+// and the raddr is the destination to decide the IP_TOS or the IPV6_TCLASS, see "ToS Preservation".
+func writeMsgUDPWithTOS(conn *net.UDPConn, packet *Packet, dst netip.AddrPort, raddr netip.Addr) (err error) {
+	var oob [kTOSControlSize]byte
+	_, _, err = conn.WriteMsgUDPAddrPort(packet.Slice(), putTOSControl(oob[:], packet.tos, raddr.Unmap().Is4()), dst)
+	return
+}
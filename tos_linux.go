@@ -0,0 +1,75 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"unsafe"
+)
+
+const tosPreservationSupported = true
+
+// setRecvTOS sets the IP_RECVTOS, and the IPV6_RECVTCLASS for IPv6 sockets.
+// A dual-stack socket receives IPv4 packets with the IP_TOS, so both are set on it.
+func setRecvTOS(conn *net.UDPConn) (err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	inet6 := isInet6Conn(conn)
+	cerr := rc.Control(func(fd uintptr) {
+		if !inet6 {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+			return
+		}
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+		if err != nil {
+			return
+		}
+		// fails on an IPV6_V6ONLY socket
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+// parseTOSControl returns the IP_TOS or the IPV6_TCLASS in the control messages of a received packet.
+func parseTOSControl(oob []byte) (tos byte, ok bool) {
+	for len(oob) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		if h.Len < unix.SizeofCmsghdr || int(h.Len) > len(oob) {
+			return
+		}
+		data := oob[unix.CmsgLen(0):h.Len]
+		switch {
+		case h.Level == unix.IPPROTO_IP && h.Type == unix.IP_TOS && len(data) >= 1:
+			return data[0], true
+		case h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_TCLASS && len(data) >= 4:
+			return byte(*(*int32)(unsafe.Pointer(&data[0]))), true
+		}
+		space := unix.CmsgSpace(int(h.Len) - unix.CmsgLen(0))
+		if space >= len(oob) {
+			return
+		}
+		oob = oob[space:]
+	}
+	return
+}
+
+// putTOSControl writes the control message setting the TOS of the packet to the oob and returns it,
+// the IP_TOS for an IPv4 destination, or the IPV6_TCLASS otherwise.
+func putTOSControl(oob []byte, tos byte, ipv4 bool) []byte {
+	oob = oob[:unix.CmsgSpace(4)]
+	for i := range oob {
+		oob[i] = 0
+	}
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	if ipv4 {
+		h.Level, h.Type = unix.IPPROTO_IP, unix.IP_TOS
+	}
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = int32(tos)
+	return oob
+}
@@ -0,0 +1,130 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTOSPreservation(t *testing.T, network string, loopback net.IP, batch bool) {
+	const tos = 0xb9 // DSCP 46 with ECT(1)
+
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = &testLogger{}
+	table.PreserveTOS = true
+
+	listen := func() *UDPTransport {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: loopback})
+		if err != nil {
+			t.Skipf("%s is not available: %s", network, err.Error())
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return NewUDPTransport(conn)
+	}
+	relay, receiver := listen(), listen()
+	table.enableTOSPreservation(relay, receiver)
+	if !relay.preserveTOS || !receiver.preserveTOS {
+		t.Fatal("expected the tos preserved on the transports")
+	}
+
+	sender := listen()
+	rc, err := sender.conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		if loopback.To4() != nil {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		} else {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		}
+	})
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 3
+	for i := 0; i < count; i++ {
+		if _, err = sender.conn.WriteToUDP([]byte("tos"), relay.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the relay forwards the packets with the tos they are received with
+	packets := newBatchTestPackets(count)
+	if batch {
+		n, rerr := 0, error(nil)
+		for read := 0; read < count; read += n {
+			n, rerr = readBatchFromUDP(relay, packets[read:])
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+		}
+		for _, packet := range packets {
+			packet.Destination = receiver.conn.LocalAddr().(*net.UDPAddr)
+		}
+		if failed, werr := writeBatchToUDP(relay, packets); werr != nil {
+			t.Fatalf("%d packets failed: %s", failed, werr.Error())
+		}
+	} else {
+		for _, packet := range packets {
+			if _, err = relay.ReadPacket(packet); err != nil {
+				t.Fatal(err)
+			}
+			if err = relay.WritePacket(packet, receiver.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, packet := range packets {
+		if !packet.hasTOS || packet.tos != tos {
+			t.Errorf("packet %d: expected read with tos %#x, got %#x (%v)", i, tos, packet.tos, packet.hasTOS)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		packet := newBatchTestPackets(1)[0]
+		if _, err = receiver.ReadPacket(packet); err != nil {
+			t.Fatal(err)
+		}
+		if string(packet.Slice()) != "tos" {
+			t.Errorf("packet %d: unexpected payload %q", i, packet.Slice())
+		}
+		if !packet.hasTOS || packet.tos != tos {
+			t.Errorf("packet %d: expected forwarded with tos %#x, got %#x (%v)", i, tos, packet.tos, packet.hasTOS)
+		}
+	}
+}
+
+func TestUDPTransport_PreserveTOS(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		suffix := ""
+		if batch {
+			suffix = "-batch"
+		}
+		t.Run("udp4"+suffix, func(t *testing.T) {
+			testTOSPreservation(t, "udp4", net.IPv4(127, 0, 0, 1), batch)
+		})
+		t.Run("udp6"+suffix, func(t *testing.T) {
+			testTOSPreservation(t, "udp6", net.IPv6loopback, batch)
+		})
+	}
+}
+
+func TestValidatePreserveTOS(t *testing.T) {
+	if err := validatePreserveTOS(false, true); err != nil {
+		t.Error(err)
+	}
+	if err := validatePreserveTOS(true, false); err != nil {
+		t.Error(err)
+	}
+	err := validatePreserveTOS(true, true)
+	if err == nil || !strings.Contains(err.Error(), "udp_offload") {
+		t.Errorf("expected udp_offload rejected, got %v", err)
+	}
+}
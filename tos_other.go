@@ -0,0 +1,24 @@
+//go:build !linux
+
+package mwgp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+const tosPreservationSupported = false
+
+func setRecvTOS(conn *net.UDPConn) (err error) {
+	err = fmt.Errorf("IP_RECVTOS is not supported on %s", runtime.GOOS)
+	return
+}
+
+func parseTOSControl(oob []byte) (tos byte, ok bool) {
+	return
+}
+
+func putTOSControl(oob []byte, tos byte, ipv4 bool) []byte {
+	return nil
+}
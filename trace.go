@@ -0,0 +1,129 @@
+package mwgp
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"sync/atomic"
+	"time"
+)
+
+// Packet Trace:
+//
+// With Trace, a line is logged for each WireGuard packet forwarded for a peer, with the direction, the message type,
+// the sender and receiver indexes as forwarded, the length as read and the length as written (so the obfuscation and
+// the padding show up as the difference), whether it was deobfuscated or obfuscated, and the session ID of the peer.
+// The payload is never logged. It is a lighter-weight alternative to the "Packet Capture" for confirming that
+// the handshakes reach the other side and come back.
+//
+// The lines are rate-limited with a token bucket for the handshakes and another for the transport packets,
+// so that a bulk transfer does not hide the handshakes. The record is taken when the packet is forwarded, before
+// the obfuscation overwrites its header, and logged once it is written. Without Trace, it costs an atomic load
+// per forwarded packet and a branch per written one, and nothing is formatted or allocated.
+
+// packetTraceRecord is what is logged of a packet, kept in the packet from the forwarding to the writing.
+type packetTraceRecord struct {
+	// peer is nil if the packet is not traced.
+	peer        *Peer
+	messageType int
+	sender      uint32
+	receiver    uint32
+	hasSender   bool
+	hasReceiver bool
+	// receivedLength is the length as read, before deobfuscation.
+	receivedLength int
+	deobfuscated   bool
+	// suppressed is the number of the lines suppressed before this one.
+	suppressed int
+}
+
+// SetTrace enables or disables the "Packet Trace", it can be called at any time.
+func (t *WireGuardIndexTranslationTable) SetTrace(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&t.trace, v)
+}
+
+func (t *WireGuardIndexTranslationTable) tracing() bool {
+	return atomic.LoadInt32(&t.trace) != 0
+}
+
+// traceForwarded takes the record of the packet forwarded for the peer if it is traced and not rate-limited,
+// it must be called after the indexes are translated.
+func (t *WireGuardIndexTranslationTable) traceForwarded(peer *Peer, packet *Packet) {
+	if !t.tracing() {
+		return
+	}
+	limiter := &t.traceLimiters[0]
+	if packet.IsHandshake() {
+		limiter = &t.traceLimiters[1]
+	}
+	allowed, suppressed := limiter.allow(time.Now())
+	if !allowed {
+		return
+	}
+	record := packetTraceRecord{
+		peer:           peer,
+		messageType:    packet.MessageType(),
+		receivedLength: packet.receivedLength,
+		deobfuscated:   packet.Flags&PacketFlagDeobfuscatedAfterReceived != 0,
+		suppressed:     suppressed,
+	}
+	var err error
+	record.sender, err = packet.SenderIndex()
+	record.hasSender = err == nil
+	record.receiver, err = packet.ReceiverIndex()
+	record.hasReceiver = err == nil
+	packet.trace = record
+}
+
+// traceWritten logs the record of the packet just written, the packet retained by the write func is not logged
+// since it is no longer ours.
+func (t *WireGuardIndexTranslationTable) traceWritten(packet *Packet, s2c bool) {
+	record := &packet.trace
+	if record.peer == nil || packet.Flags&PacketFlagRetained != 0 {
+		return
+	}
+	direction := "client_to_server"
+	if s2c {
+		direction = "server_to_client"
+	}
+	obfs := "none"
+	if record.deobfuscated {
+		obfs = "deobfuscated"
+	} else if packet.Flags&PacketFlagObfuscateBeforeSend != 0 {
+		obfs = "obfuscated"
+	}
+	format := "trace: %s %s sender=%s receiver=%s length=%d->%d obfs=%s session=%s"
+	args := []interface{}{direction, messageTypeName(record.messageType),
+		formatTraceIndex(record.sender, record.hasSender), formatTraceIndex(record.receiver, record.hasReceiver),
+		record.receivedLength, packet.Length, obfs, record.peer.sessionID}
+	if record.suppressed > 0 {
+		format += " (%d similar messages suppressed)"
+		args = append(args, record.suppressed)
+	}
+	t.peerLogger(record.peer).Infof(format, args...)
+}
+
+func formatTraceIndex(index uint32, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return fmt.Sprintf("0x%08x", index)
+}
+
+// messageTypeName returns the name of the WireGuard message type in the logs.
+func messageTypeName(messageType int) string {
+	switch messageType {
+	case device.MessageInitiationType:
+		return "initiation"
+	case device.MessageResponseType:
+		return "response"
+	case device.MessageCookieReplyType:
+		return "cookie_reply"
+	case device.MessageTransportType:
+		return "transport"
+	}
+	return "unknown"
+}
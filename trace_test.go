@@ -0,0 +1,109 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"strings"
+	"testing"
+)
+
+func newTraceTestPacket(messageType int, length int) *Packet {
+	packet := newBatchTestPackets(1)[0]
+	packet.Data[0] = byte(messageType)
+	packet.Length = length
+	return packet
+}
+
+func TestPacketTrace(t *testing.T) {
+	logger := &testLogger{}
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = logger
+	peer := &Peer{sessionID: "1a2b3c4d"}
+
+	// disabled
+	packet := newTraceTestPacket(device.MessageInitiationType, device.MessageInitiationSize)
+	table.traceForwarded(peer, packet)
+	table.traceWritten(packet, false)
+	if len(logger.lines) != 0 {
+		t.Fatalf("expected nothing logged without the trace, got %q", logger.lines)
+	}
+
+	table.SetTrace(true)
+	packet.receivedLength = device.MessageInitiationSize + 37
+	packet.Flags |= PacketFlagDeobfuscatedAfterReceived
+	binary.LittleEndian.PutUint32(packet.Data[4:], 0x1e5f705b)
+	table.traceForwarded(peer, packet)
+	// the obfuscation overwrites the header, and the padding is removed
+	packet.Data[4] = 0xff
+	packet.Length = device.MessageInitiationSize + 8
+	table.traceWritten(packet, false)
+	expected := "[info] trace: client_to_server initiation sender=0x1e5f705b receiver=- length=185->156 obfs=deobfuscated session=1a2b3c4d"
+	if len(logger.lines) != 1 || logger.lines[0] != expected {
+		t.Fatalf("expected %q, got %q", expected, logger.lines)
+	}
+
+	logger.lines = nil
+	packet = newTraceTestPacket(device.MessageTransportType, 96)
+	packet.receivedLength = 96
+	packet.Flags |= PacketFlagObfuscateBeforeSend
+	binary.LittleEndian.PutUint32(packet.Data[4:], 0xb6e7a8be)
+	table.traceForwarded(peer, packet)
+	packet.Length = 120
+	table.traceWritten(packet, true)
+	expected = "[info] trace: server_to_client transport sender=- receiver=0xb6e7a8be length=96->120 obfs=obfuscated session=1a2b3c4d"
+	if len(logger.lines) != 1 || logger.lines[0] != expected {
+		t.Fatalf("expected %q, got %q", expected, logger.lines)
+	}
+
+	// a retained packet is no longer ours
+	logger.lines = nil
+	table.traceForwarded(peer, packet)
+	packet.Flags |= PacketFlagRetained
+	table.traceWritten(packet, true)
+	if len(logger.lines) != 0 {
+		t.Errorf("expected the retained packet not logged, got %q", logger.lines)
+	}
+
+	// a packet not forwarded for a peer is not logged
+	table.traceWritten(newTraceTestPacket(device.MessageTransportType, 32), true)
+	if len(logger.lines) != 0 {
+		t.Errorf("expected the packet without a record not logged, got %q", logger.lines)
+	}
+}
+
+func TestPacketTraceRateLimit(t *testing.T) {
+	logger := &testLogger{}
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = logger
+	table.SetTrace(true)
+	peer := &Peer{sessionID: "1a2b3c4d"}
+
+	for i := 0; i < kPacketLogBurst*3; i++ {
+		packet := newTraceTestPacket(device.MessageTransportType, 32)
+		table.traceForwarded(peer, packet)
+		table.traceWritten(packet, false)
+	}
+	if len(logger.lines) != kPacketLogBurst {
+		t.Fatalf("expected %d lines of the transport packets, got %d", kPacketLogBurst, len(logger.lines))
+	}
+	// the handshakes are not hidden by the transport packets
+	packet := newTraceTestPacket(device.MessageResponseType, device.MessageResponseSize)
+	table.traceForwarded(peer, packet)
+	table.traceWritten(packet, true)
+	if len(logger.lines) != kPacketLogBurst+1 || !strings.Contains(logger.lines[kPacketLogBurst], " response ") {
+		t.Errorf("expected the response logged, got %q", logger.lines[kPacketLogBurst:])
+	}
+}
+
+func TestPacketTraceDisabledAllocs(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	peer := &Peer{sessionID: "1a2b3c4d"}
+	packet := newTraceTestPacket(device.MessageTransportType, 32)
+	allocs := testing.AllocsPerRun(100, func() {
+		table.traceForwarded(peer, packet)
+		table.traceWritten(packet, false)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocation without the trace, got %v", allocs)
+	}
+}
@@ -0,0 +1,241 @@
+package mwgp
+
+import (
+	"net"
+	"net/netip"
+)
+
+// PacketTransport is the substrate the packets are read from and written to.
+//
+// The UDPTransport is the default one, other implementations (a userspace UDP stack,
+// a TUN-captured socket, an in-memory pipe in tests) can be plugged in with a PacketTransportFactory.
+type PacketTransport interface {
+	// ReadPacket reads a packet into the packet.Data, sets the packet.Length,
+	// and returns the source address. A packet larger than the packet.Data should be read up to its capacity,
+	// or with the packet.Length set beyond its length otherwise, so that it is dropped as oversized.
+	ReadPacket(packet *Packet) (addr *net.UDPAddr, err error)
+
+	// WritePacket writes the packet.Slice() to the addr.
+	// A transport returned by PacketTransportFactory.DialPacket ignores the addr.
+	WritePacket(packet *Packet, addr *net.UDPAddr) (err error)
+
+	Close() (err error)
+}
+
+// PacketTransportFactory creates the transports of the forward table.
+type PacketTransportFactory interface {
+	// ListenPacket returns the transports receiving the packets from the clients on the addr,
+	// the workers is the ClientListenWorkers and might be ignored.
+	ListenPacket(addr *net.UDPAddr, workers int) (transports []PacketTransport, err error)
+
+	// DialPacket returns a transport sending the packets to the raddr,
+	// only the packets from the raddr should be read from it.
+	DialPacket(raddr *net.UDPAddr) (transport PacketTransport, err error)
+}
+
+// UDPTransport is the PacketTransport over a *net.UDPConn.
+type UDPTransport struct {
+	conn *net.UDPConn
+
+	// connected is set for the dialed sockets, which are written without the address.
+	connected bool
+
+	// offload is the GSO/GRO enabled on the socket, see "UDP Offload".
+	offload *udpOffload
+
+	// preserveTOS reads and writes the packets with their TOS, see "ToS Preservation".
+	preserveTOS bool
+}
+
+func NewUDPTransport(conn *net.UDPConn) *UDPTransport {
+	return &UDPTransport{
+		conn:      conn,
+		connected: conn != nil && conn.RemoteAddr() != nil,
+	}
+}
+
+// Conn returns the underlying socket.
+func (u *UDPTransport) Conn() *net.UDPConn {
+	return u.conn
+}
+
+// ReadPacket returns the packet.Source, which points to the storage inside the packet.
+func (u *UDPTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	var source netip.AddrPort
+	if u.preserveTOS {
+		source, err = readMsgUDPWithTOS(u.conn, packet)
+	} else {
+		packet.Length, source, err = u.conn.ReadFromUDPAddrPort(packet.readBuffer())
+	}
+	if err != nil {
+		return
+	}
+	packet.setSourceAddrPort(source)
+	addr = packet.Source
+	return
+}
+
+func (u *UDPTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	if u.preserveTOS && packet.hasTOS {
+		if u.connected {
+			err = writeMsgUDPWithTOS(u.conn, packet, netip.AddrPort{}, u.conn.RemoteAddr().(*net.UDPAddr).AddrPort().Addr())
+		} else {
+			dst := addr.AddrPort()
+			err = writeMsgUDPWithTOS(u.conn, packet, dst, dst.Addr())
+		}
+		return
+	}
+	if u.connected {
+		_, err = u.conn.Write(packet.Slice())
+		return
+	}
+	_, err = u.conn.WriteToUDPAddrPort(packet.Slice(), addr.AddrPort())
+	return
+}
+
+func (u *UDPTransport) Close() (err error) {
+	return u.conn.Close()
+}
+
+func defaultReadFunc(transport PacketTransport, packet *Packet) (err error) {
+	packet.Source, err = transport.ReadPacket(packet)
+	return
+}
+
+func defaultWriteFunc(transport PacketTransport, packet *Packet) (err error) {
+	err = transport.WritePacket(packet, packet.Destination)
+	return
+}
+
+// defaultReadBatchFunc reads up to len(packets) packets from the UDPTransport with readBatchFromUDP(),
+// or reads only one packet at a time from other transports.
+func defaultReadBatchFunc(transport PacketTransport, packets []*Packet) (n int, err error) {
+	if u, ok := transport.(*UDPTransport); ok {
+		n, err = readBatchFromUDP(u, packets)
+		return
+	}
+	err = defaultReadFunc(transport, packets[0])
+	if err != nil {
+		return
+	}
+	n = 1
+	return
+}
+
+// defaultWriteBatchFunc writes the packets to the UDPTransport with writeBatchToUDP(),
+// or writes the packets one by one to other transports.
+//
+// A packet failed to be sent is skipped, failed is the number of such packets
+// and err is the last error.
+func defaultWriteBatchFunc(transport PacketTransport, packets []*Packet) (failed int, err error) {
+	if u, ok := transport.(*UDPTransport); ok {
+		failed, err = writeBatchToUDP(u, packets)
+		return
+	}
+	for _, packet := range packets {
+		werr := defaultWriteFunc(transport, packet)
+		if werr != nil {
+			packet.writeFailed = true
+			failed++
+			err = werr
+		}
+	}
+	return
+}
+
+// listenPacket returns the listeners of the transports facing the clients, UDP sockets if no TransportFactory,
+// one for the ClientListen and each of the ClientListenExtra.
+// With the ClientListenPortMax, the transports of every port in the range are returned.
+// With the ClientListenSystemd, the sockets passed by systemd are returned instead, see listenSystemd.
+func (t *WireGuardIndexTranslationTable) listenPacket() (listeners []*clientListener, err error) {
+	if t.ClientListenSystemd {
+		var transports []PacketTransport
+		transports, err = t.listenSystemd()
+		if err != nil {
+			return
+		}
+		listeners = []*clientListener{{address: t.clientListenString(), transports: transports}}
+		return
+	}
+	for _, r := range t.clientListenRanges() {
+		var transports []PacketTransport
+		transports, err = t.listenPacketRange(r)
+		if err != nil {
+			for _, listener := range listeners {
+				for _, transport := range listener.transports {
+					_ = transport.Close()
+				}
+			}
+			listeners = nil
+			return
+		}
+		listeners = append(listeners, &clientListener{address: r.String(), transports: transports})
+	}
+	return
+}
+
+func (t *WireGuardIndexTranslationTable) listenPacketRange(r ListenRange) (transports []PacketTransport, err error) {
+	portMax := r.PortMax
+	if portMax < r.Addr.Port {
+		portMax = r.Addr.Port
+	}
+	for port := r.Addr.Port; port <= portMax; port++ {
+		addr := *r.Addr
+		addr.Port = port
+		var ts []PacketTransport
+		ts, err = t.listenPacketOn(&addr)
+		if err != nil {
+			for _, transport := range transports {
+				_ = transport.Close()
+			}
+			transports = nil
+			return
+		}
+		transports = append(transports, ts...)
+	}
+	return
+}
+
+func (t *WireGuardIndexTranslationTable) listenPacketOn(addr *net.UDPAddr) (transports []PacketTransport, err error) {
+	if t.TransportFactory != nil {
+		transports, err = t.TransportFactory.ListenPacket(addr, t.ClientListenWorkers)
+		return
+	}
+	transports = t.listenSystemdOn(addr)
+	if len(transports) > 0 {
+		return
+	}
+	conns, err := listenUDPWorkers(addr, t.ClientListenWorkers, t.socketControl())
+	if err != nil {
+		return
+	}
+	for _, conn := range conns {
+		t.setSocketBuffers(conn, "client")
+		transports = append(transports, NewUDPTransport(conn))
+	}
+	return
+}
+
+// dialServer returns the transport to the server destination, with the DialServerFunc if set.
+func (t *WireGuardIndexTranslationTable) dialServer(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+	if t.DialServerFunc != nil {
+		transport, err = t.DialServerFunc(raddr)
+		return
+	}
+	transport, err = t.dialPacket(raddr)
+	return
+}
+
+// dialPacket returns the transport to the server destination or the fallback, a UDP socket if no TransportFactory.
+func (t *WireGuardIndexTranslationTable) dialPacket(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+	if t.TransportFactory != nil {
+		transport, err = t.TransportFactory.DialPacket(raddr)
+		return
+	}
+	conn, err := t.dialUDP(raddr)
+	if err != nil {
+		return
+	}
+	transport = NewUDPTransport(conn)
+	return
+}
@@ -0,0 +1,303 @@
+package mwgp
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/conn"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNetwork is an in-memory UDP network with a single host memNetworkIP,
+// it is the PacketTransportFactory of mwgp and the conn.Bind of WireGuard in the tests.
+type memNetwork struct {
+	lock     sync.Mutex
+	nextPort uint16
+	ports    map[uint16]*memTransport
+}
+
+var memNetworkIP = netip.MustParseAddr("192.0.2.1")
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		nextPort: 20000,
+		ports:    make(map[uint16]*memTransport),
+	}
+}
+
+type memDatagram struct {
+	data []byte
+	src  netip.AddrPort
+}
+
+// bind opens a transport on the port, or a free one if port is 0.
+// The transport only receives the datagrams from the remote if it is valid.
+func (n *memNetwork) bind(port uint16, remote netip.AddrPort) (t *memTransport, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if port == 0 {
+		for n.ports[n.nextPort] != nil {
+			n.nextPort++
+		}
+		port = n.nextPort
+	}
+	if n.ports[port] != nil {
+		err = fmt.Errorf("port %d is in use", port)
+		return
+	}
+	t = &memTransport{
+		network: n,
+		local:   netip.AddrPortFrom(memNetworkIP, port),
+		remote:  remote,
+		inbox:   make(chan memDatagram, 256),
+		closed:  make(chan struct{}),
+	}
+	n.ports[port] = t
+	return
+}
+
+func (n *memNetwork) deliver(src, dst netip.AddrPort, b []byte) {
+	n.lock.Lock()
+	t := n.ports[dst.Port()]
+	n.lock.Unlock()
+	if t == nil || dst.Addr() != memNetworkIP || (t.remote.IsValid() && t.remote != src) {
+		return
+	}
+	d := memDatagram{data: append([]byte(nil), b...), src: src}
+	select {
+	case t.inbox <- d:
+	default:
+		// dropped like a full socket buffer
+	}
+}
+
+func (n *memNetwork) ListenPacket(addr *net.UDPAddr, workers int) (transports []PacketTransport, err error) {
+	t, err := n.bind(uint16(addr.Port), netip.AddrPort{})
+	if err != nil {
+		return
+	}
+	transports = []PacketTransport{t}
+	return
+}
+
+func (n *memNetwork) DialPacket(raddr *net.UDPAddr) (transport PacketTransport, err error) {
+	t, err := n.bind(0, upstreamKey(raddr))
+	if err != nil {
+		return
+	}
+	transport = t
+	return
+}
+
+type memTransport struct {
+	network   *memNetwork
+	local     netip.AddrPort
+	remote    netip.AddrPort
+	inbox     chan memDatagram
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (t *memTransport) recv(b []byte) (n int, src netip.AddrPort, err error) {
+	select {
+	case d := <-t.inbox:
+		n = copy(b, d.data)
+		src = d.src
+	case <-t.closed:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (t *memTransport) send(b []byte, dst netip.AddrPort) (err error) {
+	select {
+	case <-t.closed:
+		err = net.ErrClosed
+		return
+	default:
+	}
+	if t.remote.IsValid() {
+		dst = t.remote
+	}
+	t.network.deliver(t.local, dst, b)
+	return
+}
+
+func (t *memTransport) ReadPacket(packet *Packet) (addr *net.UDPAddr, err error) {
+	var src netip.AddrPort
+	packet.Length, src, err = t.recv(packet.Data)
+	if err != nil {
+		return
+	}
+	addr = net.UDPAddrFromAddrPort(src)
+	return
+}
+
+func (t *memTransport) WritePacket(packet *Packet, addr *net.UDPAddr) (err error) {
+	var dst netip.AddrPort
+	if addr != nil {
+		dst = upstreamKey(addr)
+	}
+	err = t.send(packet.Slice(), dst)
+	return
+}
+
+func (t *memTransport) Close() (err error) {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.network.lock.Lock()
+		if t.network.ports[t.local.Port()] == t {
+			delete(t.network.ports, t.local.Port())
+		}
+		t.network.lock.Unlock()
+	})
+	return
+}
+
+// memBind is the conn.Bind of a WireGuard device on the memNetwork.
+type memBind struct {
+	network   *memNetwork
+	lock      sync.Mutex
+	transport *memTransport
+}
+
+type memEndpoint netip.AddrPort
+
+func (e memEndpoint) ClearSrc()           {}
+func (e memEndpoint) SrcToString() string { return "" }
+func (e memEndpoint) DstToString() string { return netip.AddrPort(e).String() }
+func (e memEndpoint) DstToBytes() []byte  { b, _ := netip.AddrPort(e).MarshalBinary(); return b }
+func (e memEndpoint) DstIP() netip.Addr   { return netip.AddrPort(e).Addr() }
+func (e memEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+func (b *memBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
+	t, err := b.network.bind(port, netip.AddrPort{})
+	if err != nil {
+		return
+	}
+	b.lock.Lock()
+	b.transport = t
+	b.lock.Unlock()
+	fns = []conn.ReceiveFunc{func(buf []byte) (n int, ep conn.Endpoint, err error) {
+		n, src, err := t.recv(buf)
+		if err != nil {
+			return
+		}
+		ep = memEndpoint(src)
+		return
+	}}
+	actualPort = t.local.Port()
+	return
+}
+
+func (b *memBind) Close() (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.transport != nil {
+		err = b.transport.Close()
+		b.transport = nil
+	}
+	return
+}
+
+func (b *memBind) SetMark(mark uint32) (err error) {
+	return
+}
+
+func (b *memBind) Send(buf []byte, ep conn.Endpoint) (err error) {
+	b.lock.Lock()
+	t := b.transport
+	b.lock.Unlock()
+	if t == nil {
+		err = net.ErrClosed
+		return
+	}
+	err = t.send(buf, netip.AddrPort(ep.(memEndpoint)))
+	return
+}
+
+func (b *memBind) ParseEndpoint(s string) (ep conn.Endpoint, err error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return
+	}
+	ep = memEndpoint(addr)
+	return
+}
+
+func TestEndToEndInMemoryTransport(t *testing.T) {
+	network := newMemNetwork()
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDeviceWithBind(t, &memBind{network: network}, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerListen := netip.AddrPortFrom(memNetworkIP, 1000).String()
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{mwgpServerListen},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    memNetworkIP.String(),
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: "in-memory",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TransportFactory = network
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := netip.AddrPortFrom(memNetworkIP, 1001).String()
+	client, err := NewClientWithConfig(&ClientConfig{
+		Server:          mwgpServerListen,
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    "in-memory",
+		AllowedSources:  []string{memNetworkIP.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TransportFactory = network
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDeviceWithBind(t, &memBind{network: network}, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	if stats := server.Stats(); stats.ActiveSessions != 1 || stats.PacketsForwarded == 0 {
+		t.Errorf("unexpected server stats: %+v", stats)
+	}
+
+	_ = client.Stop()
+	_ = server.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		network.lock.Lock()
+		ports := len(network.ports)
+		network.lock.Unlock()
+		// only the WireGuard devices are left
+		if ports == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d transports are not closed after Stop()", ports-2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
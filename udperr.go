@@ -0,0 +1,48 @@
+package mwgp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// kReadErrorMaxConsecutive is the number of consecutive read errors
+	// before we consider the socket is broken.
+	kReadErrorMaxConsecutive = 32
+)
+
+var (
+	readErrorBackoffMin = 10 * time.Millisecond
+	readErrorBackoffMax = 1 * time.Second
+)
+
+type readErrorClass int
+
+const (
+	readErrorUnknown readErrorClass = iota
+
+	// readErrorTransient is expected to go away by itself,
+	// such as an ICMP port unreachable reported by a previous write.
+	readErrorTransient
+
+	// readErrorFatal means the socket cannot be read anymore.
+	readErrorFatal
+)
+
+func classifyReadError(err error) readErrorClass {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EBADF) {
+		return readErrorFatal
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || isUDPConnResetError(err) {
+		return readErrorTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() || netErr.Temporary() {
+			return readErrorTransient
+		}
+	}
+	return readErrorUnknown
+}
@@ -0,0 +1,57 @@
+package mwgp
+
+// UDP Offload:
+//
+// With UDPOffload (and BatchSize > 1) on Linux, the sockets facing the clients are read with UDP GRO, and the sockets
+// to the servers are written with UDP GSO, so that a burst of a tunnel at a few Gbps takes a few syscalls and a few
+// trips through the network stack instead of one per packet.
+//
+// GRO: the kernel coalesces the datagrams of the same flow and the same size into a super-datagram of up to 64KiB,
+// which is read into a large buffer of the socket and split into the packets of its segments, one by one in the
+// order received. The packets are then deobfuscated and handled the same as the ones read without GRO.
+//
+// GSO: the consecutive packets of a batch to the same destination and of the same length (the last one might be
+// shorter) are copied into a single datagram, which is sent with the UDP_SEGMENT of the length, and split by the
+// kernel (or the NIC). The WireGuard packets of a bulk transfer are all of the same length, but a random padding
+// of the obfuscation makes almost every packet of a different length, so mwgp-client does not enable GSO on the
+// sockets to mwgp-server with the max_random_tail of obfs_padding.
+//
+// Both are detected on each socket when it is opened, and silently not used if the kernel does not support them.
+// GSO is also turned off for the socket once the kernel refuses a datagram with it (such as the interface without
+// the checksum offload), and the packets are sent one by one again.
+//
+// Neither is used with the PreserveTOS, see "ToS Preservation".
+
+const (
+	// kUDPOffloadMaxSegments is the max number of the segments in a datagram of GSO, UDP_MAX_SEGMENTS of Linux.
+	kUDPOffloadMaxSegments = 64
+
+	// kUDPOffloadMaxSize is the max length of a datagram of GSO or GRO,
+	// which is the max UDP payload of IPv4 and IPv6 without the jumbograms.
+	kUDPOffloadMaxSize = 65535 - 8 - 40
+
+	// kUDPOffloadGROMessages is the number of the super-datagrams read with GRO in a single syscall.
+	kUDPOffloadGROMessages = 8
+)
+
+// enableClientUDPOffload enables GRO on the transports facing the clients if UDPOffload, see "UDP Offload".
+func (t *WireGuardIndexTranslationTable) enableClientUDPOffload(transports []PacketTransport) {
+	if !t.UDPOffload || t.PreserveTOS || normalizeBatchSize(t.BatchSize) <= 1 {
+		return
+	}
+	enabled := 0
+	for _, transport := range transports {
+		if enableUDPOffload(transport, false, true) {
+			enabled++
+		}
+	}
+	t.Logger.Debugf("udp offload: GRO enabled on %d of %d client sockets", enabled, len(transports))
+}
+
+// enableServerUDPOffload enables GSO on the transport to a server if UDPOffload, see "UDP Offload".
+func (t *WireGuardIndexTranslationTable) enableServerUDPOffload(transport PacketTransport) {
+	if !t.UDPOffload || t.PreserveTOS || t.serverGSODisabled || normalizeBatchSize(t.BatchSize) <= 1 {
+		return
+	}
+	enableUDPOffload(transport, true, false)
+}
@@ -0,0 +1,363 @@
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const udpOffloadSupported = true
+
+const (
+	// UDP_SEGMENT and UDP_GRO of linux/udp.h
+	kUDPSegment = 103
+	kUDPGRO     = 104
+
+	// kUDPOffloadControlSize is the buffer of a control message of UDP_SEGMENT or UDP_GRO.
+	kUDPOffloadControlSize = 32
+)
+
+// udpOffload is the UDP GSO/GRO state of a socket, see "UDP Offload".
+type udpOffload struct {
+	// gso is 1 if the datagrams are sent with GSO, accessed atomically since it is cleared once refused
+	gso int32
+
+	// gro is not nil if the socket is read with GRO, it is only used by the goroutine reading the socket
+	gro *groReader
+}
+
+func (o *udpOffload) gsoEnabled() bool {
+	return o != nil && atomic.LoadInt32(&o.gso) != 0
+}
+
+func (o *udpOffload) groEnabled() bool {
+	return o != nil && o.gro != nil
+}
+
+// enableUDPOffload enables the GSO and GRO supported by the kernel on the UDPTransport, it must be called
+// before the transport is read or written. It reports false if none of them is enabled.
+func enableUDPOffload(transport PacketTransport, gso, gro bool) (enabled bool) {
+	u, ok := transport.(*UDPTransport)
+	if !ok || u.conn == nil {
+		return
+	}
+	rc, err := u.conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var gsoSupported, groSupported bool
+	err = rc.Control(func(fd uintptr) {
+		if gso {
+			_, gerr := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, kUDPSegment)
+			gsoSupported = gerr == nil
+		}
+		if gro {
+			groSupported = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, kUDPGRO, 1) == nil
+		}
+	})
+	if err != nil || (!gsoSupported && !groSupported) {
+		return
+	}
+	o := &udpOffload{}
+	if gsoSupported {
+		o.gso = 1
+	}
+	if groSupported {
+		o.gro = newGROReader()
+	}
+	u.offload = o
+	enabled = true
+	return
+}
+
+// groReader reads the super-datagrams of GRO and splits them into the packets.
+type groReader struct {
+	buffers [kUDPOffloadGROMessages][]byte
+	hdrs    [kUDPOffloadGROMessages]mmsghdr
+	iovs    [kUDPOffloadGROMessages]unix.Iovec
+	names   [kUDPOffloadGROMessages]unix.RawSockaddrInet6
+	oobs    [kUDPOffloadGROMessages][kUDPOffloadControlSize]byte
+
+	// the number of the messages received, and the position of the next segment to return
+	received int
+	next     int
+	offset   int
+}
+
+func newGROReader() (r *groReader) {
+	r = &groReader{}
+	for i := range r.buffers {
+		r.buffers[i] = make([]byte, 1<<16)
+	}
+	return
+}
+
+// readBatchFromUDPWithGRO returns the segments not yet returned, or reads more super-datagrams if there is none.
+func readBatchFromUDPWithGRO(u *UDPTransport, packets []*Packet) (n int, err error) {
+	r := u.offload.gro
+	if r.next >= r.received {
+		err = r.receive(u.conn)
+		if err != nil {
+			return
+		}
+	}
+	n = r.split(packets)
+	return
+}
+
+func (r *groReader) receive(conn *net.UDPConn) (err error) {
+	r.received, r.next, r.offset = 0, 0, 0
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	for i := range r.hdrs {
+		r.iovs[i].Base = &r.buffers[i][0]
+		r.iovs[i].SetLen(len(r.buffers[i]))
+		r.hdrs[i] = mmsghdr{}
+		r.hdrs[i].Hdr.Iov = &r.iovs[i]
+		r.hdrs[i].Hdr.SetIovlen(1)
+		r.hdrs[i].Hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+		r.hdrs[i].Hdr.Namelen = unix.SizeofSockaddrInet6
+		r.hdrs[i].Hdr.Control = &r.oobs[i][0]
+		r.hdrs[i].Hdr.SetControllen(kUDPOffloadControlSize)
+	}
+
+	var serr error
+	var received int
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.hdrs[0])), uintptr(len(r.hdrs)), 0, 0, 0)
+		if e == unix.EAGAIN || e == unix.EINTR {
+			return false
+		}
+		if e != 0 {
+			serr = e
+		} else {
+			received = int(n)
+		}
+		return true
+	})
+	if err == nil && serr != nil {
+		err = &net.OpError{Op: "read", Net: "udp", Source: conn.LocalAddr(), Err: os.NewSyscallError("recvmmsg", serr)}
+	}
+	if err != nil {
+		return
+	}
+	r.received = received
+	return
+}
+
+// split copies the segments received into the packets, n is the number of the packets filled.
+func (r *groReader) split(packets []*Packet) (n int) {
+	for n < len(packets) && r.next < r.received {
+		hdr := &r.hdrs[r.next]
+		msg := r.buffers[r.next][:hdr.Len]
+		size := groSegmentSize(r.oobs[r.next][:hdr.Hdr.Controllen])
+		if size <= 0 || r.offset+size > len(msg) {
+			size = len(msg) - r.offset
+		}
+		packet := packets[n]
+		packet.Length = copy(packet.readBuffer(), msg[r.offset:r.offset+size])
+		packet.setSourceAddrPort(sockaddrToAddrPort(&r.names[r.next]))
+		n++
+		r.offset += size
+		if r.offset >= len(msg) {
+			r.next++
+			r.offset = 0
+		}
+	}
+	return
+}
+
+// groSegmentSize returns the size of the segments in the control messages, 0 if the datagram is not coalesced.
+func groSegmentSize(oob []byte) (size int) {
+	for len(oob) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		if h.Len < unix.SizeofCmsghdr || int(h.Len) > len(oob) {
+			return
+		}
+		if h.Level == unix.IPPROTO_UDP && h.Type == kUDPGRO && int(h.Len) >= unix.CmsgLen(4) {
+			size = int(*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])))
+			return
+		}
+		oob = oob[unix.CmsgSpace(int(h.Len)-unix.CmsgLen(0)):]
+	}
+	return
+}
+
+type gsoBuffer struct {
+	hdrs  [kMaxBatchSize]mmsghdr
+	iovs  [kMaxBatchSize]unix.Iovec
+	names [kMaxBatchSize]unix.RawSockaddrInet6
+	oobs  [kMaxBatchSize][kUDPOffloadControlSize]byte
+
+	// the packets of each message are packets[firsts[i]:firsts[i]+counts[i]]
+	firsts [kMaxBatchSize]int
+	counts [kMaxBatchSize]int
+
+	// data holds the datagrams of more than one segment
+	data []byte
+}
+
+var gsoBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &gsoBuffer{}
+	},
+}
+
+// release drops the references to the packets so that the buffer can be pooled.
+func (b *gsoBuffer) release(count int) {
+	for i := 0; i < count; i++ {
+		b.iovs[i] = unix.Iovec{}
+		b.hdrs[i] = mmsghdr{}
+	}
+}
+
+// sameUDPAddr reports whether a and b are the same destination.
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a == b || (a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone)
+}
+
+// writeBatchToUDPWithGSO writes the packets with sendmmsg(2), the consecutive packets of the same destination
+// and the same length are sent as a single datagram with GSO.
+//
+// A packet failed to be sent is skipped, failed is the number of such packets
+// and err is the last error, the same as writeBatchToUDP.
+func writeBatchToUDPWithGSO(u *UDPTransport, packets []*Packet) (failed int, err error) {
+	conn := u.conn
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		failed = len(packets)
+		return
+	}
+	b := gsoBufferPool.Get().(*gsoBuffer)
+	defer gsoBufferPool.Put(b)
+
+	total := 0
+	for _, packet := range packets {
+		total += packet.Length
+	}
+	if cap(b.data) < total {
+		b.data = make([]byte, 0, total)
+	}
+	// never grows beyond the capacity, so the messages can point into it
+	data := b.data[:0]
+
+	inet6 := isInet6Conn(conn)
+	connected := u.connected
+	messages := 0
+	defer func() {
+		b.release(messages)
+	}()
+	for i := 0; i < len(packets); {
+		packet := packets[i]
+		size := packet.Length
+		end, length := i+1, size
+		for size > 0 && end < len(packets) && end-i < kUDPOffloadMaxSegments && packets[end].Length <= size &&
+			length+packets[end].Length <= kUDPOffloadMaxSize && (connected || sameUDPAddr(packets[end].Destination, packet.Destination)) {
+			length += packets[end].Length
+			end++
+			if packets[end-1].Length < size {
+				// only the last segment might be shorter
+				break
+			}
+		}
+
+		hdr := &b.hdrs[messages]
+		*hdr = mmsghdr{}
+		if !connected {
+			namelen, aerr := udpAddrToSockaddr(packet.Destination, inet6, &b.names[messages])
+			if aerr != nil {
+				for _, segment := range packets[i:end] {
+					segment.writeFailed = true
+				}
+				failed += end - i
+				err = &net.OpError{Op: "write", Net: "udp", Source: conn.LocalAddr(), Addr: packet.Destination, Err: aerr}
+				i = end
+				continue
+			}
+			hdr.Hdr.Name = (*byte)(unsafe.Pointer(&b.names[messages]))
+			hdr.Hdr.Namelen = namelen
+		}
+		if end-i == 1 {
+			b.iovs[messages].Base = &packet.Data[0]
+			b.iovs[messages].SetLen(packet.Length)
+		} else {
+			start := len(data)
+			for _, segment := range packets[i:end] {
+				data = append(data, segment.Slice()...)
+			}
+			b.iovs[messages].Base = &data[start]
+			b.iovs[messages].SetLen(len(data) - start)
+			oob := b.oobs[messages][:unix.CmsgSpace(2)]
+			h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+			h.Level = unix.IPPROTO_UDP
+			h.Type = kUDPSegment
+			h.SetLen(unix.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(size)
+			hdr.Hdr.Control = &oob[0]
+			hdr.Hdr.SetControllen(len(oob))
+		}
+		hdr.Hdr.Iov = &b.iovs[messages]
+		hdr.Hdr.SetIovlen(1)
+		b.firsts[messages], b.counts[messages] = i, end-i
+		messages++
+		i = end
+	}
+
+	sent := 0
+	for sent < messages {
+		var serr error
+		werr := rc.Write(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&b.hdrs[sent])), uintptr(messages-sent), 0, 0, 0)
+			if e == unix.EAGAIN || e == unix.EINTR {
+				return false
+			}
+			if e != 0 {
+				serr = e
+			} else {
+				sent += int(r)
+			}
+			return true
+		})
+		if werr != nil {
+			// the socket is not usable anymore
+			for m := sent; m < messages; m++ {
+				for _, segment := range packets[b.firsts[m] : b.firsts[m]+b.counts[m]] {
+					segment.writeFailed = true
+				}
+				failed += b.counts[m]
+			}
+			err = werr
+			return
+		}
+		if serr == nil {
+			continue
+		}
+		if b.counts[sent] > 1 && (serr == unix.EIO || serr == unix.EINVAL) {
+			// GSO is refused, such as no checksum offload on the interface, send the rest one by one from now on
+			atomic.StoreInt32(&u.offload.gso, 0)
+			var rest []*Packet
+			for m := sent; m < messages; m++ {
+				rest = append(rest, packets[b.firsts[m]:b.firsts[m]+b.counts[m]]...)
+			}
+			rfailed, rerr := writeBatchToUDP(u, rest)
+			failed += rfailed
+			if rerr != nil {
+				err = rerr
+			}
+			return
+		}
+		// sendmmsg(2) reports the error of the first message not sent
+		for _, segment := range packets[b.firsts[sent] : b.firsts[sent]+b.counts[sent]] {
+			segment.writeFailed = true
+		}
+		failed += b.counts[sent]
+		err = &net.OpError{Op: "write", Net: "udp", Source: conn.LocalAddr(), Addr: packets[b.firsts[sent]].Destination, Err: os.NewSyscallError("sendmmsg", serr)}
+		sent++
+	}
+	return
+}
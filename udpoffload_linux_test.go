@@ -0,0 +1,99 @@
+package mwgp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPOffloadRoundTrip(t *testing.T) {
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	senderTransport, receiverTransport := NewUDPTransport(sender), NewUDPTransport(receiver)
+	if !enableUDPOffload(senderTransport, true, false) || !enableUDPOffload(receiverTransport, false, true) {
+		t.Skip("UDP GSO/GRO is not supported by the kernel")
+	}
+	if !senderTransport.offload.gsoEnabled() || senderTransport.offload.groEnabled() {
+		t.Fatal("expected only GSO on the sender")
+	}
+
+	// a run of 300 with a shorter one at last, a run of 200, and a single one
+	var lengths []int
+	for i := 0; i < 8; i++ {
+		lengths = append(lengths, 300)
+	}
+	lengths = append(lengths, 100)
+	for i := 0; i < 5; i++ {
+		lengths = append(lengths, 200)
+	}
+	lengths = append(lengths, 1000)
+
+	packets := newBatchTestPackets(len(lengths))
+	for i, packet := range packets {
+		packet.Length = lengths[i]
+		for j := range packet.Data[:packet.Length] {
+			packet.Data[j] = byte(i + j)
+		}
+		packet.Destination = receiver.LocalAddr().(*net.UDPAddr)
+	}
+	failed, err := defaultWriteBatchFunc(senderTransport, packets)
+	if err != nil || failed != 0 {
+		t.Fatalf("failed to write %d packets: %v", failed, err)
+	}
+
+	// read a few at a time, so that a super-datagram is split across the reads
+	_ = receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := newBatchTestPackets(len(lengths))
+	for total := 0; total < len(received); {
+		end := total + 3
+		if end > len(received) {
+			end = len(received)
+		}
+		n, err := defaultReadBatchFunc(receiverTransport, received[total:end])
+		if err != nil {
+			t.Fatalf("failed to read packets: %s", err.Error())
+		}
+		total += n
+	}
+	for i, packet := range received {
+		if !bytes.Equal(packet.Slice(), packets[i].Slice()) {
+			t.Errorf("packet #%d mismatched: got %d bytes, expected %d", i, packet.Length, packets[i].Length)
+		}
+		if packet.Source == nil || packet.Source.Port != sender.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("packet #%d has unexpected source %v", i, packet.Source)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_UDPOffloadDisabled(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	table := NewWireGuardIndexTranslationTable()
+	table.UDPOffload = true
+	table.BatchSize = 32
+	table.serverGSODisabled = true
+	transport := NewUDPTransport(conn)
+	table.enableServerUDPOffload(transport)
+	if transport.offload != nil {
+		t.Error("expected no GSO with serverGSODisabled")
+	}
+
+	table.UDPOffload = false
+	table.enableClientUDPOffload([]PacketTransport{transport})
+	if transport.offload != nil {
+		t.Error("expected no GRO without UDPOffload")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mwgp
+
+const udpOffloadSupported = false
+
+// udpOffload is the UDP GSO/GRO state of a socket, which is never enabled on this platform.
+type udpOffload struct{}
+
+// enableUDPOffload does nothing on this platform.
+func enableUDPOffload(transport PacketTransport, gso, gro bool) (enabled bool) {
+	return
+}
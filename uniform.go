@@ -0,0 +1,47 @@
+package mwgp
+
+import (
+	"crypto/rand"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Uniform Drop:
+//
+// With the UniformDrop of mwgp-server, every packet from a client that neither belongs to an established session
+// nor deobfuscates into a valid MessageInitiation is dropped the same way: nothing is sent back, relayed or forwarded
+// for it, and it costs about the same CPU time whichever check it failed, so that a prober can tell neither from
+// the responses nor from the timing how far the validation got.
+//
+//   - The plain WireGuard packets are dropped as with the obfs_strict, instead of being passed through.
+//   - The fallback_forward and the preflight, which respond to some of the packets, cannot be used with it.
+//   - The obfuscator tries every key (the obfs and the obfs_secondary) on each packet, instead of stopping
+//     at the first match.
+//   - The MessageInitiation is tried with the private key of every server, instead of stopping at the first match,
+//     which is the most of the cost of a handshake.
+//   - The packets dropped before that (too short or too long, not obfuscated with any key, plain WireGuard, replayed, or a message
+//     type never sent by clients) are tried the same way with a random decoy MessageInitiation generated
+//     with the table, which costs the same as a real one and never matches.
+//
+// The packets dropped by the source policies (the allowed_clients and denied_clients, the probe_ban and
+// the handshake_rate_limit) skip the decoy, so that they still shed the load cheaply. So does the MessageTransport
+// to an unknown session, which can only be made with the obfuscation key, so that it never stalls the main loop.
+// Since every invalid packet costs as much as a handshake, a flood of them costs as much CPU as a handshake flood,
+// the handshake_rate_limit and the probe_ban are recommended with it.
+
+// newUniformDecoyMessage returns the random MessageInitiation of the "Uniform Drop".
+func newUniformDecoyMessage() (msg device.MessageInitiation) {
+	msg.Type = device.MessageInitiationType
+	_, _ = rand.Read(msg.Ephemeral[:])
+	_, _ = rand.Read(msg.Static[:])
+	_, _ = rand.Read(msg.Timestamp[:])
+	return
+}
+
+// uniformDecoy does the work of validating a MessageInitiation for the packet from client dropped before that,
+// see "Uniform Drop".
+func (t *WireGuardIndexTranslationTable) uniformDecoy() {
+	if !t.UniformDrop || t.ExtractPeerFunc == nil {
+		return
+	}
+	_, _ = t.ExtractPeerFunc(&t.uniformDecoyMessage)
+}
@@ -0,0 +1,270 @@
+package mwgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServerConfig_ValidateUniformDrop(t *testing.T) {
+	sk, _ := e2eGenerateKey(t)
+	config := ServerConfig{
+		Listen:          ListenAddresses{"127.0.0.1:0"},
+		Servers:         []*ServerConfigServer{{PrivateKey: &sk, Peers: []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820"}}}},
+		UniformDrop:     true,
+		FallbackForward: "127.0.0.1:53",
+		Preflight:       true,
+	}
+	err := config.Validate()
+	var problems ConfigErrors
+	if !errors.As(err, &problems) || len(problems) != 3 {
+		t.Fatalf("expected 3 problems, got %v", err)
+	}
+	for _, expected := range []string{"uniform_drop requires obfs", "fallback_forward", "preflight"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected a problem of %q in %q", expected, err.Error())
+		}
+	}
+
+	config.ObfuscateKey = "long enough password"
+	config.FallbackForward = ""
+	config.Preflight = false
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWireGuardObfuscator_Uniform(t *testing.T) {
+	for _, authenticated := range []bool{false, true} {
+		var oldObfuscator, newObfuscator, rotatingObfuscator WireGuardObfuscator
+		oldObfuscator.Initialize("old")
+		newObfuscator.Initialize("new")
+		rotatingObfuscator.Initialize("new", "older", "old")
+		rotatingObfuscator.Uniform = true
+		for _, o := range []*WireGuardObfuscator{&oldObfuscator, &newObfuscator, &rotatingObfuscator} {
+			o.Authenticated = authenticated
+		}
+
+		for _, o := range []*WireGuardObfuscator{&oldObfuscator, &newObfuscator} {
+			p := Packet{Data: make([]byte, 1500)}
+			p.Data[0] = device.MessageInitiationType
+			p.Length = device.MessageInitiationSize
+			_, _ = rand.Read(p.Data[4:p.Length])
+			original := append([]byte(nil), p.Slice()...)
+			p.Flags |= PacketFlagObfuscateBeforeSend
+			o.Obfuscate(&p)
+			rotatingObfuscator.Deobfuscate(&p)
+			if p.Flags&PacketFlagDropped != 0 || !bytes.Equal(p.Slice(), original) {
+				t.Errorf("authenticated=%v: initiation is not deobfuscated with all the keys tried", authenticated)
+			}
+		}
+		if count := rotatingObfuscator.SecondaryKeyPacketCount(); count != 1 {
+			t.Errorf("authenticated=%v: expected 1 packet deobfuscated with secondary keys, got %d", authenticated, count)
+		}
+
+		p := Packet{Data: make([]byte, 1500), Length: device.MessageInitiationSize + 16}
+		_, _ = rand.Read(p.Data[:p.Length])
+		p.Data[0] = 0xff
+		rotatingObfuscator.Deobfuscate(&p)
+		if p.Flags&PacketFlagInvalid == 0 {
+			t.Errorf("authenticated=%v: expected the random packet dropped as invalid", authenticated)
+		}
+	}
+}
+
+func TestUniformDrop(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = &testLogger{}
+	var extracted []device.MessageInitiation
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (sp *ServerConfigPeer, err error) {
+		extracted = append(extracted, *msg)
+		err = errors.New("no match")
+		return
+	}
+	ch := make(chan *Packet, 4)
+	receive := func(flags uint64) {
+		packet := newBatchTestPackets(1)[0]
+		packet.Flags = flags
+		table.receivePacket("client", nil, packet, ch, nil)
+	}
+
+	// disabled
+	receive(PacketFlagDropped | PacketFlagInvalid)
+	if len(extracted) != 0 {
+		t.Fatalf("expected no decoy without UniformDrop, got %d", len(extracted))
+	}
+
+	table.UniformDrop = true
+	for _, flags := range []uint64{
+		PacketFlagDropped | PacketFlagInvalid | PacketFlagUnrecognized,
+		PacketFlagDropped | PacketFlagInvalid,
+		// plain WireGuard with obfs_strict, or replayed
+		PacketFlagDropped,
+	} {
+		receive(flags)
+	}
+	if len(extracted) != 3 {
+		t.Fatalf("expected a decoy for each dropped packet, got %d", len(extracted))
+	}
+	for _, msg := range extracted {
+		if msg != table.uniformDecoyMessage {
+			t.Errorf("expected the decoy message, got %+v", msg)
+		}
+	}
+
+	// the blocked and the valid packets are not decoyed
+	receive(PacketFlagDropped | PacketFlagBlocked)
+	receive(PacketFlagDeobfuscatedAfterReceived)
+	if len(extracted) != 3 {
+		t.Errorf("expected no decoy for the blocked and the valid packets, got %d", len(extracted)-3)
+	}
+	if len(ch) != 1 {
+		t.Errorf("expected the valid packet passed, got %d", len(ch))
+	}
+
+	// a message type never sent by clients
+	packet := newBatchTestPackets(1)[0]
+	packet.Data[0] = device.MessageResponseType
+	packet.Length = device.MessageResponseSize
+	packet.Source = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	table.handleClientPacket(packet)
+	if len(extracted) != 4 {
+		t.Errorf("expected a decoy for the MessageResponse from client, got %d", len(extracted)-3)
+	}
+}
+
+// newUniformTestInitiation returns a MessageInitiation from the clientPK to the serverPK with only the static key
+// encrypted, which is all that the server checks.
+func newUniformTestInitiation(tb testing.TB, clientPK NoisePublicKey, serverPK NoisePublicKey) []byte {
+	ephemeralSK, ephemeralPK := e2eGenerateKey(tb)
+	msg := device.MessageInitiation{
+		Type:      device.MessageInitiationType,
+		Sender:    1,
+		Ephemeral: ephemeralPK.NoisePublicKey,
+	}
+	var hash, chainKey [blake2s.Size]byte
+	var key [chacha20poly1305.KeySize]byte
+	devicex.mixHash(&hash, &device.InitialHash, serverPK.NoisePublicKey[:])
+	devicex.mixHash(&hash, &hash, msg.Ephemeral[:])
+	devicex.mixKey(&chainKey, &device.InitialChainKey, msg.Ephemeral[:])
+	ss := ephemeralSK.SharedSecret(serverPK.NoisePublicKey)
+	device.KDF2(&chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	aead.Seal(msg.Static[:0], device.ZeroNonce[:], clientPK.NoisePublicKey[:], hash[:])
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, &msg)
+	return buf.Bytes()
+}
+
+func TestUniformDropExtractPeer(t *testing.T) {
+	server, clientPK, initiation := newUniformDropBenchmarkServer(t)
+	for _, uniform := range []bool{false, true} {
+		server.wgitTable.UniformDrop = uniform
+		var msg device.MessageInitiation
+		_ = binary.Read(bytes.NewReader(initiation), binary.LittleEndian, &msg)
+		sp, err := server.extractPeer(&msg)
+		if err != nil || *sp.ClientPublicKey != clientPK {
+			t.Errorf("uniform=%v: expected the client matched, got %v", uniform, err)
+		}
+		_, err = server.extractPeer(&server.wgitTable.uniformDecoyMessage)
+		if err == nil {
+			t.Errorf("uniform=%v: expected the decoy not matched", uniform)
+		}
+	}
+}
+
+// newUniformDropBenchmarkServer returns a server with the UniformDrop and two servers, and the obfuscated
+// MessageInitiation of a client to the first one.
+func newUniformDropBenchmarkServer(tb testing.TB) (server *Server, clientPK NoisePublicKey, initiation []byte) {
+	_, clientPK = e2eGenerateKey(tb)
+	config := &ServerConfig{
+		Listen:       ListenAddresses{"127.0.0.1:0"},
+		ObfuscateKey: "long enough password",
+		UniformDrop:  true,
+		LogLevel:     "error",
+	}
+	var serverPK NoisePublicKey
+	for i := 0; i < 2; i++ {
+		sk, pk := e2eGenerateKey(tb)
+		if i == 0 {
+			serverPK = pk
+		}
+		config.Servers = append(config.Servers, &ServerConfigServer{
+			PrivateKey: &sk,
+			Peers:      []*ServerConfigPeer{{ForwardTo: "127.0.0.1:51820"}},
+		})
+	}
+	server, err := NewServerWithConfig(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	initiation = newUniformTestInitiation(tb, clientPK, serverPK)
+	return
+}
+
+// uniformDropValidate is what mwgp-server does for a MessageInitiation from a new client before it is forwarded,
+// or before it is dropped.
+func uniformDropValidate(server *Server, packet *Packet) (valid bool) {
+	server.obfuscator.Deobfuscate(packet)
+	if packet.Flags&PacketFlagDropped != 0 {
+		server.wgitTable.uniformDecoy()
+		return
+	}
+	var msg device.MessageInitiation
+	err := binary.Read(bytes.NewReader(packet.Slice()), binary.LittleEndian, &msg)
+	if err != nil {
+		return
+	}
+	_, err = server.extractPeer(&msg)
+	valid = err == nil
+	return
+}
+
+// BenchmarkUniformDrop compares the time to validate a valid MessageInitiation and to drop the invalid packets,
+// which should be within the noise.
+func BenchmarkUniformDrop(b *testing.B) {
+	server, _, initiation := newUniformDropBenchmarkServer(b)
+	var other WireGuardObfuscator
+	other.Initialize("another long password")
+
+	obfuscate := func(o *WireGuardObfuscator, data []byte) []byte {
+		packet := Packet{Data: make([]byte, defaultMaxPacketSize), Length: len(data)}
+		copy(packet.Data, data)
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+		o.Obfuscate(&packet)
+		return append([]byte(nil), packet.Slice()...)
+	}
+	random := make([]byte, len(initiation)+20)
+	_, _ = rand.Read(random)
+
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{"valid", obfuscate(server.obfuscator, initiation), true},
+		{"random", random, false},
+		{"plain", initiation, false},
+		{"wrong_key", obfuscate(&other, initiation), false},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			packet := &Packet{Data: make([]byte, defaultMaxPacketSize)}
+			for i := 0; i < b.N; i++ {
+				copy(packet.Data, c.data)
+				packet.Length = len(c.data)
+				packet.Flags = 0
+				if uniformDropValidate(server, packet) != c.valid {
+					b.Fatalf("expected valid=%v", c.valid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package mwgp
+
+import (
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// upstreamConn is a UDP socket connected to a server destination,
+// which is a WireGuard server for mwgp-server, or mwgp-server for mwgp-client.
+// All the peers forwarded to the same destination share the socket,
+// their packets are still told apart by the index translation.
+//
+// Since the socket is connected, the kernel does not look up the destination for every packet,
+// and reports the ICMP port unreachable from the server as ECONNREFUSED,
+// so that the peers of a gone server are evicted immediately instead of waiting for the timeout.
+type upstreamConn struct {
+	transport PacketTransport
+	addr      netip.AddrPort
+
+	// the local port of the UDP socket, 0 if the transport is not a UDP socket
+	localPort int
+
+	// unix nano of the last packet sent, accessed atomically
+	lastActive int64
+
+	// the number of consecutive write errors, accessed atomically
+	writeErrors int32
+
+	// unix nano of the first packet expecting a reply (see expectsReply) sent since the last packet received,
+	// 0 if there is none, accessed atomically
+	unrepliedSince int64
+
+	// unix nano of the last packet received and the last ICMP unreachable, 0 if there is none,
+	// the number of consecutive send errors, and whether it is logged as unhealthy,
+	// all accessed atomically, see upstreamUnhealthyReason
+	lastReceived int64
+	refusedAt    int64
+	sendErrors   int32
+	unhealthy    int32
+
+	// the max length of the obfuscated packets learned from EMSGSIZE and the unix nano it is learned,
+	// 0 if there is none, both accessed atomically, see "Path MTU Discovery"
+	pathMTUCeiling   int32
+	pathMTULearnedAt int64
+}
+
+func (uc *upstreamConn) touch(now time.Time) {
+	atomic.StoreInt64(&uc.lastActive, now.UnixNano())
+}
+
+func (uc *upstreamConn) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&uc.lastActive))
+}
+
+// sent records the packet sent to the upstream.
+func (uc *upstreamConn) sent(packet *Packet, now time.Time) {
+	uc.touch(now)
+	if expectsReply(packet) && atomic.LoadInt64(&uc.unrepliedSince) == 0 {
+		atomic.CompareAndSwapInt64(&uc.unrepliedSince, 0, now.UnixNano())
+	}
+}
+
+// received records a packet received from the upstream.
+func (uc *upstreamConn) received() {
+	atomic.StoreInt64(&uc.lastReceived, time.Now().UnixNano())
+	if atomic.LoadInt64(&uc.unrepliedSince) != 0 {
+		atomic.StoreInt64(&uc.unrepliedSince, 0)
+	}
+}
+
+// expectsReply reports whether the WireGuard packet is always replied by the server in time,
+// which is a MessageInitiation, or a MessageTransport with data (replied by the passive keepalive at least).
+// The keepalive packets are not replied.
+func expectsReply(packet *Packet) bool {
+	switch packet.MessageType() {
+	case device.MessageInitiationType:
+		return true
+	case device.MessageTransportType:
+		return packet.Length > device.MessageTransportSize
+	}
+	return false
+}
+
+// upstreamKey returns the key of upstreamConns for the server destination.
+func upstreamKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// isConnRefusedError reports whether the err is an ICMP unreachable reported on a connected socket.
+// Windows reports it as ECONNRESET.
+func isConnRefusedError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || isUDPConnResetError(err)
+}
+
+// upstreamConnOf returns the socket connected to addr, it is created on the first call.
+func (t *WireGuardIndexTranslationTable) upstreamConnOf(addr *net.UDPAddr) (uc *upstreamConn, err error) {
+	key := upstreamKey(addr)
+
+	t.upstreamConnsLock.RLock()
+	uc = t.upstreamConns[key]
+	t.upstreamConnsLock.RUnlock()
+	if uc != nil {
+		return
+	}
+
+	t.upstreamConnsLock.Lock()
+	defer t.upstreamConnsLock.Unlock()
+	if uc = t.upstreamConns[key]; uc != nil {
+		return
+	}
+	if t.upstreamConnsClosed {
+		err = net.ErrClosed
+		return
+	}
+	transport, err := t.dialServer(net.UDPAddrFromAddrPort(key))
+	if err != nil {
+		return
+	}
+	uc = t.addUpstreamConnLocked(key, transport)
+	return
+}
+
+func (t *WireGuardIndexTranslationTable) addUpstreamConnLocked(key netip.AddrPort, transport PacketTransport) (uc *upstreamConn) {
+	uc = t.newUpstreamConnLocked(key, transport)
+	t.upstreamConns[key] = uc
+	return
+}
+
+// newUpstreamConnLocked starts reading the transport connected to the key,
+// without adding it to the upstreamConns.
+func (t *WireGuardIndexTranslationTable) newUpstreamConnLocked(key netip.AddrPort, transport PacketTransport) (uc *upstreamConn) {
+	uc = &upstreamConn{
+		transport: transport,
+		addr:      key,
+	}
+	if ut, ok := transport.(*UDPTransport); ok {
+		if laddr, ok := ut.Conn().LocalAddr().(*net.UDPAddr); ok {
+			uc.localPort = laddr.Port
+		}
+	}
+	t.enableServerUDPOffload(transport)
+	t.enableTOSPreservation(transport)
+	uc.touch(time.Now())
+	t.loopWaitGroup.Add(1)
+	go t.upstreamReadLoop(uc)
+	return
+}
+
+// upstreamLocalPortOf returns the local port of the socket to addr, 0 if there is none.
+func (t *WireGuardIndexTranslationTable) upstreamLocalPortOf(addr *net.UDPAddr) (port int) {
+	t.upstreamConnsLock.RLock()
+	defer t.upstreamConnsLock.RUnlock()
+	if uc := t.upstreamConns[upstreamKey(addr)]; uc != nil {
+		port = uc.localPort
+	}
+	return
+}
+
+// restoreUpstreamConns creates the sockets to the server destinations of the peers loaded from the cache,
+// bound to the same local ports as before the restart, so that the servers and the stateful firewalls
+// on the way see the packets of the peers from the same source and keep accepting them.
+// It is best-effort, the socket is created from a new port on the first packet if the port is taken.
+func (t *WireGuardIndexTranslationTable) restoreUpstreamConns(localPorts map[netip.AddrPort]int) {
+	if t.TransportFactory != nil || t.DialServerFunc != nil {
+		return
+	}
+	restored := 0
+	for key, port := range localPorts {
+		conn, err := t.dialUDPFrom(net.UDPAddrFromAddrPort(key), port)
+		if err != nil {
+			t.Logger.Debugf("failed to restore the socket to server %s from port %d: %s", key, port, err.Error())
+			continue
+		}
+		t.upstreamConnsLock.Lock()
+		if t.upstreamConnsClosed || t.upstreamConns[key] != nil {
+			_ = conn.Close()
+		} else {
+			t.addUpstreamConnLocked(key, NewUDPTransport(conn))
+			restored++
+		}
+		t.upstreamConnsLock.Unlock()
+	}
+	if restored > 0 {
+		t.Logger.Infof("restored %d of %d sockets to the servers from the cache", restored, len(localPorts))
+	}
+}
+
+func (t *WireGuardIndexTranslationTable) upstreamReadLoop(uc *upstreamConn) {
+	defer t.loopWaitGroup.Done()
+	if batchSize := normalizeBatchSize(t.BatchSize); batchSize > 1 {
+		t.readBatchLoop("server", uc.transport, t.ServerReadBatchFunc, batchSize, t.serverReadChan, uc)
+		return
+	}
+	t.readLoop("server", uc.transport, t.ServerReadFunc, t.serverReadChan, uc)
+}
+
+// handleUpstreamUnreachable evicts all the peers forwarded to the unreachable server destination.
+func (t *WireGuardIndexTranslationTable) handleUpstreamUnreachable(addr netip.AddrPort, err error) {
+	t.upstreamConnsLock.RLock()
+	if uc := t.upstreamConns[addr]; uc != nil {
+		atomic.StoreInt64(&uc.refusedAt, time.Now().UnixNano())
+	}
+	t.upstreamConnsLock.RUnlock()
+	count := t.evictPeers(func(peer *Peer) bool {
+		return upstreamKey(peer.serverAddr()) == addr
+	})
+	if count > 0 {
+		t.Logger.Infof("server %s is unreachable, evicted %d peers: %s", addr, count, err.Error())
+	}
+}
+
+// countUpstreamWriteResult counts the consecutive write errors on the upstream for its health,
+// and calls the UpstreamWriteErrorFunc once they reach the UpstreamWriteErrorThreshold.
+// The upstream is nil for the packets not sent by an upstreamConn.
+func (t *WireGuardIndexTranslationTable) countUpstreamWriteResult(upstream *upstreamConn, err error) {
+	if upstream == nil {
+		return
+	}
+	if err == nil {
+		if atomic.LoadInt32(&upstream.sendErrors) != 0 {
+			atomic.StoreInt32(&upstream.sendErrors, 0)
+		}
+	} else {
+		atomic.AddInt32(&upstream.sendErrors, 1)
+	}
+	if t.UpstreamWriteErrorFunc == nil || t.UpstreamWriteErrorThreshold <= 0 {
+		return
+	}
+	if err == nil {
+		if atomic.LoadInt32(&upstream.writeErrors) != 0 {
+			atomic.StoreInt32(&upstream.writeErrors, 0)
+		}
+		return
+	}
+	if atomic.AddInt32(&upstream.writeErrors, 1) < int32(t.UpstreamWriteErrorThreshold) {
+		return
+	}
+	atomic.StoreInt32(&upstream.writeErrors, 0)
+	t.UpstreamWriteErrorFunc(upstream.addr)
+}
+
+// upstreamUnrepliedSince returns when the first packet expecting a reply was sent to the addr
+// since the last packet received from it, or the zero time if there is none.
+func (t *WireGuardIndexTranslationTable) upstreamUnrepliedSince(addr netip.AddrPort) (since time.Time) {
+	t.upstreamConnsLock.RLock()
+	uc := t.upstreamConns[addr]
+	t.upstreamConnsLock.RUnlock()
+	if uc == nil {
+		return
+	}
+	if ns := atomic.LoadInt64(&uc.unrepliedSince); ns != 0 {
+		since = time.Unix(0, ns)
+	}
+	return
+}
+
+// closeIdleUpstreamConns closes the sockets that no peer is forwarded to,
+// and no packet is sent in the last timeout.
+// The pinned sockets (see upstreamConnOfPeer) are kept for the client public keys in the pinnedInUse instead.
+func (t *WireGuardIndexTranslationTable) closeIdleUpstreamConns(inUse map[netip.AddrPort]struct{}, pinnedInUse map[NoisePublicKey]struct{}, deadline time.Time) {
+	t.upstreamConnsLock.Lock()
+	defer t.upstreamConnsLock.Unlock()
+	t.closeIdlePinnedUpstreamsLocked(pinnedInUse, deadline)
+	for key, uc := range t.upstreamConns {
+		if _, ok := inUse[key]; ok {
+			continue
+		}
+		if uc.lastActiveTime().After(deadline) {
+			continue
+		}
+		delete(t.upstreamConns, key)
+		_ = uc.transport.Close()
+	}
+}
+
+// closeUpstreamConns closes all the sockets, no more sockets can be created after it.
+// The closed sockets are kept in the upstreamConns, so that their local ports are saved into the cache by drain().
+func (t *WireGuardIndexTranslationTable) closeUpstreamConns() {
+	t.upstreamConnsLock.Lock()
+	defer t.upstreamConnsLock.Unlock()
+	t.upstreamConnsClosed = true
+	for _, uc := range t.upstreamConns {
+		_ = uc.transport.Close()
+	}
+	for _, p := range t.pinnedUpstreams {
+		if p.uc != nil {
+			_ = p.uc.transport.Close()
+		}
+	}
+}
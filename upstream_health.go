@@ -0,0 +1,229 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream Health:
+//
+// mwgp-server checks the health of each server destination (the WireGuard endpoint behind it) every interval,
+// logs the transitions, and reports them as the Upstreams in the Stats. A server destination is unhealthy if
+//
+//   - an ICMP unreachable is received from it in the window, or
+//   - kUpstreamHealthSendErrors packets in a row failed to be sent to it, or
+//   - a packet expecting a reply (see expectsReply) is sent to it, but nothing is received in the window.
+//
+// The passive mode (default) only tracks the packets forwarded. The active mode also sends a probe
+// to each server destination every interval, which is a MessageTransport to the receiver index 0
+// and dropped by WireGuard silently, so that a closed port is found by the ICMP unreachable without any client.
+// It is not enabled by default, since the endpoint might not be ours to probe.
+
+const (
+	UpstreamHealthModePassive = "passive"
+	UpstreamHealthModeActive  = "active"
+
+	defaultUpstreamHealthInterval = 5 * time.Second
+	kUpstreamHealthIntervalMax    = time.Hour
+
+	// defaultUpstreamHealthWindow is the REKEY_TIMEOUT plus the KEEPALIVE_TIMEOUT of WireGuard,
+	// in which a MessageInitiation or a MessageTransport with data is always replied.
+	defaultUpstreamHealthWindow = 15 * time.Second
+	kUpstreamHealthWindowMax    = time.Hour
+
+	kUpstreamHealthSendErrors = 3
+)
+
+type UpstreamHealthConfig struct {
+	// Mode is UpstreamHealthModePassive (default) or UpstreamHealthModeActive.
+	Mode string `json:"mode,omitempty"`
+
+	// Interval is how often the health is checked (and probed in the active mode), default to 5s.
+	Interval Duration `json:"interval,omitempty"`
+
+	// Window is how long a server destination is considered unhealthy after an ICMP unreachable,
+	// or without any reply, default to 15s.
+	Window Duration `json:"window,omitempty"`
+
+	// FailbackDelay is how long a failed forward target is not failed back to, default to 1m,
+	// see forwardFailover.
+	FailbackDelay Duration `json:"failback_delay,omitempty"`
+}
+
+func (c *UpstreamHealthConfig) validate() (err error) {
+	switch c.Mode {
+	case "", UpstreamHealthModePassive, UpstreamHealthModeActive:
+	default:
+		err = fmt.Errorf("invalid upstream_health.mode %q, must be %s or %s", c.Mode, UpstreamHealthModePassive, UpstreamHealthModeActive)
+		return
+	}
+	err = c.Interval.validate("upstream_health.interval", kUpstreamHealthIntervalMax)
+	if err != nil {
+		return
+	}
+	err = c.Window.validate("upstream_health.window", kUpstreamHealthWindowMax)
+	if err != nil {
+		return
+	}
+	err = c.FailbackDelay.validate("upstream_health.failback_delay", kForwardFailbackDelayMax)
+	return
+}
+
+// UpstreamStats is the health of a server destination, see upstreamUnhealthyReason.
+type UpstreamStats struct {
+	Address string
+	Healthy bool
+
+	// LastReply is the time the last packet is received from it, the zero time if none.
+	LastReply time.Time
+
+	// ConsecutiveSendErrors is the number of packets failed to be sent to it since the last one sent.
+	ConsecutiveSendErrors int
+}
+
+// upstreamHealthLoop checks the health of the server destinations until the table is closed.
+func (t *WireGuardIndexTranslationTable) upstreamHealthLoop() {
+	defer t.loopWaitGroup.Done()
+	ticker := time.NewTicker(t.UpstreamHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.checkUpstreamHealth(now)
+		case <-t.closeChan:
+			return
+		}
+	}
+}
+
+// checkUpstreamHealth logs the health transitions of the server destinations,
+// and sends the probes with the UpstreamHealthProbe.
+func (t *WireGuardIndexTranslationTable) checkUpstreamHealth(now time.Time) {
+	t.upstreamConnsLock.RLock()
+	ucs := make([]*upstreamConn, 0, len(t.upstreamConns))
+	for _, uc := range t.upstreamConns {
+		ucs = append(ucs, uc)
+	}
+	t.upstreamConnsLock.RUnlock()
+
+	for _, uc := range ucs {
+		if reason := t.upstreamUnhealthyReason(uc, now); reason != "" {
+			if atomic.CompareAndSwapInt32(&uc.unhealthy, 0, 1) {
+				t.Logger.Warnf("server %s is unhealthy: %s", uc.addr, reason)
+			}
+		} else if atomic.CompareAndSwapInt32(&uc.unhealthy, 1, 0) {
+			t.Logger.Infof("server %s is healthy again", uc.addr)
+		}
+		if t.UpstreamHealthProbe {
+			t.sendUpstreamProbe(uc)
+		}
+	}
+}
+
+// upstreamUnhealthyReason returns why the server destination is unhealthy, or "" if it is healthy.
+func (t *WireGuardIndexTranslationTable) upstreamUnhealthyReason(uc *upstreamConn, now time.Time) (reason string) {
+	window := t.UpstreamHealthWindow
+	if window <= 0 {
+		window = defaultUpstreamHealthWindow
+	}
+	if ns := atomic.LoadInt64(&uc.refusedAt); ns != 0 && now.Sub(time.Unix(0, ns)) < window {
+		reason = "unreachable"
+		return
+	}
+	if n := atomic.LoadInt32(&uc.sendErrors); n >= kUpstreamHealthSendErrors {
+		reason = fmt.Sprintf("%d consecutive send errors", n)
+		return
+	}
+	if ns := atomic.LoadInt64(&uc.unrepliedSince); ns != 0 && now.Sub(time.Unix(0, ns)) >= window {
+		reason = fmt.Sprintf("no reply in %s", window)
+		return
+	}
+	return
+}
+
+// upstreamUnhealthyReasonOf returns why the server destination is unhealthy, checking the shared socket
+// and the pinned ones to it, "" if it is healthy or no socket to it is open.
+func (t *WireGuardIndexTranslationTable) upstreamUnhealthyReasonOf(addr netip.AddrPort, now time.Time) (reason string) {
+	t.upstreamConnsLock.RLock()
+	defer t.upstreamConnsLock.RUnlock()
+	if uc := t.upstreamConns[addr]; uc != nil {
+		reason = t.upstreamUnhealthyReason(uc, now)
+		if reason != "" {
+			return
+		}
+	}
+	for _, p := range t.pinnedUpstreams {
+		if p.uc != nil && p.uc.addr == addr {
+			reason = t.upstreamUnhealthyReason(p.uc, now)
+			if reason != "" {
+				return
+			}
+		}
+	}
+	return
+}
+
+// resetUpstreamHealth forgets the unreplied packets and the send errors of the sockets to the server destination,
+// so that a server destination switched back to is given a new window.
+func (t *WireGuardIndexTranslationTable) resetUpstreamHealth(addr netip.AddrPort) {
+	reset := func(uc *upstreamConn) {
+		atomic.StoreInt64(&uc.unrepliedSince, 0)
+		atomic.StoreInt32(&uc.sendErrors, 0)
+	}
+	t.upstreamConnsLock.RLock()
+	defer t.upstreamConnsLock.RUnlock()
+	if uc := t.upstreamConns[addr]; uc != nil {
+		reset(uc)
+	}
+	for _, p := range t.pinnedUpstreams {
+		if p.uc != nil && p.uc.addr == addr {
+			reset(p.uc)
+		}
+	}
+}
+
+// sendUpstreamProbe sends a MessageTransport to the receiver index 0, which is dropped by WireGuard.
+func (t *WireGuardIndexTranslationTable) sendUpstreamProbe(uc *upstreamConn) {
+	// not sent() or touch(), since the probe is never replied, and it should not keep the socket open
+	packet := t.obtainPacket()
+	packet.Length = device.MessageTransportSize
+	binary.LittleEndian.PutUint32(packet.Data[0:4], device.MessageTransportType)
+	for i := 4; i < packet.Length; i++ {
+		packet.Data[i] = 0
+	}
+	packet.Destination = net.UDPAddrFromAddrPort(uc.addr)
+	packet.transport = uc.transport
+	packet.upstream = uc
+	t.sendPacket(t.serverWriteChan, packet)
+}
+
+// upstreamStats returns the health of the server destinations, nil without the UpstreamHealthInterval.
+func (t *WireGuardIndexTranslationTable) upstreamStats() (stats []UpstreamStats) {
+	if t.UpstreamHealthInterval <= 0 {
+		return
+	}
+	now := time.Now()
+	t.upstreamConnsLock.RLock()
+	defer t.upstreamConnsLock.RUnlock()
+	for _, uc := range t.upstreamConns {
+		us := UpstreamStats{
+			Address:               uc.addr.String(),
+			Healthy:               t.upstreamUnhealthyReason(uc, now) == "",
+			ConsecutiveSendErrors: int(atomic.LoadInt32(&uc.sendErrors)),
+		}
+		if ns := atomic.LoadInt64(&uc.lastReceived); ns != 0 {
+			us.LastReply = time.Unix(0, ns)
+		}
+		stats = append(stats, us)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Address < stats[j].Address
+	})
+	return
+}
@@ -0,0 +1,105 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealthConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		config  UpstreamHealthConfig
+		invalid bool
+	}{
+		{config: UpstreamHealthConfig{}},
+		{config: UpstreamHealthConfig{Mode: UpstreamHealthModeActive, Interval: Duration(time.Second), Window: Duration(time.Minute)}},
+		{config: UpstreamHealthConfig{Mode: "icmp"}, invalid: true},
+		{config: UpstreamHealthConfig{Interval: Duration(-time.Second)}, invalid: true},
+		{config: UpstreamHealthConfig{Window: Duration(2 * time.Hour)}, invalid: true},
+	} {
+		if err := c.config.validate(); (err != nil) != c.invalid {
+			t.Errorf("%+v: expected invalid %v, got %v", c.config, c.invalid, err)
+		}
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	table.UpstreamHealthInterval = time.Second
+	table.UpstreamHealthWindow = 10 * time.Second
+	table.UpstreamHealthProbe = true
+	defer func() {
+		table.closeUpstreamConns()
+		table.loopWaitGroup.Wait()
+	}()
+	uc, err := table.upstreamConnOf(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectHealth := func(healthy bool) {
+		t.Helper()
+		now := time.Now()
+		table.checkUpstreamHealth(now)
+		// drain the probe
+		probe := <-table.serverWriteChan
+		if probe.Length != device.MessageTransportSize || binary.LittleEndian.Uint32(probe.Data[0:4]) != device.MessageTransportType ||
+			binary.LittleEndian.Uint32(probe.Data[4:8]) != 0 || probe.upstream != uc {
+			t.Errorf("expected a probe to the receiver index 0, got %x", probe.Data[:probe.Length])
+		}
+		if unhealthy := atomic.LoadInt32(&uc.unhealthy) != 0; unhealthy == healthy {
+			t.Errorf("expected healthy %v, got unhealthy because of %q", healthy, table.upstreamUnhealthyReason(uc, now))
+		}
+		stats := table.upstreamStats()
+		if len(stats) != 1 || stats[0].Address != serverAddr.String() || stats[0].Healthy != healthy {
+			t.Errorf("expected healthy %v in the stats, got %+v", healthy, stats)
+		}
+	}
+	expectHealth(true)
+
+	// no reply in the window
+	initiation := &Packet{Data: make([]byte, device.MessageInitiationSize), Length: device.MessageInitiationSize}
+	binary.LittleEndian.PutUint32(initiation.Data[0:4], device.MessageInitiationType)
+	uc.sent(initiation, time.Now().Add(-table.UpstreamHealthWindow))
+	expectHealth(false)
+	uc.received()
+	expectHealth(true)
+	if stats := table.upstreamStats(); stats[0].LastReply.IsZero() {
+		t.Errorf("expected the last reply in the stats")
+	}
+
+	// consecutive send errors
+	for i := 0; i < kUpstreamHealthSendErrors; i++ {
+		table.countUpstreamWriteResult(uc, errors.New("send error"))
+	}
+	expectHealth(false)
+	if stats := table.upstreamStats(); stats[0].ConsecutiveSendErrors != kUpstreamHealthSendErrors {
+		t.Errorf("expected %d send errors in the stats, got %d", kUpstreamHealthSendErrors, stats[0].ConsecutiveSendErrors)
+	}
+	table.countUpstreamWriteResult(uc, nil)
+	expectHealth(true)
+
+	// unreachable in the window
+	table.handleUpstreamUnreachable(uc.addr, errors.New("connection refused"))
+	expectHealth(false)
+	if reason := table.upstreamUnhealthyReason(uc, time.Now().Add(table.UpstreamHealthWindow)); reason != "" {
+		t.Errorf("expected healthy after the window, got %q", reason)
+	}
+
+	table.UpstreamHealthInterval = 0
+	if stats := table.upstreamStats(); stats != nil {
+		t.Errorf("expected no stats without the health check, got %+v", stats)
+	}
+}
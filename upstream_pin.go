@@ -0,0 +1,194 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upstream Port Pinning:
+//
+// A server peer with "upstream_port" is forwarded to its server from the pinned local port (or a port
+// in the pinned range), instead of the upstreamConn shared by all the peers to the same server,
+// so that the server and the firewalls in between always see the peer from the same source port.
+//
+// The socket is kept for the client public key and reused by the later sessions of it,
+// it is only closed once the peer is idle, or reopened from the same port if the server address changes.
+// If none of the ports can be bound, e.g. the socket of a previous process is not released yet,
+// the packets of the peer are dropped, and the binding is retried with a backoff.
+//
+// Pinning requires the UDP sockets, it is ignored with a TransportFactory or a DialServerFunc.
+
+const (
+	kUpstreamPinRetryMin = 100 * time.Millisecond
+	kUpstreamPinRetryMax = 10 * time.Second
+
+	// kUpstreamPortRangeMax is the max number of the ports in an upstream_port range.
+	kUpstreamPortRangeMax = 1024
+)
+
+// PortRange is a port like "40000", or a port range like "40000-40010".
+// A number is accepted in the config as well.
+type PortRange string
+
+func (r *PortRange) UnmarshalJSON(b []byte) (err error) {
+	var n int
+	if json.Unmarshal(b, &n) == nil {
+		*r = PortRange(strconv.Itoa(n))
+		return
+	}
+	var s string
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		err = fmt.Errorf("port must be a number or a string like \"40000-40010\": %w", err)
+		return
+	}
+	*r = PortRange(s)
+	return
+}
+
+// parse returns the ports of the range, portMax is the same as the portMin for a single port.
+func (r PortRange) parse() (portMin, portMax int, err error) {
+	minString, maxString, isRange := strings.Cut(string(r), "-")
+	portMin, err = strconv.Atoi(strings.TrimSpace(minString))
+	if err == nil {
+		portMax = portMin
+		if isRange {
+			portMax, err = strconv.Atoi(strings.TrimSpace(maxString))
+		}
+	}
+	if err != nil || portMin < 1 || portMax > 65535 || portMin > portMax {
+		err = fmt.Errorf("invalid port range %q", string(r))
+		return
+	}
+	if portMax-portMin+1 > kUpstreamPortRangeMax {
+		err = fmt.Errorf("port range %q exceeds %d ports", string(r), kUpstreamPortRangeMax)
+		return
+	}
+	return
+}
+
+// pinnedUpstream is the socket pinned for a client public key, see upstreamConnOfPeer.
+type pinnedUpstream struct {
+	uc *upstreamConn
+
+	// the next time to bind the ports after a failure, and the backoff doubled by each failure
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// pinnedTo reports whether the uc is connected to the addr from a port in the range, false if the uc is nil.
+func (uc *upstreamConn) pinnedTo(addr *net.UDPAddr, portMin, portMax int) bool {
+	return uc != nil && uc.addr == upstreamKey(addr) && uc.localPort >= portMin && uc.localPort <= portMax
+}
+
+// upstreamConnOfPeer returns the socket the packets of the peer are forwarded to the destination with,
+// the pinned one if the peer has an upstream port, or the shared one of the destination.
+func (t *WireGuardIndexTranslationTable) upstreamConnOfPeer(peer *Peer, destination *net.UDPAddr) (uc *upstreamConn, err error) {
+	if peer.upstreamPortMin == 0 || t.TransportFactory != nil || t.DialServerFunc != nil {
+		uc, err = t.upstreamConnOf(destination)
+		return
+	}
+
+	t.upstreamConnsLock.RLock()
+	p := t.pinnedUpstreams[peer.clientPublicKey]
+	if p != nil && p.uc.pinnedTo(destination, peer.upstreamPortMin, peer.upstreamPortMax) {
+		uc = p.uc
+	}
+	t.upstreamConnsLock.RUnlock()
+	if uc != nil {
+		return
+	}
+
+	t.upstreamConnsLock.Lock()
+	defer t.upstreamConnsLock.Unlock()
+	if t.upstreamConnsClosed {
+		err = net.ErrClosed
+		return
+	}
+	p = t.pinnedUpstreams[peer.clientPublicKey]
+	if p == nil {
+		p = &pinnedUpstream{}
+		t.pinnedUpstreams[peer.clientPublicKey] = p
+	}
+	if p.uc.pinnedTo(destination, peer.upstreamPortMin, peer.upstreamPortMax) {
+		uc = p.uc
+		return
+	}
+	now := time.Now()
+	if now.Before(p.retryAt) {
+		err = fmt.Errorf("upstream port %s is not available, retry in %s", peer.upstreamPortString(), p.retryAt.Sub(now).Round(time.Millisecond))
+		return
+	}
+
+	// the previous port is preferred, it must be released before being bound again
+	previousPort := 0
+	if p.uc != nil {
+		previousPort = p.uc.localPort
+		_ = p.uc.transport.Close()
+		p.uc = nil
+	}
+	conn, err := t.dialUDPFromRange(destination, previousPort, peer.upstreamPortMin, peer.upstreamPortMax)
+	if err != nil {
+		if p.backoff < kUpstreamPinRetryMin {
+			p.backoff = kUpstreamPinRetryMin
+		} else if p.backoff *= 2; p.backoff > kUpstreamPinRetryMax {
+			p.backoff = kUpstreamPinRetryMax
+		}
+		p.retryAt = now.Add(p.backoff)
+		err = errorf(ErrNetwork, "failed to bind upstream port %s, retry in %s: %w", peer.upstreamPortString(), p.backoff, err)
+		return
+	}
+	p.retryAt, p.backoff = time.Time{}, 0
+	uc = t.newUpstreamConnLocked(upstreamKey(destination), NewUDPTransport(conn))
+	p.uc = uc
+	t.peerLogger(peer).Infof("forward to server %s from the pinned port %d", destination, uc.localPort)
+	return
+}
+
+// dialUDPFromRange is dialUDPFrom the first free port in the range, the preferredPort is tried first if set.
+func (t *WireGuardIndexTranslationTable) dialUDPFromRange(raddr *net.UDPAddr, preferredPort, portMin, portMax int) (conn *net.UDPConn, err error) {
+	if preferredPort >= portMin && preferredPort <= portMax {
+		conn, err = t.dialUDPFrom(raddr, preferredPort)
+		if err == nil {
+			return
+		}
+	}
+	for port := portMin; port <= portMax; port++ {
+		if port == preferredPort {
+			continue
+		}
+		conn, err = t.dialUDPFrom(raddr, port)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// closeIdlePinnedUpstreamsLocked closes the pinned sockets of the client public keys without any peer,
+// it must be called with the upstreamConnsLock held.
+func (t *WireGuardIndexTranslationTable) closeIdlePinnedUpstreamsLocked(inUse map[NoisePublicKey]struct{}, deadline time.Time) {
+	for key, p := range t.pinnedUpstreams {
+		if _, ok := inUse[key]; ok {
+			continue
+		}
+		if p.uc != nil {
+			if p.uc.lastActiveTime().After(deadline) {
+				continue
+			}
+			_ = p.uc.transport.Close()
+		}
+		delete(t.pinnedUpstreams, key)
+	}
+}
+
+func (p *Peer) upstreamPortString() string {
+	if p.upstreamPortMax == p.upstreamPortMin {
+		return strconv.Itoa(p.upstreamPortMin)
+	}
+	return fmt.Sprintf("%d-%d", p.upstreamPortMin, p.upstreamPortMax)
+}
@@ -0,0 +1,149 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPortRange(t *testing.T) {
+	for _, c := range []struct {
+		json    string
+		portMin int
+		portMax int
+		invalid bool
+	}{
+		{json: `40000`, portMin: 40000, portMax: 40000},
+		{json: `"40000"`, portMin: 40000, portMax: 40000},
+		{json: `"40000-40010"`, portMin: 40000, portMax: 40010},
+		{json: `"40010-40000"`, invalid: true},
+		{json: `"0"`, invalid: true},
+		{json: `"40000-65536"`, invalid: true},
+		{json: `"1-2000"`, invalid: true},
+		{json: `"abc"`, invalid: true},
+	} {
+		var r PortRange
+		err := json.Unmarshal([]byte(c.json), &r)
+		var portMin, portMax int
+		if err == nil {
+			portMin, portMax, err = r.parse()
+		}
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.json)
+			}
+			continue
+		}
+		if err != nil || portMin != c.portMin || portMax != c.portMax {
+			t.Errorf("%s: expected %d-%d, got %d-%d (%v)", c.json, c.portMin, c.portMax, portMin, portMax, err)
+		}
+	}
+}
+
+func TestValidateUpstreamPorts(t *testing.T) {
+	servers := []*ServerConfigServer{
+		{Peers: []*ServerConfigPeer{{UpstreamPort: "40000-40010"}, {UpstreamPort: "40011"}}},
+		{Peers: []*ServerConfigPeer{{}, {UpstreamPort: "40005"}}},
+	}
+	errs := validateUpstreamPorts(servers)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "server[1]: peer[1]") || !strings.Contains(errs[0].Error(), "server[0]: peer[0]") {
+		t.Errorf("expected the conflict of server[1]: peer[1] with server[0]: peer[0], got %v", errs)
+	}
+	servers[1].Peers[1].UpstreamPort = "40012"
+	if errs = validateUpstreamPorts(servers); len(errs) != 0 {
+		t.Errorf("expected no conflict, got %v", errs)
+	}
+}
+
+func TestUpstreamConnOfPeer(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	_, otherPK := e2eGenerateKey(t)
+	var servers [2]*net.UDPAddr
+	for i := range servers {
+		server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers[i] = server.LocalAddr().(*net.UDPAddr)
+	}
+	portMin := e2eFreeUDPPortRange(t, 2)
+
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewStdLogger(LogLevelError)
+	defer func() {
+		table.closeUpstreamConns()
+		table.loopWaitGroup.Wait()
+	}()
+	peer := &Peer{
+		clientPublicKey:   clientPK,
+		serverDestination: servers[0],
+		upstreamPortMin:   portMin,
+		upstreamPortMax:   portMin,
+	}
+
+	// the port is taken, retried after the backoff
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{Port: portMin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.upstreamConnOfPeer(peer, servers[0]); err == nil {
+		_ = taken.Close()
+		t.Fatal("expected an error of the port taken")
+	}
+	_ = taken.Close()
+	if _, err = table.upstreamConnOfPeer(peer, servers[0]); err == nil || !strings.Contains(err.Error(), "retry in") {
+		t.Fatalf("expected to wait for the backoff, got %v", err)
+	}
+	table.pinnedUpstreams[clientPK].retryAt = time.Now()
+	uc, err := table.upstreamConnOfPeer(peer, servers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uc.localPort != portMin {
+		t.Errorf("expected the socket from port %d, got %d", portMin, uc.localPort)
+	}
+	if again, _ := table.upstreamConnOfPeer(&Peer{
+		clientPublicKey: clientPK,
+		upstreamPortMin: portMin,
+		upstreamPortMax: portMin,
+	}, servers[0]); again != uc {
+		t.Errorf("expected the socket reused by the next session")
+	}
+
+	// another peer is pinned to the next free port in its range, and an unpinned peer uses the shared socket
+	other, err := table.upstreamConnOfPeer(&Peer{
+		clientPublicKey: otherPK,
+		upstreamPortMin: portMin,
+		upstreamPortMax: portMin + 1,
+	}, servers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.localPort != portMin+1 {
+		t.Errorf("expected the socket from port %d, got %d", portMin+1, other.localPort)
+	}
+	shared, err := table.upstreamConnOfPeer(&Peer{clientPublicKey: otherPK}, servers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared == uc || shared == other || table.upstreamConns[upstreamKey(servers[0])] != shared {
+		t.Errorf("expected the shared socket for the unpinned peer")
+	}
+
+	// reopened from the same port for a new server address
+	moved, err := table.upstreamConnOfPeer(peer, servers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == uc || moved.localPort != portMin || moved.addr != upstreamKey(servers[1]) {
+		t.Errorf("expected a new socket to %s from port %d, got %s from %d", servers[1], portMin, moved.addr, moved.localPort)
+	}
+
+	table.closeIdleUpstreamConns(nil, map[NoisePublicKey]struct{}{clientPK: {}}, time.Now().Add(time.Second))
+	if table.pinnedUpstreams[clientPK] == nil || table.pinnedUpstreams[otherPK] != nil {
+		t.Errorf("expected only the socket of the peer in use kept")
+	}
+}
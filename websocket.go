@@ -0,0 +1,365 @@
+package mwgp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal WebSocket (RFC 6455) implementation for the WebSocket transport.
+//
+// Each obfuscated packet is sent as a single binary message, so the packet boundaries are kept
+// without another framing layer. Fragmented messages are reassembled, text messages are ignored,
+// pings are answered, and the extensions (such as the compression) are never negotiated.
+
+const (
+	kWebSocketGUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	kWebSocketVersion = "13"
+
+	kWebSocketOpContinuation = 0x0
+	kWebSocketOpText         = 0x1
+	kWebSocketOpBinary       = 0x2
+	kWebSocketOpClose        = 0x8
+	kWebSocketOpPing         = 0x9
+	kWebSocketOpPong         = 0xa
+
+	kWebSocketFlagFin  = 0x80
+	kWebSocketFlagMask = 0x80
+
+	// kWebSocketMaxHeaderLength is the max length of a frame header, with the 8-bytes length and the mask key.
+	kWebSocketMaxHeaderLength = 2 + 8 + 4
+
+	// kWebSocketMaxControlPayload is the max payload length of a control frame.
+	kWebSocketMaxControlPayload = 125
+)
+
+var (
+	errWebSocketMessageTooLarge = newError(ErrProtocol, "websocket message is too large")
+	errWebSocketClosed          = newError(ErrNetwork, "websocket closed by peer")
+)
+
+// webSocketAccept returns the Sec-WebSocket-Accept of the Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(kWebSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken reports whether the comma-separated header values contain the token, case-insensitively.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketConn is an established WebSocket connection.
+//
+// readMessage must be called by a single goroutine, writeMessage is safe to be called concurrently.
+type webSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// isClient masks the frames sent, as required for the client side.
+	isClient bool
+
+	// maxMessageSize bounds the reassembled messages.
+	maxMessageSize int
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// readHeader and readControl are the parts of the frame being read, kept here so that they do not escape
+	// to the heap for every frame.
+	readHeader  [8]byte
+	readControl [kWebSocketMaxControlPayload]byte
+
+	writeLock   sync.Mutex
+	writeBuffer []byte
+}
+
+// acceptWebSocket completes the server side handshake of the request, and hijacks its connection.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (conn net.Conn, reader *bufio.Reader, err error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		err = fmt.Errorf("not a websocket handshake")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != kWebSocketVersion {
+		w.Header().Set("Sec-WebSocket-Version", kWebSocketVersion)
+		http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+		err = fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		err = fmt.Errorf("connection cannot be hijacked")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		err = fmt.Errorf("failed to hijack connection: %w", err)
+		return
+	}
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		webSocketAccept(key))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		err = fmt.Errorf("failed to write handshake response: %w", err)
+		return
+	}
+	reader = rw.Reader
+	return
+}
+
+// dialWebSocket completes the client side handshake on the conn, the host and path are from the URL.
+func dialWebSocket(conn net.Conn, host, path string, timeout time.Duration) (reader *bufio.Reader, err error) {
+	var nonce [16]byte
+	_, err = io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return
+	}
+	request.Host = host
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", kWebSocketVersion)
+	err = request.Write(conn)
+	if err != nil {
+		err = fmt.Errorf("failed to write handshake request: %w", err)
+		return
+	}
+
+	reader = bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		err = fmt.Errorf("failed to read handshake response: %w", err)
+		return
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		err = fmt.Errorf("unexpected handshake response status %q", response.Status)
+		return
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		err = fmt.Errorf("invalid Sec-WebSocket-Accept in handshake response")
+		return
+	}
+	return
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, isClient bool, maxMessageSize int, readTimeout, writeTimeout time.Duration) *webSocketConn {
+	return &webSocketConn{
+		conn:           conn,
+		reader:         reader,
+		isClient:       isClient,
+		maxMessageSize: maxMessageSize,
+		readTimeout:    readTimeout,
+		writeTimeout:   writeTimeout,
+	}
+}
+
+// readMessage reads the next binary message into b, and returns its length.
+// The control frames are handled in place, the read deadline is extended for every frame.
+func (c *webSocketConn) readMessage(b []byte) (n int, err error) {
+	var inMessage, binaryMessage bool
+	for {
+		if c.readTimeout > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+		header := c.readHeader[:]
+		_, err = io.ReadFull(c.reader, header[:2])
+		if err != nil {
+			return
+		}
+		fin := header[0]&kWebSocketFlagFin != 0
+		opcode := header[0] & 0x0f
+		reserved := header[0] & 0x70
+		masked := header[1]&kWebSocketFlagMask != 0
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			_, err = io.ReadFull(c.reader, header[:2])
+			length = uint64(binary.BigEndian.Uint16(header[:2]))
+		case 127:
+			_, err = io.ReadFull(c.reader, header[:8])
+			length = binary.BigEndian.Uint64(header[:8])
+		}
+		if err != nil {
+			return
+		}
+		if reserved != 0 {
+			err = fmt.Errorf("unexpected websocket reserved bits %02x", reserved)
+			return
+		}
+		var maskKey [4]byte
+		if masked {
+			_, err = io.ReadFull(c.reader, header[:4])
+			if err != nil {
+				return
+			}
+			copy(maskKey[:], header[:4])
+		}
+
+		if opcode >= kWebSocketOpClose {
+			if !fin || length > kWebSocketMaxControlPayload {
+				err = fmt.Errorf("invalid websocket control frame")
+				return
+			}
+			payload := c.readControl[:]
+			_, err = io.ReadFull(c.reader, payload[:length])
+			if err != nil {
+				return
+			}
+			if masked {
+				maskWebSocketPayload(payload[:length], maskKey)
+			}
+			switch opcode {
+			case kWebSocketOpClose:
+				_ = c.writeFrame(kWebSocketOpClose, payload[:length])
+				err = errWebSocketClosed
+				return
+			case kWebSocketOpPing:
+				err = c.writeFrame(kWebSocketOpPong, payload[:length])
+				if err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		switch opcode {
+		case kWebSocketOpContinuation:
+			if !inMessage {
+				err = fmt.Errorf("unexpected websocket continuation frame")
+				return
+			}
+		case kWebSocketOpText, kWebSocketOpBinary:
+			if inMessage {
+				err = fmt.Errorf("unexpected websocket data frame in a fragmented message")
+				return
+			}
+			inMessage = true
+			binaryMessage = opcode == kWebSocketOpBinary
+			n = 0
+		default:
+			err = fmt.Errorf("unknown websocket opcode %d", opcode)
+			return
+		}
+		if length > uint64(c.maxMessageSize-n) || length > uint64(len(b)-n) {
+			err = errWebSocketMessageTooLarge
+			return
+		}
+		_, err = io.ReadFull(c.reader, b[n:n+int(length)])
+		if err != nil {
+			return
+		}
+		if masked {
+			maskWebSocketPayload(b[n:n+int(length)], maskKey)
+		}
+		n += int(length)
+		if !fin {
+			continue
+		}
+		inMessage = false
+		if binaryMessage {
+			return
+		}
+	}
+}
+
+// writeMessage writes b as a single binary message.
+func (c *webSocketConn) writeMessage(b []byte) (err error) {
+	return c.writeFrame(kWebSocketOpBinary, b)
+}
+
+// ping writes a ping frame, the pong extends the read deadline of the other end.
+func (c *webSocketConn) ping() (err error) {
+	return c.writeFrame(kWebSocketOpPing, nil)
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) (err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if cap(c.writeBuffer) < kWebSocketMaxHeaderLength+len(payload) {
+		c.writeBuffer = make([]byte, 0, kWebSocketMaxHeaderLength+len(payload))
+	}
+	frame := append(c.writeBuffer[:0], kWebSocketFlagFin|opcode, 0)
+	var maskFlag byte
+	if c.isClient {
+		maskFlag = kWebSocketFlagMask
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame[1] = maskFlag | byte(length)
+	case length <= 0xffff:
+		frame[1] = maskFlag | 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame[1] = maskFlag | 127
+		frame = append(frame, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	if c.isClient {
+		// read into the frame, a local array would escape to the heap for every frame
+		frame = append(frame, 0, 0, 0, 0)
+		_, err = io.ReadFull(rand.Reader, frame[len(frame)-4:])
+		if err != nil {
+			return
+		}
+		var maskKey [4]byte
+		copy(maskKey[:], frame[len(frame)-4:])
+		offset := len(frame)
+		frame = append(frame, payload...)
+		maskWebSocketPayload(frame[offset:], maskKey)
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeBuffer = frame
+
+	if c.writeTimeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err = c.conn.Write(frame)
+	return
+}
+
+func (c *webSocketConn) Close() (err error) {
+	return c.conn.Close()
+}
+
+func maskWebSocketPayload(b []byte, maskKey [4]byte) {
+	for i := range b {
+		b[i] ^= maskKey[i&3]
+	}
+}
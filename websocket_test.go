@@ -0,0 +1,203 @@
+package mwgp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestWebSocketPair(t *testing.T) (client, server *webSocketConn) {
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	client = newWebSocketConn(c, bufio.NewReader(c), true, 2048, time.Second, time.Second)
+	server = newWebSocketConn(s, bufio.NewReader(s), false, 2048, time.Second, time.Second)
+	return
+}
+
+func TestWebSocketConn_RoundTrip(t *testing.T) {
+	client, server := newTestWebSocketPair(t)
+	for _, length := range []int{0, 1, 125, 126, 1400, 2048} {
+		message := bytes.Repeat([]byte{byte(length)}, length)
+		go func() { _ = client.writeMessage(message) }()
+		buffer := make([]byte, 2048)
+		n, err := server.readMessage(buffer)
+		if err != nil {
+			t.Fatalf("length %d: %s", length, err.Error())
+		}
+		if !bytes.Equal(buffer[:n], message) {
+			t.Fatalf("length %d: message mismatch", length)
+		}
+	}
+
+	go func() { _ = server.writeMessage([]byte("reply")) }()
+	buffer := make([]byte, 2048)
+	n, err := client.readMessage(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "reply" {
+		t.Fatalf("unexpected message %q", buffer[:n])
+	}
+}
+
+func TestWebSocketConn_ControlAndFragments(t *testing.T) {
+	client, server := newTestWebSocketPair(t)
+	go func() {
+		// a ping, a text message and a fragmented binary message with a ping in the middle
+		_ = client.ping()
+		_ = client.writeFrame(kWebSocketOpText, []byte("ignored"))
+		frame := func(header byte, payload string) {
+			_, _ = client.conn.Write(append([]byte{header, byte(len(payload))}, payload...))
+		}
+		frame(kWebSocketOpBinary, "frag")
+		frame(kWebSocketFlagFin|kWebSocketOpPing, "")
+		frame(kWebSocketFlagFin|kWebSocketOpContinuation, "mented")
+	}()
+	pongs := make(chan error, 1)
+	go func() {
+		// the server answers the pings while reading the message
+		header := make([]byte, 2)
+		for i := 0; i < 2; i++ {
+			_, err := client.reader.Read(header)
+			if err == nil && header[0] != kWebSocketFlagFin|kWebSocketOpPong {
+				err = fmt.Errorf("unexpected frame %x", header)
+			}
+			if err != nil {
+				pongs <- err
+				return
+			}
+		}
+		pongs <- nil
+	}()
+
+	buffer := make([]byte, 2048)
+	n, err := server.readMessage(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "fragmented" {
+		t.Fatalf("unexpected message %q", buffer[:n])
+	}
+	if err = <-pongs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSocketConn_TooLarge(t *testing.T) {
+	client, server := newTestWebSocketPair(t)
+	go func() { _ = client.writeMessage(make([]byte, 4096)) }()
+	_, err := server.readMessage(make([]byte, 4096))
+	if !errors.Is(err, errWebSocketMessageTooLarge) {
+		t.Fatalf("expected errWebSocketMessageTooLarge, got %v", err)
+	}
+}
+
+func TestParseWebSocketURL(t *testing.T) {
+	for s, expected := range map[string]string{
+		"ws://example.com/mwgp":       "example.com:80",
+		"wss://example.com":           "example.com:443",
+		"wss://example.com:8443/mwgp": "example.com:8443",
+		"ws://[2001:db8::1]/":         "[2001:db8::1]:80",
+		"http://example.com/":         "",
+		"wss:///mwgp":                 "",
+	} {
+		_, hostport, err := parseWebSocketURL(s)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", s)
+			}
+			continue
+		}
+		if err != nil || hostport != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", s, expected, hostport, err)
+		}
+	}
+}
+
+func TestEndToEndWebSocket(t *testing.T) {
+	const obfsKey = "websocket"
+
+	serverSK, serverPK := e2eGenerateKey(t)
+	clientSK, clientPK := e2eGenerateKey(t)
+	serverIP := netip.AddrFrom4([4]byte{1, 0, 0, 1})
+	clientIP := netip.AddrFrom4([4]byte{1, 0, 0, 2})
+
+	wgServer, wgServerPort := newE2EWireGuardDevice(t, serverIP, serverSK, clientPK, clientIP, "")
+
+	mwgpServerWebSocketListen := e2eFreeTCPAddr(t)
+	server, err := NewServerWithConfig(&ServerConfig{
+		Listen: ListenAddresses{e2eFreeUDPAddr(t)},
+		Servers: []*ServerConfigServer{
+			{
+				PrivateKey: &serverSK,
+				Address:    "127.0.0.1",
+				Peers: []*ServerConfigPeer{
+					{
+						ClientPublicKey: &clientPK,
+						ForwardTo:       fmt.Sprintf(":%d", wgServerPort),
+					},
+				},
+			},
+		},
+		ObfuscateKey: obfsKey,
+		WebSocket: &WebSocketServerConfig{
+			Listen: mwgpServerWebSocketListen,
+			Path:   "/mwgp",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	mwgpClientListen := e2eFreeUDPAddr(t)
+	client, err := NewClientWithConfig(&ClientConfig{
+		Listen:          ListenAddresses{mwgpClientListen},
+		ClientPublicKey: clientPK,
+		ServerPublicKey: serverPK,
+		ObfuscateKey:    obfsKey,
+		WebSocket: &WebSocketClientConfig{
+			URL: fmt.Sprintf("ws://%s/mwgp", mwgpServerWebSocketListen),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = client.Start() }()
+	t.Cleanup(func() { _ = client.Stop() })
+
+	wgClient, _ := newE2EWireGuardDevice(t, clientIP, clientSK, serverPK, serverIP, mwgpClientListen)
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+
+	// the client reconnects after the connection is lost, and the session roams to the new connection
+	client.wgitTable.upstreamConnsLock.RLock()
+	if len(client.wgitTable.upstreamConns) != 1 {
+		t.Errorf("expected 1 upstream conn, got %d", len(client.wgitTable.upstreamConns))
+	}
+	for _, uc := range client.wgitTable.upstreamConns {
+		ws := uc.transport.(*streamClientTransport)
+		ws.lock.Lock()
+		if ws.conn != nil {
+			_ = ws.conn.Close()
+		}
+		ws.lock.Unlock()
+	}
+	client.wgitTable.upstreamConnsLock.RUnlock()
+
+	wgClient.ping(t, wgServer)
+	wgServer.ping(t, wgClient)
+	if stats := server.Stats(); stats.TotalSessionsCreated != 1 {
+		t.Errorf("expected the session to be kept after reconnect, got %d sessions created", stats.TotalSessionsCreated)
+	}
+}
@@ -0,0 +1,240 @@
+package mwgp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebSocketServerConfig makes mwgp-server accept mwgp-client over WebSocket in addition to UDP,
+// for the networks only allowing TCP (such as TCP/443) outbound.
+type WebSocketServerConfig struct {
+	// Listen is the TCP address of the HTTP server.
+	Listen string `json:"listen"`
+
+	// Path is the path of the WebSocket endpoint, default to "/". Other paths respond 404.
+	Path string `json:"path,omitempty"`
+
+	// TLSCert and TLSKey are the certificate and key files to serve wss:// directly,
+	// leave them empty to serve ws:// behind a TLS-terminating reverse proxy.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+
+	// ReadTimeout closes a connection without any frame (including pings) in time, default to 90s.
+	// WriteTimeout is the deadline of writing a frame, default to 10s.
+	ReadTimeout  Duration `json:"read_timeout,omitempty"`
+	WriteTimeout Duration `json:"write_timeout,omitempty"`
+}
+
+// WebSocketClientConfig makes mwgp-client forward to mwgp-server over WebSocket instead of UDP.
+type WebSocketClientConfig struct {
+	// URL is the ws:// or wss:// URL of the WebSocket endpoint of mwgp-server.
+	URL string `json:"url"`
+
+	// ReadTimeout reconnects if nothing is received in time, default to 90s,
+	// a ping is sent every third of it to keep the connection alive.
+	// WriteTimeout is the deadline of writing a frame, default to 10s.
+	ReadTimeout  Duration `json:"read_timeout,omitempty"`
+	WriteTimeout Duration `json:"write_timeout,omitempty"`
+}
+
+const (
+	defaultWebSocketPath         = "/"
+	defaultWebSocketReadTimeout  = 90 * time.Second
+	defaultWebSocketWriteTimeout = 10 * time.Second
+	kWebSocketTimeoutMax         = time.Hour
+)
+
+func webSocketTimeouts(readTimeout, writeTimeout Duration) (read, write time.Duration, err error) {
+	err = readTimeout.validate("websocket.read_timeout", kWebSocketTimeoutMax)
+	if err != nil {
+		return
+	}
+	err = writeTimeout.validate("websocket.write_timeout", kWebSocketTimeoutMax)
+	if err != nil {
+		return
+	}
+	read, write = defaultWebSocketReadTimeout, defaultWebSocketWriteTimeout
+	if readTimeout > 0 {
+		read = time.Duration(readTimeout)
+	}
+	if writeTimeout > 0 {
+		write = time.Duration(writeTimeout)
+	}
+	return
+}
+
+func (c *WebSocketServerConfig) validate() (err error) {
+	if c.Listen == "" {
+		err = fmt.Errorf("websocket.listen is required")
+		return
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		err = fmt.Errorf("websocket.tls_cert and websocket.tls_key must be set together")
+		return
+	}
+	if c.Path != "" && c.Path[0] != '/' {
+		err = fmt.Errorf("websocket.path %q must start with \"/\"", c.Path)
+		return
+	}
+	_, _, err = webSocketTimeouts(c.ReadTimeout, c.WriteTimeout)
+	return
+}
+
+// parseWebSocketURL parses the websocket.url, and returns the host:port to connect to.
+func parseWebSocketURL(s string) (u *url.URL, hostport string, err error) {
+	u, err = url.Parse(s)
+	if err != nil {
+		err = fmt.Errorf("invalid websocket.url: %w", err)
+		return
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ws":
+		if port == "" {
+			port = "80"
+		}
+	case "wss":
+		if port == "" {
+			port = "443"
+		}
+	default:
+		err = fmt.Errorf("invalid websocket.url %q, the scheme must be ws or wss", s)
+		return
+	}
+	if u.Hostname() == "" {
+		err = fmt.Errorf("invalid websocket.url %q, no host", s)
+		return
+	}
+	hostport = net.JoinHostPort(u.Hostname(), port)
+	return
+}
+
+// webSocketServerTransport accepts the WebSocket connections from the clients on an HTTP server.
+type webSocketServerTransport struct {
+	*streamServerTransport
+	listener     net.Listener
+	server       *http.Server
+	path         string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+var _ PacketTransport = (*webSocketServerTransport)(nil)
+
+func newWebSocketServerTransport(config *WebSocketServerConfig, maxMessageSize int, logger Logger) (t *webSocketServerTransport, err error) {
+	readTimeout, writeTimeout, err := webSocketTimeouts(config.ReadTimeout, config.WriteTimeout)
+	if err != nil {
+		return
+	}
+	transport := &webSocketServerTransport{
+		streamServerTransport: newStreamServerTransport("websocket", maxMessageSize, logger),
+		path:                  config.Path,
+		readTimeout:           readTimeout,
+		writeTimeout:          writeTimeout,
+	}
+	if transport.path == "" {
+		transport.path = defaultWebSocketPath
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSCert != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			err = fmt.Errorf("failed to load websocket.tls_cert and websocket.tls_key: %w", err)
+			return
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"http/1.1"},
+		}
+	}
+	transport.listener, err = net.Listen("tcp", config.Listen)
+	if err != nil {
+		err = errorf(ErrNetwork, "failed to listen on websocket.listen %s: %w", config.Listen, err)
+		return
+	}
+	if tlsConfig != nil {
+		transport.listener = tls.NewListener(transport.listener, tlsConfig)
+	}
+	transport.server = &http.Server{
+		Handler:           transport,
+		ReadHeaderTimeout: kStreamDialTimeout,
+	}
+	go func() { _ = transport.server.Serve(transport.listener) }()
+	t = transport
+	return
+}
+
+// Addr returns the address the HTTP server is listening on.
+func (t *webSocketServerTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *webSocketServerTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != t.path {
+		http.NotFound(w, r)
+		return
+	}
+	conn, reader, err := acceptWebSocket(w, r)
+	if err != nil {
+		t.logger.Debugf("websocket handshake from %s failed: %s", r.RemoteAddr, err.Error())
+		return
+	}
+	t.serveConn(newWebSocketConn(conn, reader, false, t.maxMessageSize, t.readTimeout, t.writeTimeout), conn.RemoteAddr())
+}
+
+func (t *webSocketServerTransport) Close() (err error) {
+	_ = t.streamServerTransport.Close()
+	err = t.server.Close()
+	return
+}
+
+// newWebSocketClientTransport returns the transport to mwgp-server at the addr (resolved from the URL, or the "server" option).
+func newWebSocketClientTransport(config *WebSocketClientConfig, addr *net.UDPAddr, dialer *net.Dialer, maxMessageSize int, logger Logger) (t *streamClientTransport, err error) {
+	u, _, err := parseWebSocketURL(config.URL)
+	if err != nil {
+		return
+	}
+	readTimeout, writeTimeout, err := webSocketTimeouts(config.ReadTimeout, config.WriteTimeout)
+	if err != nil {
+		return
+	}
+	var tlsConfig *tls.Config
+	if u.Scheme == "wss" {
+		tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			NextProtos: []string{"http/1.1"},
+		}
+	}
+	dial := func(ctx context.Context) (sc streamConn, err error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return
+		}
+		if tlsConfig != nil {
+			tlsConn := tls.Client(conn, tlsConfig)
+			err = tlsConn.HandshakeContext(ctx)
+			if err != nil {
+				_ = conn.Close()
+				err = fmt.Errorf("tls handshake: %w", err)
+				return
+			}
+			conn = tlsConn
+		}
+		reader, err := dialWebSocket(conn, u.Host, u.RequestURI(), kStreamDialTimeout)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		sc = newWebSocketConn(conn, reader, true, maxMessageSize, readTimeout, writeTimeout)
+		return
+	}
+	t = newStreamClientTransport("websocket "+u.Redacted(), addr, dial, readTimeout/3, maxMessageSize, logger)
+	return
+}
@@ -2,18 +2,28 @@ package mwgp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"golang.zx2c4.com/wireguard/device"
 	"log"
 	"math/rand"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Peer struct {
+	// keep 64-bit aligned for atomic operations
+	stats peerStats
+
+	// unix nano of the last packet, accessed atomically
+	lastActive int64
+
 	// the index the client told us whom CLIENT is
 	// in MessageInitiation.Sender (client -> us, register)
 	// in MessageResponse.Receiver (us -> client, translate)
@@ -39,8 +49,9 @@ type Peer struct {
 	serverProxyIndex uint32
 
 	// the cookie generator initialized with the server public key
-	// used to generate mac{1,2} for MessageInitialize(c->s)
-	clientCookieGenerator device.CookieGenerator
+	// used to generate mac{1,2} for MessageInitialize(c->s),
+	// shared by the sessions of the client public key, see cookie.go.
+	clientCookieGenerator *device.CookieGenerator
 	clientPublicKey       NoisePublicKey
 
 	// the cookie generator initialized with the client public key
@@ -48,55 +59,414 @@ type Peer struct {
 	serverCookieGenerator device.CookieGenerator
 	serverPublicKey       NoisePublicKey
 
+	// clientDestination and clientTransport are changed by the roaming of the client, and serverDestination by
+	// the failover of the forward_to, once the peer is in the maps. They must be accessed with the endpointLock
+	// held then, see clientEndpoint, setClientEndpoint, serverAddr and setServerDestination.
+	endpointLock      sync.Mutex
 	clientDestination *net.UDPAddr
 	serverDestination *net.UDPAddr
-	lastActive        atomic.Value // time.Time
 
 	clientSourceValidateLevel int
 	serverSourceValidateLevel int
 
 	obfuscateEnabled bool
+
+	// the listener transport the client packets arrived on,
+	// packets to client should be sent back from the same transport.
+	clientTransport PacketTransport
+
+	// sessionID is a short random ID included in the logs of the peer,
+	// so that the logs of a single session can be correlated.
+	sessionID string
+
+	// createdAt is the zero time for the peers loaded from the cache.
+	createdAt time.Time
+
+	// upstreamPortMin and upstreamPortMax are the pinned upstream ports, 0 if not pinned, see upstreamConnOfPeer.
+	upstreamPortMin int
+	upstreamPortMax int
+
+	// bandwidth is the rate_limit of the server peer, nil if not limited, see allowBandwidth.
+	bandwidth *bandwidthLimiter
+
+	// account is shared by all the sessions of the client public key, see accounting.go.
+	account *peerAccount
+
+	// sendProxyProtocol is the send_proxy_protocol of the server peer, and proxyProtocolSource is the client address
+	// the PROXY protocol header was last sent for, see prependProxyProtocolHeader.
+	sendProxyProtocol   bool
+	proxyProtocolSource netip.AddrPort
+}
+
+func newSessionID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// logFields returns the fields identifying the peer in the structured logs.
+func (p *Peer) logFields() (fields []LogField) {
+	fields = []LogField{
+		{Key: "peer_id", Value: p.clientPublicKey.Base64()},
+		{Key: "session_id", Value: p.sessionID},
+		{Key: "src", Value: p.clientAddr().String()},
+	}
+	if dst := p.serverAddr(); dst != nil {
+		fields = append(fields, LogField{Key: "dst", Value: dst.String()})
+	}
+	return
+}
+
+// clientEndpoint returns the clientDestination and the clientTransport of the peer.
+func (p *Peer) clientEndpoint() (destination *net.UDPAddr, transport PacketTransport) {
+	p.endpointLock.Lock()
+	destination, transport = p.clientDestination, p.clientTransport
+	p.endpointLock.Unlock()
+	return
+}
+
+// clientAddr returns the clientDestination of the peer.
+func (p *Peer) clientAddr() (destination *net.UDPAddr) {
+	destination, _ = p.clientEndpoint()
+	return
+}
+
+// setClientEndpoint moves the peer to the client destination, a nil destination or transport is not changed.
+func (p *Peer) setClientEndpoint(destination *net.UDPAddr, transport PacketTransport) {
+	p.endpointLock.Lock()
+	if destination != nil {
+		p.clientDestination = destination
+	}
+	if transport != nil {
+		p.clientTransport = transport
+	}
+	p.endpointLock.Unlock()
+}
+
+// serverAddr returns the serverDestination of the peer.
+func (p *Peer) serverAddr() (destination *net.UDPAddr) {
+	p.endpointLock.Lock()
+	destination = p.serverDestination
+	p.endpointLock.Unlock()
+	return
+}
+
+// setServerDestination moves the peer to the server destination.
+func (p *Peer) setServerDestination(destination *net.UDPAddr) {
+	p.endpointLock.Lock()
+	p.serverDestination = destination
+	p.endpointLock.Unlock()
+}
+
+// allowsClientSource reports whether the packets of the peer are accepted from the src
+// with the clientSourceValidateLevel.
+func (p *Peer) allowsClientSource(src *net.UDPAddr) bool {
+	switch p.clientSourceValidateLevel {
+	case SourceValidateLevelIP:
+		return src.IP.Equal(p.clientAddr().IP)
+	case SourceValidateLevelIPAndPort:
+		destination := p.clientAddr()
+		return src.IP.Equal(destination.IP) && src.Port == destination.Port
+	}
+	return true
 }
 
 func (p *Peer) IsServerReplied() bool {
 	return p.serverProxyIndex != 0
 }
 
+func (p *Peer) touch(now time.Time) {
+	atomic.StoreInt64(&p.lastActive, now.UnixNano())
+}
+
+func (p *Peer) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastActive))
+}
+
 type WireGuardIndexTranslationTable struct {
+	// keep 64-bit aligned for atomic operations
+	stats tableStats
+	// activeTimeout is the Timeout in nanoseconds for isExpired, see "Expiration".
+	activeTimeout int64
+
+	// TransportFactory creates the transports to the clients and the servers,
+	// UDP sockets are used if it is nil.
+	TransportFactory PacketTransportFactory
+
 	// client <-> us
-	clientConn            *net.UDPConn
-	ClientListen          *net.UDPAddr
-	ClientReadFromUDPFunc func(conn *net.UDPConn, packet *Packet) (err error)
-	ClientWriteToUDPFunc  func(conn *net.UDPConn, packet *Packet) (err error)
-	clientReadChan        chan *Packet
-	clientWriteChan       chan *Packet
+	clientTransport     PacketTransport
+	clientTransports    []PacketTransport
+	ClientListen        *net.UDPAddr
+	ClientListenWorkers int
+
+	// ClientListenPortMax listens on every port from the ClientListen.Port to it as well if set,
+	// see splitPortRange.
+	ClientListenPortMax int
+
+	// ClientListenExtra are listened on along with the ClientListen, see ListenAddresses.
+	ClientListenExtra []ListenRange
+	clientListeners   []*clientListener
+	clientListenerMap map[PacketTransport]*clientListener
+
+	// ClientListenSystemd serves the UDP sockets passed by the systemd socket activation
+	// instead of listening on the ClientListen, only the ones named ClientListenFDName if set.
+	ClientListenSystemd bool
+	ClientListenFDName  string
+
+	// The {Client,Server}{Read,Write}Func and the batch ones are called with the packets owned by the table,
+	// see PacketPool: a read func fills the packet in place (swapping its Data with another buffer of the same
+	// size is fine), and a write func must not keep the packet after it returns unless it sets PacketFlagRetained.
+	ClientReadFunc  func(transport PacketTransport, packet *Packet) (err error)
+	ClientWriteFunc func(transport PacketTransport, packet *Packet) (err error)
+	clientReadChan  chan *Packet
+	clientWriteChan chan *Packet
+
+	// ExtraClientTransports are served along with the ones listening on the ClientListen,
+	// such as the WebSocket transport. They are closed by the table.
+	ExtraClientTransports []PacketTransport
+
+	// the handshake queues of the {client,server}{Read,Write}Chan, see "Handshake Priority"
+	clientReadHandshakeChan  chan *Packet
+	clientWriteHandshakeChan chan *Packet
+	serverReadHandshakeChan  chan *Packet
+	serverWriteHandshakeChan chan *Packet
 
 	// us <-> server
-	serverConn            *net.UDPConn
-	ServerListen          *net.UDPAddr
-	ServerReadFromUDPFunc func(conn *net.UDPConn, packet *Packet) (err error)
-	ServerWriteToUDPFunc  func(conn *net.UDPConn, packet *Packet) (err error)
-	serverReadChan        chan *Packet
-	serverWriteChan       chan *Packet
-
-	Timeout         time.Duration
+	//
+	// Each server destination has its own connected socket, see upstreamConn.
+	// ServerListen is the local address of these sockets, its port should be left 0
+	// since there might be more than one of them.
+	// BindDevice is the interface these sockets are bound to if set (Linux only).
+	ServerListen        *net.UDPAddr
+	BindDevice          string
+	ServerReadFunc      func(transport PacketTransport, packet *Packet) (err error)
+	ServerWriteFunc     func(transport PacketTransport, packet *Packet) (err error)
+	serverReadChan      chan *Packet
+	serverWriteChan     chan *Packet
+	upstreamConns       map[netip.AddrPort]*upstreamConn
+	pinnedUpstreams     map[NoisePublicKey]*pinnedUpstream
+	upstreamConnsLock   sync.RWMutex
+	upstreamConnsClosed bool
+
+	// DialServerFunc creates the transport to a server destination instead of the dialPacket if set,
+	// such as the WebSocket transport.
+	DialServerFunc func(raddr *net.UDPAddr) (transport PacketTransport, err error)
+
+	// BatchSize is the max number of packets read or written in a single syscall.
+	//
+	// With BatchSize > 1, the {Client,Server}{Read,Write}BatchFunc are used instead of
+	// the per-packet ones, which use recvmmsg/sendmmsg on Linux.
+	// It is ignored on other platforms.
+	BatchSize            int
+	ClientReadBatchFunc  func(transport PacketTransport, packets []*Packet) (n int, err error)
+	ClientWriteBatchFunc func(transport PacketTransport, packets []*Packet) (failed int, err error)
+	ServerReadBatchFunc  func(transport PacketTransport, packets []*Packet) (n int, err error)
+	ServerWriteBatchFunc func(transport PacketTransport, packets []*Packet) (failed int, err error)
+
+	// UDPOffload enables UDP GRO on the client sockets and UDP GSO on the server sockets with BatchSize > 1
+	// if the kernel supports them (Linux only), see "UDP Offload".
+	// It cannot be changed after Serve() is called.
+	UDPOffload bool
+	// serverGSODisabled keeps GSO off on the server sockets, where the obfuscation randomizes the packet lengths.
+	serverGSODisabled bool
+
+	// LatencySampleRate samples one of every LatencySampleRate packets for the latency histograms, 0 disables them,
+	// see "Latency Histogram". It cannot be changed after Serve() is called.
+	LatencySampleRate int
+
+	// trace is 1 with the "Packet Trace" enabled by SetTrace(), accessed atomically,
+	// and the traceLimiters rate-limit the lines of the transport packets and the handshakes.
+	trace         int32
+	traceLimiters [2]logRateLimiter
+
+	Timeout time.Duration
+	// CleanupInterval is the interval of the sweep of the expired sessions, the Timeout is used if it is 0.
+	// It cannot be changed after Serve() is called.
+	CleanupInterval time.Duration
+
+	// FwMark is the SO_MARK set on all the sockets if not 0 (Linux only),
+	// so that the forwarded packets can be excluded from the routes into the WireGuard tunnel.
+	FwMark int
+
+	// DSCP and TTL are set on all the sockets if not 0, see socketControl.
+	DSCP            int
+	TTL             int
+	sockoptWarnOnce [4]sync.Once
+
+	// PreserveTOS carries the TOS (the DSCP and the ECN bits) of each packet over the relay on the UDP sockets
+	// (Linux only), see "ToS Preservation". It cannot be changed after Serve() is called.
+	PreserveTOS bool
+
+	// PathMTUDiscovery sets the DF bit on the UDP sockets to the servers (Linux only), and writes the packets
+	// failed with EMSGSIZE again with less padding, see "Path MTU Discovery".
+	// It cannot be changed after Serve() is called.
+	PathMTUDiscovery bool
+	// pathMTUSnapshots are the packets to server before they are obfuscated, only used by the writeLoop.
+	pathMTUSnapshots []pathMTUSnapshot
+
+	// RecvBuffer and SendBuffer are the SO_RCVBUF and SO_SNDBUF of all the sockets if not 0.
+	RecvBuffer           int
+	SendBuffer           int
+	socketBuffersLogOnce [2]sync.Once
+
+	// MaxSessions is the max number of peers in the table, 0 means unlimited.
+	// Once the table is full, the MaxSessionsPolicy decides what happens to a new MessageInitiation.
+	// Both must not be changed after Serve() is called.
+	MaxSessions       int
+	MaxSessionsPolicy string
+
+	// MaxClients is the max number of distinct client addresses in the table, 0 means unlimited,
+	// it must not be changed after Serve() is called, see acceptsClientSourceLocked.
+	MaxClients int
+
+	// bandwidthLimit is the global rate_limit of mwgp-server, nil if not limited, see allowBandwidth.
+	bandwidthLimit *bandwidthLimiter
+
+	// HandshakeRateLimiter limits the MessageInitiation packets from clients per source IP, if set.
+	// The MessageTransport packets are never limited.
+	HandshakeRateLimiter *HandshakeRateLimiter
+
+	// probeBan is the probe_ban of mwgp-server, nil if disabled, see blockProbeSource.
+	probeBan *probeBanList
+
+	// clientACL is the *clientACL of mwgp-server, nil if all the clients are allowed, see allowClientSource.
+	clientACL atomic.Value
+
+	// allowedSources is the *prefixSet of the allowed_sources of mwgp-client, nil if all the sources are allowed,
+	// see allowSource.
+	allowedSources atomic.Value
+
+	// ValidateWireGuard drops the implausible WireGuard packets from the clients without a session,
+	// it must not be changed after Serve() is called, see validateClientPacket.
+	ValidateWireGuard bool
+
+	// packetFilter is the PacketFilterFunc of the packets from clients, nil if not set, see filterClientPacket.
+	// FilterAllPackets passes every packet from clients to it instead of the MessageInitiation only,
+	// it must be set before Serve().
+	packetFilter     atomic.Value
+	FilterAllPackets bool
+
+	// FallbackForward is the address the unrecognized packets from clients are forwarded to verbatim, if set.
+	// See fallbackSession.
+	FallbackForward        *net.UDPAddr
+	fallbackSessions       map[netip.AddrPort]*fallbackSession
+	fallbackSessionsLock   sync.Mutex
+	fallbackSessionsClosed bool
+
+	// UniformDrop does the same work for the packets from clients dropped before the MessageInitiation is validated
+	// as for a MessageInitiation, it must be set before Serve(), see "Uniform Drop" in uniform.go.
+	UniformDrop         bool
+	uniformDecoyMessage device.MessageInitiation
+
+	// DrainForward is the address the new clients are relayed to after Drain() if set, see drain.go.
+	DrainForward *net.UDPAddr
+	drainState   int32
+
+	// AccountingFile is where the traffic of each client public key is kept across restarts if set,
+	// it is written every AccountingInterval. Both must not be changed after Serve() is called.
+	AccountingFile     string
+	AccountingInterval time.Duration
+	accounts           map[NoisePublicKey]*peerAccount
+	accountsLock       sync.Mutex
+
 	ExtractPeerFunc func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error)
 	CacheJar        WGITCacheJar
 
+	// Logger must not be changed after Serve() is called.
+	Logger Logger
+	// packetLogLimiter rate-limits the logs triggered by a single packet, see logPacketf.
+	packetLogLimiter categoryLogLimiter
+
+	// ForwardTableShards is the number of the shards of the clientMap and the serverMap, rounded up to a power of two,
+	// see "Forward Table Shards". It cannot be changed after Serve() is called.
+	ForwardTableShards int
+
 	// clientProxyIndex -> Peer
-	clientMap map[uint32]*Peer
+	clientMap *peerMap
 
 	// serverProxyIndex -> Peer
-	serverMap map[uint32]*Peer
-
-	mapLock    sync.RWMutex
-	expireChan <-chan time.Time
-	packetPool sync.Pool
+	serverMap *peerMap
+
+	// latestPeers is the peer of the latest completed handshake of each client (keyed by the peer ID,
+	// the client public key), the earlier session follows it once the client roams, see roamPreviousPeerLocked.
+	latestPeers map[NoisePublicKey]*Peer
+
+	mapLock      sync.RWMutex
+	expireTicker *time.Ticker
+	expireChan   <-chan time.Time
+	packetPool   *PacketPool
+
+	// timeoutUpdateChan holds the latest Timeout set by SetTimeout().
+	timeoutUpdateChan chan time.Duration
+
+	// closeChan is closed by Close() to ask all loops to exit.
+	closeChan chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	// doneChan is closed once Serve() has released all resources.
+	doneChan chan struct{}
+	serving  int32
+
+	// ctx is canceled by Close() with the closeChan, see "Shutdown" in shutdown.go.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// loopWaitGroup tracks the read/write loops,
+	// handlerWaitGroup tracks the in-flight handleClientPacket/handleServerPacket goroutines,
+	// background tracks the other goroutines started by goBackground.
+	loopWaitGroup    sync.WaitGroup
+	handlerWaitGroup sync.WaitGroup
+	background       backgroundGroup
+
+	// closeGracePeriod is how long Serve() waits for the loops after the transports are closed.
+	closeGracePeriod time.Duration
 
 	// UpdateAllServerDestinationChan is used to set all server address for mwgp-client (in case of DNS update).
 	// this channel is not intended to be used by mwgp-server.
 	UpdateAllServerDestinationChan chan *net.UDPAddr
 
+	// ServerUnreachableFunc is called (in the main loop, so it must not block) after
+	// ServerUnreachableThreshold peers expired in a row without any reply from server.
+	// mwgp-client uses it to re-resolve the server address.
+	ServerUnreachableFunc      func()
+	ServerUnreachableThreshold int
+	unrepliedExpireCount       int32
+
+	// ControlPacketFunc is called (in the read loops, so it must not block) with the packets that are
+	// neither deobfuscated nor plain WireGuard, before they are dropped or forwarded to the FallbackForward.
+	// The packet is consumed if it returns true. Both ends use it for the preflight messages.
+	ControlPacketFunc func(transport PacketTransport, packet *Packet) (handled bool)
+
+	// ListenedFunc is called once the client sockets are listened, before any packet is read,
+	// and Serve() fails with its error. mwgp-server uses it to drop the privileges.
+	ListenedFunc func() (err error)
+
+	// PreflightFunc is called before a MessageInitiation from client is forwarded to the addr through the transport,
+	// the MessageInitiation is dropped if it returns false. mwgp-client uses it to run the preflight.
+	PreflightFunc func(transport PacketTransport, addr *net.UDPAddr) (forward bool)
+
+	// UpstreamWriteErrorFunc is called (in the write loop, so it must not block) after
+	// UpstreamWriteErrorThreshold consecutive write errors on the socket to a server destination.
+	// mwgp-server uses it to re-resolve the forward_to addresses.
+	UpstreamWriteErrorFunc      func(addr netip.AddrPort)
+	UpstreamWriteErrorThreshold int
+
+	// OnSessionCreated and OnSessionExpired are the session hooks if not nil,
+	// they must be set before Serve(), see sessionHookLoop.
+	OnSessionCreated func(info SessionInfo)
+	OnSessionExpired func(info SessionInfo)
+	sessionEvents    chan sessionEvent
+
+	// UpstreamHealthInterval checks the health of the server destinations every interval if set,
+	// they are unhealthy without a reply in the UpstreamHealthWindow, and probed with the UpstreamHealthProbe,
+	// see upstreamHealthLoop.
+	UpstreamHealthInterval time.Duration
+	UpstreamHealthWindow   time.Duration
+	UpstreamHealthProbe    bool
+
+	// NATKeepalive sends a NAT keepalive to a server destination if nothing is sent to it in the interval,
+	// for mwgp-client only, see isNATKeepalive.
+	NATKeepalive       time.Duration
+	natKeepaliveRandom obfuscateRandomSource
+
 	// MaxPacketSize is the maximum size of a WireGuard packet.
 	//
 	// We use the default value of 65536, which is the maximum possible size of a UDP packet.
@@ -106,145 +476,773 @@ type WireGuardIndexTranslationTable struct {
 	//
 	// If you are running mwgp on a server with limited memory, you can adjust this to
 	// reduce memory consumption.
+	//
+	// It sizes the buffers of the packets, so it is also the ceiling of the obfuscation padding and tag.
+	// The packets read larger than it are dropped (counted as OversizedPackets) instead of being truncated.
 	MaxPacketSize uint
 }
 
-func defaultReadFromUDPFunc(conn *net.UDPConn, packet *Packet) (err error) {
-	packet.Length, packet.Source, err = conn.ReadFromUDP(packet.Data[:])
-	if err != nil {
-		return
-	}
-	return
-}
+// The MaxSessionsPolicy.
+const (
+	// MaxSessionsPolicyReject drops the MessageInitiation, which is the default.
+	MaxSessionsPolicyReject = "reject"
 
-func defaultWriteToUDPFunc(conn *net.UDPConn, packet *Packet) (err error) {
-	_, err = conn.WriteToUDP(packet.Slice(), packet.Destination)
-	if err != nil {
+	// MaxSessionsPolicyLRU evicts the least recently active peer to make room.
+	MaxSessionsPolicyLRU = "lru"
+)
+
+func validateMaxSessions(maxSessions int, policy string) (err error) {
+	if maxSessions < 0 {
+		err = fmt.Errorf("max_sessions must not be negative")
 		return
 	}
+	switch policy {
+	case "", MaxSessionsPolicyReject, MaxSessionsPolicyLRU:
+	default:
+		err = fmt.Errorf("invalid max_sessions_policy %q, must be %q or %q",
+			policy, MaxSessionsPolicyReject, MaxSessionsPolicyLRU)
+	}
 	return
 }
 
+const (
+	// kTimeoutMax is the max Timeout allowed in config,
+	// a larger one is more likely to be a mistake (such as in milliseconds).
+	kTimeoutMax = time.Hour
+
+	defaultTimeout = 60 * time.Second
+)
+
 func NewWireGuardIndexTranslationTable() (table *WireGuardIndexTranslationTable) {
 	table = &WireGuardIndexTranslationTable{
-		ClientReadFromUDPFunc:          defaultReadFromUDPFunc,
-		ServerReadFromUDPFunc:          defaultReadFromUDPFunc,
-		ClientWriteToUDPFunc:           defaultWriteToUDPFunc,
-		ServerWriteToUDPFunc:           defaultWriteToUDPFunc,
-		clientReadChan:                 make(chan *Packet, 64),
-		clientWriteChan:                make(chan *Packet, 64),
-		serverReadChan:                 make(chan *Packet, 64),
-		serverWriteChan:                make(chan *Packet, 64),
-		Timeout:                        60 * time.Second,
-		clientMap:                      make(map[uint32]*Peer),
-		serverMap:                      make(map[uint32]*Peer),
+		ClientReadFunc:                 defaultReadFunc,
+		ServerReadFunc:                 defaultReadFunc,
+		ClientWriteFunc:                defaultWriteFunc,
+		ServerWriteFunc:                defaultWriteFunc,
+		BatchSize:                      1,
+		ClientReadBatchFunc:            defaultReadBatchFunc,
+		ServerReadBatchFunc:            defaultReadBatchFunc,
+		ClientWriteBatchFunc:           defaultWriteBatchFunc,
+		ServerWriteBatchFunc:           defaultWriteBatchFunc,
+		clientReadChan:                 make(chan *Packet, kPacketQueueSize),
+		clientWriteChan:                make(chan *Packet, kPacketQueueSize),
+		serverReadChan:                 make(chan *Packet, kPacketQueueSize),
+		serverWriteChan:                make(chan *Packet, kPacketQueueSize),
+		clientReadHandshakeChan:        make(chan *Packet, kHandshakeQueueSize),
+		clientWriteHandshakeChan:       make(chan *Packet, kHandshakeQueueSize),
+		serverReadHandshakeChan:        make(chan *Packet, kHandshakeQueueSize),
+		serverWriteHandshakeChan:       make(chan *Packet, kHandshakeQueueSize),
+		upstreamConns:                  make(map[netip.AddrPort]*upstreamConn),
+		pinnedUpstreams:                make(map[NoisePublicKey]*pinnedUpstream),
+		fallbackSessions:               make(map[netip.AddrPort]*fallbackSession),
+		Timeout:                        defaultTimeout,
+		ForwardTableShards:             defaultForwardTableShards,
+		clientMap:                      newPeerMap(defaultForwardTableShards),
+		serverMap:                      newPeerMap(defaultForwardTableShards),
+		latestPeers:                    make(map[NoisePublicKey]*Peer),
+		accounts:                       make(map[NoisePublicKey]*peerAccount),
 		UpdateAllServerDestinationChan: make(chan *net.UDPAddr),
 		MaxPacketSize:                  defaultMaxPacketSize,
+		closeChan:                      make(chan struct{}),
+		doneChan:                       make(chan struct{}),
+		timeoutUpdateChan:              make(chan time.Duration, 1),
+		closeGracePeriod:               kCloseGracePeriod,
+		Logger:                         defaultLogger,
+	}
+	table.ctx, table.cancel = context.WithCancel(context.Background())
+	table.packetPool = NewPacketPool(table.MaxPacketSize)
+	table.uniformDecoyMessage = newUniformDecoyMessage()
+	return
+}
+
+// logPacketf logs a message triggered by a single packet, which is rate-limited
+// since the packets might be sent by anyone. The messages of the same level and format are limited together,
+// and the number of the suppressed ones is counted as the SuppressedLogs, and logged every kPacketLogSummaryInterval.
+func (t *WireGuardIndexTranslationTable) logPacketf(level LogLevel, format string, args ...interface{}) {
+	t.logRateLimitedf(nil, level, format, args...)
+}
+
+// logPeerPacketf is logPacketf for the packets of a known peer.
+func (t *WireGuardIndexTranslationTable) logPeerPacketf(peer *Peer, level LogLevel, format string, args ...interface{}) {
+	t.logRateLimitedf(peer, level, format, args...)
+}
+
+func (t *WireGuardIndexTranslationTable) logRateLimitedf(peer *Peer, level LogLevel, format string, args ...interface{}) {
+	allowed, suppressed := t.packetLogLimiter.allow(logCategory{level: level, format: format}, time.Now())
+	if !allowed {
+		atomic.AddUint64(&t.stats.suppressedLogs, 1)
+		return
 	}
-	table.packetPool.New = func() interface{} {
-		return &Packet{
-			Data: make([]byte, table.MaxPacketSize),
+	if suppressed > 0 {
+		format += " (%d similar messages suppressed)"
+		args = append(args, suppressed)
+	}
+	logger := t.Logger
+	if peer != nil {
+		logger = t.peerLogger(peer)
+	}
+	logf(logger, level, format, args...)
+}
+
+// packetLogSummaryLoop logs the number of the suppressed per-packet messages until the table is closed.
+func (t *WireGuardIndexTranslationTable) packetLogSummaryLoop() {
+	defer t.loopWaitGroup.Done()
+	ticker := time.NewTicker(kPacketLogSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.logSuppressedSummary(kPacketLogSummaryInterval)
+		case <-t.closeChan:
+			return
 		}
 	}
-	return
+}
+
+// logSuppressedSummary logs the number of the per-packet messages suppressed and not reported yet of each category.
+func (t *WireGuardIndexTranslationTable) logSuppressedSummary(interval time.Duration) {
+	suppressed := t.packetLogLimiter.takeSuppressed()
+	categories := make([]logCategory, 0, len(suppressed))
+	for category := range suppressed {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].level != categories[j].level {
+			return categories[i].level > categories[j].level
+		}
+		return categories[i].format < categories[j].format
+	})
+	for _, category := range categories {
+		logf(t.Logger, category.level, "suppressed %d similar messages in the last %s: %q", suppressed[category], interval, category.format)
+	}
+}
+
+// peerLogger returns the Logger with the fields of the peer attached.
+func (t *WireGuardIndexTranslationTable) peerLogger(peer *Peer) Logger {
+	fl, ok := t.Logger.(FieldLogger)
+	if !ok {
+		return t.Logger
+	}
+	return fl.WithFields(peer.logFields()...)
 }
 
 func (t *WireGuardIndexTranslationTable) Serve() (err error) {
-	cerr := t.CacheJar.LoadLocked(t.serverMap, t.clientMap)
-	if cerr != nil {
-		log.Printf("[warn] forward table cache not loaded: %s\n", cerr.Error())
+	if !atomic.CompareAndSwapInt32(&t.serving, 0, 1) {
+		err = fmt.Errorf("table is already served")
+		return
 	}
+	defer close(t.doneChan)
 
-	t.clientConn, err = net.ListenUDP("udp", t.ClientListen)
+	if t.isClosed() {
+		t.closeExtraClientTransports()
+		return
+	}
+
+	// the MaxPacketSize might be changed after the table created
+	t.packetPool = NewPacketPool(t.MaxPacketSize)
+
+	err = t.loadAccounting()
 	if err != nil {
-		err = fmt.Errorf("failed to listen on client addr %s: %w", t.ClientListen, err)
+		t.closeExtraClientTransports()
+		err = categorize(ErrConfig, err)
 		return
 	}
-	t.serverConn, err = net.ListenUDP("udp", t.ServerListen)
+
+	t.CacheJar.logger = t.Logger
+	t.CacheJar.timeout = t.Timeout
+	t.CacheJar.upstreamLocalPort = t.upstreamLocalPortOf
+	t.mapLock.Lock()
+	t.clientMap.reshardLocked(t.ForwardTableShards)
+	t.serverMap.reshardLocked(t.ForwardTableShards)
+	cachedServerMap := make(map[uint32]*Peer)
+	cachedClientMap := make(map[uint32]*Peer)
+	cerr := t.CacheJar.LoadLocked(cachedServerMap, cachedClientMap)
+	if cerr != nil {
+		t.Logger.Warnf("forward table cache not loaded: %s", cerr.Error())
+	}
+	for index, peer := range cachedClientMap {
+		t.clientMap.storeLocked(index, peer)
+	}
+	for index, peer := range cachedServerMap {
+		t.serverMap.storeLocked(index, peer)
+		peer.account = t.accountOf(peer.clientPublicKey)
+		peer.clientCookieGenerator = t.cookieGeneratorOf(peer.account, peer.serverPublicKey)
+		latest := t.latestPeers[peer.clientPublicKey]
+		if latest == nil || latest.lastActiveTime().Before(peer.lastActiveTime()) {
+			t.latestPeers[peer.clientPublicKey] = peer
+		}
+	}
+	t.mapLock.Unlock()
+
+	listeners, err := t.listenPacket()
 	if err != nil {
-		err = fmt.Errorf("failed to listen on server addr %s: %w", t.ServerListen, err)
+		t.closeExtraClientTransports()
+		err = errorf(ErrNetwork, "failed to listen on client addr %s: %w", t.clientListenString(), err)
 		return
 	}
-	t.expireChan = time.Tick(t.Timeout)
+	t.setClientListeners(listeners)
+	t.clientTransports = nil
+	for _, listener := range listeners {
+		t.clientTransports = append(t.clientTransports, listener.transports...)
+	}
+	t.clientTransports = append(t.clientTransports, t.ExtraClientTransports...)
+	t.clientTransport = t.clientTransports[0]
+	if t.ListenedFunc != nil {
+		err = t.ListenedFunc()
+		if err != nil {
+			t.closeClientTransports()
+			return
+		}
+	}
+	t.enableClientUDPOffload(t.clientTransports)
+	t.enableTOSPreservation(t.clientTransports...)
+	t.setActiveTimeout(t.Timeout)
+	t.expireTicker = time.NewTicker(t.cleanupInterval(t.Timeout))
+	defer t.expireTicker.Stop()
+	t.expireChan = t.expireTicker.C
+	t.loopWaitGroup.Add(1 + len(t.clientTransports))
 	go t.writeLoop()
-	go t.serverReadLoop()
-	go t.clientReadLoop()
+	if t.NATKeepalive > 0 {
+		t.loopWaitGroup.Add(1)
+		go t.natKeepaliveLoop()
+	}
+	if t.UpstreamHealthInterval > 0 {
+		t.loopWaitGroup.Add(1)
+		go t.upstreamHealthLoop()
+	}
+	t.loopWaitGroup.Add(1)
+	go t.packetLogSummaryLoop()
+	if t.AccountingFile != "" {
+		t.loopWaitGroup.Add(1)
+		go t.accountingLoop()
+	}
+	if t.OnSessionCreated != nil || t.OnSessionExpired != nil {
+		t.sessionEvents = make(chan sessionEvent, kSessionEventQueueSize)
+		t.loopWaitGroup.Add(1)
+		go t.sessionHookLoop()
+	}
+	t.restoreUpstreamConns(t.CacheJar.upstreamLocalPorts)
+	for _, transport := range t.clientTransports {
+		go t.clientReadLoop(transport)
+	}
 	t.mainLoop()
+
+	// mainLoop only returns after Close() is called
+	t.closeClientTransports()
+	t.closeUpstreamConns()
+	t.closeFallbackSessions()
+	t.handlerWaitGroup.Wait()
+	t.waitBackground()
+	if !t.waitLoops(t.closeGracePeriod) {
+		t.Logger.Warnf("some loops did not exit in %s after the transports are closed, leaving them behind", t.closeGracePeriod)
+	}
+	t.drain()
+	if aerr := t.saveAccounting(); aerr != nil {
+		t.Logger.Errorf("%s", aerr.Error())
+	}
+	err = t.closeErr
 	return
 }
 
-func (t *WireGuardIndexTranslationTable) clientReadLoop() {
-	for {
-		packet := t.obtainPacket()
-		err := t.ClientReadFromUDPFunc(t.clientConn, packet)
+// Close stops a running Serve(), and waits for it to release the sockets and
+// all in-flight goroutines. It is safe to be called more than once.
+func (t *WireGuardIndexTranslationTable) Close() (err error) {
+	t.closeWithError(nil)
+	if atomic.LoadInt32(&t.serving) != 0 {
+		<-t.doneChan
+	}
+	return
+}
+
+// closeWithError stops Serve() without waiting, the Serve() will return the err.
+func (t *WireGuardIndexTranslationTable) closeWithError(err error) {
+	t.closeOnce.Do(func() {
+		t.closeErr = err
+		close(t.closeChan)
+		t.cancel()
+	})
+}
+
+func (t *WireGuardIndexTranslationTable) isClosed() bool {
+	select {
+	case <-t.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain saves the forward table into the cache and then purges it.
+func (t *WireGuardIndexTranslationTable) drain() {
+	t.mapLock.Lock()
+	defer t.mapLock.Unlock()
+
+	t.saveForwardTableCacheLocked()
+	t.clientMap.clearLocked()
+	t.serverMap.clearLocked()
+	t.latestPeers = make(map[NoisePublicKey]*Peer)
+}
+
+func (t *WireGuardIndexTranslationTable) closeClientTransports() {
+	for _, transport := range t.clientTransports {
+		_ = transport.Close()
+	}
+}
+
+func (t *WireGuardIndexTranslationTable) closeExtraClientTransports() {
+	for _, transport := range t.ExtraClientTransports {
+		_ = transport.Close()
+	}
+}
+
+func (t *WireGuardIndexTranslationTable) clientReadLoop(transport PacketTransport) {
+	defer t.loopWaitGroup.Done()
+	readFunc, readBatchFunc := t.ClientReadFunc, t.ClientReadBatchFunc
+	if listener := t.clientListenerOf(transport); listener != nil {
+		readFunc = func(transport PacketTransport, packet *Packet) (err error) {
+			err = t.ClientReadFunc(transport, packet)
+			if err == nil {
+				listener.countReceived([]*Packet{packet})
+			}
+			return
+		}
+		readBatchFunc = func(transport PacketTransport, packets []*Packet) (n int, err error) {
+			n, err = t.ClientReadBatchFunc(transport, packets)
+			if err == nil {
+				listener.countReceived(packets[:n])
+			}
+			return
+		}
+	}
+	if batchSize := normalizeBatchSize(t.BatchSize); batchSize > 1 {
+		t.readBatchLoop("client", transport, readBatchFunc, batchSize, t.clientReadChan, nil)
+		return
+	}
+	t.readLoop("client", transport, readFunc, t.clientReadChan, nil)
+}
+
+func (t *WireGuardIndexTranslationTable) readLoop(side string, transport PacketTransport,
+	readFunc func(transport PacketTransport, packet *Packet) (err error), ch chan<- *Packet, upstream *upstreamConn) {
+	readBatchFunc := func(transport PacketTransport, packets []*Packet) (n int, err error) {
+		err = readFunc(transport, packets[0])
 		if err != nil {
-			log.Printf("[error] failed to read from client conn: %s\n", err.Error())
-			t.recyclePacket(packet)
-			continue
+			return
 		}
-		t.clientReadChan <- packet
+		n = 1
+		return
 	}
+	t.readBatchLoop(side, transport, readBatchFunc, 1, ch, upstream)
 }
 
-func (t *WireGuardIndexTranslationTable) serverReadLoop() {
+// readBatchLoop reads the transport until the table is closed,
+// the upstream is nil for the listening transports facing the clients.
+func (t *WireGuardIndexTranslationTable) readBatchLoop(side string, transport PacketTransport,
+	readBatchFunc func(transport PacketTransport, packets []*Packet) (n int, err error), batchSize int, ch chan<- *Packet,
+	upstream *upstreamConn) {
+	packets := make([]*Packet, batchSize)
+	defer func() {
+		for _, packet := range packets {
+			if packet != nil {
+				t.recyclePacket(packet)
+			}
+		}
+	}()
+
+	sampler := latencySampler{rate: t.LatencySampleRate}
+	var consecutiveErrors int
+	backoff := readErrorBackoffMin
 	for {
-		packet := t.obtainPacket()
-		err := t.ServerReadFromUDPFunc(t.serverConn, packet)
-		if err != nil {
-			log.Printf("[error] failed to read from server conn: %s\n", err.Error())
-			t.recyclePacket(packet)
+		for i := range packets {
+			if packets[i] == nil {
+				packets[i] = t.obtainPacket()
+			}
+		}
+		n, err := t.readBatchSafely(side, transport, readBatchFunc, packets)
+		if err == nil {
+			consecutiveErrors = 0
+			backoff = readErrorBackoffMin
+			if upstream != nil && n > 0 {
+				upstream.received()
+			}
+			sampler.sample(packets[:n])
+			for i := 0; i < n; i++ {
+				packet := packets[i]
+				packets[i] = nil
+				if !t.receivePacket(side, transport, packet, ch, upstream) {
+					return
+				}
+			}
 			continue
 		}
-		t.serverReadChan <- packet
+		for _, packet := range packets {
+			packet.Reset()
+		}
+		if t.isClosed() {
+			return
+		}
+		if upstream != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// closed by closeIdleUpstreamConns() or closeUpstreamConnsOf()
+				return
+			}
+			if isConnRefusedError(err) {
+				t.handleUpstreamUnreachable(upstream.addr, err)
+				continue
+			}
+		}
+
+		atomic.AddUint64(&t.stats.readErrors, 1)
+		consecutiveErrors++
+		switch classifyReadError(err) {
+		case readErrorFatal:
+			t.closeWithError(errorf(ErrNetwork, "unrecoverable error on %s conn: %w", side, err))
+			return
+		case readErrorTransient:
+			t.logPacketf(LogLevelDebug, "transient error on %s conn, retry in %s: %s", side, backoff, err.Error())
+		default:
+			t.logPacketf(LogLevelError, "failed to read from %s conn: %s", side, err.Error())
+		}
+		if consecutiveErrors >= kReadErrorMaxConsecutive {
+			t.closeWithError(errorf(ErrNetwork, "too many consecutive errors on %s conn, last error: %w", side, err))
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-t.closeChan:
+			return
+		}
+		backoff *= 2
+		if backoff > readErrorBackoffMax {
+			backoff = readErrorBackoffMax
+		}
+	}
+}
+
+// receivePacket passes the packet read from the transport to the ch unless it is consumed or dropped,
+// and returns false if the table is closed.
+func (t *WireGuardIndexTranslationTable) receivePacket(side string, transport PacketTransport, packet *Packet,
+	ch chan<- *Packet, upstream *upstreamConn) (ok bool) {
+	ok = true
+	defer t.recoverPacketPanic(side, packet)
+	if packet.isOversized() {
+		atomic.AddUint64(&t.stats.oversizedPackets, 1)
+		t.logPacketf(LogLevelDebug, "dropped oversized packet from %s conn: larger than the max_packet_size %d", side, len(packet.Data))
+		if upstream == nil {
+			t.uniformDecoy()
+		}
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+		return
+	}
+	if t.isControlPacket(transport, packet) {
+		t.recyclePacket(packet)
+		return
+	}
+	if packet.Flags&PacketFlagDropped != 0 && !(upstream == nil && t.shouldFallback(packet)) {
+		if upstream == nil && packet.Flags&PacketFlagInvalid != 0 {
+			t.countProbeFailure(packet)
+		}
+		if upstream == nil && packet.Flags&PacketFlagBlocked == 0 {
+			t.uniformDecoy()
+		}
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+		return
+	}
+	packet.transport = transport
+	if packet.receivedLength == 0 {
+		packet.receivedLength = packet.Length
+	}
+	ok = t.sendReceivedPacket(ch, packet)
+	return
+}
+
+// isControlPacket passes the packet to the ControlPacketFunc unless it is deobfuscated or a plain WireGuard packet,
+// and reports whether it is consumed.
+func (t *WireGuardIndexTranslationTable) isControlPacket(transport PacketTransport, packet *Packet) bool {
+	if t.ControlPacketFunc == nil || packet.Flags&PacketFlagDeobfuscatedAfterReceived != 0 || isPlainWireGuardPacket(packet) {
+		return false
 	}
+	return t.ControlPacketFunc(transport, packet)
 }
 
 func (t *WireGuardIndexTranslationTable) writeLoop() {
+	defer t.loopWaitGroup.Done()
+	if batchSize := normalizeBatchSize(t.BatchSize); batchSize > 1 {
+		t.writeBatchLoop(batchSize)
+		return
+	}
 	for {
+		// the handshakes first, see "Handshake Priority"
+		if packet, s2c := receiveHandshake(t.clientWriteHandshakeChan, t.serverWriteHandshakeChan); packet != nil {
+			if s2c {
+				t.writeServerPacket(packet)
+			} else {
+				t.writeClientPacket(packet)
+			}
+			continue
+		}
 		select {
+		case packet := <-t.clientWriteHandshakeChan:
+			t.writeClientPacket(packet)
+		case packet := <-t.serverWriteHandshakeChan:
+			t.writeServerPacket(packet)
 		case packet := <-t.clientWriteChan:
-			err := t.ClientWriteToUDPFunc(t.clientConn, packet)
-			if err != nil {
-				log.Printf("[error] failed to write to client conn dest=%s: %s\n", packet.Destination.String(), err.Error())
-			}
-			t.recyclePacket(packet)
+			t.writeClientPacket(packet)
 		case packet := <-t.serverWriteChan:
-			err := t.ServerWriteToUDPFunc(t.serverConn, packet)
-			if err != nil {
-				log.Printf("[error] failed to write to server conn dest=%s: %s\n", packet.Destination.String(), err.Error())
+			t.writeServerPacket(packet)
+		case <-t.closeChan:
+			return
+		}
+	}
+}
+
+// writeClientPacket writes the packet to the client and recycles it.
+func (t *WireGuardIndexTranslationTable) writeClientPacket(packet *Packet) {
+	transport := packet.transport
+	if transport == nil {
+		transport = t.clientTransport
+	}
+	err := t.writeSafely("client", t.ClientWriteFunc, transport, packet)
+	if err != nil {
+		atomic.AddUint64(&t.stats.writeErrors, 1)
+		t.logPacketf(LogLevelError, "failed to write to client conn dest=%s: %s", packet.Destination.String(), err.Error())
+	} else {
+		t.observeLatency(packet, true)
+		t.traceWritten(packet, true)
+		if listener := t.clientListenerOf(transport); listener != nil {
+			listener.countSent([]*Packet{packet})
+		}
+	}
+	t.recyclePacket(packet)
+}
+
+// writeServerPacket writes the packet to the server and recycles it.
+func (t *WireGuardIndexTranslationTable) writeServerPacket(packet *Packet) {
+	snapshots := t.savePathMTUSnapshots(packet)
+	err := t.writeSafely("server", t.ServerWriteFunc, packet.transport, packet)
+	if err != nil && snapshots != nil {
+		err = t.retryPathMTU(&snapshots[0], err)
+	}
+	t.countUpstreamWriteResult(packet.upstream, err)
+	if err != nil {
+		if isConnRefusedError(err) {
+			t.handleUpstreamUnreachable(upstreamKey(packet.Destination), err)
+		} else {
+			atomic.AddUint64(&t.stats.writeErrors, 1)
+			t.logPacketf(LogLevelError, "failed to write to server conn dest=%s: %s", packet.Destination.String(), err.Error())
+		}
+	} else {
+		t.observeLatency(packet, false)
+		t.traceWritten(packet, false)
+	}
+	t.recyclePacket(packet)
+}
+
+func (t *WireGuardIndexTranslationTable) writeBatchLoop(batchSize int) {
+	batch := make([]*Packet, 0, batchSize)
+	writeClient := func(first *Packet, ch <-chan *Packet) {
+		batch = collectPacketBatch(batch, first, ch)
+		t.writeBatch("client", t.clientTransport, t.ClientWriteBatchFunc, batch)
+	}
+	writeServer := func(first *Packet, ch <-chan *Packet) {
+		batch = collectPacketBatch(batch, first, ch)
+		t.writeBatch("server", nil, t.ServerWriteBatchFunc, batch)
+	}
+	for {
+		// the handshakes first, see "Handshake Priority"
+		if packet, s2c := receiveHandshake(t.clientWriteHandshakeChan, t.serverWriteHandshakeChan); packet != nil {
+			if s2c {
+				writeServer(packet, t.serverWriteHandshakeChan)
+			} else {
+				writeClient(packet, t.clientWriteHandshakeChan)
 			}
-			t.recyclePacket(packet)
+		} else {
+			select {
+			case packet := <-t.clientWriteHandshakeChan:
+				writeClient(packet, t.clientWriteHandshakeChan)
+			case packet := <-t.serverWriteHandshakeChan:
+				writeServer(packet, t.serverWriteHandshakeChan)
+			case packet := <-t.clientWriteChan:
+				writeClient(packet, t.clientWriteChan)
+			case packet := <-t.serverWriteChan:
+				writeServer(packet, t.serverWriteChan)
+			case <-t.closeChan:
+				return
+			}
+		}
+		for i := range batch {
+			batch[i] = nil
 		}
 	}
 }
 
+// collectPacketBatch fills the batch with first and the packets already in ch, without blocking.
+func collectPacketBatch(batch []*Packet, first *Packet, ch <-chan *Packet) []*Packet {
+	batch = append(batch[:0], first)
+	for len(batch) < cap(batch) {
+		select {
+		case packet := <-ch:
+			batch = append(batch, packet)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch writes the batch and recycles the packets,
+// the consecutive packets sent to the same transport are written with a single writeBatchFunc call.
+// The defaultTransport is used for the packets without transport, it is nil for the server side since
+// the packets to server always have their upstreamConn (or fallbackSession).
+func (t *WireGuardIndexTranslationTable) writeBatch(side string, defaultTransport PacketTransport,
+	writeBatchFunc func(transport PacketTransport, packets []*Packet) (failed int, err error), batch []*Packet) {
+	transportOf := func(packet *Packet) PacketTransport {
+		if packet.transport != nil {
+			return packet.transport
+		}
+		return defaultTransport
+	}
+	for start := 0; start < len(batch); {
+		transport := transportOf(batch[start])
+		end := start + 1
+		for end < len(batch) && transportOf(batch[end]) == transport {
+			end++
+		}
+		var snapshots []pathMTUSnapshot
+		if defaultTransport == nil {
+			snapshots = t.savePathMTUSnapshots(batch[start:end]...)
+		}
+		failed, err := t.writeBatchSafely(side, writeBatchFunc, transport, batch[start:end])
+		if err != nil && snapshots != nil {
+			failed, err = t.retryPathMTUBatch(snapshots, failed, err)
+		}
+		for _, packet := range batch[start:end] {
+			if packet.writeFailed {
+				continue
+			}
+			t.observeLatency(packet, defaultTransport != nil)
+			t.traceWritten(packet, defaultTransport != nil)
+		}
+		if defaultTransport != nil {
+			if listener := t.clientListenerOf(transport); listener != nil {
+				listener.countSent(batch[start:end])
+			}
+		}
+		t.countUpstreamWriteResult(batch[start].upstream, err)
+		if err != nil && defaultTransport == nil && isConnRefusedError(err) {
+			t.handleUpstreamUnreachable(upstreamKey(batch[start].Destination), err)
+		} else if err != nil {
+			atomic.AddUint64(&t.stats.writeErrors, uint64(failed))
+			t.logPacketf(LogLevelError, "failed to write %d of %d packets to %s conn: %s", failed, end-start, side, err.Error())
+		}
+		start = end
+	}
+	for _, packet := range batch {
+		t.recyclePacket(packet)
+	}
+}
+
 func (t *WireGuardIndexTranslationTable) mainLoop() {
 	for {
-		select {
-		case packet := <-t.clientReadChan:
-			if packet.MessageType() == device.MessageTransportType {
-				t.handleClientPacket(packet)
+		// the handshakes first, see "Handshake Priority"
+		if packet, s2c := receiveHandshake(t.clientReadHandshakeChan, t.serverReadHandshakeChan); packet != nil {
+			if s2c {
+				t.dispatchServerPacket(packet)
 			} else {
-				go t.handleClientPacket(packet)
+				t.dispatchClientPacket(packet)
 			}
+			continue
+		}
+		select {
+		case packet := <-t.clientReadHandshakeChan:
+			t.dispatchClientPacket(packet)
+		case packet := <-t.serverReadHandshakeChan:
+			t.dispatchServerPacket(packet)
+		case packet := <-t.clientReadChan:
+			t.dispatchClientPacket(packet)
 		case packet := <-t.serverReadChan:
-			if packet.MessageType() == device.MessageTransportType {
-				t.handleServerPacket(packet)
-			} else {
-				go t.handleServerPacket(packet)
-			}
+			t.dispatchServerPacket(packet)
 		case current := <-t.expireChan:
 			t.handlePeersExpireCheck(current)
+		case timeout := <-t.timeoutUpdateChan:
+			t.Timeout = timeout
+			t.setActiveTimeout(timeout)
+			t.expireTicker.Reset(t.cleanupInterval(timeout))
 		case newServerAddr := <-t.UpdateAllServerDestinationChan:
 			t.handleAllServerDestinationUpdate(newServerAddr)
+		case <-t.closeChan:
+			return
 		}
 	}
 }
 
+// dispatchClientPacket handles the packet from client in the main loop,
+// or in a new goroutine for the handshakes which are slow to be handled.
+func (t *WireGuardIndexTranslationTable) dispatchClientPacket(packet *Packet) {
+	defer t.recoverPacketPanic("client", packet)
+	if !t.allowSource(packet) || !t.validateClientPacket(packet) {
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+		return
+	}
+	if !t.filterClientPacket(packet) {
+		return
+	}
+	if t.shouldFallback(packet) {
+		t.handleFallbackClientPacket(packet)
+	} else if t.isDrainRelayed(packet) {
+		t.relayClientPacket(packet, true)
+	} else if isNATKeepalive(packet) {
+		t.handleNATKeepalive(packet)
+	} else if packet.MessageType() == device.MessageTransportType {
+		t.handleClientPacket(packet)
+	} else if !t.allowClientSource(packet) {
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+	} else if !t.allowClientHandshake(packet) {
+		atomic.AddUint64(&t.stats.handshakesRateLimited, 1)
+		t.countDroppedPacket()
+		t.recyclePacket(packet)
+	} else {
+		t.handlerWaitGroup.Add(1)
+		go func() {
+			defer t.handlerWaitGroup.Done()
+			defer t.recoverPacketPanic("client", packet)
+			t.handleClientPacket(packet)
+		}()
+	}
+}
+
+// dispatchServerPacket is the dispatchClientPacket for the packet from server.
+func (t *WireGuardIndexTranslationTable) dispatchServerPacket(packet *Packet) {
+	defer t.recoverPacketPanic("server", packet)
+	if packet.MessageType() == device.MessageTransportType {
+		t.handleServerPacket(packet)
+	} else {
+		t.handlerWaitGroup.Add(1)
+		go func() {
+			defer t.handlerWaitGroup.Done()
+			defer t.recoverPacketPanic("server", packet)
+			t.handleServerPacket(packet)
+		}()
+	}
+}
+
+// allowClientHandshake checks the MessageInitiation packet from client with the HandshakeRateLimiter.
+func (t *WireGuardIndexTranslationTable) allowClientHandshake(packet *Packet) bool {
+	if t.HandshakeRateLimiter == nil || packet.MessageType() != device.MessageInitiationType {
+		return true
+	}
+	return t.HandshakeRateLimiter.Allow(packet.Source.AddrPort().Addr(), time.Now())
+}
+
 func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
 	packetForwarded := false
 	defer func() {
 		if !packetForwarded {
+			t.countDroppedPacket()
 			t.recyclePacket(packet)
 		}
 	}()
@@ -259,7 +1257,12 @@ func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
 		if err != nil {
 			break
 		}
-		peer, err = t.processClientMessageInitiation(packet.Source, &msg)
+		peer, err = t.processClientMessageInitiation(packet.Source, packet.transport, &msg)
+		if errors.Is(err, errDraining) && t.DrainForward != nil {
+			packetForwarded = true
+			t.relayClientPacket(packet, true)
+			return
+		}
 		if err != nil {
 			break
 		}
@@ -268,42 +1271,75 @@ func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
 		if packet.Flags&PacketFlagDeobfuscatedAfterReceived != 0 {
 			peer.obfuscateEnabled = true
 		}
+		t.upgradeFallbackSession(packet.Source)
 	case device.MessageTransportType:
 		peer, err = t.processMessageTransport(packet, false)
 	default:
+		t.uniformDecoy()
 		err = fmt.Errorf("unexcepted message type %d", packet.MessageType())
 	}
 	if err != nil {
-		log.Printf("[info] failed to handle type %d packet from client %s: %s\n", packet.MessageType(), packet.Source.String(), err.Error())
+		t.logPacketf(LogLevelDebug, "failed to handle type %d packet from client %s: %s", packet.MessageType(), packet.Source.String(), err.Error())
 		return
 	}
 	if peer == nil {
-		log.Panicf("[fatal] err == nil && peer == nil, there must be a bug in the code\n")
+		log.Panicf("[fatal] err == nil && peer == nil, there must be a bug in the code")
+		return
+	}
+	if !t.allowBandwidth(peer, false, packet, time.Now()) {
 		return
 	}
 	switch packet.MessageType() {
 	case device.MessageInitiationType:
 		if peer.clientOriginIndex != peer.clientProxyIndex {
 			err = packet.SetSenderIndex(peer.clientProxyIndex)
-			packet.FixMACs(&peer.clientCookieGenerator)
+			packet.FixMACs(peer.clientCookieGenerator)
+		} else {
+			peer.recordMAC1(packet)
 		}
 	case device.MessageTransportType:
 		err = packet.SetReceiverIndex(peer.serverOriginIndex)
 	}
 	if err != nil {
-		log.Printf("[error] failed to patch type %d packet from client %s: %s\n", packet.MessageType(), packet.Source.String(), err.Error())
+		t.logPeerPacketf(peer, LogLevelWarn, "failed to patch type %d packet from client %s: %s", packet.MessageType(), packet.Source.String(), err.Error())
+		return
+	}
+
+	serverDestination := peer.serverAddr()
+	upstream, err := t.upstreamConnOfPeer(peer, serverDestination)
+	if err != nil {
+		t.logPeerPacketf(peer, LogLevelError, "failed to connect to server %s: %s", serverDestination.String(), err.Error())
+		return
+	}
+	upstream.sent(packet, time.Now())
+
+	if packet.MessageType() == device.MessageInitiationType && t.PreflightFunc != nil &&
+		!t.PreflightFunc(upstream.transport, serverDestination) {
+		t.logPeerPacketf(peer, LogLevelDebug, "MessageInitiation to server %s is dropped by the preflight", serverDestination.String())
+		return
+	}
+
+	t.traceForwarded(peer, packet)
+	if !t.prependProxyProtocolHeader(peer, packet) {
 		return
 	}
 
-	packet.Destination = peer.serverDestination
-	t.serverWriteChan <- packet
+	t.countForwardedPacket(peer, false, packet.Length)
+	if packet.MessageType() == device.MessageInitiationType && peer.account != nil {
+		atomic.StoreInt64(&peer.account.lastHandshakeForwarded, time.Now().UnixNano())
+	}
+	packet.Destination = serverDestination
+	packet.transport = upstream.transport
+	packet.upstream = upstream
 	packetForwarded = true
+	t.sendPacket(t.serverWriteChan, packet)
 }
 
 func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 	packetForwarded := false
 	defer func() {
 		if !packetForwarded {
+			t.countDroppedPacket()
 			t.recyclePacket(packet)
 		}
 	}()
@@ -340,11 +1376,14 @@ func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 		err = fmt.Errorf("unexcepted message type %d", packet.MessageType())
 	}
 	if err != nil {
-		log.Printf("[info] failed to handle type %d packet from server %s: %s\n", packet.MessageType(), packet.Source.String(), err.Error())
+		t.logPacketf(LogLevelDebug, "failed to handle type %d packet from server %s: %s", packet.MessageType(), packet.Source.String(), err.Error())
 		return
 	}
 	if peer == nil {
-		log.Panicf("[fatal] err == nil && peer == nil, there must be a bug in the code\n")
+		log.Panicf("[fatal] err == nil && peer == nil, there must be a bug in the code")
+		return
+	}
+	if !t.allowBandwidth(peer, true, packet, time.Now()) {
 		return
 	}
 	switch packet.MessageType() {
@@ -366,7 +1405,7 @@ func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 		err = packet.SetReceiverIndex(peer.clientOriginIndex)
 	}
 	if err != nil {
-		log.Printf("[error] failed to patch type %d packet from server %s: %s\n", packet.MessageType(), packet.Source.String(), err.Error())
+		t.logPeerPacketf(peer, LogLevelWarn, "failed to patch type %d packet from server %s: %s", packet.MessageType(), packet.Source.String(), err.Error())
 		return
 	}
 
@@ -375,45 +1414,80 @@ func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 		packet.Flags |= PacketFlagObfuscateBeforeSend
 	}
 
-	packet.Destination = peer.clientDestination
-	t.clientWriteChan <- packet
+	t.traceForwarded(peer, packet)
+	t.countForwardedPacket(peer, true, packet.Length)
+	packet.Destination, packet.transport = peer.clientEndpoint()
 	packetForwarded = true
+	t.sendPacket(t.clientWriteChan, packet)
 }
 
-func (t *WireGuardIndexTranslationTable) processClientMessageInitiation(src *net.UDPAddr, msg *device.MessageInitiation) (peer *Peer, err error) {
+func (t *WireGuardIndexTranslationTable) processClientMessageInitiation(src *net.UDPAddr, transport PacketTransport, msg *device.MessageInitiation) (peer *Peer, err error) {
 	// the MessageInitiation is the only message we can decrypt.
 	sp, err := t.ExtractPeerFunc(msg)
 	if err != nil {
 		return
 	}
 	if sp == nil {
-		log.Panicf("[fatal] ExtractPeerFunc must return a non-nil sp when err == nil\n")
+		log.Panicf("[fatal] ExtractPeerFunc must return a non-nil sp when err == nil")
 		return
 	}
 
 	peer = &Peer{}
 
 	peer.clientPublicKey = *sp.ClientPublicKey
-	peer.clientCookieGenerator.Init(sp.serverPublicKey.NoisePublicKey)
 	peer.serverPublicKey = sp.serverPublicKey
 	peer.serverCookieGenerator.Init(sp.ClientPublicKey.NoisePublicKey)
 
 	peer.clientOriginIndex = msg.Sender
-	peer.clientDestination = src
+	peer.clientDestination = cloneUDPAddr(src)
+	peer.clientTransport = transport
 
 	peer.serverDestination = sp.forwardToAddress
 	peer.clientSourceValidateLevel = sp.ClientSourceValidateLevel
+	peer.upstreamPortMin, peer.upstreamPortMax = sp.upstreamPortMin, sp.upstreamPortMax
+	peer.bandwidth = sp.bandwidth
+	peer.sendProxyProtocol = sp.SendProxyProtocol
+	if peer.sendProxyProtocol {
+		peer.proxyProtocolSource = src.AddrPort()
+	}
+	peer.account = t.accountOf(peer.clientPublicKey)
+	peer.clientCookieGenerator = t.cookieGeneratorOf(peer.account, peer.serverPublicKey)
+	peer.sessionID = newSessionID()
 
-	peer.lastActive.Store(time.Now())
+	peer.createdAt = time.Now()
+	peer.touch(peer.createdAt)
 
 	t.mapLock.Lock()
+	if !t.acceptsClientLocked(peer.clientPublicKey) {
+		t.mapLock.Unlock()
+		atomic.AddUint64(&t.stats.handshakesDrained, 1)
+		err = errDraining
+		return
+	}
+	if !t.acceptsClientSourceLocked(src.AddrPort()) {
+		t.mapLock.Unlock()
+		atomic.AddUint64(&t.stats.clientsRejected, 1)
+		err = fmt.Errorf("too many clients, max_clients %d is reached", t.MaxClients)
+		return
+	}
+	if t.MaxSessions > 0 && t.clientMap.lenLocked() >= t.MaxSessions {
+		if t.MaxSessionsPolicy != MaxSessionsPolicyLRU {
+			t.mapLock.Unlock()
+			atomic.AddUint64(&t.stats.sessionsRejected, 1)
+			err = fmt.Errorf("forward table is full with %d peers", t.MaxSessions)
+			return
+		}
+		t.evictLeastRecentlyActivePeerLocked()
+	}
 	peer.clientProxyIndex = t.generateProxyIndexLocked(t.clientMap, peer.clientOriginIndex)
-	t.clientMap[peer.clientProxyIndex] = peer
+	t.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	t.sessionCreatedLocked(peer)
 	t.mapLock.Unlock()
+	atomic.AddUint64(&t.stats.sessionsCreated, 1)
 
-	log.Printf("[info] received message initiation from client, peer create stage #1: %s(idx:%08x->%08x) <=> %s\n",
-		peer.clientDestination.String(), peer.clientOriginIndex, peer.clientProxyIndex,
-		peer.serverDestination.String())
+	t.peerLogger(peer).Infof("received message initiation from client, peer create stage #1: %s(idx:%08x->%08x) <=> %s",
+		peer.clientAddr().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+		peer.serverAddr().String())
 
 	return
 }
@@ -432,16 +1506,23 @@ func (t *WireGuardIndexTranslationTable) processServerMessageResponse(src *net.U
 	defer t.mapLock.Unlock()
 
 	var ok bool
-	if peer, ok = t.clientMap[msg.Receiver]; ok {
-		peer.lastActive.Store(time.Now())
+	if peer, ok = t.clientMap.loadLocked(msg.Receiver); ok {
+		now := time.Now()
+		if t.isExpired(peer, now) {
+			err = fmt.Errorf("peer for clientMap[%08x] expired, referred by MessageResponse.Receiver from server %s", msg.Receiver, src.String())
+			return
+		}
+		peer.touch(now)
 		peer.serverOriginIndex = msg.Sender
 		peer.serverProxyIndex = t.generateProxyIndexLocked(t.serverMap, peer.serverOriginIndex)
-		t.serverMap[peer.serverProxyIndex] = peer
-		log.Printf("[info] received message response from server, peer create stage #2: %s(idx:%08x->%08x) <=> %s(idx:%08x->%08x)\n",
-			peer.clientDestination.String(), peer.clientOriginIndex, peer.clientProxyIndex,
-			peer.serverDestination.String(), peer.serverOriginIndex, peer.serverProxyIndex)
+		t.serverMap.storeLocked(peer.serverProxyIndex, peer)
+		atomic.StoreInt32(&t.unrepliedExpireCount, 0)
+		t.peerLogger(peer).Infof("received message response from server, peer create stage #2: %s(idx:%08x->%08x) <=> %s(idx:%08x->%08x)",
+			peer.clientAddr().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+			peer.serverAddr().String(), peer.serverOriginIndex, peer.serverProxyIndex)
+		t.roamPreviousPeerLocked(peer)
 
-		go t.persistForwardTableCache()
+		t.goBackground(t.persistForwardTableCache)
 
 		return
 	}
@@ -450,27 +1531,66 @@ func (t *WireGuardIndexTranslationTable) processServerMessageResponse(src *net.U
 	return
 }
 
+// roamPreviousPeerLocked moves the previous session of the same client to the client destination of the peer
+// which has just completed a handshake.
+//
+// A roamed client sends the new MessageInitiation from its new address, but the server keeps sending
+// with the previous session until the handshake is completed, which would go to the old address.
+// The MessageResponse proves the MessageInitiation is not replayed, since the server rejects them.
+func (t *WireGuardIndexTranslationTable) roamPreviousPeerLocked(peer *Peer) {
+	previous := t.latestPeers[peer.clientPublicKey]
+	t.latestPeers[peer.clientPublicKey] = peer
+	if previous == nil || previous == peer {
+		return
+	}
+	if current, _ := t.clientMap.loadLocked(previous.clientProxyIndex); current != previous {
+		return
+	}
+	if upstreamKey(previous.serverAddr()) != upstreamKey(peer.serverAddr()) {
+		return
+	}
+	src, transport := peer.clientEndpoint()
+	previousSrc := previous.clientAddr()
+	if previousSrc.IP.Equal(src.IP) && previousSrc.Port == src.Port {
+		return
+	}
+	if !previous.allowsClientSource(src) {
+		return
+	}
+	t.peerLogger(previous).Infof("client roamed with a new handshake (idx:%08x): %s => %s",
+		peer.clientOriginIndex, previousSrc.String(), src.String())
+	// the main loop reads and moves the previous one concurrently, see setClientEndpoint
+	previous.setClientEndpoint(cloneUDPAddr(src), transport)
+}
+
+// forgetLatestPeerLocked removes the peer from the latestPeers once it is removed from the table.
+func (t *WireGuardIndexTranslationTable) forgetLatestPeerLocked(peer *Peer) {
+	if t.latestPeers[peer.clientPublicKey] == peer {
+		delete(t.latestPeers, peer.clientPublicKey)
+	}
+}
+
 func (t *WireGuardIndexTranslationTable) processServerMessageCookieReply(src *net.UDPAddr, msg *device.MessageCookieReply) (peer *Peer, err error) {
 	if msg.Receiver == 0 {
 		err = fmt.Errorf("received message cookie_reply from server %s with impossible receiver_index=0", src.String())
 		return
 	}
 
-	var ok bool
-	t.mapLock.RLock()
-	peer, ok = t.clientMap[msg.Receiver]
-	t.mapLock.RUnlock()
+	peer, ok := t.clientMap.load(msg.Receiver)
 
 	if !ok {
 		err = fmt.Errorf("no matched peer found for clientMap[%08x], referred by MessageCookieReply.Receiver from server %s", msg.Receiver, src.String())
 		return
 	}
-
-	ok = peer.clientCookieGenerator.ConsumeReply(msg)
-	if !ok {
-		err = fmt.Errorf("failed to consume cookie reply from server %s", src.String())
+	if t.isExpired(peer, time.Now()) {
+		err = fmt.Errorf("peer for clientMap[%08x] expired, referred by MessageCookieReply.Receiver from server %s", msg.Receiver, src.String())
 		return
 	}
+
+	// the reply is passed through even if it is not consumed, the client might decrypt it by itself
+	if !peer.clientCookieGenerator.ConsumeReply(msg) {
+		t.logPeerPacketf(peer, LogLevelDebug, "failed to consume cookie reply from server %s", src.String())
+	}
 	return
 }
 
@@ -490,17 +1610,12 @@ func (t *WireGuardIndexTranslationTable) processMessageTransport(packet *Packet,
 		return
 	}
 
-	var m map[uint32]*Peer
+	m := t.serverMap
 	if s2c {
 		m = t.clientMap
-	} else {
-		m = t.serverMap
 	}
 
-	var ok bool
-	t.mapLock.RLock()
-	peer, ok = m[receiverIndex]
-	t.mapLock.RUnlock()
+	peer, ok := m.load(receiverIndex)
 
 	if !ok {
 		if s2c {
@@ -511,20 +1626,31 @@ func (t *WireGuardIndexTranslationTable) processMessageTransport(packet *Packet,
 		return
 	}
 
-	peer.lastActive.Store(time.Now())
+	// the sweep might not have removed it yet, see "Expiration"
+	now := time.Now()
+	if t.isExpired(peer, now) {
+		if s2c {
+			err = fmt.Errorf("peer for clientMap[%08x] expired, referred by packet from server %s", receiverIndex, packet.Source.String())
+		} else {
+			err = fmt.Errorf("peer for serverMap[%08x] expired, referred by packet from client %s", receiverIndex, packet.Source.String())
+		}
+		return
+	}
+	peer.touch(now)
 
 	if s2c {
 		// in case of udp out-of-order (seems not possible to happen)
 		if peer.IsServerReplied() {
-			ipChanged := !packet.Source.IP.Equal(peer.serverDestination.IP)
-			portChanged := packet.Source.Port != peer.serverDestination.Port
+			destination := peer.serverAddr()
+			ipChanged := !packet.Source.IP.Equal(destination.IP)
+			portChanged := packet.Source.Port != destination.Port
 
 			switch peer.serverSourceValidateLevel {
 			case SourceValidateLevelIP:
 				if ipChanged {
 					err = fmt.Errorf("server IP mismatch (for client %s), expected %s, got %s",
-						peer.clientDestination,
-						peer.serverDestination.IP.String(),
+						peer.clientAddr(),
+						destination.IP.String(),
 						packet.Source.IP.String())
 					return
 				}
@@ -533,54 +1659,60 @@ func (t *WireGuardIndexTranslationTable) processMessageTransport(packet *Packet,
 			case SourceValidateLevelIPAndPort:
 				if ipChanged || portChanged {
 					err = fmt.Errorf("server IP/port mismatch (for server %s), expected %s:%d, got %s:%d",
-						peer.clientDestination,
-						peer.serverDestination.IP.String(), peer.serverDestination.Port,
+						peer.clientAddr(),
+						destination.IP.String(), destination.Port,
 						packet.Source.IP.String(), packet.Source.Port)
 					return
 				}
 			}
 			if ipChanged || portChanged {
-				log.Printf("[info] allowed server reply from another source: %s => %s\n", peer.clientDestination.String(), packet.Source.String())
+				t.peerLogger(peer).Infof("allowed server reply from another source: %s => %s", peer.clientAddr().String(), packet.Source.String())
 			}
 		}
 	} else {
-		ipChanged := !packet.Source.IP.Equal(peer.clientDestination.IP)
-		portChanged := packet.Source.Port != peer.clientDestination.Port
+		destination, transport := peer.clientEndpoint()
+		ipChanged := !packet.Source.IP.Equal(destination.IP)
+		portChanged := packet.Source.Port != destination.Port
 
 		switch peer.clientSourceValidateLevel {
 		case SourceValidateLevelIP:
 			if ipChanged {
 				err = fmt.Errorf("client IP mismatch (for server %s), expected %s, got %s",
-					peer.serverDestination,
-					peer.clientDestination.IP.String(),
+					peer.serverAddr(),
+					destination.IP.String(),
 					packet.Source.IP.String())
 				return
 			}
 		case SourceValidateLevelIPAndPort:
 			if ipChanged || portChanged {
 				err = fmt.Errorf("client IP/port mismatch (for server %s), expected %s:%d, got %s:%d",
-					peer.serverDestination,
-					peer.clientDestination.IP.String(), peer.clientDestination.Port,
+					peer.serverAddr(),
+					destination.IP.String(), destination.Port,
 					packet.Source.IP.String(), packet.Source.Port)
 				return
 			}
 		}
+		var roamed *net.UDPAddr
 		if ipChanged || portChanged {
-			log.Printf("[info] allowed client romaing: %s => %s\n", peer.clientDestination.String(), packet.Source.String())
-			peer.clientDestination = packet.Source
+			t.peerLogger(peer).Infof("allowed client romaing: %s => %s", destination.String(), packet.Source.String())
+			roamed = cloneUDPAddr(packet.Source)
+		}
+		if roamed != nil || packet.transport != nil && packet.transport != transport {
+			// a handshake might move the peer concurrently, see roamPreviousPeerLocked
+			peer.setClientEndpoint(roamed, packet.transport)
 		}
 	}
 
 	return
 }
 
-func (t *WireGuardIndexTranslationTable) generateProxyIndexLocked(m map[uint32]*Peer, origin uint32) (proxy uint32) {
+func (t *WireGuardIndexTranslationTable) generateProxyIndexLocked(m *peerMap, origin uint32) (proxy uint32) {
 	if !DebugAlwaysGenerateProxyIndex {
 		proxy = origin
 	}
 
 	// proxy index also cannot be 0, since the zero-value indicates the peer is not yet initialized
-	for _, ok := m[proxy]; ok || proxy == 0; {
+	for _, ok := m.loadLocked(proxy); ok || proxy == 0; _, ok = m.loadLocked(proxy) {
 		proxy = rand.Uint32()
 	}
 	return
@@ -588,51 +1720,200 @@ func (t *WireGuardIndexTranslationTable) generateProxyIndexLocked(m map[uint32]*
 
 func (t *WireGuardIndexTranslationTable) handlePeersExpireCheck(current time.Time) {
 	defer func() {
-		go t.persistForwardTableCache()
+		t.goBackground(t.persistForwardTableCache)
 	}()
 
 	t.mapLock.Lock()
 	defer t.mapLock.Unlock()
 
-	for _, peer := range t.clientMap {
-		if peer.lastActive.Load().(time.Time).Before(current.Add(-t.Timeout)) {
-			delete(t.clientMap, peer.clientProxyIndex)
-			delete(t.serverMap, peer.serverProxyIndex)
-			log.Printf("[info] expire peer %s (idx:%08x->%08x) <=> %s (idx:%08x->%08x)\n",
-				peer.clientDestination.String(), peer.clientOriginIndex, peer.clientProxyIndex,
-				peer.serverDestination.String(), peer.serverOriginIndex, peer.serverProxyIndex)
+	// the server destinations of the remaining peers, their upstreamConns are kept
+	inUse := make(map[netip.AddrPort]struct{})
+	pinnedInUse := make(map[NoisePublicKey]struct{})
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		if !peer.lastActiveTime().Before(current.Add(-t.Timeout)) {
+			inUse[upstreamKey(peer.serverAddr())] = struct{}{}
+			if peer.upstreamPortMin != 0 {
+				pinnedInUse[peer.clientPublicKey] = struct{}{}
+			}
+			return true
+		}
+		t.clientMap.deleteLocked(peer.clientProxyIndex)
+		t.serverMap.deleteLocked(peer.serverProxyIndex)
+		t.forgetLatestPeerLocked(peer)
+		t.sessionEndedLocked(peer, SessionEndExpired)
+		atomic.AddUint64(&t.stats.sessionsExpired, 1)
+		t.peerLogger(peer).Infof("expire peer %s (idx:%08x->%08x) <=> %s (idx:%08x->%08x)",
+			peer.clientAddr().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+			peer.serverAddr().String(), peer.serverOriginIndex, peer.serverProxyIndex)
+		if !peer.IsServerReplied() {
+			t.handleUnrepliedPeerExpire()
 		}
+		return true
+	})
+	t.checkDrainedLocked()
+	t.closeIdleUpstreamConns(inUse, pinnedInUse, current.Add(-t.Timeout))
+	t.expireFallbackSessions(current.Add(-t.Timeout))
+}
+
+// evictLeastRecentlyActivePeerLocked removes the peer with the oldest last packet to make room for a new one.
+//
+// It scans the whole table, which is fine since it only happens on MessageInitiation when the table is full.
+// The upstreamConn of the peer is shared with other peers to the same server destination,
+// it is closed by the next expire check if no peer is using it.
+func (t *WireGuardIndexTranslationTable) evictLeastRecentlyActivePeerLocked() {
+	var lru *Peer
+	var lruActive int64
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		active := atomic.LoadInt64(&peer.lastActive)
+		if lru == nil || active < lruActive {
+			lru = peer
+			lruActive = active
+		}
+		return true
+	})
+	if lru == nil {
+		return
+	}
+	t.clientMap.deleteLocked(lru.clientProxyIndex)
+	if lru.IsServerReplied() {
+		t.serverMap.deleteLocked(lru.serverProxyIndex)
+	}
+	t.forgetLatestPeerLocked(lru)
+	t.sessionEndedLocked(lru, SessionEndEvicted)
+	atomic.AddUint64(&t.stats.sessionsEvicted, 1)
+	t.peerLogger(lru).Infof("forward table is full, evict the least recently active peer %s (idx:%08x->%08x) <=> %s (idx:%08x->%08x)",
+		lru.clientAddr().String(), lru.clientOriginIndex, lru.clientProxyIndex,
+		lru.serverAddr().String(), lru.serverOriginIndex, lru.serverProxyIndex)
+}
+
+// SetTimeout changes the Timeout of a running table.
+//
+// The Timeout field must not be changed directly after Serve() is called.
+func (t *WireGuardIndexTranslationTable) SetTimeout(timeout time.Duration) {
+	for {
+		select {
+		case t.timeoutUpdateChan <- timeout:
+			return
+		default:
+			// replace the one not yet consumed by the main loop
+			select {
+			case <-t.timeoutUpdateChan:
+			default:
+			}
+		}
+	}
+}
+
+// evictPeers removes all peers matched by the match func from the table,
+// so that their packets will not be forwarded anymore.
+func (t *WireGuardIndexTranslationTable) evictPeers(match func(peer *Peer) bool) (count int) {
+	count = len(t.removePeers(match, SessionEndRemoved))
+	return
+}
+
+// removePeers removes all peers matched by the match func from the table for the reason, and returns them.
+func (t *WireGuardIndexTranslationTable) removePeers(match func(peer *Peer) bool, reason string) (removed []*Peer) {
+	t.mapLock.Lock()
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		if !match(peer) {
+			return true
+		}
+		t.clientMap.deleteLocked(peer.clientProxyIndex)
+		if peer.IsServerReplied() {
+			t.serverMap.deleteLocked(peer.serverProxyIndex)
+		}
+		t.forgetLatestPeerLocked(peer)
+		t.sessionEndedLocked(peer, reason)
+		removed = append(removed, peer)
+		t.peerLogger(peer).Infof("evict peer %s (idx:%08x->%08x) <=> %s (idx:%08x->%08x)",
+			peer.clientAddr().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+			peer.serverAddr().String(), peer.serverOriginIndex, peer.serverProxyIndex)
+		return true
+	})
+	t.mapLock.Unlock()
+
+	if len(removed) > 0 {
+		t.goBackground(t.persistForwardTableCache)
+	}
+	return
+}
+
+// migratePeers moves the peers matched to the server destination addr, and returns the number of them.
+// The new server does not know the sessions, so the WireGuard clients handshake again with it.
+func (t *WireGuardIndexTranslationTable) migratePeers(match func(peer *Peer) bool, addr *net.UDPAddr) (count int) {
+	t.mapLock.Lock()
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		if !match(peer) {
+			return true
+		}
+		t.peerLogger(peer).Infof("migrate peer %s (idx:%08x->%08x) from server %s to %s",
+			peer.clientAddr().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+			peer.serverAddr().String(), addr.String())
+		peer.setServerDestination(addr)
+		count++
+		return true
+	})
+	t.mapLock.Unlock()
+
+	if count > 0 {
+		t.goBackground(t.persistForwardTableCache)
 	}
+	return
+}
+
+func (t *WireGuardIndexTranslationTable) handleUnrepliedPeerExpire() {
+	if t.ServerUnreachableFunc == nil || t.ServerUnreachableThreshold <= 0 {
+		return
+	}
+	if atomic.AddInt32(&t.unrepliedExpireCount, 1) < int32(t.ServerUnreachableThreshold) {
+		return
+	}
+	atomic.StoreInt32(&t.unrepliedExpireCount, 0)
+	t.ServerUnreachableFunc()
 }
 
 func (t *WireGuardIndexTranslationTable) handleAllServerDestinationUpdate(addr *net.UDPAddr) {
 	defer func() {
-		go t.persistForwardTableCache()
+		t.goBackground(t.persistForwardTableCache)
 	}()
 
 	t.mapLock.Lock()
 	defer t.mapLock.Unlock()
 
-	for _, peer := range t.clientMap {
-		peer.serverDestination = addr
-	}
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		peer.setServerDestination(addr)
+		return true
+	})
 }
 
 func (t *WireGuardIndexTranslationTable) persistForwardTableCache() {
 	t.mapLock.RLock()
 	defer t.mapLock.RUnlock()
 
-	err := t.CacheJar.SaveLocked(t.serverMap)
+	t.saveForwardTableCacheLocked()
+}
+
+// saveForwardTableCacheLocked saves the serverMap into the cache file if any, with the mapLock held.
+func (t *WireGuardIndexTranslationTable) saveForwardTableCacheLocked() {
+	if t.CacheJar.CacheFilePath == "" {
+		// skip copying the serverMap for nothing
+		return
+	}
+	err := t.CacheJar.SaveLocked(t.serverMap.snapshotLocked())
 	if err != nil {
-		log.Printf("[error] failed to save forward table cache: %s\n", err)
+		t.Logger.Errorf("failed to save forward table cache: %s", err)
 	}
 }
 
 func (t *WireGuardIndexTranslationTable) obtainPacket() *Packet {
-	return t.packetPool.Get().(*Packet)
+	return t.packetPool.Get()
 }
 
+// recyclePacket puts the packet back to the pool, the caller must be its owner.
+// A packet retained by the write func is left to the one retaining it.
 func (t *WireGuardIndexTranslationTable) recyclePacket(packet *Packet) {
-	packet.Reset()
+	if packet.Flags&PacketFlagRetained != 0 {
+		return
+	}
 	t.packetPool.Put(packet)
 }
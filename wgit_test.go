@@ -0,0 +1,968 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWireGuardIndexTranslationTable_ReadLoopTransientErrors(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	ch := make(chan *Packet, 1)
+
+	var reads int
+	readFunc := func(transport PacketTransport, packet *Packet) (err error) {
+		reads++
+		switch {
+		case reads <= 5:
+			err = &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}
+		case reads == 6:
+			packet.Data[0] = 4
+			packet.Length = 32
+		default:
+			<-table.closeChan
+			err = net.ErrClosed
+		}
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		table.readLoop("test", nil, readFunc, ch, nil)
+		close(done)
+	}()
+
+	select {
+	case packet := <-ch:
+		if packet.Length != 32 {
+			t.Errorf("unexpected packet length %d", packet.Length)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read loop does not survive transient errors")
+	}
+
+	table.closeWithError(nil)
+	<-done
+	if table.closeErr != nil {
+		t.Errorf("unexpected close error: %s", table.closeErr.Error())
+	}
+}
+
+func TestWireGuardIndexTranslationTable_ReadLoopFatalErrors(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	ch := make(chan *Packet, 1)
+
+	readFunc := func(transport PacketTransport, packet *Packet) (err error) {
+		err = &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.EBADF)}
+		return
+	}
+	table.readLoop("test", nil, readFunc, ch, nil)
+	if !errors.Is(table.closeErr, syscall.EBADF) {
+		t.Errorf("expected EBADF, got %v", table.closeErr)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_ReadLoopConsecutiveErrors(t *testing.T) {
+	defer func(d time.Duration) { readErrorBackoffMax = d }(readErrorBackoffMax)
+	readErrorBackoffMax = readErrorBackoffMin
+
+	table := NewWireGuardIndexTranslationTable()
+	ch := make(chan *Packet, 1)
+
+	var reads int
+	readFunc := func(transport PacketTransport, packet *Packet) (err error) {
+		reads++
+		err = errors.New("unknown error")
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		table.readLoop("test", nil, readFunc, ch, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("read loop does not bail out on consecutive errors")
+	}
+	if reads != kReadErrorMaxConsecutive {
+		t.Errorf("expected %d reads, got %d", kReadErrorMaxConsecutive, reads)
+	}
+	if table.closeErr == nil {
+		t.Errorf("expected close error")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_ClientListenWorkers(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	conns, err := listenUDPWorkers(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 4, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	if len(conns) != 4 {
+		t.Fatalf("expected 4 conns, got %d", len(conns))
+	}
+	for _, conn := range conns[1:] {
+		if conn.LocalAddr().String() != conns[0].LocalAddr().String() {
+			t.Errorf("conns bound to different addr: %s != %s", conn.LocalAddr(), conns[0].LocalAddr())
+		}
+	}
+
+	// the packet to client should be sent from the socket the client packet arrived on
+	table := NewWireGuardIndexTranslationTable()
+	defer table.closeUpstreamConns()
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000},
+		serverDestination: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000},
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+
+	packet := table.obtainPacket()
+	packet.Data[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(packet.Data[4:], peer.serverProxyIndex)
+	packet.Length = device.MessageTransportSize
+	packet.Source = peer.clientDestination
+	transport := NewUDPTransport(conns[2])
+	packet.transport = transport
+	table.handleClientPacket(packet)
+	<-table.serverWriteChan
+
+	packet = table.obtainPacket()
+	packet.Data[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(packet.Data[4:], peer.clientProxyIndex)
+	packet.Length = device.MessageTransportSize
+	packet.Source = peer.serverDestination
+	packet.transport = nil
+	table.handleServerPacket(packet)
+	packet = <-table.clientWriteChan
+	if packet.transport != transport {
+		t.Errorf("packet to client is not sent from the socket it arrived on")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_DualStackListen(t *testing.T) {
+	conns, err := listenUDPWorkers(&net.UDPAddr{}, 1, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	conn := conns[0]
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	for _, network := range []string{"udp4", "udp6"} {
+		loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+		if network == "udp6" {
+			loopback = &net.UDPAddr{IP: net.IPv6loopback, Port: port}
+		}
+		client, err := net.DialUDP(network, nil, loopback)
+		if err != nil {
+			t.Logf("skip %s: %s", network, err.Error())
+			continue
+		}
+		_, err = client.Write([]byte{device.MessageTransportType})
+		if err != nil {
+			_ = client.Close()
+			t.Logf("skip %s: %s", network, err.Error())
+			continue
+		}
+
+		var packet Packet
+		packet.Data = make([]byte, 16)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, source, err := conn.ReadFromUDPAddrPort(packet.Data)
+		if err != nil {
+			_ = client.Close()
+			t.Fatalf("%s: failed to read: %s", network, err.Error())
+		}
+		packet.setSourceAddrPort(source)
+		expected := client.LocalAddr().(*net.UDPAddr)
+		if packet.Source.String() != expected.String() {
+			t.Errorf("%s: expected source %s, got %s", network, expected, packet.Source)
+		}
+		if network == "udp4" && len(packet.Source.IP) != net.IPv4len {
+			t.Errorf("%s: source %s is not in the 4-bytes form", network, packet.Source)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestPacket_SetSourceAddrPortUnmap(t *testing.T) {
+	var packet Packet
+	packet.setSourceAddrPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:1000"))
+	if packet.Source.String() != "192.0.2.1:1000" || len(packet.Source.IP) != net.IPv4len {
+		t.Errorf("expected 192.0.2.1:1000 in the 4-bytes form, got %s", packet.Source)
+	}
+
+	// the forwarding entry created from an IPv4 source must match the same client via a dual-stack socket
+	table := NewWireGuardIndexTranslationTable()
+	defer table.closeUpstreamConns()
+	peer := &Peer{
+		clientOriginIndex:         0x11111111,
+		clientProxyIndex:          0x22222222,
+		serverOriginIndex:         0x33333333,
+		serverProxyIndex:          0x44444444,
+		clientDestination:         &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000},
+		serverDestination:         &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000},
+		clientSourceValidateLevel: SourceValidateLevelIPAndPort,
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+
+	p := table.obtainPacket()
+	p.Data[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(p.Data[4:], peer.serverProxyIndex)
+	p.Length = device.MessageTransportSize
+	p.setSourceAddrPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:1000"))
+	table.handleClientPacket(p)
+	select {
+	case p = <-table.serverWriteChan:
+		if p.Destination.String() != peer.serverDestination.String() {
+			t.Errorf("expected destination %s, got %s", peer.serverDestination, p.Destination)
+		}
+	default:
+		t.Errorf("packet from the IPv4-mapped address of the client is not forwarded")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_UpstreamUnreachable(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tableAddr := netip.MustParseAddrPort(e2eFreeUDPAddr(t))
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = net.UDPAddrFromAddrPort(tableAddr)
+	table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.Timeout = time.Minute
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: client.LocalAddr().(*net.UDPAddr),
+		serverDestination: server.LocalAddr().(*net.UDPAddr),
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	payload := make([]byte, device.MessageTransportSize)
+	payload[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(payload[4:], peer.serverProxyIndex)
+	buf := make([]byte, 1500)
+	for i := 0; ; i++ {
+		// retry until the table is listening
+		_, err = client.WriteToUDPAddrPort(payload, tableAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err = server.ReadFromUDPAddrPort(buf)
+		if err == nil {
+			break
+		}
+		if i >= 50 {
+			t.Fatalf("packet is not forwarded to server: %s", err.Error())
+		}
+	}
+
+	// the server goes away mid-session, the peer should be evicted long before the timeout
+	_ = server.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err = client.WriteToUDPAddrPort(payload, tableAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		table.mapLock.RLock()
+		_, ok := table.serverMap.loadLocked(peer.serverProxyIndex)
+		table.mapLock.RUnlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer of the unreachable server is not evicted within a second")
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_UpstreamWriteErrors(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	var reported []netip.AddrPort
+	table.UpstreamWriteErrorFunc = func(addr netip.AddrPort) {
+		reported = append(reported, addr)
+	}
+	table.UpstreamWriteErrorThreshold = 3
+	upstream := &upstreamConn{addr: netip.MustParseAddrPort("192.0.2.1:51820")}
+	writeErr := errors.New("network is unreachable")
+
+	// a successful write resets the count
+	table.countUpstreamWriteResult(upstream, writeErr)
+	table.countUpstreamWriteResult(upstream, writeErr)
+	table.countUpstreamWriteResult(upstream, nil)
+	table.countUpstreamWriteResult(upstream, writeErr)
+	table.countUpstreamWriteResult(upstream, writeErr)
+	if len(reported) != 0 {
+		t.Fatalf("reported before %d consecutive errors: %v", table.UpstreamWriteErrorThreshold, reported)
+	}
+	table.countUpstreamWriteResult(upstream, writeErr)
+	if len(reported) != 1 || reported[0] != upstream.addr {
+		t.Fatalf("expected %s reported once, got %v", upstream.addr, reported)
+	}
+	// counted again from 0 after reported
+	table.countUpstreamWriteResult(upstream, writeErr)
+	table.countUpstreamWriteResult(upstream, nil)
+	// packets sent without upstreamConn are ignored
+	table.countUpstreamWriteResult(nil, writeErr)
+	if len(reported) != 1 {
+		t.Errorf("expected reported once, got %v", reported)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_FwMark(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const fwmark = 0xca6c
+	var marksLock sync.Mutex
+	var marks []int
+	setSocketFwMarkFunc = func(fd uintptr, mark int) (err error) {
+		marksLock.Lock()
+		defer marksLock.Unlock()
+		marks = append(marks, mark)
+		return
+	}
+	defer func() { setSocketFwMarkFunc = setSocketFwMark }()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	workers := 1
+	if reusePortSupported {
+		workers = 2
+	}
+	tableAddr := netip.MustParseAddrPort(e2eFreeUDPAddr(t))
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = net.UDPAddrFromAddrPort(tableAddr)
+	table.ClientListenWorkers = workers
+	table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.FwMark = fwmark
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: client.LocalAddr().(*net.UDPAddr),
+		serverDestination: server.LocalAddr().(*net.UDPAddr),
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	payload := make([]byte, device.MessageTransportSize)
+	payload[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(payload[4:], peer.serverProxyIndex)
+	buf := make([]byte, 1500)
+	for i := 0; ; i++ {
+		// retry until the table is listening
+		_, err = client.WriteToUDPAddrPort(payload, tableAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err = server.ReadFromUDPAddrPort(buf)
+		if err == nil {
+			break
+		}
+		if i >= 50 {
+			t.Fatalf("packet is not forwarded to server: %s", err.Error())
+		}
+	}
+
+	marksLock.Lock()
+	defer marksLock.Unlock()
+	// the listening sockets and the upstream socket
+	if len(marks) != workers+1 {
+		t.Fatalf("expected SO_MARK on %d sockets, got %d", workers+1, len(marks))
+	}
+	for i, mark := range marks {
+		if mark != fwmark {
+			t.Errorf("socket #%d: expected SO_MARK %#x, got %#x", i, fwmark, mark)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_SocketBuffers(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var calls []string
+	setReadBufferFunc = func(conn *net.UDPConn, bytes int) (err error) {
+		calls = append(calls, fmt.Sprintf("read %d", bytes))
+		return
+	}
+	setWriteBufferFunc = func(conn *net.UDPConn, bytes int) (err error) {
+		calls = append(calls, fmt.Sprintf("write %d", bytes))
+		return
+	}
+	defer func() {
+		setReadBufferFunc = (*net.UDPConn).SetReadBuffer
+		setWriteBufferFunc = (*net.UDPConn).SetWriteBuffer
+	}()
+
+	var config ClientConfig
+	err := json.Unmarshal([]byte(`{"server": "127.0.0.1:1", "listen": "127.0.0.1:0", "recv_buffer": "4MiB", "send_buffer": 1048576}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientWithConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := client.wgitTable
+
+	conns, err := listenUDPWorkers(table.ClientListen, 1, table.socketControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns[0].Close()
+	table.setSocketBuffers(conns[0], "client")
+	upstream, err := table.dialUDP(conns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	expected := []string{"read 4194304", "write 1048576", "read 4194304", "write 1048576"}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected setters called with %v, got %v", expected, calls)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_MaxSessions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const maxSessions = 16
+	var clientPublicKey NoisePublicKey
+	sp := &ServerConfigPeer{
+		ClientPublicKey:  &clientPublicKey,
+		forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000},
+	}
+	newTable := func(policy string) *WireGuardIndexTranslationTable {
+		table := NewWireGuardIndexTranslationTable()
+		table.MaxSessions = maxSessions
+		table.MaxSessionsPolicy = policy
+		table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+			fi = sp
+			return
+		}
+		return table
+	}
+	initiate := func(table *WireGuardIndexTranslationTable, i int) (peer *Peer, err error) {
+		msg := device.MessageInitiation{Sender: uint32(0x1000 + i)}
+		src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000 + i}
+		return table.processClientMessageInitiation(src, nil, &msg)
+	}
+
+	t.Run("lru", func(t *testing.T) {
+		table := newTable(MaxSessionsPolicyLRU)
+		peers := make([]*Peer, 0, maxSessions+10)
+		for i := 0; i < maxSessions+10; i++ {
+			if i == maxSessions {
+				// the first peer is active again, the following ones become the least recently active
+				atomic.StoreInt64(&peers[0].lastActive, int64(maxSessions))
+			}
+			peer, err := initiate(table, i)
+			if err != nil {
+				t.Fatalf("peer %d: %s", i, err.Error())
+			}
+			atomic.StoreInt64(&peer.lastActive, int64(i))
+			peers = append(peers, peer)
+			if table.clientMap.lenLocked() > maxSessions {
+				t.Fatalf("peer %d: table size %d exceeds max_sessions %d", i, table.clientMap.lenLocked(), maxSessions)
+			}
+		}
+		for i, peer := range peers {
+			_, ok := table.clientMap.loadLocked(peer.clientProxyIndex)
+			expected := i == 0 || i > 10
+			if ok != expected {
+				t.Errorf("peer %d: expected in table %t, got %t", i, expected, ok)
+			}
+		}
+		stats := table.Stats()
+		if stats.ActiveSessions != maxSessions || stats.SessionsEvicted != 10 || stats.SessionsRejected != 0 {
+			t.Errorf("unexpected stats: active=%d evicted=%d rejected=%d",
+				stats.ActiveSessions, stats.SessionsEvicted, stats.SessionsRejected)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		table := newTable("")
+		var rejected int
+		for i := 0; i < maxSessions+10; i++ {
+			_, err := initiate(table, i)
+			if err != nil {
+				rejected++
+			}
+		}
+		stats := table.Stats()
+		if rejected != 10 || stats.ActiveSessions != maxSessions || stats.SessionsRejected != 10 || stats.SessionsEvicted != 0 {
+			t.Errorf("unexpected stats: errors=%d active=%d evicted=%d rejected=%d",
+				rejected, stats.ActiveSessions, stats.SessionsEvicted, stats.SessionsRejected)
+		}
+	})
+}
+
+func BenchmarkWireGuardIndexTranslationTable_ForwardTransport(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.MaxPacketSize = 1500
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: client.LocalAddr().(*net.UDPAddr),
+		serverDestination: server.LocalAddr().(*net.UDPAddr),
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	listened := make(chan struct{})
+	table.ListenedFunc = func() (err error) {
+		close(listened)
+		return
+	}
+	served := make(chan error, 1)
+	go func() { served <- table.Serve() }()
+	defer table.Close()
+	select {
+	case <-listened:
+	case err = <-served:
+		b.Fatalf("failed to serve: %v", err)
+	}
+	tableAddr := table.clientTransport.(*UDPTransport).Conn().LocalAddr().(*net.UDPAddr).AddrPort()
+
+	payload := make([]byte, 148)
+	payload[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(payload[4:], peer.serverProxyIndex)
+	buf := make([]byte, 1500)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = client.WriteToUDPAddrPort(payload, tableAddr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = server.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_Drain(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	_, established := e2eGenerateKey(t)
+	_, newcomer := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = time.Minute
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		clientPublicKey := established
+		if msg.Sender >= 0x2000 {
+			clientPublicKey = newcomer
+		}
+		fi = &ServerConfigPeer{
+			ClientPublicKey:  &clientPublicKey,
+			forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000},
+		}
+		return
+	}
+	handshake := func(sender uint32) (err error) {
+		src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: int(sender)}
+		peer, err := table.processClientMessageInitiation(src, nil, &device.MessageInitiation{Sender: sender})
+		if err != nil {
+			return
+		}
+		_, err = table.processServerMessageResponse(peer.serverDestination, &device.MessageResponse{Sender: sender + 1, Receiver: sender})
+		return
+	}
+
+	if err := handshake(0x1000); err != nil {
+		t.Fatal(err)
+	}
+	table.Drain()
+
+	// the established client still rekeys, but the new one is refused
+	if err := handshake(0x1100); err != nil {
+		t.Fatalf("rekey of the established client is refused: %s", err.Error())
+	}
+	if err := handshake(0x2000); !errors.Is(err, errDraining) {
+		t.Fatalf("expected the new client to be refused, got %v", err)
+	}
+	stats := table.Stats()
+	if !stats.Draining || stats.HandshakesDrained != 1 || stats.ActiveSessions != 2 {
+		t.Errorf("unexpected stats: draining=%t drained=%d active=%d", stats.Draining, stats.HandshakesDrained, stats.ActiveSessions)
+	}
+
+	// the established client is refused as well once its sessions are expired
+	table.handlePeersExpireCheck(time.Now().Add(2 * table.Timeout))
+	if atomic.LoadInt32(&table.drainState) != drainStateDrained {
+		t.Errorf("expected to be drained without any session")
+	}
+	if err := handshake(0x1200); !errors.Is(err, errDraining) {
+		t.Fatalf("expected the expired client to be refused, got %v", err)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_PacketPanic(t *testing.T) {
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tableAddr := netip.MustParseAddrPort(e2eFreeUDPAddr(t))
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = NewJSONLogger(LogLevelError, io.Discard)
+	table.ClientListen = net.UDPAddrFromAddrPort(tableAddr)
+	table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	table.Timeout = time.Minute
+	// a ReadFunc indexing the header without checking the length, the bug to be recovered from
+	table.ClientReadFunc = func(transport PacketTransport, packet *Packet) (err error) {
+		err = defaultReadFunc(transport, packet)
+		if err == nil && packet.Data[:packet.Length][3] != 0 {
+			err = fmt.Errorf("unexpected reserved byte")
+		}
+		return
+	}
+	peer := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: client.LocalAddr().(*net.UDPAddr),
+		serverDestination: server.LocalAddr().(*net.UDPAddr),
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+	go func() { _ = table.Serve() }()
+	defer table.Close()
+
+	payload := make([]byte, device.MessageTransportSize)
+	payload[0] = device.MessageTransportType
+	binary.LittleEndian.PutUint32(payload[4:], peer.serverProxyIndex)
+	buf := make([]byte, 1500)
+	forward := func() (err error) {
+		_, err = client.WriteToUDPAddrPort(payload, tableAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err = server.ReadFromUDPAddrPort(buf)
+		return
+	}
+	for i := 0; forward() != nil; i++ {
+		// retry until the table is listening
+		if i >= 50 {
+			t.Fatalf("packet is not forwarded to server")
+		}
+	}
+
+	for _, length := range []int{0, 1, 3} {
+		if _, err = client.WriteToUDPAddrPort(payload[:length], tableAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = forward(); err != nil {
+		t.Fatalf("packet is not forwarded after the short datagrams: %s", err.Error())
+	}
+	if stats := table.Stats(); stats.PacketPanics != 3 {
+		t.Errorf("expected 3 panics recovered, got %d", stats.PacketPanics)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_Oversized(t *testing.T) {
+	for _, batchSize := range []int{1, 8} {
+		t.Run(fmt.Sprintf("batch_size=%d", batchSize), func(t *testing.T) {
+			client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			table := NewWireGuardIndexTranslationTable()
+			table.Logger = &testLogger{}
+			table.ClientListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			table.ServerListen = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			table.MaxPacketSize = 600
+			table.BatchSize = batchSize
+			peer := &Peer{
+				clientOriginIndex: 0x11111111,
+				clientProxyIndex:  0x22222222,
+				serverOriginIndex: 0x33333333,
+				serverProxyIndex:  0x44444444,
+				clientDestination: client.LocalAddr().(*net.UDPAddr),
+				serverDestination: server.LocalAddr().(*net.UDPAddr),
+			}
+			peer.touch(time.Now())
+			table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+			table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+			listened := make(chan struct{})
+			table.ListenedFunc = func() (err error) {
+				close(listened)
+				return
+			}
+			served := make(chan error, 1)
+			go func() { served <- table.Serve() }()
+			defer table.Close()
+			select {
+			case <-listened:
+			case err = <-served:
+				t.Fatalf("failed to serve: %v", err)
+			}
+			tableAddr := table.clientTransport.(*UDPTransport).Conn().LocalAddr().(*net.UDPAddr).AddrPort()
+
+			send := func(length int) {
+				payload := make([]byte, length)
+				payload[0] = device.MessageTransportType
+				binary.LittleEndian.PutUint32(payload[4:], peer.serverProxyIndex)
+				if _, err := client.WriteToUDPAddrPort(payload, tableAddr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			send(601)
+			send(9000)
+			send(600)
+
+			buf := make([]byte, 65536)
+			_ = server.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := server.ReadFromUDPAddrPort(buf)
+			if err != nil || n != 600 {
+				t.Fatalf("expected the packet of the max size forwarded, got %d bytes (%v)", n, err)
+			}
+			_ = server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, _, err = server.ReadFromUDPAddrPort(buf); err == nil {
+				t.Errorf("expected the oversized packets dropped, got %d bytes forwarded", n)
+			}
+			if stats := table.Stats(); stats.OversizedPackets != 2 || stats.DroppedPackets != 2 {
+				t.Errorf("expected 2 oversized packets dropped, got %d oversized and %d dropped",
+					stats.OversizedPackets, stats.DroppedPackets)
+			}
+		})
+	}
+}
+
+func TestWireGuardIndexTranslationTable_RoamPreviousPeerConcurrently(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = &testLogger{}
+	defer table.closeUpstreamConns()
+	oldAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000}
+	newAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1001}
+	previous := &Peer{
+		clientOriginIndex: 0x11111111,
+		clientProxyIndex:  0x22222222,
+		serverOriginIndex: 0x33333333,
+		serverProxyIndex:  0x44444444,
+		clientDestination: oldAddr,
+		serverDestination: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000},
+	}
+	previous.touch(time.Now())
+	table.clientMap.storeLocked(previous.clientProxyIndex, previous)
+	table.serverMap.storeLocked(previous.serverProxyIndex, previous)
+	peer := &Peer{
+		clientOriginIndex: 0x55555555,
+		clientProxyIndex:  0x66666666,
+		clientDestination: newAddr,
+		serverDestination: previous.serverDestination,
+	}
+
+	// the handshake of the new session moves the previous one while the main loop is forwarding it
+	const rounds = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			table.mapLock.Lock()
+			table.latestPeers[peer.clientPublicKey] = previous
+			table.roamPreviousPeerLocked(peer)
+			table.mapLock.Unlock()
+		}
+	}()
+	for i := 0; i < rounds; i++ {
+		packet := table.obtainPacket()
+		packet.Data[0] = device.MessageTransportType
+		binary.LittleEndian.PutUint32(packet.Data[4:], previous.serverProxyIndex)
+		packet.Length = device.MessageTransportSize
+		packet.Source = oldAddr
+		table.handleClientPacket(packet)
+		table.recyclePacket(<-table.serverWriteChan)
+
+		packet = table.obtainPacket()
+		packet.Data[0] = device.MessageTransportType
+		binary.LittleEndian.PutUint32(packet.Data[4:], previous.clientProxyIndex)
+		packet.Length = device.MessageTransportSize
+		packet.Source = previous.serverDestination
+		table.handleServerPacket(packet)
+		packet = <-table.clientWriteChan
+		if dst := packet.Destination.String(); dst != oldAddr.String() && dst != newAddr.String() {
+			t.Fatalf("unexpected client destination %s", dst)
+		}
+		table.recyclePacket(packet)
+	}
+	<-done
+
+	table.mapLock.Lock()
+	table.latestPeers[peer.clientPublicKey] = previous
+	table.roamPreviousPeerLocked(peer)
+	table.mapLock.Unlock()
+	if dst := previous.clientAddr().String(); dst != newAddr.String() {
+		t.Errorf("expected the previous session moved to %s, got %s", newAddr, dst)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_MigratePeersConcurrently(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	table.Logger = &testLogger{}
+	defer table.closeUpstreamConns()
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000}
+	oldAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2000}
+	newAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2001}
+	peer := &Peer{
+		clientOriginIndex:         0x11111111,
+		clientProxyIndex:          0x22222222,
+		serverOriginIndex:         0x33333333,
+		serverProxyIndex:          0x44444444,
+		clientDestination:         clientAddr,
+		serverDestination:         oldAddr,
+		serverSourceValidateLevel: SourceValidateLevelIP,
+	}
+	peer.touch(time.Now())
+	table.clientMap.storeLocked(peer.clientProxyIndex, peer)
+	table.serverMap.storeLocked(peer.serverProxyIndex, peer)
+
+	// the failover of the forward_to moves the peer back and forth while the main loop is forwarding it
+	const rounds = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			addr := oldAddr
+			if i%2 == 0 {
+				addr = newAddr
+			}
+			table.migratePeers(func(peer *Peer) bool { return true }, addr)
+		}
+	}()
+	for i := 0; i < rounds; i++ {
+		packet := table.obtainPacket()
+		packet.Data[0] = device.MessageTransportType
+		binary.LittleEndian.PutUint32(packet.Data[4:], peer.serverProxyIndex)
+		packet.Length = device.MessageTransportSize
+		packet.Source = clientAddr
+		table.handleClientPacket(packet)
+		packet = <-table.serverWriteChan
+		if dst := packet.Destination.String(); dst != oldAddr.String() && dst != newAddr.String() {
+			t.Fatalf("unexpected server destination %s", dst)
+		}
+		if dst := packet.upstream.addr; dst != upstreamKey(packet.Destination) {
+			t.Fatalf("expected forwarded with the socket of %s, got %s", packet.Destination, dst)
+		}
+		table.recyclePacket(packet)
+
+		packet = table.obtainPacket()
+		packet.Data[0] = device.MessageTransportType
+		binary.LittleEndian.PutUint32(packet.Data[4:], peer.clientProxyIndex)
+		packet.Length = device.MessageTransportSize
+		packet.Source = oldAddr
+		table.handleServerPacket(packet)
+		table.recyclePacket(<-table.clientWriteChan)
+	}
+	<-done
+	table.background.waitGroup.Wait()
+
+	if dst := peer.serverAddr().String(); dst != oldAddr.String() {
+		t.Errorf("expected the peer migrated back to %s, got %s", oldAddr, dst)
+	}
+}
@@ -0,0 +1,64 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"sync/atomic"
+)
+
+// WireGuard Validation:
+//
+// With the "validate_wireguard" of mwgp-client, the packets from a new source, which has no session in the forward
+// table, are only forwarded if they are plausible WireGuard messages: the message type is 1 to 4, the reserved bytes
+// are zero, and the length is the fixed size of the handshake messages, or at least the size of an empty
+// MessageTransport. So the junk from the applications pointed at the wrong port is not relayed to mwgp-server,
+// and is dropped with a rate-limited warning instead, counted as the InvalidClientPackets.
+//
+// The packets from the sources with a session skip the check, and it is off by default,
+// for the variants of WireGuard with a non-standard wire format.
+
+// isValidWireGuardPacket reports whether the packet is a plausible WireGuard message, see "WireGuard Validation".
+func isValidWireGuardPacket(packet *Packet) bool {
+	if !isPlainWireGuardPacket(packet) {
+		return false
+	}
+	switch packet.MessageType() {
+	case device.MessageInitiationType:
+		return packet.Length == device.MessageInitiationSize
+	case device.MessageResponseType:
+		return packet.Length == device.MessageResponseSize
+	case device.MessageCookieReplyType:
+		return packet.Length == device.MessageCookieReplySize
+	default:
+		return packet.Length >= device.MessageTransportSize
+	}
+}
+
+// validateClientPacket checks the packet from client with the ValidateWireGuard,
+// the sources with a session are looked up only if the packet is invalid, which should be rare.
+func (t *WireGuardIndexTranslationTable) validateClientPacket(packet *Packet) bool {
+	if !t.ValidateWireGuard || isValidWireGuardPacket(packet) || t.hasClientSource(packet.Source.AddrPort()) {
+		return true
+	}
+	atomic.AddUint64(&t.stats.invalidClientPackets, 1)
+	t.logPacketf(LogLevelWarn, "dropped invalid WireGuard packet from new client %s (type %d, %d bytes), check the endpoint of the client",
+		packet.Source.String(), packet.MessageType(), packet.Length)
+	return false
+}
+
+// hasClientSource reports whether there is a session from the src in the forward table.
+func (t *WireGuardIndexTranslationTable) hasClientSource(src netip.AddrPort) (found bool) {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	t.mapLock.RLock()
+	defer t.mapLock.RUnlock()
+	t.clientMap.rangeLocked(func(index uint32, peer *Peer) bool {
+		destination := peer.clientAddr()
+		if destination == nil {
+			return true
+		}
+		source := destination.AddrPort()
+		found = netip.AddrPortFrom(source.Addr().Unmap(), source.Port()) == src
+		return !found
+	})
+	return
+}
@@ -0,0 +1,74 @@
+package mwgp
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsValidWireGuardPacket(t *testing.T) {
+	for _, c := range []struct {
+		header []byte
+		length int
+		valid  bool
+	}{
+		{[]byte{1, 0, 0, 0}, device.MessageInitiationSize, true},
+		{[]byte{1, 0, 0, 0}, device.MessageInitiationSize + 1, false},
+		{[]byte{2, 0, 0, 0}, device.MessageResponseSize, true},
+		{[]byte{2, 0, 0, 0}, device.MessageInitiationSize, false},
+		{[]byte{3, 0, 0, 0}, device.MessageCookieReplySize, true},
+		{[]byte{3, 0, 0, 0}, device.MessageCookieReplySize - 1, false},
+		{[]byte{4, 0, 0, 0}, device.MessageTransportSize, true},
+		{[]byte{4, 0, 0, 0}, 1420, true},
+		{[]byte{4, 0, 0, 0}, device.MessageTransportSize - 1, false},
+		{[]byte{4, 0, 1, 0}, 1420, false},
+		{[]byte{1, 0x80, 0, 0}, device.MessageInitiationSize, false},
+		{[]byte{0, 0, 0, 0}, 64, false},
+		{[]byte{5, 0, 0, 0}, 64, false},
+		{[]byte{'G', 'E', 'T', ' '}, 64, false},
+		{[]byte{4}, 1, false},
+	} {
+		packet := &Packet{Data: make([]byte, 2048), Length: c.length}
+		copy(packet.Data, c.header)
+		if isValidWireGuardPacket(packet) != c.valid {
+			t.Errorf("%x with %d bytes: expected valid: %v", c.header, c.length, c.valid)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_ValidateClientPacket(t *testing.T) {
+	_, clientPK := e2eGenerateKey(t)
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = time.Minute
+	table.Logger = NewStdLogger(LogLevelError)
+	table.ExtractPeerFunc = func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
+		fi = &ServerConfigPeer{ClientPublicKey: &clientPK, forwardToAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820}}
+		return
+	}
+	known := netip.MustParseAddrPort("127.0.0.1:1000")
+	if _, err := table.processClientMessageInitiation(net.UDPAddrFromAddrPort(known), nil, &device.MessageInitiation{Sender: 1}); err != nil {
+		t.Fatal(err)
+	}
+	newJunk := func(src netip.AddrPort) *Packet {
+		packet := table.obtainPacket()
+		packet.Length = copy(packet.Data, "GET / HTTP/1.1\r\n\r\n")
+		packet.setSourceAddrPort(src)
+		return packet
+	}
+	if !table.validateClientPacket(newJunk(netip.MustParseAddrPort("127.0.0.1:2000"))) {
+		t.Errorf("expected the packets not validated without validate_wireguard")
+	}
+
+	table.ValidateWireGuard = true
+	if !table.validateClientPacket(newJunk(known)) || !table.validateClientPacket(newJunk(netip.MustParseAddrPort("[::ffff:127.0.0.1]:1000"))) {
+		t.Errorf("expected the packets from a known source not validated")
+	}
+	for _, src := range []string{"127.0.0.1:2000", "127.0.0.2:1000", "[::1]:1000"} {
+		table.dispatchClientPacket(newJunk(netip.MustParseAddrPort(src)))
+	}
+	if stats := table.Stats(); stats.InvalidClientPackets != 3 || stats.DroppedPackets != 3 || stats.ActiveSessions != 1 {
+		t.Errorf("expected 3 invalid packets dropped, got %d of %d with %d sessions", stats.InvalidClientPackets, stats.DroppedPackets, stats.ActiveSessions)
+	}
+}